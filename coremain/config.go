@@ -32,6 +32,8 @@ type Config struct {
 	Plugins       []PluginConfig                     `yaml:"plugins"`
 	Servers       []ServerConfig                     `yaml:"servers"`
 	API           APIConfig                          `yaml:"api"`
+	Limits        LimitsConfig                       `yaml:"limits"`
+	Failsafe      FailsafeConfig                     `yaml:"failsafe"`
 
 	// Experimental
 	Security SecurityConfig `yaml:"security"`
@@ -49,12 +51,65 @@ type PluginConfig struct {
 	// The type of Args is depended on RegNewPluginFunc.
 	// If it's a map[string]interface{}, it will be converted by mapstruct.
 	Args interface{} `yaml:"args"`
+
+	// DependsOn, optional. Tags of plugins (or data providers) that this
+	// plugin depends on. Plugins are initialized in the order of their
+	// dependencies instead of the config order.
+	DependsOn []string `yaml:"depends_on"`
+
+	// Log, optional. Overrides the log level of this plugin and/or writes
+	// its logs into a separate file. Levels can also be changed at runtime
+	// by api "/log/level".
+	Log mlog.PluginLogConfig `yaml:"log"`
 }
 
 type ServerConfig struct {
 	Exec      string                  `yaml:"exec"`
 	Timeout   uint                    `yaml:"timeout"` // (sec) query timeout.
 	Listeners []*ServerListenerConfig `yaml:"listeners"`
+
+	// PerfStats records statistics of the queries to this server. They can be
+	// read from api "/stats/dnsperf" and "/stats/resperf" in dnsperf/resperf format.
+	PerfStats bool `yaml:"perf_stats"`
+
+	// Opcodes routes requests with non-QUERY opcodes, e.g. NOTIFY, UPDATE,
+	// to dedicated entries. Requests with other opcodes go to Exec.
+	Opcodes []*OpcodeConfig `yaml:"opcodes"`
+
+	// EncryptedOnly: queries to this server are only forwarded to
+	// encrypted (dot, doh) upstreams. If none of them is available, the
+	// query fails with an extended dns error instead of falling back to
+	// plaintext upstreams. It can also be enabled per view by the preset
+	// plugin "_encrypted_only".
+	EncryptedOnly bool `yaml:"encrypted_only"`
+
+	// ClientLimits limits each client IP of this server, over all its
+	// listeners.
+	ClientLimits ClientLimitsConfig `yaml:"client_limits"`
+
+	// TraceQueries answers CHAOS TXT queries for
+	// "<qtype>.<qname>.trace.mosdns." with the trace of the query, for
+	// debugging routing rules, e.g. `dig CH TXT a.example.com.trace.mosdns.`.
+	// The trace can also be read from api "/debug/trace".
+	TraceQueries bool `yaml:"trace_queries"`
+}
+
+// ClientLimitsConfig protects the server from misbehaving clients.
+// Zero disables a limit.
+type ClientLimitsConfig struct {
+	MaxConns    int     `yaml:"max_conns"`    // connections (tcp, dot, doh, dnscrypt) per client (or proxy if proxy_protocol is enabled).
+	MaxInflight int     `yaml:"max_inflight"` // concurrent queries per client.
+	QPS         float64 `yaml:"qps"`          // queries per second per client.
+	Burst       int     `yaml:"burst"`        // token bucket size of qps. Default is qps.
+
+	// Action for the queries over the max_inflight or qps limit,
+	// "refuse" (default, REFUSED response) or "drop" (no response).
+	Action string `yaml:"action"`
+}
+
+type OpcodeConfig struct {
+	Opcode string `yaml:"opcode"` // opcode name (notify, update, dso, etc.) or number.
+	Exec   string `yaml:"exec"`
 }
 
 type ServerListenerConfig struct {
@@ -62,25 +117,138 @@ type ServerListenerConfig struct {
 	// "", "udp" -> udp
 	// "tcp" -> tcp
 	// "dot", "tls" -> dns over tls
+	// "doq", "quic" -> dns over quic (rfc 9250)
 	// "doh", "https" -> dns over https (rfc 8844)
 	// "http" -> dns over https (rfc 8844) but without tls
+	// "dnscrypt" -> dnscrypt v2 over udp and tcp
+	// "unix" -> dns over unix stream socket (framed like tcp)
+	// "unixgram" -> dns over unix datagram socket
 	Protocol string `yaml:"protocol"`
 
-	// Addr: server "host:port" addr.
+	// Addr: server "host:port" addr, or socket path for unix, unixgram.
 	// Addr cannot be empty.
 	Addr string `yaml:"addr"`
 
-	Cert                string `yaml:"cert"`                    // certificate path, used by dot, doh
-	Key                 string `yaml:"key"`                     // certificate key path, used by dot, doh
+	Cert                string `yaml:"cert"`                    // certificate path, used by dot, doh, doq. Reloaded on change or SIGHUP.
+	Key                 string `yaml:"key"`                     // certificate key path, used by dot, doh, doq
 	URLPath             string `yaml:"url_path"`                // used by doh, http. If it's empty, any path will be handled.
-	GetUserIPFromHeader string `yaml:"get_user_ip_from_header"` // used by doh, http.
+	GetUserIPFromHeader string `yaml:"get_user_ip_from_header"` // used by doh, http. e.g. "X-Forwarded-For", "X-Real-IP".
 	ProxyProtocol       bool   `yaml:"proxy_protocol"`          // accepting the PROXYProtocol
 
-	IdleTimeout uint `yaml:"idle_timeout"` // (sec) used by tcp, dot, doh as connection idle timeout.
+	// ProxyProtocolTrusted: used with proxy_protocol. IPs or CIDRs of the
+	// proxies that send PROXY protocol (v1 or v2) headers. Other peers are
+	// served as direct clients and their headers are rejected. Default is
+	// all peers, and they must send the header.
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"`
+
+	// TProxy: used by udp, tcp. Linux only. Serve DNS traffic that was
+	// redirected by iptables TPROXY (udp, tcp) or REDIRECT (tcp). The
+	// original destination is recorded for the original_dst matcher of
+	// query_matcher. TPROXY requires CAP_NET_ADMIN.
+	TProxy bool `yaml:"tproxy"`
+
+	// EnableHTTP3: used by doh. Also serve DoH over HTTP/3 on the udp port
+	// of Addr, and advertise it to h2 clients via the Alt-Svc header.
+	EnableHTTP3 bool `yaml:"enable_http3"`
+
+	// TrustedProxies: used by doh, http. IPs or CIDRs of the peers whose
+	// GetUserIPFromHeader is trusted. Default is all peers. The client
+	// address is the rightmost address in the header that is not a trusted
+	// proxy.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	IdleTimeout uint `yaml:"idle_timeout"` // (sec) used by tcp, dot, doh, doq as connection idle timeout.
+	MaxInflight int  `yaml:"max_inflight"` // used by tcp, dot, doq. Maximum concurrent queries per connection. Default is no limit (100 streams for doq).
+
+	// SNI: used by dot, doh, doq. Per server name certificates and entries.
+	// The certificate whose names match the client's SNI will be used.
+	// Cert and Key above are still the default certificate.
+	SNI []*SNIConfig `yaml:"sni"`
+
+	UDPRcvBuf int `yaml:"udp_rcvbuf"` // (bytes) used by udp. SO_RCVBUF of the socket. Default is system default.
+	UDPSndBuf int `yaml:"udp_sndbuf"` // (bytes) used by udp. SO_SNDBUF of the socket. Default is system default.
+
+	DNSCrypt *DNSCryptConfig `yaml:"dnscrypt"` // required by dnscrypt.
+
+	UnixSocket *UnixSocketConfig `yaml:"unix_socket"` // optional, used by unix, unixgram.
+}
+
+// UnixSocketConfig sets the socket file of unix, unixgram servers. A stale
+// socket file is removed on startup. The socket file is removed on shutdown.
+type UnixSocketConfig struct {
+	Mode  string `yaml:"mode"`  // octal file mode, e.g. "0660". Default is set by umask.
+	Owner string `yaml:"owner"` // user name or uid. Default is unchanged.
+	Group string `yaml:"group"` // group name or gid. Default is unchanged.
+}
+
+type DNSCryptConfig struct {
+	// ProviderName: e.g. "2.dnscrypt-cert.example". The "2.dnscrypt-cert."
+	// prefix is added if it is missing.
+	ProviderName string `yaml:"provider_name"`
+
+	// KeyFile: path of the hex encoded ed25519 provider key. A new key will
+	// be generated and saved if the file does not exist. The server stamp
+	// for clients is logged on startup.
+	KeyFile string `yaml:"key_file"`
+
+	// CertTTL: (sec) validity of the short-term certificates, which are
+	// rotated on expiry. Default is 86400 (1 day).
+	CertTTL uint `yaml:"cert_ttl"`
+
+	// EsVersion: encryption of the certificates, "xsalsa20poly1305"
+	// (default) or "xchacha20poly1305".
+	EsVersion string `yaml:"es_version"`
+}
+
+type SNIConfig struct {
+	// ServerName: domain name, e.g. "family.example", or wildcard name,
+	// e.g. "*.example", which matches a single label.
+	ServerName string `yaml:"server_name"`
+	Cert       string `yaml:"cert"` // optional, certificate for this name.
+	Key        string `yaml:"key"`
+	Exec       string `yaml:"exec"` // optional, entry for queries to this name. Default is the server's entry.
+}
+
+// FailsafeConfig configures the fail-open mode, for deployments where
+// availability beats policy. If the entry of a server fails (returns an
+// error, panics or returns without a response), the query is passed to
+// Exec instead of being answered with SERVFAIL.
+type FailsafeConfig struct {
+	// Exec is the tag of an executable plugin, e.g. a forward plugin of an
+	// emergency upstream. Empty disables the failsafe.
+	Exec    string `yaml:"exec"`
+	Timeout uint   `yaml:"timeout"` // (sec) Default is 2.
 }
 
 type APIConfig struct {
 	HTTP string `yaml:"http"`
+
+	// Token, if set, is required by all api requests, in the header
+	// "Authorization: Bearer <token>".
+	Token string `yaml:"token"`
+
+	// ConfigUpdate enables the api endpoints that stage and apply new
+	// configs. It requires Token, because a config can run commands
+	// (e.g. plugin iptoshell) and write files (e.g. query logs).
+	// Note that applying a config stops the servers before the new ones
+	// are started, queries are not answered during an apply.
+	ConfigUpdate bool `yaml:"config_update"`
+}
+
+// LimitsConfig configures the daemon-wide resource limits. When the
+// usage of a resource exceeds soft_ratio of its limit, new tcp connections
+// are refused and low-priority queries are shed. When it reaches the limit,
+// all queries are shed.
+type LimitsConfig struct {
+	MaxGoroutines int     `yaml:"max_goroutines"` // Zero disables the goroutine limit.
+	MaxFDs        int     `yaml:"max_fds"`        // Zero disables the fd limit. Linux only.
+	FDHeadroom    int     `yaml:"fd_headroom"`    // fds kept free below RLIMIT_NOFILE. Default is 64.
+	SoftRatio     float64 `yaml:"soft_ratio"`     // Default is 0.8.
+	CheckInterval int     `yaml:"check_interval"` // (ms) Default is 1000.
+
+	// LowPriorityQtypes are the qtypes of queries that are shed first.
+	// Default is PTR, TXT and ANY.
+	LowPriorityQtypes []uint16 `yaml:"low_priority_qtypes"`
 }
 
 type SecurityConfig struct {
@@ -0,0 +1,489 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/safe_close"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultApplyHealthCheckPeriod = time.Second * 3
+	maxConfigBodySize             = 4 * 1024 * 1024
+
+	redactedValue = "REDACTED"
+)
+
+// Keys whose values are redacted in exported configs. Any key that
+// contains one of these words is redacted.
+var secretKeyWords = []string{"password", "passphrase", "secret", "token", "authorization", "key"}
+
+// Keys whose values are maps of http headers, e.g. "doh_headers". All
+// header values are redacted because any header may carry credentials.
+var headerKeyWords = []string{"header"}
+
+// runner runs the Mosdns of the current config, and swaps it with a new one
+// when a staged config is applied via the api.
+//
+// Api endpoints:
+//
+//	GET    /config        exports the current effective config.
+//	GET    /config/stage  exports the staged config.
+//	PUT    /config/stage  stages a new yaml config from the request body.
+//	DELETE /config/stage  discards the staged config.
+//	POST   /config/apply  applies the staged config. The optional query
+//	                      "wait" (sec) sets the health check period.
+//
+// Exported configs are yaml with includes merged and secrets redacted.
+// Endpoints that stage and apply configs are only available if
+// APIConfig.ConfigUpdate is enabled. If APIConfig.Token is set, all api
+// requests, including the ones of Mosdns, require it.
+//
+// Servers must release their listeners before the new ones can bind, so
+// apply stops the current Mosdns before it starts the new one. Queries
+// are not answered until the new Mosdns is started (or rolled back).
+type runner struct {
+	logger *zap.Logger
+	sc     *safe_close.SafeClose
+	api    APIConfig
+
+	applyM sync.Mutex // serializes stage and apply.
+	staged *Config
+
+	m       sync.Mutex
+	cfg     *Config
+	current *Mosdns
+}
+
+func newRunner(cfg *Config) (*runner, error) {
+	if cfg.API.ConfigUpdate && len(cfg.API.Token) == 0 {
+		return nil, errors.New("api config_update requires an api token")
+	}
+	m, err := newMosdns(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &runner{
+		logger: m.logger,
+		sc:     safe_close.NewSafeClose(),
+		api:    cfg.API,
+	}
+	r.setCurrent(cfg, m)
+	return r, nil
+}
+
+// setCurrent sets m as the current Mosdns and watches it. If m exits on
+// its own, e.g. a server failed, r will be closed.
+func (r *runner) setCurrent(cfg *Config, m *Mosdns) {
+	r.m.Lock()
+	r.cfg, r.current = cfg, m
+	r.m.Unlock()
+
+	go func() {
+		<-m.sc.ReceiveCloseSignal()
+		r.m.Lock()
+		isCurrent := r.current == m
+		r.m.Unlock()
+		if isCurrent {
+			r.sc.SendCloseSignal(m.sc.Err())
+		}
+	}()
+}
+
+func (r *runner) getCurrent() (*Config, *Mosdns) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.cfg, r.current
+}
+
+// closeCurrent closes the current Mosdns.
+func (r *runner) closeCurrent() {
+	r.m.Lock()
+	m := r.current
+	r.current = nil
+	r.m.Unlock()
+	if m != nil {
+		m.close()
+	}
+}
+
+func (r *runner) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !r.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/config":
+		r.handleExport(w, req)
+		return
+	case "/config/stage", "/config/apply":
+		if !r.api.ConfigUpdate {
+			http.Error(w, "config updates are disabled", http.StatusForbidden)
+			return
+		}
+		if req.URL.Path == "/config/stage" {
+			r.handleStage(w, req)
+		} else {
+			r.handleApply(w, req)
+		}
+		return
+	}
+
+	_, m := r.getCurrent()
+	if m == nil {
+		http.Error(w, "config is being applied", http.StatusServiceUnavailable)
+		return
+	}
+	m.httpAPIMux.ServeHTTP(w, req)
+}
+
+// authorized reports whether req has the api token, or no token is
+// required.
+func (r *runner) authorized(req *http.Request) bool {
+	if len(r.api.Token) == 0 {
+		return true
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(r.api.Token)) == 1
+}
+
+func (r *runner) handleExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, _ := r.getCurrent()
+	r.writeConfig(w, cfg)
+}
+
+func (r *runner) handleStage(w http.ResponseWriter, req *http.Request) {
+	r.applyM.Lock()
+	defer r.applyM.Unlock()
+
+	switch req.Method {
+	case http.MethodGet:
+		if r.staged == nil {
+			http.Error(w, "no staged config", http.StatusNotFound)
+			return
+		}
+		r.writeConfig(w, r.staged)
+	case http.MethodPut, http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(req.Body, maxConfigBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg, err := LoadConfigFromBytes(b)
+		if err == nil {
+			err = mergeInclude(cfg, 0, []string{"api"})
+		}
+		if err == nil {
+			err = validateConfig(cfg)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid config, %s", err), http.StatusBadRequest)
+			return
+		}
+		r.staged = cfg
+		r.logger.Info("new config staged")
+	case http.MethodDelete:
+		r.staged = nil
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *runner) handleApply(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	period := defaultApplyHealthCheckPeriod
+	if s := req.URL.Query().Get("wait"); len(s) > 0 {
+		d, err := time.ParseDuration(s + "s")
+		if err != nil || d < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		period = d
+	}
+
+	r.applyM.Lock()
+	defer r.applyM.Unlock()
+	if r.staged == nil {
+		http.Error(w, "no staged config", http.StatusNotFound)
+		return
+	}
+
+	if err := r.apply(r.staged, period); err != nil {
+		http.Error(w, fmt.Sprintf("failed to apply config, rolled back, %s", err), http.StatusInternalServerError)
+		return
+	}
+	r.staged = nil
+}
+
+// apply replaces the current Mosdns with a new one of cfg. If the new
+// Mosdns failed to start or exited within the health check period, the
+// previous config will be restored.
+func (r *runner) apply(cfg *Config, healthCheckPeriod time.Duration) error {
+	oldCfg, _ := r.getCurrent()
+	if cfg.API.HTTP != oldCfg.API.HTTP {
+		r.logger.Warn("api address changes require a restart, ignored", zap.String("addr", cfg.API.HTTP))
+	}
+
+	r.logger.Info("applying new config, servers are stopped until it is started")
+	r.closeCurrent()
+	err := r.startAndCheck(cfg, healthCheckPeriod)
+	if err == nil {
+		r.logger.Info("new config applied")
+		return nil
+	}
+
+	r.logger.Error("failed to apply new config, rolling back", zap.Error(err))
+	if rollbackErr := r.startAndCheck(oldCfg, 0); rollbackErr != nil {
+		r.logger.Error("failed to roll back config", zap.Error(rollbackErr))
+		r.sc.SendCloseSignal(fmt.Errorf("failed to roll back config, %w", rollbackErr))
+	}
+	return err
+}
+
+func (r *runner) startAndCheck(cfg *Config, healthCheckPeriod time.Duration) error {
+	m, err := newMosdns(cfg)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(healthCheckPeriod)
+	defer timer.Stop()
+	select {
+	case <-m.sc.ReceiveCloseSignal():
+		m.close()
+		err := m.sc.Err()
+		if err == nil {
+			err = errors.New("exited during health check")
+		}
+		return err
+	case <-timer.C:
+	}
+	r.setCurrent(cfg, m)
+	return nil
+}
+
+func (r *runner) writeConfig(w http.ResponseWriter, cfg *Config) {
+	b, err := exportConfig(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+// validateConfig checks cfg without initializing its plugins, because
+// plugin inits have side effects in the running process, e.g. they
+// register metrics, start goroutines and take file locks. Errors from
+// plugin inits are reported by apply, which rolls back the config.
+func validateConfig(cfg *Config) error {
+	tags := make(map[string]struct{})
+	for _, dpc := range cfg.DataProviders {
+		if len(dpc.Tag) == 0 {
+			continue
+		}
+		if _, dup := tags[dpc.Tag]; dup {
+			return fmt.Errorf("duplicated provider tag %s", dpc.Tag)
+		}
+		tags[dpc.Tag] = struct{}{}
+	}
+	for tag := range LoadNewPersetPluginFuncs() {
+		tags[tag] = struct{}{}
+	}
+
+	dupTag := make(map[string]struct{})
+	pluginConfigs := make([]PluginConfig, 0, len(cfg.Plugins))
+	for _, pc := range cfg.Plugins {
+		if len(pc.Type) == 0 || len(pc.Tag) == 0 {
+			continue
+		}
+		if _, dup := dupTag[pc.Tag]; dup {
+			return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
+		}
+		dupTag[pc.Tag] = struct{}{}
+		typeInfo, ok := GetPluginType(pc.Type)
+		if !ok {
+			return fmt.Errorf("plugin %s, plugin type %s not defined", pc.Tag, pc.Type)
+		}
+		if _, err := decodePluginArgs(&pc, typeInfo); err != nil {
+			return fmt.Errorf("plugin %s, %w", pc.Tag, err)
+		}
+		pluginConfigs = append(pluginConfigs, pc)
+	}
+	if _, err := sortPluginConfigs(pluginConfigs, tags); err != nil {
+		return err
+	}
+	for tag := range dupTag {
+		tags[tag] = struct{}{}
+	}
+
+	if len(cfg.Servers) == 0 {
+		return errors.New("no server is configured")
+	}
+	checkEntry := func(tag string) error {
+		if _, ok := tags[tag]; !ok {
+			return fmt.Errorf("cannot find entry %s", tag)
+		}
+		return nil
+	}
+	for i, sc := range cfg.Servers {
+		if len(sc.Listeners) == 0 {
+			return fmt.Errorf("server #%d, no server listener is configured", i)
+		}
+		if err := checkEntry(sc.Exec); err != nil {
+			return fmt.Errorf("server #%d, %w", i, err)
+		}
+		for _, oc := range sc.Opcodes {
+			if _, err := dns_handler.ParseOpcode(oc.Opcode); err != nil {
+				return fmt.Errorf("server #%d, %w", i, err)
+			}
+			if err := checkEntry(oc.Exec); err != nil {
+				return fmt.Errorf("server #%d, %w", i, err)
+			}
+		}
+		for _, lc := range sc.Listeners {
+			for _, sni := range lc.SNI {
+				if len(sni.Exec) == 0 {
+					continue
+				}
+				if err := checkEntry(sni.Exec); err != nil {
+					return fmt.Errorf("server #%d, %w", i, err)
+				}
+			}
+			if _, err := parsePrefixes(lc.TrustedProxies); err != nil {
+				return fmt.Errorf("server #%d, invalid trusted proxies, %w", i, err)
+			}
+			if _, err := newProxyProtocolPolicy(lc.ProxyProtocolTrusted); err != nil {
+				return fmt.Errorf("server #%d, %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// exportConfig marshals cfg to yaml with secrets redacted.
+func exportConfig(cfg *Config) ([]byte, error) {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactConfigValue("", v))
+}
+
+// redactConfigValue redacts values of secret keys, http headers and
+// passwords in urls.
+func redactConfigValue(key string, v interface{}) interface{} {
+	lk := strings.ToLower(key)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		redactAll := containsAny(lk, headerKeyWords)
+		for k, e := range v {
+			if redactAll {
+				v[k] = redactAllValues(e)
+				continue
+			}
+			v[k] = redactConfigValue(k, e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactConfigValue(key, e)
+		}
+		return v
+	case string:
+		if len(v) == 0 {
+			return v
+		}
+		if containsAny(lk, secretKeyWords) {
+			return redactedValue
+		}
+		if strings.Contains(v, "://") {
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					return u.Redacted()
+				}
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// redactAllValues redacts all non-empty strings in v.
+func redactAllValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = redactAllValues(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactAllValues(e)
+		}
+		return v
+	case string:
+		if len(v) == 0 {
+			return v
+		}
+		return redactedValue
+	default:
+		return v
+	}
+}
+
+func containsAny(s string, words []string) bool {
+	for _, w := range words {
+		if strings.Contains(s, w) {
+			return true
+		}
+	}
+	return false
+}
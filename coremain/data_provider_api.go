@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Data provider api endpoints:
+//
+//	GET  /data_providers         reports the last reload status of providers.
+//	POST /data_providers/reload  reloads all providers and reports the results.
+//	                             The optional query "tag" reloads one provider.
+//
+// Providers are also reloaded when mosdns receives a SIGHUP.
+
+type dataProviderStatus struct {
+	Tag        string     `json:"tag"`
+	ReloadedAt *time.Time `json:"reloaded_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+func (m *Mosdns) handleDataProviders(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res []dataProviderStatus
+	for tag, s := range m.dataManager.Status() {
+		ps := dataProviderStatus{Tag: tag}
+		if !s.Time.IsZero() {
+			t := s.Time
+			ps.ReloadedAt = &t
+		}
+		if s.Err != nil {
+			ps.Error = s.Err.Error()
+		}
+		res = append(res, ps)
+	}
+	m.writeDataProviderStatus(w, http.StatusOK, res)
+}
+
+func (m *Mosdns) handleReloadDataProviders(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var errs map[string]error
+	if tag := req.URL.Query().Get("tag"); len(tag) > 0 {
+		p := m.dataManager.GetDataProvider(tag)
+		if p == nil {
+			http.Error(w, "data provider not found", http.StatusNotFound)
+			return
+		}
+		errs = map[string]error{tag: p.Reload()}
+	} else {
+		errs = m.dataManager.ReloadAll()
+	}
+
+	code := http.StatusOK
+	now := time.Now()
+	res := make([]dataProviderStatus, 0, len(errs))
+	for tag, err := range errs {
+		ps := dataProviderStatus{Tag: tag, ReloadedAt: &now}
+		if err != nil {
+			ps.Error = err.Error()
+			code = http.StatusInternalServerError
+		}
+		res = append(res, ps)
+	}
+	m.logReloadResults(errs)
+	m.writeDataProviderStatus(w, code, res)
+}
+
+func (m *Mosdns) writeDataProviderStatus(w http.ResponseWriter, code int, res []dataProviderStatus) {
+	sort.Slice(res, func(i, j int) bool { return res[i].Tag < res[j].Tag })
+	if res == nil {
+		res = []dataProviderStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		m.logger.Warn("failed to write data provider status", zap.Error(err))
+	}
+}
+
+func (m *Mosdns) logReloadResults(errs map[string]error) {
+	for tag, err := range errs {
+		if err != nil {
+			m.logger.Error("failed to reload data provider", zap.String("tag", tag), zap.Error(err))
+		} else {
+			m.logger.Info("data provider reloaded", zap.String("tag", tag))
+		}
+	}
+}
+
+// reloadDataProvidersOnSIGHUP reloads all data providers when mosdns
+// receives a SIGHUP, until m is closed.
+func (m *Mosdns) reloadDataProvidersOnSIGHUP() {
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-sig:
+				m.logger.Info("received SIGHUP, reloading data providers")
+				m.logReloadResults(m.dataManager.ReloadAll())
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
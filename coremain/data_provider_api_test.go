@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMosdns_handleReloadDataProviders(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(nil)
+	f := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(f, []byte("example.com"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := data_provider.NewDataProvider(zap.NewNop(), data_provider.DataProviderConfig{File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.dataManager.AddDataProvider("list", dp)
+	defer m.dataManager.Close()
+
+	do := func(method, path string, wantCode int) []dataProviderStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if path == "/data_providers" {
+			m.handleDataProviders(w, httptest.NewRequest(method, path, nil))
+		} else {
+			m.handleReloadDataProviders(w, httptest.NewRequest(method, path, nil))
+		}
+		if w.Code != wantCode {
+			t.Fatalf("%s %s: want code %d, got %d", method, path, wantCode, w.Code)
+		}
+		var res []dataProviderStatus
+		if wantCode != http.StatusOK && wantCode != http.StatusInternalServerError {
+			return nil
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := do(http.MethodGet, "/data_providers", http.StatusOK); len(res) != 1 || res[0].ReloadedAt != nil {
+		t.Fatalf("unexpected status %+v", res)
+	}
+	do(http.MethodGet, "/data_providers/reload", http.StatusMethodNotAllowed)
+	do(http.MethodPost, "/data_providers/reload?tag=none", http.StatusNotFound)
+	if res := do(http.MethodPost, "/data_providers/reload?tag=list", http.StatusOK); len(res) != 1 || len(res[0].Error) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	os.Remove(f)
+	if res := do(http.MethodPost, "/data_providers/reload", http.StatusInternalServerError); len(res) != 1 || len(res[0].Error) == 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res := do(http.MethodGet, "/data_providers", http.StatusOK); len(res) != 1 || res[0].ReloadedAt == nil || len(res[0].Error) == 0 {
+		t.Fatalf("unexpected status %+v", res)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sortPluginConfigs sorts plugin configs so that a plugin is always
+// initialized after the plugins it depends on (PluginConfig.DependsOn).
+// The config order is kept as a stable tiebreak: only plugins that declare
+// DependsOn are moved, and they are moved backward, right after their last
+// dependency. Plugins without DependsOn are never reordered, so configs that
+// rely on the config order keep working.
+// knownTags contains tags that are already available before any plugin is
+// initialized (e.g. data providers and preset plugins).
+// An error will be returned if there is a missing or circular dependency.
+func sortPluginConfigs(pcs []PluginConfig, knownTags map[string]struct{}) ([]PluginConfig, error) {
+	idx := make(map[string]int, len(pcs))
+	for i, pc := range pcs {
+		idx[pc.Tag] = i
+	}
+	for _, pc := range pcs {
+		for _, dep := range pc.DependsOn {
+			if _, ok := idx[dep]; ok {
+				continue
+			}
+			if _, known := knownTags[dep]; !known {
+				return nil, fmt.Errorf("plugin %s depends on %s, which is not defined", pc.Tag, dep)
+			}
+		}
+	}
+
+	done := make([]bool, len(pcs))
+	ready := func(i int) bool {
+		for _, dep := range pcs[i].DependsOn {
+			if j, ok := idx[dep]; ok && !done[j] {
+				return false
+			}
+		}
+		return true
+	}
+
+	sorted := make([]PluginConfig, 0, len(pcs))
+	var pending []int // Indexes of deferred plugins, in config order.
+	for i := range pcs {
+		if !ready(i) {
+			pending = append(pending, i)
+			continue
+		}
+		done[i] = true
+		sorted = append(sorted, pcs[i])
+
+		// Place deferred plugins that are ready now. Restart the scan
+		// after each placement to keep their config order.
+		for k := 0; k < len(pending); {
+			j := pending[k]
+			if !ready(j) {
+				k++
+				continue
+			}
+			done[j] = true
+			sorted = append(sorted, pcs[j])
+			pending = append(pending[:k], pending[k+1:]...)
+			k = 0
+		}
+	}
+
+	if len(pending) > 0 {
+		return nil, cycleError(pcs, idx, done, pending[0])
+	}
+	return sorted, nil
+}
+
+// cycleError follows unresolved dependencies from pcs[i] until a plugin
+// repeats and reports the cycle. Every plugin that is not done has at least
+// one dependency that is not done either.
+func cycleError(pcs []PluginConfig, idx map[string]int, done []bool, i int) error {
+	var path []string
+	pos := make(map[int]int)
+	for {
+		if p, ok := pos[i]; ok {
+			cycle := append(path[p:len(path):len(path)], pcs[i].Tag)
+			return fmt.Errorf("circular plugin dependency: %s", strings.Join(cycle, " -> "))
+		}
+		pos[i] = len(path)
+		path = append(path, pcs[i].Tag)
+		for _, dep := range pcs[i].DependsOn {
+			if j, ok := idx[dep]; ok && !done[j] {
+				i = j
+				break
+			}
+		}
+	}
+}
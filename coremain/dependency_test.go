@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_sortPluginConfigs(t *testing.T) {
+	pc := func(tag string, deps ...string) PluginConfig {
+		return PluginConfig{Tag: tag, Type: "t", DependsOn: deps}
+	}
+	known := map[string]struct{}{"dp": {}}
+
+	tests := []struct {
+		name    string
+		pcs     []PluginConfig
+		want    []string
+		wantErr string
+	}{
+		{"no deps", []PluginConfig{pc("a"), pc("b"), pc("c")}, []string{"a", "b", "c"}, ""},
+		{"satisfied deps", []PluginConfig{pc("a"), pc("b", "a"), pc("c", "b")}, []string{"a", "b", "c"}, ""},
+		{"defer dependent", []PluginConfig{pc("a", "c"), pc("b"), pc("c")}, []string{"b", "c", "a"}, ""},
+		{"chain", []PluginConfig{pc("a", "b"), pc("b", "c"), pc("c")}, []string{"c", "b", "a"}, ""},
+		{"keep order of deferred", []PluginConfig{pc("a", "c"), pc("b", "c"), pc("c"), pc("d")}, []string{"c", "a", "b", "d"}, ""},
+		{"do not move dependency", []PluginConfig{pc("a"), pc("b", "d"), pc("c"), pc("d")}, []string{"a", "c", "d", "b"}, ""},
+		{"known tag", []PluginConfig{pc("a", "dp"), pc("b")}, []string{"a", "b"}, ""},
+		{"unknown tag", []PluginConfig{pc("a", "x")}, nil, "depends on x"},
+		{"self cycle", []PluginConfig{pc("a", "a")}, nil, "a -> a"},
+		{"cycle", []PluginConfig{pc("a", "b"), pc("b", "c"), pc("c", "a"), pc("d")}, nil, "a -> b -> c -> a"},
+		{"cycle behind deferred", []PluginConfig{pc("x", "a"), pc("a", "b"), pc("b", "a")}, nil, "a -> b -> a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sortPluginConfigs(tt.pcs, known)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("sortPluginConfigs() err = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotTags []string
+			for _, pc := range got {
+				gotTags = append(gotTags, pc.Tag)
+			}
+			if !reflect.DeepEqual(gotTags, tt.want) {
+				t.Fatalf("sortPluginConfigs() = %v, want %v", gotTags, tt.want)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@
 package coremain
 
 import (
+	"context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"io"
 )
@@ -42,3 +43,29 @@ type MatcherPlugin interface {
 	Plugin
 	executable_seq.Matcher
 }
+
+// Starter is an optional interface of Plugin. Start is called after all
+// plugins are initialized and before servers start, in the plugin
+// init order. A plugin should start its background jobs and open its
+// external resources (sockets, netlink handles, files) here.
+// If Start returns an error, mosdns exits.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// ReadyChecker is an optional interface of Plugin. Servers start after
+// Ready of all plugins returned, or after the ready timeout. A plugin
+// that needs time to serve correctly, e.g. loading a cache dump, should
+// block in Ready until it is done or ctx is done.
+type ReadyChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// Shutdowner is an optional interface of Plugin. If a plugin implements it,
+// Shutdown is called instead of Close when mosdns exits. Plugins are shut
+// down in the reverse init order, after servers are stopped, so a plugin
+// is always shut down before the plugins it depends on.
+// The plugin should release its resources before ctx is done.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
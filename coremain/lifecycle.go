@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	pluginStartTimeout = time.Second * 30
+	pluginReadyTimeout = time.Second * 30
+	pluginCloseTimeout = time.Second * 5
+)
+
+// startPlugins calls Start of plugins that implement Starter, in the
+// init order.
+func (m *Mosdns) startPlugins() error {
+	for _, tag := range m.pluginOrder {
+		s, ok := m.plugins[tag].(Starter)
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pluginStartTimeout)
+		err := s.Start(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to start plugin %s, %w", tag, err)
+		}
+	}
+	return nil
+}
+
+// waitPluginsReady waits for plugins that implement ReadyChecker. Plugins
+// that are not ready in pluginReadyTimeout are logged and ignored.
+func (m *Mosdns) waitPluginsReady() {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginReadyTimeout)
+	defer cancel()
+	for _, tag := range m.pluginOrder {
+		r, ok := m.plugins[tag].(ReadyChecker)
+		if !ok {
+			continue
+		}
+		if err := r.Ready(ctx); err != nil {
+			m.logger.Warn("plugin is not ready", zap.String("tag", tag), zap.Error(err))
+		}
+	}
+}
+
+// closePlugins closes plugins in the reverse init order. So a plugin is
+// always closed before the plugins it depends on. Each plugin has timeout
+// to close. If it does not return in time, it is logged and left behind.
+func (m *Mosdns) closePlugins(timeout time.Duration) {
+	for i := len(m.pluginOrder) - 1; i >= 0; i-- {
+		tag := m.pluginOrder[i]
+		if err := closePlugin(m.plugins[tag], timeout); err != nil {
+			m.logger.Warn("failed to close plugin", zap.String("tag", tag), zap.Error(err))
+		}
+	}
+}
+
+func closePlugin(p Plugin, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errChan := make(chan error, 1)
+	go func() {
+		if s, ok := p.(Shutdowner); ok {
+			errChan <- s.Shutdown(ctx)
+			return
+		}
+		errChan <- p.Close()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("plugin did not close in %s", timeout)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lifecycleRecorder struct {
+	sync.Mutex
+	events []string
+}
+
+func (r *lifecycleRecorder) add(e string) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *lifecycleRecorder) get() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+type lifecyclePlugin struct {
+	*BP
+	r *lifecycleRecorder
+}
+
+func (p *lifecyclePlugin) Start(_ context.Context) error {
+	p.r.add("start " + p.Tag())
+	return nil
+}
+
+func (p *lifecyclePlugin) Close() error {
+	p.r.add("close " + p.Tag())
+	return nil
+}
+
+type shutdownPlugin struct {
+	*BP
+	r     *lifecycleRecorder
+	block bool
+}
+
+func (p *shutdownPlugin) Shutdown(ctx context.Context) error {
+	if p.block {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 50) // ignores ctx for a while.
+	}
+	p.r.add("shutdown " + p.Tag())
+	return nil
+}
+
+type failedStartPlugin struct {
+	*BP
+}
+
+func (p *failedStartPlugin) Start(_ context.Context) error {
+	return errors.New("start failed")
+}
+
+func newLifecycleTestMosdns(ps ...Plugin) *Mosdns {
+	m := &Mosdns{logger: zap.NewNop(), plugins: make(map[string]Plugin)}
+	for _, p := range ps {
+		m.addPlugin(p)
+	}
+	return m
+}
+
+func TestMosdns_pluginLifecycle(t *testing.T) {
+	r := new(lifecycleRecorder)
+	m := newLifecycleTestMosdns(
+		&lifecyclePlugin{BP: NewBP("a", "", nil, nil), r: r},
+		&shutdownPlugin{BP: NewBP("b", "", nil, nil), r: r},
+		&shutdownPlugin{BP: NewBP("c", "", nil, nil), r: r, block: true},
+		&lifecyclePlugin{BP: NewBP("d", "", nil, nil), r: r},
+	)
+
+	if err := m.startPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	m.closePlugins(time.Millisecond * 10)
+
+	// c timed out, it is left behind and b is closed without waiting for it.
+	want := []string{"start a", "start d", "close d", "shutdown b", "close a"}
+	if got := r.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if got := r.get(); got[len(got)-1] != "shutdown c" {
+		t.Fatalf("blocked plugin was not shut down, events = %v", got)
+	}
+}
+
+func TestMosdns_startPlugins_error(t *testing.T) {
+	r := new(lifecycleRecorder)
+	m := newLifecycleTestMosdns(
+		&lifecyclePlugin{BP: NewBP("a", "", nil, nil), r: r},
+		&failedStartPlugin{BP: NewBP("b", "", nil, nil)},
+		&lifecyclePlugin{BP: NewBP("c", "", nil, nil), r: r},
+	)
+	if err := m.startPlugins(); err == nil {
+		t.Fatal("want an error")
+	}
+	if got, want := r.get(), []string{"start a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
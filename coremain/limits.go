@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/self_limit"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+var defaultLowPriorityQtypes = []uint16{dns.TypePTR, dns.TypeTXT, dns.TypeANY}
+
+// initLimiter starts the resource limiter if any limit of cfg is set
+// and registers its metrics.
+func (m *Mosdns) initLimiter(cfg *LimitsConfig) error {
+	if cfg.MaxGoroutines == 0 && cfg.MaxFDs == 0 {
+		return nil
+	}
+	l, err := self_limit.NewLimiter(self_limit.Opts{
+		MaxGoroutines: cfg.MaxGoroutines,
+		MaxFDs:        cfg.MaxFDs,
+		FDHeadroom:    cfg.FDHeadroom,
+		SoftRatio:     cfg.SoftRatio,
+		CheckInterval: time.Duration(cfg.CheckInterval) * time.Millisecond,
+		Logger:        m.logger,
+	})
+	if err != nil {
+		return err
+	}
+	m.limiter = l
+	m.lowPriorityQtypes = cfg.LowPriorityQtypes
+	if len(m.lowPriorityQtypes) == 0 {
+		m.lowPriorityQtypes = defaultLowPriorityQtypes
+	}
+
+	reg := m.GetMetricsReg()
+	gauge := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+	}
+	counter := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, f)
+	}
+	reg.MustRegister(
+		gauge("limits_goroutines", "The number of goroutines of the last limit check",
+			func() float64 { return float64(l.Goroutines()) }),
+		gauge("limits_max_goroutines", "The goroutine limit, zero means no limit",
+			func() float64 { return float64(l.MaxGoroutines()) }),
+		gauge("limits_open_fds", "The number of open fds of the last limit check",
+			func() float64 { return float64(l.OpenFDs()) }),
+		gauge("limits_max_fds", "The effective fd limit, zero means no limit",
+			func() float64 { return float64(l.MaxFDs()) }),
+		gauge("limits_level", "The load level, 0 is normal, 1 is soft limited, 2 is hard limited",
+			func() float64 { return float64(l.Level()) }),
+		counter("limits_refused_conns_total", "The total number of tcp connections refused by limits",
+			func() float64 { return float64(l.RefusedConns()) }),
+		counter("limits_shed_queries_total", "The total number of queries shed by limits",
+			func() float64 { return float64(l.ShedQueries()) }),
+	)
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+)
+
+// Log level api endpoints:
+//
+//	GET  /log/level                          reports the global level and
+//	                                         the levels of plugins that have
+//	                                         their own level.
+//	POST /log/level?level=debug              sets the global level.
+//	POST /log/level?plugin=tag&level=debug   sets the level of a plugin.
+//	POST /log/level?plugin=tag               resets a plugin to the global level.
+//
+// Changes are not saved, they are lost after a restart or config reload.
+
+type logLevels struct {
+	Level   string            `json:"level"`
+	Plugins map[string]string `json:"plugins"`
+}
+
+func (m *Mosdns) handleLogLevel(w http.ResponseWriter, req *http.Request) {
+	if m.logs == nil {
+		http.Error(w, "log levels are not available", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		query := req.URL.Query()
+		var lvl *zapcore.Level
+		if s := query.Get("level"); len(s) > 0 {
+			l, err := zapcore.ParseLevel(s)
+			if err != nil {
+				http.Error(w, "invalid level", http.StatusBadRequest)
+				return
+			}
+			lvl = &l
+		}
+		if tag := query.Get("plugin"); len(tag) > 0 {
+			if err := m.logs.SetPluginLevel(tag, lvl); err != nil {
+				http.Error(w, "plugin not found", http.StatusNotFound)
+				return
+			}
+			if lvl != nil {
+				m.logger.Info("plugin log level changed", zap.String("plugin", tag), zap.Stringer("level", *lvl))
+			} else {
+				m.logger.Info("plugin log level reset", zap.String("plugin", tag))
+			}
+		} else {
+			if lvl == nil {
+				http.Error(w, "missing level", http.StatusBadRequest)
+				return
+			}
+			m.logs.SetLevel(*lvl)
+			m.logger.Info("log level changed", zap.Stringer("level", *lvl))
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := logLevels{Level: m.logs.Level().String(), Plugins: make(map[string]string)}
+	for tag, l := range m.logs.PluginLevels() {
+		res.Plugins[tag] = l.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		m.logger.Warn("failed to write log levels", zap.Error(err))
+	}
+}
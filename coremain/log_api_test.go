@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMosdns_handleLogLevel(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(nil)
+	logs, err := mlog.NewManager(&mlog.LogConfig{Level: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.logs = logs
+	if _, err := m.pluginLogger("p", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, query string, wantCode int) logLevels {
+		t.Helper()
+		w := httptest.NewRecorder()
+		m.handleLogLevel(w, httptest.NewRequest(method, "/log/level?"+query, nil))
+		if w.Code != wantCode {
+			t.Fatalf("%s %s: want code %d, got %d", method, query, wantCode, w.Code)
+		}
+		var res logLevels
+		if wantCode == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res
+	}
+
+	if res := do(http.MethodGet, "", http.StatusOK); res.Level != "info" || len(res.Plugins) != 0 {
+		t.Fatalf("unexpected levels %+v", res)
+	}
+	do(http.MethodPut, "level=debug", http.StatusMethodNotAllowed)
+	do(http.MethodPost, "", http.StatusBadRequest)
+	do(http.MethodPost, "level=bad", http.StatusBadRequest)
+	do(http.MethodPost, "plugin=none&level=debug", http.StatusNotFound)
+
+	if res := do(http.MethodPost, "level=warn", http.StatusOK); res.Level != "warn" {
+		t.Fatalf("unexpected levels %+v", res)
+	}
+	if res := do(http.MethodPost, "plugin=p&level=debug", http.StatusOK); res.Level != "warn" || res.Plugins["p"] != "debug" {
+		t.Fatalf("unexpected levels %+v", res)
+	}
+	if res := do(http.MethodPost, "plugin=p", http.StatusOK); len(res.Plugins) != 0 {
+		t.Fatalf("unexpected levels %+v", res)
+	}
+}
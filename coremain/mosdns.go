@@ -25,53 +25,148 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/mlog"
 	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/perf_stats"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_tail"
 	"github.com/IrineSistiana/mosdns/v4/pkg/safe_close"
+	"github.com/IrineSistiana/mosdns/v4/pkg/self_limit"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"time"
 )
 
 type Mosdns struct {
 	logger *zap.Logger
+	logs   *mlog.Manager // nil in tests.
 
 	// Data
 	dataManager *data_provider.DataManager
 
 	// Plugins
-	execs    map[string]executable_seq.Executable
-	matchers map[string]executable_seq.Matcher
+	plugins     map[string]Plugin
+	pluginOrder []string // plugin tags in init order.
+	execs       map[string]executable_seq.Executable
+	matchers    map[string]executable_seq.Matcher
 
 	httpAPIMux    *http.ServeMux
 	httpAPIServer *http.Server
 
-	metricsReg *prometheus.Registry
+	metricsReg      *prometheus.Registry
+	queryMetrics    *dns_handler.QueryMetrics
+	pluginExecTotal *prometheus.CounterVec
+	perfStats       *perf_stats.Stats
+	queryTail       *query_tail.Hub
+	limiter         *self_limit.Limiter // nil if limits are disabled.
+	udpStats        *udpStatsCollector
+
+	serverAddrs []net.Addr // bound addresses of server listeners.
+	traceEntry  string     // default entry of api "/debug/trace", the exec of the first server.
+
+	lowPriorityQtypes []uint16
+
+	failsafe        executable_seq.Executable // nil if failsafe is disabled.
+	failsafeTimeout time.Duration
 
 	sc *safe_close.SafeClose
 }
 
 func RunMosdns(cfg *Config) error {
-	lg, err := mlog.NewLogger(&cfg.Log)
+	r, err := newRunner(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to init logger: %w", err)
+		return err
+	}
+
+	// Start http api server
+	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
+		httpServer := &http.Server{
+			Addr:    httpAddr,
+			Handler: r,
+		}
+		r.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			defer done()
+			errChan := make(chan error, 1)
+			go func() {
+				r.logger.Info("starting api http server", zap.String("addr", httpAddr))
+				errChan <- httpServer.ListenAndServe()
+			}()
+			select {
+			case err := <-errChan:
+				r.sc.SendCloseSignal(err)
+			case <-closeSignal:
+				httpServer.Close()
+			}
+		})
 	}
 
+	time.AfterFunc(time.Second*1, func() {
+		runtime.GC()
+		debug.FreeOSMemory()
+	})
+	<-r.sc.ReceiveCloseSignal()
+	r.sc.Done()
+	r.sc.CloseWait()
+	r.closeCurrent()
+	return r.sc.Err()
+}
+
+// NewMosdns initializes data providers, plugins and servers of cfg.
+// It is used to embed mosdns, e.g. in tests. Unlike RunMosdns, the
+// api server of cfg is not started, use GetHTTPAPIMux instead.
+// The returned Mosdns must be closed by Close.
+func NewMosdns(cfg *Config) (*Mosdns, error) {
+	return newMosdns(cfg)
+}
+
+// newMosdns initializes data providers and plugins of cfg and starts its
+// servers. The returned Mosdns must be closed by close.
+func newMosdns(cfg *Config) (_ *Mosdns, err error) {
+	logs, err := mlog.NewManager(&cfg.Log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init logger: %w", err)
+	}
+	lg := logs.L()
+
 	m := &Mosdns{
 		logger:      lg,
+		logs:        logs,
 		dataManager: data_provider.NewDataManager(),
+		plugins:     make(map[string]Plugin),
 		execs:       make(map[string]executable_seq.Executable),
 		matchers:    make(map[string]executable_seq.Matcher),
 		httpAPIMux:  http.NewServeMux(),
 		metricsReg:  newMetricsReg(),
+		perfStats:   perf_stats.NewStats(),
+		queryTail:   query_tail.NewHub(),
 		sc:          safe_close.NewSafeClose(),
 	}
+	m.udpStats = newUDPStatsCollector(m.logger)
+	m.GetMetricsReg().MustRegister(m.udpStats)
+	m.queryMetrics = dns_handler.NewQueryMetrics()
+	m.GetMetricsReg().MustRegister(m.queryMetrics.Collectors()...)
+	m.pluginExecTotal = newPluginExecTotal()
+	m.GetMetricsReg().MustRegister(m.pluginExecTotal)
+	defer func() {
+		if err != nil {
+			m.close()
+		}
+	}()
 
 	m.httpAPIMux.Handle("/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
+	m.httpAPIMux.HandleFunc("/stats/dnsperf", m.handlePerfStats)
+	m.httpAPIMux.HandleFunc("/stats/resperf", m.handlePerfStats)
+	m.httpAPIMux.HandleFunc("/data_providers", m.handleDataProviders)
+	m.httpAPIMux.HandleFunc("/data_providers/reload", m.handleReloadDataProviders)
+	m.httpAPIMux.HandleFunc("/log/level", m.handleLogLevel)
+	m.httpAPIMux.HandleFunc("/queries/tail", m.handleQueryTail)
+	m.httpAPIMux.HandleFunc("/debug/trace", m.handleTrace)
 	m.httpAPIMux.HandleFunc("/debug/pprof/", pprof.Index)
 	m.httpAPIMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	m.httpAPIMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -85,41 +180,72 @@ func RunMosdns(cfg *Config) error {
 			continue
 		}
 		if _, ok := dupTag[dpc.Tag]; ok {
-			return fmt.Errorf("duplicated provider tag %s", dpc.Tag)
+			return nil, fmt.Errorf("duplicated provider tag %s", dpc.Tag)
 		}
 		dupTag[dpc.Tag] = struct{}{}
 
 		dp, err := data_provider.NewDataProvider(lg, dpc)
 		if err != nil {
-			return fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
+			return nil, fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
 		}
 		m.dataManager.AddDataProvider(dpc.Tag, dp)
 	}
 
-	// Init preset plugins
-	for tag, f := range LoadNewPersetPluginFuncs() {
-		p, err := f(NewBP(tag, "preset", m.logger, m))
+	m.reloadDataProvidersOnSIGHUP()
+
+	// Tags that are available before any plugin is initialized.
+	knownTags := make(map[string]struct{}, len(dupTag))
+	for tag := range dupTag {
+		knownTags[tag] = struct{}{}
+	}
+
+	// Init preset plugins. Sorted, so they have a stable init (and close) order.
+	presetFuncs := LoadNewPersetPluginFuncs()
+	presetTags := make([]string, 0, len(presetFuncs))
+	for tag := range presetFuncs {
+		presetTags = append(presetTags, tag)
+	}
+	sort.Strings(presetTags)
+	for _, tag := range presetTags {
+		lg, err := m.pluginLogger(tag, nil)
 		if err != nil {
-			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
+			return nil, fmt.Errorf("failed to init logger of preset plugin %s, %w", tag, err)
+		}
+		p, err := presetFuncs[tag](NewBP(tag, "preset", lg, m))
+		if err != nil {
+			return nil, fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
 		}
 		m.addPlugin(p)
+		knownTags[tag] = struct{}{}
 	}
 
 	// Init plugins
 	dupTag = make(map[string]struct{})
-	for i, pc := range cfg.Plugins {
+	pluginConfigs := make([]PluginConfig, 0, len(cfg.Plugins))
+	for _, pc := range cfg.Plugins {
 		if len(pc.Type) == 0 || len(pc.Tag) == 0 {
 			continue
 		}
 		if _, dup := dupTag[pc.Tag]; dup {
-			return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
+			return nil, fmt.Errorf("duplicated plugin tag %s", pc.Tag)
 		}
 		dupTag[pc.Tag] = struct{}{}
+		pluginConfigs = append(pluginConfigs, pc)
+	}
+	pluginConfigs, err = sortPluginConfigs(pluginConfigs, knownTags)
+	if err != nil {
+		return nil, err
+	}
 
+	for _, pc := range pluginConfigs {
 		m.logger.Info("loading plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
-		p, err := NewPlugin(&pc, m.logger, m)
+		lg, err := m.pluginLogger(pc.Tag, &pc.Log)
 		if err != nil {
-			return fmt.Errorf("failed to init plugin #%d, %w", i, err)
+			return nil, fmt.Errorf("failed to init logger of plugin %s, %w", pc.Tag, err)
+		}
+		p, err := NewPlugin(&pc, lg, m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init plugin %s, %w", pc.Tag, err)
 		}
 
 		m.addPlugin(p)
@@ -129,55 +255,78 @@ func RunMosdns(cfg *Config) error {
 		}
 	}
 
+	if err := m.startPlugins(); err != nil {
+		return nil, err
+	}
+	m.waitPluginsReady()
+
 	if len(cfg.Servers) == 0 {
-		return errors.New("no server is configured")
+		return nil, errors.New("no server is configured")
 	}
-	for i, sc := range cfg.Servers {
-		if err := m.startServers(&sc); err != nil {
-			return fmt.Errorf("failed to start server #%d, %w", i, err)
+	m.traceEntry = cfg.Servers[0].Exec
+	if err := m.initLimiter(&cfg.Limits); err != nil {
+		return nil, fmt.Errorf("failed to init limits, %w", err)
+	}
+	if tag := cfg.Failsafe.Exec; len(tag) > 0 {
+		m.failsafe = m.execs[tag]
+		if m.failsafe == nil {
+			return nil, fmt.Errorf("cannot find failsafe exec %s", tag)
 		}
+		m.failsafeTimeout = time.Duration(cfg.Failsafe.Timeout) * time.Second
 	}
-
-	// Start http api server
-	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
-		httpServer := &http.Server{
-			Addr:    httpAddr,
-			Handler: m.httpAPIMux,
+	for i, sc := range cfg.Servers {
+		if err := m.startServers(&sc); err != nil {
+			return nil, fmt.Errorf("failed to start server #%d, %w", i, err)
 		}
-		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
-			defer done()
-			errChan := make(chan error, 1)
-			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
-			}()
-			select {
-			case err := <-errChan:
-				m.sc.SendCloseSignal(err)
-			case <-closeSignal:
-				httpServer.Close()
-			}
-		})
 	}
+	return m, nil
+}
 
-	time.AfterFunc(time.Second*1, func() {
-		runtime.GC()
-		debug.FreeOSMemory()
-	})
-	<-m.sc.ReceiveCloseSignal()
+// close stops servers, then closes all plugins in the reverse init order,
+// then data providers of m. It can only be called once.
+func (m *Mosdns) close() {
+	m.sc.SendCloseSignal(nil)
 	m.sc.Done()
 	m.sc.CloseWait()
-	return m.sc.Err()
+	m.queryTail.Close()
+	m.closePlugins(pluginCloseTimeout)
+	m.dataManager.Close()
+	if m.limiter != nil {
+		m.limiter.Close()
+	}
+	if m.logs != nil {
+		m.logs.Close()
+	}
+}
+
+// Close stops servers and closes all plugins and data providers of a
+// Mosdns created by NewMosdns. It can only be called once.
+func (m *Mosdns) Close() {
+	m.close()
 }
 
 func (m *Mosdns) addPlugin(p Plugin) {
 	t := p.Tag()
+	m.plugins[t] = p
+	m.pluginOrder = append(m.pluginOrder, t)
 	if p, ok := p.(ExecutablePlugin); ok {
-		m.execs[t] = p
+		ie := &instrumentedExecutable{tag: t, e: p}
+		if m.pluginExecTotal != nil {
+			ie.execTotal = m.pluginExecTotal.WithLabelValues(t)
+		}
+		m.execs[t] = ie
 	}
 	if p, ok := p.(MatcherPlugin); ok {
-		m.matchers[p.Tag()] = p
+		m.matchers[t] = &tracedMatcher{tag: t, m: p}
+	}
+}
+
+// pluginLogger returns a new logger for plugin tag. c can be nil.
+func (m *Mosdns) pluginLogger(tag string, c *mlog.PluginLogConfig) (*zap.Logger, error) {
+	if m.logs == nil {
+		return m.logger, nil
 	}
+	return m.logs.PluginLogger(tag, c)
 }
 
 func (m *Mosdns) GetDataManager() *data_provider.DataManager {
@@ -188,6 +337,12 @@ func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
 	return m.sc
 }
 
+// GetPlugin returns the plugin that has the tag. Or nil if the plugin is
+// not found or not initialized yet.
+func (m *Mosdns) GetPlugin(tag string) Plugin {
+	return m.plugins[tag]
+}
+
 func (m *Mosdns) GetExecutables() map[string]executable_seq.Executable {
 	return m.execs
 }
@@ -196,6 +351,12 @@ func (m *Mosdns) GetMatchers() map[string]executable_seq.Matcher {
 	return m.matchers
 }
 
+// GetServerAddrs returns the bound addresses of server listeners, in
+// config order. It is useful when listeners are configured with port 0.
+func (m *Mosdns) GetServerAddrs() []net.Addr {
+	return m.serverAddrs
+}
+
 // GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_"
 func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
 	return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newPluginExecTotal() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plugin_exec_total",
+		Help: "The total number of executions of executable plugins",
+	}, []string{"plugin"})
+}
+
+// instrumentedExecutable counts the executions of an executable plugin,
+// and traces them if tracing of the query is enabled.
+type instrumentedExecutable struct {
+	tag       string
+	e         executable_seq.Executable
+	execTotal prometheus.Counter // may be nil
+}
+
+func (ie *instrumentedExecutable) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if ie.execTotal != nil {
+		ie.execTotal.Inc()
+	}
+	if !qCtx.TraceEnabled() {
+		return ie.e.Exec(ctx, qCtx, next)
+	}
+
+	qCtx.Tracef(ie.tag, "exec")
+	err := ie.e.Exec(ctx, qCtx, next)
+	switch r := qCtx.R(); {
+	case err != nil:
+		qCtx.Tracef(ie.tag, "returned err: %v", err)
+	case r == nil:
+		qCtx.Tracef(ie.tag, "returned, no response")
+	default:
+		qCtx.Tracef(ie.tag, "returned, response %s with %d answers", dns.RcodeToString[r.Rcode], len(r.Answer))
+	}
+	return err
+}
+
+// tracedMatcher traces the results of a matcher plugin if tracing of the
+// query is enabled.
+type tracedMatcher struct {
+	tag string
+	m   executable_seq.Matcher
+}
+
+func (tm *tracedMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	matched, err := tm.m.Match(ctx, qCtx)
+	if qCtx.TraceEnabled() {
+		switch {
+		case err != nil:
+			qCtx.Tracef(tm.tag, "match err: %v", err)
+		case matched:
+			qCtx.Tracef(tm.tag, "matched")
+		default:
+			qCtx.Tracef(tm.tag, "not matched")
+		}
+	}
+	return matched, err
+}
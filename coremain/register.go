@@ -91,30 +91,33 @@ func NewPlugin(c *PluginConfig, lg *zap.Logger, m *Mosdns) (p Plugin, err error)
 	if !ok {
 		return nil, fmt.Errorf("plugin type %s not defined", c.Type)
 	}
+	args, err := decodePluginArgs(c, typeInfo)
+	if err != nil {
+		return nil, err
+	}
+	return typeInfo.NewPlugin(NewBP(c.Tag, c.Type, lg, m), args)
+}
 
-	bp := NewBP(c.Tag, c.Type, lg, m)
-
-	// parse args
-	if typeInfo.NewArgs != nil {
-		args := typeInfo.NewArgs()
-		if m, ok := c.Args.(map[string]interface{}); ok {
-			if err = utils.WeakDecode(m, args); err != nil {
-				return nil, fmt.Errorf("unable to decode plugin args: %w", err)
-			}
-		} else if c.Args != nil {
-			tc := reflect.TypeOf(c.Args) // args type from config
-			tp := reflect.TypeOf(args)   // args type from plugin init func
-			if tc == tp {
-				args = c.Args
-			} else {
-				return nil, fmt.Errorf("invalid plugin args type, want %s, got %s", tp.String(), tc.String())
-			}
+// decodePluginArgs decodes c.Args to the args type of typeInfo.
+func decodePluginArgs(c *PluginConfig, typeInfo PluginTypeInfo) (interface{}, error) {
+	if typeInfo.NewArgs == nil {
+		return c.Args, nil
+	}
+	args := typeInfo.NewArgs()
+	if m, ok := c.Args.(map[string]interface{}); ok {
+		if err := utils.WeakDecode(m, args); err != nil {
+			return nil, fmt.Errorf("unable to decode plugin args: %w", err)
+		}
+	} else if c.Args != nil {
+		tc := reflect.TypeOf(c.Args) // args type from config
+		tp := reflect.TypeOf(args)   // args type from plugin init func
+		if tc == tp {
+			args = c.Args
+		} else {
+			return nil, fmt.Errorf("invalid plugin args type, want %s, got %s", tp.String(), tc.String())
 		}
-
-		return typeInfo.NewPlugin(bp, args)
 	}
-
-	return typeInfo.NewPlugin(bp, c.Args)
+	return args, nil
 }
 
 // GetAllPluginTypes returns all plugin types which are configurable.
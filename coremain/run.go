@@ -20,6 +20,7 @@
 package coremain
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/mlog"
 	"github.com/kardianos/service"
@@ -137,6 +138,24 @@ func loadConfig(filePath string) (*Config, string, error) {
 		return nil, "", fmt.Errorf("failed to read config: %w", err)
 	}
 
+	cfg, err := unmarshalConfig(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return cfg, v.ConfigFileUsed(), nil
+}
+
+// LoadConfigFromBytes loads a yaml config from b.
+func LoadConfigFromBytes(b []byte) (*Config, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return unmarshalConfig(v)
+}
+
+func unmarshalConfig(v *viper.Viper) (*Config, error) {
 	decoderOpt := func(cfg *mapstructure.DecoderConfig) {
 		cfg.ErrorUnused = true
 		cfg.TagName = "yaml"
@@ -145,9 +164,9 @@ func loadConfig(filePath string) (*Config, string, error) {
 
 	cfg := new(Config)
 	if err := v.Unmarshal(cfg, decoderOpt); err != nil {
-		return nil, "", fmt.Errorf("failed to unmarshal config: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
-	return cfg, v.ConfigFileUsed(), nil
+	return cfg, nil
 }
 
 func mergeInclude(cfg *Config, depth int, paths []string) error {
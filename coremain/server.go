@@ -22,12 +22,20 @@ package coremain
 import (
 	"errors"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/self_limit"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/http_handler"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/pires/go-proxyproto"
 	"go.uber.org/zap"
+	"io"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -59,21 +67,63 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 		Entry:              entry,
 		QueryTimeout:       queryTimeout,
 		RecursionAvailable: true,
+		EncryptedOnly:      cfg.EncryptedOnly,
+		Failsafe:           m.failsafe,
+		FailsafeTimeout:    m.failsafeTimeout,
+		Metrics:            m.queryMetrics,
+		TraceQueries:       cfg.TraceQueries,
+		Tail:               m.queryTail,
+	}
+	if cfg.PerfStats {
+		dnsHandlerOpts.PerfStats = m.perfStats
 	}
 	dnsHandler, err := dns_handler.NewEntryHandler(dnsHandlerOpts)
 	if err != nil {
 		return fmt.Errorf("failed to init entry handler, %w", err)
 	}
 
+	clientLimiter, err := newClientLimiter(&cfg.ClientLimits)
+	if err != nil {
+		return fmt.Errorf("invalid client limits, %w", err)
+	}
+
+	opcodeHandlers, err := m.newOpcodeHandlers(cfg.Opcodes, dnsHandlerOpts)
+	if err != nil {
+		return fmt.Errorf("failed to init opcode handlers, %w", err)
+	}
+
 	for _, lc := range cfg.Listeners {
-		if err := m.startServerListener(lc, dnsHandler); err != nil {
+		var h dns_handler.Handler = dnsHandler
+		if len(lc.SNI) > 0 {
+			h, err = m.newSNIRouter(lc.SNI, dnsHandler, dnsHandlerOpts)
+			if err != nil {
+				return fmt.Errorf("failed to init sni router, %w", err)
+			}
+		}
+		if len(opcodeHandlers) > 0 {
+			r := dns_handler.NewOpcodeRouter(h)
+			for opcode, oh := range opcodeHandlers {
+				if err := r.Add(opcode, oh); err != nil {
+					return err
+				}
+			}
+			h = r
+		}
+		if m.limiter != nil {
+			h = self_limit.NewHandler(h, m.limiter, m.lowPriorityQtypes)
+		}
+		if clientLimiter != nil {
+			h = clientLimiter.Handler(h)
+		}
+		if err := m.startServerListener(lc, h, clientLimiter); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_handler.Handler) error {
+// startServerListener starts the listener of cfg. clientLimiter can be nil.
+func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_handler.Handler, clientLimiter *server.ClientLimiter) error {
 	if len(cfg.Addr) == 0 {
 		return errors.New("no address to bind")
 	}
@@ -85,11 +135,16 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_h
 		idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
 	}
 
+	trustedProxies, err := parsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies, %w", err)
+	}
 	httpOpts := http_handler.HandlerOpts{
-		DNSHandler:  dnsHandler,
-		Path:        cfg.URLPath,
-		SrcIPHeader: cfg.GetUserIPFromHeader,
-		Logger:      m.logger,
+		DNSHandler:     dnsHandler,
+		Path:           cfg.URLPath,
+		SrcIPHeader:    cfg.GetUserIPFromHeader,
+		TrustedProxies: trustedProxies,
+		Logger:         m.logger,
 	}
 
 	httpHandler, err := http_handler.NewHandler(httpOpts)
@@ -98,67 +153,205 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_h
 	}
 
 	opts := server.ServerOpts{
-		DNSHandler:  dnsHandler,
-		HttpHandler: httpHandler,
-		Cert:        cfg.Cert,
-		Key:         cfg.Key,
-		IdleTimeout: idleTimeout,
-		Logger:      m.logger,
+		DNSHandler:         dnsHandler,
+		HttpHandler:        httpHandler,
+		IdleTimeout:        idleTimeout,
+		MaxInflightPerConn: cfg.MaxInflight,
+		Logger:             m.logger,
+	}
+	switch cfg.Protocol {
+	case "tls", "dot", "https", "doh", "quic", "doq":
+		certReloader, err := m.newCertReloader(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to load certificates, %w", err)
+		}
+		opts.TLSConfig = certReloader.TLSConfig()
+	case "dnscrypt":
+		opts.DNSCrypt, err = newDNSCryptOpts(cfg.DNSCrypt)
+		if err != nil {
+			return fmt.Errorf("invalid dnscrypt config, %w", err)
+		}
 	}
-	s := server.NewServer(opts)
+	var s *server.Server // created after the listeners were opened.
 
-	// helper func for proxy protocol listener
-	requirePP := func(_ net.Addr) (proxyproto.Policy, error) {
-		return proxyproto.REQUIRE, nil
+	ppPolicy, err := newProxyProtocolPolicy(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return err
+	}
+	listenTCP := func() (net.Listener, error) {
+		var l net.Listener
+		var err error
+		if cfg.TProxy {
+			l, err = server.ListenTProxyTCP(cfg.Addr)
+		} else {
+			l, err = net.Listen("tcp", cfg.Addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.limiter != nil {
+			l = m.limiter.Listener(l)
+		}
+		if clientLimiter != nil {
+			// Before the proxy protocol, reading its header would block
+			// the Accept loop. So max_conns limits the proxies.
+			l = clientLimiter.Listener(l)
+		}
+		if cfg.ProxyProtocol {
+			l = &proxyproto.Listener{Listener: l, Policy: ppPolicy}
+		}
+		return l, nil
 	}
 
 	var run func() error
+	var closer io.Closer // the listener
+	var onClose func()   // called after the listener was closed
 	switch cfg.Protocol {
 	case "", "udp":
+		if cfg.TProxy {
+			c, err := server.ListenTProxyUDP(cfg.Addr)
+			if err != nil {
+				return err
+			}
+			run = func() error { return s.ServeTProxyUDP(c) }
+			closer = c
+			m.serverAddrs = append(m.serverAddrs, c.LocalAddr())
+			break
+		}
 		conn, err := net.ListenPacket("udp", cfg.Addr)
 		if err != nil {
 			return err
 		}
+		if uc, ok := conn.(*net.UDPConn); ok {
+			if err := m.setupUDPListener(cfg, uc); err != nil {
+				conn.Close()
+				return fmt.Errorf("failed to set up udp socket, %w", err)
+			}
+			onClose = func() { m.udpStats.remove(uc) }
+		}
 		run = func() error { return s.ServeUDP(conn) }
+		closer = conn
+		m.serverAddrs = append(m.serverAddrs, conn.LocalAddr())
 	case "tcp":
-		l, err := net.Listen("tcp", cfg.Addr)
+		l, err := listenTCP()
 		if err != nil {
 			return err
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
-		}
 		run = func() error { return s.ServeTCP(l) }
+		if cfg.TProxy {
+			run = func() error { return s.ServeTProxyTCP(l) }
+		}
+		closer = l
+		m.serverAddrs = append(m.serverAddrs, l.Addr())
 	case "tls", "dot":
-		l, err := net.Listen("tcp", cfg.Addr)
+		l, err := listenTCP()
 		if err != nil {
 			return err
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
-		}
 		run = func() error { return s.ServeTLS(l) }
-	case "http":
-		l, err := net.Listen("tcp", cfg.Addr)
+		closer = l
+		m.serverAddrs = append(m.serverAddrs, l.Addr())
+	case "quic", "doq":
+		conn, err := net.ListenPacket("udp", cfg.Addr)
 		if err != nil {
 			return err
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+		run = func() error { return s.ServeQUIC(conn) }
+		closer = conn
+		m.serverAddrs = append(m.serverAddrs, conn.LocalAddr())
+	case "http":
+		l, err := listenTCP()
+		if err != nil {
+			return err
 		}
 		run = func() error { return s.ServeHTTP(l) }
+		closer = l
+		m.serverAddrs = append(m.serverAddrs, l.Addr())
 	case "https", "doh":
-		l, err := net.Listen("tcp", cfg.Addr)
+		l, err := listenTCP()
 		if err != nil {
 			return err
 		}
-		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+		m.serverAddrs = append(m.serverAddrs, l.Addr())
+		if !cfg.EnableHTTP3 {
+			run = func() error { return s.ServeHTTPS(l) }
+			closer = l
+			break
+		}
+
+		// HTTP/3 listens on the same port as the tcp listener.
+		h3Conn, err := net.ListenPacket("udp", l.Addr().String())
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("failed to open http3 listener, %w", err)
+		}
+		opts.AltSvc = fmt.Sprintf(`h3=":%d"; ma=86400`, h3Conn.LocalAddr().(*net.UDPAddr).Port)
+		run = func() error {
+			errChan := make(chan error, 2)
+			go func() { errChan <- s.ServeHTTP3(h3Conn) }()
+			go func() { errChan <- s.ServeHTTPS(l) }()
+			return <-errChan
+		}
+		closer = closerFunc(func() error {
+			h3Conn.Close()
+			return l.Close()
+		})
+	case "dnscrypt":
+		l, err := listenTCP()
+		if err != nil {
+			return err
+		}
+		// DNSCrypt listens on the same port for udp and tcp.
+		c, err := net.ListenPacket("udp", l.Addr().String())
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("failed to open udp listener, %w", err)
+		}
+		m.serverAddrs = append(m.serverAddrs, l.Addr())
+		stamp, err := server.DNSCryptStamp(opts.DNSCrypt, l.Addr().String())
+		if err != nil {
+			c.Close()
+			l.Close()
+			return fmt.Errorf("failed to create dnscrypt stamp, %w", err)
+		}
+		m.logger.Info("dnscrypt server stamp", zap.String("addr", cfg.Addr), zap.String("stamp", stamp))
+		run = func() error { return s.ServeDNSCrypt(c.(*net.UDPConn), l) }
+		closer = closerFunc(func() error {
+			c.Close()
+			return l.Close()
+		})
+	case "unix":
+		sockOpts, err := newUnixSocketOpts(cfg.UnixSocket)
+		if err != nil {
+			return fmt.Errorf("invalid unix socket config, %w", err)
+		}
+		var l net.Listener
+		l, err = server.ListenUnix(cfg.Addr, sockOpts)
+		if err != nil {
+			return err
+		}
+		if m.limiter != nil {
+			l = m.limiter.Listener(l)
+		}
+		run = func() error { return s.ServeTCP(l) }
+		closer = l
+		m.serverAddrs = append(m.serverAddrs, l.Addr())
+	case "unixgram":
+		sockOpts, err := newUnixSocketOpts(cfg.UnixSocket)
+		if err != nil {
+			return fmt.Errorf("invalid unix socket config, %w", err)
 		}
-		run = func() error { return s.ServeHTTPS(l) }
+		c, err := server.ListenUnixgram(cfg.Addr, sockOpts)
+		if err != nil {
+			return err
+		}
+		run = func() error { return s.ServeUDP(c) }
+		closer = c
+		m.serverAddrs = append(m.serverAddrs, c.LocalAddr())
 	default:
 		return fmt.Errorf("unknown protocol: [%s]", cfg.Protocol)
 	}
+	s = server.NewServer(opts)
 
 	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 		defer done()
@@ -170,8 +363,206 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler dns_h
 		case err := <-errChan:
 			m.sc.SendCloseSignal(fmt.Errorf("server exited, %w", err))
 		case <-closeSignal:
+			s.Close()
+			closer.Close()
+		}
+		if onClose != nil {
+			onClose()
 		}
 	})
 
 	return nil
 }
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func newUnixSocketOpts(cfg *UnixSocketConfig) (server.UnixSocketOpts, error) {
+	var opts server.UnixSocketOpts
+	if cfg == nil {
+		return opts, nil
+	}
+	if len(cfg.Mode) > 0 {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return opts, fmt.Errorf("invalid mode %s", cfg.Mode)
+		}
+		opts.Mode = os.FileMode(mode)
+	}
+	opts.Owner = cfg.Owner
+	opts.Group = cfg.Group
+	return opts, nil
+}
+
+// newClientLimiter returns nil if cfg has no limit.
+func newClientLimiter(cfg *ClientLimitsConfig) (*server.ClientLimiter, error) {
+	var drop bool
+	switch cfg.Action {
+	case "", "refuse":
+	case "drop":
+		drop = true
+	default:
+		return nil, fmt.Errorf("invalid action %s", cfg.Action)
+	}
+	if cfg.MaxConns <= 0 && cfg.MaxInflight <= 0 && cfg.QPS <= 0 {
+		return nil, nil
+	}
+	return server.NewClientLimiter(server.ClientLimiterOpts{
+		MaxConns:    cfg.MaxConns,
+		MaxInflight: cfg.MaxInflight,
+		QPS:         cfg.QPS,
+		Burst:       cfg.Burst,
+		Drop:        drop,
+	}), nil
+}
+
+// newDNSCryptOpts loads the provider key of cfg.
+func newDNSCryptOpts(cfg *DNSCryptConfig) (*server.DNSCryptOpts, error) {
+	if cfg == nil || len(cfg.ProviderName) == 0 {
+		return nil, errors.New("missing provider name")
+	}
+	if len(cfg.KeyFile) == 0 {
+		return nil, errors.New("missing key file")
+	}
+	opts := &server.DNSCryptOpts{
+		ProviderName: cfg.ProviderName,
+		CertTTL:      time.Duration(cfg.CertTTL) * time.Second,
+	}
+	switch strings.ToLower(cfg.EsVersion) {
+	case "", "xsalsa20poly1305":
+		opts.EsVersion = dnscrypt.XSalsa20Poly1305
+	case "xchacha20poly1305":
+		opts.EsVersion = dnscrypt.XChacha20Poly1305
+	default:
+		return nil, fmt.Errorf("unknown es version %s", cfg.EsVersion)
+	}
+	k, err := server.LoadOrGenerateDNSCryptKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	opts.PrivateKey = k
+	return opts, nil
+}
+
+// newOpcodeHandlers returns handlers of the opcode entries.
+func (m *Mosdns) newOpcodeHandlers(opcodes []*OpcodeConfig, opts dns_handler.EntryHandlerOpts) (map[int]dns_handler.Handler, error) {
+	hs := make(map[int]dns_handler.Handler)
+	for _, oc := range opcodes {
+		opcode, err := dns_handler.ParseOpcode(oc.Opcode)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := hs[opcode]; dup {
+			return nil, fmt.Errorf("duplicated opcode %s", oc.Opcode)
+		}
+		entry := m.execs[oc.Exec]
+		if entry == nil {
+			return nil, fmt.Errorf("cannot find entry %s", oc.Exec)
+		}
+		opts.Entry = entry
+		h, err := dns_handler.NewEntryHandler(opts)
+		if err != nil {
+			return nil, err
+		}
+		hs[opcode] = h
+	}
+	return hs, nil
+}
+
+// newSNIRouter returns a handler that routes queries to the entries of sni
+// by the client's tls server name.
+func (m *Mosdns) newSNIRouter(sni []*SNIConfig, defaultHandler dns_handler.Handler, opts dns_handler.EntryHandlerOpts) (*dns_handler.SNIRouter, error) {
+	r := dns_handler.NewSNIRouter(defaultHandler)
+	for _, sc := range sni {
+		h := defaultHandler
+		if len(sc.Exec) > 0 {
+			entry := m.execs[sc.Exec]
+			if entry == nil {
+				return nil, fmt.Errorf("cannot find entry %s", sc.Exec)
+			}
+			opts.Entry = entry
+			eh, err := dns_handler.NewEntryHandler(opts)
+			if err != nil {
+				return nil, err
+			}
+			h = eh
+		}
+		if err := r.Add(sc.ServerName, h); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// newCertReloader loads the default certificate and certificates of cfg.SNI.
+// The default certificate comes first so it is used when the client sends
+// no server name or no certificate matches. Certificates are reloaded
+// when their files change or mosdns receives a SIGHUP.
+func (m *Mosdns) newCertReloader(cfg *ServerListenerConfig) (*server.CertReloader, error) {
+	var files []server.CertFile
+	if len(cfg.Cert)+len(cfg.Key) != 0 {
+		files = append(files, server.CertFile{Cert: cfg.Cert, Key: cfg.Key})
+	}
+	for _, sc := range cfg.SNI {
+		if len(sc.Cert)+len(sc.Key) == 0 {
+			continue
+		}
+		files = append(files, server.CertFile{Cert: sc.Cert, Key: sc.Key})
+	}
+	r, err := server.NewCertReloader(files, m.logger)
+	if err != nil {
+		return nil, err
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		<-closeSignal
+		r.Close()
+	})
+	return r, nil
+}
+
+// parsePrefixes parses IPs or CIDRs in s.
+// newProxyProtocolPolicy returns a proxyproto.PolicyFunc that requires
+// the PROXY header from trusted peers and rejects it from others.
+// All peers are trusted if trusted is empty.
+func newProxyProtocolPolicy(trusted []string) (proxyproto.PolicyFunc, error) {
+	prefixes, err := parsePrefixes(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol trusted proxies, %w", err)
+	}
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		if len(prefixes) == 0 {
+			return proxyproto.REQUIRE, nil
+		}
+		addr := utils.GetAddrFromAddr(upstream).Unmap()
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return proxyproto.REQUIRE, nil
+			}
+		}
+		return proxyproto.REJECT, nil
+	}, nil
+}
+
+func parsePrefixes(s []string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, v := range s {
+		if strings.ContainsRune(v, '/') {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return ps, nil
+}
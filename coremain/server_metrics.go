@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	udpRcvBufDesc = prometheus.NewDesc(
+		"server_udp_rcvbuf_bytes",
+		"Effective receive buffer size of the udp listener socket",
+		[]string{"listener"}, nil,
+	)
+	udpSndBufDesc = prometheus.NewDesc(
+		"server_udp_sndbuf_bytes",
+		"Effective send buffer size of the udp listener socket",
+		[]string{"listener"}, nil,
+	)
+	udpDropsDesc = prometheus.NewDesc(
+		"server_udp_drops_total",
+		"The total number of datagrams dropped by the kernel on the udp listener socket",
+		[]string{"listener"}, nil,
+	)
+)
+
+// udpStatsCollector exports kernel stats of all udp listener sockets.
+// Series are labeled by the listener address.
+type udpStatsCollector struct {
+	logger *zap.Logger
+
+	m     sync.Mutex
+	conns map[*net.UDPConn]string // listener addresses
+}
+
+func newUDPStatsCollector(logger *zap.Logger) *udpStatsCollector {
+	return &udpStatsCollector{logger: logger, conns: make(map[*net.UDPConn]string)}
+}
+
+func (u *udpStatsCollector) add(addr string, c *net.UDPConn) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.conns[c] = addr
+}
+
+func (u *udpStatsCollector) remove(c *net.UDPConn) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	delete(u.conns, c)
+}
+
+func (u *udpStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- udpRcvBufDesc
+	ch <- udpSndBufDesc
+	ch <- udpDropsDesc
+}
+
+func (u *udpStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	for c, addr := range u.conns {
+		stats, err := server.GetUDPSocketStats(c)
+		if err != nil {
+			u.logger.Debug("failed to read udp socket stats", zap.String("addr", addr), zap.Error(err))
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(udpRcvBufDesc, prometheus.GaugeValue, float64(stats.RcvBuf), addr)
+		ch <- prometheus.MustNewConstMetric(udpSndBufDesc, prometheus.GaugeValue, float64(stats.SndBuf), addr)
+		ch <- prometheus.MustNewConstMetric(udpDropsDesc, prometheus.CounterValue, float64(stats.Drops), addr)
+	}
+}
+
+// setupUDPListener applies the socket buffer settings of cfg to c and
+// exports its kernel stats if the platform supports it. The caller must
+// call m.udpStats.remove(c) once c is closed.
+func (m *Mosdns) setupUDPListener(cfg *ServerListenerConfig, c *net.UDPConn) error {
+	if err := server.SetUDPSocketBuffers(c, cfg.UDPRcvBuf, cfg.UDPSndBuf); err != nil {
+		return err
+	}
+
+	stats, err := server.GetUDPSocketStats(c)
+	if err != nil {
+		m.logger.Debug("udp socket stats is unavailable", zap.String("addr", cfg.Addr), zap.Error(err))
+		return nil
+	}
+	if cfg.UDPRcvBuf > 0 && stats.RcvBuf < cfg.UDPRcvBuf {
+		m.logger.Warn(
+			"udp receive buffer is smaller than configured, check net.core.rmem_max",
+			zap.String("addr", cfg.Addr),
+			zap.Int("configured", cfg.UDPRcvBuf),
+			zap.Int("effective", stats.RcvBuf),
+		)
+	}
+	if cfg.UDPSndBuf > 0 && stats.SndBuf < cfg.UDPSndBuf {
+		m.logger.Warn(
+			"udp send buffer is smaller than configured, check net.core.wmem_max",
+			zap.String("addr", cfg.Addr),
+			zap.Int("configured", cfg.UDPSndBuf),
+			zap.Int("effective", stats.SndBuf),
+		)
+	}
+
+	m.udpStats.add(cfg.Addr, c)
+	return nil
+}
+
+// handlePerfStats writes the summary of server query statistics in
+// dnsperf or resperf format, depending on the request path.
+// If the request has a "reset" query, the statistics will be reset after
+// the summary is written.
+func (m *Mosdns) handlePerfStats(w http.ResponseWriter, req *http.Request) {
+	sum := m.perfStats.Summary()
+	if req.URL.Query().Has("reset") {
+		m.perfStats.Reset()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var err error
+	if req.URL.Path == "/stats/resperf" {
+		err = sum.WriteResperf(w)
+	} else {
+		err = sum.WriteDnsperf(w)
+	}
+	if err != nil {
+		m.logger.Warn("failed to write perf stats", zap.Error(err))
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"testing"
+)
+
+func TestMosdns_setupUDPListener_metrics(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(nil)
+
+	listen := func() *net.UDPConn {
+		t.Helper()
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	c1, c2 := listen(), listen()
+	if _, err := server.GetUDPSocketStats(c1); err != nil {
+		t.Skipf("udp socket stats is unavailable, %v", err)
+	}
+
+	for _, c := range []*net.UDPConn{c1, c2} {
+		cfg := &ServerListenerConfig{Addr: c.LocalAddr().String()}
+		if err := m.setupUDPListener(cfg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countDropSeries := func() int {
+		t.Helper()
+		mfs, err := m.metricsReg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == "mosdns_server_udp_drops_total" {
+				return len(mf.GetMetric())
+			}
+		}
+		return 0
+	}
+	if n := countDropSeries(); n != 2 {
+		t.Fatalf("want drop stats of 2 listeners, got %d", n)
+	}
+	m.udpStats.remove(c1)
+	if n := countDropSeries(); n != 1 {
+		t.Fatalf("want drop stats of 1 listener after removal, got %d", n)
+	}
+}
+
+type execPlugin struct {
+	*BP
+}
+
+func (p *execPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func TestMosdns_addPlugin_execMetrics(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(nil)
+	m.pluginExecTotal = newPluginExecTotal()
+	m.addPlugin(&execPlugin{BP: NewBP("e", "", nil, m)})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if err := m.execs["e"].Exec(context.Background(), query_context.NewContext(q, nil), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(m.pluginExecTotal.WithLabelValues("e")); got != 2 {
+		t.Fatalf("plugin_exec_total{plugin=e} = %v, want 2", got)
+	}
+}
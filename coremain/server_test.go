@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"github.com/pires/go-proxyproto"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func Test_newProxyProtocolPolicy(t *testing.T) {
+	tcpAddr := func(s string) net.Addr {
+		return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+	}
+	tests := []struct {
+		name     string
+		trusted  []string
+		upstream string
+		want     proxyproto.Policy
+	}{
+		{"all trusted", nil, "1.1.1.1:53", proxyproto.REQUIRE},
+		{"trusted cidr", []string{"10.0.0.0/8"}, "10.1.1.1:53", proxyproto.REQUIRE},
+		{"trusted ip", []string{"10.0.0.0/8", "::1"}, "[::1]:53", proxyproto.REQUIRE},
+		{"mapped addr", []string{"10.0.0.0/8"}, "[::ffff:10.1.1.1]:53", proxyproto.REQUIRE},
+		{"direct client", []string{"10.0.0.0/8"}, "1.1.1.1:53", proxyproto.REJECT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newProxyProtocolPolicy(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := f(tcpAddr(tt.upstream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("want policy %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := newProxyProtocolPolicy([]string{"not an ip"}); err == nil {
+		t.Fatal("want an error for invalid trusted proxies")
+	}
+}
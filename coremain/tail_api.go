@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_tail"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query tail api endpoint:
+//
+//	GET /queries/tail?client=192.168.1.0/24&domain=example.com&rcode=NXDOMAIN
+//
+// streams completed queries as json objects over a WebSocket (if the
+// request is a WebSocket upgrade) or Server-Sent Events. All filters are
+// optional. "client" is an ip or a prefix, "domain" also matches sub
+// domains, "rcode" is a rcode name or number, or NORESPONSE for dropped
+// queries. Slow clients lose events. Cross-origin WebSocket requests are
+// rejected.
+
+const (
+	queryTailBufSize      = 256
+	queryTailPingInterval = time.Second * 15
+)
+
+func (m *Mosdns) handleQueryTail(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := parseTailFilter(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{
+			Handshake: checkSameOrigin,
+			Handler: func(ws *websocket.Conn) {
+				m.tailWebSocket(ws, f)
+			},
+		}.ServeHTTP(w, req)
+		return
+	}
+	m.tailSSE(w, req, f)
+}
+
+// checkSameOrigin rejects cross-origin WebSocket requests. Browsers do not
+// apply CORS to WebSockets, without it any web page could read queries.
+// Requests without an Origin header are from non-browser clients.
+func checkSameOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin != nil && !strings.EqualFold(origin.Host, req.Host) {
+		return fmt.Errorf("cross-origin request from %s", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+func parseTailFilter(req *http.Request) (query_tail.Filter, error) {
+	var f query_tail.Filter
+	query := req.URL.Query()
+	if s := query.Get("client"); len(s) > 0 {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return f, fmt.Errorf("invalid client, %w", err)
+			}
+			f.Client = p.Masked()
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return f, fmt.Errorf("invalid client, %w", err)
+			}
+			f.Client = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+	if s := query.Get("domain"); len(s) > 0 {
+		f.Domain = dns.Fqdn(s)
+	}
+	if s := query.Get("rcode"); len(s) > 0 {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			n, err := strconv.ParseUint(s, 10, 12)
+			switch {
+			case err == nil:
+				rcode = int(n)
+			case strings.EqualFold(s, "NORESPONSE"):
+				rcode = -1
+			default:
+				return f, fmt.Errorf("invalid rcode %s", s)
+			}
+		}
+		f.Rcode = &rcode
+	}
+	return f, nil
+}
+
+func (m *Mosdns) tailSSE(w http.ResponseWriter, req *http.Request, f query_tail.Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	s := m.queryTail.Subscribe(f, queryTailBufSize)
+	defer m.queryTail.Unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(queryTailPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-s.C():
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				m.logger.Warn("failed to marshal query event", zap.Error(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+		case <-ticker.C:
+			// Comments keep the connection alive, and detect dead clients.
+			if _, err := fmt.Fprintf(w, ": ping, dropped %d\n\n", s.Dropped()); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (m *Mosdns) tailWebSocket(ws *websocket.Conn, f query_tail.Filter) {
+	defer ws.Close()
+	s := m.queryTail.Subscribe(f, queryTailBufSize)
+	defer m.queryTail.Unsubscribe(s)
+
+	// Messages from the client are ignored. Reading detects the closed
+	// connection.
+	clientClosed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, ws)
+		close(clientClosed)
+	}()
+
+	for {
+		select {
+		case e, ok := <-s.C():
+			if !ok {
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(queryTailPingInterval))
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-clientClosed:
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_tail"
+	"github.com/miekg/dns"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishUntilActive waits for a subscriber and publishes a query of each
+// name to m.
+func publishUntilActive(t *testing.T, m *Mosdns, names ...string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); !m.queryTail.Active(); time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatal("no subscriber")
+		}
+	}
+	for _, name := range names {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("127.0.0.1")})
+		r := new(dns.Msg)
+		r.SetReply(q)
+		m.queryTail.Publish(query_tail.NewEvent(qCtx, r, nil))
+	}
+}
+
+func newTestTailServer(t *testing.T) (*Mosdns, *httptest.Server) {
+	m := NewTestMosdnsWithPlugins(nil)
+	srv := httptest.NewServer(http.HandlerFunc(m.handleQueryTail))
+	t.Cleanup(srv.Close)
+	return m, srv
+}
+
+func TestMosdns_handleQueryTail(t *testing.T) {
+	_, srv := newTestTailServer(t)
+	for _, query := range []string{"client=bad", "client=127.0.0.1/33", "rcode=bad"} {
+		resp, err := http.Get(srv.URL + "/queries/tail?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: want code 400, got %d", query, resp.StatusCode)
+		}
+	}
+
+	t.Run("sse", func(t *testing.T) {
+		m, srv := newTestTailServer(t)
+		resp, err := http.Get(srv.URL + "/queries/tail?domain=example.com&client=127.0.0.0/8&rcode=noerror")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("unexpected content type %s", ct)
+		}
+		publishUntilActive(t, m, "example.org.", "www.example.com.")
+
+		br := bufio.NewReader(resp.Body)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e query_tail.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Qname != "www.example.com." || e.Rcode != "NOERROR" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		m, srv := newTestTailServer(t)
+		wsURL := strings.Replace(srv.URL, "http", "ws", 1) + "/queries/tail"
+		if _, err := websocket.Dial(wsURL, "", "http://evil.example"); err == nil {
+			t.Fatal("cross-origin request should be rejected")
+		}
+
+		ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/queries/tail?rcode=0", "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		publishUntilActive(t, m, "example.org.")
+
+		var e query_tail.Event
+		if err := websocket.JSON.Receive(ws, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Qname != "example.org." || e.Client != "127.0.0.1" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/perf_stats"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_tail"
+	"github.com/IrineSistiana/mosdns/v4/pkg/safe_close"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// NewTestMosdnsWithPlugins returns a *Mosdns that only has plugins in p.
+// It is used by plugin tests that need a *Mosdns, e.g. to look up other
+// plugins or to register metrics.
+func NewTestMosdnsWithPlugins(p map[string]Plugin) *Mosdns {
+	m := &Mosdns{
+		logger:      zap.NewNop(),
+		dataManager: data_provider.NewDataManager(),
+		plugins:     make(map[string]Plugin),
+		execs:       make(map[string]executable_seq.Executable),
+		matchers:    make(map[string]executable_seq.Matcher),
+		httpAPIMux:  http.NewServeMux(),
+		metricsReg:  newMetricsReg(),
+		perfStats:   perf_stats.NewStats(),
+		queryTail:   query_tail.NewHub(),
+		sc:          safe_close.NewSafeClose(),
+	}
+	m.udpStats = newUDPStatsCollector(m.logger)
+	m.GetMetricsReg().MustRegister(m.udpStats)
+	for tag, p := range p {
+		m.plugins[tag] = p
+		if p, ok := p.(ExecutablePlugin); ok {
+			m.execs[tag] = p
+		}
+		if p, ok := p.(MatcherPlugin); ok {
+			m.matchers[tag] = p
+		}
+	}
+	return m
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Trace api endpoint:
+//
+//	GET /debug/trace?name=example.com&type=AAAA&client=192.168.1.2&exec=main
+//
+// executes a query and reports the trace of it, i.e. which plugins were
+// executed, which matchers matched and how long it took. "type" defaults
+// to A, "client" (the client address seen by plugins) is optional and
+// "exec" defaults to the exec of the first server.
+
+const traceQueryTimeout = time.Second * 5
+
+type traceResult struct {
+	Query    string   `json:"query"`
+	Exec     string   `json:"exec"`
+	Rcode    string   `json:"rcode,omitempty"`
+	Response string   `json:"response,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Trace    []string `json:"trace"`
+}
+
+func (m *Mosdns) handleTrace(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	name := query.Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if s := query.Get("type"); len(s) > 0 {
+		t, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+		qtype = t
+	}
+	meta := new(query_context.RequestMeta)
+	if s := query.Get("client"); len(s) > 0 {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+		meta.ClientAddr = addr
+	}
+	tag := query.Get("exec")
+	if len(tag) == 0 {
+		tag = m.traceEntry
+	}
+	entry := m.execs[tag]
+	if entry == nil {
+		http.Error(w, "exec not found", http.StatusNotFound)
+		return
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	ctx, cancel := context.WithTimeout(req.Context(), traceQueryTimeout)
+	defer cancel()
+	qCtx, err := dns_handler.ExecTrace(ctx, entry, q, meta)
+
+	res := traceResult{Query: q.Question[0].Name + " " + dns.TypeToString[qtype], Exec: tag, Trace: []string{}}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	if r := qCtx.R(); r != nil {
+		res.Rcode = dns.RcodeToString[r.Rcode]
+		res.Response = r.String()
+	}
+	for _, e := range qCtx.Trace() {
+		res.Trace = append(res.Trace, e.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		m.logger.Warn("failed to write trace", zap.Error(err))
+	}
+}
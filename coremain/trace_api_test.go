@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type matchPlugin struct {
+	*BP
+}
+
+func (p *matchPlugin) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	return qCtx.ReqMeta().ClientAddr.IsLoopback(), nil
+}
+
+// routePlugin executes "e" and answers NXDOMAIN if "m" matches.
+type routePlugin struct {
+	*BP
+}
+
+func (p *routePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	matched, err := p.M().GetMatchers()["m"].Match(ctx, qCtx)
+	if err != nil {
+		return err
+	}
+	if matched {
+		if err := p.M().GetExecutables()["e"].Exec(ctx, qCtx, nil); err != nil {
+			return err
+		}
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+func TestMosdns_handleTrace(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(nil)
+	m.addPlugin(&execPlugin{BP: NewBP("e", "", nil, m)})
+	m.addPlugin(&matchPlugin{BP: NewBP("m", "", nil, m)})
+	m.addPlugin(&routePlugin{BP: NewBP("main", "", nil, m)})
+	m.traceEntry = "main"
+
+	do := func(query string, wantCode int) traceResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		m.handleTrace(w, httptest.NewRequest(http.MethodGet, "/debug/trace?"+query, nil))
+		if w.Code != wantCode {
+			t.Fatalf("%s: want code %d, got %d", query, wantCode, w.Code)
+		}
+		var res traceResult
+		if wantCode == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res
+	}
+
+	do("", http.StatusBadRequest)
+	do("name=example.com&type=bad", http.StatusBadRequest)
+	do("name=example.com&client=bad", http.StatusBadRequest)
+	do("name=example.com&exec=none", http.StatusNotFound)
+
+	res := do("name=example.com&type=aaaa&client=127.0.0.1", http.StatusOK)
+	if res.Query != "example.com. AAAA" || res.Exec != "main" || res.Rcode != "NXDOMAIN" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	want := []string{"main: exec", "m: matched", "e: exec", "e: returned, no response", "main: returned, response NXDOMAIN with 0 answers"}
+	if len(res.Trace) != len(want) {
+		t.Fatalf("want trace %v, got %v", want, res.Trace)
+	}
+	for i := range want {
+		if !strings.HasSuffix(res.Trace[i], want[i]) {
+			t.Fatalf("want trace %v, got %v", want, res.Trace)
+		}
+	}
+
+	res = do("name=example.com&client=192.0.2.1", http.StatusOK)
+	if res.Rcode != "" || len(res.Trace) != 3 || !strings.HasSuffix(res.Trace[1], "m: not matched") {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
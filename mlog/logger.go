@@ -63,26 +63,35 @@ func NewLogger(lc *LogConfig) (*zap.Logger, error) {
 }
 
 func newLoggerFromCfg(lc *LogConfig) (*zap.Logger, error) {
-	var out zapcore.WriteSyncer
-	if lf := lc.File; len(lf) > 0 {
-		f, _, err := zap.Open(lf)
-		if err != nil {
-			return nil, fmt.Errorf("open log file: %w", err)
-		}
-		out = zapcore.Lock(f)
-	} else {
-		out = stderr
+	out, _, err := openOutput(lc.File)
+	if err != nil {
+		return nil, err
+	}
+	return zap.New(zapcore.NewCore(newEncoder(lc), out, lc.lvl)), nil
+}
+
+// openOutput opens the log file. Empty file means stderr, in which case
+// the returned close func is nil.
+func openOutput(file string) (zapcore.WriteSyncer, func(), error) {
+	if len(file) == 0 {
+		return stderr, nil, nil
 	}
+	f, closeFile, err := zap.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open log file: %w", err)
+	}
+	return zapcore.Lock(f), closeFile, nil
+}
 
+func newEncoder(lc *LogConfig) zapcore.Encoder {
 	ec := defaultEncoderConfig()
 	if lc.OmitTime {
 		ec.TimeKey = ""
 	}
-
 	if lc.Production {
-		return newLogger(zapcore.NewJSONEncoder, ec, lc.lvl, out), nil
+		return zapcore.NewJSONEncoder(ec)
 	}
-	return newLogger(zapcore.NewConsoleEncoder, ec, lc.lvl, out), nil
+	return zapcore.NewConsoleEncoder(ec)
 }
 
 func newLogger(
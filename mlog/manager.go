@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// PluginLogConfig configures the logger of a plugin.
+type PluginLogConfig struct {
+	// Level overrides the global level for this plugin.
+	// Default is the global level.
+	Level string `yaml:"level"`
+
+	// File that logs of this plugin will be written into, instead of the
+	// global log output.
+	File string `yaml:"file"`
+}
+
+// Manager builds the logger of mosdns and the loggers of plugins.
+// Their levels can be changed at runtime.
+type Manager struct {
+	l       *zap.Logger
+	lvl     zap.AtomicLevel
+	encoder zapcore.Encoder
+	out     zapcore.WriteSyncer
+
+	mu      sync.Mutex
+	plugins map[string]*pluginLevel
+	files   map[string]zapcore.WriteSyncer // opened plugin log files
+	closers []func()
+}
+
+// NewManager creates a Manager from lc.
+func NewManager(lc *LogConfig) (*Manager, error) {
+	lvl, err := zapcore.ParseLevel(lc.Level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	out, closeFile, err := openOutput(lc.File)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		lvl:     zap.NewAtomicLevelAt(lvl),
+		encoder: newEncoder(lc),
+		out:     out,
+		plugins: make(map[string]*pluginLevel),
+		files:   make(map[string]zapcore.WriteSyncer),
+	}
+	if closeFile != nil {
+		m.closers = append(m.closers, closeFile)
+	}
+	m.l = zap.New(zapcore.NewCore(m.encoder, m.out, m.lvl))
+	return m, nil
+}
+
+// L returns the global logger.
+func (m *Manager) L() *zap.Logger {
+	return m.l
+}
+
+// Level returns the global level.
+func (m *Manager) Level() zapcore.Level {
+	return m.lvl.Level()
+}
+
+// SetLevel sets the global level. Plugins that have their own level are
+// not affected.
+func (m *Manager) SetLevel(l zapcore.Level) {
+	m.lvl.SetLevel(l)
+}
+
+// PluginLogger returns a new logger for plugin tag. c can be nil.
+// The returned logger is not named, see coremain.NewBP.
+func (m *Manager) PluginLogger(tag string, c *PluginLogConfig) (*zap.Logger, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pl := &pluginLevel{global: m.lvl, lvl: levelUnset}
+	out := m.out
+	if c != nil {
+		if len(c.Level) > 0 {
+			l, err := zapcore.ParseLevel(c.Level)
+			if err != nil {
+				return nil, fmt.Errorf("invalid log level: %w", err)
+			}
+			pl.set(&l)
+		}
+		if len(c.File) > 0 {
+			f, ok := m.files[c.File]
+			if !ok {
+				var closeFile func()
+				var err error
+				f, closeFile, err = openOutput(c.File)
+				if err != nil {
+					return nil, err
+				}
+				m.files[c.File] = f
+				m.closers = append(m.closers, closeFile)
+			}
+			out = f
+		}
+	}
+	m.plugins[tag] = pl
+	return zap.New(zapcore.NewCore(m.encoder, out, pl)), nil
+}
+
+// SetPluginLevel overrides the level of plugin tag. A nil l resets the
+// plugin to the global level. It returns an error if tag has no logger.
+func (m *Manager) SetPluginLevel(tag string, l *zapcore.Level) error {
+	m.mu.Lock()
+	pl := m.plugins[tag]
+	m.mu.Unlock()
+	if pl == nil {
+		return fmt.Errorf("plugin %s has no logger", tag)
+	}
+	pl.set(l)
+	return nil
+}
+
+// PluginLevels returns the levels of plugins that have their own level.
+func (m *Manager) PluginLevels() map[string]zapcore.Level {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]zapcore.Level)
+	for tag, pl := range m.plugins {
+		if l, ok := pl.get(); ok {
+			res[tag] = l
+		}
+	}
+	return res
+}
+
+// PluginTags returns the sorted tags of plugins that have a logger.
+func (m *Manager) PluginTags() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tags := make([]string, 0, len(m.plugins))
+	for tag := range m.plugins {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Close syncs loggers and closes log files.
+func (m *Manager) Close() {
+	_ = m.l.Sync()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.files {
+		_ = f.Sync()
+	}
+	for _, closeFile := range m.closers {
+		closeFile()
+	}
+	m.closers = nil
+}
+
+const levelUnset = math.MinInt32
+
+// pluginLevel is a zapcore.LevelEnabler that uses its own level if it
+// is set, otherwise the global level.
+type pluginLevel struct {
+	global zap.AtomicLevel
+	lvl    int32 // levelUnset if the plugin uses the global level.
+}
+
+func (p *pluginLevel) Enabled(l zapcore.Level) bool {
+	if own := atomic.LoadInt32(&p.lvl); own != levelUnset {
+		return l >= zapcore.Level(own)
+	}
+	return p.global.Enabled(l)
+}
+
+func (p *pluginLevel) set(l *zapcore.Level) {
+	if l == nil {
+		atomic.StoreInt32(&p.lvl, levelUnset)
+		return
+	}
+	atomic.StoreInt32(&p.lvl, int32(*l))
+}
+
+func (p *pluginLevel) get() (zapcore.Level, bool) {
+	own := atomic.LoadInt32(&p.lvl)
+	return zapcore.Level(own), own != levelUnset
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"go.uber.org/zap/zapcore"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	global := filepath.Join(dir, "global.log")
+	m, err := NewManager(&LogConfig{Level: "info", File: global})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := m.PluginLogger("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bFile := filepath.Join(dir, "b.log")
+	b, err := m.PluginLogger("b", &PluginLogConfig{Level: "debug", File: bFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.PluginLogger("c", &PluginLogConfig{Level: "bad"}); err == nil {
+		t.Fatal("want an error for invalid level")
+	}
+
+	a.Debug("a debug 1")
+	a.Info("a info 1")
+	b.Debug("b debug 1")
+
+	m.SetLevel(zapcore.DebugLevel)
+	a.Debug("a debug 2")
+	warn := zapcore.WarnLevel
+	if err := m.SetPluginLevel("b", &warn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPluginLevel("none", &warn); err == nil {
+		t.Fatal("want an error for unknown plugin")
+	}
+	b.Info("b info 2")
+	if lvls := m.PluginLevels(); len(lvls) != 1 || lvls["b"] != zapcore.WarnLevel {
+		t.Fatalf("unexpected plugin levels %v", lvls)
+	}
+	if err := m.SetPluginLevel("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Debug("b debug 3")
+	m.Close()
+
+	read := func(f string) string {
+		t.Helper()
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	gl, bl := read(global), read(bFile)
+	for _, s := range []string{"a info 1", "a debug 2"} {
+		if !strings.Contains(gl, s) {
+			t.Fatalf("global log missing %q: %s", s, gl)
+		}
+	}
+	for _, s := range []string{"a debug 1", "b debug"} {
+		if strings.Contains(gl, s) {
+			t.Fatalf("global log has unexpected %q: %s", s, gl)
+		}
+	}
+	if !strings.Contains(bl, "b debug 1") || strings.Contains(bl, "b info 2") || !strings.Contains(bl, "b debug 3") {
+		t.Fatalf("unexpected plugin log: %s", bl)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package batch_queue
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"sync"
+)
+
+type Opts struct {
+	Size     int // Max number of pending items. Default is 1024.
+	Workers  int // Default is 1.
+	MaxBatch int // Max number of items passed to the handler at once. Default is 256.
+}
+
+func (opts *Opts) init() {
+	utils.SetDefaultNum(&opts.Size, 1024)
+	utils.SetDefaultNum(&opts.Workers, 1)
+	utils.SetDefaultNum(&opts.MaxBatch, 256)
+}
+
+// Queue is a bounded queue that is processed by a pool of workers.
+// Items that are already pending in the queue are deduplicated.
+// Workers take all pending items, up to Opts.MaxBatch, at once, so
+// the handler can process them in one batch.
+type Queue[T comparable] struct {
+	opts Opts
+	h    func(batch []T)
+
+	c chan T
+
+	pm      sync.Mutex
+	pending map[T]struct{}
+	closed  bool
+
+	wg sync.WaitGroup
+}
+
+// New starts the workers of a new Queue. h is called by the workers
+// concurrently if Opts.Workers > 1.
+func New[T comparable](opts Opts, h func(batch []T)) *Queue[T] {
+	opts.init()
+	q := &Queue[T]{
+		opts:    opts,
+		h:       h,
+		c:       make(chan T, opts.Size),
+		pending: make(map[T]struct{}),
+	}
+	q.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Push adds v to the queue. It never blocks. It returns false if v
+// was dropped because the queue is full or closed. If v is already
+// pending, it is not added again and Push returns true.
+func (q *Queue[T]) Push(v T) bool {
+	q.pm.Lock()
+	defer q.pm.Unlock()
+	if q.closed {
+		return false
+	}
+	if _, ok := q.pending[v]; ok {
+		return true
+	}
+	select {
+	case q.c <- v:
+		q.pending[v] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+// Len returns the number of pending items.
+func (q *Queue[T]) Len() int {
+	q.pm.Lock()
+	defer q.pm.Unlock()
+	return len(q.pending)
+}
+
+func (q *Queue[T]) worker() {
+	defer q.wg.Done()
+	batch := make([]T, 0, q.opts.MaxBatch)
+	for v := range q.c {
+		batch = append(batch[:0], v)
+	collect:
+		for len(batch) < q.opts.MaxBatch {
+			select {
+			case v, ok := <-q.c:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, v)
+			default:
+				break collect
+			}
+		}
+
+		// Remove items from pending before the handler is called. So
+		// items that were pushed during the call will be handled again.
+		q.pm.Lock()
+		for _, v := range batch {
+			delete(q.pending, v)
+		}
+		q.pm.Unlock()
+		q.h(batch)
+	}
+}
+
+// Shutdown stops accepting new items and waits until all pending
+// items were handled or ctx is done.
+func (q *Queue[T]) Shutdown(ctx context.Context) error {
+	q.pm.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.c)
+	}
+	q.pm.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
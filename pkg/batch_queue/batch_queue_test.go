@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package batch_queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	block := make(chan struct{})
+	var mu sync.Mutex
+	var batches [][]int
+	q := New(Opts{Size: 4, MaxBatch: 3}, func(batch []int) {
+		<-block
+		mu.Lock()
+		batches = append(batches, append([]int(nil), batch...))
+		mu.Unlock()
+	})
+
+	// The worker takes the first item and blocks in the handler.
+	q.Push(0)
+	for q.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, v := range []int{1, 2, 1, 3, 4} {
+		if !q.Push(v) {
+			t.Fatalf("item %d was dropped", v)
+		}
+	}
+	if q.Len() != 4 {
+		t.Fatalf("pending items = %d, want 4", q.Len())
+	}
+	if q.Push(5) {
+		t.Fatal("item was added to a full queue")
+	}
+
+	close(block)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if q.Push(6) {
+		t.Fatal("item was added to a closed queue")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][]int{{0}, {1, 2, 3}, {4}}
+	if len(batches) != len(want) {
+		t.Fatalf("batches = %v, want %v", batches, want)
+	}
+	for i := range want {
+		if len(batches[i]) != len(want[i]) {
+			t.Fatalf("batches = %v, want %v", batches, want)
+		}
+		for j := range want[i] {
+			if batches[i][j] != want[i][j] {
+				t.Fatalf("batches = %v, want %v", batches, want)
+			}
+		}
+	}
+}
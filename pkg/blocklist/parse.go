@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package blocklist parses ad and tracker blocklists in common formats
+// into domain matcher patterns.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/miekg/dns"
+	"net/netip"
+	"strings"
+)
+
+// Formats of blocklists.
+const (
+	FormatHosts   = "hosts"   // "0.0.0.0 ads.example.com", names are matched exactly.
+	FormatAdblock = "adblock" // AdGuard/ABP syntax, e.g. "||ads.example.com^".
+	FormatDnsmasq = "dnsmasq" // "address=/ads.example.com/0.0.0.0" or "server=/ads.example.com/".
+	FormatDomain  = "domain"  // one domain per line, matching its subdomains.
+)
+
+// Rules are parsed rules of a blocklist, in the pattern syntax of
+// domain.MixMatcher, e.g. "domain:example.com".
+type Rules struct {
+	Block []string
+	Allow []string // exceptions, adblock lists only.
+
+	// Skipped is the number of lines that are not supported and skipped.
+	Skipped int
+}
+
+// Parse parses a blocklist in format. Lines that cannot be parsed or have
+// unsupported syntax are skipped, because public lists often contain
+// rules for other programs.
+func Parse(format string, b []byte) (*Rules, error) {
+	var parseLine func(r *Rules, s string) bool
+	switch format {
+	case FormatHosts:
+		parseLine = parseHostsLine
+	case FormatAdblock:
+		parseLine = parseAdblockLine
+	case FormatDnsmasq:
+		parseLine = parseDnsmasqLine
+	case FormatDomain, "":
+		parseLine = parseDomainLine
+	default:
+		return nil, fmt.Errorf("invalid blocklist format %s", format)
+	}
+
+	r := new(Rules)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, 64*1024)
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 {
+			continue
+		}
+		if !parseLine(r, s) {
+			r.Skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// hostsIgnored are names in system hosts files that should never be
+// blocked.
+var hostsIgnored = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+func parseHostsLine(r *Rules, s string) bool {
+	if s[0] == '#' {
+		return true
+	}
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = s[:i]
+	}
+	f := strings.Fields(s)
+	if len(f) < 2 {
+		return false
+	}
+	if _, err := netip.ParseAddr(f[0]); err != nil {
+		return false
+	}
+	ok := true
+	for _, name := range f[1:] {
+		name = strings.ToLower(name)
+		if _, ignored := hostsIgnored[name]; ignored {
+			continue
+		}
+		if !validName(name) {
+			ok = false
+			continue
+		}
+		r.Block = append(r.Block, domain.MatcherFull+":"+name)
+	}
+	return ok
+}
+
+// adblockModifiers are rule modifiers that do not change which names are
+// blocked. Rules with other modifiers, e.g. "$client" or "$dnstype", are
+// skipped.
+var adblockModifiers = map[string]struct{}{
+	"important":   {},
+	"all":         {},
+	"document":    {},
+	"third-party": {},
+}
+
+func parseAdblockLine(r *Rules, s string) bool {
+	if s[0] == '!' || s[0] == '[' || s[0] == '#' {
+		return true
+	}
+
+	allow := false
+	if strings.HasPrefix(s, "@@") {
+		allow = true
+		s = s[2:]
+	}
+
+	if i := strings.LastIndexByte(s, '$'); i >= 0 && !strings.HasPrefix(s, "/") {
+		for _, m := range strings.Split(s[i+1:], ",") {
+			if _, ok := adblockModifiers[strings.TrimPrefix(m, "~")]; !ok {
+				return false
+			}
+		}
+		s = s[:i]
+	}
+
+	var pattern string
+	switch {
+	case len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/':
+		pattern = domain.MatcherRegexp + ":" + s[1:len(s)-1]
+	case strings.HasPrefix(s, "||"):
+		name, ok := adblockName(s[2:])
+		if !ok {
+			return false
+		}
+		pattern = domain.MatcherDomain + ":" + name
+	case strings.HasPrefix(s, "|"):
+		name, ok := adblockName(strings.TrimSuffix(s[1:], "|"))
+		if !ok {
+			return false
+		}
+		pattern = domain.MatcherFull + ":" + name
+	default:
+		// Plain names, e.g. "ads.example.com" or "ads.example.com^".
+		name, ok := adblockName(s)
+		if !ok {
+			return false
+		}
+		pattern = domain.MatcherDomain + ":" + name
+	}
+
+	if allow {
+		r.Allow = append(r.Allow, pattern)
+	} else {
+		r.Block = append(r.Block, pattern)
+	}
+	return true
+}
+
+// adblockName returns the name of a "name^" rule body.
+func adblockName(s string) (string, bool) {
+	s = strings.TrimSuffix(s, "^")
+	s = strings.ToLower(s)
+	if !validName(s) {
+		return "", false
+	}
+	return s, true
+}
+
+func parseDnsmasqLine(r *Rules, s string) bool {
+	if s[0] == '#' {
+		return true
+	}
+	key, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return false
+	}
+	key = strings.TrimSpace(key)
+	switch key {
+	case "address", "server", "local":
+	default:
+		return false
+	}
+	// "/name1/name2/[value]"
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "/") {
+		return false
+	}
+	f := strings.Split(v[1:], "/")
+	if len(f) < 2 {
+		return false
+	}
+	names, value := f[:len(f)-1], f[len(f)-1]
+	if !dnsmasqBlocks(key, value) {
+		return false
+	}
+	ok = true
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimPrefix(name, "."))
+		if !validName(name) {
+			ok = false
+			continue
+		}
+		r.Block = append(r.Block, domain.MatcherDomain+":"+name)
+	}
+	return ok
+}
+
+// dnsmasqBlocks reports whether a dnsmasq rule with the value blocks its
+// names. Rules that forward names to a server or redirect them to other
+// addresses are not block rules.
+func dnsmasqBlocks(key, value string) bool {
+	if len(value) == 0 {
+		return true
+	}
+	if key != "address" {
+		return false
+	}
+	if value == "#" {
+		return true
+	}
+	addr, err := netip.ParseAddr(value)
+	return err == nil && (addr.IsUnspecified() || addr.IsLoopback())
+}
+
+func parseDomainLine(r *Rules, s string) bool {
+	if s[0] == '#' {
+		return true
+	}
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	// Lines may have a matcher type prefix.
+	typ, pattern, ok := strings.Cut(s, ":")
+	if !ok {
+		typ, pattern = domain.MatcherDomain, s
+	}
+	switch typ {
+	case domain.MatcherDomain, domain.MatcherFull:
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "*."))
+		if !validName(pattern) {
+			return false
+		}
+	case domain.MatcherKeyword, domain.MatcherRegexp:
+		if len(pattern) == 0 {
+			return false
+		}
+	default:
+		return false
+	}
+	r.Block = append(r.Block, typ+":"+pattern)
+	return true
+}
+
+// validName reports whether s is a valid domain name without the
+// trailing dot.
+func validName(s string) bool {
+	if len(s) == 0 || strings.ContainsAny(s, "*/|^$@# ") {
+		return false
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok
+}
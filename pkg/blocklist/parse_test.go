@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		in          string
+		wantBlock   []string
+		wantAllow   []string
+		wantSkipped int
+		wantErr     bool
+	}{
+		{
+			name:   "hosts",
+			format: FormatHosts,
+			in: `# comment
+127.0.0.1 localhost
+0.0.0.0 ads.example.com Tracker.example.com # inline
+::1 ip6-localhost
+invalid line`,
+			wantBlock:   []string{"full:ads.example.com", "full:tracker.example.com"},
+			wantSkipped: 1,
+		},
+		{
+			name:   "adblock",
+			format: FormatAdblock,
+			in: `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||important.example.com^$important
+@@||good.example.com^
+|exact.example.com^
+/^ad[0-9]+\./
+plain.example.com
+||client.example.com^$client=127.0.0.1
+example.com##.banner
+||*.wildcard.com^`,
+			wantBlock: []string{
+				"domain:ads.example.com",
+				"domain:important.example.com",
+				"full:exact.example.com",
+				`regexp:^ad[0-9]+\.`,
+				"domain:plain.example.com",
+			},
+			wantAllow:   []string{"domain:good.example.com"},
+			wantSkipped: 3,
+		},
+		{
+			name:   "dnsmasq",
+			format: FormatDnsmasq,
+			in: `# comment
+address=/ads.example.com/0.0.0.0
+address=/a.example.com/b.example.com/
+address=/c.example.com/#
+server=/d.example.com/
+server=/e.example.com/1.1.1.1
+address=/f.example.com/1.2.3.4
+conf-file=/etc/x`,
+			wantBlock: []string{
+				"domain:ads.example.com",
+				"domain:a.example.com",
+				"domain:b.example.com",
+				"domain:c.example.com",
+				"domain:d.example.com",
+			},
+			wantSkipped: 3,
+		},
+		{
+			name:   "domain",
+			format: FormatDomain,
+			in: `# comment
+ads.example.com
+*.tracker.example.com
+full:exact.example.com
+keyword:ad
+bad:example.com`,
+			wantBlock: []string{
+				"domain:ads.example.com",
+				"domain:tracker.example.com",
+				"full:exact.example.com",
+				"keyword:ad",
+			},
+			wantSkipped: 1,
+		},
+		{name: "invalid format", format: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Parse(tt.format, []byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(r.Block, tt.wantBlock) {
+				t.Errorf("Block = %v, want %v", r.Block, tt.wantBlock)
+			}
+			if !reflect.DeepEqual(r.Allow, tt.wantAllow) {
+				t.Errorf("Allow = %v, want %v", r.Allow, tt.wantAllow)
+			}
+			if r.Skipped != tt.wantSkipped {
+				t.Errorf("Skipped = %d, want %d", r.Skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bpf_map
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+// NativeEndian is the byte order of the host. Keys and values
+// of maps are usually in host byte order.
+var NativeEndian = nativeEndian()
+
+func nativeEndian() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+type MapType uint32
+
+const (
+	MapTypeHash    MapType = unix.BPF_MAP_TYPE_HASH
+	MapTypeLPMTrie MapType = unix.BPF_MAP_TYPE_LPM_TRIE
+)
+
+func (t MapType) String() string {
+	switch t {
+	case MapTypeHash:
+		return "hash"
+	case MapTypeLPMTrie:
+		return "lpm_trie"
+	default:
+		return fmt.Sprintf("type(%d)", uint32(t))
+	}
+}
+
+// MapSpec describes a map.
+type MapSpec struct {
+	Type       MapType
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	Name       string // Optional, at most 15 bytes.
+}
+
+// Map is a bpf map.
+type Map struct {
+	fd   int
+	spec MapSpec
+}
+
+// OpenOrCreatePinned opens the map pinned at path. If there is no such
+// map, a new map is created and pinned. The directory of path must be
+// in a bpf filesystem. The type, key size and value size of an existing
+// map must match spec.
+func OpenOrCreatePinned(path string, spec MapSpec) (*Map, error) {
+	m, err := openPinned(path)
+	if err == nil {
+		if m.spec.Type != spec.Type || m.spec.KeySize != spec.KeySize || m.spec.ValueSize != spec.ValueSize {
+			m.Close()
+			return nil, fmt.Errorf("pinned map %s (%s, key %d, value %d) does not match the required map (%s, key %d, value %d)",
+				path, m.spec.Type, m.spec.KeySize, m.spec.ValueSize, spec.Type, spec.KeySize, spec.ValueSize)
+		}
+		return m, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open pinned map %s, %w", path, err)
+	}
+
+	m, err = createMap(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create map, %w", err)
+	}
+	if err := m.pin(path); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to pin map to %s, %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *Map) Spec() MapSpec {
+	return m.spec
+}
+
+// Close closes the fd of the map. A pinned map is not removed.
+func (m *Map) Close() error {
+	return unix.Close(m.fd)
+}
+
+// Update creates or updates the element of key.
+func (m *Map) Update(key, value []byte) error {
+	if err := m.checkSize(key, value); err != nil {
+		return err
+	}
+	attr := mapElemAttr{
+		mapFd: uint32(m.fd),
+		key:   ptr(key),
+		value: ptr(value),
+		flags: unix.BPF_ANY,
+	}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// Lookup copies the value of key into value. It returns
+// an error that wraps os.ErrNotExist if key is not in the map.
+func (m *Map) Lookup(key, value []byte) error {
+	if err := m.checkSize(key, value); err != nil {
+		return err
+	}
+	attr := mapElemAttr{
+		mapFd: uint32(m.fd),
+		key:   ptr(key),
+		value: ptr(value),
+	}
+	_, err := bpf(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// Delete deletes the element of key. It returns an error that wraps
+// os.ErrNotExist if key is not in the map.
+func (m *Map) Delete(key []byte) error {
+	if err := m.checkSize(key, nil); err != nil {
+		return err
+	}
+	attr := mapElemAttr{
+		mapFd: uint32(m.fd),
+		key:   ptr(key),
+	}
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	return err
+}
+
+// Keys returns all keys in the map.
+func (m *Map) Keys() ([][]byte, error) {
+	var keys [][]byte
+	var key []byte // nil key gets the first key
+	for {
+		next := make([]byte, m.spec.KeySize)
+		attr := mapElemAttr{
+			mapFd: uint32(m.fd),
+			key:   ptr(key),
+			value: ptr(next),
+		}
+		_, err := bpf(unix.BPF_MAP_GET_NEXT_KEY, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(key)
+		runtime.KeepAlive(next)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return keys, nil
+			}
+			return nil, err
+		}
+		keys = append(keys, next)
+		key = next
+	}
+}
+
+func (m *Map) checkSize(key, value []byte) error {
+	if uint32(len(key)) != m.spec.KeySize {
+		return fmt.Errorf("invalid key size %d, want %d", len(key), m.spec.KeySize)
+	}
+	if value != nil && uint32(len(value)) != m.spec.ValueSize {
+		return fmt.Errorf("invalid value size %d, want %d", len(value), m.spec.ValueSize)
+	}
+	return nil
+}
+
+func createMap(spec MapSpec) (*Map, error) {
+	attr := mapCreateAttr{
+		mapType:    uint32(spec.Type),
+		keySize:    spec.KeySize,
+		valueSize:  spec.ValueSize,
+		maxEntries: spec.MaxEntries,
+	}
+	if spec.Type == MapTypeLPMTrie {
+		attr.mapFlags = unix.BPF_F_NO_PREALLOC // required by lpm tries
+	}
+	copy(attr.mapName[:len(attr.mapName)-1], spec.Name)
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, err
+	}
+	return &Map{fd: fd, spec: spec}, nil
+}
+
+func openPinned(path string) (*Map, error) {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	attr := objAttr{pathname: uint64(uintptr(unsafe.Pointer(p)))}
+	fd, err := bpf(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var info mapInfo
+	infoAttr := objInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    uint64(uintptr(unsafe.Pointer(&info))),
+	}
+	_, err = bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&infoAttr), unsafe.Sizeof(infoAttr))
+	runtime.KeepAlive(&info)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to get map info, %w", err)
+	}
+	spec := MapSpec{
+		Type:       MapType(info.mapType),
+		KeySize:    info.keySize,
+		ValueSize:  info.valueSize,
+		MaxEntries: info.maxEntries,
+		Name:       unix.ByteSliceToString(info.name[:]),
+	}
+	return &Map{fd: fd, spec: spec}, nil
+}
+
+func (m *Map) pin(path string) error {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr := objAttr{pathname: uint64(uintptr(unsafe.Pointer(p))), bpfFd: uint32(m.fd)}
+	_, err = bpf(unix.BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(p)
+	return err
+}
+
+// Layouts of union bpf_attr and struct bpf_map_info in linux/bpf.h.
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+	innerMapFd uint32
+	numaNode   uint32
+	mapName    [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+type mapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64 // or next_key
+	flags uint64
+}
+
+type objAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+type objInfoAttr struct {
+	bpfFd   uint32
+	infoLen uint32
+	info    uint64
+}
+
+type mapInfo struct {
+	mapType    uint32
+	id         uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+	name       [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+func ptr(b []byte) uint64 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
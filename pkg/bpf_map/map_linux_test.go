@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bpf_map
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TEST_BPF_DIR must be a directory in a bpf filesystem.
+func TestMap(t *testing.T) {
+	dir := os.Getenv("TEST_BPF_DIR")
+	if dir == "" {
+		t.SkipNow()
+	}
+	path := filepath.Join(dir, "mosdns_test")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	spec := MapSpec{Type: MapTypeLPMTrie, KeySize: 8, ValueSize: 4, MaxEntries: 16, Name: "mosdns_test"}
+	m, err := OpenOrCreatePinned(path, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte{24, 0, 0, 0, 192, 0, 2, 0}
+	if err := m.Update(key, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	m, err = OpenOrCreatePinned(path, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Spec() != spec {
+		t.Fatalf("spec = %+v, want %+v", m.Spec(), spec)
+	}
+	v := make([]byte, 4)
+	if err := m.Lookup(key, v); err != nil || !bytes.Equal(v, []byte{1, 2, 3, 4}) {
+		t.Fatalf("lookup = %v, %v", v, err)
+	}
+	keys, err := m.Keys()
+	if err != nil || len(keys) != 1 || !bytes.Equal(keys[0], key) {
+		t.Fatalf("keys = %v, %v", keys, err)
+	}
+	if err := m.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	spec.ValueSize = 8
+	if _, err := OpenOrCreatePinned(path, spec); err == nil {
+		t.Fatal("map with a different value size should be rejected")
+	}
+}
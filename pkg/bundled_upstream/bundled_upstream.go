@@ -58,7 +58,11 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 	q := qCtx.Q()
 	t := len(upstreams)
 	if t == 1 {
-		return upstreams[0].Exchange(ctx, q)
+		r, err := upstreams[0].Exchange(ctx, q)
+		if err == nil {
+			qCtx.SetUpstream(upstreams[0].Address())
+		}
+		return r, err
 	}
 
 	c := make(chan *parallelResult, t) // use buf chan to avoid blocking.
@@ -88,6 +92,7 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 			}
 
 			if res.from.Trusted() || res.r.Rcode == dns.RcodeSuccess {
+				qCtx.SetUpstream(res.from.Address())
 				return res.r, nil
 			}
 			continue
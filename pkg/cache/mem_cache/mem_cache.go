@@ -34,6 +34,7 @@ const (
 // It is safe for concurrent use.
 type MemCache struct {
 	closed           uint32
+	evicted          uint64
 	closeCleanerChan chan struct{}
 	lru              *concurrent_lru.ShardedLRU[*elem]
 }
@@ -57,8 +58,8 @@ func NewMemCache(size int, cleanerInterval time.Duration) *MemCache {
 
 	c := &MemCache{
 		closeCleanerChan: make(chan struct{}),
-		lru:              concurrent_lru.NewShardedLRU[*elem](shardSize, sizePerShard, nil),
 	}
+	c.lru = concurrent_lru.NewShardedLRU[*elem](shardSize, sizePerShard, c.onEvict)
 	go c.startCleaner(cleanerInterval)
 	return c
 }
@@ -133,6 +134,34 @@ func (c *MemCache) cleanFunc() func(_ string, v *elem) bool {
 	}
 }
 
+// Range calls f for every unexpired value in c. Values of each shard are
+// ranged from the least recently used one. f must not modify v or call
+// other methods of c.
+func (c *MemCache) Range(f func(key string, v []byte, storedTime, expirationTime time.Time)) {
+	now := time.Now()
+	c.lru.Clean(func(key string, e *elem) bool {
+		if e.expirationTime.Before(now) {
+			return true
+		}
+		f(key, e.v, e.storedTime, e.expirationTime)
+		return false
+	})
+}
+
+// onEvict counts unexpired values that were removed to make room for
+// new values.
+func (c *MemCache) onEvict(_ string, e *elem) {
+	if e.expirationTime.After(time.Now()) {
+		atomic.AddUint64(&c.evicted, 1)
+	}
+}
+
+// Evicted returns the number of unexpired values that were evicted
+// because the cache was full.
+func (c *MemCache) Evicted() uint64 {
+	return atomic.LoadUint64(&c.evicted)
+}
+
 func (c *MemCache) Len() int {
 	return c.lru.Len()
 }
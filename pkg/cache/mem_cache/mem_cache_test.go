@@ -46,6 +46,9 @@ func Test_memCache(t *testing.T) {
 	if c.Len() > 1024 {
 		t.Fatal("cache overflow")
 	}
+	if want := uint64(1024*4 - c.Len()); c.Evicted() != want {
+		t.Fatalf("want %d evicted, got %d", want, c.Evicted())
+	}
 }
 
 func Test_memCache_cleaner(t *testing.T) {
@@ -80,3 +83,20 @@ func Test_memCache_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func Test_memCache_Range(t *testing.T) {
+	c := NewMemCache(1024, -1)
+	defer c.Close()
+	now := time.Now()
+	c.Store("k1", []byte{1}, now, now.Add(time.Minute))
+	c.Store("k2", []byte{2}, now, now.Add(time.Millisecond*10))
+	time.Sleep(time.Millisecond * 20)
+
+	got := make(map[string][]byte)
+	c.Range(func(key string, v []byte, _, _ time.Time) {
+		got[key] = v
+	})
+	if len(got) != 1 || got["k1"][0] != 1 {
+		t.Fatalf("want k1 only, got %v", got)
+	}
+}
@@ -154,6 +154,46 @@ func (r *RedisCache) Store(key string, v []byte, storedTime, expirationTime time
 	}
 }
 
+// BatchGet retrieves values of keys via a redis pipeline, in one round
+// trip like MGET. Unlike MGET, keys of a redis cluster can be in different
+// slots. The returned KVs are in the order of keys. Missing keys have nil
+// values.
+func (r *RedisCache) BatchGet(keys []string) []KV {
+	kvs := make([]KV, len(keys))
+	for i, key := range keys {
+		kvs[i].Key = key
+	}
+	if r.disabled() || len(keys) == 0 {
+		return kvs
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ClientTimeout)
+	defer cancel()
+	pipeline := r.opts.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipeline.Get(ctx, key)
+	}
+	if _, err := pipeline.Exec(ctx); err != nil && err != redis.Nil {
+		r.opts.Logger.Warn("redis pipeline get", zap.Error(err))
+		r.disableClient()
+		return kvs
+	}
+	for i, cmd := range cmds {
+		b, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+		storedTime, expirationTime, v, err := unpackRedisValue(b)
+		if err != nil {
+			r.opts.Logger.Warn("redis data unpack error", zap.Error(err))
+			continue
+		}
+		kvs[i].V, kvs[i].StoreTime, kvs[i].ExpirationTime = v, storedTime, expirationTime
+	}
+	return kvs
+}
+
 type KV struct {
 	Key            string
 	V              []byte
@@ -20,7 +20,15 @@
 package redis_cache
 
 import (
+	"bufio"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"net"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -55,3 +63,139 @@ func Test_RedisValue(t *testing.T) {
 		})
 	}
 }
+
+// fakeRedis is a minimal redis server that supports PING, GET, SET and
+// DBSIZE. Expiration is not supported.
+type fakeRedis struct {
+	l  net.Listener
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{l: l, m: make(map[string]string)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) handleConn(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		args, err := readRESPArray(br)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		var resp string
+		switch args[0] {
+		case "ping":
+			resp = "+PONG\r\n"
+		case "get":
+			if v, ok := s.m[args[1]]; ok {
+				resp = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				resp = "$-1\r\n"
+			}
+		case "set":
+			s.m[args[1]] = args[2]
+			resp = "+OK\r\n"
+		case "dbsize":
+			resp = fmt.Sprintf(":%d\r\n", len(s.m))
+		default:
+			resp = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+		if _, err := io.WriteString(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+func readRESPArray(br *bufio.Reader) ([]string, error) {
+	readLine := func() (string, error) {
+		l, err := br.ReadString('\n')
+		if len(l) < 3 {
+			return "", fmt.Errorf("invalid line %q, %v", l, err)
+		}
+		return l[1 : len(l)-2], err
+	}
+	h, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(h)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		h, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(h)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	args[0] = strings.ToLower(args[0])
+	return args, nil
+}
+
+func Test_RedisCache(t *testing.T) {
+	s := newFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: s.l.Addr().String(), MaxRetries: -1})
+	c, err := NewRedisCache(RedisCacheOpts{Client: client, ClientCloser: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Now()
+	c.Store("k1", []byte{1}, now, now.Add(time.Minute))
+	c.BatchStore([]KV{{Key: "k2", V: []byte{2}, StoreTime: now, ExpirationTime: now.Add(time.Minute)}})
+	if v, _, _ := c.Get("k1"); !reflect.DeepEqual(v, []byte{1}) {
+		t.Fatalf("k1: want [1], got %v", v)
+	}
+	if c.Len() != 2 {
+		t.Fatalf("want len 2, got %d", c.Len())
+	}
+
+	kvs := c.BatchGet([]string{"k2", "k3", "k1"})
+	if !reflect.DeepEqual(kvs[0].V, []byte{2}) || kvs[1].V != nil || !reflect.DeepEqual(kvs[2].V, []byte{1}) {
+		t.Fatalf("unexpected batch get result %v", kvs)
+	}
+	if kvs[0].StoreTime.Unix() != now.Unix() {
+		t.Fatalf("k2: want stored time %v, got %v", now, kvs[0].StoreTime)
+	}
+
+	// Redis is down, the client should be disabled.
+	s.l.Close()
+	client.Close()
+	if v, _, _ := c.Get("k1"); v != nil {
+		t.Fatal("want nil value from a closed client")
+	}
+	if !c.disabled() {
+		t.Fatal("client should be disabled")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tiered_cache
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/cache"
+	"time"
+)
+
+// TieredCache is a two-tier cache.Backend. L1 is usually a small and fast
+// in-memory cache in front of a large persistent L2, e.g. redis.
+type TieredCache struct {
+	l1, l2 cache.Backend
+}
+
+var _ cache.Backend = (*TieredCache)(nil)
+
+// NewTieredCache returns a TieredCache. l1 and l2 will be closed by
+// TieredCache.Close.
+func NewTieredCache(l1, l2 cache.Backend) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2}
+}
+
+// Get retrieves v from L1. If L1 misses, v is retrieved from L2 and
+// stored to L1.
+func (c *TieredCache) Get(key string) (v []byte, storedTime, expirationTime time.Time) {
+	v, storedTime, expirationTime = c.l1.Get(key)
+	if v != nil {
+		return v, storedTime, expirationTime
+	}
+	v, storedTime, expirationTime = c.l2.Get(key)
+	if v != nil {
+		c.l1.Store(key, v, storedTime, expirationTime)
+	}
+	return v, storedTime, expirationTime
+}
+
+// Store stores v to both tiers.
+func (c *TieredCache) Store(key string, v []byte, storedTime, expirationTime time.Time) {
+	c.l1.Store(key, v, storedTime, expirationTime)
+	c.l2.Store(key, v, storedTime, expirationTime)
+}
+
+// Len returns the length of L2, which contains L1.
+func (c *TieredCache) Len() int {
+	return c.l2.Len()
+}
+
+// Close closes both tiers.
+func (c *TieredCache) Close() error {
+	err1 := c.l1.Close()
+	err2 := c.l2.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tiered_cache
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/cache/mem_cache"
+	"testing"
+	"time"
+)
+
+func Test_tieredCache(t *testing.T) {
+	l1 := mem_cache.NewMemCache(1024, 0)
+	l2 := mem_cache.NewMemCache(1024, 0)
+	c := NewTieredCache(l1, l2)
+	defer c.Close()
+
+	now := time.Now()
+	c.Store("k1", []byte{1}, now, now.Add(time.Minute))
+	if v, _, _ := l1.Get("k1"); v == nil {
+		t.Fatal("k1 is not stored to l1")
+	}
+	if v, _, _ := l2.Get("k1"); v == nil {
+		t.Fatal("k1 is not stored to l2")
+	}
+
+	// l1 miss, l2 hit.
+	l2.Store("k2", []byte{2}, now, now.Add(time.Minute))
+	v, storedTime, _ := c.Get("k2")
+	if len(v) != 1 || v[0] != 2 || !storedTime.Equal(now) {
+		t.Fatalf("unexpected k2 value %v stored at %v", v, storedTime)
+	}
+	if v, _, _ := l1.Get("k2"); v == nil {
+		t.Fatal("k2 is not populated to l1")
+	}
+
+	if v, _, _ := c.Get("k3"); v != nil {
+		t.Fatal("k3 should miss")
+	}
+}
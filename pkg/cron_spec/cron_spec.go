@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package cron_spec parses the standard 5 fields cron spec
+// "minute hour day-of-month month day-of-week".
+package cron_spec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a parsed cron spec. Each field is a bitset of allowed values.
+type Spec struct {
+	minute, hour, dom, month, dow uint64
+
+	// Per cron convention, if both day fields are restricted, a day
+	// matches if either of them matches.
+	domStar, dowStar bool
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses s. Fields support "*", values, ranges "a-b", lists "a,b"
+// and steps "*/n", "a-b/n". Day-of-week is 0-7, both 0 and 7 are Sunday.
+// Descriptors "@hourly", "@daily", "@weekly", "@monthly" and "@yearly"
+// are also supported.
+func Parse(s string) (*Spec, error) {
+	if d, ok := descriptors[strings.TrimSpace(s)]; ok {
+		s = d
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron spec %q, want 5 fields, got %d", s, len(fields))
+	}
+
+	spec := new(Spec)
+	var err error
+	for i, f := range []struct {
+		dst      *uint64
+		min, max int
+		name     string
+	}{
+		{&spec.minute, 0, 59, "minute"},
+		{&spec.hour, 0, 23, "hour"},
+		{&spec.dom, 1, 31, "day of month"},
+		{&spec.month, 1, 12, "month"},
+		{&spec.dow, 0, 7, "day of week"},
+	} {
+		if *f.dst, err = parseField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid %s field, %w", f.name, err)
+		}
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domStar = fields[2] == "*"
+	spec.dowStar = fields[4] == "*"
+	return spec, nil
+}
+
+func parseField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			loStr, hiStr, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loStr)
+			}
+			switch {
+			case isRange:
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiStr)
+				}
+			case !hasStep:
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("invalid range %q, must be in %d-%d", rangePart, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Match reports whether the minute of t matches the spec. Seconds of t
+// are ignored.
+func (s *Spec) Match(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<t.Month()) == 0 {
+		return false
+	}
+	domMatched := s.dom&(1<<t.Day()) != 0
+	dowMatched := s.dow&(1<<t.Weekday()) != 0
+	if s.domStar || s.dowStar {
+		return domMatched && dowMatched
+	}
+	return domMatched || dowMatched
+}
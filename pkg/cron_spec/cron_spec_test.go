@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cron_spec
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"0 3 * * *", false},
+		{"*/15 1-5 1,15 * 1-5", false},
+		{"0 0 * * 7", false},
+		{"@daily", false},
+		{"0 3 * *", true},
+		{"60 * * * *", true},
+		{"* * 0 * *", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"a * * * *", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := Parse(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSpec_Match(t *testing.T) {
+	// 2022-11-07 is a Monday.
+	monday := time.Date(2022, 11, 7, 3, 0, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"0 3 * * *", monday, true},
+		{"0 3 * * *", monday.Add(time.Minute), false},
+		{"*/15 * * * *", monday.Add(time.Minute * 45), true},
+		{"*/15 * * * *", monday.Add(time.Minute * 40), false},
+		{"0 3 * * 1-5", monday, true},
+		{"0 3 * * 0,6", monday, false},
+		{"0 3 * * 7", monday.AddDate(0, 0, 6), true},
+		{"0 3 1 * 1", monday, true},  // either day field matches
+		{"0 3 1 * 2", monday, false}, // neither matches
+		{"0 3 7 * *", monday, true},
+		{"0 3 * 12 *", monday, false},
+		{"@hourly", monday.Add(-time.Hour * 3), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Match(tt.t); got != tt.want {
+				t.Fatalf("Match(%s) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
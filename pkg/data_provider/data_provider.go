@@ -20,6 +20,7 @@
 package data_provider
 
 import (
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/safe_close"
 	"github.com/fsnotify/fsnotify"
@@ -38,6 +39,17 @@ type DataListener interface {
 	Update(newData []byte) error
 }
 
+// DeltaListener is a DataListener that supports delta updates. See
+// DataProviderConfig.Delta.
+type DeltaListener interface {
+	DataListener
+
+	// ApplyDelta applies the delta file content. The delta is always
+	// relative to the last data passed to Update, so the listener should
+	// revert the previously applied delta, if any.
+	ApplyDelta(delta []byte) error
+}
+
 func NewDataManager() *DataManager {
 	return &DataManager{
 		ps: make(map[string]*DataProvider),
@@ -56,31 +68,111 @@ func (m *DataManager) GetDataProvider(name string) *DataProvider {
 	return m.ps[name]
 }
 
+// ReloadAll reloads all DataProviders, see DataProvider.Reload. It
+// returns the reload errors by provider tags. A provider that is reloaded
+// successfully has a nil error.
+func (m *DataManager) ReloadAll() map[string]error {
+	m.pm.RLock()
+	ps := make(map[string]*DataProvider, len(m.ps))
+	for name, p := range m.ps {
+		ps[name] = p
+	}
+	m.pm.RUnlock()
+
+	errs := make(map[string]error, len(ps))
+	for name, p := range ps {
+		errs[name] = p.Reload()
+	}
+	return errs
+}
+
+// Status returns the last reload status of all DataProviders by tags.
+func (m *DataManager) Status() map[string]ReloadStatus {
+	m.pm.RLock()
+	defer m.pm.RUnlock()
+	s := make(map[string]ReloadStatus, len(m.ps))
+	for name, p := range m.ps {
+		s[name] = p.Status()
+	}
+	return s
+}
+
+// Close closes all DataProvider.
+func (m *DataManager) Close() {
+	m.pm.Lock()
+	defer m.pm.Unlock()
+	for name, p := range m.ps {
+		p.Close()
+		delete(m.ps, name)
+	}
+}
+
 type DataProviderConfig struct {
 	Tag        string `yaml:"tag"`
 	File       string `yaml:"file"`
 	AutoReload bool   `yaml:"auto_reload"`
+
+	// Delta is an optional delta file of File. It contains the changes
+	// ("+entry" and "-entry" lines) between File and the current data.
+	// If AutoReload is enabled, a change of the delta file is applied
+	// incrementally by listeners, which is a lot faster than reloading
+	// a huge File. Only listeners that support delta updates (e.g. domain
+	// lists) can use the provider.
+	Delta string `yaml:"delta"`
+
+	// URL downloads the data from a http(s) url. The file is saved to
+	// File, or a file in CacheDir (default "cache") if File is empty.
+	// The cached file is used at startup, and it is updated every
+	// UpdateInterval seconds (default 86400). A failed update is retried
+	// later, and the old data is kept. AutoReload is ignored.
+	URL            string `yaml:"url"`
+	UpdateInterval int    `yaml:"update_interval"`
+	CacheDir       string `yaml:"cache_dir"`
+
+	// SHA256 is an optional checksum of the downloaded file in hex, or
+	// the url of a sha256sum file. A file with a mismatched checksum is
+	// discarded.
+	SHA256 string `yaml:"sha256"`
 }
 
 type DataProvider struct {
 	logger     *zap.Logger
 	file       string
+	delta      string
 	autoReload bool
+	remote     *remote // nil if the file is not downloaded from a url.
 
 	lm        sync.Mutex
 	listeners map[DataListener]struct{}
 
+	statusM sync.Mutex
+	status  ReloadStatus
+
 	sc *safe_close.SafeClose
 }
 
+// ReloadStatus is the status of the last reload of a DataProvider.
+type ReloadStatus struct {
+	Time time.Time // zero if the provider was never reloaded.
+	Err  error
+}
+
 func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, error) {
 	dp := new(DataProvider)
 	dp.logger = lg
 	dp.file = cfg.File
+	dp.delta = cfg.Delta
 	dp.autoReload = cfg.AutoReload
 
 	dp.sc = safe_close.NewSafeClose()
 
+	if len(cfg.URL) > 0 {
+		if err := dp.initRemote(cfg); err != nil {
+			dp.Close()
+			return nil, err
+		}
+		return dp, nil
+	}
 	if err := dp.init(); err != nil {
 		return nil, err
 	}
@@ -92,11 +184,21 @@ func (ds *DataProvider) init() error {
 	if err != nil {
 		return err
 	}
+	if len(ds.delta) > 0 {
+		if _, err := os.ReadFile(ds.delta); err != nil {
+			return err
+		}
+	}
 
 	if ds.autoReload {
-		if err := ds.startFsWatcher(); err != nil {
+		if err := ds.startFsWatcher(ds.file, ds.Reload); err != nil {
 			return fmt.Errorf("failed to start fs watcher, %w", err)
 		}
+		if len(ds.delta) > 0 {
+			if err := ds.startFsWatcher(ds.delta, ds.reloadDelta); err != nil {
+				return fmt.Errorf("failed to start fs watcher, %w", err)
+			}
+		}
 	}
 	return nil
 }
@@ -106,6 +208,19 @@ func (ds *DataProvider) Close() {
 	ds.sc.CloseWait()
 }
 
+// PartialError is an optional interface of errors of DataListener.Update.
+// If Partial returns true, the listener was updated with the valid part
+// of the data, so the error is logged instead of failing the update.
+type PartialError interface {
+	error
+	Partial() bool
+}
+
+func isPartial(err error) bool {
+	var pe PartialError
+	return errors.As(err, &pe) && pe.Partial()
+}
+
 // LoadAndAddListener loads the DataListener, returns any error that occurs, and
 // add this DataListener to this DataProvider.
 func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
@@ -115,7 +230,23 @@ func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
 	}
 
 	if err := l.Update(b); err != nil {
-		return err
+		if !isPartial(err) {
+			return err
+		}
+		ds.logger.Warn("some data is invalid", zap.String("file", ds.file), zap.Error(err))
+	}
+	if len(ds.delta) > 0 {
+		dl, ok := l.(DeltaListener)
+		if !ok {
+			return fmt.Errorf("data of %s has a delta file, which is not supported here", ds.file)
+		}
+		delta, err := os.ReadFile(ds.delta)
+		if err != nil {
+			return err
+		}
+		if err := dl.ApplyDelta(delta); err != nil {
+			return fmt.Errorf("failed to apply delta file, %w", err)
+		}
 	}
 
 	ds.lm.Lock()
@@ -133,23 +264,78 @@ func (ds *DataProvider) DeleteListener(l DataListener) {
 	delete(ds.listeners, l)
 }
 
+// Reload re-reads the file (and the delta file) and updates all listeners.
+// Listeners that failed to update keep their old data. It returns the
+// first error.
+func (ds *DataProvider) Reload() error {
+	err := ds.reloadData()
+	ds.statusM.Lock()
+	ds.status = ReloadStatus{Time: time.Now(), Err: err}
+	ds.statusM.Unlock()
+	return err
+}
+
+// Status returns the status of the last reload.
+func (ds *DataProvider) Status() ReloadStatus {
+	ds.statusM.Lock()
+	defer ds.statusM.Unlock()
+	return ds.status
+}
+
 func (ds *DataProvider) GetData() ([]byte, error) {
 	return os.ReadFile(ds.file)
 }
 
-// pushData notify the notifier and trigger all listeners.
-func (ds *DataProvider) pushData(newData []byte) {
+func (ds *DataProvider) getListeners() []DataListener {
 	ds.lm.Lock()
+	defer ds.lm.Unlock()
 	ls := make([]DataListener, 0, len(ds.listeners))
 	for listener := range ds.listeners {
 		ls = append(ls, listener)
 	}
-	ds.lm.Unlock()
+	return ls
+}
 
-	for _, l := range ls {
+// pushData notify the notifier and trigger all listeners.
+// If the provider has a delta file, delta is applied after newData.
+// It returns the first error of listeners.
+func (ds *DataProvider) pushData(newData, delta []byte) error {
+	var firstErr error
+	for _, l := range ds.getListeners() {
 		if err := l.Update(newData); err != nil {
+			if !isPartial(err) {
+				ds.logger.Error(
+					"failed to update data listener",
+					zap.Error(err),
+				)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			ds.logger.Warn("some data is invalid", zap.String("file", ds.file), zap.Error(err))
+		}
+		if delta != nil {
+			if err := l.(DeltaListener).ApplyDelta(delta); err != nil {
+				ds.logger.Error(
+					"failed to apply delta to data listener",
+					zap.Error(err),
+				)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// pushDelta triggers all listeners to apply the new delta.
+func (ds *DataProvider) pushDelta(delta []byte) {
+	for _, l := range ds.getListeners() {
+		if err := l.(DeltaListener).ApplyDelta(delta); err != nil {
 			ds.logger.Error(
-				"failed to update data listener",
+				"failed to apply delta to data listener",
 				zap.Error(err),
 			)
 		}
@@ -160,12 +346,38 @@ func (ds *DataProvider) loadFromDisk() ([]byte, error) {
 	return os.ReadFile(ds.file)
 }
 
-func (ds *DataProvider) startFsWatcher() error {
+// reloadData reloads the file and the delta file.
+func (ds *DataProvider) reloadData() error {
+	b, err := ds.loadFromDisk()
+	if err != nil {
+		return err
+	}
+	var delta []byte
+	if len(ds.delta) > 0 {
+		if delta, err = os.ReadFile(ds.delta); err != nil {
+			return err
+		}
+	}
+	return ds.pushData(b, delta)
+}
+
+func (ds *DataProvider) reloadDelta() error {
+	delta, err := os.ReadFile(ds.delta)
+	if err != nil {
+		return err
+	}
+	ds.pushDelta(delta)
+	return nil
+}
+
+// startFsWatcher watches file and calls reload when it changes.
+func (ds *DataProvider) startFsWatcher(file string, reload func() error) error {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-	if err := w.Add(ds.file); err != nil {
+	if err := w.Add(file); err != nil {
+		w.Close()
 		return err
 	}
 
@@ -190,11 +402,11 @@ func (ds *DataProvider) startFsWatcher() error {
 				}
 				delayReloadTimer = time.AfterFunc(time.Second, func() {
 					if hasOp(e, fsnotify.Remove) {
-						_ = w.Remove(ds.file)
-						if err := w.Add(ds.file); err != nil {
+						_ = w.Remove(file)
+						if err := w.Add(file); err != nil {
 							ds.logger.Error(
 								"failed to re-watch file, auto reload may not work anymore",
-								zap.String("file", ds.file),
+								zap.String("file", file),
 								zap.Error(err),
 							)
 						}
@@ -202,20 +414,19 @@ func (ds *DataProvider) startFsWatcher() error {
 
 					ds.logger.Info(
 						"reloading file",
-						zap.String("file", ds.file),
+						zap.String("file", file),
 					)
-					if v, err := ds.loadFromDisk(); err != nil {
+					if err := reload(); err != nil {
 						ds.logger.Error(
 							"failed to reload file",
-							zap.String("file", ds.file),
+							zap.String("file", file),
 							zap.Error(err),
 						)
 					} else {
 						ds.logger.Info(
 							"file reloaded",
-							zap.String("file", ds.file),
+							zap.String("file", file),
 						)
-						ds.pushData(v)
 					}
 				})
 
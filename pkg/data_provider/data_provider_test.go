@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type testListener struct {
+	m sync.Mutex
+	b []byte
+}
+
+func (l *testListener) Update(b []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.b = b
+	return nil
+}
+
+func TestDataProvider_remote(t *testing.T) {
+	var m sync.Mutex
+	data := []byte("example.com\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if r.URL.Path == "/sum" {
+			h := sha256.Sum256(data)
+			w.Write([]byte(hex.EncodeToString(h[:]) + "  list.txt\n"))
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := DataProviderConfig{URL: srv.URL + "/list.txt", SHA256: srv.URL + "/sum", CacheDir: dir}
+	dp, err := NewDataProvider(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	if filepath.Dir(dp.file) != dir {
+		t.Fatalf("cache file %s is not in the cache dir", dp.file)
+	}
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if string(l.b) != "example.com\n" {
+		t.Fatalf("unexpected data %q", l.b)
+	}
+
+	// A file with a mismatched checksum is discarded.
+	dp.remote.sha256 = "00"
+	dp.remote.lastModified = ""
+	m.Lock()
+	data = []byte("bad.com\n")
+	m.Unlock()
+	if _, err := dp.updateRemote(context.Background()); err == nil {
+		t.Fatal("mismatched checksum should be rejected")
+	}
+	if b, _ := os.ReadFile(dp.file); string(b) != "example.com\n" {
+		t.Fatalf("cache file was changed, %q", b)
+	}
+
+	// The cache file is used if the server is unavailable.
+	srv.Close()
+	dp2, err := NewDataProvider(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp2.Close()
+	if b, _ := dp2.GetData(); string(b) != "example.com\n" {
+		t.Fatalf("unexpected data %q", b)
+	}
+
+	// Without a cache file, the first download must succeed.
+	cfg.CacheDir = t.TempDir()
+	if _, err := NewDataProvider(zap.NewNop(), cfg); err == nil {
+		t.Fatal("NewDataProvider() should fail")
+	}
+}
+
+type testFailListener struct{}
+
+func (testFailListener) Update(b []byte) error {
+	if string(b) == "bad" {
+		return errors.New("bad data")
+	}
+	return nil
+}
+
+func TestDataManager_ReloadAll(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(f, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := NewDataProvider(zap.NewNop(), DataProviderConfig{File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := NewDataManager()
+	dm.AddDataProvider("p", dp)
+	defer dm.Close()
+
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.LoadAndAddListener(testFailListener{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := dm.Status()["p"]; !s.Time.IsZero() {
+		t.Fatal("provider should not be reloaded yet")
+	}
+
+	if err := os.WriteFile(f, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.ReloadAll()["p"]; err != nil {
+		t.Fatal(err)
+	}
+	if string(l.b) != "b" {
+		t.Fatalf("listener is not updated, %q", l.b)
+	}
+
+	if err := os.WriteFile(f, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.ReloadAll()["p"]; err == nil {
+		t.Fatal("reload should fail")
+	}
+	if s := dm.Status()["p"]; s.Time.IsZero() || s.Err == nil {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUpdateInterval = 86400
+	defaultCacheDir       = "cache"
+	remoteRetryInterval   = time.Minute * 5
+	remoteFetchTimeout    = time.Second * 60
+	maxRemoteDataSize     = 128 * 1024 * 1024
+)
+
+// remote downloads the file of a DataProvider from a url.
+type remote struct {
+	url      string
+	sha256   string // hex checksum, or the url of a checksum file.
+	interval time.Duration
+
+	lastModified string
+}
+
+func (ds *DataProvider) initRemote(cfg DataProviderConfig) error {
+	if len(cfg.Delta) > 0 {
+		return errors.New("delta file is not supported with url")
+	}
+	interval := cfg.UpdateInterval
+	if interval <= 0 {
+		interval = defaultUpdateInterval
+	}
+	ds.remote = &remote{
+		url:      cfg.URL,
+		sha256:   strings.ToLower(strings.TrimSpace(cfg.SHA256)),
+		interval: time.Duration(interval) * time.Second,
+	}
+	if len(ds.file) == 0 {
+		cacheDir := cfg.CacheDir
+		if len(cacheDir) == 0 {
+			cacheDir = defaultCacheDir
+		}
+		h := sha256.Sum256([]byte(cfg.URL))
+		ds.file = filepath.Join(cacheDir, hex.EncodeToString(h[:8]))
+	}
+
+	// Use the cached file if it exists, so mosdns can start without
+	// network. Otherwise, the first download must succeed.
+	next := time.Now()
+	if fi, err := os.Stat(ds.file); err == nil {
+		ds.remote.lastModified = fi.ModTime().UTC().Format(http.TimeFormat)
+		next = fi.ModTime().Add(ds.remote.interval)
+	} else {
+		if _, err := ds.updateRemote(context.Background()); err != nil {
+			return fmt.Errorf("failed to download %s, %w", cfg.URL, err)
+		}
+		next = next.Add(ds.remote.interval)
+	}
+
+	ds.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ds.remoteUpdateLoop(next, closeSignal)
+	})
+	return nil
+}
+
+func (ds *DataProvider) remoteUpdateLoop(next time.Time, closeSignal <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closeSignal:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			b, err := ds.updateRemote(ctx)
+			if err != nil {
+				ds.logger.Warn("failed to update remote file, keep using the old data", zap.String("url", ds.remote.url), zap.Error(err))
+				timer.Reset(remoteRetryInterval)
+				continue
+			}
+			if b != nil {
+				ds.logger.Info("remote file updated", zap.String("url", ds.remote.url), zap.String("file", ds.file))
+				ds.pushData(b, nil)
+			}
+			timer.Reset(ds.remote.interval)
+		case <-closeSignal:
+			return
+		}
+	}
+}
+
+// updateRemote downloads the remote file, verifies it and saves it to the
+// cache file. It returns nil data if the file is not modified.
+func (ds *DataProvider) updateRemote(ctx context.Context) ([]byte, error) {
+	r := ds.remote
+	ctx, cancel := context.WithTimeout(ctx, remoteFetchTimeout)
+	defer cancel()
+
+	b, lastModified, err := httpGet(ctx, r.url, r.lastModified)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	if len(r.sha256) > 0 {
+		want := r.sha256
+		if strings.HasPrefix(want, "http://") || strings.HasPrefix(want, "https://") {
+			sum, _, err := httpGet(ctx, want, "")
+			if err != nil {
+				return nil, fmt.Errorf("failed to download checksum, %w", err)
+			}
+			// The format of sha256sum, "checksum  filename".
+			fields := strings.Fields(string(sum))
+			if len(fields) == 0 {
+				return nil, errors.New("empty checksum file")
+			}
+			want = strings.ToLower(fields[0])
+		}
+		h := sha256.Sum256(b)
+		if got := hex.EncodeToString(h[:]); got != want {
+			return nil, fmt.Errorf("sha256 mismatched, want %s, got %s", want, got)
+		}
+	}
+
+	if err := writeFileAtomic(ds.file, b); err != nil {
+		return nil, fmt.Errorf("failed to save cache file, %w", err)
+	}
+	r.lastModified = lastModified
+	return b, nil
+}
+
+// httpGet downloads the url. If lastModified is not empty, it sends a
+// conditional request and returns nil data if the file is not modified.
+func httpGet(ctx context.Context, url, lastModified string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, lastModified, nil
+	default:
+		return nil, "", fmt.Errorf("http status %s", resp.Status)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(io.LimitReader(resp.Body, maxRemoteDataSize+1)); err != nil {
+		return nil, "", err
+	}
+	if buf.Len() > maxRemoteDataSize {
+		return nil, "", errors.New("file is too large")
+	}
+	return buf.Bytes(), resp.Header.Get("Last-Modified"), nil
+}
+
+// writeFileAtomic writes b to a temporary file and renames it to file, so
+// readers never see a partially written file.
+func writeFileAtomic(file string, b []byte) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec_signer
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/state_file"
+	"github.com/miekg/dns"
+	"os"
+)
+
+const (
+	flagZSK = 256
+	flagKSK = 257
+)
+
+// Key is a DNSSEC key pair.
+type Key struct {
+	DNSKEY *dns.DNSKEY
+	Signer crypto.Signer
+}
+
+// IsKSK reports whether k has the SEP flag.
+func (k *Key) IsKSK() bool {
+	return k.DNSKEY.Flags&dns.SEP != 0
+}
+
+// GenerateKey generates an ECDSAP256SHA256 key for zone.
+func GenerateKey(zone string, ksk bool) (*Key, error) {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flagZSK,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if ksk {
+		k.Flags = flagKSK
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("generated key is not a crypto.Signer")
+	}
+	return &Key{DNSKEY: k, Signer: signer}, nil
+}
+
+// LoadKey reads a key pair in BIND format. prefix is the path without
+// the ".key" and ".private" suffix. e.g. "Kexample.com.+013+12345".
+func LoadKey(prefix string) (*Key, error) {
+	pubFile, err := os.Open(prefix + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer pubFile.Close()
+	rr, err := dns.ReadRR(pubFile, prefix+".key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key, %w", err)
+	}
+	k, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key is not a DNSKEY record", prefix)
+	}
+
+	privFile, err := os.Open(prefix + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer privFile.Close()
+	priv, err := k.ReadPrivateKey(privFile, prefix+".private")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key, %w", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private is not a signing key", prefix)
+	}
+	return &Key{DNSKEY: k, Signer: signer}, nil
+}
+
+// LoadOrGenerateKey loads the key from prefix. If the key files do not exist,
+// a new key will be generated and saved to prefix.
+// Key files can be shared between instances. An exclusive file lock on prefix
+// makes sure that only one of the instances generates the key.
+func LoadOrGenerateKey(prefix, zone string, ksk bool) (*Key, error) {
+	l, err := state_file.Lock(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock key files, %w", err)
+	}
+	defer l.Unlock()
+
+	if _, err := os.Stat(prefix + ".key"); !errors.Is(err, os.ErrNotExist) {
+		return LoadKey(prefix)
+	}
+
+	k, err := GenerateKey(zone, ksk)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.Save(prefix); err != nil {
+		return nil, fmt.Errorf("failed to save generated key, %w", err)
+	}
+	return k, nil
+}
+
+// Save writes k to prefix.key and prefix.private in BIND format.
+// Files are replaced atomically, see state_file.WriteFile.
+func (k *Key) Save(prefix string) error {
+	if err := state_file.WriteFile(prefix+".key", []byte(k.DNSKEY.String()+"\n"), 0644); err != nil {
+		return err
+	}
+	return state_file.WriteFile(prefix+".private", []byte(k.DNSKEY.PrivateKeyString(k.Signer)), 0600)
+}
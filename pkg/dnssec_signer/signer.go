@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec_signer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/concurrent_lru"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultValidity = time.Hour * 24 * 7
+
+	// inceptionOffset is subtracted from the signing time, so validators
+	// with a slightly slow clock can accept the signatures.
+	inceptionOffset = time.Hour
+
+	sigCacheShards       = 16
+	sigCacheSizePerShard = 256
+)
+
+type Opts struct {
+	// Zone is the apex of the signed zone.
+	Zone string
+
+	// KSK signs the DNSKEY rrset. ZSK signs all other rrsets.
+	KSK *Key
+	ZSK *Key
+
+	// Validity is the validity period of signatures. Signatures are
+	// re-generated after half of the validity period.
+	// Default is 7 days.
+	Validity time.Duration
+}
+
+// Signer signs responses of a zone on the fly. Signatures are cached.
+type Signer struct {
+	zone     string
+	ksk      *Key
+	zsk      *Key
+	validity time.Duration
+
+	sigCache *concurrent_lru.ShardedLRU[*dns.RRSIG]
+}
+
+func NewSigner(opts Opts) (*Signer, error) {
+	if len(opts.Zone) == 0 {
+		return nil, errors.New("missing zone")
+	}
+	zone := dns.CanonicalName(opts.Zone)
+	if opts.KSK == nil || opts.ZSK == nil {
+		return nil, errors.New("missing key")
+	}
+	for _, k := range [...]*Key{opts.KSK, opts.ZSK} {
+		if !dns.IsFqdn(k.DNSKEY.Hdr.Name) || dns.CanonicalName(k.DNSKEY.Hdr.Name) != zone {
+			return nil, fmt.Errorf("key %d does not belong to zone %s", k.DNSKEY.KeyTag(), zone)
+		}
+	}
+	if !opts.KSK.IsKSK() {
+		return nil, fmt.Errorf("key %d is not a ksk", opts.KSK.DNSKEY.KeyTag())
+	}
+
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = defaultValidity
+	}
+	return &Signer{
+		zone:     zone,
+		ksk:      opts.KSK,
+		zsk:      opts.ZSK,
+		validity: validity,
+		sigCache: concurrent_lru.NewShardedLRU[*dns.RRSIG](sigCacheShards, sigCacheSizePerShard, nil),
+	}, nil
+}
+
+// Zone returns the canonical name of the zone apex.
+func (s *Signer) Zone() string {
+	return s.zone
+}
+
+// InZone reports whether name is the zone apex or a subdomain of it.
+func (s *Signer) InZone(name string) bool {
+	return dns.IsSubDomain(s.zone, dns.CanonicalName(name))
+}
+
+// DNSKEYs returns the DNSKEY rrset of the zone.
+func (s *Signer) DNSKEYs() []dns.RR {
+	rrs := []dns.RR{dns.Copy(s.ksk.DNSKEY)}
+	if s.zsk != s.ksk {
+		rrs = append(rrs, dns.Copy(s.zsk.DNSKEY))
+	}
+	return rrs
+}
+
+// DS returns the DS record of the KSK that should be published in
+// the parent zone or be configured as a trust anchor.
+func (s *Signer) DS() *dns.DS {
+	return s.ksk.DNSKEY.ToDS(dns.SHA256)
+}
+
+// BlackLie returns a NSEC record for name that only covers name itself
+// ("NSEC black lies"). types are the types that exist at name. A
+// non-existent name is reported as an empty non-terminal, so the
+// response for it can be NOERROR/NODATA, which needs no pre-computed chain.
+func (s *Signer) BlackLie(name string, types []uint16, ttl uint32) *dns.NSEC {
+	bitmap := make([]uint16, 0, len(types)+2)
+	bitmap = append(bitmap, types...)
+	bitmap = append(bitmap, dns.TypeRRSIG, dns.TypeNSEC)
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	// dedup
+	n := 0
+	for i, t := range bitmap {
+		if i > 0 && t == bitmap[n-1] {
+			continue
+		}
+		bitmap[n] = t
+		n++
+	}
+	bitmap = bitmap[:n]
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: bitmap,
+	}
+}
+
+// Sign signs rrsets in the answer and authority sections of r that
+// belong to the zone. RRSIGs are appended to the same section.
+func (s *Signer) Sign(r *dns.Msg) error {
+	var err error
+	now := time.Now()
+	if r.Answer, err = s.signSection(r.Answer, now); err != nil {
+		return err
+	}
+	if r.Ns, err = s.signSection(r.Ns, now); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Signer) signSection(rrs []dns.RR, now time.Time) ([]dns.RR, error) {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+		class  uint16
+	}
+	var keys []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT || !s.InZone(h.Name) {
+			continue
+		}
+		k := rrsetKey{name: dns.CanonicalName(h.Name), rrtype: h.Rrtype, class: h.Class}
+		if _, ok := sets[k]; !ok {
+			keys = append(keys, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	for _, k := range keys {
+		sig, err := s.signRRSet(sets[k], now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign %s %s, %w", k.name, dns.TypeToString[k.rrtype], err)
+		}
+		rrs = append(rrs, sig)
+	}
+	return rrs, nil
+}
+
+func (s *Signer) signRRSet(rrset []dns.RR, now time.Time) (*dns.RRSIG, error) {
+	key := s.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key = s.ksk
+	}
+
+	cacheKey := rrsetCacheKey(rrset, key)
+	if sig, ok := s.sigCache.Get(cacheKey); ok {
+		inception := time.Unix(int64(sig.Inception), 0).Add(inceptionOffset)
+		if now.Sub(inception) < s.validity/2 {
+			return dns.Copy(sig).(*dns.RRSIG), nil
+		}
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.DNSKEY.Algorithm,
+		Inception:  uint32(now.Add(-inceptionOffset).Unix()),
+		Expiration: uint32(now.Add(s.validity).Unix()),
+		KeyTag:     key.DNSKEY.KeyTag(),
+		SignerName: s.zone,
+	}
+	if err := sig.Sign(key.Signer, rrset); err != nil {
+		return nil, err
+	}
+	s.sigCache.Add(cacheKey, sig)
+	return dns.Copy(sig).(*dns.RRSIG), nil
+}
+
+// rrsetCacheKey returns a key that identifies the content of rrset
+// and the signing key.
+func rrsetCacheKey(rrset []dns.RR, key *Key) string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%d|", key.DNSKEY.KeyTag())
+	for _, rr := range rrset {
+		b.WriteString(rr.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec_signer
+
+import (
+	"github.com/miekg/dns"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newTestSigner(t *testing.T) *Signer {
+	t.Helper()
+	ksk, err := GenerateKey("example.com.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zsk, err := GenerateKey("example.com.", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSigner(Opts{Zone: "Example.com", KSK: ksk, ZSK: zsk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestSigner_Sign(t *testing.T) {
+	s := newTestSigner(t)
+
+	r := new(dns.Msg)
+	r.Answer = []dns.RR{
+		mustRR(t, "a.example.com. 300 IN A 192.0.2.1"),
+		mustRR(t, "a.example.com. 300 IN A 192.0.2.2"),
+		mustRR(t, "other.test. 300 IN A 192.0.2.3"), // not in zone
+	}
+	r.Ns = s.DNSKEYs()
+	if err := s.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Answer) != 4 || len(r.Ns) != 3 {
+		t.Fatalf("unexpected number of rrs, answer: %d, ns: %d", len(r.Answer), len(r.Ns))
+	}
+	sig := r.Answer[3].(*dns.RRSIG)
+	if err := sig.Verify(s.zsk.DNSKEY, r.Answer[:2]); err != nil {
+		t.Fatalf("answer signature: %v", err)
+	}
+	keySig := r.Ns[2].(*dns.RRSIG)
+	if keySig.KeyTag != s.ksk.DNSKEY.KeyTag() {
+		t.Fatal("DNSKEY rrset is not signed by the ksk")
+	}
+	if err := keySig.Verify(s.ksk.DNSKEY, r.Ns[:2]); err != nil {
+		t.Fatalf("dnskey signature: %v", err)
+	}
+
+	// The cached signature is used.
+	r2 := new(dns.Msg)
+	r2.Answer = []dns.RR{r.Answer[0], r.Answer[1]}
+	if err := s.Sign(r2); err != nil {
+		t.Fatal(err)
+	}
+	if sig2 := r2.Answer[2].(*dns.RRSIG); sig2 == sig || sig2.Signature != sig.Signature {
+		t.Fatal("cached signature should be copied and reused")
+	}
+}
+
+func TestSigner_BlackLie(t *testing.T) {
+	s := newTestSigner(t)
+	nsec := s.BlackLie("x.example.com.", []uint16{dns.TypeTXT, dns.TypeA, dns.TypeNSEC}, 300)
+	if nsec.NextDomain != "\\000.x.example.com." {
+		t.Fatalf("unexpected next domain %s", nsec.NextDomain)
+	}
+	want := []uint16{dns.TypeA, dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}
+	if !reflect.DeepEqual(nsec.TypeBitMap, want) {
+		t.Fatalf("want bitmap %v, got %v", want, nsec.TypeBitMap)
+	}
+	if !s.InZone("X.Example.COM.") || s.InZone("example.org.") {
+		t.Fatal("InZone returned unexpected result")
+	}
+}
+
+func TestLoadOrGenerateKey(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "Kexample.com")
+	k1, err := LoadOrGenerateKey(prefix, "example.com.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := LoadOrGenerateKey(prefix, "example.com.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.DNSKEY.KeyTag() != k2.DNSKEY.KeyTag() || !k2.IsKSK() {
+		t.Fatal("loaded key does not match the generated key")
+	}
+	if _, err := NewSigner(Opts{Zone: "example.com.", KSK: k2, ZSK: k2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadOrGenerateKey_concurrent(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "Kexample.com")
+	keys := make([]*Key, 8)
+	wg := new(sync.WaitGroup)
+	for i := range keys {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := LoadOrGenerateKey(prefix, "example.com.", false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			keys[i] = k
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	for _, k := range keys[1:] {
+		if k.DNSKEY.KeyTag() != keys[0].DNSKEY.KeyTag() {
+			t.Fatal("concurrent callers got different keys")
+		}
+	}
+}
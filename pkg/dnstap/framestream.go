@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame Streams, see https://farsightsec.github.io/fstrm/.
+
+const (
+	contentType = "protobuf:dnstap.Dnstap"
+
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+
+	controlFieldContentType = 1
+
+	maxControlFrameSize = 512
+)
+
+// writeControl writes a control frame. If ct is true, the content type
+// field is included.
+func writeControl(w io.Writer, typ uint32, ct bool) error {
+	b := make([]byte, 12, 20+len(contentType))
+	// b[0:4] is the zero escape.
+	binary.BigEndian.PutUint32(b[8:12], typ)
+	if ct {
+		b = appendUint32(b, controlFieldContentType)
+		b = appendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(b)-8))
+	_, err := w.Write(b)
+	return err
+}
+
+// readControl reads a control frame and returns its type and whether
+// it contains the dnstap content type.
+func readControl(r io.Reader) (typ uint32, ct bool, err error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, false, err
+	}
+	if binary.BigEndian.Uint32(h[0:4]) != 0 {
+		return 0, false, errors.New("unexpected data frame")
+	}
+	l := binary.BigEndian.Uint32(h[4:8])
+	if l < 4 || l > maxControlFrameSize {
+		return 0, false, fmt.Errorf("invalid control frame length %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, false, err
+	}
+	typ = binary.BigEndian.Uint32(b)
+	b = b[4:]
+	for len(b) >= 8 {
+		field, fl := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+		b = b[8:]
+		if uint32(len(b)) < fl {
+			return 0, false, errors.New("invalid control field length")
+		}
+		if field == controlFieldContentType && string(b[:fl]) == contentType {
+			ct = true
+		}
+		b = b[fl:]
+	}
+	return typ, ct, nil
+}
+
+// handshake runs the writer side of the bidirectional handshake.
+func handshake(rw io.ReadWriter) error {
+	if err := writeControl(rw, controlReady, true); err != nil {
+		return err
+	}
+	typ, ct, err := readControl(rw)
+	if err != nil {
+		return fmt.Errorf("failed to read accept frame, %w", err)
+	}
+	if typ != controlAccept {
+		return fmt.Errorf("unexpected control frame type %d", typ)
+	}
+	if !ct {
+		return errors.New("content type is not accepted by the collector")
+	}
+	return writeControl(rw, controlStart, true)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnstap implements a dnstap sender. Messages are encoded as
+// dnstap.Dnstap protobuf messages (see https://dnstap.info) and sent over
+// a bidirectional Frame Streams connection.
+package dnstap
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"net/netip"
+	"time"
+)
+
+// MessageType is the dnstap Message.Type.
+type MessageType int32
+
+const (
+	MessageAuthQuery         MessageType = 1
+	MessageAuthResponse      MessageType = 2
+	MessageResolverQuery     MessageType = 3
+	MessageResolverResponse  MessageType = 4
+	MessageClientQuery       MessageType = 5
+	MessageClientResponse    MessageType = 6
+	MessageForwarderQuery    MessageType = 7
+	MessageForwarderResponse MessageType = 8
+)
+
+// SocketProtocol is the dnstap SocketProtocol.
+type SocketProtocol int32
+
+const (
+	ProtocolUDP         SocketProtocol = 1
+	ProtocolTCP         SocketProtocol = 2
+	ProtocolDOT         SocketProtocol = 3
+	ProtocolDOH         SocketProtocol = 4
+	ProtocolDNSCryptUDP SocketProtocol = 5
+	ProtocolDNSCryptTCP SocketProtocol = 6
+	ProtocolDOQ         SocketProtocol = 7
+)
+
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Field numbers of dnstap.proto.
+const (
+	fieldDnstapIdentity = 1
+	fieldDnstapVersion  = 2
+	fieldDnstapMessage  = 14
+	fieldDnstapType     = 15
+
+	fieldMessageType             = 1
+	fieldMessageSocketFamily     = 2
+	fieldMessageSocketProtocol   = 3
+	fieldMessageQueryAddress     = 4
+	fieldMessageResponseAddress  = 5
+	fieldMessageQueryPort        = 6
+	fieldMessageResponsePort     = 7
+	fieldMessageQueryTimeSec     = 8
+	fieldMessageQueryTimeNsec    = 9
+	fieldMessageQueryMessage     = 10
+	fieldMessageResponseTimeSec  = 12
+	fieldMessageResponseTimeNsec = 13
+	fieldMessageResponseMessage  = 14
+)
+
+// Message is a dnstap Message. Zero fields are omitted.
+type Message struct {
+	Type     MessageType
+	Protocol SocketProtocol
+
+	// QueryAddr is the address of the initiator of the query, e.g. the
+	// client of CLIENT_* messages, or mosdns itself of FORWARDER_*
+	// messages. ResponseAddr is the address of the responder.
+	// The socket family is derived from QueryAddr, or ResponseAddr if
+	// QueryAddr is invalid.
+	QueryAddr    netip.AddrPort
+	ResponseAddr netip.AddrPort
+
+	QueryTime       time.Time
+	QueryMessage    []byte // wire format
+	ResponseTime    time.Time
+	ResponseMessage []byte // wire format
+}
+
+// appendDnstap appends m as a dnstap.Dnstap message to b.
+func appendDnstap(b []byte, identity, version string, m *Message) []byte {
+	if len(identity) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapIdentity, protowire.BytesType)
+		b = protowire.AppendString(b, identity)
+	}
+	if len(version) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapVersion, protowire.BytesType)
+		b = protowire.AppendString(b, version)
+	}
+	b = protowire.AppendTag(b, fieldDnstapMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.marshal())
+	b = protowire.AppendTag(b, fieldDnstapType, protowire.VarintType)
+	b = protowire.AppendVarint(b, dnstapTypeMessage)
+	return b
+}
+
+func (m *Message) marshal() []byte {
+	b := make([]byte, 0, 64+len(m.QueryMessage)+len(m.ResponseMessage))
+	b = appendVarint(b, fieldMessageType, uint64(m.Type))
+
+	family := m.QueryAddr.Addr()
+	if !family.IsValid() {
+		family = m.ResponseAddr.Addr()
+	}
+	switch {
+	case family.Is4() || family.Is4In6():
+		b = appendVarint(b, fieldMessageSocketFamily, socketFamilyINET)
+	case family.Is6():
+		b = appendVarint(b, fieldMessageSocketFamily, socketFamilyINET6)
+	}
+	if m.Protocol != 0 {
+		b = appendVarint(b, fieldMessageSocketProtocol, uint64(m.Protocol))
+	}
+
+	b = appendAddrPort(b, fieldMessageQueryAddress, fieldMessageQueryPort, m.QueryAddr)
+	b = appendAddrPort(b, fieldMessageResponseAddress, fieldMessageResponsePort, m.ResponseAddr)
+	b = appendTime(b, fieldMessageQueryTimeSec, fieldMessageQueryTimeNsec, m.QueryTime)
+	b = appendBytes(b, fieldMessageQueryMessage, m.QueryMessage)
+	b = appendTime(b, fieldMessageResponseTimeSec, fieldMessageResponseTimeNsec, m.ResponseTime)
+	b = appendBytes(b, fieldMessageResponseMessage, m.ResponseMessage)
+	return b
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendAddrPort(b []byte, addrNum, portNum protowire.Number, ap netip.AddrPort) []byte {
+	if !ap.Addr().IsValid() {
+		return b
+	}
+	b = appendBytes(b, addrNum, ap.Addr().Unmap().AsSlice())
+	if ap.Port() != 0 {
+		b = appendVarint(b, portNum, uint64(ap.Port()))
+	}
+	return b
+}
+
+func appendTime(b []byte, secNum, nsecNum protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = appendVarint(b, secNum, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecNum, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
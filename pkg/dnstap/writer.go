@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSize = 4096
+
+	dialTimeout  = 5 * time.Second
+	ioTimeout    = 5 * time.Second
+	minBackoff   = time.Second
+	maxBackoff   = 30 * time.Second
+	writeBufSize = 64 * 1024
+)
+
+type Opts struct {
+	// Network is "unix" or "tcp".
+	Network string
+	Addr    string
+
+	// Identity and Version are sent in every dnstap message. Optional.
+	Identity string
+	Version  string
+
+	// QueueSize is the maximum number of pending messages. Messages are
+	// dropped if the queue is full, e.g. the collector is slow or
+	// unreachable. Default is 4096.
+	QueueSize int
+
+	Logger *zap.Logger
+}
+
+// Writer sends dnstap messages to a collector. It connects in the
+// background and reconnects with backoff if the connection is lost.
+// Writer is safe for concurrent use.
+type Writer struct {
+	opts   Opts
+	logger *zap.Logger
+	queue  chan []byte
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+func NewWriter(opts Opts) (*Writer, error) {
+	switch opts.Network {
+	case "unix", "tcp":
+	default:
+		return nil, errors.New("network must be unix or tcp")
+	}
+	if len(opts.Addr) == 0 {
+		return nil, errors.New("missing collector address")
+	}
+	utils.SetDefaultNum(&opts.QueueSize, defaultQueueSize)
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	w := &Writer{
+		opts:        opts,
+		logger:      logger,
+		queue:       make(chan []byte, opts.QueueSize),
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues m. It never blocks and reports false if m is dropped
+// because the queue is full or w is closed.
+// m can be reused after Write returns.
+func (w *Writer) Write(m *Message) bool {
+	select {
+	case <-w.closeNotify:
+		return false
+	default:
+	}
+	b := appendDnstap(nil, w.opts.Identity, w.opts.Version, m)
+	select {
+	case w.queue <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close flushes queued messages if the collector is connected, stops
+// the stream and closes the connection.
+func (w *Writer) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closeNotify)
+	})
+	<-w.done
+	return nil
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	backoff := minBackoff
+	for {
+		c, err := w.connect()
+		if err != nil {
+			w.logger.Warn("failed to connect to dnstap collector", zap.String("addr", w.opts.Addr), zap.Error(err))
+			select {
+			case <-time.After(backoff):
+			case <-w.closeNotify:
+				return
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		closed, err := w.serve(c)
+		c.Close()
+		if closed {
+			if err != nil {
+				w.logger.Warn("failed to stop dnstap stream", zap.Error(err))
+			}
+			return
+		}
+		w.logger.Warn("dnstap connection lost", zap.String("addr", w.opts.Addr), zap.Error(err))
+	}
+}
+
+func (w *Writer) connect() (net.Conn, error) {
+	c, err := net.DialTimeout(w.opts.Network, w.opts.Addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(ioTimeout))
+	if err := handshake(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// serve sends queued messages to c until w is closed or an error occurs.
+// closed reports whether w was closed.
+func (w *Writer) serve(c net.Conn) (closed bool, err error) {
+	bw := bufio.NewWriterSize(c, writeBufSize)
+	var hdr [4]byte
+	writeFrame := func(b []byte) error {
+		c.SetWriteDeadline(time.Now().Add(ioTimeout))
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+		bw.Write(hdr[:])
+		_, err := bw.Write(b)
+		return err
+	}
+
+	for {
+		select {
+		case b := <-w.queue:
+			if err := writeFrame(b); err != nil {
+				return false, err
+			}
+			if len(w.queue) == 0 {
+				if err := bw.Flush(); err != nil {
+					return false, err
+				}
+			}
+		case <-w.closeNotify:
+			for len(w.queue) > 0 {
+				if err := writeFrame(<-w.queue); err != nil {
+					return true, err
+				}
+			}
+			return true, stop(c, bw)
+		}
+	}
+}
+
+// stop sends the STOP frame and waits for the FINISH frame.
+func stop(c net.Conn, bw *bufio.Writer) error {
+	c.SetDeadline(time.Now().Add(ioTimeout))
+	if err := writeControl(bw, controlStop, false); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	typ, _, err := readControl(c)
+	if err != nil {
+		return err
+	}
+	if typ != controlFinish {
+		return errors.New("unexpected control frame type")
+	}
+	return nil
+}
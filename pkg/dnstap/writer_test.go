@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// collector is a minimal Frame Streams reader.
+func collector(t *testing.T, l net.Listener, frames chan<- []byte) {
+	c, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+	defer close(frames)
+	r := bufio.NewReader(c)
+
+	if typ, ct, err := readControl(r); err != nil || typ != controlReady || !ct {
+		t.Errorf("bad ready frame: %d %v %v", typ, ct, err)
+		return
+	}
+	if err := writeControl(c, controlAccept, true); err != nil {
+		t.Error(err)
+		return
+	}
+	if typ, ct, err := readControl(r); err != nil || typ != controlStart || !ct {
+		t.Errorf("bad start frame: %d %v %v", typ, ct, err)
+		return
+	}
+
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			t.Error(err)
+			return
+		}
+		l := binary.BigEndian.Uint32(h[:])
+		if l == 0 { // control frame
+			var cl [4]byte
+			io.ReadFull(r, cl[:])
+			b := make([]byte, binary.BigEndian.Uint32(cl[:]))
+			io.ReadFull(r, b)
+			if typ := binary.BigEndian.Uint32(b); typ != controlStop {
+				t.Errorf("unexpected control frame %d", typ)
+			}
+			writeControl(c, controlFinish, false)
+			return
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Error(err)
+			return
+		}
+		frames <- b
+	}
+}
+
+// fields decodes a protobuf message into field number -> raw value.
+// Varint and fixed32 values are returned as uint64.
+func fields(t *testing.T, b []byte) map[protowire.Number]interface{} {
+	t.Helper()
+	m := make(map[protowire.Number]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m[num], b = v, b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			m[num], b = uint64(v), b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			m[num], b = v, b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	return m
+}
+
+func TestWriter(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	frames := make(chan []byte, 16)
+	go collector(t, l, frames)
+
+	w, err := NewWriter(Opts{Network: "unix", Addr: sock, Identity: "test", Version: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qt := time.Unix(1650000000, 123456789)
+	ok := w.Write(&Message{
+		Type:         MessageClientResponse,
+		Protocol:     ProtocolUDP,
+		QueryAddr:    netip.MustParseAddrPort("192.0.2.1:5353"),
+		ResponseAddr: netip.MustParseAddrPort("[::ffff:192.0.2.2]:53"),
+		QueryTime:    qt,
+		QueryMessage: []byte{1, 2, 3},
+		ResponseTime: qt.Add(time.Millisecond),
+	})
+	if !ok {
+		t.Fatal("message dropped")
+	}
+	w.Write(&Message{Type: MessageForwarderQuery, ResponseAddr: netip.MustParseAddrPort("[2001:db8::1]:53")})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Write(&Message{}) {
+		t.Fatal("write after close should fail")
+	}
+
+	var got [][]byte
+	for b := range frames {
+		got = append(got, b)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 frames, got %d", len(got))
+	}
+
+	d := fields(t, got[0])
+	if string(d[fieldDnstapIdentity].([]byte)) != "test" || string(d[fieldDnstapVersion].([]byte)) != "v1" || d[fieldDnstapType] != uint64(dnstapTypeMessage) {
+		t.Fatalf("unexpected dnstap fields %v", d)
+	}
+	m := fields(t, d[fieldDnstapMessage].([]byte))
+	want := map[protowire.Number]interface{}{
+		fieldMessageType:             uint64(MessageClientResponse),
+		fieldMessageSocketFamily:     uint64(socketFamilyINET),
+		fieldMessageSocketProtocol:   uint64(ProtocolUDP),
+		fieldMessageQueryPort:        uint64(5353),
+		fieldMessageResponsePort:     uint64(53),
+		fieldMessageQueryTimeSec:     uint64(1650000000),
+		fieldMessageQueryTimeNsec:    uint64(123456789),
+		fieldMessageResponseTimeSec:  uint64(1650000000),
+		fieldMessageResponseTimeNsec: uint64(124456789),
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("field %d: want %v, got %v", k, v, m[k])
+		}
+	}
+	if a := netip.AddrFrom4(*(*[4]byte)(m[fieldMessageResponseAddress].([]byte))); a.String() != "192.0.2.2" {
+		t.Errorf("unexpected response address %s", a)
+	}
+	if _, ok := m[fieldMessageResponseMessage]; ok {
+		t.Error("empty response message should be omitted")
+	}
+
+	m = fields(t, fields(t, got[1])[fieldDnstapMessage].([]byte))
+	if m[fieldMessageSocketFamily] != uint64(socketFamilyINET6) || len(m[fieldMessageResponseAddress].([]byte)) != 16 {
+		t.Errorf("unexpected forwarder query fields %v", m)
+	}
+}
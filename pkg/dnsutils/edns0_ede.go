@@ -0,0 +1,37 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import "github.com/miekg/dns"
+
+// AddEDE adds an extended dns error (RFC 8914) to the response r of
+// query q. r gets an OPT record if it has none. It is a noop if q does
+// not support EDNS0, since clients that do not send an OPT record
+// cannot receive one.
+func AddEDE(q, r *dns.Msg, code uint16, text string) {
+	if q.IsEdns0() == nil {
+		return
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		opt = UpgradeEDNS0(r)
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
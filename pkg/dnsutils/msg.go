@@ -53,6 +53,22 @@ func GetMinimalTTL(m *dns.Msg) uint32 {
 	return minTTL
 }
 
+// GetNegativeTTL returns the negative caching ttl of m, which is the
+// minimum of the ttl and the MINIMUM field of the SOA record in the
+// authority section (RFC 2308 section 5). ok is false if m has no SOA.
+func GetNegativeTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, rr := range m.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
 // SetTTL updates all records' ttl to ttl, except opt record.
 func SetTTL(m *dns.Msg, ttl uint32) {
 	for _, section := range [...][]dns.RR{m.Answer, m.Ns, m.Extra} {
@@ -22,6 +22,7 @@ package executable_seq
 import (
 	"context"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/Knetic/govaluate"
 	"go.uber.org/zap"
@@ -158,24 +159,32 @@ func (r exprResult) String() string {
 	}
 }
 
+// matcherCall calls a matcher of the expression for a query. It is
+// allocated from the arena of the query, so calls don't produce garbage.
+type matcherCall struct {
+	ctx  context.Context
+	qCtx *query_context.Context
+	m    Matcher
+}
+
 type exprParamsPlaceHolder struct {
-	f   map[string]func() (bool, error)
+	f   map[string]*matcherCall
 	res map[string]exprResult
 }
 
 func newExprParamsPlaceHolder() *exprParamsPlaceHolder {
 	return &exprParamsPlaceHolder{
-		f:   make(map[string]func() (bool, error)),
+		f:   make(map[string]*matcherCall),
 		res: make(map[string]exprResult),
 	}
 }
 
 func (e *exprParamsPlaceHolder) Get(name string) (interface{}, error) {
-	f, ok := e.f[name]
+	c, ok := e.f[name]
 	if !ok {
 		return nil, fmt.Errorf("cannot find var %s", name)
 	}
-	res, err := f()
+	res, err := c.m.Match(c.ctx, c.qCtx)
 	if err != nil {
 		return nil, err
 	}
@@ -187,15 +196,25 @@ func (e *exprParamsPlaceHolder) Get(name string) (interface{}, error) {
 	return res, nil
 }
 
-func (e *exprParamsPlaceHolder) setCall(name string, f func() (bool, error)) {
-	e.f[name] = f
+func (e *exprParamsPlaceHolder) setCall(name string, c *matcherCall) {
+	e.f[name] = c
+}
+
+// reset clears calls and results of the last query. Calls point to
+// memory of its arena.
+func (e *exprParamsPlaceHolder) reset() {
+	for name := range e.f {
+		e.f[name] = nil
+	}
+	for name := range e.res {
+		delete(e.res, name)
+	}
 }
 
 // A helper func for better log.
-func (e *exprParamsPlaceHolder) makeResultZapFields(queryInfoField zap.Field, res bool) []zap.Field {
-	o := make([]zap.Field, 2, len(e.res)+2)
-	o[0] = queryInfoField
-	o[1] = zap.Bool("result", res)
+func (e *exprParamsPlaceHolder) makeResultZapFields(qCtx *query_context.Context, res bool) []zap.Field {
+	o := make([]zap.Field, 0, len(e.res)+2)
+	o = append(o, qCtx.InfoField(), zap.Bool("result", res))
 	for s, result := range e.res {
 		o = append(o, zap.Stringer(s, result))
 	}
@@ -207,24 +226,27 @@ func (m *conditionMatcher) Match(ctx context.Context, qCtx *query_context.Contex
 	if !ok {
 		paramsPH = newExprParamsPlaceHolder()
 	}
-	defer m.paramsPHPool.Put(paramsPH)
+	defer func() {
+		paramsPH.reset()
+		m.paramsPHPool.Put(paramsPH)
+	}()
 
+	calls := pool.AllocSlice[matcherCall](qCtx.Arena(), len(m.matchers))
+	i := 0
 	for tag, matcher := range m.matchers {
-		matcher := matcher
-		f := func() (bool, error) {
-			return matcher.Match(ctx, qCtx)
-		}
-		paramsPH.setCall(tag, f)
+		c := &calls[i]
+		i++
+		c.ctx, c.qCtx, c.m = ctx, qCtx, matcher
+		paramsPH.setCall(tag, c)
 	}
 	out, err := m.expr.Eval(paramsPH)
 	if err != nil {
 		return false, err
 	}
 	res := out.(bool)
-	m.lg.Debug(
-		"condition matcher result",
-		paramsPH.makeResultZapFields(qCtx.InfoField(), res)...,
-	)
+	if ce := m.lg.Check(zap.DebugLevel, "condition matcher result"); ce != nil {
+		ce.Write(paramsPH.makeResultZapFields(qCtx, res)...)
+	}
 	return res, nil
 }
 
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func newTestConditionMatcher(tb testing.TB) *conditionMatcher {
+	ms := map[string]Matcher{
+		"a": &DummyMatcher{Matched: false},
+		"b": &DummyMatcher{Matched: true},
+		"c": &DummyMatcher{Matched: true},
+	}
+	cm, err := newConditionMatcher(zap.NewNop(), "a || b && c", ms)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cm
+}
+
+func newTestQCtx() *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	return query_context.NewContext(q, nil)
+}
+
+// Matcher calls are allocated from the query arena. Without it, Match
+// has 4 allocs, 1 from govaluate and 1 for the call of each matcher.
+func Test_conditionMatcher_allocs(t *testing.T) {
+	cm := newTestConditionMatcher(t)
+	qCtx := newTestQCtx()
+	allocs := testing.AllocsPerRun(100, func() {
+		ok, err := cm.Match(context.Background(), qCtx)
+		if err != nil || !ok {
+			t.Fatal("unexpected result")
+		}
+		qCtx.ReleaseArena()
+	})
+	if allocs > 1 {
+		t.Fatalf("want at most 1 alloc from govaluate, got %v", allocs)
+	}
+}
+
+func Benchmark_conditionMatcher_Match(b *testing.B) {
+	cm := newTestConditionMatcher(b)
+	qCtx := newTestQCtx()
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = cm.Match(ctx, qCtx)
+		qCtx.ReleaseArena()
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Entry is a parsed hosts entry.
+type Entry struct {
+	Pattern string
+	IPs     *IPs
+}
+
+// ParseHostsFile parses hosts entries in b. Each line is either a hosts
+// entry ("pattern ip..."), or a line of a system hosts file ("ip name...").
+// In the latter case, addresses of the same name are merged.
+// Texts after "#" are comments.
+func ParseHostsFile(b []byte) ([]Entry, error) {
+	var entries []Entry
+	systemHosts := make(map[string]int) // name -> index in entries
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineCounter := 0
+	for scanner.Scan() {
+		lineCounter++
+		s := strings.TrimSpace(utils.RemoveComment(scanner.Text(), "#"))
+		if len(s) == 0 {
+			continue
+		}
+		f := strings.Fields(s)
+		if ip, err := netip.ParseAddr(f[0]); err == nil {
+			if len(f) < 2 {
+				return nil, fmt.Errorf("line %d: missing host name", lineCounter)
+			}
+			ip = ip.Unmap()
+			for _, name := range f[1:] {
+				i, ok := systemHosts[name]
+				if !ok {
+					i = len(entries)
+					systemHosts[name] = i
+					entries = append(entries, Entry{Pattern: domain.MatcherFull + ":" + name, IPs: new(IPs)})
+				}
+				v := entries[i].IPs
+				if ip.Is4() {
+					v.IPv4 = append(v.IPv4, ip)
+				} else {
+					v.IPv6 = append(v.IPv6, ip)
+				}
+			}
+			continue
+		}
+		pattern, v, err := ParseIPs(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineCounter, err)
+		}
+		entries = append(entries, Entry{Pattern: pattern, IPs: v})
+	}
+	return entries, scanner.Err()
+}
+
+// NewMatcher creates a matcher of hosts entries. The default match type
+// is full. Later entries replace earlier entries with the same pattern.
+func NewMatcher(entries []Entry) (*domain.MixMatcher[*IPs], error) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	for _, e := range entries {
+		if err := m.Add(e.Pattern, e.IPs); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s, %w", e.Pattern, err)
+		}
+	}
+	return m, nil
+}
+
+// PTRIndex maps addresses of hosts entries to their names, so PTR
+// queries can be answered. Entries of each source are updated
+// independently. Only entries of full and domain patterns are indexed,
+// and wildcards are ignored. It is safe for concurrent use.
+type PTRIndex struct {
+	mu      sync.RWMutex
+	sources map[string]map[netip.Addr][]string
+}
+
+func NewPTRIndex() *PTRIndex {
+	return &PTRIndex{sources: make(map[string]map[netip.Addr][]string)}
+}
+
+// Update replaces the entries of source with entries.
+func (x *PTRIndex) Update(source string, entries []Entry) {
+	m := make(map[netip.Addr][]string)
+	for _, e := range entries {
+		if len(e.IPs.wildcard) > 0 {
+			continue
+		}
+		typ, name, ok := utils.SplitString2(e.Pattern, ":")
+		if !ok {
+			name = e.Pattern
+		} else if typ != domain.MatcherFull && typ != domain.MatcherDomain {
+			continue
+		}
+		name = dns.Fqdn(name)
+		for _, ips := range [...][]netip.Addr{e.IPs.IPv4, e.IPs.IPv6} {
+			for _, ip := range ips {
+				m[ip] = appendUnique(m[ip], name)
+			}
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.sources[source] = m
+}
+
+// Lookup returns the names of addr.
+func (x *PTRIndex) Lookup(addr netip.Addr) []string {
+	addr = addr.Unmap()
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	sources := make([]string, 0, len(x.sources))
+	for source := range x.sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	var names []string
+	for _, source := range sources {
+		for _, name := range x.sources[source][addr] {
+			names = appendUnique(names, name)
+		}
+	}
+	return names
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, e := range s {
+		if strings.EqualFold(e, v) {
+			return s
+		}
+	}
+	return append(s, v)
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/miekg/dns"
 	"net/netip"
 	"strings"
@@ -31,6 +32,7 @@ import (
 
 type Hosts struct {
 	matcher domain.Matcher[*IPs]
+	ptr     *PTRIndex // nil if PTR queries are not answered.
 }
 
 // NewHosts creates a hosts using m.
@@ -40,11 +42,23 @@ func NewHosts(m domain.Matcher[*IPs]) *Hosts {
 	}
 }
 
+// NewHostsWithPTR creates a hosts using m, which also answers PTR
+// queries of addresses in ptr.
+func NewHostsWithPTR(m domain.Matcher[*IPs], ptr *PTRIndex) *Hosts {
+	return &Hosts{
+		matcher: m,
+		ptr:     ptr,
+	}
+}
+
 func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 	ips, ok := h.matcher.Match(fqdn)
 	if !ok {
 		return nil, nil // no such host
 	}
+	if len(ips.wildcard) > 0 && strings.EqualFold(dns.Fqdn(fqdn), ips.wildcard) {
+		return nil, nil // wildcards don't match their parents.
+	}
 	return ips.IPv4, ips.IPv6
 }
 
@@ -55,7 +69,13 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	q := m.Question[0]
 	typ := q.Qtype
 	fqdn := q.Name
-	if q.Qclass != dns.ClassINET || (typ != dns.TypeA && typ != dns.TypeAAAA) {
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	if typ == dns.TypePTR && h.ptr != nil {
+		return h.lookupPTRMsg(m)
+	}
+	if typ != dns.TypeA && typ != dns.TypeAAAA {
 		return nil
 	}
 
@@ -103,13 +123,47 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	return r
 }
 
+func (h *Hosts) lookupPTRMsg(m *dns.Msg) *dns.Msg {
+	fqdn := m.Question[0].Name
+	addr, err := utils.ParsePTRName(strings.ToLower(fqdn))
+	if err != nil {
+		return nil
+	}
+	names := h.ptr.Lookup(addr)
+	if len(names) == 0 {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.RecursionAvailable = true
+	for _, name := range names {
+		r.Answer = append(r.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   fqdn,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    10,
+			},
+			Ptr: name,
+		})
+	}
+	return r
+}
+
 type IPs struct {
 	IPv4 []netip.Addr
 	IPv6 []netip.Addr
+
+	// wildcard is the parent domain (lower case fqdn) of a wildcard
+	// pattern "*.parent", which matches subdomains of the parent only.
+	wildcard string
 }
 
 var _ domain.ParseStringFunc[*IPs] = ParseIPs
 
+// ParseIPs parses a hosts entry "pattern ip...". A pattern "*.parent"
+// matches all subdomains of the parent.
 func ParseIPs(s string) (string, *IPs, error) {
 	f := strings.Fields(s)
 	if len(f) == 0 {
@@ -118,6 +172,10 @@ func ParseIPs(s string) (string, *IPs, error) {
 
 	pattern := f[0]
 	v := new(IPs)
+	if parent, ok := cutWildcard(pattern); ok {
+		pattern = domain.MatcherDomain + ":" + parent
+		v.wildcard = strings.ToLower(dns.Fqdn(parent))
+	}
 	for _, ipStr := range f[1:] {
 		ip, err := netip.ParseAddr(ipStr)
 		if err != nil {
@@ -133,3 +191,10 @@ func ParseIPs(s string) (string, *IPs, error) {
 
 	return pattern, v, nil
 }
+
+func cutWildcard(pattern string) (parent string, ok bool) {
+	if strings.HasPrefix(pattern, "*.") && len(pattern) > 2 {
+		return pattern[2:], true
+	}
+	return "", false
+}
@@ -103,3 +103,70 @@ func Test_hostsContainer_Match(t *testing.T) {
 		})
 	}
 }
+
+func Test_Hosts_wildcardAndPTR(t *testing.T) {
+	entries, err := ParseHostsFile([]byte(`
+*.lan 192.168.1.100
+nas.lan 192.168.1.10 fd00::10
+192.168.1.20 printer.lan printer # system hosts format
+192.168.1.21 printer.lan
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMatcher(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr := NewPTRIndex()
+	ptr.Update("", entries)
+	h := NewHostsWithPTR(m, ptr)
+
+	tests := []struct {
+		name string
+		typ  uint16
+		want []string // nil means no response.
+	}{
+		{"pc.lan.", dns.TypeA, []string{"192.168.1.100"}},
+		{"a.b.lan.", dns.TypeA, []string{"192.168.1.100"}},
+		{"lan.", dns.TypeA, nil},
+		{"nas.lan.", dns.TypeA, []string{"192.168.1.10"}},
+		{"printer.lan.", dns.TypeA, []string{"192.168.1.20", "192.168.1.21"}},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"nas.lan."}},
+		{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, []string{"nas.lan."}},
+		{"20.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"printer.lan.", "printer."}},
+		{"100.1.168.192.in-addr.arpa.", dns.TypePTR, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.name, tt.typ)
+			r := h.LookupMsg(q)
+			if tt.want == nil {
+				if r != nil {
+					t.Fatalf("want no response, got %v", r)
+				}
+				return
+			}
+			if r == nil || len(r.Answer) != len(tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, r)
+			}
+			for i, rr := range r.Answer {
+				var got string
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.PTR:
+					got = rr.Ptr
+				}
+				if got != tt.want[i] {
+					t.Fatalf("want %v, got %v", tt.want, r.Answer)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseHostsFile([]byte("192.168.1.1")); err == nil {
+		t.Fatal("want an error for a line without names")
+	}
+}
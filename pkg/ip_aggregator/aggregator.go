@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_aggregator
+
+import (
+	"go4.org/netipx"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxMergeLimit is the upper limit of Opts.MaxMerge. Each block
+	// holds at most 2^MaxMergeLimit base prefixes.
+	MaxMergeLimit = 8
+)
+
+// Opts for Aggregator.
+type Opts struct {
+	// Mask is the prefix length that addresses will be masked to.
+	// It must be a valid prefix length of the address family.
+	Mask int
+
+	// MaxMerge is the maximum number of bits that contiguous prefixes can be
+	// merged above Mask. e.g. Mask 24 with MaxMerge 2 allows four contiguous
+	// /24 prefixes to be merged into one /22 prefix.
+	// Zero disables the aggregation. Max is MaxMergeLimit.
+	MaxMerge int
+}
+
+// Diff represents prefixes that should be added to or deleted from the set
+// to keep it in sync with the Aggregator.
+type Diff struct {
+	Add []netip.Prefix
+	Del []netip.Prefix
+}
+
+// IsEmpty returns true if d has nothing to change.
+func (d *Diff) IsEmpty() bool {
+	return len(d.Add) == 0 && len(d.Del) == 0
+}
+
+// Merge merges a later Diff o into d. Prefixes that are added and
+// then deleted (or vice versa) cancel each other out.
+func (d *Diff) Merge(o Diff) {
+	d.merge(o.Add, o.Del)
+}
+
+func (d *Diff) merge(add, del []netip.Prefix) {
+	for _, p := range del {
+		if i := indexOf(d.Add, p); i >= 0 {
+			d.Add = append(d.Add[:i], d.Add[i+1:]...)
+			continue
+		}
+		d.Del = append(d.Del, p)
+	}
+	for _, p := range add {
+		if i := indexOf(d.Del, p); i >= 0 {
+			d.Del = append(d.Del[:i], d.Del[i+1:]...)
+			continue
+		}
+		d.Add = append(d.Add, p)
+	}
+}
+
+func indexOf(s []netip.Prefix, p netip.Prefix) int {
+	for i := range s {
+		if s[i] == p {
+			return i
+		}
+	}
+	return -1
+}
+
+// Aggregator tracks prefixes with their expiration time, and merges
+// contiguous prefixes into larger ones. Expired prefixes are removed and
+// the merged prefixes they belong to are split back.
+// Aggregator only does bookkeeping. Caller applies the returned Diff
+// to the real set (ipset, nftables etc.).
+// It is safe for concurrent use.
+type Aggregator struct {
+	opts Opts
+
+	m      sync.Mutex
+	blocks map[netip.Prefix]*block // blocks with prefix length of Mask - MaxMerge
+}
+
+type block struct {
+	entries   map[netip.Prefix]time.Time // base prefix -> expiration time
+	installed []netip.Prefix             // aggregated prefixes
+}
+
+// NewAggregator inits a Aggregator. Invalid MaxMerge will be clamped.
+func NewAggregator(opts Opts) *Aggregator {
+	if opts.MaxMerge < 0 {
+		opts.MaxMerge = 0
+	}
+	if opts.MaxMerge > MaxMergeLimit {
+		opts.MaxMerge = MaxMergeLimit
+	}
+	if opts.MaxMerge > opts.Mask {
+		opts.MaxMerge = opts.Mask
+	}
+	return &Aggregator{
+		opts:   opts,
+		blocks: make(map[netip.Prefix]*block),
+	}
+}
+
+// Add adds addr to the Aggregator. If addr already exists, its expiration
+// time will be extended to now+ttl if that is later.
+func (a *Aggregator) Add(addr netip.Addr, ttl time.Duration, now time.Time) Diff {
+	var d Diff
+	base, err := addr.Prefix(a.opts.Mask)
+	if err != nil {
+		return d
+	}
+	root, _ := addr.Prefix(a.opts.Mask - a.opts.MaxMerge)
+	expirationTime := now.Add(ttl)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	b := a.blocks[root]
+	if b == nil {
+		b = &block{entries: make(map[netip.Prefix]time.Time)}
+		a.blocks[root] = b
+	}
+	if et, ok := b.entries[base]; ok {
+		if expirationTime.After(et) {
+			b.entries[base] = expirationTime
+		}
+		return d
+	}
+	b.entries[base] = expirationTime
+	d.merge(a.update(root, b))
+	return d
+}
+
+// Expire removes all prefixes that have been expired at now.
+func (a *Aggregator) Expire(now time.Time) Diff {
+	var d Diff
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for root, b := range a.blocks {
+		changed := false
+		for p, et := range b.entries {
+			if now.After(et) {
+				delete(b.entries, p)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		d.merge(a.update(root, b))
+		if len(b.entries) == 0 {
+			delete(a.blocks, root)
+		}
+	}
+	return d
+}
+
+// Flush removes all prefixes.
+func (a *Aggregator) Flush() Diff {
+	var d Diff
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	for root, b := range a.blocks {
+		d.Del = append(d.Del, b.installed...)
+		delete(a.blocks, root)
+	}
+	return d
+}
+
+// Len returns the number of aggregated prefixes.
+func (a *Aggregator) Len() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	n := 0
+	for _, b := range a.blocks {
+		n += len(b.installed)
+	}
+	return n
+}
+
+// Installed returns all aggregated prefixes, i.e. the expected content
+// of the real set. It can be used to resync the set after a failed update.
+func (a *Aggregator) Installed() []netip.Prefix {
+	a.m.Lock()
+	defer a.m.Unlock()
+	var ps []netip.Prefix
+	for _, b := range a.blocks {
+		ps = append(ps, b.installed...)
+	}
+	return ps
+}
+
+// update re-aggregates the block and returns prefixes that need to be
+// added and deleted.
+func (a *Aggregator) update(root netip.Prefix, b *block) (add, del []netip.Prefix) {
+	newInstalled := a.aggregate(root, b.entries, nil)
+
+	oldSet := make(map[netip.Prefix]struct{}, len(b.installed))
+	for _, p := range b.installed {
+		oldSet[p] = struct{}{}
+	}
+	newSet := make(map[netip.Prefix]struct{}, len(newInstalled))
+	for _, p := range newInstalled {
+		newSet[p] = struct{}{}
+		if _, ok := oldSet[p]; !ok {
+			add = append(add, p)
+		}
+	}
+	for _, p := range b.installed {
+		if _, ok := newSet[p]; !ok {
+			del = append(del, p)
+		}
+	}
+	b.installed = newInstalled
+	return add, del
+}
+
+// aggregate appends the aggregated prefixes of entries that are in p to dst.
+func (a *Aggregator) aggregate(p netip.Prefix, entries map[netip.Prefix]time.Time, dst []netip.Prefix) []netip.Prefix {
+	if p.Bits() >= a.opts.Mask {
+		if _, ok := entries[p]; ok {
+			dst = append(dst, p)
+		}
+		return dst
+	}
+
+	left := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+	right := netip.PrefixFrom(netipx.RangeOfPrefix(left).To().Next(), p.Bits()+1)
+
+	start := len(dst)
+	dst = a.aggregate(left, entries, dst)
+	dst = a.aggregate(right, entries, dst)
+	if len(dst)-start == 2 && dst[start] == left && dst[start+1] == right {
+		dst = append(dst[:start], p)
+	}
+	return dst
+}
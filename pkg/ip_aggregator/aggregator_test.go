@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_aggregator
+
+import (
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_Aggregator(t *testing.T) {
+	a := NewAggregator(Opts{Mask: 24, MaxMerge: 2})
+	now := time.Now()
+
+	prefixes := func(s ...string) []netip.Prefix {
+		var ps []netip.Prefix
+		for _, e := range s {
+			ps = append(ps, netip.MustParsePrefix(e))
+		}
+		return ps
+	}
+	checkDiff := func(d Diff, add, del []netip.Prefix) {
+		t.Helper()
+		if !reflect.DeepEqual(d.Add, add) || !reflect.DeepEqual(d.Del, del) {
+			t.Fatalf("want add %v del %v, got add %v del %v", add, del, d.Add, d.Del)
+		}
+	}
+
+	checkDiff(a.Add(netip.MustParseAddr("1.0.0.1"), time.Second, now), prefixes("1.0.0.0/24"), nil)
+	checkDiff(a.Add(netip.MustParseAddr("1.0.0.2"), time.Second*2, now), nil, nil)
+	checkDiff(a.Add(netip.MustParseAddr("1.0.1.1"), time.Second*10, now), prefixes("1.0.0.0/23"), prefixes("1.0.0.0/24"))
+	checkDiff(a.Add(netip.MustParseAddr("1.0.3.1"), time.Second*10, now), prefixes("1.0.3.0/24"), nil)
+	checkDiff(a.Add(netip.MustParseAddr("1.0.2.1"), time.Second*10, now), prefixes("1.0.0.0/22"), prefixes("1.0.0.0/23", "1.0.3.0/24"))
+
+	// Out of the max merge range.
+	checkDiff(a.Add(netip.MustParseAddr("1.0.4.1"), time.Second*10, now), prefixes("1.0.4.0/24"), nil)
+	if n := a.Len(); n != 2 {
+		t.Fatalf("want 2 prefixes, got %d", n)
+	}
+	installed := a.Installed()
+	sort.Slice(installed, func(i, j int) bool { return installed[i].Addr().Less(installed[j].Addr()) })
+	if want := prefixes("1.0.0.0/22", "1.0.4.0/24"); !reflect.DeepEqual(installed, want) {
+		t.Fatalf("want installed %v, got %v", want, installed)
+	}
+
+	// 1.0.0.0/24 expired, /22 should be split.
+	checkDiff(a.Expire(now.Add(time.Second*5)), prefixes("1.0.1.0/24", "1.0.2.0/23"), prefixes("1.0.0.0/22"))
+	checkDiff(a.Expire(now.Add(time.Second*5)), nil, nil)
+
+	d := a.Flush()
+	if len(d.Add) != 0 || len(d.Del) != 3 {
+		t.Fatalf("unexpected flush diff %v", d)
+	}
+	if n := a.Len(); n != 0 {
+		t.Fatalf("want empty aggregator, got %d prefixes", n)
+	}
+}
+
+func Test_Aggregator_noMerge(t *testing.T) {
+	a := NewAggregator(Opts{Mask: 64})
+	now := time.Now()
+	a.Add(netip.MustParseAddr("2001::1"), time.Second, now)
+	a.Add(netip.MustParseAddr("2001:0:0:1::1"), time.Second, now)
+	if n := a.Len(); n != 2 {
+		t.Fatalf("want 2 prefixes, got %d", n)
+	}
+	d := a.Expire(now.Add(time.Second * 2))
+	if len(d.Del) != 2 {
+		t.Fatalf("want 2 deleted prefixes, got %v", d.Del)
+	}
+}
+
+func Test_Diff_Merge(t *testing.T) {
+	p1 := netip.MustParsePrefix("1.0.0.0/24")
+	p2 := netip.MustParsePrefix("1.0.0.0/23")
+	d := Diff{Add: []netip.Prefix{p1}}
+	d.Merge(Diff{Add: []netip.Prefix{p2}, Del: []netip.Prefix{p1}})
+	if !reflect.DeepEqual(d.Add, []netip.Prefix{p2}) || len(d.Del) != 0 {
+		t.Fatalf("unexpected merged diff %v", d)
+	}
+}
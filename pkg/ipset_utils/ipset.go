@@ -0,0 +1,289 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ipset_utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mdlayher/netlink"
+	"net/netip"
+	"syscall"
+)
+
+// Constants from linux/netfilter/ipset/ip_set.h and linux/netfilter/nfnetlink.h.
+const (
+	netlinkNetfilter = 12 // NETLINK_NETFILTER
+	nfnlSubsysIPSet  = 6
+
+	ipsetProtocol = 6
+
+	ipsetCmdCreate = 2
+	ipsetCmdAdd    = 9
+	ipsetCmdDel    = 10
+
+	// Command level attributes.
+	ipsetAttrProtocol = 1
+	ipsetAttrSetName  = 2
+	ipsetAttrTypeName = 3
+	ipsetAttrRevision = 4
+	ipsetAttrFamily   = 5
+	ipsetAttrData     = 7
+	ipsetAttrADT      = 8
+	ipsetAttrLineNo   = 9
+
+	// Data attributes.
+	ipsetAttrIP      = 1
+	ipsetAttrCIDR    = 3
+	ipsetAttrTimeout = 6
+
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+
+	nfprotoIPv4 = 2
+	nfprotoIPv6 = 10
+
+	// hashNetRevision is the hash:net revision that is used to create sets.
+	// Revision 1 is supported since linux 2.6.39 and has the timeout extension.
+	hashNetRevision = 1
+
+	// maxBatchSize is the max number of entries in one netlink message.
+	maxBatchSize = 512
+)
+
+// Entry is an entry of a hash:net set.
+type Entry struct {
+	Prefix netip.Prefix
+
+	// Timeout (sec) of the entry. It is sent to the kernel only if
+	// HasTimeout is true, otherwise the default timeout of the set
+	// applies. Zero means the entry never expires. The set must
+	// be created with a timeout, or the kernel will reject it.
+	Timeout    uint32
+	HasTimeout bool
+}
+
+// CreateOpts are options of a new hash:net set.
+type CreateOpts struct {
+	IPv6 bool
+
+	// Timeout enables the timeout extension of the set and is the default
+	// timeout (sec) of its entries. Zero disables the timeout extension.
+	Timeout uint32
+}
+
+// Conn is a netlink connection to the kernel ipset subsystem.
+// Unlike the ipset command, entries are sent in batches and each
+// batch is acknowledged by the kernel, so errors are reported
+// to the caller. Conn is safe for concurrent use.
+type Conn struct {
+	c *netlink.Conn
+}
+
+// Dial opens a netlink connection. It requires CAP_NET_ADMIN.
+func Dial() (*Conn, error) {
+	c, err := netlink.Dial(netlinkNetfilter, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// Create creates a hash:net set. It is a noop if a set with the same name
+// and compatible options exists.
+func (c *Conn) Create(name string, opts CreateOpts) error {
+	msg, err := marshalCreate(name, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := c.c.Execute(msg); err != nil {
+		return fmt.Errorf("failed to create set %s, %w", name, wrapErr(err))
+	}
+	return nil
+}
+
+// Add adds entries to the set. Existing entries are updated with the new
+// timeout. Entries are sent in as few netlink messages as possible.
+func (c *Conn) Add(name string, entries []Entry) error {
+	return c.adt(ipsetCmdAdd, name, entries)
+}
+
+// Del deletes entries from the set. Entries that are not in the set
+// are ignored. Timeouts of entries are ignored.
+func (c *Conn) Del(name string, entries []Entry) error {
+	return c.adt(ipsetCmdDel, name, entries)
+}
+
+func (c *Conn) adt(cmd uint8, name string, entries []Entry) error {
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		msg, err := marshalADT(cmd, name, entries[:n])
+		if err != nil {
+			return err
+		}
+		if _, err := c.c.Execute(msg); err != nil {
+			return fmt.Errorf("failed to update set %s, %w", name, wrapErr(err))
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+func newMsg(cmd uint8, family uint8, attrs []byte) netlink.Message {
+	// struct nfgenmsg, res_id is always 0.
+	data := make([]byte, 4, 4+len(attrs))
+	data[0] = family
+	data = append(data, attrs...)
+	return netlink.Message{
+		Header: netlink.Header{
+			Type: netlink.HeaderType(nfnlSubsysIPSet<<8 | uint16(cmd)),
+			// No NLM_F_EXCL, so the kernel sets IPSET_FLAG_EXIST and
+			// ignores existing entries and sets.
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	}
+}
+
+func familyOf(ipv6 bool) uint8 {
+	if ipv6 {
+		return nfprotoIPv6
+	}
+	return nfprotoIPv4
+}
+
+func marshalCreate(name string, opts CreateOpts) (netlink.Message, error) {
+	if len(name) == 0 {
+		return netlink.Message{}, errors.New("empty set name")
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint8(ipsetAttrProtocol, ipsetProtocol)
+	ae.String(ipsetAttrSetName, name)
+	ae.String(ipsetAttrTypeName, "hash:net")
+	ae.Uint8(ipsetAttrRevision, hashNetRevision)
+	ae.Uint8(ipsetAttrFamily, familyOf(opts.IPv6))
+	ae.Nested(ipsetAttrData, func(nae *netlink.AttributeEncoder) error {
+		if opts.Timeout > 0 {
+			nae.Bytes(ipsetAttrTimeout|netlink.NetByteOrder, beUint32(opts.Timeout))
+		}
+		return nil
+	})
+	b, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return newMsg(ipsetCmdCreate, nfprotoIPv4, b), nil
+}
+
+func marshalADT(cmd uint8, name string, entries []Entry) (netlink.Message, error) {
+	if len(name) == 0 {
+		return netlink.Message{}, errors.New("empty set name")
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint8(ipsetAttrProtocol, ipsetProtocol)
+	ae.String(ipsetAttrSetName, name)
+	// Required by the kernel for batched commands.
+	ae.Uint32(ipsetAttrLineNo, 0)
+	ae.Nested(ipsetAttrADT, func(nae *netlink.AttributeEncoder) error {
+		for i, e := range entries {
+			if !e.Prefix.IsValid() {
+				return fmt.Errorf("invalid prefix %s", e.Prefix)
+			}
+			i := i
+			e := e
+			nae.Nested(ipsetAttrData, func(dae *netlink.AttributeEncoder) error {
+				addr := e.Prefix.Addr()
+				dae.Nested(ipsetAttrIP, func(iae *netlink.AttributeEncoder) error {
+					if addr.Is4() {
+						iae.Bytes(ipsetAttrIPAddrIPv4|netlink.NetByteOrder, addr.AsSlice())
+					} else {
+						iae.Bytes(ipsetAttrIPAddrIPv6|netlink.NetByteOrder, addr.AsSlice())
+					}
+					return nil
+				})
+				dae.Uint8(ipsetAttrCIDR, uint8(e.Prefix.Bits()))
+				if e.HasTimeout && cmd == ipsetCmdAdd {
+					dae.Bytes(ipsetAttrTimeout|netlink.NetByteOrder, beUint32(e.Timeout))
+				}
+				// The kernel reports the line number of the failed entry.
+				dae.Uint32(ipsetAttrLineNo, uint32(i+1))
+				return nil
+			})
+		}
+		return nil
+	})
+	b, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return newMsg(cmd, nfprotoIPv4, b), nil
+}
+
+// ipsetErrors are descriptions of ipset specific errnos.
+var ipsetErrors = map[syscall.Errno]string{
+	4097: "protocol error",
+	4098: "set type is not supported",
+	4099: "max number of sets reached",
+	4102: "set type mismatch",
+	4104: "invalid cidr",
+	4106: "invalid family",
+	4107: "set has no timeout support",
+	4109: "invalid ipv4 address",
+	4110: "invalid ipv6 address",
+	4352: "set is full",
+}
+
+type errnoError struct {
+	errno syscall.Errno
+	s     string
+}
+
+func (e *errnoError) Error() string {
+	return fmt.Sprintf("%s (errno %d)", e.s, e.errno)
+}
+
+func (e *errnoError) Unwrap() error {
+	return e.errno
+}
+
+// wrapErr adds a description to ipset specific errnos, which
+// are not known by syscall.Errno.
+func wrapErr(err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if s, ok := ipsetErrors[errno]; ok {
+			return &errnoError{errno: errno, s: s}
+		}
+	}
+	return err
+}
+
+func beUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ipset_utils
+
+import (
+	"encoding/binary"
+	"github.com/mdlayher/netlink"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func Test_marshalADT(t *testing.T) {
+	entries := []Entry{
+		{Prefix: netip.MustParsePrefix("1.2.3.0/24"), Timeout: 300, HasTimeout: true},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32")},
+	}
+	msg, err := marshalADT(ipsetCmdAdd, "test", entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netlink.HeaderType(nfnlSubsysIPSet<<8 | ipsetCmdAdd); msg.Header.Type != want {
+		t.Fatalf("header type = %d, want %d", msg.Header.Type, want)
+	}
+
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		addr    netip.Addr
+		cidr    uint8
+		timeout uint32
+		lineNo  uint32
+	}
+	var got []entry
+	var setName string
+	for ad.Next() {
+		switch ad.Type() {
+		case ipsetAttrSetName:
+			setName = ad.String()
+		case ipsetAttrADT:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() != ipsetAttrData {
+						t.Fatalf("unexpected attr %d in adt", nad.Type())
+					}
+					var e entry
+					nad.Nested(func(dad *netlink.AttributeDecoder) error {
+						for dad.Next() {
+							switch dad.Type() {
+							case ipsetAttrIP:
+								dad.Nested(func(iad *netlink.AttributeDecoder) error {
+									for iad.Next() {
+										e.addr, _ = netip.AddrFromSlice(iad.Bytes())
+									}
+									return nil
+								})
+							case ipsetAttrCIDR:
+								e.cidr = dad.Uint8()
+							case ipsetAttrTimeout:
+								e.timeout = binary.BigEndian.Uint32(dad.Bytes())
+							case ipsetAttrLineNo:
+								e.lineNo = dad.Uint32()
+							}
+						}
+						return nil
+					})
+					got = append(got, e)
+				}
+				return nil
+			})
+		}
+	}
+	if err := ad.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if setName != "test" {
+		t.Fatalf("set name = %q", setName)
+	}
+	want := []entry{
+		{addr: netip.MustParseAddr("1.2.3.0"), cidr: 24, timeout: 300, lineNo: 1},
+		{addr: netip.MustParseAddr("2001:db8::"), cidr: 32, lineNo: 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entry #%d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func Test_Conn(t *testing.T) {
+	if os.Getenv("TEST_IPSET") == "" {
+		t.SkipNow()
+	}
+	c, err := Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Create("mosdns_test4", CreateOpts{Timeout: 60}); err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]Entry, 0, 2*maxBatchSize)
+	for i := 0; i < cap(entries); i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0})
+		entries = append(entries, Entry{Prefix: netip.PrefixFrom(addr, 24), Timeout: 30, HasTimeout: true})
+	}
+	if err := c.Add("mosdns_test4", entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del("mosdns_test4", entries); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+const (
+	bloomBitsPerKey = 10 // about 2% false positive rate with bloomHashes.
+	bloomHashes     = 6
+
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// bloomFilter is a blocked bloom filter of uint64 hashes. All bits of a
+// hash are in one uint64 word, so a check only reads one word.
+type bloomFilter struct {
+	words []uint64
+}
+
+func newBloomFilter(n int) *bloomFilter {
+	nWords := (n*bloomBitsPerKey + 63) / 64
+	if nWords < 1 {
+		nWords = 1
+	}
+	return &bloomFilter{words: make([]uint64, nWords)}
+}
+
+// locate returns the word index and the bit mask of h.
+func (f *bloomFilter) locate(h uint64) (int, uint64) {
+	// The high 32 bits select the word, the low bits select the bits.
+	i := int((h >> 32) * uint64(len(f.words)) >> 32)
+	var mask uint64
+	for j := 0; j < bloomHashes; j++ {
+		mask |= 1 << (h & 63)
+		h >>= 6
+	}
+	return i, mask
+}
+
+func (f *bloomFilter) add(h uint64) {
+	i, mask := f.locate(h)
+	f.words[i] |= mask
+}
+
+// mayContain reports whether h may be in the filter. False positives are
+// possible, false negatives are not.
+func (f *bloomFilter) mayContain(h uint64) bool {
+	i, mask := f.locate(h)
+	return f.words[i]&mask == mask
+}
+
+// labelHash continues the hash h of the parent labels with label. The
+// hash of a domain is the hash of its labels from the root, starting with
+// fnvOffset64, so hashes of all suffixes of a domain are computed in one
+// pass. It is a FNV-1a variant that reads 8 bytes at a time.
+func labelHash(h uint64, label string) uint64 {
+	for len(label) >= 8 {
+		h ^= uint64(label[0]) | uint64(label[1])<<8 | uint64(label[2])<<16 | uint64(label[3])<<24 |
+			uint64(label[4])<<32 | uint64(label[5])<<40 | uint64(label[6])<<48 | uint64(label[7])<<56
+		h *= fnvPrime64
+		label = label[8:]
+	}
+	for i := 0; i < len(label); i++ {
+		h ^= uint64(label[i])
+		h *= fnvPrime64
+	}
+	h ^= '.'
+	h *= fnvPrime64
+	return h ^ h>>32
+}
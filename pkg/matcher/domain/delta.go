@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"strings"
+)
+
+// Delta is the changes between a base list and the current list.
+type Delta struct {
+	Add []string // patterns that are not in the base list.
+	Del []string // patterns that were deleted from the base list.
+}
+
+// ParseDelta parses a delta file. Each line is a "+pattern" to add or
+// a "-pattern" to delete. Comments start with "#".
+func ParseDelta(b []byte) (*Delta, error) {
+	d := new(Delta)
+	lineCounter := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		lineCounter++
+		s := utils.RemoveComment(scanner.Text(), "#")
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		pattern := strings.TrimSpace(s[1:])
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("line %d: missing pattern", lineCounter)
+		}
+		switch s[0] {
+		case '+':
+			d.Add = append(d.Add, pattern)
+		case '-':
+			d.Del = append(d.Del, pattern)
+		default:
+			return nil, fmt.Errorf("line %d: a delta line must start with + or -", lineCounter)
+		}
+	}
+	return d, scanner.Err()
+}
+
+// ApplyDelta implements data_provider.DeltaListener. It reverts the
+// previously applied delta and applies the new one in place. Only the
+// trie nodes of the changed patterns are touched, so it is fast even for
+// a huge base list. Only pattern-only lists (T is struct{}) are
+// supported. If an error occurs, the matcher might be partially updated, the next
+// Update restores it.
+func (d *DynamicMatcher[T]) ApplyDelta(b []byte) error {
+	var zeroT T
+	if _, ok := any(zeroT).(struct{}); !ok {
+		return fmt.Errorf("list of %T values does not support delta updates", zeroT)
+	}
+	nd, err := ParseDelta(b)
+	if err != nil {
+		return err
+	}
+
+	d.l.Lock()
+	defer d.l.Unlock()
+	dm, ok := d.m.(DeletableMatcher[T])
+	if !ok {
+		return fmt.Errorf("matcher %T does not support delta updates", d.m)
+	}
+
+	if od := d.delta; od != nil {
+		newAdd := toSet(nd.Add)
+		newDel := toSet(nd.Del)
+		for _, pattern := range od.Add {
+			if _, ok := newAdd[pattern]; !ok {
+				if err := dm.Del(pattern); err != nil {
+					return fmt.Errorf("failed to revert %s, %w", pattern, err)
+				}
+			}
+		}
+		for _, pattern := range od.Del {
+			if _, ok := newDel[pattern]; !ok {
+				if err := dm.Add(pattern, zeroT); err != nil {
+					return fmt.Errorf("failed to revert %s, %w", pattern, err)
+				}
+			}
+		}
+	}
+	for _, pattern := range nd.Add {
+		if err := dm.Add(pattern, zeroT); err != nil {
+			return fmt.Errorf("failed to add %s, %w", pattern, err)
+		}
+	}
+	for _, pattern := range nd.Del {
+		if err := dm.Del(pattern); err != nil {
+			return fmt.Errorf("failed to delete %s, %w", pattern, err)
+		}
+	}
+	d.delta = nd
+	return nil
+}
+
+func toSet(s []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(s))
+	for _, e := range s {
+		m[e] = struct{}{}
+	}
+	return m
+}
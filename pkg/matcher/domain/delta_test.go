@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"testing"
+)
+
+func TestDynamicMatcher_ApplyDelta(t *testing.T) {
+	d := NewDynamicMatcher[struct{}](func(b []byte) (Matcher[struct{}], error) {
+		return ParseTextDomainFile(b)
+	})
+	if err := d.Update([]byte("a.com\nb.com\nfull:c.com\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, want map[string]bool) {
+		t.Helper()
+		for s, wantOk := range want {
+			if _, ok := d.Match(s); ok != wantOk {
+				t.Errorf("Match(%s) = %v, want %v", s, ok, wantOk)
+			}
+		}
+	}
+
+	if err := d.ApplyDelta([]byte("+x.com\n-b.com\n# comment\n-full:c.com\n")); err != nil {
+		t.Fatal(err)
+	}
+	check(t, map[string]bool{"a.com": true, "sub.x.com": true, "sub.b.com": false, "c.com": false})
+
+	// The new delta is relative to the base, not to the previous delta.
+	if err := d.ApplyDelta([]byte("+y.com\n-a.com\n")); err != nil {
+		t.Fatal(err)
+	}
+	check(t, map[string]bool{"a.com": false, "x.com": false, "y.com": true, "b.com": true, "c.com": true})
+	if d.Len() != 3 {
+		t.Fatalf("want 3 patterns, got %d", d.Len())
+	}
+
+	// A base update drops the delta.
+	if err := d.Update([]byte("a.com\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ApplyDelta([]byte("+z.com\n")); err != nil {
+		t.Fatal(err)
+	}
+	check(t, map[string]bool{"a.com": true, "y.com": false, "z.com": true})
+}
+
+func TestParseDelta(t *testing.T) {
+	for _, s := range []string{"a.com", "+", "- "} {
+		if _, err := ParseDelta([]byte(s)); err == nil {
+			t.Errorf("ParseDelta(%q) should fail", s)
+		}
+	}
+}
+
+func TestSubDomainMatcher_Del(t *testing.T) {
+	m := NewSubDomainMatcher[struct{}]()
+	for _, s := range []string{"com", "a.b.com", "c.b.com"} {
+		m.Add(s, struct{}{})
+	}
+	m.Del("a.b.com")
+	m.Del("not.exist.com")
+	if _, ok := m.Match("c.b.com"); !ok {
+		t.Fatal("c.b.com should match")
+	}
+	m.Del("c.b.com")
+	if b := m.root.getChild("com").getChild("b"); b != nil {
+		t.Fatal("empty nodes should be removed")
+	}
+	m.Del("com")
+	if m.Len() != 0 || !m.root.isEmpty() {
+		t.Fatal("matcher should be empty")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"sync"
+)
+
+// GeoSiteMatcher is a matcher of v2ray geosite data from multiple files.
+// Entries of the same tag in different files are merged. It is rebuilt
+// when any of the files is updated.
+type GeoSiteMatcher struct {
+	filters []*V2filter
+
+	dataM  sync.Mutex
+	data   []*v2data.GeoSiteList // nil if the file is not loaded yet.
+	loaded int
+
+	l sync.RWMutex
+	m Matcher[struct{}] // nil if not all files are loaded.
+}
+
+// NewGeoSiteMatcher returns a GeoSiteMatcher of n files. Use Listener to
+// load the files.
+func NewGeoSiteMatcher(n int, filters []*V2filter) *GeoSiteMatcher {
+	return &GeoSiteMatcher{filters: filters, data: make([]*v2data.GeoSiteList, n)}
+}
+
+// Listener returns the data_provider.DataListener of the i-th file.
+func (g *GeoSiteMatcher) Listener(i int) *GeoSiteListener {
+	return &GeoSiteListener{g: g, i: i}
+}
+
+func (g *GeoSiteMatcher) Match(s string) (v struct{}, ok bool) {
+	g.l.RLock()
+	defer g.l.RUnlock()
+	if g.m == nil {
+		return v, false
+	}
+	return g.m.Match(s)
+}
+
+func (g *GeoSiteMatcher) Len() int {
+	g.l.RLock()
+	defer g.l.RUnlock()
+	if g.m == nil {
+		return 0
+	}
+	return g.m.Len()
+}
+
+func (g *GeoSiteMatcher) update(i int, b []byte) error {
+	list, err := LoadGeoSiteList(b)
+	if err != nil {
+		return err
+	}
+
+	g.dataM.Lock()
+	defer g.dataM.Unlock()
+	if g.data[i] == nil {
+		g.loaded++
+	}
+	old := g.data[i]
+	g.data[i] = list
+	if g.loaded < len(g.data) {
+		return nil
+	}
+
+	merged := new(v2data.GeoSiteList)
+	for _, l := range g.data {
+		merged.Entry = append(merged.Entry, l.GetEntry()...)
+	}
+	m, err := NewV2rayDomainDat(merged, g.filters...)
+	if err != nil {
+		g.data[i] = old
+		return err
+	}
+	g.l.Lock()
+	g.m = m
+	g.l.Unlock()
+	return nil
+}
+
+// GeoSiteListener is a data_provider.DataListener of a file of a
+// GeoSiteMatcher.
+type GeoSiteListener struct {
+	g *GeoSiteMatcher
+	i int
+}
+
+func (l *GeoSiteListener) Update(b []byte) error {
+	return l.g.update(l.i, b)
+}
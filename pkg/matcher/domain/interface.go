@@ -35,3 +35,12 @@ type WriteableMatcher[T any] interface {
 	Matcher[T]
 	Add(pattern string, v T) error
 }
+
+// DeletableMatcher is a WriteableMatcher that can delete patterns.
+type DeletableMatcher[T any] interface {
+	WriteableMatcher[T]
+
+	// Del deletes the pattern that was added by Add. Deleting a pattern
+	// that does not exist is a no-op.
+	Del(pattern string) error
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"google.golang.org/protobuf/proto"
 	"io"
+	"regexp/syntax"
 	"strings"
 	"sync"
 )
@@ -146,6 +147,9 @@ func BatchLoadProvider[T any](
 }
 
 // BatchLoadDomainProvider loads multiple domain entries.
+// Entries "provider:tag" load text files. Entries
+// "provider:tag1[+tag2...]:filters" load v2ray geosite files, see
+// ParseV2Suffix for the format of filters.
 // Caller must call MatcherGroup.Close to detach this matcher from data_provider.DataManager to
 // avoid leaking.
 func BatchLoadDomainProvider(
@@ -159,21 +163,22 @@ func BatchLoadDomainProvider(
 		if strings.HasPrefix(s, "provider:") {
 			providerTag := strings.TrimPrefix(s, "provider:")
 			providerTag, v2suffix, _ := strings.Cut(providerTag, ":")
+			if len(v2suffix) > 0 {
+				m, closer, err := loadGeoSite(strings.Split(providerTag, "+"), ParseV2Suffix(v2suffix), dm)
+				if err != nil {
+					return nil, err
+				}
+				mg.Append(m)
+				mg.AppendCloser(closer)
+				continue
+			}
 			provider := dm.GetDataProvider(providerTag)
 			if provider == nil {
 				return nil, fmt.Errorf("cannot find provider %s", providerTag)
 			}
-			var parseFunc func(b []byte) (Matcher[struct{}], error)
-			if len(v2suffix) > 0 {
-				parseFunc = func(b []byte) (Matcher[struct{}], error) {
-					return ParseV2rayDomainFile(b, ParseV2Suffix(v2suffix)...)
-				}
-			} else {
-				parseFunc = func(b []byte) (Matcher[struct{}], error) {
-					return ParseTextDomainFile(b)
-				}
-			}
-			m := NewDynamicMatcher[struct{}](parseFunc)
+			m := NewDynamicMatcher[struct{}](func(b []byte) (Matcher[struct{}], error) {
+				return ParseTextDomainFile(b)
+			})
 			if err := provider.LoadAndAddListener(m); err != nil {
 				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
 			}
@@ -191,10 +196,39 @@ func BatchLoadDomainProvider(
 	return mg, nil
 }
 
+// loadGeoSite loads geosite files of providers to a GeoSiteMatcher.
+// The returned func detaches the matcher from the providers.
+func loadGeoSite(providerTags []string, filters []*V2filter, dm *data_provider.DataManager) (*GeoSiteMatcher, func(), error) {
+	g := NewGeoSiteMatcher(len(providerTags), filters)
+	var closers []func()
+	closer := func() {
+		for _, f := range closers {
+			f()
+		}
+	}
+	for i, tag := range providerTags {
+		provider := dm.GetDataProvider(tag)
+		if provider == nil {
+			closer()
+			return nil, nil, fmt.Errorf("cannot find provider %s", tag)
+		}
+		l := g.Listener(i)
+		if err := provider.LoadAndAddListener(l); err != nil {
+			closer()
+			return nil, nil, fmt.Errorf("failed to load data from provider %s, %w", tag, err)
+		}
+		closers = append(closers, func() { provider.DeleteListener(l) })
+	}
+	return g, closer, nil
+}
+
 type DynamicMatcher[T any] struct {
 	parserFunc func(b []byte) (Matcher[T], error)
-	l          sync.RWMutex
-	m          Matcher[T]
+
+	// l also protects m from being modified by ApplyDelta while matching.
+	l     sync.RWMutex
+	m     Matcher[T]
+	delta *Delta // the applied delta, nil if no delta was applied.
 }
 
 func NewDynamicMatcher[T any](parserFunc func(b []byte) (Matcher[T], error)) *DynamicMatcher[T] {
@@ -203,32 +237,73 @@ func NewDynamicMatcher[T any](parserFunc func(b []byte) (Matcher[T], error)) *Dy
 
 func (d *DynamicMatcher[T]) Match(s string) (v T, ok bool) {
 	d.l.RLock()
-	m := d.m
-	d.l.RUnlock()
-	return m.Match(s)
+	defer d.l.RUnlock()
+	return d.m.Match(s)
 }
 
 func (d *DynamicMatcher[T]) Len() int {
 	d.l.RLock()
-	m := d.m
-	d.l.RUnlock()
-	return m.Len()
+	defer d.l.RUnlock()
+	return d.m.Len()
 }
 
+// Update updates the matcher. If the parser returns a matcher with an
+// *InvalidRulesError, the matcher is still used and the error is returned.
 func (d *DynamicMatcher[T]) Update(b []byte) error {
 	m, err := d.parserFunc(b)
 	if err != nil {
-		return err
+		var invalidErr *InvalidRulesError
+		if m == nil || !errors.As(err, &invalidErr) {
+			return err
+		}
 	}
 	d.l.Lock()
 	d.m = m
+	d.delta = nil
 	d.l.Unlock()
-	return nil
+	return err
+}
+
+// maxReportedLines limits the lines in the message of InvalidRulesError.
+const maxReportedLines = 5
+
+// LineError is an error of a line of a text file.
+type LineError struct {
+	Line int
+	Err  error
 }
 
-// LoadFromTextReader loads multiple lines from reader r. r
+// InvalidRulesError reports invalid regexp rules that were skipped by
+// LoadFromTextReader. Other rules were loaded. It is a partial error of
+// data_provider.DataListener.
+type InvalidRulesError struct {
+	Errs []LineError
+}
+
+func (e *InvalidRulesError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d invalid rules are skipped", len(e.Errs))
+	for i, le := range e.Errs {
+		if i == maxReportedLines {
+			sb.WriteString(", ...")
+			break
+		}
+		fmt.Fprintf(&sb, ", line %d: %v", le.Line, le.Err)
+	}
+	return sb.String()
+}
+
+// Partial implements data_provider.PartialError.
+func (e *InvalidRulesError) Partial() bool {
+	return true
+}
+
+// LoadFromTextReader loads multiple lines from reader r. Lines of invalid
+// regexp rules are skipped, and reported by an *InvalidRulesError after all
+// other lines are loaded. Other errors abort the loading.
 func LoadFromTextReader[T any](m WriteableMatcher[T], r io.Reader, parseString ParseStringFunc[T]) error {
 	lineCounter := 0
+	var invalid []LineError
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		lineCounter++
@@ -241,14 +316,25 @@ func LoadFromTextReader[T any](m WriteableMatcher[T], r io.Reader, parseString P
 
 		err := Load(m, s, parseString)
 		if err != nil {
+			var syntaxErr *syntax.Error
+			if errors.As(err, &syntaxErr) {
+				invalid = append(invalid, LineError{Line: lineCounter, Err: err})
+				continue
+			}
 			return fmt.Errorf("line %d: %v", lineCounter, err)
 		}
 	}
-	return scanner.Err()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		return &InvalidRulesError{Errs: invalid}
+	}
+	return nil
 }
 
 // ParseV2rayDomainFile See NewV2rayDomainDat.
-func ParseV2rayDomainFile(in []byte, filters ...*V2filter) (*MixMatcher[struct{}], error) {
+func ParseV2rayDomainFile(in []byte, filters ...*V2filter) (Matcher[struct{}], error) {
 	v, err := LoadGeoSiteList(in)
 	if err != nil {
 		return nil, err
@@ -258,11 +344,15 @@ func ParseV2rayDomainFile(in []byte, filters ...*V2filter) (*MixMatcher[struct{}
 
 type V2filter struct {
 	Tag   string
-	Attrs []string
+	Attrs []string // attributes, "!attr" excludes domains that have attr.
+
+	// Exclude excludes domains that are matched by the filter from the
+	// domains of other filters.
+	Exclude bool
 }
 
 // ParseV2Suffix parses s into V2filter.
-// The format of s is "tag[@attr@attr...],tag[@attr@attr...]..."
+// The format of s is "[!]tag[@[!]attr@[!]attr...],[!]tag[@attr...]..."
 func ParseV2Suffix(s string) []*V2filter {
 	vf := make([]*V2filter, 0)
 	for _, t := range strings.Split(s, ",") {
@@ -270,68 +360,111 @@ func ParseV2Suffix(s string) []*V2filter {
 		if len(t) == 0 {
 			continue
 		}
-		s := strings.Split(t, "@")
+		exclude := strings.HasPrefix(t, "!")
+		s := strings.Split(strings.TrimPrefix(t, "!"), "@")
 		tag := s[0]
 		attr := s[1:]
 		vf = append(vf, &V2filter{
-			Tag:   tag,
-			Attrs: attr,
+			Tag:     tag,
+			Attrs:   attr,
+			Exclude: exclude,
 		})
 	}
 	return vf
 }
 
-// NewV2rayDomainDat builds a V2rayDomainDat from given v and args.
-// The format of args is "tag1@attr1@attr2,tag2@attr1...".
-// Only domains that are matched by the args will be loaded to V2rayDomainDat.
-func NewV2rayDomainDat(v *v2data.GeoSiteList, filters ...*V2filter) (*MixMatcher[struct{}], error) {
+// MatchDomain reports whether d has any of the attributes of f and none
+// of the excluded attributes. If f has no (non-excluded) attributes, d
+// only needs to have none of the excluded attributes.
+func (f *V2filter) MatchDomain(d *v2data.Domain) bool {
+	hasWanted, wanted := false, false
+	for _, want := range f.Attrs {
+		negative := strings.HasPrefix(want, "!")
+		attr := strings.TrimPrefix(want, "!")
+		has := false
+		for _, a := range d.GetAttribute() {
+			if a.GetKey() == attr {
+				has = true
+				break
+			}
+		}
+		if negative {
+			if has {
+				return false
+			}
+			continue
+		}
+		hasWanted = true
+		wanted = wanted || has
+	}
+	return !hasWanted || wanted
+}
+
+// NewV2rayDomainDat builds a matcher from given v and filters. Domains
+// of tags of filters are loaded. Domains that are matched by the excluded
+// filters are not matched by the returned matcher.
+func NewV2rayDomainDat(v *v2data.GeoSiteList, filters ...*V2filter) (Matcher[struct{}], error) {
 	dataTags := make(map[string][]*v2data.Domain)
 	for _, gs := range v.GetEntry() {
-		dataTags[strings.ToLower(gs.GetCountryCode())] = gs.Domain
+		tag := strings.ToLower(gs.GetCountryCode())
+		dataTags[tag] = append(dataTags[tag], gs.Domain...)
 	}
 
-	m := NewMixMatcher[struct{}]()
+	include := NewMixMatcher[struct{}]()
+	exclude := NewMixMatcher[struct{}]()
 	for _, f := range filters {
-		tag := f.Tag
-		attrs := f.Attrs
-		domains := dataTags[tag]
+		domains := dataTags[f.Tag]
 		if domains == nil {
-			return nil, fmt.Errorf("tag %s does not exist", tag)
+			return nil, fmt.Errorf("tag %s does not exist", f.Tag)
 		}
-		_, err := BuildDomainMatcher(domains, attrs, m)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load tag %s, %w", tag, err)
+		m := include
+		if f.Exclude {
+			m = exclude
+		}
+		if err := buildDomainMatcher(domains, f, m); err != nil {
+			return nil, fmt.Errorf("failed to load tag %s, %w", f.Tag, err)
 		}
 	}
 
-	return m, nil
+	if exclude.Len() == 0 {
+		return include, nil
+	}
+	return &diffMatcher{include: include, exclude: exclude}, nil
 }
 
-func BuildDomainMatcher(domains []*v2data.Domain, attrs []string, m *MixMatcher[struct{}]) (*MixMatcher[struct{}], error) {
-	am := make(map[string]struct{})
-	if len(attrs) > 0 {
-		for _, attr := range attrs {
-			am[attr] = struct{}{}
-		}
+// diffMatcher matches strings that are matched by include but not by
+// exclude.
+type diffMatcher struct {
+	include Matcher[struct{}]
+	exclude Matcher[struct{}]
+}
+
+func (m *diffMatcher) Match(s string) (v struct{}, ok bool) {
+	if _, ok := m.include.Match(s); !ok {
+		return v, false
 	}
+	_, excluded := m.exclude.Match(s)
+	return v, !excluded
+}
+
+func (m *diffMatcher) Len() int {
+	return m.include.Len()
+}
 
+func BuildDomainMatcher(domains []*v2data.Domain, attrs []string, m *MixMatcher[struct{}]) (*MixMatcher[struct{}], error) {
 	if m == nil {
 		m = NewMixMatcher[struct{}]()
 	}
+	if err := buildDomainMatcher(domains, &V2filter{Attrs: attrs}, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-getDomainLoop:
+func buildDomainMatcher(domains []*v2data.Domain, f *V2filter, m *MixMatcher[struct{}]) error {
 	for _, d := range domains {
-		if len(am) > 0 {
-			hasAttr := false
-			for _, attr := range d.Attribute {
-				if _, ok := am[attr.Key]; ok {
-					hasAttr = true
-					break
-				}
-			}
-			if !hasAttr {
-				continue getDomainLoop
-			}
+		if !f.MatchDomain(d) {
+			continue
 		}
 
 		var subMatcherType string
@@ -345,19 +478,19 @@ getDomainLoop:
 		case v2data.Domain_Full:
 			subMatcherType = MatcherFull
 		default:
-			return nil, fmt.Errorf("invalid v2ray Domain_Type %d", d.Type)
+			return fmt.Errorf("invalid v2ray Domain_Type %d", d.Type)
 		}
 
 		sm := m.GetSubMatcher(subMatcherType)
 		if sm == nil {
-			return nil, fmt.Errorf("invalid MixMatcher, missing submatcher %s", subMatcherType)
+			return fmt.Errorf("invalid MixMatcher, missing submatcher %s", subMatcherType)
 		}
 
 		if err := sm.Add(d.Value, struct{}{}); err != nil {
-			return nil, fmt.Errorf("failed to load value %s, %w", d.Value, err)
+			return fmt.Errorf("failed to load value %s, %w", d.Value, err)
 		}
 	}
-	return m, nil
+	return nil
 }
 
 func LoadGeoSiteList(b []byte) (*v2data.GeoSiteList, error) {
@@ -368,9 +501,15 @@ func LoadGeoSiteList(b []byte) (*v2data.GeoSiteList, error) {
 	return geoSiteList, nil
 }
 
+// ParseTextDomainFile parses a text domain file. If some regexp rules are
+// invalid, it returns the matcher of other rules and an *InvalidRulesError.
 func ParseTextDomainFile(in []byte) (*MixMatcher[struct{}], error) {
 	mixMatcher := NewDomainMixMatcher()
 	if err := LoadFromTextReader[struct{}](mixMatcher, bytes.NewReader(in), nil); err != nil {
+		var invalidErr *InvalidRulesError
+		if errors.As(err, &invalidErr) {
+			return mixMatcher, err
+		}
 		return nil, err
 	}
 	return mixMatcher, nil
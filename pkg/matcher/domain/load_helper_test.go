@@ -20,6 +20,13 @@
 package domain
 
 import (
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -41,3 +48,128 @@ func TestParseV2Suffix(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTextDomainFile_invalidRegexp(t *testing.T) {
+	in := []byte("full:a.com\nregexp:(\nregexp:^b\\.\nregexp:[z-a]\n")
+	m, err := ParseTextDomainFile(in)
+	var invalidErr *InvalidRulesError
+	if !errors.As(err, &invalidErr) {
+		t.Fatalf("want an InvalidRulesError, got %v", err)
+	}
+	if len(invalidErr.Errs) != 2 || invalidErr.Errs[0].Line != 2 || invalidErr.Errs[1].Line != 4 {
+		t.Fatalf("unexpected errors %v", invalidErr)
+	}
+	for _, s := range []string{"a.com", "b.com"} {
+		if _, ok := m.Match(s); !ok {
+			t.Fatalf("valid rule of %s is not loaded", s)
+		}
+	}
+
+	dm := NewDynamicMatcher[struct{}](func(b []byte) (Matcher[struct{}], error) {
+		return ParseTextDomainFile(b)
+	})
+	if err := dm.Update(in); !errors.As(err, &invalidErr) {
+		t.Fatalf("want an InvalidRulesError, got %v", err)
+	}
+	if _, ok := dm.Match("b.com"); !ok {
+		t.Fatal("dynamic matcher is not updated")
+	}
+	if err := dm.Update([]byte("bad:a.com")); err == nil || errors.As(err, &invalidErr) {
+		t.Fatalf("want a fatal error, got %v", err)
+	}
+}
+
+func TestParseV2Suffix_exclude(t *testing.T) {
+	got := ParseV2Suffix("cn@!ads,!cn@ads")
+	want := []*V2filter{{Tag: "cn", Attrs: []string{"!ads"}}, {Tag: "cn", Attrs: []string{"ads"}, Exclude: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseV2Suffix() = %v, want %v", got, want)
+	}
+}
+
+func testGeoSiteList(tag string, domains ...*v2data.Domain) *v2data.GeoSiteList {
+	return &v2data.GeoSiteList{Entry: []*v2data.GeoSite{{CountryCode: tag, Domain: domains}}}
+}
+
+func testV2Domain(typ v2data.Domain_Type, value string, attrs ...string) *v2data.Domain {
+	d := &v2data.Domain{Type: typ, Value: value}
+	for _, a := range attrs {
+		d.Attribute = append(d.Attribute, &v2data.Domain_Attribute{Key: a})
+	}
+	return d
+}
+
+func TestNewV2rayDomainDat(t *testing.T) {
+	gl := testGeoSiteList("CN",
+		testV2Domain(v2data.Domain_Domain, "cn.com"),
+		testV2Domain(v2data.Domain_Domain, "ads.cn.com", "ads"),
+		testV2Domain(v2data.Domain_Full, "tracker.com", "ads"),
+	)
+	tests := []struct {
+		filters string
+		match   []string
+		noMatch []string
+	}{
+		{"cn", []string{"cn.com", "ads.cn.com", "tracker.com"}, []string{"a.tracker.com"}},
+		{"cn@ads", []string{"ads.cn.com", "tracker.com"}, []string{"cn.com"}},
+		{"cn@!ads", []string{"cn.com", "ads.cn.com"}, []string{"tracker.com"}},
+		{"cn,!cn@ads", []string{"cn.com", "x.cn.com"}, []string{"ads.cn.com", "a.ads.cn.com", "tracker.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filters, func(t *testing.T) {
+			m, err := NewV2rayDomainDat(gl, ParseV2Suffix(tt.filters)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.match {
+				if _, ok := m.Match(s); !ok {
+					t.Errorf("%s should match", s)
+				}
+			}
+			for _, s := range tt.noMatch {
+				if _, ok := m.Match(s); ok {
+					t.Errorf("%s should not match", s)
+				}
+			}
+		})
+	}
+	if _, err := NewV2rayDomainDat(gl, ParseV2Suffix("us")...); err == nil {
+		t.Fatal("missing tag should be rejected")
+	}
+}
+
+func TestBatchLoadDomainProvider_geoSiteFiles(t *testing.T) {
+	dir := t.TempDir()
+	dm := data_provider.NewDataManager()
+	for tag, gl := range map[string]*v2data.GeoSiteList{
+		"a": testGeoSiteList("cn", testV2Domain(v2data.Domain_Domain, "a.com")),
+		"b": testGeoSiteList("cn", testV2Domain(v2data.Domain_Domain, "b.com", "ads")),
+	} {
+		b, err := proto.Marshal(gl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := filepath.Join(dir, tag)
+		if err := os.WriteFile(f, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		dp, err := data_provider.NewDataProvider(zap.NewNop(), data_provider.DataProviderConfig{File: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm.AddDataProvider(tag, dp)
+	}
+	defer dm.Close()
+
+	mg, err := BatchLoadDomainProvider([]string{"provider:a+b:cn,!cn@ads"}, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mg.Close()
+	if _, ok := mg.Match("a.com"); !ok {
+		t.Fatal("a.com should match")
+	}
+	if _, ok := mg.Match("b.com"); ok {
+		t.Fatal("b.com should not match")
+	}
+}
@@ -22,30 +22,111 @@ package domain
 import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
-	"regexp"
+	"regexp/syntax"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-var _ WriteableMatcher[any] = (*MixMatcher[any])(nil)
-var _ WriteableMatcher[any] = (*SubDomainMatcher[any])(nil)
-var _ WriteableMatcher[any] = (*FullMatcher[any])(nil)
-var _ WriteableMatcher[any] = (*KeywordMatcher[any])(nil)
-var _ WriteableMatcher[any] = (*RegexMatcher[any])(nil)
+var _ DeletableMatcher[any] = (*MixMatcher[any])(nil)
+var _ DeletableMatcher[any] = (*SubDomainMatcher[any])(nil)
+var _ DeletableMatcher[any] = (*FullMatcher[any])(nil)
+var _ DeletableMatcher[any] = (*KeywordMatcher[any])(nil)
+var _ DeletableMatcher[any] = (*RegexMatcher[any])(nil)
 
 type SubDomainMatcher[T any] struct {
 	root *labelNode[T]
+
+	// labels interns short labels, which are often shared by many
+	// domains, e.g. "www" and "cdn".
+	labels map[string]string
+
+	// Optional bloom filter of domains, see EnablePrefilter.
+	prefilter bool
+	version   uint64 // increased on every change.
+	filterM   sync.Mutex
+	filter    atomic.Value // *domainFilter
+}
+
+type domainFilter struct {
+	version uint64
+	f       *bloomFilter
 }
 
+// maxInternLabelLen is the max length of interned labels. Longer labels
+// are rarely shared.
+const maxInternLabelLen = 4
+
 func NewSubDomainMatcher[T any]() *SubDomainMatcher[T] {
-	return &SubDomainMatcher[T]{root: new(labelNode[T])}
+	return &SubDomainMatcher[T]{root: new(labelNode[T]), labels: make(map[string]string)}
+}
+
+// intern returns a copy of label, so the trie does not reference the
+// (probably much larger) string that contains the label.
+func (m *SubDomainMatcher[T]) intern(label string) string {
+	if len(label) > maxInternLabelLen {
+		return strings.Clone(label)
+	}
+	if s, ok := m.labels[label]; ok {
+		return s
+	}
+	s := strings.Clone(label)
+	m.labels[s] = s
+	return s
+}
+
+// EnablePrefilter enables a bloom filter in front of the trie, so names
+// that do not match are answered by hash checks (one per label) without
+// walking the trie. It costs about 1.25 bytes per domain. A trie walk of
+// an unmatched name usually stops at the second level, so the filter only
+// helps if names often share long suffixes with domains of a large trie.
+// See BenchmarkSubDomainMatcher_Match. The filter is built now, and
+// rebuilt on the first Match after the matcher is changed.
+func (m *SubDomainMatcher[T]) EnablePrefilter() {
+	m.prefilter = true
+	m.getFilter()
+}
+
+// getFilter returns the bloom filter of the current domains.
+func (m *SubDomainMatcher[T]) getFilter() *bloomFilter {
+	if f, _ := m.filter.Load().(*domainFilter); f != nil && f.version == m.version {
+		return f.f
+	}
+	m.filterM.Lock()
+	defer m.filterM.Unlock()
+	if f, _ := m.filter.Load().(*domainFilter); f != nil && f.version == m.version {
+		return f.f
+	}
+	bf := newBloomFilter(m.Len())
+	m.root.addToFilter(fnvOffset64, bf)
+	m.filter.Store(&domainFilter{version: m.version, f: bf})
+	return bf
+}
+
+// mayMatch reports whether s (normalized) may match any domain by checking
+// the bloom filter.
+func (m *SubDomainMatcher[T]) mayMatch(s string) bool {
+	f := m.getFilter()
+	ds := NewReverseDomainScanner(s)
+	h := uint64(fnvOffset64)
+	for ds.Scan() {
+		h = labelHash(h, ds.NextLabel())
+		if f.mayContain(h) {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *SubDomainMatcher[T]) Match(s string) (T, bool) {
 	s = NormalizeDomain(s)
-	ds := NewReverseDomainScanner(s)
-	currentNode := m.root
 	var v T
 	var ok bool
+	if m.prefilter && !m.mayMatch(s) {
+		return v, ok
+	}
+	ds := NewReverseDomainScanner(s)
+	currentNode := m.root
 	for ds.Scan() {
 		label := ds.NextLabel()
 		if nextNode := currentNode.getChild(label); nextNode != nil {
@@ -73,10 +154,35 @@ func (m *SubDomainMatcher[T]) Add(s string, v T) error {
 		if child := currentNode.getChild(label); child != nil {
 			currentNode = child
 		} else {
-			currentNode = currentNode.newChild(label)
+			currentNode = currentNode.newChild(m.intern(label))
 		}
 	}
 	currentNode.storeValue(v)
+	m.version++
+	return nil
+}
+
+// Del deletes domain s. Nodes that become empty are removed, so only
+// the nodes of s are touched.
+func (m *SubDomainMatcher[T]) Del(s string) error {
+	s = NormalizeDomain(s)
+	ds := NewReverseDomainScanner(s)
+	path := []*labelNode[T]{m.root}
+	var labels []string
+	for ds.Scan() {
+		label := ds.NextLabel()
+		child := path[len(path)-1].getChild(label)
+		if child == nil {
+			return nil
+		}
+		path = append(path, child)
+		labels = append(labels, label)
+	}
+	path[len(path)-1].clearValue()
+	m.version++
+	for i := len(path) - 1; i > 0 && path[i].isEmpty(); i-- {
+		path[i-1].delChild(labels[i-1])
+	}
 	return nil
 }
 
@@ -97,6 +203,11 @@ func (m *FullMatcher[T]) Add(s string, v T) error {
 	return nil
 }
 
+func (m *FullMatcher[T]) Del(s string) error {
+	delete(m.m, NormalizeDomain(s))
+	return nil
+}
+
 func (m *FullMatcher[T]) Match(s string) (v T, ok bool) {
 	s = NormalizeDomain(s)
 	v, ok = m.m[s]
@@ -123,6 +234,11 @@ func (m *KeywordMatcher[T]) Add(keyword string, v T) error {
 	return nil
 }
 
+func (m *KeywordMatcher[T]) Del(keyword string) error {
+	delete(m.kws, NormalizeDomain(keyword))
+	return nil
+}
+
 func (m *KeywordMatcher[T]) Match(s string) (v T, ok bool) {
 	s = NormalizeDomain(s)
 	for k, v := range m.kws {
@@ -139,13 +255,14 @@ func (m *KeywordMatcher[T]) Len() int {
 
 // RegexMatcher contains regexp rules.
 // Note: the regexp rule is expect to match a lower-case non fqdn.
+// Rules are only parsed by Add. They are compiled into combined regexps
+// lazily, on the first Match after they are changed.
 type RegexMatcher[T any] struct {
-	regs map[string]*regElem[T]
-}
+	regs    map[string]*regElem[T]
+	version uint64 // increased on every change.
 
-type regElem[T any] struct {
-	reg *regexp.Regexp
-	v   T
+	setM sync.Mutex
+	set  atomic.Value // *regexSet[T]
 }
 
 func NewRegexMatcher[T any]() *RegexMatcher[T] {
@@ -155,35 +272,56 @@ func NewRegexMatcher[T any]() *RegexMatcher[T] {
 func (m *RegexMatcher[T]) Add(expr string, v T) error {
 	e := m.regs[expr]
 	if e == nil {
-		reg, err := regexp.Compile(expr)
+		re, err := syntax.Parse(expr, syntax.Perl)
 		if err != nil {
 			return err
 		}
 		m.regs[expr] = &regElem[T]{
-			reg: reg,
-			v:   v,
+			expr: expr,
+			re:   re,
+			v:    v,
 		}
+		m.version++
 	} else {
 		e.v = v
 	}
 	return nil
 }
 
+func (m *RegexMatcher[T]) Del(expr string) error {
+	if _, ok := m.regs[expr]; ok {
+		delete(m.regs, expr)
+		m.version++
+	}
+	return nil
+}
+
 func (m *RegexMatcher[T]) Match(s string) (v T, ok bool) {
-	s = NormalizeDomain(s)
-	for _, e := range m.regs {
-		if e.reg.MatchString(s) {
-			return e.v, true
-		}
+	if len(m.regs) == 0 {
+		return
 	}
-	var zeroT T
-	return zeroT, false
+	return m.getSet().match(NormalizeDomain(s))
 }
 
 func (m *RegexMatcher[T]) Len() int {
 	return len(m.regs)
 }
 
+// getSet returns the compiled set of the current rules.
+func (m *RegexMatcher[T]) getSet() *regexSet[T] {
+	if s, _ := m.set.Load().(*regexSet[T]); s != nil && s.version == m.version {
+		return s
+	}
+	m.setM.Lock()
+	defer m.setM.Unlock()
+	if s, _ := m.set.Load().(*regexSet[T]); s != nil && s.version == m.version {
+		return s
+	}
+	s := newRegexSet(m.regs, m.version)
+	m.set.Store(s)
+	return s
+}
+
 const (
 	MatcherFull    = "full"
 	MatcherDomain  = "domain"
@@ -210,6 +348,12 @@ func NewMixMatcher[T any]() *MixMatcher[T] {
 	}
 }
 
+// EnablePrefilter enables the bloom filter of domain rules. See
+// SubDomainMatcher.EnablePrefilter.
+func (m *MixMatcher[T]) EnablePrefilter() {
+	m.domain.EnablePrefilter()
+}
+
 func (m *MixMatcher[T]) SetDefaultMatcher(s string) {
 	m.defaultMatcher = s
 }
@@ -229,6 +373,15 @@ func (m *MixMatcher[T]) GetSubMatcher(typ string) WriteableMatcher[T] {
 }
 
 func (m *MixMatcher[T]) Add(s string, v T) error {
+	sm, pattern, err := m.subMatcherOf(s)
+	if err != nil {
+		return err
+	}
+	return sm.Add(pattern, v)
+}
+
+// subMatcherOf returns the sub matcher and the pattern of s.
+func (m *MixMatcher[T]) subMatcherOf(s string) (WriteableMatcher[T], string, error) {
 	typ, pattern := m.splitTypeAndPattern(s)
 	if len(typ) == 0 {
 		if len(m.defaultMatcher) != 0 {
@@ -239,9 +392,17 @@ func (m *MixMatcher[T]) Add(s string, v T) error {
 	}
 	sm := m.GetSubMatcher(typ)
 	if sm == nil {
-		return fmt.Errorf("unsupported match type [%s]", typ)
+		return nil, "", fmt.Errorf("unsupported match type [%s]", typ)
 	}
-	return sm.Add(pattern, v)
+	return sm, pattern, nil
+}
+
+func (m *MixMatcher[T]) Del(s string) error {
+	sm, pattern, err := m.subMatcherOf(s)
+	if err != nil {
+		return err
+	}
+	return sm.(DeletableMatcher[T]).Del(pattern)
 }
 
 func (m *MixMatcher[T]) Match(s string) (v T, ok bool) {
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"sync"
+)
+
+const (
+	// Rules are combined into chunks. The combined regexp of a chunk
+	// is matched first, so the rules of a chunk are only matched
+	// individually if one of them matches. Big chunks might exceed the
+	// size limit of regexp.
+	maxChunkRules = 128
+	maxChunkSize  = 16 * 1024 // total length of the expressions
+)
+
+type regElem[T any] struct {
+	expr string
+	re   *syntax.Regexp
+	v    T
+
+	once sync.Once
+	reg  *regexp.Regexp // compiled lazily, nil if it cannot be compiled.
+}
+
+func (e *regElem[T]) compiled() *regexp.Regexp {
+	e.once.Do(func() {
+		e.reg, _ = regexp.Compile(e.expr)
+	})
+	return e.reg
+}
+
+// regexSet is the compiled rules of a RegexMatcher.
+type regexSet[T any] struct {
+	version uint64
+	chunks  []regexChunk[T]
+}
+
+type regexChunk[T any] struct {
+	combined *regexp.Regexp // nil if the chunk cannot be combined.
+	elems    []*regElem[T]
+}
+
+func newRegexSet[T any](regs map[string]*regElem[T], version uint64) *regexSet[T] {
+	elems := make([]*regElem[T], 0, len(regs))
+	for _, e := range regs {
+		elems = append(elems, e)
+	}
+	sort.Slice(elems, func(i, j int) bool { return elems[i].expr < elems[j].expr })
+
+	s := &regexSet[T]{version: version}
+	for len(elems) > 0 {
+		n, size := 0, 0
+		for n < len(elems) && n < maxChunkRules && (n == 0 || size+len(elems[n].expr) <= maxChunkSize) {
+			size += len(elems[n].expr)
+			n++
+		}
+		s.chunks = append(s.chunks, newRegexChunk(elems[:n]))
+		elems = elems[n:]
+	}
+	return s
+}
+
+func newRegexChunk[T any](elems []*regElem[T]) regexChunk[T] {
+	c := regexChunk[T]{elems: elems}
+	if len(elems) == 1 {
+		c.combined = elems[0].compiled()
+		return c
+	}
+	alt := &syntax.Regexp{Op: syntax.OpAlternate, Flags: syntax.Perl}
+	for _, e := range elems {
+		alt.Sub = append(alt.Sub, e.re)
+	}
+	c.combined, _ = regexp.Compile(alt.String())
+	return c
+}
+
+func (s *regexSet[T]) match(str string) (v T, ok bool) {
+	for _, c := range s.chunks {
+		if c.combined != nil && !c.combined.MatchString(str) {
+			continue
+		}
+		for _, e := range c.elems {
+			if reg := e.compiled(); reg != nil && reg.MatchString(str) {
+				return e.v, true
+			}
+		}
+	}
+	return
+}
@@ -71,18 +71,39 @@ func TrimDot(s string) string {
 }
 
 // labelNode can store dns labels.
+// Leaf nodes, which are the majority of a large domain list, only take
+// 16 bytes (plus v). Children are kept in a sorted slice, which is a lot
+// smaller than a map, until there are too many of them.
 type labelNode[T any] struct {
-	children map[string]*labelNode[T] // lazy init
+	c *labelChildren[T] // lazy init
 
 	v    T
 	hasV bool
 }
 
+const maxSliceChildren = 32
+
+type labelChildren[T any] struct {
+	s []labelEdge[T]           // sorted by labels, nil if m is used.
+	m map[string]*labelNode[T] // used if there are more than maxSliceChildren children.
+}
+
+type labelEdge[T any] struct {
+	label string
+	n     *labelNode[T]
+}
+
 func (n *labelNode[T]) storeValue(v T) {
 	n.v = v
 	n.hasV = true
 }
 
+func (n *labelNode[T]) clearValue() {
+	var zeroT T
+	n.v = zeroT
+	n.hasV = false
+}
+
 func (n *labelNode[T]) getValue() (T, bool) {
 	return n.v, n.hasV
 }
@@ -91,26 +112,120 @@ func (n *labelNode[T]) hasValue() bool {
 	return n.hasV
 }
 
+// newChild adds a new child. key must not exist in n.
 func (n *labelNode[T]) newChild(key string) *labelNode[T] {
-	if n.children == nil {
-		n.children = make(map[string]*labelNode[T])
+	if n.c == nil {
+		n.c = new(labelChildren[T])
 	}
 	node := new(labelNode[T])
-	n.children[key] = node
+	c := n.c
+	if c.m != nil {
+		c.m[key] = node
+		return node
+	}
+	if len(c.s) >= maxSliceChildren {
+		c.m = make(map[string]*labelNode[T], len(c.s)+1)
+		for _, e := range c.s {
+			c.m[e.label] = e.n
+		}
+		c.m[key] = node
+		c.s = nil
+		return node
+	}
+	i := c.search(key)
+	c.s = append(c.s, labelEdge[T]{})
+	copy(c.s[i+1:], c.s[i:])
+	c.s[i] = labelEdge[T]{label: key, n: node}
 	return node
 }
 
 func (n *labelNode[T]) getChild(key string) *labelNode[T] {
-	return n.children[key]
+	c := n.c
+	if c == nil {
+		return nil
+	}
+	if c.m != nil {
+		return c.m[key]
+	}
+	if i := c.search(key); i < len(c.s) && c.s[i].label == key {
+		return c.s[i].n
+	}
+	return nil
+}
+
+func (n *labelNode[T]) delChild(key string) {
+	c := n.c
+	if c == nil {
+		return
+	}
+	if c.m != nil {
+		delete(c.m, key)
+	} else if i := c.search(key); i < len(c.s) && c.s[i].label == key {
+		c.s = append(c.s[:i], c.s[i+1:]...)
+	}
+	if len(c.m) == 0 && len(c.s) == 0 {
+		n.c = nil
+	}
+}
+
+func (n *labelNode[T]) isEmpty() bool {
+	return !n.hasV && n.c == nil
 }
 
 func (n *labelNode[T]) len() int {
 	l := 0
-	for _, node := range n.children {
+	n.rangeChildren(func(node *labelNode[T]) {
 		l += node.len()
 		if node.hasValue() {
 			l++
 		}
-	}
+	})
 	return l
 }
+
+func (n *labelNode[T]) rangeChildren(f func(node *labelNode[T])) {
+	if n.c == nil {
+		return
+	}
+	for _, e := range n.c.s {
+		f(e.n)
+	}
+	for _, node := range n.c.m {
+		f(node)
+	}
+}
+
+// addToFilter adds hashes of domains under n to bf. h is the hash of n,
+// see labelHash.
+func (n *labelNode[T]) addToFilter(h uint64, bf *bloomFilter) {
+	if n.c == nil {
+		return
+	}
+	add := func(label string, child *labelNode[T]) {
+		ch := labelHash(h, label)
+		if child.hasValue() {
+			bf.add(ch)
+		}
+		child.addToFilter(ch, bf)
+	}
+	for _, e := range n.c.s {
+		add(e.label, e.n)
+	}
+	for label, child := range n.c.m {
+		add(label, child)
+	}
+}
+
+// search returns the index of the first label that is not less than key.
+func (c *labelChildren[T]) search(key string) int {
+	i, j := 0, len(c.s)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if c.s[h].label < key {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i
+}
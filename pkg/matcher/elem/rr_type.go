@@ -19,8 +19,24 @@
 
 package elem
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IntMatcher matches ints in a set, in ranges, and not in excluded sets
+// and ranges.
 type IntMatcher struct {
-	m map[int]struct{}
+	m      map[int]struct{}
+	ranges []intRange
+
+	exclude       map[int]struct{}
+	excludeRanges []intRange
+}
+
+type intRange struct {
+	from, to int // inclusive
 }
 
 // NewIntMatcher inits a new IntMatcher.
@@ -33,7 +49,61 @@ func NewIntMatcher(elem []int) *IntMatcher {
 	return matcher
 }
 
+// ParseIntMatcher parses rules to an IntMatcher. A rule is a value, or
+// a range "from-to" (inclusive). Rules prefixed with "!" exclude values.
+// If there are only excluding rules, all other values are matched.
+// parseValue parses a value, e.g. a symbolic name, to an int.
+func ParseIntMatcher(rules []string, parseValue func(s string) (int, error)) (*IntMatcher, error) {
+	matcher := &IntMatcher{m: make(map[int]struct{}), exclude: make(map[int]struct{})}
+	for _, rule := range rules {
+		s := strings.TrimSpace(rule)
+		m, ranges := matcher.m, &matcher.ranges
+		if strings.HasPrefix(s, "!") {
+			s = strings.TrimSpace(s[1:])
+			m, ranges = matcher.exclude, &matcher.excludeRanges
+		}
+		from, to, isRange := strings.Cut(s, "-")
+		fromV, err := parseValue(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q, %w", rule, err)
+		}
+		if !isRange {
+			m[fromV] = struct{}{}
+			continue
+		}
+		toV, err := parseValue(strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q, %w", rule, err)
+		}
+		if toV < fromV {
+			return nil, fmt.Errorf("invalid range %q", rule)
+		}
+		*ranges = append(*ranges, intRange{from: fromV, to: toV})
+	}
+	return matcher, nil
+}
+
+// ParseInt is a parseValue function of ParseIntMatcher for numbers.
+func ParseInt(s string) (int, error) {
+	return strconv.Atoi(s)
+}
+
 func (m *IntMatcher) Match(v int) bool {
+	if _, ok := m.exclude[v]; ok || inRanges(m.excludeRanges, v) {
+		return false
+	}
+	if len(m.m) == 0 && len(m.ranges) == 0 {
+		return len(m.exclude) > 0 || len(m.excludeRanges) > 0
+	}
 	_, ok := m.m[v]
-	return ok
+	return ok || inRanges(m.ranges, v)
+}
+
+func inRanges(ranges []intRange, v int) bool {
+	for _, r := range ranges {
+		if v >= r.from && v <= r.to {
+			return true
+		}
+	}
+	return false
 }
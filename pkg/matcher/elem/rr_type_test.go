@@ -43,3 +43,41 @@ func TestIntMatcher_Match(t *testing.T) {
 		})
 	}
 }
+
+func TestParseIntMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		want    []int
+		notWant []int
+		wantErr bool
+	}{
+		{"values", []string{"1", "28"}, []int{1, 28}, []int{2}, false},
+		{"range", []string{"65-99"}, []int{65, 80, 99}, []int{64, 100}, false},
+		{"exclude only", []string{"!255", "!65-66"}, []int{1, 64, 67}, []int{255, 65, 66}, false},
+		{"range with exclude", []string{"1-10", "!5"}, []int{1, 4, 6, 10}, []int{5, 11}, false},
+		{"invalid value", []string{"a"}, nil, nil, true},
+		{"invalid range", []string{"10-1"}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseIntMatcher(tt.rules, ParseInt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIntMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, v := range tt.want {
+				if !m.Match(v) {
+					t.Errorf("%d should match", v)
+				}
+			}
+			for _, v := range tt.notWant {
+				if m.Match(v) {
+					t.Errorf("%d should not match", v)
+				}
+			}
+		})
+	}
+}
@@ -46,6 +46,24 @@ func (m *ClientIPMatcher) Match(_ context.Context, qCtx *query_context.Context)
 	return m.ipMatcher.Match(clientAddr)
 }
 
+// OriginalDstMatcher matches the original destination ip of requests from
+// transparent proxy listeners.
+type OriginalDstMatcher struct {
+	ipMatcher netlist.Matcher
+}
+
+func NewOriginalDstMatcher(ipMatcher netlist.Matcher) *OriginalDstMatcher {
+	return &OriginalDstMatcher{ipMatcher: ipMatcher}
+}
+
+func (m *OriginalDstMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	dst := qCtx.ReqMeta().OriginalDst
+	if !dst.IsValid() {
+		return false, nil
+	}
+	return m.ipMatcher.Match(dst.Addr())
+}
+
 type ClientECSMatcher struct {
 	ipMatcher netlist.Matcher
 }
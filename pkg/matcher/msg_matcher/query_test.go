@@ -78,6 +78,36 @@ func TestClientIPMatcher_Match(t *testing.T) {
 	}
 }
 
+func TestOriginalDstMatcher_Match(t *testing.T) {
+	nl := netlist.NewList()
+	if err := netlist.LoadFromText(nl, "10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	nl.Sort()
+
+	msg := new(dns.Msg)
+	tests := []struct {
+		name        string
+		meta        *query_context.RequestMeta
+		wantMatched bool
+	}{
+		{"matched", &query_context.RequestMeta{OriginalDst: netip.MustParseAddrPort("10.0.0.1:53")}, true},
+		{"not matched", &query_context.RequestMeta{OriginalDst: netip.MustParseAddrPort("1.1.1.1:53")}, false},
+		{"not intercepted", &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("10.0.0.2")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMatched, err := NewOriginalDstMatcher(nl).Match(context.Background(), query_context.NewContext(msg, tt.meta))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotMatched != tt.wantMatched {
+				t.Errorf("Match() gotMatched = %v, want %v", gotMatched, tt.wantMatched)
+			}
+		})
+	}
+}
+
 func TestClientECSMatcher_Match(t *testing.T) {
 	nl := netlist.NewList()
 	if err := netlist.LoadFromText(nl, "127.0.0.0/24"); err != nil {
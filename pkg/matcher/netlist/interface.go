@@ -27,3 +27,8 @@ type Matcher interface {
 	Match(addr netip.Addr) (bool, error)
 	Len() int
 }
+
+// memSizer is implemented by matchers that can report their memory size.
+type memSizer interface {
+	MemSize() int
+}
@@ -22,8 +22,10 @@ package netlist
 import (
 	"errors"
 	"fmt"
+	"go4.org/netipx"
 	"net/netip"
 	"sort"
+	"unsafe"
 )
 
 var (
@@ -31,13 +33,23 @@ var (
 	ErrInvalidAddr = errors.New("addr is invalid")
 )
 
-// List is a list of netip.Prefix. It stores all netip.Prefix in one single slice
-// and use binary search.
+// List is a list of netip.Prefix. Once sorted, prefixes are merged into
+// sorted, non-overlapping address ranges, ipv4 ranges in 8 bytes and ipv6
+// ranges in 32 bytes, and searched by binary search. Adjacent prefixes are
+// merged into one range, so a list of millions of cidrs (e.g. chnroutes)
+// only takes a few MBs and a lookup takes O(log n).
 // It is suitable for large static cidr search.
 type List struct {
-	// stores valid and masked netip.Prefix(s)
+	// stores valid and masked netip.Prefix(s) that are not sorted yet.
 	e      []netip.Prefix
 	sorted bool
+
+	n int // number of merged prefixes.
+
+	// Inclusive ranges. ipv4 (and ipv4-mapped ipv6) addresses are
+	// stored in v4.
+	v4Start, v4End []uint32
+	v6Start, v6End []uint128
 }
 
 // NewList returns a *List.
@@ -67,6 +79,9 @@ func (list *List) Append(newNet ...netip.Prefix) {
 		newNet[i] = netip.PrefixFrom(addr, bits).Masked()
 	}
 	mustValid(newNet)
+	if list.sorted {
+		list.e = list.rangePrefixes()
+	}
 	list.e = append(list.e, newNet...)
 	list.sorted = false
 }
@@ -97,12 +112,72 @@ func (list *List) Sort() {
 
 	}
 
-	list.e = out
+	list.n = len(out)
+	list.buildRanges(out)
+	list.e = nil
 	list.sorted = true
 }
 
-// Len implements sort Interface.
+// buildRanges builds ranges from sorted, non-overlapping prefixes.
+func (list *List) buildRanges(prefixes []netip.Prefix) {
+	list.v4Start, list.v4End = list.v4Start[:0], list.v4End[:0]
+	list.v6Start, list.v6End = list.v6Start[:0], list.v6End[:0]
+
+	var starts, ends []uint128
+	for _, p := range prefixes {
+		start := u128From(p.Addr())
+		end := start.or(hostMask(p.Bits()))
+		if l := len(ends); l > 0 && ends[l-1] != uint128Max && ends[l-1].add1() == start {
+			ends[l-1] = end
+			continue
+		}
+		starts = append(starts, start)
+		ends = append(ends, end)
+	}
+
+	// Split ranges into ipv4-mapped and ipv6 parts.
+	for i := range starts {
+		s, e := starts[i], ends[i]
+		if s.less(v4MappedStart) {
+			list.v6Start = append(list.v6Start, s)
+			list.v6End = append(list.v6End, minUint128(e, v4MappedStart.sub1()))
+		}
+		if !e.less(v4MappedStart) && !v4MappedEnd.less(s) {
+			list.v4Start = append(list.v4Start, uint32(maxUint128(s, v4MappedStart).lo))
+			list.v4End = append(list.v4End, uint32(minUint128(e, v4MappedEnd).lo))
+		}
+		if v4MappedEnd.less(e) {
+			list.v6Start = append(list.v6Start, maxUint128(s, v4MappedEnd.add1()))
+			list.v6End = append(list.v6End, e)
+		}
+	}
+}
+
+// rangePrefixes converts ranges back to prefixes.
+func (list *List) rangePrefixes() []netip.Prefix {
+	var out []netip.Prefix
+	for i := range list.v4Start {
+		r := netipx.IPRangeFrom(
+			netip.AddrFrom4(u32ToBytes(list.v4Start[i])),
+			netip.AddrFrom4(u32ToBytes(list.v4End[i])),
+		)
+		for _, p := range r.Prefixes() {
+			out = append(out, netip.PrefixFrom(to6(p.Addr()), p.Bits()+96))
+		}
+	}
+	for i := range list.v6Start {
+		r := netipx.IPRangeFrom(list.v6Start[i].addr(), list.v6End[i].addr())
+		out = append(out, r.Prefixes()...)
+	}
+	return out
+}
+
+// Len implements sort Interface. Once sorted, it returns the number of
+// merged prefixes.
 func (list *List) Len() int {
+	if list.sorted {
+		return list.n
+	}
 	return len(list.e)
 }
 
@@ -116,6 +191,18 @@ func (list *List) Swap(i, j int) {
 	list.e[i], list.e[j] = list.e[j], list.e[i]
 }
 
+// Ranges returns the number of address ranges of a sorted list.
+func (list *List) Ranges() int {
+	return len(list.v4Start) + len(list.v6Start)
+}
+
+// MemSize returns the approximate memory size of the list in bytes.
+func (list *List) MemSize() int {
+	return cap(list.e)*int(unsafe.Sizeof(netip.Prefix{})) +
+		(cap(list.v4Start)+cap(list.v4End))*4 +
+		(cap(list.v6Start)+cap(list.v6End))*16
+}
+
 func (list *List) Match(addr netip.Addr) (bool, error) {
 	return list.Contains(addr)
 }
@@ -129,23 +216,33 @@ func (list *List) Contains(addr netip.Addr) (bool, error) {
 		return false, ErrInvalidAddr
 	}
 
-	addr = to6(addr)
+	addr = addr.Unmap()
+	if addr.Is4() {
+		b := addr.As4()
+		x := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+		i, j := 0, len(list.v4Start)
+		for i < j {
+			h := int(uint(i+j) >> 1) // avoid overflow when computing h
+			if list.v4Start[h] <= x {
+				i = h + 1
+			} else {
+				j = h
+			}
+		}
+		return i > 0 && x <= list.v4End[i-1], nil
+	}
 
-	i, j := 0, len(list.e)
+	x := u128From(addr)
+	i, j := 0, len(list.v6Start)
 	for i < j {
-		h := int(uint(i+j) >> 1) // avoid overflow when computing h
-		if list.e[h].Addr().Compare(addr) <= 0 {
+		h := int(uint(i+j) >> 1)
+		if !x.less(list.v6Start[h]) {
 			i = h + 1
 		} else {
 			j = h
 		}
 	}
-
-	if i == 0 {
-		return false, nil
-	}
-
-	return list.e[i-1].Contains(addr), nil
+	return i > 0 && !list.v6End[i-1].less(x), nil
 }
 
 func to6(addr netip.Addr) netip.Addr {
@@ -154,3 +251,7 @@ func to6(addr netip.Addr) netip.Addr {
 	}
 	return netip.AddrFrom16(addr.As16())
 }
+
+func u32ToBytes(u uint32) [4]byte {
+	return [4]byte{byte(u >> 24), byte(u >> 16), byte(u >> 8), byte(u)}
+}
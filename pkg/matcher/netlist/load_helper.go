@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"github.com/IrineSistiana/mosdns/v4/pkg/mmdb"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"google.golang.org/protobuf/proto"
 	"io"
@@ -46,6 +47,17 @@ func (m *MatcherGroup) Len() int {
 	return s
 }
 
+// MemSize returns the approximate memory size of lists in m in bytes.
+func (m *MatcherGroup) MemSize() int {
+	s := 0
+	for _, l := range m.g {
+		if l, ok := l.(memSizer); ok {
+			s += l.MemSize()
+		}
+	}
+	return s
+}
+
 func (m *MatcherGroup) Match(addr netip.Addr) (bool, error) {
 	for _, list := range m.g {
 		ok, err := list.Match(addr)
@@ -67,32 +79,46 @@ func (m *MatcherGroup) Close() error {
 }
 
 type DynamicMatcher struct {
-	parseFunc func(in []byte) (*List, error)
-	v         atomic.Value
+	parseFunc func(in []byte) (Matcher, error)
+	v         atomic.Value // *dynamicMatcherValue
 }
 
-func NewDynamicMatcher(parseFunc func(in []byte) (*List, error)) *DynamicMatcher {
+type dynamicMatcherValue struct {
+	m Matcher
+}
+
+func NewDynamicMatcher(parseFunc func(in []byte) (Matcher, error)) *DynamicMatcher {
 	return &DynamicMatcher{parseFunc: parseFunc}
 }
 
 func (d *DynamicMatcher) Update(newData []byte) error {
-	list, err := d.parseFunc(newData)
+	m, err := d.parseFunc(newData)
 	if err != nil {
 		return err
 	}
-	d.v.Store(list)
+	d.v.Store(&dynamicMatcherValue{m: m})
 	return nil
 }
 
 func (d *DynamicMatcher) Match(addr netip.Addr) (bool, error) {
-	return d.v.Load().(*List).Match(addr)
+	return d.v.Load().(*dynamicMatcherValue).m.Match(addr)
 }
 
 func (d *DynamicMatcher) Len() int {
-	return d.v.Load().(*List).Len()
+	return d.v.Load().(*dynamicMatcherValue).m.Len()
+}
+
+func (d *DynamicMatcher) MemSize() int {
+	if m, ok := d.v.Load().(*dynamicMatcherValue).m.(memSizer); ok {
+		return m.MemSize()
+	}
+	return 0
 }
 
 // BatchLoadProvider is a helper func to load multiple files using Load.
+// An entry "provider:tag" loads an ip list from the data provider tag.
+// "provider:tag:cn,us" loads tags of a v2ray geoip.dat file, or country
+// codes and ASNs (e.g. "as13335") of a MaxMind .mmdb file. See ParseMMDB.
 // Caller must call MatcherGroup.Close to detach this matcher from data_provider.DataManager to
 // avoid leaking.
 func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup, error) {
@@ -107,20 +133,19 @@ func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup
 			if provider == nil {
 				return nil, fmt.Errorf("cannot find provider %s", providerName)
 			}
-			var parseFunc func(in []byte) (*List, error)
-			if len(v2suffix) > 0 {
-				parseFunc = func(in []byte) (*List, error) {
+			parseFunc := func(in []byte) (Matcher, error) {
+				if mmdb.IsMMDB(in) {
+					return ParseMMDB(in, v2suffix)
+				}
+				if len(v2suffix) > 0 {
 					return ParseV2rayIPDat(in, v2suffix)
 				}
-			} else {
-				parseFunc = func(in []byte) (*List, error) {
-					l := NewList()
-					if err := LoadFromReader(l, bytes.NewReader(in)); err != nil {
-						return nil, err
-					}
-					l.Sort()
-					return l, nil
+				l := NewList()
+				if err := LoadFromReader(l, bytes.NewReader(in)); err != nil {
+					return nil, err
 				}
+				l.Sort()
+				return l, nil
 			}
 			m := NewDynamicMatcher(parseFunc)
 			if err := provider.LoadAndAddListener(m); err != nil {
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/mmdb"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MMDBMatcher matches addresses by the country or the autonomous system
+// of their records in a MaxMind DB (GeoIP2/GeoLite2 Country, City or ASN).
+type MMDBMatcher struct {
+	r         *mmdb.Reader
+	countries map[string]struct{}
+	asns      map[uint64]struct{}
+
+	// cache caches results by record offsets. Many addresses share a
+	// record, and there are at most as many records as tree nodes.
+	cache sync.Map // map[uint32]bool
+}
+
+// ParseMMDB parses a mmdb file and builds a MMDBMatcher from args.
+// The format of args is "tag1,tag2,...". A tag is either an ISO 3166
+// country code (e.g. "cn") or an ASN with an "as" prefix (e.g. "as13335").
+// Country codes are matched against the country of a record, or its
+// registered country if it has no country.
+func ParseMMDB(in []byte, args string) (*MMDBMatcher, error) {
+	r, err := mmdb.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return NewMMDBMatcher(r, args)
+}
+
+// NewMMDBMatcher builds a MMDBMatcher from r. See ParseMMDB for args.
+func NewMMDBMatcher(r *mmdb.Reader, args string) (*MMDBMatcher, error) {
+	m := &MMDBMatcher{
+		r:         r,
+		countries: make(map[string]struct{}),
+		asns:      make(map[uint64]struct{}),
+	}
+	for _, tag := range strings.Split(args, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) == 0 {
+			continue
+		}
+		if s := strings.TrimPrefix(tag, "as"); len(s) < len(tag) && len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+			asn, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid asn %s, %w", tag, err)
+			}
+			m.asns[asn] = struct{}{}
+			continue
+		}
+		if len(tag) != 2 {
+			return nil, fmt.Errorf("invalid country code %s", tag)
+		}
+		m.countries[tag] = struct{}{}
+	}
+	if len(m.countries)+len(m.asns) == 0 {
+		return nil, errors.New("mmdb requires at least one country code or asn")
+	}
+	return m, nil
+}
+
+func (m *MMDBMatcher) Match(addr netip.Addr) (bool, error) {
+	offset, ok, err := m.r.LookupOffset(addr)
+	if err != nil || !ok {
+		return false, err
+	}
+	if v, ok := m.cache.Load(offset); ok {
+		return v.(bool), nil
+	}
+	record, err := m.r.Decode(offset)
+	if err != nil {
+		return false, err
+	}
+	matched := m.matchRecord(record)
+	m.cache.Store(offset, matched)
+	return matched, nil
+}
+
+// Len returns the number of nodes of the database search tree.
+func (m *MMDBMatcher) Len() int {
+	return int(m.r.Metadata().NodeCount)
+}
+
+func (m *MMDBMatcher) matchRecord(record interface{}) bool {
+	rm, _ := record.(map[string]interface{})
+	if len(m.countries) > 0 {
+		code := recordCountry(rm, "country")
+		if len(code) == 0 {
+			code = recordCountry(rm, "registered_country")
+		}
+		if _, ok := m.countries[strings.ToLower(code)]; ok && len(code) > 0 {
+			return true
+		}
+	}
+	if len(m.asns) > 0 {
+		if asn, ok := rm["autonomous_system_number"].(uint64); ok {
+			if _, ok := m.asns[asn]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func recordCountry(rm map[string]interface{}, key string) string {
+	c, _ := rm[key].(map[string]interface{})
+	code, _ := c["iso_code"].(string)
+	return code
+}
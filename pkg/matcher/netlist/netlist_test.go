@@ -21,7 +21,10 @@ package netlist
 
 import (
 	"bytes"
+	"math/rand"
 	"net/netip"
+	"runtime"
+	"sort"
 	"testing"
 )
 
@@ -113,3 +116,272 @@ func TestIPNetList_New_And_Contains(t *testing.T) {
 		})
 	}
 }
+
+func TestMMDBMatcher_matchRecord(t *testing.T) {
+	m, err := NewMMDBMatcher(nil, "CN, as13335")
+	if err != nil {
+		t.Fatal(err)
+	}
+	country := func(key, code string) map[string]interface{} {
+		return map[string]interface{}{key: map[string]interface{}{"iso_code": code}}
+	}
+	tests := []struct {
+		name   string
+		record interface{}
+		want   bool
+	}{
+		{"country", country("country", "CN"), true},
+		{"other country", country("country", "US"), false},
+		{"registered country", country("registered_country", "CN"), true},
+		{"asn", map[string]interface{}{"autonomous_system_number": uint64(13335)}, true},
+		{"other asn", map[string]interface{}{"autonomous_system_number": uint64(15169)}, false},
+		{"empty", map[string]interface{}{}, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := m.matchRecord(tt.record); got != tt.want {
+			t.Errorf("%s: matchRecord() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, args := range []string{"", "chn", "as1x"} {
+		if _, err := NewMMDBMatcher(nil, args); err == nil {
+			t.Errorf("args %q should be rejected", args)
+		}
+	}
+}
+
+func TestList_ranges(t *testing.T) {
+	l := NewList()
+	for _, s := range []string{
+		"1.0.0.0/24", "1.0.1.0/24", // adjacent, one range
+		"1.0.3.0/24",
+		"2000::/64", "2000:0:0:1::/64", // adjacent, one range
+		"::ffff:2.0.0.0/120", // ipv4-mapped
+	} {
+		if err := LoadFromText(l, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Sort()
+	if l.Len() != 6 || l.Ranges() != 4 {
+		t.Fatalf("unexpected len %d and ranges %d", l.Len(), l.Ranges())
+	}
+	if l.MemSize() <= 0 {
+		t.Fatal("MemSize() should be positive")
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"1.0.1.255", true},
+		{"1.0.2.0", false},
+		{"::ffff:1.0.3.1", true},
+		{"2.0.0.1", true},
+		{"2000:0:0:1:ffff::", true},
+		{"2000:0:0:2::", false},
+	}
+	for _, tt := range tests {
+		if got, _ := l.Match(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// Appending to a sorted list keeps the old prefixes.
+	l.Append(netip.MustParsePrefix("3.0.0.0/8"))
+	l.Sort()
+	for _, s := range []string{"1.0.0.1", "3.1.1.1", "2000::1"} {
+		if ok, _ := l.Match(netip.MustParseAddr(s)); !ok {
+			t.Errorf("%s should match", s)
+		}
+	}
+
+	// Prefixes that cover the ipv4-mapped block.
+	all := NewList()
+	all.Append(netip.MustParsePrefix("::/0"))
+	all.Sort()
+	for _, s := range []string{"0.0.0.0", "255.255.255.255", "::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+		if ok, _ := all.Match(netip.MustParseAddr(s)); !ok {
+			t.Errorf("%s should match ::/0", s)
+		}
+	}
+}
+
+func TestList_random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var prefixes []netip.Prefix
+	l := NewList()
+	for i := 0; i < 2000; i++ {
+		var p netip.Prefix
+		if i%2 == 0 {
+			p = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))}), 16+r.Intn(17)).Masked()
+		} else {
+			p = netip.PrefixFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 0, byte(r.Intn(4)), byte(r.Intn(256))}), 24+r.Intn(25)).Masked()
+		}
+		prefixes = append(prefixes, p)
+		l.Append(p)
+	}
+	l.Sort()
+
+	for i := 0; i < 20000; i++ {
+		var addr netip.Addr
+		if i%2 == 0 {
+			addr = netip.AddrFrom4([4]byte{10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))})
+		} else {
+			addr = netip.AddrFrom16([16]byte{0x20, 0x01, 0, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))})
+		}
+		want := false
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				want = true
+				break
+			}
+		}
+		if got, _ := l.Match(addr); got != want {
+			t.Fatalf("Match(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// baselineList is the List before it stored merged ranges: sorted
+// netip.Prefix(s) in ipv6 form, searched by binary search. It is kept to
+// compare the memory and speed of List with.
+type baselineList struct {
+	e []netip.Prefix
+}
+
+func newBaselineList(prefixes []netip.Prefix) *baselineList {
+	e := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			bits += 96
+		}
+		e = append(e, netip.PrefixFrom(netip.AddrFrom16(p.Addr().As16()), bits).Masked())
+	}
+	sort.Slice(e, func(i, j int) bool { return e[i].Addr().Less(e[j].Addr()) })
+	out := make([]netip.Prefix, 0)
+	for i, n := range e {
+		if i == 0 {
+			out = append(out, n)
+			continue
+		}
+		lv := &out[len(out)-1]
+		switch {
+		case n.Addr() == lv.Addr():
+			if n.Bits() < lv.Bits() {
+				*lv = n
+			}
+		case !lv.Contains(n.Addr()):
+			out = append(out, n)
+		}
+	}
+	return &baselineList{e: out}
+}
+
+func (l *baselineList) Match(addr netip.Addr) bool {
+	addr = netip.AddrFrom16(addr.As16())
+	i, j := 0, len(l.e)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if l.e[h].Addr().Compare(addr) <= 0 {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i > 0 && l.e[i-1].Contains(addr)
+}
+
+// benchPrefixes returns about the size of a full route table, n4 ipv4 /24
+// and n6 ipv6 /48 prefixes, and some random ipv4 addresses to match.
+func benchPrefixes(n4, n6 int) ([]netip.Prefix, []netip.Addr) {
+	r := rand.New(rand.NewSource(1))
+	prefixes := make([]netip.Prefix, 0, n4+n6)
+	for i := 0; i < n4; i++ {
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(r.Intn(224)), byte(r.Intn(256)), byte(r.Intn(256))}), 24))
+	}
+	for i := 0; i < n6; i++ {
+		var a [16]byte
+		r.Read(a[:6])
+		a[0] = 0x20
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom16(a), 48))
+	}
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{byte(r.Intn(224)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))})
+	}
+	return prefixes, addrs
+}
+
+// heapGrowth returns how much the live heap grows after calling f, which
+// should return the built object.
+func heapGrowth(f func() any) (any, int64) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := f()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return v, int64(after.HeapAlloc) - int64(before.HeapAlloc)
+}
+
+func newSortedList(prefixes []netip.Prefix) *List {
+	l := NewList()
+	l.Append(append([]netip.Prefix(nil), prefixes...)...)
+	l.Sort()
+	return l
+}
+
+func TestList_memory(t *testing.T) {
+	prefixes, addrs := benchPrefixes(100000, 20000)
+	v, listMem := heapGrowth(func() any { return newSortedList(prefixes) })
+	l := v.(*List)
+	v, baselineMem := heapGrowth(func() any { return newBaselineList(prefixes) })
+	bl := v.(*baselineList)
+	runtime.KeepAlive(prefixes) // or it is freed during the measurement.
+
+	for _, addr := range addrs {
+		got, _ := l.Match(addr)
+		if want := bl.Match(addr); got != want {
+			t.Fatalf("Match(%s) = %v, baseline %v", addr, got, want)
+		}
+	}
+
+	// MemSize reports the real size of the list.
+	if d := listMem - int64(l.MemSize()); d < -int64(l.MemSize())/10 || d > int64(l.MemSize())/10 {
+		t.Errorf("MemSize() = %d, but the heap grew by %d", l.MemSize(), listMem)
+	}
+	// ipv4 ranges take 8 bytes and ipv6 ranges take 32 bytes, while
+	// netip.Prefix(s) take 32 bytes.
+	if listMem*2 > baselineMem {
+		t.Errorf("list takes %d bytes, should be less than half of the baseline (%d bytes)", listMem, baselineMem)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { l.Match(addrs[0]) }); allocs != 0 {
+		t.Errorf("Match allocates %v times", allocs)
+	}
+}
+
+func BenchmarkList_Match(b *testing.B) {
+	prefixes, addrs := benchPrefixes(1000000, 200000)
+	b.Run("ranges", func(b *testing.B) {
+		v, mem := heapGrowth(func() any { return newSortedList(prefixes) })
+		l := v.(*List)
+		runtime.KeepAlive(prefixes)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.Match(addrs[i%len(addrs)])
+		}
+		b.ReportMetric(float64(mem)/(1<<20), "MB")
+	})
+	b.Run("baseline", func(b *testing.B) {
+		v, mem := heapGrowth(func() any { return newBaselineList(prefixes) })
+		l := v.(*baselineList)
+		runtime.KeepAlive(prefixes)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.Match(addrs[i%len(addrs)])
+		}
+		b.ReportMetric(float64(mem)/(1<<20), "MB")
+	})
+}
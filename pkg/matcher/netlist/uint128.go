@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+)
+
+// uint128 is an ipv6 address in integer.
+type uint128 struct {
+	hi, lo uint64
+}
+
+var (
+	uint128Max    = uint128{math.MaxUint64, math.MaxUint64}
+	v4MappedStart = uint128{0, 0xffff_0000_0000}
+	v4MappedEnd   = uint128{0, 0xffff_ffff_ffff}
+)
+
+func u128From(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+func (u uint128) addr() netip.Addr {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	return netip.AddrFrom16(b)
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+func (u uint128) add1() uint128 {
+	lo := u.lo + 1
+	hi := u.hi
+	if lo == 0 {
+		hi++
+	}
+	return uint128{hi, lo}
+}
+
+func (u uint128) sub1() uint128 {
+	lo := u.lo - 1
+	hi := u.hi
+	if u.lo == 0 {
+		hi--
+	}
+	return uint128{hi, lo}
+}
+
+// hostMask returns the host mask of a prefix of bits length.
+func hostMask(bits int) uint128 {
+	switch {
+	case bits <= 0:
+		return uint128Max
+	case bits < 64:
+		return uint128{math.MaxUint64 >> bits, math.MaxUint64}
+	case bits < 128:
+		return uint128{0, math.MaxUint64 >> (bits - 64)}
+	default:
+		return uint128{}
+	}
+}
+
+func minUint128(a, b uint128) uint128 {
+	if a.less(b) {
+		return a
+	}
+	return b
+}
+
+func maxUint128(a, b uint128) uint128 {
+	if a.less(b) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,405 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mmdb implements a reader of the MaxMind DB file format (.mmdb),
+// which is used by GeoIP2 and GeoLite2 databases.
+// See https://maxmind.github.io/MaxMind-DB/ for the specification.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+var metadataStartMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	dataSectionSeparatorSize = 16
+
+	// maxDecodeDepth limits the nesting of maps and arrays, so a
+	// malformed file cannot cause a stack overflow.
+	maxDecodeDepth = 32
+)
+
+// Metadata is the metadata of a database.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    int
+	NodeCount    uint32
+	RecordSize   int
+	BuildEpoch   uint64
+}
+
+// Reader reads records from a database in memory.
+// It is safe for concurrent use.
+type Reader struct {
+	meta       Metadata
+	tree       []byte
+	data       []byte
+	nodeSize   int
+	ipv4Start  uint32 // node of ::/96 in an ipv6 tree.
+	ipv4Bitlen int    // depth of ipv4Start.
+}
+
+// IsMMDB reports whether b looks like a MaxMind DB file.
+func IsMMDB(b []byte) bool {
+	return bytes.LastIndex(b, metadataStartMarker) >= 0
+}
+
+// NewReader parses b. b must not be modified after this call.
+func NewReader(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataStartMarker)
+	if i < 0 {
+		return nil, errors.New("invalid mmdb file, metadata not found")
+	}
+	metaDec := decoder{b: b[i+len(metadataStartMarker):]}
+	v, _, err := metaDec.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata, %w", err)
+	}
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata, not a map")
+	}
+	meta := Metadata{}
+	meta.DatabaseType, _ = mv["database_type"].(string)
+	meta.IPVersion = int(toUint64(mv["ip_version"]))
+	meta.NodeCount = uint32(toUint64(mv["node_count"]))
+	meta.RecordSize = int(toUint64(mv["record_size"]))
+	meta.BuildEpoch = toUint64(mv["build_epoch"])
+
+	switch meta.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", meta.RecordSize)
+	}
+	if meta.IPVersion != 4 && meta.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", meta.IPVersion)
+	}
+
+	nodeSize := meta.RecordSize / 4
+	treeSize := uint64(meta.NodeCount) * uint64(nodeSize)
+	if treeSize+dataSectionSeparatorSize > uint64(i) {
+		return nil, errors.New("invalid mmdb file, search tree is truncated")
+	}
+	r := &Reader{
+		meta:     meta,
+		tree:     b[:treeSize],
+		data:     b[treeSize+dataSectionSeparatorSize : i],
+		nodeSize: nodeSize,
+	}
+	if meta.IPVersion == 6 {
+		node := uint32(0)
+		for r.ipv4Bitlen = 0; r.ipv4Bitlen < 96 && node < meta.NodeCount; r.ipv4Bitlen++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Metadata returns the metadata of the database.
+func (r *Reader) Metadata() Metadata {
+	return r.meta
+}
+
+// LookupOffset returns the offset of the record of addr in the data
+// section. Addresses that share a record have the same offset, so it can
+// be used as a cache key. ok is false if addr has no record.
+func (r *Reader) LookupOffset(addr netip.Addr) (offset uint32, ok bool, err error) {
+	addr = addr.Unmap()
+	var node uint32
+	var ip []byte
+	switch {
+	case addr.Is4():
+		a := addr.As4()
+		ip = a[:]
+		if r.meta.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	case addr.Is6():
+		if r.meta.IPVersion == 4 {
+			return 0, false, nil
+		}
+		a := addr.As16()
+		ip = a[:]
+	default:
+		return 0, false, nil
+	}
+
+	nodeCount := r.meta.NodeCount
+	for i := 0; i < len(ip)*8 && node < nodeCount; i++ {
+		bit := (ip[i>>3] >> (7 - uint(i&7))) & 1
+		node = r.readRecord(node, bit)
+	}
+	switch {
+	case node == nodeCount:
+		return 0, false, nil
+	case node > nodeCount:
+		// Records between nodeCount and the end of the separator are
+		// invalid, they would underflow the offset.
+		if node-nodeCount < dataSectionSeparatorSize {
+			return 0, false, errors.New("invalid mmdb file, data pointer points to the separator")
+		}
+		offset = node - nodeCount - dataSectionSeparatorSize
+		if uint64(offset) >= uint64(len(r.data)) {
+			return 0, false, errors.New("invalid mmdb file, data pointer out of range")
+		}
+		return offset, true, nil
+	default:
+		return 0, false, errors.New("invalid mmdb file, search tree is too deep")
+	}
+}
+
+// Lookup returns the decoded record of addr. Maps are decoded as
+// map[string]interface{}, arrays as []interface{}, unsigned integers as
+// uint64 (or []byte for uint128), int32 as int64 and floats as float64.
+// It returns nil if addr has no record.
+func (r *Reader) Lookup(addr netip.Addr) (interface{}, error) {
+	offset, ok, err := r.LookupOffset(addr)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return r.Decode(offset)
+}
+
+// Decode decodes the record at offset of the data section.
+func (r *Reader) Decode(offset uint32) (interface{}, error) {
+	if uint64(offset) >= uint64(len(r.data)) {
+		return nil, errors.New("offset out of range")
+	}
+	d := decoder{b: r.data}
+	v, _, err := d.decode(int(offset), 0)
+	return v, err
+}
+
+func (r *Reader) readRecord(node uint32, bit byte) uint32 {
+	b := r.tree[int(node)*r.nodeSize:]
+	switch r.meta.RecordSize {
+	case 24:
+		b = b[int(bit)*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(b[int(bit)*4:])
+	}
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("invalid mmdb file, data is truncated")
+
+type decoder struct {
+	b []byte
+}
+
+// decode decodes the value at off and returns the offset after it.
+func (d *decoder) decode(off int, depth int) (interface{}, int, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("invalid mmdb file, data is nested too deep")
+	}
+	typ, size, off, err := d.decodeCtrl(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		p, next, err := d.decodePointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(p, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var k, v interface{}
+			k, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid mmdb file, map key is not a string")
+			}
+			v, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = v
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			var v interface{}
+			v, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > len(d.b) {
+		return nil, 0, errTruncated
+	}
+	b := d.b[off : off+size]
+	next := off + size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid uint size %d", size)
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size %d", size)
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+func (d *decoder) decodeCtrl(off int) (typ int, size int, next int, err error) {
+	if off < 0 || off >= len(d.b) {
+		return 0, 0, 0, errTruncated
+	}
+	ctrl := d.b[off]
+	off++
+	typ = int(ctrl >> 5)
+	if typ == typeExtended {
+		if off >= len(d.b) {
+			return 0, 0, 0, errTruncated
+		}
+		typ = 7 + int(d.b[off])
+		off++
+	}
+	size = int(ctrl & 0x1f)
+	if typ == typePointer || size < 29 {
+		return typ, size, off, nil
+	}
+	n := size - 28
+	if off+n > len(d.b) {
+		return 0, 0, 0, errTruncated
+	}
+	var v int
+	for _, c := range d.b[off : off+n] {
+		v = v<<8 | int(c)
+	}
+	switch n {
+	case 1:
+		size = 29 + v
+	case 2:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+	return typ, size, off + n, nil
+}
+
+// decodePointer decodes a pointer. ctrlSize is the size bits of the
+// control byte.
+func (d *decoder) decodePointer(ctrlSize int, off int) (p int, next int, err error) {
+	n := (ctrlSize>>3)&0x3 + 1
+	if off+n > len(d.b) {
+		return 0, 0, errTruncated
+	}
+	// Pointers are up to 32 bits, compute them in uint64, so they can't
+	// overflow int on 32-bit platforms.
+	var v uint64
+	for _, c := range d.b[off : off+n] {
+		v = v<<8 | uint64(c)
+	}
+	vvv := uint64(ctrlSize & 0x7)
+	var u uint64
+	switch n {
+	case 1:
+		u = vvv<<8 | v
+	case 2:
+		u = (vvv<<16 | v) + 2048
+	case 3:
+		u = (vvv<<24 | v) + 526336
+	default:
+		u = v
+	}
+	if u >= uint64(len(d.b)) {
+		return 0, 0, errors.New("invalid mmdb file, data pointer out of range")
+	}
+	return int(u), off + n, nil
+}
+
+func toUint64(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
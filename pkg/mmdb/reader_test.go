@@ -0,0 +1,264 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testEncode encodes v in the data section format. Only types that are
+// used by tests are supported.
+func testEncode(b *bytes.Buffer, v interface{}) {
+	ctrl := func(typ int, size int) {
+		var ext []byte
+		if typ > 7 {
+			ext = []byte{byte(typ - 7)}
+			typ = typeExtended
+		}
+		if size >= 29 {
+			panic("size is too large")
+		}
+		b.WriteByte(byte(typ<<5 | size))
+		b.Write(ext)
+	}
+	switch v := v.(type) {
+	case string:
+		ctrl(typeString, len(v))
+		b.WriteString(v)
+	case uint32:
+		var u [4]byte
+		binary.BigEndian.PutUint32(u[:], v)
+		ctrl(typeUint32, 4)
+		b.Write(u[:])
+	case bool:
+		s := 0
+		if v {
+			s = 1
+		}
+		ctrl(typeBool, s)
+	case []interface{}:
+		ctrl(typeArray, len(v))
+		for _, e := range v {
+			testEncode(b, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ctrl(typeMap, len(v))
+		for _, k := range keys {
+			testEncode(b, k)
+			testEncode(b, v[k])
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+type testRecord struct {
+	prefix string
+	data   map[string]interface{}
+}
+
+// testBuild builds an ipv6 database with 24 bits records.
+func testBuild(records []testRecord) []byte {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	data := new(bytes.Buffer)
+	dataRef := func(off int) int { return -2 - off }
+
+	for _, r := range records {
+		p := netip.MustParsePrefix(r.prefix)
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			bits += 96
+		}
+		ip := p.Addr().As16()
+		if p.Addr().Is4() {
+			ip = [16]byte{}
+			a := p.Addr().As4()
+			copy(ip[12:], a[:])
+		}
+		off := data.Len()
+		testEncode(data, r.data)
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := (ip[i>>3] >> (7 - uint(i&7))) & 1
+			if i == bits-1 {
+				nodes[node][bit] = dataRef(off)
+				break
+			}
+			next := nodes[node][bit]
+			if next < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				next = len(nodes) - 1
+				nodes[node][bit] = next
+			}
+			node = next
+		}
+	}
+
+	out := new(bytes.Buffer)
+	nodeCount := len(nodes)
+	for _, n := range nodes {
+		for _, rec := range n {
+			var v int
+			switch {
+			case rec == empty:
+				v = nodeCount
+			case rec < 0:
+				v = nodeCount + dataSectionSeparatorSize + (-2 - rec)
+			default:
+				v = rec
+			}
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, dataSectionSeparatorSize))
+	out.Write(data.Bytes())
+	out.Write(metadataStartMarker)
+	testEncode(out, map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(6),
+		"database_type": "Test",
+	})
+	return out.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	cn := map[string]interface{}{"country": map[string]interface{}{"iso_code": "CN"}}
+	asn := map[string]interface{}{"autonomous_system_number": uint32(13335), "anycast": true}
+	b := testBuild([]testRecord{
+		{"1.0.1.0/24", cn},
+		{"1.1.1.0/24", asn},
+		{"2400:da00::/32", cn},
+	})
+	if !IsMMDB(b) {
+		t.Fatal("IsMMDB() = false")
+	}
+	r, err := NewReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Metadata().DatabaseType; got != "Test" {
+		t.Fatalf("DatabaseType = %s", got)
+	}
+
+	wantCN := map[string]interface{}{"country": map[string]interface{}{"iso_code": "CN"}}
+	wantASN := map[string]interface{}{"autonomous_system_number": uint64(13335), "anycast": true}
+	tests := []struct {
+		addr string
+		want interface{}
+	}{
+		{"1.0.1.1", wantCN},
+		{"::ffff:1.0.1.1", wantCN},
+		{"1.1.1.1", wantASN},
+		{"1.0.2.1", nil},
+		{"2400:da00::1", wantCN},
+		{"2400:db00::1", nil},
+	}
+	for _, tt := range tests {
+		got, err := r.Lookup(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	o1, _, _ := r.LookupOffset(netip.MustParseAddr("1.0.1.1"))
+	o2, _, _ := r.LookupOffset(netip.MustParseAddr("1.0.1.2"))
+	if o1 != o2 {
+		t.Fatal("addresses of a record should have the same offset")
+	}
+}
+
+func TestNewReader_invalid(t *testing.T) {
+	if _, err := NewReader([]byte("not a mmdb file")); err == nil {
+		t.Fatal("invalid file should be rejected")
+	}
+	b := testBuild([]testRecord{{"1.0.1.0/24", map[string]interface{}{}}})
+	i := bytes.Index(b, metadataStartMarker)
+	if _, err := NewReader(b[i-20:]); err == nil {
+		t.Fatal("truncated file should be rejected")
+	}
+}
+
+// testBuildRaw builds an ipv4 database of a single node with raw records
+// and data.
+func testBuildRaw(left, right uint32, data []byte) []byte {
+	out := new(bytes.Buffer)
+	for _, v := range []uint32{left, right} {
+		out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+	}
+	out.Write(make([]byte, dataSectionSeparatorSize))
+	out.Write(data)
+	out.Write(metadataStartMarker)
+	testEncode(out, map[string]interface{}{
+		"node_count":  uint32(1),
+		"record_size": uint32(24),
+		"ip_version":  uint32(4),
+	})
+	return out.Bytes()
+}
+
+func TestReader_malformed(t *testing.T) {
+	str := new(bytes.Buffer)
+	testEncode(str, "ok")
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"pointer to separator", testBuildRaw(1+5, 1, str.Bytes())},
+		{"pointer out of data", testBuildRaw(1+dataSectionSeparatorSize+100, 1, str.Bytes())},
+		{"data pointer out of data", testBuildRaw(1+dataSectionSeparatorSize, 1, []byte{typePointer<<5 | 3<<3, 0xff, 0xff, 0xff, 0xff})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Lookup(netip.MustParseAddr("1.1.1.1")); err == nil {
+				t.Fatal("want an error")
+			}
+		})
+	}
+	r, err := NewReader(testBuildRaw(1+dataSectionSeparatorSize, 1, str.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.Lookup(netip.MustParseAddr("1.1.1.1")); err != nil || v != "ok" {
+		t.Fatalf("Lookup() = %v, %v", v, err)
+	}
+	if _, err := r.Decode(1 << 31); err == nil {
+		t.Fatal("want an error for invalid offset")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package neighbor looks up link layer (MAC) addresses of ip addresses
+// from the system neighbor (ARP and NDP) table.
+package neighbor
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var ErrNotSupported = errors.New("neighbor table is not supported on this platform")
+
+const (
+	defaultRefreshInterval = time.Minute
+
+	// minMissRefreshInterval limits table reloads caused by lookup misses.
+	minMissRefreshInterval = time.Second
+)
+
+// Table is a cached snapshot of the neighbor table.
+type Table struct {
+	refreshInterval time.Duration
+	load            func() (map[netip.Addr]net.HardwareAddr, error)
+
+	m         sync.Mutex
+	entries   map[netip.Addr]net.HardwareAddr
+	updatedAt time.Time
+}
+
+// NewTable returns a Table that reloads the system table every
+// refreshInterval, or when a lookup misses. Default interval is 1 min.
+func NewTable(refreshInterval time.Duration) *Table {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultRefreshInterval
+	}
+	return &Table{refreshInterval: refreshInterval, load: loadTable}
+}
+
+// Lookup returns the link layer address of addr. It returns nil if addr
+// is not in the table.
+func (t *Table) Lookup(addr netip.Addr) (net.HardwareAddr, error) {
+	addr = addr.Unmap()
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	now := time.Now()
+	hw, ok := t.entries[addr]
+	age := now.Sub(t.updatedAt)
+	if age < t.refreshInterval && (ok || age < minMissRefreshInterval) {
+		return hw, nil
+	}
+	entries, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	t.entries = entries
+	t.updatedAt = now
+	return entries[addr], nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sizeofNdMsg = 12
+	ndaDst      = 1
+	ndaLLAddr   = 2
+
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+	nudNoARP      = 0x40
+)
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// Supported reports whether the neighbor table is supported on this
+// platform.
+func Supported() bool {
+	return true
+}
+
+// loadTable dumps the neighbor table with a rtnetlink RTM_GETNEIGH
+// request.
+func loadTable() (map[netip.Addr]net.HardwareAddr, error) {
+	b, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[netip.Addr]net.HardwareAddr)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < sizeofNdMsg {
+			continue
+		}
+		state := nativeEndian.Uint16(m.Data[8:10])
+		if state&(nudIncomplete|nudFailed|nudNoARP) != 0 {
+			continue
+		}
+		var addr netip.Addr
+		var hw net.HardwareAddr
+		for ab := m.Data[sizeofNdMsg:]; len(ab) >= 4; {
+			l := int(nativeEndian.Uint16(ab[0:2]))
+			typ := nativeEndian.Uint16(ab[2:4])
+			if l < 4 || l > len(ab) {
+				break
+			}
+			v := ab[4:l]
+			switch typ {
+			case ndaDst:
+				addr, _ = netip.AddrFromSlice(v)
+			case ndaLLAddr:
+				hw = append(net.HardwareAddr(nil), v...)
+			}
+			l = (l + 3) &^ 3
+			if l > len(ab) {
+				break
+			}
+			ab = ab[l:]
+		}
+		if addr.IsValid() && len(hw) > 0 {
+			entries[addr.Unmap()] = hw
+		}
+	}
+	return entries, nil
+}
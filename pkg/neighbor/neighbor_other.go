@@ -0,0 +1,37 @@
+//go:build !linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Supported reports whether the neighbor table is supported on this
+// platform.
+func Supported() bool {
+	return false
+}
+
+func loadTable() (map[netip.Addr]net.HardwareAddr, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTable_Lookup(t *testing.T) {
+	hw, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	loads := 0
+	tb := NewTable(time.Hour)
+	tb.load = func() (map[netip.Addr]net.HardwareAddr, error) {
+		loads++
+		return map[netip.Addr]net.HardwareAddr{netip.MustParseAddr("192.168.1.2"): hw}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := tb.Lookup(netip.MustParseAddr("::ffff:192.168.1.2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != hw.String() {
+			t.Fatalf("want %s, got %s", hw, got)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("want 1 load, got %d", loads)
+	}
+
+	// Misses do not reload the table too often.
+	got, err := tb.Lookup(netip.MustParseAddr("192.168.1.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil || loads != 1 {
+		t.Fatalf("unexpected lookup result %s, loads %d", got, loads)
+	}
+	tb.updatedAt = time.Now().Add(-minMissRefreshInterval)
+	if _, err := tb.Lookup(netip.MustParseAddr("192.168.1.3")); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 {
+		t.Fatalf("want 2 loads, got %d", loads)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package net_watcher
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = time.Second * 5
+)
+
+// Some public addresses that are used to find out the source addresses of
+// the default routes. No packet will be sent to them.
+var defaultRouteProbeAddrs = [...]string{"8.8.8.8:53", "[2001:4860:4860::8888]:53"}
+
+// Opts for Watcher.
+type Opts struct {
+	// Interval specifies the polling interval. Default is 5s.
+	Interval time.Duration
+
+	// OnChange will be called in the Watcher's goroutine when the network
+	// is changed. Required.
+	OnChange func(old, new Snapshot)
+}
+
+// Snapshot is a summary of the network state.
+// Two snapshots are equal if the network is not changed.
+type Snapshot struct {
+	// Interfaces contains "name|addr" of all up interfaces, sorted.
+	Interfaces []string
+	// DefaultRoutes contains the source addresses of the default routes.
+	DefaultRoutes []string
+}
+
+// Equal returns true if s and o are equal.
+func (s Snapshot) Equal(o Snapshot) bool {
+	return strSliceEqual(s.Interfaces, o.Interfaces) && strSliceEqual(s.DefaultRoutes, o.DefaultRoutes)
+}
+
+func (s Snapshot) String() string {
+	return "interfaces: [" + strings.Join(s.Interfaces, ", ") + "], default routes: [" + strings.Join(s.DefaultRoutes, ", ") + "]"
+}
+
+func strSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TakeSnapshot returns the current network state.
+func TakeSnapshot() (Snapshot, error) {
+	var s Snapshot
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return s, err
+	}
+	for _, i := range ifs {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			return s, err
+		}
+		for _, addr := range addrs {
+			s.Interfaces = append(s.Interfaces, i.Name+"|"+addr.String())
+		}
+	}
+	sort.Strings(s.Interfaces)
+
+	for _, probeAddr := range defaultRouteProbeAddrs {
+		// Dialing udp won't send any packet. It only asks the kernel
+		// for a route.
+		c, err := net.Dial("udp", probeAddr)
+		if err != nil { // no route
+			continue
+		}
+		s.DefaultRoutes = append(s.DefaultRoutes, c.LocalAddr().(*net.UDPAddr).IP.String())
+		c.Close()
+	}
+	return s, nil
+}
+
+// Watcher polls the network state and calls Opts.OnChange when the
+// interfaces or the default routes are changed.
+type Watcher struct {
+	opts Opts
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewWatcher takes the first snapshot and starts the watcher.
+func NewWatcher(opts Opts) (*Watcher, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	s, err := TakeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		opts:        opts,
+		closeNotify: make(chan struct{}),
+	}
+	go w.loop(s)
+	return w, nil
+}
+
+func (w *Watcher) loop(last Snapshot) {
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.closeNotify:
+			return
+		case <-ticker.C:
+			s, err := TakeSnapshot()
+			if err != nil {
+				continue
+			}
+			if !s.Equal(last) {
+				w.opts.OnChange(last, s)
+				last = s
+			}
+		}
+	}
+}
+
+// Close stops the Watcher. It always returns a nil error.
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closeNotify)
+	})
+	return nil
+}
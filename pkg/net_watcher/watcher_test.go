@@ -0,0 +1,43 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package net_watcher
+
+import (
+	"testing"
+)
+
+func TestSnapshot_Equal(t *testing.T) {
+	s, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Equal(s2) {
+		t.Fatalf("snapshots should be equal, %s, %s", s, s2)
+	}
+
+	s3 := Snapshot{Interfaces: append([]string{"test|127.0.0.1/8"}, s.Interfaces...), DefaultRoutes: s.DefaultRoutes}
+	if s.Equal(s3) {
+		t.Fatal("snapshots should not be equal")
+	}
+}
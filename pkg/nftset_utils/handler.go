@@ -84,11 +84,32 @@ func (h *NftSetHandler) getSet() (*nftables.Set, error) {
 
 // AddElems adds SetIPElem(s) to set in a single batch.
 func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
+	return h.UpdateElems(es, nil)
+}
+
+// UpdateElems deletes del and then adds add to the set in a single batch.
+// The batch is applied atomically by the kernel, so overlapped intervals
+// can be replaced without a gap.
+func (h *NftSetHandler) UpdateElems(add, del []netip.Prefix) error {
 	set, err := h.getSet()
 	if err != nil {
 		return fmt.Errorf("failed to get set, %w", err)
 	}
 
+	if len(del) > 0 {
+		if err := h.opts.Conn.SetDeleteElements(set, toSetElements(set, del)); err != nil {
+			return err
+		}
+	}
+	if len(add) > 0 {
+		if err := h.opts.Conn.SetAddElements(set, toSetElements(set, add)); err != nil {
+			return err
+		}
+	}
+	return h.opts.Conn.Flush()
+}
+
+func toSetElements(set *nftables.Set, es []netip.Prefix) []nftables.SetElement {
 	var elems []nftables.SetElement
 	if set.Interval {
 		elems = make([]nftables.SetElement, 0, 2*len(es))
@@ -110,10 +131,5 @@ func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
 			elems = append(elems, nftables.SetElement{Key: e.Addr().AsSlice()})
 		}
 	}
-
-	err = h.opts.Conn.SetAddElements(set, elems)
-	if err != nil {
-		return err
-	}
-	return h.opts.Conn.Flush()
+	return elems
 }
@@ -0,0 +1,289 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package perf_stats
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats accumulates query statistics and summarizes them in the same
+// format as dnsperf/resperf, so the results can be compared with other
+// resolvers directly. It is safe for concurrent use.
+type Stats struct {
+	mu  sync.Mutex
+	now func() time.Time // for testing
+
+	start time.Time
+	end   time.Time // zero if not stopped
+
+	sent      uint64
+	completed uint64
+	reqBytes  uint64
+	respBytes uint64
+	rcodes    map[int]uint64
+
+	latencySum   float64 // in seconds
+	latencySumSq float64
+	latencyMin   time.Duration
+	latencyMax   time.Duration
+
+	// Throughput of the current second and the best second so far,
+	// for resperf's "Maximum throughput".
+	curSec       int64
+	curSent      uint64
+	curCompleted uint64
+	maxCompleted uint64
+	maxSent      uint64
+}
+
+// NewStats returns a *Stats that starts counting from now.
+func NewStats() *Stats {
+	s := &Stats{now: time.Now}
+	s.Reset()
+	return s
+}
+
+// Reset clears all counters and restarts the clock.
+func (s *Stats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start, s.end = s.now(), time.Time{}
+	s.sent, s.completed, s.reqBytes, s.respBytes = 0, 0, 0, 0
+	s.rcodes = make(map[int]uint64)
+	s.latencySum, s.latencySumSq, s.latencyMin, s.latencyMax = 0, 0, 0, 0
+	s.curSec, s.curSent, s.curCompleted, s.maxCompleted, s.maxSent = 0, 0, 0, 0, 0
+}
+
+// Stop stops the clock. Run time in later summaries ends at the time
+// Stop was called.
+func (s *Stats) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.end = s.now()
+	}
+}
+
+// Sent records a query of size bytes.
+func (s *Stats) Sent(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	s.reqBytes += uint64(size)
+	s.rollSecond()
+	s.curSent++
+}
+
+// Completed records a response of size bytes that took latency to arrive.
+func (s *Stats) Completed(rcode int, size int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed++
+	s.respBytes += uint64(size)
+	s.rcodes[rcode]++
+
+	sec := latency.Seconds()
+	s.latencySum += sec
+	s.latencySumSq += sec * sec
+	if s.completed == 1 || latency < s.latencyMin {
+		s.latencyMin = latency
+	}
+	if latency > s.latencyMax {
+		s.latencyMax = latency
+	}
+
+	s.rollSecond()
+	s.curCompleted++
+}
+
+// rollSecond starts a new per-second bucket if the clock moved
+// to the next second. Caller must hold the lock.
+func (s *Stats) rollSecond() {
+	sec := int64(s.now().Sub(s.start) / time.Second)
+	if sec == s.curSec {
+		return
+	}
+	s.commitSecond()
+	s.curSec = sec
+	s.curSent = 0
+	s.curCompleted = 0
+}
+
+func (s *Stats) commitSecond() {
+	if s.curCompleted > s.maxCompleted {
+		s.maxCompleted = s.curCompleted
+		s.maxSent = s.curSent
+	}
+}
+
+// Summary is a snapshot of Stats.
+type Summary struct {
+	Sent          uint64
+	Completed     uint64
+	Rcodes        map[int]uint64
+	AvgReqSize    uint64
+	AvgRespSize   uint64
+	RunTime       time.Duration
+	LatencyAvg    time.Duration
+	LatencyMin    time.Duration
+	LatencyMax    time.Duration
+	LatencyStdDev time.Duration
+
+	// MaxThroughput is the largest number of responses completed within
+	// a second. LostAtMax is the percentage of queries that were lost in
+	// that second.
+	MaxThroughput float64
+	LostAtMax     float64
+}
+
+// Summary returns a snapshot of current statistics.
+func (s *Stats) Summary() *Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := s.end
+	if end.IsZero() {
+		end = s.now()
+	}
+	sum := &Summary{
+		Sent:       s.sent,
+		Completed:  s.completed,
+		Rcodes:     make(map[int]uint64, len(s.rcodes)),
+		RunTime:    end.Sub(s.start),
+		LatencyMin: s.latencyMin,
+		LatencyMax: s.latencyMax,
+	}
+	for rcode, n := range s.rcodes {
+		sum.Rcodes[rcode] = n
+	}
+	if s.sent > 0 {
+		sum.AvgReqSize = s.reqBytes / s.sent
+	}
+	if s.completed > 0 {
+		n := float64(s.completed)
+		sum.AvgRespSize = s.respBytes / s.completed
+		sum.LatencyAvg = secToDuration(s.latencySum / n)
+		if s.completed > 1 {
+			v := (s.latencySumSq - s.latencySum*s.latencySum/n) / (n - 1)
+			sum.LatencyStdDev = secToDuration(math.Sqrt(math.Max(v, 0)))
+		}
+	}
+
+	maxCompleted, maxSent := s.maxCompleted, s.maxSent
+	if s.curCompleted > maxCompleted {
+		maxCompleted, maxSent = s.curCompleted, s.curSent
+	}
+	sum.MaxThroughput = float64(maxCompleted)
+	if maxSent > maxCompleted {
+		sum.LostAtMax = percent(maxSent-maxCompleted, maxSent)
+	}
+	return sum
+}
+
+// Lost returns the number of queries that have no response.
+func (sum *Summary) Lost() uint64 {
+	if sum.Completed > sum.Sent {
+		return 0
+	}
+	return sum.Sent - sum.Completed
+}
+
+// QPS returns the average number of completed queries per second.
+func (sum *Summary) QPS() float64 {
+	if sum.RunTime <= 0 {
+		return 0
+	}
+	return float64(sum.Completed) / sum.RunTime.Seconds()
+}
+
+// WriteDnsperf writes the summary in the same format as dnsperf.
+func (sum *Summary) WriteDnsperf(w io.Writer) error {
+	b := new(strings.Builder)
+	b.WriteString("Statistics:\n\n")
+	fmt.Fprintf(b, "  Queries sent:         %d\n", sum.Sent)
+	fmt.Fprintf(b, "  Queries completed:    %d (%.2f%%)\n", sum.Completed, percent(sum.Completed, sum.Sent))
+	fmt.Fprintf(b, "  Queries lost:         %d (%.2f%%)\n", sum.Lost(), percent(sum.Lost(), sum.Sent))
+	b.WriteString("\n")
+	fmt.Fprintf(b, "  Response codes:       %s\n", sum.rcodeString())
+	fmt.Fprintf(b, "  Average packet size:  request %d, response %d\n", sum.AvgReqSize, sum.AvgRespSize)
+	fmt.Fprintf(b, "  Run time (s):         %.6f\n", sum.RunTime.Seconds())
+	fmt.Fprintf(b, "  Queries per second:   %.6f\n", sum.QPS())
+	b.WriteString("\n")
+	fmt.Fprintf(b, "  Average Latency (s):  %.6f (min %.6f, max %.6f)\n",
+		sum.LatencyAvg.Seconds(), sum.LatencyMin.Seconds(), sum.LatencyMax.Seconds())
+	fmt.Fprintf(b, "  Latency StdDev (s):   %.6f\n", sum.LatencyStdDev.Seconds())
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteResperf writes the summary in the same format as resperf.
+func (sum *Summary) WriteResperf(w io.Writer) error {
+	b := new(strings.Builder)
+	b.WriteString("Statistics:\n\n")
+	fmt.Fprintf(b, "  Queries sent:         %d\n", sum.Sent)
+	fmt.Fprintf(b, "  Queries completed:    %d\n", sum.Completed)
+	fmt.Fprintf(b, "  Queries lost:         %d\n", sum.Lost())
+	fmt.Fprintf(b, "  Response codes:       %s\n", sum.rcodeString())
+	fmt.Fprintf(b, "  Reconnection(s):      %d\n", 0)
+	fmt.Fprintf(b, "  Run time (s):         %.6f\n", sum.RunTime.Seconds())
+	fmt.Fprintf(b, "  Maximum throughput:   %.6f qps\n", sum.MaxThroughput)
+	fmt.Fprintf(b, "  Lost at that point:   %.2f%%\n", sum.LostAtMax)
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (sum *Summary) rcodeString() string {
+	rcodes := make([]int, 0, len(sum.Rcodes))
+	for rcode := range sum.Rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Ints(rcodes)
+
+	ss := make([]string, 0, len(rcodes))
+	for _, rcode := range rcodes {
+		name, ok := dns.RcodeToString[rcode]
+		if !ok {
+			name = fmt.Sprintf("RCODE%d", rcode)
+		}
+		n := sum.Rcodes[rcode]
+		ss = append(ss, fmt.Sprintf("%s %d (%.2f%%)", name, n, percent(n, sum.Completed)))
+	}
+	return strings.Join(ss, ", ")
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func secToDuration(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package perf_stats
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := &Stats{now: func() time.Time { return now }}
+	s.Reset()
+
+	// second 0: 3 sent, 2 completed
+	for i := 0; i < 3; i++ {
+		s.Sent(30)
+	}
+	s.Completed(dns.RcodeSuccess, 100, time.Millisecond)
+	s.Completed(dns.RcodeNameError, 50, time.Millisecond*3)
+
+	// second 1: 1 sent, 1 completed
+	now = now.Add(time.Second)
+	s.Sent(30)
+	s.Completed(dns.RcodeSuccess, 90, time.Millisecond*2)
+
+	now = now.Add(time.Second)
+	s.Stop()
+	now = now.Add(time.Second) // should be ignored
+
+	sum := s.Summary()
+	if sum.Sent != 4 || sum.Completed != 3 || sum.Lost() != 1 {
+		t.Fatalf("unexpected counters, %+v", sum)
+	}
+	if sum.AvgReqSize != 30 || sum.AvgRespSize != 80 {
+		t.Fatalf("unexpected packet sizes, %+v", sum)
+	}
+	if sum.RunTime != time.Second*2 || sum.QPS() != 1.5 {
+		t.Fatalf("unexpected run time, %+v", sum)
+	}
+	if sum.LatencyAvg != time.Millisecond*2 || sum.LatencyMin != time.Millisecond || sum.LatencyMax != time.Millisecond*3 {
+		t.Fatalf("unexpected latency, %+v", sum)
+	}
+	if d := sum.LatencyStdDev - time.Millisecond; d > time.Microsecond || d < -time.Microsecond {
+		t.Fatalf("unexpected latency stddev, %s", sum.LatencyStdDev)
+	}
+	if sum.MaxThroughput != 2 || sum.LostAtMax < 33.3 || sum.LostAtMax > 33.4 {
+		t.Fatalf("unexpected max throughput, %+v", sum)
+	}
+
+	b := new(bytes.Buffer)
+	if err := sum.WriteDnsperf(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"  Queries completed:    3 (75.00%)\n",
+		"  Response codes:       NOERROR 2 (66.67%), NXDOMAIN 1 (33.33%)\n",
+		"  Queries per second:   1.500000\n",
+		"  Average Latency (s):  0.002000 (min 0.001000, max 0.003000)\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("dnsperf output missing %q, got:\n%s", want, b.String())
+		}
+	}
+
+	b.Reset()
+	if err := sum.WriteResperf(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"  Maximum throughput:   2.000000 qps\n",
+		"  Lost at that point:   33.33%\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("resperf output missing %q, got:\n%s", want, b.String())
+		}
+	}
+
+	s.Reset()
+	if sum := s.Summary(); sum.Sent != 0 || sum.Completed != 0 || len(sum.Rcodes) != 0 {
+		t.Fatalf("stats not reset, %+v", sum)
+	}
+}
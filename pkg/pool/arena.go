@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package pool
+
+import (
+	"reflect"
+	"sync"
+)
+
+const (
+	arenaSlabSize = 64 // elements of a slab
+	arenaMaxSlabs = 4  // slab types of an Arena
+)
+
+// slabPools maps reflect.Type of *T to a *sync.Pool of *slab[T].
+var slabPools sync.Map
+
+// Arena allocates short-lived objects of a query, e.g. match scratch
+// space, from pooled slabs. Release returns the slabs to their pools,
+// so these objects don't produce garbage for the GC.
+// An Arena has up to arenaMaxSlabs slabs of different types, and each
+// slab has arenaSlabSize elements. Allocations beyond them fall back to
+// the heap.
+// The zero value is ready to use. Arena is not safe for concurrent use.
+// Memory from an Arena must not be used after Release.
+type Arena struct {
+	slabs [arenaMaxSlabs]releaser
+	n     int
+}
+
+type releaser interface {
+	release()
+}
+
+// AllocSlice returns a []T from a with length n. Elements are zero
+// values. Appending to it beyond n allocates a new array from the heap.
+func AllocSlice[T any](a *Arena, n int) []T {
+	if n <= 0 {
+		return nil
+	}
+	var s *slab[T]
+	for _, r := range a.slabs[:a.n] {
+		if ts, ok := r.(*slab[T]); ok {
+			s = ts
+			break
+		}
+	}
+	if s == nil {
+		if a.n == arenaMaxSlabs {
+			return make([]T, n)
+		}
+		s = getSlab[T]()
+		a.slabs[a.n] = s
+		a.n++
+	}
+	if s.off+n > len(s.buf) {
+		return make([]T, n)
+	}
+	b := s.buf[s.off : s.off+n : s.off+n]
+	s.off += n
+	return b
+}
+
+// Release returns all slabs to their pools. The Arena can be reused
+// after Release.
+func (a *Arena) Release() {
+	for i, r := range a.slabs[:a.n] {
+		r.release()
+		a.slabs[i] = nil
+	}
+	a.n = 0
+}
+
+type slab[T any] struct {
+	p   *sync.Pool
+	buf []T
+	off int // used elements of buf
+}
+
+func getSlab[T any]() *slab[T] {
+	typ := reflect.TypeOf((*T)(nil))
+	p, ok := slabPools.Load(typ)
+	if !ok {
+		np := new(sync.Pool)
+		np.New = func() interface{} {
+			return &slab[T]{p: np, buf: make([]T, arenaSlabSize)}
+		}
+		p, _ = slabPools.LoadOrStore(typ, np)
+	}
+	return p.(*sync.Pool).Get().(*slab[T])
+}
+
+func (s *slab[T]) release() {
+	// Clear references, so objects can be collected, and slices from
+	// AllocSlice have zero elements.
+	var zero T
+	for i := range s.buf[:s.off] {
+		s.buf[i] = zero
+	}
+	s.off = 0
+	s.p.Put(s)
+}
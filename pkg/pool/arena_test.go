@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package pool
+
+import (
+	"testing"
+)
+
+func TestArena(t *testing.T) {
+	a := new(Arena)
+	if s := AllocSlice[int](a, 0); s != nil {
+		t.Fatal("want nil for n == 0")
+	}
+
+	s1 := AllocSlice[*int](a, 3)
+	s2 := AllocSlice[*int](a, 2)
+	if len(s1) != 3 || cap(s1) != 3 || len(s2) != 2 {
+		t.Fatalf("unexpected len or cap, %d %d %d", len(s1), cap(s1), len(s2))
+	}
+	v := 1
+	s1[2] = &v
+	if s2[0] != nil {
+		t.Fatal("slices overlap")
+	}
+	if big := AllocSlice[*int](a, arenaSlabSize); len(big) != arenaSlabSize {
+		t.Fatal("heap fallback failed")
+	}
+
+	// More types than slabs fall back to the heap.
+	AllocSlice[int8](a, 1)
+	AllocSlice[int16](a, 1)
+	AllocSlice[int32](a, 1)
+	if s := AllocSlice[int64](a, 1); len(s) != 1 || a.n != arenaMaxSlabs {
+		t.Fatalf("unexpected slabs %d", a.n)
+	}
+
+	a.Release()
+	if a.n != 0 {
+		t.Fatal("slabs are not released")
+	}
+	if s1[2] != nil {
+		t.Fatal("released memory is not cleared")
+	}
+}
+
+func TestArena_allocs(t *testing.T) {
+	a := new(Arena)
+	allocs := testing.AllocsPerRun(100, func() {
+		s := AllocSlice[*int](a, 8)
+		s[0] = new(int) // escapes, 1 alloc.
+		AllocSlice[[2]uintptr](a, 4)
+		a.Release()
+	})
+	if allocs > 1 {
+		t.Fatalf("want at most 1 alloc, got %v", allocs)
+	}
+}
+
+func BenchmarkArena_AllocSlice(b *testing.B) {
+	a := new(Arena)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		AllocSlice[*int](a, 4)
+		a.Release()
+	}
+}
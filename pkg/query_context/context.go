@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"net/netip"
@@ -37,8 +38,27 @@ type RequestMeta struct {
 	// It might be zero/invalid.
 	ClientAddr netip.Addr
 
+	// ClientPort is the source port of the client. It is zero if unknown,
+	// e.g. ClientAddr was read from a http header.
+	ClientPort uint16
+
 	// FromUDP indicates the request is from an udp socket.
 	FromUDP bool
+
+	// OriginalDst is the original destination of a request that was
+	// intercepted by a transparent proxy (TPROXY, REDIRECT) listener.
+	// It is invalid if the request was not intercepted.
+	OriginalDst netip.AddrPort
+
+	// Protocol is the transport of the request, one of "udp", "tcp",
+	// "tls", "http", "https", "h3", "dnscrypt", "unix" and "unixgram".
+	// It might be empty. ClientAddr is invalid for unix sockets.
+	Protocol string
+
+	// ServerName is the tls server name (SNI) sent by the client.
+	// It is empty if the request is not from a tls connection or
+	// the client did not send one.
+	ServerName string
 }
 
 // Context is a query context that pass through plugins
@@ -55,6 +75,14 @@ type Context struct {
 
 	r     *dns.Msg
 	marks map[uint]struct{}
+
+	encryptedOnly bool
+	upstream      string
+	cacheHit      bool
+
+	trace *trace // nil if tracing is disabled
+
+	arena pool.Arena // not copied.
 }
 
 var contextUid uint32
@@ -173,9 +201,121 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 	for m := range ctx.marks {
 		d.AddMark(m)
 	}
+	d.encryptedOnly = ctx.encryptedOnly
+	d.upstream = ctx.upstream
+	d.cacheHit = ctx.cacheHit
+	d.trace = ctx.trace // copies append to the same trace
 	return d
 }
 
+// Arena returns the memory arena of this Context for short-lived objects
+// of the query, e.g. match scratch space. Memory from the Arena must not
+// be kept after the query, nor be referenced by the response, because it
+// is released by ReleaseArena once the query is done. Copies of this
+// Context have their own Arena.
+func (ctx *Context) Arena() *pool.Arena {
+	return &ctx.arena
+}
+
+// ReleaseArena releases the memory of the Arena. It should only be called
+// by the owner of this Context (e.g. the server handler) after the query
+// is done.
+func (ctx *Context) ReleaseArena() {
+	ctx.arena.Release()
+}
+
+// SetEncryptedOnly sets whether the query must only be forwarded to
+// encrypted upstreams. Forwarders fail the query instead of sending it
+// over plaintext.
+func (ctx *Context) SetEncryptedOnly(b bool) {
+	ctx.encryptedOnly = b
+}
+
+// EncryptedOnly reports whether the query must only be forwarded to
+// encrypted upstreams.
+func (ctx *Context) EncryptedOnly() bool {
+	return ctx.encryptedOnly
+}
+
+// SetUpstream records the address of the upstream that the response
+// was received from.
+func (ctx *Context) SetUpstream(addr string) {
+	ctx.upstream = addr
+}
+
+// Upstream returns the address of the upstream that the response was
+// received from. It is empty if the response was not from an upstream.
+func (ctx *Context) Upstream() string {
+	return ctx.upstream
+}
+
+// SetCacheHit sets whether the response was served from a cache.
+func (ctx *Context) SetCacheHit(b bool) {
+	ctx.cacheHit = b
+}
+
+// CacheHit reports whether the response was served from a cache.
+func (ctx *Context) CacheHit() bool {
+	return ctx.cacheHit
+}
+
+// TraceEvent is an event in the trace of a query.
+type TraceEvent struct {
+	Elapsed time.Duration // since the Context was created
+	Plugin  string
+	Event   string
+}
+
+func (e TraceEvent) String() string {
+	return fmt.Sprintf("%.3fms %s: %s", float64(e.Elapsed.Microseconds())/1000, e.Plugin, e.Event)
+}
+
+// trace is shared by a Context and its copies, which may be used
+// concurrently.
+type trace struct {
+	m      sync.Mutex
+	events []TraceEvent
+}
+
+// EnableTrace enables tracing of this Context and its future copies.
+// Plugins append events by Tracef.
+func (ctx *Context) EnableTrace() {
+	if ctx.trace == nil {
+		ctx.trace = new(trace)
+	}
+}
+
+// TraceEnabled reports whether tracing is enabled.
+func (ctx *Context) TraceEnabled() bool {
+	return ctx.trace != nil
+}
+
+// Tracef appends an event of plugin to the trace. It is a noop if
+// tracing is disabled, callers can check TraceEnabled first to avoid
+// the formatting cost.
+func (ctx *Context) Tracef(plugin, format string, args ...interface{}) {
+	t := ctx.trace
+	if t == nil {
+		return
+	}
+	e := TraceEvent{Elapsed: time.Since(ctx.startTime), Plugin: plugin, Event: fmt.Sprintf(format, args...)}
+	t.m.Lock()
+	t.events = append(t.events, e)
+	t.m.Unlock()
+}
+
+// Trace returns a copy of the trace events. It returns nil if tracing
+// is disabled.
+func (ctx *Context) Trace() []TraceEvent {
+	t := ctx.trace
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	return append([]TraceEvent(nil), t.events...)
+}
+
 // AddMark adds mark m to this Context.
 func (ctx *Context) AddMark(m uint) {
 	if ctx.marks == nil {
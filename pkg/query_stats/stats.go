@@ -0,0 +1,303 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package query_stats computes query statistics over sliding windows in
+// memory. Memory usage is bounded: counters are kept in fixed rings, and
+// at most Opts.TopCapacity domains and clients are tracked per minute.
+package query_stats
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	secRingSize = 15 * 60 // counters of the last 15 minutes
+	minRingSize = 60      // top lists and upstreams of the last hour
+
+	// MaxTopWindow is the maximum window of top lists and upstreams.
+	MaxTopWindow = minRingSize * time.Minute
+
+	maxUpstreams  = 64
+	otherUpstream = "other"
+)
+
+// Windows of the counters in Summary.
+var counterWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+type Opts struct {
+	// TopCapacity is the maximum number of domains and clients that are
+	// tracked per minute. Default is 1000.
+	TopCapacity int
+}
+
+// Query is a processed query.
+type Query struct {
+	Qname    string
+	Client   string
+	Upstream string // empty if the response was not from an upstream
+	Latency  time.Duration
+	Blocked  bool
+	CacheHit bool
+	Failed   bool // no response, or SERVFAIL
+}
+
+type counters struct {
+	Queries   uint64 `json:"queries"`
+	Blocked   uint64 `json:"blocked"`
+	CacheHits uint64 `json:"cache_hits"`
+	Failed    uint64 `json:"failed"`
+}
+
+func (c *counters) add(q *Query) {
+	c.Queries++
+	if q.Blocked {
+		c.Blocked++
+	}
+	if q.CacheHit {
+		c.CacheHits++
+	}
+	if q.Failed {
+		c.Failed++
+	}
+}
+
+func (c *counters) merge(o *counters) {
+	c.Queries += o.Queries
+	c.Blocked += o.Blocked
+	c.CacheHits += o.CacheHits
+	c.Failed += o.Failed
+}
+
+type secBucket struct {
+	sec int64
+	counters
+}
+
+type upstreamCounters struct {
+	responses  uint64
+	failed     uint64
+	latencySum time.Duration
+}
+
+type minBucket struct {
+	min       int64
+	domains   *topK
+	clients   *topK
+	upstreams map[string]*upstreamCounters
+}
+
+// Stats is safe for concurrent use.
+type Stats struct {
+	opts  Opts
+	now   func() time.Time // for testing
+	start time.Time
+
+	m     sync.Mutex
+	total counters
+	secs  [secRingSize]secBucket
+	mins  [minRingSize]minBucket
+}
+
+func New(opts Opts) *Stats {
+	utils.SetDefaultNum(&opts.TopCapacity, 1000)
+	s := &Stats{opts: opts, now: time.Now}
+	s.start = s.now()
+	return s
+}
+
+// Add adds q to s.
+func (s *Stats) Add(q *Query) {
+	now := s.now()
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.total.add(q)
+
+	sec := now.Unix()
+	sb := &s.secs[sec%secRingSize]
+	if sb.sec != sec {
+		*sb = secBucket{sec: sec}
+	}
+	sb.add(q)
+
+	min := sec / 60
+	mb := &s.mins[min%minRingSize]
+	if mb.min != min || mb.domains == nil {
+		*mb = minBucket{
+			min:       min,
+			domains:   newTopK(s.opts.TopCapacity),
+			clients:   newTopK(s.opts.TopCapacity),
+			upstreams: make(map[string]*upstreamCounters),
+		}
+	}
+	if len(q.Qname) > 0 {
+		mb.domains.add(q.Qname)
+	}
+	if len(q.Client) > 0 {
+		mb.clients.add(q.Client)
+	}
+	if len(q.Upstream) > 0 {
+		addr := q.Upstream
+		u := mb.upstreams[addr]
+		if u == nil {
+			if len(mb.upstreams) >= maxUpstreams {
+				addr = otherUpstream
+				u = mb.upstreams[addr]
+			}
+			if u == nil {
+				u = new(upstreamCounters)
+				mb.upstreams[addr] = u
+			}
+		}
+		u.responses++
+		u.latencySum += q.Latency
+		if q.Failed {
+			u.failed++
+		}
+	}
+}
+
+// WindowSummary is the summary of a window.
+type WindowSummary struct {
+	counters
+	QPS          float64 `json:"qps"`
+	BlockRate    float64 `json:"block_rate"`
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	FailureRate  float64 `json:"failure_rate"`
+}
+
+func newWindowSummary(c counters, d time.Duration) WindowSummary {
+	ws := WindowSummary{counters: c}
+	if d > 0 {
+		ws.QPS = float64(c.Queries) / d.Seconds()
+	}
+	if c.Queries > 0 {
+		ws.BlockRate = float64(c.Blocked) / float64(c.Queries)
+		ws.CacheHitRate = float64(c.CacheHits) / float64(c.Queries)
+		ws.FailureRate = float64(c.Failed) / float64(c.Queries)
+	}
+	return ws
+}
+
+// UpstreamSummary is the summary of responses from an upstream.
+type UpstreamSummary struct {
+	Addr         string  `json:"addr"`
+	Responses    uint64  `json:"responses"`
+	Failed       uint64  `json:"failed"`
+	FailureRate  float64 `json:"failure_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+type Summary struct {
+	Uptime  float64                  `json:"uptime_sec"`
+	Total   WindowSummary            `json:"total"`
+	Windows map[string]WindowSummary `json:"windows"`
+
+	// Top lists and upstreams are of the last TopWindow.
+	TopWindow  float64           `json:"top_window_sec"`
+	TopDomains []Count           `json:"top_domains"`
+	TopClients []Count           `json:"top_clients"`
+	Upstreams  []UpstreamSummary `json:"upstreams"`
+}
+
+// Summary returns the summary of s. Top lists contain at most n entries
+// and are of the last topWindow, which is rounded up to minutes and
+// capped at MaxTopWindow.
+func (s *Stats) Summary(n int, topWindow time.Duration) *Summary {
+	now := s.now()
+	if topWindow <= 0 || topWindow > MaxTopWindow {
+		topWindow = MaxTopWindow
+	}
+	topMins := int64((topWindow + time.Minute - 1) / time.Minute)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	uptime := now.Sub(s.start)
+	sum := &Summary{
+		Uptime:    uptime.Seconds(),
+		Total:     newWindowSummary(s.total, uptime),
+		Windows:   make(map[string]WindowSummary, len(counterWindows)),
+		TopWindow: (time.Duration(topMins) * time.Minute).Seconds(),
+	}
+
+	sec := now.Unix()
+	for _, w := range counterWindows {
+		var c counters
+		ws := int64(w.d / time.Second)
+		for i := range s.secs {
+			if b := &s.secs[i]; b.sec > sec-ws && b.sec <= sec {
+				c.merge(&b.counters)
+			}
+		}
+		d := w.d
+		if uptime < d {
+			d = uptime
+		}
+		sum.Windows[w.name] = newWindowSummary(c, d)
+	}
+
+	min := sec / 60
+	var domains, clients []*topK
+	upstreams := make(map[string]*upstreamCounters)
+	for i := range s.mins {
+		b := &s.mins[i]
+		if b.domains == nil || b.min <= min-topMins || b.min > min {
+			continue
+		}
+		domains = append(domains, b.domains)
+		clients = append(clients, b.clients)
+		for addr, c := range b.upstreams {
+			u := upstreams[addr]
+			if u == nil {
+				u = new(upstreamCounters)
+				upstreams[addr] = u
+			}
+			u.responses += c.responses
+			u.failed += c.failed
+			u.latencySum += c.latencySum
+		}
+	}
+	sum.TopDomains = mergeTop(domains, n)
+	sum.TopClients = mergeTop(clients, n)
+	sum.Upstreams = make([]UpstreamSummary, 0, len(upstreams))
+	for addr, u := range upstreams {
+		sum.Upstreams = append(sum.Upstreams, UpstreamSummary{
+			Addr:         addr,
+			Responses:    u.responses,
+			Failed:       u.failed,
+			FailureRate:  float64(u.failed) / float64(u.responses),
+			AvgLatencyMs: float64(u.latencySum.Microseconds()) / 1000 / float64(u.responses),
+		})
+	}
+	sort.Slice(sum.Upstreams, func(i, j int) bool {
+		return sum.Upstreams[i].Addr < sum.Upstreams[j].Addr
+	})
+	return sum
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_topK(t *testing.T) {
+	tk := newTopK(3)
+	for i := 0; i < 50; i++ {
+		tk.add("a")
+	}
+	for i := 0; i < 30; i++ {
+		tk.add("b")
+	}
+	// Rare keys share the last slot.
+	for i := 0; i < 20; i++ {
+		tk.add("rare" + strconv.Itoa(i))
+	}
+	if len(tk.m) != 3 || len(tk.heap) != 3 {
+		t.Fatalf("topK should track at most 3 keys, got %d", len(tk.m))
+	}
+	top := mergeTop([]*topK{tk}, 2)
+	if len(top) != 2 || top[0].Key != "a" || top[0].Count != 50 || top[1].Key != "b" || top[1].Count != 30 {
+		t.Fatalf("unexpected top %v", top)
+	}
+
+	tk2 := newTopK(3)
+	for i := 0; i < 25; i++ {
+		tk2.add("b")
+	}
+	top = mergeTop([]*topK{tk, tk2}, 1)
+	if len(top) != 1 || top[0].Key != "b" || top[0].Count != 55 {
+		t.Fatalf("unexpected merged top %v", top)
+	}
+}
+
+func TestStats(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := New(Opts{})
+	s.now = func() time.Time { return now }
+	s.start = now
+
+	add := func(qname, client, upstream string, blocked, failed bool) {
+		s.Add(&Query{Qname: qname, Client: client, Upstream: upstream, Latency: 10 * time.Millisecond, Blocked: blocked, Failed: failed})
+	}
+
+	// 10 minutes ago.
+	now = now.Add(10 * time.Minute)
+	add("old.", "192.0.2.9", "", false, false)
+
+	now = now.Add(10 * time.Minute)
+	add("a.", "192.0.2.1", "udp://8.8.8.8", false, false)
+	add("a.", "192.0.2.1", "udp://8.8.8.8", false, true)
+	add("ad.", "192.0.2.2", "", true, false)
+	now = now.Add(30 * time.Second)
+	add("a.", "192.0.2.2", "udp://1.1.1.1", false, false)
+
+	sum := s.Summary(10, 5*time.Minute)
+	if sum.Total.Queries != 5 {
+		t.Fatalf("want 5 queries in total, got %d", sum.Total.Queries)
+	}
+	w1 := sum.Windows["1m"]
+	if w1.Queries != 4 || w1.Blocked != 1 || w1.Failed != 1 || w1.BlockRate != 0.25 || w1.QPS != 4.0/60 {
+		t.Fatalf("unexpected 1m window %+v", w1)
+	}
+	if w15 := sum.Windows["15m"]; w15.Queries != 5 {
+		t.Fatalf("unexpected 15m window %+v", w15)
+	}
+
+	if len(sum.TopDomains) != 2 || sum.TopDomains[0] != (Count{Key: "a.", Count: 3}) {
+		t.Fatalf("unexpected top domains %v", sum.TopDomains)
+	}
+	if len(sum.TopClients) != 2 || sum.TopClients[0].Count != 2 {
+		t.Fatalf("unexpected top clients %v", sum.TopClients)
+	}
+	if len(sum.Upstreams) != 2 {
+		t.Fatalf("unexpected upstreams %v", sum.Upstreams)
+	}
+	if u := sum.Upstreams[1]; u.Addr != "udp://8.8.8.8" || u.Responses != 2 || u.FailureRate != 0.5 || u.AvgLatencyMs != 10 {
+		t.Fatalf("unexpected upstream %+v", u)
+	}
+
+	// The old query is in the top lists of the last hour.
+	if sum := s.Summary(10, 0); len(sum.TopDomains) != 3 || sum.TopWindow != 3600 {
+		t.Fatalf("unexpected top domains of the last hour %v", sum.TopDomains)
+	}
+
+	// Everything expires from the windows.
+	now = now.Add(2 * time.Hour)
+	sum = s.Summary(10, 0)
+	if sum.Windows["15m"].Queries != 0 || len(sum.TopDomains) != 0 || len(sum.Upstreams) != 0 || sum.Total.Queries != 5 {
+		t.Fatalf("unexpected summary after 2 hours %+v", sum)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// topK counts keys with the Space-Saving algorithm. It tracks at most cap
+// keys. When it is full, a new key replaces the key with the minimum count
+// and inherits its count, so counts of frequent keys are overestimated by
+// at most the minimum count.
+type topK struct {
+	cap  int
+	m    map[string]*topKEntry
+	heap topKHeap // min-heap of m by count
+}
+
+type topKEntry struct {
+	key   string
+	count uint64
+	i     int // index in heap
+}
+
+func newTopK(cap int) *topK {
+	return &topK{cap: cap, m: make(map[string]*topKEntry)}
+}
+
+func (t *topK) add(key string) {
+	if e := t.m[key]; e != nil {
+		e.count++
+		heap.Fix(&t.heap, e.i)
+		return
+	}
+	if len(t.heap) < t.cap {
+		e := &topKEntry{key: key, count: 1}
+		t.m[key] = e
+		heap.Push(&t.heap, e)
+		return
+	}
+	e := t.heap[0]
+	delete(t.m, e.key)
+	e.key = key
+	e.count++
+	t.m[key] = e
+	heap.Fix(&t.heap, 0)
+}
+
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i, h[j].i = i, j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*topKEntry)
+	e.i = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Count is a key and its count.
+type Count struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// mergeTop sums the counts of ts and returns the top n keys.
+func mergeTop(ts []*topK, n int) []Count {
+	sum := make(map[string]uint64)
+	for _, t := range ts {
+		for k, e := range t.m {
+			sum[k] += e.count
+		}
+	}
+	cs := make([]Count, 0, len(sum))
+	for k, c := range sum {
+		cs = append(cs, Count{Key: k, Count: c})
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Count != cs[j].Count {
+			return cs[i].Count > cs[j].Count
+		}
+		return cs[i].Key < cs[j].Key
+	})
+	if len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package query_tail streams live query events to subscribers, e.g. api
+// clients that watch queries for debugging.
+package query_tail
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a completed query.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Qname     string    `json:"qname"`
+	Qtype     string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	CacheHit  bool      `json:"cache_hit"`
+	Error     string    `json:"error,omitempty"`
+
+	clientAddr netip.Addr
+	rcode      int
+}
+
+// NewEvent creates an Event of qCtx, which was answered by r.
+// r can be nil if the query was dropped.
+func NewEvent(qCtx *query_context.Context, r *dns.Msg, err error) *Event {
+	e := &Event{
+		Time:       qCtx.StartTime(),
+		Protocol:   qCtx.ReqMeta().Protocol,
+		Upstream:   qCtx.Upstream(),
+		LatencyMs:  float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+		CacheHit:   qCtx.CacheHit(),
+		clientAddr: qCtx.ReqMeta().ClientAddr,
+		rcode:      -1,
+	}
+	if e.clientAddr.IsValid() {
+		e.Client = e.clientAddr.String()
+	}
+	if q := qCtx.OriginalQuery(); len(q.Question) == 1 {
+		e.Qname = q.Question[0].Name
+		e.Qtype = dnsutils.QtypeToString(q.Question[0].Qtype)
+	}
+	if r != nil {
+		e.rcode = r.Rcode
+		e.Rcode = dns.RcodeToString[r.Rcode]
+		if len(e.Rcode) == 0 {
+			e.Rcode = strconv.Itoa(r.Rcode)
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				e.Answers = append(e.Answers, rr.A.String())
+			case *dns.AAAA:
+				e.Answers = append(e.Answers, rr.AAAA.String())
+			}
+		}
+	} else {
+		e.Rcode = "NORESPONSE"
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Filter selects events. Zero fields match all events.
+type Filter struct {
+	Client netip.Prefix // client address in this prefix.
+	Domain string       // qname equals to or is a sub domain of Domain.
+	Rcode  *int         // response rcode. -1 matches queries without responses.
+}
+
+// Match reports whether e matches f.
+func (f *Filter) Match(e *Event) bool {
+	if f.Client.IsValid() && !f.Client.Contains(e.clientAddr) {
+		return false
+	}
+	if len(f.Domain) > 0 && !dns.IsSubDomain(f.Domain, e.Qname) {
+		return false
+	}
+	if f.Rcode != nil && *f.Rcode != e.rcode {
+		return false
+	}
+	return true
+}
+
+// Hub publishes events to its subscribers.
+type Hub struct {
+	n int32 // number of subscribers, for fast checks in Active.
+
+	m      sync.Mutex
+	closed bool
+	subs   map[*Subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscriber]struct{})}
+}
+
+// Active reports whether h has subscribers. Callers can check it to
+// avoid building events that nobody receives.
+func (h *Hub) Active() bool {
+	return atomic.LoadInt32(&h.n) > 0
+}
+
+// Publish sends e to subscribers whose filter matches e. It never
+// blocks, slow subscribers lose events.
+func (h *Hub) Publish(e *Event) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for s := range h.subs {
+		if !s.f.Match(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Subscribe adds a subscriber that receives events matching f. Up to size
+// events are buffered. Subscribers must be removed by Unsubscribe.
+func (h *Hub) Subscribe(f Filter, size int) *Subscriber {
+	s := &Subscriber{h: h, f: f, c: make(chan *Event, size)}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.closed {
+		close(s.c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	atomic.AddInt32(&h.n, 1)
+	return s
+}
+
+// Unsubscribe removes s from h and closes its channel. It is a noop if s
+// was removed.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.remove(s)
+}
+
+func (h *Hub) remove(s *Subscriber) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	atomic.AddInt32(&h.n, -1)
+	close(s.c)
+}
+
+// Close removes all subscribers. Subscribers that subscribe later
+// receive a closed channel.
+func (h *Hub) Close() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.remove(s)
+	}
+}
+
+// Subscriber receives events from a Hub.
+type Subscriber struct {
+	h       *Hub
+	f       Filter
+	c       chan *Event
+	dropped uint64
+}
+
+// C returns the channel of events. It is closed after the Subscriber is
+// removed from its Hub.
+func (s *Subscriber) C() <-chan *Event {
+	return s.c
+}
+
+// Dropped returns the number of events that were dropped because the
+// channel was full.
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
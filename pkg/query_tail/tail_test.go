@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_tail
+
+import (
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func newTestEvent(client, qname string, rcode int) *Event {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, dns.TypeA)
+	qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(client)})
+	if rcode < 0 {
+		return NewEvent(qCtx, nil, errors.New("dropped"))
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, rcode)
+	if rcode == dns.RcodeSuccess {
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(1, 2, 3, 4)})
+	}
+	return NewEvent(qCtx, r, nil)
+}
+
+func TestNewEvent(t *testing.T) {
+	e := newTestEvent("192.0.2.1", "example.com.", dns.RcodeSuccess)
+	if e.Client != "192.0.2.1" || e.Qname != "example.com." || e.Qtype != "A" || e.Rcode != "NOERROR" ||
+		len(e.Answers) != 1 || e.Answers[0] != "1.2.3.4" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	e = newTestEvent("192.0.2.1", "example.com.", -1)
+	if e.Rcode != "NORESPONSE" || e.Error != "dropped" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	nx, noResp := dns.RcodeNameError, -1
+	e := newTestEvent("192.0.2.1", "www.Example.com.", dns.RcodeNameError)
+	tests := []struct {
+		name string
+		f    Filter
+		want bool
+	}{
+		{"empty", Filter{}, true},
+		{"client", Filter{Client: netip.MustParsePrefix("192.0.2.0/24")}, true},
+		{"client mismatched", Filter{Client: netip.MustParsePrefix("198.51.100.0/24")}, false},
+		{"domain", Filter{Domain: "example.com."}, true},
+		{"domain equal", Filter{Domain: "www.example.com."}, true},
+		{"domain mismatched", Filter{Domain: "example.org."}, false},
+		{"rcode", Filter{Rcode: &nx}, true},
+		{"rcode mismatched", Filter{Rcode: &noResp}, false},
+		{"all", Filter{Client: netip.MustParsePrefix("192.0.2.1/32"), Domain: "com.", Rcode: &nx}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.Match(e); got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	if h.Active() {
+		t.Fatal("new hub should be inactive")
+	}
+	all := h.Subscribe(Filter{}, 1)
+	org := h.Subscribe(Filter{Domain: "example.org."}, 4)
+	if !h.Active() {
+		t.Fatal("hub should be active")
+	}
+
+	h.Publish(newTestEvent("192.0.2.1", "example.com.", 0))
+	h.Publish(newTestEvent("192.0.2.1", "example.org.", 0))
+	if e := <-all.C(); e.Qname != "example.com." {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if all.Dropped() != 1 {
+		t.Fatalf("want 1 dropped event, got %d", all.Dropped())
+	}
+	if e := <-org.C(); e.Qname != "example.org." || len(org.C()) != 0 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	h.Unsubscribe(all)
+	h.Unsubscribe(all)
+	if _, ok := <-all.C(); ok {
+		t.Fatal("channel should be closed")
+	}
+	h.Close()
+	if _, ok := <-org.C(); ok || h.Active() {
+		t.Fatal("hub should be closed")
+	}
+	if _, ok := <-h.Subscribe(Filter{}, 1).C(); ok {
+		t.Fatal("subscribing a closed hub should return a closed channel")
+	}
+}
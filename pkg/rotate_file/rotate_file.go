@@ -0,0 +1,283 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rotate_file
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	timeFormat = "20060102-150405.000"
+	gzipSuffix = ".gz"
+)
+
+var ErrClosed = errors.New("writer closed")
+
+type Opts struct {
+	// MaxSize is the size in bytes of the file at which it is rotated.
+	// Zero means no size limit.
+	MaxSize int64
+
+	// Interval rotates the file when the current time crosses a multiple
+	// of Interval (in UTC), e.g. 24h rotates at midnight UTC.
+	// Zero disables time based rotation.
+	Interval time.Duration
+
+	// MaxBackups is the maximum number of rotated files to keep. Older files
+	// are removed. Zero keeps all rotated files.
+	MaxBackups int
+
+	// Compress compresses rotated files with gzip.
+	Compress bool
+}
+
+// Writer is an io.WriteCloser that writes to a file and rotates it by
+// size and time. Rotated files are renamed to "path.<timestamp>" and,
+// if Opts.Compress is set, compressed to "path.<timestamp>.gz" in the
+// background.
+// A single Write call never spans two files.
+// Writer is safe for concurrent use.
+type Writer struct {
+	path string
+	opts Opts
+	now  func() time.Time
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	postMu sync.Mutex // serializes compression and pruning
+	postWg sync.WaitGroup
+}
+
+var _ io.WriteCloser = (*Writer)(nil)
+
+// Open opens or creates the file at path for appending.
+func Open(path string, opts Opts) (*Writer, error) {
+	w := &Writer{path: path, opts: opts, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	w.openedAt = w.now()
+	return nil
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	if w.shouldRotate(int64(len(b))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.opts.MaxSize > 0 && w.size+n > w.opts.MaxSize {
+		return true
+	}
+	if d := w.opts.Interval; d > 0 {
+		return !w.now().UTC().Truncate(d).Equal(w.openedAt.UTC().Truncate(d))
+	}
+	return false
+}
+
+// Rotate rotates the file immediately, if it is not empty.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.size == 0 {
+		return nil
+	}
+	return w.rotate()
+}
+
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	backup := w.backupName(w.now())
+	if err := os.Rename(w.path, backup); err != nil {
+		// Keep writing to the old file.
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	w.postWg.Add(1)
+	go func() {
+		defer w.postWg.Done()
+		w.postRotate(backup)
+	}()
+	return nil
+}
+
+// backupName returns an unused name for a rotated file.
+func (w *Writer) backupName(t time.Time) string {
+	name := w.path + "." + t.UTC().Format(timeFormat)
+	for i := 1; ; i++ {
+		_, err1 := os.Stat(name)
+		_, err2 := os.Stat(name + gzipSuffix)
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return name
+		}
+		name = w.path + "." + t.UTC().Add(time.Duration(i)*time.Millisecond).Format(timeFormat)
+	}
+}
+
+func (w *Writer) postRotate(backup string) {
+	w.postMu.Lock()
+	defer w.postMu.Unlock()
+	if w.opts.Compress {
+		_ = compress(backup)
+	}
+	if w.opts.MaxBackups > 0 {
+		_ = w.prune()
+	}
+}
+
+// compress compresses name to name.gz and removes name.
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+gzipSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + gzipSuffix)
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+// Backups returns rotated files of this Writer, oldest first.
+func (w *Writer) Backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(w.path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(w.path) + "."
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, prefix), gzipSuffix)
+		if _, err := time.Parse(timeFormat, ts); err != nil {
+			continue
+		}
+		names = append(names, filepath.Join(filepath.Dir(w.path), name))
+	}
+	// Timestamps have a fixed width, so the lexical order is the time order.
+	sort.Slice(names, func(i, j int) bool {
+		return strings.TrimSuffix(names[i], gzipSuffix) < strings.TrimSuffix(names[j], gzipSuffix)
+	})
+	return names, nil
+}
+
+func (w *Writer) prune() error {
+	names, err := w.Backups()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for len(names) > w.opts.MaxBackups {
+		if err := os.Remove(names[0]); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		names = names[1:]
+	}
+	return firstErr
+}
+
+// Close closes the file and waits for pending compressions.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.f.Close()
+	w.mu.Unlock()
+
+	w.postWg.Wait()
+	return err
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rotate_file
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, gzipSuffix) {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWriter_size(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "q.log")
+	w, err := Open(path, Opts{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggggggggggg\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("want ErrClosed, got %v", err)
+	}
+
+	if got := readFile(t, path); got != "gggggggggggg\n" {
+		t.Fatalf("current file: %q", got)
+	}
+	backups, err := w.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("want 2 backups, got %v", backups)
+	}
+	for i, want := range []string{"cccc\ndddd\n", "eeee\nffff\n"} {
+		if !strings.HasSuffix(backups[i], gzipSuffix) {
+			t.Fatalf("backup %s is not compressed", backups[i])
+		}
+		if got := readFile(t, backups[i]); got != want {
+			t.Fatalf("backup %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestWriter_interval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2022, 1, 1, 23, 59, 0, 0, time.UTC)
+	w := &Writer{path: path, opts: Opts{Interval: 24 * time.Hour}, now: func() time.Time { return now }}
+	if err := w.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("a\n"))
+	now = now.Add(time.Minute) // next day
+	w.Write([]byte("b\n"))
+	now = now.Add(time.Hour)
+	w.Write([]byte("c\n"))
+
+	if got := readFile(t, path); got != "b\nc\n" {
+		t.Fatalf("current file: %q", got)
+	}
+	backups, err := w.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || readFile(t, backups[0]) != "old\na\n" {
+		t.Fatalf("unexpected backups %v", backups)
+	}
+
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := w.Backups(); len(backups) != 2 {
+		t.Fatalf("want 2 backups after Rotate, got %v", backups)
+	}
+}
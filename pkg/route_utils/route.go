@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package route_utils
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mdlayher/netlink"
+	"net/netip"
+)
+
+// Constants from linux/rtnetlink.h.
+const (
+	netlinkRoute = 0 // NETLINK_ROUTE
+
+	rtmNewRoute = 24
+	rtmDelRoute = 25
+
+	rtaDst      = 1
+	rtaOIF      = 4
+	rtaGateway  = 5
+	rtaPriority = 6
+	rtaTable    = 15
+
+	rtnUnicast = 1
+
+	rtScopeUniverse = 0
+	rtScopeLink     = 253
+	rtScopeNowhere  = 255
+
+	afInet  = 2
+	afInet6 = 10
+
+	nlmFReplace = 0x100
+	nlmFCreate  = 0x400
+)
+
+// RouteProtocol is the rtm_protocol of routes that are added by Conn.
+// It is RTPROT_STATIC, so routes are shown as "proto static" by iproute2.
+const RouteProtocol = 4
+
+// Route is a unicast route.
+type Route struct {
+	Dst     netip.Prefix // Required.
+	Table   uint32       // Zero means the main table.
+	OIF     int          // Index of the output interface. Optional if Gateway is valid.
+	Gateway netip.Addr   // Optional. Must have the same family as Dst.
+	Metric  uint32
+}
+
+// Conn is a rtnetlink connection. Conn is safe for concurrent use.
+type Conn struct {
+	c *netlink.Conn
+}
+
+// Dial opens a rtnetlink connection. It requires CAP_NET_ADMIN to
+// change routes.
+func Dial() (*Conn, error) {
+	c, err := netlink.Dial(netlinkRoute, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// Replace adds r, or replaces the route that has the same
+// destination, table and metric.
+func (c *Conn) Replace(r Route) error {
+	msg, err := marshalRoute(rtmNewRoute, netlink.Request|netlink.Acknowledge|nlmFCreate|nlmFReplace, r)
+	if err != nil {
+		return err
+	}
+	if _, err := c.c.Execute(msg); err != nil {
+		return fmt.Errorf("failed to add route %s, %w", r.Dst, err)
+	}
+	return nil
+}
+
+// Del deletes r.
+func (c *Conn) Del(r Route) error {
+	msg, err := marshalRoute(rtmDelRoute, netlink.Request|netlink.Acknowledge, r)
+	if err != nil {
+		return err
+	}
+	if _, err := c.c.Execute(msg); err != nil {
+		return fmt.Errorf("failed to delete route %s, %w", r.Dst, err)
+	}
+	return nil
+}
+
+func marshalRoute(typ netlink.HeaderType, flags netlink.HeaderFlags, r Route) (netlink.Message, error) {
+	if !r.Dst.IsValid() {
+		return netlink.Message{}, errors.New("invalid route destination")
+	}
+	dst := r.Dst.Masked()
+	family := uint8(afInet)
+	if dst.Addr().Is6() {
+		family = afInet6
+	}
+	if r.Gateway.IsValid() && r.Gateway.Is4() != dst.Addr().Is4() {
+		return netlink.Message{}, fmt.Errorf("gateway %s and destination %s have different families", r.Gateway, dst)
+	}
+	if !r.Gateway.IsValid() && r.OIF == 0 {
+		return netlink.Message{}, errors.New("route has neither gateway nor output interface")
+	}
+
+	table := r.Table
+	if table == 0 {
+		table = 254 // RT_TABLE_MAIN
+	}
+	var scope uint8
+	switch {
+	case typ == rtmDelRoute:
+		scope = rtScopeNowhere // matches any scope
+	case r.Gateway.IsValid():
+		scope = rtScopeUniverse
+	default:
+		scope = rtScopeLink
+	}
+
+	// struct rtmsg
+	data := make([]byte, 12)
+	data[0] = family
+	data[1] = uint8(dst.Bits())
+	if table < 256 {
+		data[4] = uint8(table)
+	}
+	data[5] = RouteProtocol
+	data[6] = scope
+	data[7] = rtnUnicast
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(rtaDst, dst.Addr().AsSlice())
+	ae.Uint32(rtaTable, table)
+	if r.OIF > 0 {
+		ae.Uint32(rtaOIF, uint32(r.OIF))
+	}
+	if r.Gateway.IsValid() {
+		ae.Bytes(rtaGateway, r.Gateway.AsSlice())
+	}
+	if r.Metric > 0 {
+		ae.Uint32(rtaPriority, r.Metric)
+	}
+	b, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return netlink.Message{
+		Header: netlink.Header{Type: typ, Flags: flags},
+		Data:   append(data, b...),
+	}, nil
+}
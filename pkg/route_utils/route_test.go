@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package route_utils
+
+import (
+	"github.com/mdlayher/netlink"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func Test_marshalRoute(t *testing.T) {
+	r := Route{Dst: netip.MustParsePrefix("1.2.3.4/32"), Table: 1000, Gateway: netip.MustParseAddr("10.0.0.1"), Metric: 10}
+	msg, err := marshalRoute(rtmNewRoute, netlink.Request, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtm := msg.Data[:12]
+	if rtm[0] != afInet || rtm[1] != 32 || rtm[4] != 0 || rtm[6] != rtScopeUniverse {
+		t.Fatalf("unexpected rtmsg %v", rtm)
+	}
+	attrs, err := netlink.UnmarshalAttributes(msg.Data[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[uint16][]byte)
+	for _, a := range attrs {
+		got[a.Type] = a.Data
+	}
+	if netip.AddrFrom4(*(*[4]byte)(got[rtaDst])) != r.Dst.Addr() {
+		t.Fatalf("dst = %v", got[rtaDst])
+	}
+	if netip.AddrFrom4(*(*[4]byte)(got[rtaGateway])) != r.Gateway {
+		t.Fatalf("gateway = %v", got[rtaGateway])
+	}
+	if _, ok := got[rtaOIF]; ok {
+		t.Fatal("unexpected oif")
+	}
+	for typ, want := range map[uint16]uint32{rtaTable: 1000, rtaPriority: 10} {
+		ad, _ := netlink.NewAttributeDecoder(nil)
+		if v := ad.ByteOrder.Uint32(got[typ]); v != want {
+			t.Fatalf("attr %d = %d, want %d", typ, v, want)
+		}
+	}
+
+	if _, err := marshalRoute(rtmNewRoute, netlink.Request, Route{Dst: r.Dst, Gateway: netip.MustParseAddr("::1")}); err == nil {
+		t.Fatal("route with a gateway of another family should be rejected")
+	}
+	if _, err := marshalRoute(rtmNewRoute, netlink.Request, Route{Dst: r.Dst}); err == nil {
+		t.Fatal("route without gateway and oif should be rejected")
+	}
+}
+
+func Test_Conn(t *testing.T) {
+	if os.Getenv("TEST_ROUTE") == "" {
+		t.SkipNow()
+	}
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, s := range []string{"192.0.2.1/32", "2001:db8::1/128"} {
+		r := Route{Dst: netip.MustParsePrefix(s), Table: 1000, OIF: lo.Index, Metric: 10}
+		if err := c.Replace(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Replace(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Del(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Del(r); err == nil {
+			t.Fatal("deleting a deleted route should fail")
+		}
+	}
+}
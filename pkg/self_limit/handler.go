@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package self_limit
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+)
+
+// Handler is a dns_handler.Handler that sheds queries when the load
+// level of its Limiter is not LevelNormal. Shed queries get a REFUSED
+// response.
+type Handler struct {
+	next        dns_handler.Handler
+	l           *Limiter
+	lowPriority map[uint16]struct{}
+}
+
+var _ dns_handler.Handler = (*Handler)(nil)
+
+// NewHandler returns a Handler that passes allowed queries to next.
+// Queries with a qtype in lowPriorityQtypes are shed at LevelSoft.
+func NewHandler(next dns_handler.Handler, l *Limiter, lowPriorityQtypes []uint16) *Handler {
+	lp := make(map[uint16]struct{}, len(lowPriorityQtypes))
+	for _, qt := range lowPriorityQtypes {
+		lp[qt] = struct{}{}
+	}
+	return &Handler{next: next, l: l, lowPriority: lp}
+}
+
+func (h *Handler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	if h.l.AllowQuery(h.isLowPriority(req)) {
+		return h.next.ServeDNS(ctx, req, meta)
+	}
+	r := new(dns.Msg)
+	r.SetRcode(req, dns.RcodeRefused)
+	return r, nil
+}
+
+func (h *Handler) isLowPriority(req *dns.Msg) bool {
+	for _, q := range req.Question {
+		if _, ok := h.lowPriority[q.Qtype]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package self_limit
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"go.uber.org/zap"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Level is the load level of the process.
+type Level int32
+
+const (
+	// LevelNormal means all resources are below the soft limits.
+	LevelNormal Level = iota
+	// LevelSoft means at least one resource exceeds its soft limit. New tcp
+	// connections are refused and low-priority queries are shed.
+	LevelSoft
+	// LevelHard means at least one resource reaches its limit. All queries
+	// are shed.
+	LevelHard
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelNormal:
+		return "normal"
+	case LevelSoft:
+		return "soft"
+	case LevelHard:
+		return "hard"
+	default:
+		return fmt.Sprintf("level%d", int32(l))
+	}
+}
+
+const (
+	defaultFDHeadroom    = 64
+	defaultSoftRatio     = 0.8
+	defaultCheckInterval = time.Second
+)
+
+type Opts struct {
+	// MaxGoroutines is the maximum number of goroutines. Zero disables
+	// the goroutine check.
+	MaxGoroutines int
+
+	// MaxFDs is the maximum number of open file descriptors. Zero disables
+	// the fd check. The effective limit is also capped at RLIMIT_NOFILE
+	// minus FDHeadroom. The fd check is only supported on linux.
+	MaxFDs int
+
+	// FDHeadroom is the number of fds that are always kept free below
+	// RLIMIT_NOFILE. Default is 64.
+	FDHeadroom int
+
+	// SoftRatio is the fraction of a limit at which the load level becomes
+	// LevelSoft. It should be in (0, 1]. Default is 0.8.
+	SoftRatio float64
+
+	// CheckInterval is the interval of resource usage checks. Default is 1s.
+	CheckInterval time.Duration
+
+	// Logger logs load level changes. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+func (opts *Opts) Init() error {
+	if opts.MaxGoroutines < 0 || opts.MaxFDs < 0 || opts.FDHeadroom < 0 {
+		return errors.New("negative limit")
+	}
+	if opts.SoftRatio < 0 || opts.SoftRatio > 1 {
+		return fmt.Errorf("invalid soft ratio %f, should be 0~1", opts.SoftRatio)
+	}
+	utils.SetDefaultNum(&opts.FDHeadroom, defaultFDHeadroom)
+	utils.SetDefaultNum(&opts.SoftRatio, defaultSoftRatio)
+	utils.SetDefaultNum(&opts.CheckInterval, defaultCheckInterval)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return nil
+}
+
+// Limiter periodically samples the number of goroutines and open fds
+// of the process and reports a load Level, so servers can degrade
+// gracefully before the process hits its ulimits.
+type Limiter struct {
+	opts    Opts
+	fdLimit int // zero if fd check is disabled.
+
+	level        int32 // Level
+	goroutines   int64
+	fds          int64
+	refusedConns uint64
+	shedQueries  uint64
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewLimiter creates a Limiter and starts its check loop. Limiter
+// must be closed by Close.
+func NewLimiter(opts Opts) (*Limiter, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	l := &Limiter{
+		opts:        opts,
+		closeNotify: make(chan struct{}),
+	}
+
+	if opts.MaxFDs > 0 {
+		l.fdLimit = opts.MaxFDs
+		rlimit, err := getFDRlimit()
+		if err != nil {
+			return nil, fmt.Errorf("fd limit is unavailable, %w", err)
+		}
+		if max := rlimit - opts.FDHeadroom; max < l.fdLimit {
+			if max <= 0 {
+				return nil, fmt.Errorf("RLIMIT_NOFILE %d is smaller than the fd headroom %d", rlimit, opts.FDHeadroom)
+			}
+			opts.Logger.Warn(
+				"max_fds exceeds RLIMIT_NOFILE minus headroom, using the lower limit",
+				zap.Int("max_fds", opts.MaxFDs),
+				zap.Int("rlimit", rlimit),
+				zap.Int("limit", max),
+			)
+			l.fdLimit = max
+		}
+	}
+
+	l.Check()
+	go l.checkLoop()
+	return l, nil
+}
+
+func (l *Limiter) checkLoop() {
+	ticker := time.NewTicker(l.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Check()
+		case <-l.closeNotify:
+			return
+		}
+	}
+}
+
+// Check samples the resource usage and updates the load level.
+func (l *Limiter) Check() {
+	goroutines := runtime.NumGoroutine()
+	atomic.StoreInt64(&l.goroutines, int64(goroutines))
+	level := l.levelOf(goroutines, l.opts.MaxGoroutines)
+
+	if l.fdLimit > 0 {
+		fds, err := countOpenFDs()
+		if err != nil {
+			l.opts.Logger.Warn("failed to count open fds", zap.Error(err))
+		} else {
+			atomic.StoreInt64(&l.fds, int64(fds))
+			if fl := l.levelOf(fds, l.fdLimit); fl > level {
+				level = fl
+			}
+		}
+	}
+
+	old := Level(atomic.SwapInt32(&l.level, int32(level)))
+	if old == level {
+		return
+	}
+	fields := []zap.Field{
+		zap.Stringer("level", level),
+		zap.Int("goroutines", goroutines),
+		zap.Int("max_goroutines", l.opts.MaxGoroutines),
+		zap.Int64("fds", atomic.LoadInt64(&l.fds)),
+		zap.Int("max_fds", l.fdLimit),
+	}
+	if level > old {
+		l.opts.Logger.Warn("resource usage is high, start shedding load", fields...)
+	} else {
+		l.opts.Logger.Info("resource usage decreased", fields...)
+	}
+}
+
+func (l *Limiter) levelOf(used, limit int) Level {
+	switch {
+	case limit <= 0:
+		return LevelNormal
+	case used >= limit:
+		return LevelHard
+	case float64(used) >= float64(limit)*l.opts.SoftRatio:
+		return LevelSoft
+	default:
+		return LevelNormal
+	}
+}
+
+// Level returns the load level of the last check.
+func (l *Limiter) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// AllowConn reports whether a new connection can be accepted.
+func (l *Limiter) AllowConn() bool {
+	if l.Level() == LevelNormal {
+		return true
+	}
+	atomic.AddUint64(&l.refusedConns, 1)
+	return false
+}
+
+// AllowQuery reports whether a query can be handled.
+func (l *Limiter) AllowQuery(lowPriority bool) bool {
+	switch l.Level() {
+	case LevelNormal:
+		return true
+	case LevelSoft:
+		if !lowPriority {
+			return true
+		}
+	}
+	atomic.AddUint64(&l.shedQueries, 1)
+	return false
+}
+
+// Goroutines returns the number of goroutines of the last check.
+func (l *Limiter) Goroutines() int {
+	return int(atomic.LoadInt64(&l.goroutines))
+}
+
+// MaxGoroutines returns the goroutine limit. Zero means no limit.
+func (l *Limiter) MaxGoroutines() int {
+	return l.opts.MaxGoroutines
+}
+
+// OpenFDs returns the number of open fds of the last check.
+func (l *Limiter) OpenFDs() int {
+	return int(atomic.LoadInt64(&l.fds))
+}
+
+// MaxFDs returns the effective fd limit. Zero means no limit.
+func (l *Limiter) MaxFDs() int {
+	return l.fdLimit
+}
+
+// RefusedConns returns the total number of refused connections.
+func (l *Limiter) RefusedConns() uint64 {
+	return atomic.LoadUint64(&l.refusedConns)
+}
+
+// ShedQueries returns the total number of shed queries.
+func (l *Limiter) ShedQueries() uint64 {
+	return atomic.LoadUint64(&l.shedQueries)
+}
+
+// Close stops the check loop. It always returns a nil error.
+func (l *Limiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeNotify)
+	})
+	return nil
+}
+
+const (
+	minAcceptRetryDelay = time.Millisecond * 5
+	maxAcceptRetryDelay = time.Second
+)
+
+// Listener wraps ln. Connections accepted when AllowConn returns false
+// are closed immediately. Accept errors caused by fd exhaustion are
+// retried with a backoff instead of being returned.
+func (l *Limiter) Listener(ln net.Listener) net.Listener {
+	return &listener{Listener: ln, l: l}
+}
+
+type listener struct {
+	net.Listener
+	l *Limiter
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			if !errors.Is(err, syscall.EMFILE) && !errors.Is(err, syscall.ENFILE) {
+				return nil, err
+			}
+			if delay == 0 {
+				delay = minAcceptRetryDelay
+			} else if delay *= 2; delay > maxAcceptRetryDelay {
+				delay = maxAcceptRetryDelay
+			}
+			ln.l.opts.Logger.Warn("too many open files, retrying accept", zap.Duration("delay", delay), zap.Error(err))
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !ln.l.AllowConn() {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
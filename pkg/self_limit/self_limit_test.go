@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package self_limit
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Level(t *testing.T) {
+	n := runtime.NumGoroutine() + 16
+	tests := []struct {
+		name          string
+		maxGoroutines int
+		softRatio     float64
+		want          Level
+	}{
+		{"disabled", 0, 0, LevelNormal},
+		{"normal", n * 100, 0, LevelNormal},
+		{"soft", n * 100, 0.001, LevelSoft},
+		{"hard", 1, 0, LevelHard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLimiter(Opts{MaxGoroutines: tt.maxGoroutines, SoftRatio: tt.softRatio, CheckInterval: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			if got := l.Level(); got != tt.want {
+				t.Fatalf("Level() = %v, want %v", got, tt.want)
+			}
+			if l.Goroutines() <= 0 {
+				t.Fatalf("invalid goroutine number %d", l.Goroutines())
+			}
+		})
+	}
+}
+
+func TestLimiter_FDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fd check is not supported")
+	}
+	l, err := NewLimiter(Opts{MaxFDs: 1 << 20, FDHeadroom: 1, CheckInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.OpenFDs() <= 0 {
+		t.Fatalf("invalid fd number %d", l.OpenFDs())
+	}
+	if l.MaxFDs() <= 0 || l.MaxFDs() >= 1<<20 {
+		t.Fatalf("fd limit %d is not capped by rlimit", l.MaxFDs())
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	l, err := NewLimiter(Opts{CheckInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		level        Level
+		conn, lp, hp bool
+	}{
+		{LevelNormal, true, true, true},
+		{LevelSoft, false, false, true},
+		{LevelHard, false, false, false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&l.level, int32(tt.level))
+		if got := l.AllowConn(); got != tt.conn {
+			t.Errorf("%v: AllowConn() = %v, want %v", tt.level, got, tt.conn)
+		}
+		if got := l.AllowQuery(true); got != tt.lp {
+			t.Errorf("%v: AllowQuery(true) = %v, want %v", tt.level, got, tt.lp)
+		}
+		if got := l.AllowQuery(false); got != tt.hp {
+			t.Errorf("%v: AllowQuery(false) = %v, want %v", tt.level, got, tt.hp)
+		}
+	}
+	if l.RefusedConns() != 2 || l.ShedQueries() != 3 {
+		t.Fatalf("unexpected counters, refused conns %d, shed queries %d", l.RefusedConns(), l.ShedQueries())
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := NewLimiter(Opts{CheckInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = l.Listener(ln)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	atomic.StoreInt32(&l.level, int32(LevelSoft))
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("refused connection is not closed")
+	}
+	if l.RefusedConns() != 1 {
+		t.Fatalf("refused conns = %d, want 1", l.RefusedConns())
+	}
+
+	atomic.StoreInt32(&l.level, int32(LevelNormal))
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection is not accepted")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, err := NewLimiter(Opts{CheckInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := NewHandler(&dns_handler.DummyServerHandler{T: t}, l, []uint16{dns.TypeANY})
+
+	meta := &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("127.0.0.1")}
+	serve := func(qt uint16) int {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qt)
+		r, err := h.ServeDNS(context.Background(), q, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Rcode
+	}
+
+	atomic.StoreInt32(&l.level, int32(LevelSoft))
+	if rc := serve(dns.TypeA); rc != dns.RcodeSuccess {
+		t.Fatalf("high priority query got rcode %d", rc)
+	}
+	if rc := serve(dns.TypeANY); rc != dns.RcodeRefused {
+		t.Fatalf("low priority query got rcode %d", rc)
+	}
+	atomic.StoreInt32(&l.level, int32(LevelHard))
+	if rc := serve(dns.TypeA); rc != dns.RcodeRefused {
+		t.Fatalf("query got rcode %d at hard level", rc)
+	}
+}
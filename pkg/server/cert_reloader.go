@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const certReloadDelay = time.Second
+
+// CertFile is a pair of certificate and key files.
+type CertFile struct {
+	Cert, Key string
+}
+
+// CertReloader serves certificates loaded from files. It reloads them
+// when the files change or the process receives a SIGHUP, so renewed
+// certificates can be used without restarting the server.
+type CertReloader struct {
+	files  []CertFile
+	logger *zap.Logger
+
+	m     sync.RWMutex
+	certs []*tls.Certificate
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewCertReloader loads certificates of files and starts watching
+// them. If a client's hello matches none of the certificates, the
+// first one is used. A nil logger disables logging.
+// CertReloader must be closed by Close.
+func NewCertReloader(files []CertFile, logger *zap.Logger) (*CertReloader, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	if logger == nil {
+		logger = nopLogger
+	}
+	r := &CertReloader{
+		files:       files,
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch dirs instead of files. Certificate renewers usually replace
+	// files or symlinks, which removes the watch of the old file.
+	dirs := make(map[string]struct{})
+	for _, f := range files {
+		for _, name := range []string{f.Cert, f.Key} {
+			dir := filepath.Dir(name)
+			if _, ok := dirs[dir]; ok {
+				continue
+			}
+			dirs[dir] = struct{}{}
+			if err := w.Add(dir); err != nil {
+				w.Close()
+				return nil, fmt.Errorf("failed to watch %s, %w", dir, err)
+			}
+		}
+	}
+	go r.watch(w)
+	return r, nil
+}
+
+// Reload reloads all certificates. If any of them fails to load, the
+// current certificates are kept.
+func (r *CertReloader) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(r.files))
+	for _, f := range r.files {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s, %w", f.Cert, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("failed to parse certificate %s, %w", f.Cert, err)
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	r.m.Lock()
+	r.certs = certs
+	r.m.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.m.RLock()
+	certs := r.certs
+	r.m.RUnlock()
+
+	if len(certs) > 1 {
+		for _, cert := range certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+// TLSConfig returns a tls.Config that uses r to get certificates.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
+
+// Close stops watching the files. It always returns a nil error.
+func (r *CertReloader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeNotify)
+	})
+	return nil
+}
+
+func (r *CertReloader) watch(w *fsnotify.Watcher) {
+	defer w.Close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	watched := make(map[string]struct{})
+	for _, f := range r.files {
+		watched[filepath.Clean(f.Cert)] = struct{}{}
+		watched[filepath.Clean(f.Key)] = struct{}{}
+	}
+
+	var delayReload <-chan time.Time
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if _, ok := watched[filepath.Clean(e.Name)]; !ok {
+				continue
+			}
+			r.logger.Debug("certificate fs event", zap.Stringer("event", e.Op), zap.String("file", e.Name))
+			delayReload = time.After(certReloadDelay) // wait for both files to be written.
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Error("fs notify error", zap.Error(err))
+		case <-sig:
+			r.logger.Info("received SIGHUP, reloading certificates")
+			r.reload()
+		case <-delayReload:
+			delayReload = nil
+			r.logger.Info("certificate files changed, reloading certificates")
+			r.reload()
+		case <-r.closeNotify:
+			return
+		}
+	}
+}
+
+func (r *CertReloader) reload() {
+	if err := r.Reload(); err != nil {
+		r.logger.Error("failed to reload certificates, keeping the old ones", zap.Error(err))
+		return
+	}
+	r.logger.Info("certificates reloaded")
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCertFiles(t *testing.T, dir, name string) CertFile {
+	t.Helper()
+	cert, err := utils.GenerateCertificate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := CertFile{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(f.Key, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.Cert, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	f := writeCertFiles(t, dir, "old.test")
+
+	r, err := NewCertReloader([]CertFile{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	l := getListener(t)
+	s := NewServer(ServerOpts{DNSHandler: &serverNameHandler{}, TLSConfig: r.TLSConfig()})
+	go s.ServeTLS(l)
+	defer s.Close()
+
+	peerCN := func() string {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := peerCN(); cn != "old.test" {
+		t.Fatalf("want certificate old.test, got %s", cn)
+	}
+
+	// Broken files should not replace the current certificate.
+	if err := os.WriteFile(f.Cert, []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("broken certificate should not be loaded")
+	}
+	if cn := peerCN(); cn != "old.test" {
+		t.Fatalf("want certificate old.test, got %s", cn)
+	}
+
+	writeCertFiles(t, dir, "new.test")
+	deadline := time.Now().Add(time.Second * 5)
+	for peerCN() != "new.test" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate is not reloaded after files changed")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const clientLimiterGCInterval = time.Second * 10
+
+// ClientLimiterOpts configures per client IP limits. Zero disables a limit.
+type ClientLimiterOpts struct {
+	// MaxConns limits the number of connections (tcp, dot, doh, dnscrypt
+	// over tcp) of each client. Connections over the limit are closed
+	// right after they were accepted.
+	MaxConns int
+
+	// MaxInflight limits the number of concurrent queries of each client.
+	MaxInflight int
+
+	// QPS and Burst configure the token bucket of each client. Default
+	// Burst is QPS.
+	QPS   float64
+	Burst int
+
+	// Drop drops the queries over MaxInflight or QPS without a response.
+	// Otherwise, they get a REFUSED response.
+	Drop bool
+}
+
+// ClientLimiter limits the connections and queries of each client IP.
+// Clients without an IP address (e.g. from unix sockets) are not limited.
+type ClientLimiter struct {
+	opts ClientLimiterOpts
+
+	m      sync.Mutex
+	lastGC time.Time
+	cs     map[netip.Addr]*clientState
+}
+
+type clientState struct {
+	conns    int
+	inflight int
+	tokens   float64
+	last     time.Time // last token bucket refill
+}
+
+func NewClientLimiter(opts ClientLimiterOpts) *ClientLimiter {
+	if opts.Burst <= 0 {
+		opts.Burst = int(opts.QPS)
+		if opts.Burst < 1 {
+			opts.Burst = 1
+		}
+	}
+	return &ClientLimiter{
+		opts:   opts,
+		lastGC: time.Now(),
+		cs:     make(map[netip.Addr]*clientState),
+	}
+}
+
+// getLocked returns the state of addr. Caller must hold l.m.
+func (l *ClientLimiter) getLocked(addr netip.Addr, now time.Time) *clientState {
+	if now.Sub(l.lastGC) > clientLimiterGCInterval {
+		l.lastGC = now
+		for a, c := range l.cs {
+			if c.conns == 0 && c.inflight == 0 && l.refill(c, now) >= float64(l.opts.Burst) {
+				delete(l.cs, a)
+			}
+		}
+	}
+	c := l.cs[addr]
+	if c == nil {
+		c = &clientState{tokens: float64(l.opts.Burst), last: now}
+		l.cs[addr] = c
+	}
+	return c
+}
+
+// refill refills the token bucket of c and returns its tokens.
+func (l *ClientLimiter) refill(c *clientState, now time.Time) float64 {
+	c.tokens += now.Sub(c.last).Seconds() * l.opts.QPS
+	if b := float64(l.opts.Burst); c.tokens > b {
+		c.tokens = b
+	}
+	c.last = now
+	return c.tokens
+}
+
+func (l *ClientLimiter) acquireConn(addr netip.Addr) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	c := l.getLocked(addr, time.Now())
+	if c.conns >= l.opts.MaxConns {
+		return false
+	}
+	c.conns++
+	return true
+}
+
+func (l *ClientLimiter) releaseConn(addr netip.Addr) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if c := l.cs[addr]; c != nil {
+		c.conns--
+	}
+}
+
+func (l *ClientLimiter) acquireQuery(addr netip.Addr) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := time.Now()
+	c := l.getLocked(addr, now)
+	if l.opts.MaxInflight > 0 && c.inflight >= l.opts.MaxInflight {
+		return false
+	}
+	if l.opts.QPS > 0 {
+		if l.refill(c, now) < 1 {
+			return false
+		}
+		c.tokens--
+	}
+	c.inflight++
+	return true
+}
+
+func (l *ClientLimiter) releaseQuery(addr netip.Addr) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if c := l.cs[addr]; c != nil {
+		c.inflight--
+	}
+}
+
+// Listener returns a net.Listener that closes the connections of clients
+// that exceed MaxConns. If MaxConns is disabled, ln is returned.
+func (l *ClientLimiter) Listener(ln net.Listener) net.Listener {
+	if l.opts.MaxConns <= 0 {
+		return ln
+	}
+	return &limitedListener{Listener: ln, l: l}
+}
+
+type limitedListener struct {
+	net.Listener
+	l *ClientLimiter
+}
+
+func (ln *limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr := utils.GetAddrFromAddr(c.RemoteAddr())
+		if !addr.IsValid() {
+			return c, nil
+		}
+		if !ln.l.acquireConn(addr) {
+			c.Close()
+			continue
+		}
+		return &limitedConn{Conn: c, release: func() { ln.l.releaseConn(addr) }}, nil
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	release   func()
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+// Handler returns a dns_handler.Handler that limits the queries of each
+// client before passing them to next. If MaxInflight and QPS are disabled,
+// next is returned.
+func (l *ClientLimiter) Handler(next dns_handler.Handler) dns_handler.Handler {
+	if l.opts.MaxInflight <= 0 && l.opts.QPS <= 0 {
+		return next
+	}
+	return &limitedHandler{next: next, l: l}
+}
+
+type limitedHandler struct {
+	next dns_handler.Handler
+	l    *ClientLimiter
+}
+
+func (h *limitedHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	addr := meta.ClientAddr
+	if !addr.IsValid() {
+		return h.next.ServeDNS(ctx, req, meta)
+	}
+	if !h.l.acquireQuery(addr) {
+		if h.l.opts.Drop {
+			return nil, dns_handler.ErrDrop
+		}
+		r := new(dns.Msg)
+		r.SetRcode(req, dns.RcodeRefused)
+		return r, nil
+	}
+	defer h.l.releaseQuery(addr)
+	return h.next.ServeDNS(ctx, req, meta)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func serveLimited(h dns_handler.Handler, client string) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	return h.ServeDNS(context.Background(), q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(client)})
+}
+
+func TestClientLimiter_qps(t *testing.T) {
+	tests := []struct {
+		name    string
+		drop    bool
+		wantErr error
+	}{
+		{"refuse", false, nil},
+		{"drop", true, dns_handler.ErrDrop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewClientLimiter(ClientLimiterOpts{QPS: 1, Burst: 2, Drop: tt.drop})
+			h := l.Handler(new(dns_handler.DummyServerHandler))
+			for i := 0; i < 2; i++ {
+				if r, err := serveLimited(h, "192.0.2.1"); err != nil || r.Rcode != dns.RcodeSuccess {
+					t.Fatalf("query #%d should pass, %v", i, err)
+				}
+			}
+			r, err := serveLimited(h, "192.0.2.1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && r.Rcode != dns.RcodeRefused {
+				t.Fatalf("want REFUSED, got %d", r.Rcode)
+			}
+
+			// Other clients are not affected.
+			if _, err := serveLimited(h, "192.0.2.2"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClientLimiter_maxInflight(t *testing.T) {
+	l := NewClientLimiter(ClientLimiterOpts{MaxInflight: 1})
+	bh := &blockingHandler{started: make(chan uint16, 1), release: make(chan struct{})}
+	h := l.Handler(bh)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveLimited(h, "192.0.2.1")
+	}()
+	<-bh.started
+
+	if r, _ := serveLimited(h, "192.0.2.1"); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want REFUSED, got %d", r.Rcode)
+	}
+	bh.release <- struct{}{}
+	<-done
+	go func() { bh.release <- struct{}{} }()
+	if r, _ := serveLimited(h, "192.0.2.1"); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("want NOERROR after the inflight query finished, got %d", r.Rcode)
+	}
+}
+
+func TestClientLimiter_maxConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewClientLimiter(ClientLimiterOpts{MaxConns: 1})
+	ll := l.Listener(ln)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1 := dial()
+	defer c1.Close()
+	s1 := <-accepted
+
+	// The second connection is closed by the server.
+	c2 := dial()
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c2.Read(make([]byte, 1))
+	var ne net.Error
+	if err == nil || (errors.As(err, &ne) && ne.Timeout()) {
+		t.Fatalf("want the connection closed, got %v", err)
+	}
+
+	// A slot is released after the first one was closed.
+	s1.Close()
+	c3 := dial()
+	defer c3.Close()
+	select {
+	case s3 := <-accepted:
+		s3.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection is not accepted")
+	}
+}
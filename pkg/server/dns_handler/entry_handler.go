@@ -22,23 +22,32 @@ package dns_handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/perf_stats"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_tail"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
+	"runtime/debug"
 	"testing"
 	"time"
 )
 
 const (
-	defaultQueryTimeout = time.Second * 5
+	defaultQueryTimeout    = time.Second * 5
+	defaultFailsafeTimeout = time.Second * 2
 )
 
 var (
 	nopLogger = zap.NewNop()
 )
 
+// ErrDrop is returned by Handler if the request should be dropped
+// without a response. Executables can return it to drop the query.
+var ErrDrop = errors.New("request dropped")
+
 // Handler handles dns query.
 type Handler interface {
 	// ServeDNS handles incoming request req and returns a response.
@@ -48,7 +57,7 @@ type Handler interface {
 	// ServeDNS should always return a responses.
 	// If ServeDNS returns an error, caller considers that the error is associated
 	// with the downstream connection and will close the downstream connection
-	// immediately.
+	// immediately. (ErrDrop is not logged as an error.)
 	// All input parameters won't be nil.
 	ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error)
 }
@@ -65,6 +74,32 @@ type EntryHandlerOpts struct {
 
 	// RecursionAvailable sets the dns.Msg.RecursionAvailable flag globally.
 	RecursionAvailable bool
+
+	// PerfStats, if not nil, records query statistics.
+	PerfStats *perf_stats.Stats
+
+	// Metrics, if not nil, records prometheus metrics of queries.
+	Metrics *QueryMetrics
+
+	// EncryptedOnly marks all queries as encrypted only. See
+	// query_context.Context.SetEncryptedOnly.
+	EncryptedOnly bool
+
+	// Failsafe, if not nil, handles the original query when Entry fails
+	// (returns an error, panics or returns without a response), instead of
+	// answering SERVFAIL. It runs with a new timeout of FailsafeTimeout.
+	Failsafe executable_seq.Executable
+
+	// FailsafeTimeout limits the timeout value of Failsafe.
+	// Default is defaultFailsafeTimeout.
+	FailsafeTimeout time.Duration
+
+	// TraceQueries answers CHAOS TXT queries in TraceZone with the trace
+	// of the query they contain. See TraceZone.
+	TraceQueries bool
+
+	// Tail, if not nil, publishes completed queries to its subscribers.
+	Tail *query_tail.Hub
 }
 
 func (opts *EntryHandlerOpts) Init() error {
@@ -75,6 +110,7 @@ func (opts *EntryHandlerOpts) Init() error {
 		return errors.New("nil entry")
 	}
 	utils.SetDefaultNum(&opts.QueryTimeout, defaultQueryTimeout)
+	utils.SetDefaultNum(&opts.FailsafeTimeout, defaultFailsafeTimeout)
 	return nil
 }
 
@@ -90,8 +126,10 @@ func NewEntryHandler(opts EntryHandlerOpts) (*EntryHandler, error) {
 }
 
 // ServeDNS implements Handler.
-// If entry returns an error, a SERVFAIL response will be returned.
-// If entry returns without a response, a REFUSED response will be returned.
+// If entry returns an error or panics, a SERVFAIL response will be returned.
+// If entry returns without a response, a SERVFAIL response will be returned.
+// If Failsafe is set, it answers the query in both cases instead.
+// If entry returns ErrDrop, ServeDNS returns ErrDrop.
 func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
 	// apply timeout to ctx
 	ddl := time.Now().Add(h.opts.QueryTimeout)
@@ -102,9 +140,42 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 		ctx = newCtx
 	}
 
+	if h.opts.TraceQueries {
+		q, ok, err := parseTraceQuery(req)
+		if ok {
+			if err != nil {
+				h.opts.Logger.Debug("invalid trace query", zap.Error(err))
+				r := new(dns.Msg)
+				r.SetRcode(req, dns.RcodeFormatError)
+				return r, nil
+			}
+			return h.serveTrace(ctx, req, q, meta), nil
+		}
+	}
+
+	start := time.Now()
+	if stats := h.opts.PerfStats; stats != nil {
+		stats.Sent(req.Len())
+	}
+	if m := h.opts.Metrics; m != nil {
+		m.queryStarted(req)
+	}
+
 	// exec entry
 	qCtx := query_context.NewContext(req, meta)
-	err := h.opts.Entry.Exec(ctx, qCtx, nil)
+	defer qCtx.ReleaseArena()
+	qCtx.SetEncryptedOnly(h.opts.EncryptedOnly)
+	err := execRecover(ctx, h.opts.Entry, qCtx)
+	if errors.Is(err, ErrDrop) {
+		h.opts.Logger.Debug("query dropped", qCtx.InfoField())
+		if m := h.opts.Metrics; m != nil {
+			m.queryDone(nil, time.Since(start))
+		}
+		if t := h.opts.Tail; t != nil && t.Active() {
+			t.Publish(query_tail.NewEvent(qCtx, nil, err))
+		}
+		return nil, ErrDrop
+	}
 	respMsg := qCtx.R()
 	if err != nil {
 		h.opts.Logger.Warn("entry returned an err", qCtx.InfoField(), zap.Error(err))
@@ -115,7 +186,10 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 		h.opts.Logger.Error("entry returned an nil response", qCtx.InfoField())
 	}
 
-	if respMsg == nil || err != nil {
+	if (respMsg == nil || err != nil) && h.opts.Failsafe != nil {
+		respMsg = h.execFailsafe(qCtx)
+	}
+	if respMsg == nil || (err != nil && h.opts.Failsafe == nil) {
 		respMsg = new(dns.Msg)
 		respMsg.SetReply(req)
 		respMsg.Rcode = dns.RcodeServerFailure
@@ -124,9 +198,48 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	if h.opts.RecursionAvailable {
 		respMsg.RecursionAvailable = true
 	}
+	if stats := h.opts.PerfStats; stats != nil {
+		stats.Completed(respMsg.Rcode, respMsg.Len(), time.Since(start))
+	}
+	if m := h.opts.Metrics; m != nil {
+		m.queryDone(respMsg, time.Since(start))
+	}
+	if t := h.opts.Tail; t != nil && t.Active() {
+		t.Publish(query_tail.NewEvent(qCtx, respMsg, err))
+	}
 	return respMsg, nil
 }
 
+// execFailsafe handles the original query of the failed qCtx by Failsafe.
+// It returns nil if Failsafe fails too.
+func (h *EntryHandler) execFailsafe(failed *query_context.Context) *dns.Msg {
+	ctx, cancel := context.WithTimeout(context.Background(), h.opts.FailsafeTimeout)
+	defer cancel()
+
+	qCtx := query_context.NewContext(failed.OriginalQuery().Copy(), failed.ReqMeta())
+	qCtx.SetEncryptedOnly(failed.EncryptedOnly())
+	h.opts.Logger.Warn("entry failed, passing query to failsafe", qCtx.InfoField())
+	if err := execRecover(ctx, h.opts.Failsafe, qCtx); err != nil {
+		h.opts.Logger.Warn("failsafe returned an err", qCtx.InfoField(), zap.Error(err))
+		return nil
+	}
+	r := qCtx.R()
+	if r != nil {
+		r.Id = failed.Q().Id
+	}
+	return r
+}
+
+// execRecover executes e and converts its panic to an error.
+func execRecover(ctx context.Context, e executable_seq.Executable, qCtx *query_context.Context) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v, %s", v, debug.Stack())
+		}
+	}()
+	return e.Exec(ctx, qCtx, nil)
+}
+
 type DummyServerHandler struct {
 	T       *testing.T
 	WantMsg *dns.Msg
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+type panicExecutable struct{}
+
+func (panicExecutable) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	panic("boom")
+}
+
+func TestEntryHandler_failsafe(t *testing.T) {
+	failsafeR := new(dns.Msg)
+	failsafeR.Rcode = dns.RcodeSuccess
+	failsafeR.Answer = append(failsafeR.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}})
+	entryR := new(dns.Msg)
+	entryR.Rcode = dns.RcodeNameError
+
+	tests := []struct {
+		name      string
+		entry     executable_seq.Executable
+		failsafe  executable_seq.Executable
+		wantRcode int
+		wantAns   int
+	}{
+		{"entry ok", &executable_seq.DummyExecutable{WantR: entryR}, &executable_seq.DummyExecutable{WantR: failsafeR}, dns.RcodeNameError, 0},
+		{"entry err", &executable_seq.DummyExecutable{WantErr: errors.New("err")}, &executable_seq.DummyExecutable{WantR: failsafeR}, dns.RcodeSuccess, 1},
+		{"entry panic", panicExecutable{}, &executable_seq.DummyExecutable{WantR: failsafeR}, dns.RcodeSuccess, 1},
+		{"no response", &executable_seq.DummyExecutable{}, &executable_seq.DummyExecutable{WantR: failsafeR}, dns.RcodeSuccess, 1},
+		{"failsafe err", &executable_seq.DummyExecutable{WantErr: errors.New("err")}, &executable_seq.DummyExecutable{WantErr: errors.New("err")}, dns.RcodeServerFailure, 0},
+		{"failsafe panic", panicExecutable{}, panicExecutable{}, dns.RcodeServerFailure, 0},
+		{"no failsafe", panicExecutable{}, nil, dns.RcodeServerFailure, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewEntryHandler(EntryHandlerOpts{Entry: tt.entry, Failsafe: tt.failsafe})
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, err := h.ServeDNS(context.Background(), q, new(query_context.RequestMeta))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAns {
+				t.Fatalf("want rcode %d with %d answers, got %d with %d", tt.wantRcode, tt.wantAns, r.Rcode, len(r.Answer))
+			}
+			if tt.wantAns > 0 && r.Id != q.Id {
+				t.Fatal("failsafe response id mismatched")
+			}
+		})
+	}
+}
+
+func TestEntryHandler_drop(t *testing.T) {
+	entry := &executable_seq.DummyExecutable{WantErr: fmt.Errorf("wrapped, %w", ErrDrop)}
+	h, err := NewEntryHandler(EntryHandlerOpts{Entry: entry, Failsafe: &executable_seq.DummyExecutable{WantR: new(dns.Msg)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := h.ServeDNS(context.Background(), q, new(query_context.RequestMeta))
+	if !errors.Is(err, ErrDrop) || r != nil {
+		t.Fatalf("want ErrDrop without a response, got %v, %v", r, err)
+	}
+}
+
+func TestEntryHandler_metrics(t *testing.T) {
+	r := new(dns.Msg)
+	r.Rcode = dns.RcodeNameError
+	m := NewQueryMetrics()
+	h, err := NewEntryHandler(EntryHandlerOpts{Entry: &executable_seq.DummyExecutable{WantR: r}, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeA, 65000} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		if _, err := h.ServeDNS(context.Background(), q, new(query_context.RequestMeta)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for label, want := range map[string]float64{"A": 2, "other": 1} {
+		if got := testutil.ToFloat64(m.queryTotal.WithLabelValues(label)); got != want {
+			t.Fatalf("query_total{qtype=%s} = %v, want %v", label, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(m.responseTotal.WithLabelValues("NXDOMAIN")); got != 3 {
+		t.Fatalf("response_total{rcode=NXDOMAIN} = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.inflight); got != 0 {
+		t.Fatalf("query_inflight = %v, want 0", got)
+	}
+}
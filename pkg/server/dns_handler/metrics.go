@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// QueryMetrics are prometheus metrics of queries that are handled
+// by EntryHandlers. It can be shared by multiple EntryHandlers.
+type QueryMetrics struct {
+	queryTotal    *prometheus.CounterVec
+	responseTotal *prometheus.CounterVec
+	inflight      prometheus.Gauge
+	duration      prometheus.Histogram
+}
+
+func NewQueryMetrics() *QueryMetrics {
+	return &QueryMetrics{
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_total",
+			Help: "The total number of queries by query type",
+		}, []string{"qtype"}),
+		responseTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "response_total",
+			Help: "The total number of responses by rcode",
+		}, []string{"rcode"}),
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "query_inflight",
+			Help: "The number of queries that are being handled",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "query_duration_seconds",
+			Help:    "The duration of handling queries",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+	}
+}
+
+// Collectors returns the collectors of m, which should be registered
+// to a prometheus.Registerer.
+func (m *QueryMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.queryTotal, m.responseTotal, m.inflight, m.duration}
+}
+
+func (m *QueryMetrics) queryStarted(q *dns.Msg) {
+	m.inflight.Inc()
+	qtype := "none"
+	if len(q.Question) > 0 {
+		qtype = typeLabel(q.Question[0].Qtype)
+	}
+	m.queryTotal.WithLabelValues(qtype).Inc()
+}
+
+// queryDone records the response of a query. r is nil if the query
+// was dropped.
+func (m *QueryMetrics) queryDone(r *dns.Msg, d time.Duration) {
+	m.inflight.Dec()
+	rcode := "dropped"
+	if r != nil {
+		rcode = rcodeLabel(r.Rcode)
+	}
+	m.responseTotal.WithLabelValues(rcode).Inc()
+	m.duration.Observe(d.Seconds())
+}
+
+// typeLabel and rcodeLabel only return known values, so clients
+// cannot create unlimited series.
+func typeLabel(t uint16) string {
+	if s, ok := dns.TypeToString[t]; ok {
+		return s
+	}
+	return "other"
+}
+
+func rcodeLabel(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return "other"
+}
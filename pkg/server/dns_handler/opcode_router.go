@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// OpcodeDSO is the DNS Stateful Operations opcode. See RFC 8490.
+const OpcodeDSO = 6
+
+// ParseOpcode parses an opcode name (query, iquery, status, notify, update,
+// dso) or number.
+func ParseOpcode(s string) (int, error) {
+	name := strings.ToUpper(s)
+	if name == "DSO" {
+		return OpcodeDSO, nil
+	}
+	if opcode, ok := dns.StringToOpcode[name]; ok {
+		return opcode, nil
+	}
+	opcode, err := strconv.Atoi(s)
+	if err != nil || opcode < 0 || opcode > 15 {
+		return 0, fmt.Errorf("invalid opcode %s", s)
+	}
+	return opcode, nil
+}
+
+// OpcodeRouter is a Handler that routes requests to different Handlers
+// based on their opcodes. e.g. NOTIFY and UPDATE requests can be handled
+// by dedicated entries instead of the query entry.
+type OpcodeRouter struct {
+	defaultHandler Handler
+	routes         [16]Handler
+}
+
+// NewOpcodeRouter returns a OpcodeRouter. Requests with opcodes that have
+// no route will be handled by defaultHandler.
+func NewOpcodeRouter(defaultHandler Handler) *OpcodeRouter {
+	return &OpcodeRouter{defaultHandler: defaultHandler}
+}
+
+// Add adds a route for opcode.
+func (r *OpcodeRouter) Add(opcode int, h Handler) error {
+	if opcode < 0 || opcode >= len(r.routes) {
+		return fmt.Errorf("invalid opcode %d", opcode)
+	}
+	if r.routes[opcode] != nil {
+		return fmt.Errorf("duplicated opcode %d", opcode)
+	}
+	r.routes[opcode] = h
+	return nil
+}
+
+// Match returns the Handler for opcode.
+func (r *OpcodeRouter) Match(opcode int) Handler {
+	if opcode >= 0 && opcode < len(r.routes) && r.routes[opcode] != nil {
+		return r.routes[opcode]
+	}
+	return r.defaultHandler
+}
+
+// ServeDNS implements Handler.
+func (r *OpcodeRouter) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	return r.Match(req.Opcode).ServeDNS(ctx, req, meta)
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestParseOpcode(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int
+		wantErr bool
+	}{
+		{"notify", dns.OpcodeNotify, false},
+		{"UPDATE", dns.OpcodeUpdate, false},
+		{"dso", OpcodeDSO, false},
+		{"7", 7, false},
+		{"16", 0, true},
+		{"xfr", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOpcode(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseOpcode(%s) = %d, %v, want %d, err %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestOpcodeRouter(t *testing.T) {
+	newHandler := func(rcode int) Handler {
+		r := new(dns.Msg)
+		r.Rcode = rcode
+		return &DummyServerHandler{T: t, WantMsg: r}
+	}
+	r := NewOpcodeRouter(newHandler(dns.RcodeSuccess))
+	if err := r.Add(dns.OpcodeNotify, newHandler(dns.RcodeNotImplemented)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(dns.OpcodeNotify, newHandler(dns.RcodeRefused)); err == nil {
+		t.Fatal("want err for duplicated opcode")
+	}
+
+	for opcode, want := range map[int]int{
+		dns.OpcodeQuery:  dns.RcodeSuccess,
+		dns.OpcodeNotify: dns.RcodeNotImplemented,
+		dns.OpcodeUpdate: dns.RcodeSuccess,
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeSOA)
+		q.Opcode = opcode
+		resp, err := r.ServeDNS(context.Background(), q, new(query_context.RequestMeta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != want {
+			t.Errorf("opcode %d, want rcode %d, got %d", opcode, want, resp.Rcode)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// SNIRouter is a Handler that routes requests to different Handlers based
+// on the tls server name (query_context.RequestMeta.ServerName) sent by
+// the client.
+type SNIRouter struct {
+	defaultHandler Handler
+	exact          map[string]Handler
+	wildcards      []wildcardRoute
+}
+
+type wildcardRoute struct {
+	suffix string // e.g. ".example.com"
+	h      Handler
+}
+
+// NewSNIRouter returns a SNIRouter. Requests that match no route
+// will be handled by defaultHandler.
+func NewSNIRouter(defaultHandler Handler) *SNIRouter {
+	return &SNIRouter{
+		defaultHandler: defaultHandler,
+		exact:          make(map[string]Handler),
+	}
+}
+
+// Add adds a route. serverName can be a domain name, e.g. "family.example",
+// or a wildcard name, e.g. "*.example", which matches a single label like the
+// wildcard in certificates. Exact names take precedence over wildcard names.
+// Wildcard names are matched in the order they were added.
+func (r *SNIRouter) Add(serverName string, h Handler) error {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if len(name) == 0 {
+		return fmt.Errorf("invalid server name %s", serverName)
+	}
+	if strings.HasPrefix(name, "*.") {
+		suffix := name[1:]
+		if len(suffix) < 2 || strings.Contains(suffix, "*") {
+			return fmt.Errorf("invalid wildcard server name %s", serverName)
+		}
+		r.wildcards = append(r.wildcards, wildcardRoute{suffix: suffix, h: h})
+		return nil
+	}
+	if strings.Contains(name, "*") {
+		return fmt.Errorf("invalid server name %s, wildcard must be the first label", serverName)
+	}
+	if _, dup := r.exact[name]; dup {
+		return fmt.Errorf("duplicated server name %s", serverName)
+	}
+	r.exact[name] = h
+	return nil
+}
+
+// Match returns the Handler for serverName.
+func (r *SNIRouter) Match(serverName string) Handler {
+	if len(serverName) == 0 {
+		return r.defaultHandler
+	}
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if h, ok := r.exact[name]; ok {
+		return h
+	}
+	for _, w := range r.wildcards {
+		if strings.HasSuffix(name, w.suffix) {
+			label := name[:len(name)-len(w.suffix)]
+			if len(label) > 0 && !strings.Contains(label, ".") {
+				return w.h
+			}
+		}
+	}
+	return r.defaultHandler
+}
+
+// ServeDNS implements Handler.
+func (r *SNIRouter) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	return r.Match(meta.ServerName).ServeDNS(ctx, req, meta)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// TraceZone is the zone of trace queries. A CHAOS TXT query for
+// "<qtype>.<qname>.trace.mosdns." executes a query for qname with qtype
+// and answers the trace of it, one TXT record per event. e.g.
+//
+//	dig @127.0.0.1 CH TXT aaaa.example.com.trace.mosdns.
+const TraceZone = "trace.mosdns."
+
+// ExecTrace executes e with a new traced Context of q. Panics of e are
+// converted to errors. The returned Context is never nil.
+func ExecTrace(ctx context.Context, e executable_seq.Executable, q *dns.Msg, meta *query_context.RequestMeta) (*query_context.Context, error) {
+	qCtx := query_context.NewContext(q, meta)
+	qCtx.EnableTrace()
+	return qCtx, execRecover(ctx, e, qCtx)
+}
+
+// parseTraceQuery returns the query to be traced if req is a trace query.
+func parseTraceQuery(req *dns.Msg) (q *dns.Msg, ok bool, err error) {
+	if len(req.Question) != 1 {
+		return nil, false, nil
+	}
+	question := req.Question[0]
+	if question.Qclass != dns.ClassCHAOS || question.Qtype != dns.TypeTXT || !dns.IsSubDomain(TraceZone, question.Name) {
+		return nil, false, nil
+	}
+	name := strings.TrimSuffix(dns.CanonicalName(question.Name), TraceZone)
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 1 {
+		return nil, true, fmt.Errorf("missing qtype in trace query %s", question.Name)
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(labels[0])]
+	if !ok {
+		return nil, true, fmt.Errorf("invalid qtype %s in trace query", labels[0])
+	}
+	qname := name[len(labels[0])+1:]
+	if len(qname) == 0 {
+		qname = "."
+	}
+
+	q = new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = req.RecursionDesired
+	q.CheckingDisabled = req.CheckingDisabled
+	if opt := req.IsEdns0(); opt != nil {
+		q.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return q, true, nil
+}
+
+// serveTrace answers the trace query req with the trace of q.
+func (h *EntryHandler) serveTrace(ctx context.Context, req, q *dns.Msg, meta *query_context.RequestMeta) *dns.Msg {
+	qCtx, err := ExecTrace(ctx, h.opts.Entry, q, meta)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	name := req.Question[0].Name
+	add := func(s string) {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: splitTXT(s),
+		})
+	}
+	add(fmt.Sprintf("query: %s %s", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype]))
+	for _, e := range qCtx.Trace() {
+		add(e.String())
+	}
+	switch r := qCtx.R(); {
+	case err != nil:
+		add(fmt.Sprintf("error: %v", err))
+	case r == nil:
+		add("response: none")
+	default:
+		add(fmt.Sprintf("response: %s", dns.RcodeToString[r.Rcode]))
+		for _, rr := range r.Answer {
+			add(fmt.Sprintf("answer: %s", rr))
+		}
+	}
+	return resp
+}
+
+// splitTXT splits s into character strings of at most 255 bytes.
+func splitTXT(s string) []string {
+	var ss []string
+	for len(s) > 255 {
+		ss = append(ss, s[:255])
+		s = s[255:]
+	}
+	return append(ss, s)
+}
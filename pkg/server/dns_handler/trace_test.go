@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+type traceExecutable struct{}
+
+func (traceExecutable) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	qCtx.Tracef("e", "exec %s", dns.TypeToString[qCtx.Q().Question[0].Qtype])
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: qCtx.Q().Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(1, 2, 3, 4)})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func TestEntryHandler_trace(t *testing.T) {
+	serve := func(traceQueries bool, name string, qclass uint16) *dns.Msg {
+		t.Helper()
+		h, err := NewEntryHandler(EntryHandlerOpts{Entry: traceExecutable{}, TraceQueries: traceQueries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeTXT)
+		q.Question[0].Qclass = qclass
+		r, err := h.ServeDNS(context.Background(), q, new(query_context.RequestMeta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	txts := func(r *dns.Msg) []string {
+		var ss []string
+		for _, rr := range r.Answer {
+			ss = append(ss, strings.Join(rr.(*dns.TXT).Txt, ""))
+		}
+		return ss
+	}
+
+	r := serve(true, "A.Example.COM.trace.mosdns.", dns.ClassCHAOS)
+	got := txts(r)
+	if len(got) != 4 || got[0] != "query: example.com. A" || !strings.HasSuffix(got[1], "e: exec A") ||
+		got[2] != "response: NOERROR" || !strings.HasPrefix(got[3], "answer: example.com.") {
+		t.Fatalf("unexpected trace %q", got)
+	}
+	if r.Answer[0].Header().Name != "A.Example.COM.trace.mosdns." || r.Answer[0].Header().Class != dns.ClassCHAOS {
+		t.Fatalf("unexpected answer header %s", r.Answer[0].Header())
+	}
+
+	if r := serve(true, "bad.example.com.trace.mosdns.", dns.ClassCHAOS); r.Rcode != dns.RcodeFormatError {
+		t.Fatalf("want FORMERR for invalid qtype, got %s", dns.RcodeToString[r.Rcode])
+	}
+	// Not a trace query, or trace queries are disabled.
+	for _, r := range []*dns.Msg{
+		serve(true, "a.example.com.trace.mosdns.", dns.ClassINET),
+		serve(false, "a.example.com.trace.mosdns.", dns.ClassCHAOS),
+	} {
+		if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeA {
+			t.Fatalf("want the entry response, got %s", r)
+		}
+	}
+}
+
+func Test_splitTXT(t *testing.T) {
+	s := strings.Repeat("a", 600)
+	ss := splitTXT(s)
+	if len(ss) != 3 || len(ss[0]) != 255 || len(ss[2]) != 90 || strings.Join(ss, "") != s {
+		t.Fatalf("unexpected split %v", ss)
+	}
+}
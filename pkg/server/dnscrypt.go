@@ -0,0 +1,332 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v4/pkg/state_file"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDNSCryptCertTTL  = time.Hour * 24
+	dnscryptShutdownTimeout = time.Second * 5
+	dnscryptProviderPrefix  = "2.dnscrypt-cert."
+)
+
+var errMissingDNSCryptOpts = errors.New("missing dnscrypt options")
+
+// DNSCryptOpts configures the DNSCrypt v2 server.
+type DNSCryptOpts struct {
+	// ProviderName is the provider name, e.g. "2.dnscrypt-cert.example".
+	// The "2.dnscrypt-cert." prefix is added if it is missing.
+	ProviderName string
+
+	// PrivateKey is the long-term provider key. It signs the short-term
+	// certificates. Clients pin its public key via the server stamp.
+	PrivateKey ed25519.PrivateKey
+
+	// EsVersion is the encryption of the certificates. Default is
+	// dnscrypt.XSalsa20Poly1305.
+	EsVersion dnscrypt.CryptoConstruction
+
+	// CertTTL is the validity of the short-term certificates. A new
+	// certificate with a new key pair replaces the old one when it
+	// expires. Clients refetch certificates no later than that.
+	// Default is defaultDNSCryptCertTTL.
+	CertTTL time.Duration
+}
+
+// DNSCryptProviderName returns name with the "2.dnscrypt-cert." prefix.
+func DNSCryptProviderName(name string) string {
+	if strings.HasPrefix(name, dnscryptProviderPrefix) {
+		return name
+	}
+	return dnscryptProviderPrefix + name
+}
+
+// DNSCryptStamp returns the "sdns://" stamp of the server at addr, which
+// clients use to connect to the server.
+func DNSCryptStamp(opts *DNSCryptOpts, addr string) (string, error) {
+	rc := dnscrypt.ResolverConfig{
+		ProviderName: DNSCryptProviderName(opts.ProviderName),
+		PublicKey:    dnscrypt.HexEncodeKey(opts.PrivateKey.Public().(ed25519.PublicKey)),
+	}
+	stamp, err := rc.CreateStamp(addr)
+	if err != nil {
+		return "", err
+	}
+	return stamp.String(), nil
+}
+
+// LoadOrGenerateDNSCryptKey loads the hex encoded provider key from path.
+// If path does not exist, a new key will be generated and saved.
+func LoadOrGenerateDNSCryptKey(path string) (ed25519.PrivateKey, error) {
+	// Serializes the generation between processes. path itself is locked
+	// by state_file.WriteFile.
+	l, err := state_file.Lock(path + ".gen")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock key file, %w", err)
+	}
+	defer l.Unlock()
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		k, err := dnscrypt.HexDecodeKey(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file, %w", err)
+		}
+		if len(k) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid key length %d", len(k))
+		}
+		return k, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := state_file.WriteFile(path, []byte(dnscrypt.HexEncodeKey(k)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save generated key, %w", err)
+	}
+	return k, nil
+}
+
+// newDNSCryptCert generates a short-term certificate that is valid from
+// now until now + ttl.
+func newDNSCryptCert(opts *DNSCryptOpts, now time.Time, ttl time.Duration) (*dnscrypt.Cert, error) {
+	var sk [32]byte
+	if _, err := rand.Read(sk[:]); err != nil {
+		return nil, err
+	}
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &dnscrypt.Cert{
+		Serial:     uint32(now.Unix()),
+		EsVersion:  opts.EsVersion,
+		ResolverSk: sk,
+		NotBefore:  uint32(now.Unix()),
+		NotAfter:   uint32(now.Add(ttl).Unix()),
+	}
+	if cert.EsVersion == dnscrypt.UndefinedConstruction {
+		cert.EsVersion = dnscrypt.XSalsa20Poly1305
+	}
+	copy(cert.ResolverPk[:], pk)
+	// Different client magics let clients tell the new certificate
+	// from the old one.
+	copy(cert.ClientMagic[:], pk)
+	cert.Sign(opts.PrivateKey)
+	return cert, nil
+}
+
+// ServeDNSCrypt serves DNSCrypt v2 on c and l. They should be bound to the
+// same address. The short-term certificate is rotated on expiry, see
+// DNSCryptOpts.CertTTL.
+func (s *Server) ServeDNSCrypt(c *net.UDPConn, l net.Listener) error {
+	defer c.Close()
+	defer l.Close()
+
+	handler := s.opts.DNSHandler
+	if handler == nil {
+		return errMissingDNSHandler
+	}
+	opts := s.opts.DNSCrypt
+	if opts == nil || len(opts.PrivateKey) != ed25519.PrivateKeySize {
+		return errMissingDNSCryptOpts
+	}
+	ttl := opts.CertTTL
+	if ttl <= 0 {
+		ttl = defaultDNSCryptCertTTL
+	}
+
+	for _, closer := range []io.Closer{c, l} {
+		closer := closer
+		if ok := s.trackCloser(&closer, true); !ok {
+			return ErrServerClosed
+		}
+		defer s.trackCloser(&closer, false)
+	}
+
+	// The dnscrypt.Server cannot change its certificate, so it is
+	// replaced by a new one on rotation. The listener is shared by them,
+	// Accept() of a replaced server returns once its dnscryptListener is
+	// closed.
+	a := newConnAcceptor(l)
+	defer a.close()
+	for {
+		cert, err := newDNSCryptCert(opts, time.Now(), ttl)
+		if err != nil {
+			return fmt.Errorf("failed to generate certificate, %w", err)
+		}
+		ds := &dnscrypt.Server{
+			ProviderName: DNSCryptProviderName(opts.ProviderName),
+			ResolverCert: cert,
+			Handler:      &dnscryptHandler{h: handler, logger: s.opts.Logger},
+		}
+		dl := a.listener()
+		errChan := make(chan error, 2)
+		go func() { errChan <- ds.ServeUDP(c) }()
+		go func() { errChan <- ds.ServeTCP(dl) }()
+
+		rotateTimer := time.NewTimer(ttl)
+		select {
+		case <-rotateTimer.C:
+			s.opts.Logger.Info("rotating dnscrypt certificate")
+			dl.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), dnscryptShutdownTimeout)
+			ds.Shutdown(ctx)
+			cancel()
+		case err := <-errChan:
+			rotateTimer.Stop()
+			dl.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), dnscryptShutdownTimeout)
+			ds.Shutdown(ctx)
+			cancel()
+			if s.Closed() {
+				return ErrServerClosed
+			}
+			if err == nil {
+				err = errors.New("server exited")
+			}
+			return fmt.Errorf("unexpected listener err: %w", err)
+		}
+	}
+}
+
+// dnscryptHandler adapts dns_handler.Handler to dnscrypt.Handler.
+type dnscryptHandler struct {
+	h      dns_handler.Handler
+	logger *zap.Logger
+}
+
+func (h *dnscryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, req *dns.Msg) error {
+	_, fromUDP := rw.RemoteAddr().(*net.UDPAddr)
+	meta := &query_context.RequestMeta{
+		ClientAddr: utils.GetAddrFromAddr(rw.RemoteAddr()),
+		ClientPort: utils.GetPortFromAddr(rw.RemoteAddr()),
+		FromUDP:    fromUDP,
+		Protocol:   "dnscrypt",
+	}
+	r, err := h.h.ServeDNS(context.Background(), req, meta)
+	if err != nil {
+		logHandlerErr(h.logger, err)
+		return err
+	}
+	return rw.WriteMsg(r)
+}
+
+// connAcceptor accepts connections from l and hands them out to its
+// dnscryptListener.
+type connAcceptor struct {
+	l     net.Listener
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{} // closed when the Accept loop exited.
+	err       error         // the Accept err, valid after done was closed.
+}
+
+func newConnAcceptor(l net.Listener) *connAcceptor {
+	a := &connAcceptor{
+		l:      l,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go a.acceptLoop()
+	return a
+}
+
+func (a *connAcceptor) acceptLoop() {
+	defer close(a.done)
+	for {
+		c, err := a.l.Accept()
+		if err != nil {
+			a.err = err
+			return
+		}
+		select {
+		case a.conns <- c:
+		case <-a.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (a *connAcceptor) close() {
+	a.closeOnce.Do(func() { close(a.closed) })
+}
+
+func (a *connAcceptor) listener() *dnscryptListener {
+	return &dnscryptListener{a: a, closed: make(chan struct{})}
+}
+
+type dnscryptListener struct {
+	a         *connAcceptor
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ net.Listener = (*dnscryptListener)(nil)
+
+func (l *dnscryptListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.a.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.a.done:
+		return nil, l.a.err
+	}
+}
+
+// Close closes l only. The underlying listener is not closed.
+func (l *dnscryptListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *dnscryptListener) Addr() net.Addr {
+	return l.a.l.Addr()
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrGenerateDNSCryptKey(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "dnscrypt.key")
+	k1, err := LoadOrGenerateDNSCryptKey(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := LoadOrGenerateDNSCryptKey(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k1, k2) {
+		t.Fatal("saved key is not loaded")
+	}
+}
+
+func TestDNSCryptServer(t *testing.T) {
+	k, err := LoadOrGenerateDNSCryptKey(filepath.Join(t.TempDir(), "dnscrypt.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &DNSCryptOpts{ProviderName: "example", PrivateKey: k, CertTTL: time.Second}
+	s := NewServer(ServerOpts{DNSHandler: &dns_handler.DummyServerHandler{T: t}, DNSCrypt: opts})
+	defer s.Close()
+
+	l := getListener(t)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := s.ServeDNSCrypt(c, l); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	stamp, err := DNSCryptStamp(opts, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(t *testing.T, network string) *dnscrypt.Cert {
+		client := &dnscrypt.Client{Net: network, Timeout: time.Second}
+		ri, err := client.Dial(stamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r, err := client.Exchange(q, ri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != q.Id {
+			t.Fatal("invalid response id")
+		}
+		return ri.ResolverCert
+	}
+
+	var certs []*dnscrypt.Cert
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			certs = append(certs, exchange(t, network))
+		})
+	}
+
+	// Wait for the certificate rotation.
+	time.Sleep(time.Millisecond * 1500)
+	t.Run("rotated", func(t *testing.T) {
+		cert := exchange(t, "tcp")
+		if len(certs) == 0 || cert.ClientMagic == certs[0].ClientMagic {
+			t.Fatal("certificate is not rotated")
+		}
+	})
+}
@@ -22,6 +22,7 @@ package server
 import (
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"io"
 	"net"
 	"net/http"
@@ -43,8 +44,22 @@ func (s *Server) serveHTTP(l net.Listener, https bool) error {
 		return errMissingHTTPHandler
 	}
 
+	h2s := &http2.Server{IdleTimeout: s.opts.IdleTimeout}
+	handler := s.opts.HttpHandler
+	if altSvc := s.opts.AltSvc; len(altSvc) > 0 {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Alt-Svc", altSvc)
+			next.ServeHTTP(w, req)
+		})
+	}
+	if !https {
+		// Also serve http2 over cleartext (h2c), which is used by some
+		// reverse proxies.
+		handler = h2c.NewHandler(handler, h2s)
+	}
 	hs := &http.Server{
-		Handler:           s.opts.HttpHandler,
+		Handler:           handler,
 		ReadHeaderTimeout: time.Millisecond * 500,
 		ReadTimeout:       time.Second * 5,
 		WriteTimeout:      time.Second * 5,
@@ -58,7 +73,7 @@ func (s *Server) serveHTTP(l net.Listener, https bool) error {
 	}
 	defer s.trackCloser(&closer, false)
 
-	if err := http2.ConfigureServer(hs, &http2.Server{IdleTimeout: s.opts.IdleTimeout}); err != nil {
+	if err := http2.ConfigureServer(hs, h2s); err != nil {
 		s.opts.Logger.Error("failed to set up http2 support", zap.Error(err))
 	}
 
@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ServeHTTP3 serves DoH over HTTP/3 (quic) on c. It shares the
+// HttpHandler and certificates with ServeHTTPS.
+func (s *Server) ServeHTTP3(c net.PacketConn) error {
+	defer c.Close()
+
+	if s.opts.HttpHandler == nil {
+		return errMissingHTTPHandler
+	}
+	tlsConf, err := s.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	hs := &http3.Server{
+		Handler:        s.opts.HttpHandler,
+		TLSConfig:      tlsConf,
+		QuicConfig:     &quic.Config{MaxIdleTimeout: s.opts.IdleTimeout},
+		MaxHeaderBytes: 2048,
+	}
+	closer := io.Closer(hs)
+	if ok := s.trackCloser(&closer, true); !ok {
+		return ErrServerClosed
+	}
+	defer s.trackCloser(&closer, false)
+
+	err = hs.Serve(c)
+	if err == http.ErrServerClosed || s.Closed() {
+		return ErrServerClosed
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"time"
+)
+
+// DoQ error codes, RFC 9250 4.3.
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+// ServeQUIC serves DNS over QUIC (RFC 9250) on c. Each query is read from
+// its own stream. Like ServeTLS, the tls server name of the connection is
+// passed to the handler.
+func (s *Server) ServeQUIC(c net.PacketConn) error {
+	defer c.Close()
+
+	handler := s.opts.DNSHandler
+	if handler == nil {
+		return errMissingDNSHandler
+	}
+	tlsConf, err := s.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConf.NextProtos = []string{"doq"}
+
+	qc := &quic.Config{
+		MaxIdleTimeout:        s.opts.IdleTimeout,
+		MaxIncomingUniStreams: -1, // DoQ only uses bidirectional streams.
+	}
+	if n := s.opts.MaxInflightPerConn; n > 0 {
+		qc.MaxIncomingStreams = int64(n)
+	}
+	l, err := quic.Listen(c, tlsConf, qc)
+	if err != nil {
+		return err
+	}
+	closer := io.Closer(l)
+	if ok := s.trackCloser(&closer, true); !ok {
+		return ErrServerClosed
+	}
+	defer s.trackCloser(&closer, false)
+
+	listenerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		conn, err := l.Accept(listenerCtx)
+		if err != nil {
+			if s.Closed() {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("unexpected listener err: %w", err)
+		}
+		go s.handleQUICConn(conn, handler)
+	}
+}
+
+// quicConnCloser closes a quic.Connection without an error.
+type quicConnCloser struct {
+	conn quic.Connection
+}
+
+func (c quicConnCloser) Close() error {
+	return c.conn.CloseWithError(doqNoError, "")
+}
+
+func (s *Server) handleQUICConn(conn quic.Connection, handler dns_handler.Handler) {
+	closer := io.Closer(quicConnCloser{conn: conn})
+	if !s.trackCloser(&closer, true) {
+		closer.Close()
+		return
+	}
+	defer s.trackCloser(&closer, false)
+
+	meta := &query_context.RequestMeta{
+		ClientAddr: utils.GetAddrFromAddr(conn.RemoteAddr()),
+		ClientPort: utils.GetPortFromAddr(conn.RemoteAddr()),
+		Protocol:   "quic",
+		ServerName: conn.ConnectionState().TLS.ServerName,
+	}
+	ctx := conn.Context() // canceled when the connection is closed.
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return // connection closed or idle timeout
+		}
+		go s.handleQUICStream(ctx, conn, stream, handler, meta)
+	}
+}
+
+// handleQUICStream reads a query from stream, and writes the response
+// and closes the stream.
+func (s *Server) handleQUICStream(ctx context.Context, conn quic.Connection, stream quic.Stream, handler dns_handler.Handler, meta *query_context.RequestMeta) {
+	defer stream.Close()
+
+	idleTimeout := s.opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	stream.SetReadDeadline(time.Now().Add(idleTimeout))
+	req, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+	if req.Id != 0 { // RFC 9250 4.2.1
+		conn.CloseWithError(doqProtocolError, "message id is not 0")
+		return
+	}
+
+	r, err := handler.ServeDNS(ctx, req, meta)
+	if err != nil {
+		logHandlerErr(s.opts.Logger, err)
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+
+	b, buf, err := pool.PackBuffer(r)
+	if err != nil {
+		s.opts.Logger.Error("failed to unpack handler's response", zap.Error(err), zap.Stringer("msg", r))
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	defer buf.Release()
+
+	if _, err := dnsutils.WriteRawMsgToTCP(stream, b); err != nil {
+		s.opts.Logger.Warn("failed to write response", zap.Stringer("client", conn.RemoteAddr()), zap.Error(err))
+	}
+}
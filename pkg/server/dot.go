@@ -26,6 +26,18 @@ import (
 )
 
 func (s *Server) ServeTLS(l net.Listener) error {
+	tlsConf, err := s.serverTLSConfig()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	l = tls.NewListener(l, tlsConf)
+	return s.ServeTCP(l)
+}
+
+// serverTLSConfig returns a copy of opts.TLSConfig with the certificate
+// of opts.Cert and opts.Key.
+func (s *Server) serverTLSConfig() (*tls.Config, error) {
 	var tlsConf *tls.Config
 	if s.opts.TLSConfig != nil {
 		tlsConf = s.opts.TLSConfig.Clone()
@@ -36,15 +48,13 @@ func (s *Server) ServeTLS(l net.Listener) error {
 	if len(s.opts.Key)+len(s.opts.Cert) != 0 {
 		cert, err := tls.LoadX509KeyPair(s.opts.Cert, s.opts.Key)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		tlsConf.Certificates = append(tlsConf.Certificates, cert)
 	}
 
-	if len(tlsConf.Certificates) == 0 {
-		return errors.New("missing certificate for tls listener")
+	if len(tlsConf.Certificates) == 0 && tlsConf.GetCertificate == nil {
+		return nil, errors.New("missing certificate for tls listener")
 	}
-
-	l = tls.NewListener(l, tlsConf)
-	return s.ServeTCP(l)
+	return tlsConf, nil
 }
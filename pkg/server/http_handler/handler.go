@@ -30,6 +30,7 @@ import (
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"io"
+	"mime"
 	"net/http"
 	"net/netip"
 	"strings"
@@ -48,9 +49,18 @@ type HandlerOpts struct {
 	Path string
 
 	// SrcIPHeader specifies the header that contain client source address.
-	// e.g. "X-Forwarded-For".
+	// e.g. "X-Forwarded-For", "X-Real-IP". If the header has a list of
+	// addresses, it is walked from the right and the first address that is
+	// not in TrustedProxies is used, since addresses on its left may be
+	// forged by the client. If all addresses are trusted, the leftmost
+	// one is used.
 	SrcIPHeader string
 
+	// TrustedProxies specifies the peers whose SrcIPHeader is trusted.
+	// SrcIPHeader of other peers is ignored. If it is empty, all peers
+	// are trusted.
+	TrustedProxies []netip.Prefix
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
@@ -89,17 +99,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	clientAddr := addrPort.Addr()
+	clientPort := addrPort.Port()
 
 	// read remote addr from header
-	if header := h.opts.SrcIPHeader; len(header) != 0 {
-		if xff := req.Header.Get(header); len(xff) != 0 {
-			addr, err := readClientAddrFromXFF(xff)
+	if header := h.opts.SrcIPHeader; len(header) != 0 && h.trustedProxy(clientAddr) {
+		if xff := strings.Join(req.Header.Values(header), ","); len(xff) != 0 {
+			addr, err := h.readClientAddrFromXFF(xff)
 			if err != nil {
 				h.warnErr(req, "failed to get client ip from header", fmt.Errorf("failed to prase header %s: %s, %s", header, xff, err))
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 			clientAddr = addr
+			clientPort = 0
 		}
 	}
 
@@ -118,8 +130,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r, err := h.opts.DNSHandler.ServeDNS(req.Context(), q, &query_context.RequestMeta{ClientAddr: clientAddr})
+	meta := &query_context.RequestMeta{ClientAddr: clientAddr, ClientPort: clientPort, Protocol: "http"}
+	if req.TLS != nil {
+		meta.ServerName = req.TLS.ServerName
+		meta.Protocol = "https"
+	}
+	if req.ProtoMajor == 3 {
+		meta.Protocol = "h3"
+	}
+	r, err := h.opts.DNSHandler.ServeDNS(req.Context(), q, meta)
 	if err != nil {
+		if errors.Is(err, dns_handler.ErrDrop) {
+			panic(http.ErrAbortHandler) // Close connection without logging.
+		}
 		panic(err.Error()) // Force http server to close connection.
 	}
 
@@ -131,7 +154,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	defer buf.Release()
 
-	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Content-Type", dnsMsgMediaType)
 	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dnsutils.GetMinimalTTL(r)))
 	if _, err := w.Write(b); err != nil {
 		h.warnErr(req, "failed to write response", err)
@@ -139,13 +162,69 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func readClientAddrFromXFF(s string) (netip.Addr, error) {
-	if i := strings.IndexRune(s, ','); i > 0 {
-		return netip.ParseAddr(s[:i])
+func (h *Handler) trustedProxy(addr netip.Addr) bool {
+	if len(h.opts.TrustedProxies) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range h.opts.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readClientAddrFromXFF reads the rightmost address in the list s that is
+// not a trusted proxy, or the leftmost address if all of them are trusted.
+// Addresses may have a port, e.g. "1.2.3.4:5678", "[2001:db8::1]:5678".
+func (h *Handler) readClientAddrFromXFF(s string) (netip.Addr, error) {
+	l := strings.Split(s, ",")
+	var addr netip.Addr
+	for i := len(l) - 1; i >= 0; i-- {
+		var err error
+		addr, err = parseXFFAddr(l[i])
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if !h.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+func parseXFFAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr(), nil
+	}
+	return netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// hasMediaType reports whether the header value v, which can be a list
+// of media types with parameters, has the dns message media type. If
+// allowAny is true, "*/*" and "application/*" also match.
+func hasMediaType(v string, allowAny bool) bool {
+	for _, s := range strings.Split(v, ",") {
+		mt, _, err := mime.ParseMediaType(s)
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case dnsMsgMediaType:
+			return true
+		case "*/*", "application/*":
+			if allowAny {
+				return true
+			}
+		}
 	}
-	return netip.ParseAddr(s)
+	return false
 }
 
+const dnsMsgMediaType = "application/dns-message"
+
 var errInvalidMediaType = errors.New("missing or invalid media type header")
 
 var bufPool = pool.NewBytesBufPool(512)
@@ -155,8 +234,8 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 
 	switch req.Method {
 	case http.MethodGet:
-		// Check accept header
-		if req.Header.Get("Accept") != "application/dns-message" {
+		// Check accept header. Clients may omit it.
+		if accept := req.Header.Get("Accept"); len(accept) != 0 && !hasMediaType(accept, true) {
 			return nil, errInvalidMediaType
 		}
 
@@ -177,7 +256,7 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 
 	case http.MethodPost:
 		// Check Content-Type header
-		if req.Header.Get("Content-Type") != "application/dns-message" {
+		if !hasMediaType(req.Header.Get("Content-Type"), false) {
 			return nil, errInvalidMediaType
 		}
 
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// clientAddrHandler replies the client address of the request in a TXT record.
+type clientAddrHandler struct{}
+
+func (clientAddrHandler) ServeDNS(_ context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{meta.ClientAddr.String()},
+	})
+	return r, nil
+}
+
+func TestHandler_ServeHTTP(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHandler(HandlerOpts{
+		DNSHandler:     clientAddrHandler{},
+		Path:           "/dns-query",
+		SrcIPHeader:    "X-Forwarded-For",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(accept string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		return req
+	}
+	post := func(contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(wire))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	withHeader := func(req *http.Request, remoteAddr, xff string) *http.Request {
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", xff)
+		return req
+	}
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantCode   int
+		wantClient string
+	}{
+		{"get", get("application/dns-message"), http.StatusOK, "192.0.2.1"},
+		{"get without accept", get(""), http.StatusOK, "192.0.2.1"},
+		{"get accept any", get("text/html, */*;q=0.8"), http.StatusOK, "192.0.2.1"},
+		{"get invalid accept", get("text/html"), http.StatusBadRequest, ""},
+		{"post", post("application/dns-message"), http.StatusOK, "192.0.2.1"},
+		{"post with params", post("application/dns-message; charset=utf-8"), http.StatusOK, "192.0.2.1"},
+		{"post invalid content type", post("application/json"), http.StatusBadRequest, ""},
+		{"invalid path", httptest.NewRequest(http.MethodGet, "/other", nil), http.StatusNotFound, ""},
+		{"xff from trusted proxy", withHeader(post("application/dns-message"), "127.0.0.1:1234", " 2001:db8::1 , 10.0.0.1"), http.StatusOK, "2001:db8::1"},
+		{"xff forged by client", withHeader(post("application/dns-message"), "127.0.0.1:1234", "192.0.2.9, 2001:db8::1, 10.0.0.1"), http.StatusOK, "2001:db8::1"},
+		{"xff forged junk", withHeader(post("application/dns-message"), "127.0.0.1:1234", "junk, 2001:db8::1"), http.StatusOK, "2001:db8::1"},
+		{"xff all trusted", withHeader(post("application/dns-message"), "127.0.0.1:1234", "10.0.0.2, 10.0.0.1"), http.StatusOK, "10.0.0.2"},
+		{"xff with port", withHeader(post("application/dns-message"), "127.0.0.1:1234", "[2001:db8::1]:5678"), http.StatusOK, "2001:db8::1"},
+		{"xff from untrusted peer", withHeader(post("application/dns-message"), "192.0.2.2:1234", "2001:db8::1"), http.StatusOK, "192.0.2.2"},
+		{"invalid xff", withHeader(post("application/dns-message"), "127.0.0.1:1234", "junk"), http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want status %d, got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/dns-message" {
+				t.Fatalf("invalid content type %s", ct)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.TXT).Txt[0]; got != tt.wantClient {
+				t.Fatalf("want client %s, got %s", tt.wantClient, got)
+			}
+		})
+	}
+}
@@ -62,6 +62,20 @@ type ServerOpts struct {
 	// IdleTimeout limits the maximum time period that a connection
 	// can idle. Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// AltSvc is the value of the Alt-Svc header of HTTP, DoH responses,
+	// e.g. `h3=":443"; ma=86400`, which advertises the HTTP/3 listener.
+	// Default is empty, no Alt-Svc header.
+	AltSvc string
+
+	// MaxInflightPerConn limits the number of concurrent (pipelined)
+	// queries of each TCP, DoT connection. The server stops reading a
+	// connection until one of its queries is finished. Default is 0,
+	// which means no limit.
+	MaxInflightPerConn int
+
+	// DNSCrypt is required by DNSCrypt server.
+	DNSCrypt *DNSCryptOpts
 }
 
 func (opts *ServerOpts) init() {
@@ -137,3 +151,12 @@ func (s *Server) Close() {
 	}
 	return
 }
+
+// logHandlerErr logs the err returned by a dns_handler.Handler.
+func logHandlerErr(lg *zap.Logger, err error) {
+	if errors.Is(err, dns_handler.ErrDrop) {
+		lg.Debug("request dropped by handler")
+		return
+	}
+	lg.Warn("handler err", zap.Error(err))
+}
@@ -20,14 +20,22 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/server/http_handler"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/miekg/dns"
+	"io"
 	"net"
+	"net/http"
 	"sync"
 	"testing"
 	"time"
@@ -151,6 +159,11 @@ func TestTCPDoTServer(t *testing.T) {
 			scheme: "tcp",
 			opts:   ServerOpts{DNSHandler: dnsHandler},
 		},
+		{
+			name:   "tcp with max inflight",
+			scheme: "tcp",
+			opts:   ServerOpts{DNSHandler: dnsHandler, MaxInflightPerConn: 2},
+		},
 		{
 			name:   "dot with tls config",
 			scheme: "tls",
@@ -198,6 +211,80 @@ func TestTCPDoTServer(t *testing.T) {
 	}
 }
 
+// blockingHandler blocks every query until release receives a value.
+type blockingHandler struct {
+	started chan uint16
+	release chan struct{}
+}
+
+func (h *blockingHandler) ServeDNS(ctx context.Context, req *dns.Msg, _ *query_context.RequestMeta) (*dns.Msg, error) {
+	h.started <- req.Id
+	select {
+	case <-h.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestTCPServer_maxInflight(t *testing.T) {
+	const maxInflight = 2
+	h := &blockingHandler{started: make(chan uint16, maxInflight+1), release: make(chan struct{})}
+	l := getListener(t)
+	s := NewServer(ServerOpts{DNSHandler: h, MaxInflightPerConn: maxInflight})
+	go s.ServeTCP(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 1; i <= maxInflight+1; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = uint16(i)
+		if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitStarted := func() uint16 {
+		t.Helper()
+		select {
+		case id := <-h.started:
+			return id
+		case <-time.After(time.Second):
+			t.Fatal("query is not served")
+			return 0
+		}
+	}
+	for i := 0; i < maxInflight; i++ {
+		waitStarted()
+	}
+	select {
+	case id := <-h.started:
+		t.Fatalf("query %d is served while %d queries are inflight", id, maxInflight)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// Finish one query, then the last one can be served.
+	h.release <- struct{}{}
+	if id := waitStarted(); id != maxInflight+1 {
+		t.Fatalf("want query %d to be served, got %d", maxInflight+1, id)
+	}
+	close(h.release)
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < maxInflight+1; i++ {
+		if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestDoHServer(t *testing.T) {
 	dnsHandler := &dns_handler.DummyServerHandler{T: t}
 	opts := http_handler.HandlerOpts{
@@ -249,3 +336,205 @@ func TestDoHServer(t *testing.T) {
 		})
 	}
 }
+
+// serverNameHandler replies the server name of the request in a TXT record.
+type serverNameHandler struct {
+	prefix string
+}
+
+func (h *serverNameHandler) ServeDNS(_ context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{h.prefix + meta.ServerName},
+	})
+	return r, nil
+}
+
+func TestDoTServerSNIRouting(t *testing.T) {
+	defaultCert, err := utils.GenerateCertificate("default.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wildcardCert, err := utils.GenerateCertificate("*.family.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := dns_handler.NewSNIRouter(&serverNameHandler{prefix: "default:"})
+	if err := router.Add("work.test", &serverNameHandler{prefix: "work:"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Add("*.family.test", &serverNameHandler{prefix: "family:"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Add("a.*.test", &serverNameHandler{}); err == nil {
+		t.Fatal("invalid wildcard name should be rejected")
+	}
+
+	l := getListener(t)
+	s := NewServer(ServerOpts{
+		DNSHandler: router,
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{defaultCert, wildcardCert}},
+	})
+	go s.ServeTLS(l)
+	defer s.Close()
+
+	tests := []struct {
+		serverName string
+		wantTxt    string
+		wantCertCN string
+	}{
+		{"work.test", "work:work.test", "default.test"},
+		{"kids.family.test", "family:kids.family.test", "*.family.test"},
+		{"a.kids.family.test", "default:a.kids.family.test", "default.test"},
+		{"other.test", "default:other.test", "default.test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if cn := c.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != tt.wantCertCN {
+				t.Fatalf("want certificate %s, got %s", tt.wantCertCN, cn)
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeTXT)
+			if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+				t.Fatal(err)
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second * 3))
+			r, _, err := dnsutils.ReadMsgFromTCP(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if txt := r.Answer[0].(*dns.TXT).Txt[0]; txt != tt.wantTxt {
+				t.Fatalf("want %s, got %s", tt.wantTxt, txt)
+			}
+		})
+	}
+}
+
+func TestDoQServer(t *testing.T) {
+	router := dns_handler.NewSNIRouter(&serverNameHandler{prefix: "default:"})
+	if err := router.Add("work.test", &serverNameHandler{prefix: "work:"}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ServerOpts{DNSHandler: router, TLSConfig: getTLSConfig(t), IdleTimeout: time.Second * 3})
+	defer s.Close()
+	c := getUDPListener(t)
+	go func() {
+		if err := s.ServeQUIC(c); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+
+	exchange := func(serverName string, id uint16) (*dns.Msg, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		conn, err := quic.DialAddrContext(ctx, c.LocalAddr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.CloseWithError(0, "")
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, err
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeTXT)
+		q.Id = id
+		if _, err := dnsutils.WriteMsgToTCP(stream, q); err != nil {
+			return nil, err
+		}
+		stream.Close()
+		stream.SetReadDeadline(time.Now().Add(time.Second * 3))
+		r, _, err := dnsutils.ReadMsgFromTCP(stream)
+		return r, err
+	}
+
+	for serverName, want := range map[string]string{
+		"work.test":  "work:work.test",
+		"other.test": "default:other.test",
+	} {
+		r, err := exchange(serverName, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txt := r.Answer[0].(*dns.TXT).Txt[0]; txt != want {
+			t.Fatalf("want %s, got %s", want, txt)
+		}
+	}
+	if _, err := exchange("work.test", 1); err == nil {
+		t.Fatal("query with a non-zero message id should fail")
+	}
+}
+
+func TestHTTP3Server(t *testing.T) {
+	dnsHandler := &dns_handler.DummyServerHandler{T: t}
+	httpHandler, err := http_handler.NewHandler(http_handler.HandlerOpts{DNSHandler: dnsHandler, Path: "/dns-query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := getTLSConfig(t)
+	s := NewServer(ServerOpts{HttpHandler: httpHandler, TLSConfig: tlsConfig, AltSvc: `h3=":443"`})
+	defer s.Close()
+
+	c := getUDPListener(t)
+	go func() {
+		if err := s.ServeHTTP3(c); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	l := getListener(t)
+	go func() {
+		if err := s.ServeHTTPS(l); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLSConfig := &tls.Config{InsecureSkipVerify: true}
+	rt := &http3.RoundTripper{TLSClientConfig: clientTLSConfig}
+	defer rt.Close()
+	for _, tt := range []struct {
+		name string
+		rt   http.RoundTripper
+		url  string
+	}{
+		{"h3", rt, "https://" + c.LocalAddr().String() + "/dns-query"},
+		{"h2", &http.Transport{TLSClientConfig: clientTLSConfig, ForceAttemptHTTP2: true}, "https://" + l.Addr().String() + "/dns-query"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := (&http.Client{Transport: tt.rt, Timeout: time.Second * 2}).Post(tt.url, "application/dns-message", bytes.NewReader(wire))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("want status 200, got %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Alt-Svc"); tt.name == "h2" && got != `h3=":443"` {
+				t.Fatalf("invalid Alt-Svc header %q", got)
+			}
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(b); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
@@ -38,6 +39,12 @@ const (
 )
 
 func (s *Server) ServeTCP(l net.Listener) error {
+	return s.serveTCP(l, false)
+}
+
+// serveTCP serves l. If origDst, the original destination of the
+// connections is recorded, see ServeTProxyTCP.
+func (s *Server) serveTCP(l net.Listener, origDst bool) error {
 	defer l.Close()
 
 	handler := s.opts.DNSHandler
@@ -84,6 +91,31 @@ func (s *Server) ServeTCP(l net.Listener) error {
 			clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
 			meta := &query_context.RequestMeta{
 				ClientAddr: clientAddr,
+				ClientPort: utils.GetPortFromAddr(c.RemoteAddr()),
+				Protocol:   "tcp",
+			}
+			if c.LocalAddr().Network() == "unix" {
+				meta.Protocol = "unix"
+			}
+			if origDst {
+				meta.OriginalDst = tcpOriginalDst(c)
+			}
+
+			// Finish the tls handshake first, so the handler knows the server name.
+			if tlsConn, ok := c.(*tls.Conn); ok {
+				c.SetDeadline(time.Now().Add(idleTimeout))
+				if err := tlsConn.HandshakeContext(tcpConnCtx); err != nil {
+					s.opts.Logger.Debug("tls handshake failed", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+					return
+				}
+				c.SetDeadline(time.Time{})
+				meta.ServerName = tlsConn.ConnectionState().ServerName
+				meta.Protocol = "tls"
+			}
+
+			var inflight chan struct{}
+			if n := s.opts.MaxInflightPerConn; n > 0 {
+				inflight = make(chan struct{}, n)
 			}
 
 			firstRead := true
@@ -99,11 +131,22 @@ func (s *Server) ServeTCP(l net.Listener) error {
 					return // read err, close the connection
 				}
 
-				// handle query
+				// Queries are handled concurrently and responses are sent
+				// out of order, as RFC 7766 6.2.1.1 suggested.
+				if inflight != nil {
+					select {
+					case inflight <- struct{}{}:
+					case <-tcpConnCtx.Done():
+						return
+					}
+				}
 				go func() {
+					if inflight != nil {
+						defer func() { <-inflight }()
+					}
 					r, err := handler.ServeDNS(tcpConnCtx, req, meta)
 					if err != nil {
-						s.opts.Logger.Warn("handler err", zap.Error(err))
+						logHandlerErr(s.opts.Logger, err)
 						c.Close()
 						return
 					}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// ServeTProxyUDP serves udp packets that were redirected by the iptables
+// TPROXY target. c must be opened by ListenTProxyUDP. The original
+// destination is recorded in query_context.RequestMeta and responses are
+// sent from it, as clients expect.
+func (s *Server) ServeTProxyUDP(c *net.UDPConn) error {
+	defer c.Close()
+
+	handler := s.opts.DNSHandler
+	if handler == nil {
+		return errMissingDNSHandler
+	}
+
+	closer := io.Closer(c)
+	if ok := s.trackCloser(&closer, true); !ok {
+		return ErrServerClosed
+	}
+	defer s.trackCloser(&closer, false)
+
+	listenerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	readBuf := pool.GetBuf(64 * 1024)
+	defer readBuf.Release()
+	rb := readBuf.Bytes()
+	oob := make([]byte, 1024)
+
+	for {
+		n, oobn, _, remoteAddr, err := c.ReadMsgUDPAddrPort(rb, oob)
+		if err != nil {
+			if s.Closed() {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("unexpected read err: %w", err)
+		}
+		origDst, ok := parseOrigDst(oob[:oobn])
+
+		q := new(dns.Msg)
+		if err := q.Unpack(rb[:n]); err != nil {
+			s.opts.Logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", rb[:n]), zap.Stringer("from", remoteAddr))
+			continue
+		}
+
+		// handle query
+		go func() {
+			meta := &query_context.RequestMeta{
+				ClientAddr:  remoteAddr.Addr(),
+				ClientPort:  remoteAddr.Port(),
+				FromUDP:     true,
+				Protocol:    "udp",
+				OriginalDst: origDst,
+			}
+
+			r, err := handler.ServeDNS(listenerCtx, q, meta)
+			if err != nil {
+				logHandlerErr(s.opts.Logger, err)
+				return
+			}
+			if r != nil {
+				r.Truncate(getUDPSize(q))
+				b, buf, err := pool.PackBuffer(r)
+				if err != nil {
+					s.opts.Logger.Error("failed to unpack handler's response", zap.Error(err), zap.Stringer("msg", r))
+					return
+				}
+				defer buf.Release()
+				sent := false
+				if ok {
+					err = writeFromOrigDst(b, origDst, remoteAddr)
+					// EADDRINUSE: the packet was sent to the listener itself.
+					sent = !errors.Is(err, syscall.EADDRINUSE)
+				}
+				if !sent {
+					_, err = c.WriteToUDPAddrPort(b, remoteAddr)
+				}
+				if err != nil {
+					s.opts.Logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+				}
+			}
+		}()
+	}
+}
+
+// writeFromOrigDst sends b to the client with the source address origDst.
+func writeFromOrigDst(b []byte, origDst, client netip.AddrPort) error {
+	c, err := listenTransparentUDP(origDst)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if origDst.Addr().Is4() {
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	}
+	_, err = c.WriteToUDPAddrPort(b, client)
+	return err
+}
+
+// ServeTProxyTCP is like ServeTCP, but it records the original destination
+// of the connections, which were redirected by the iptables TPROXY or
+// REDIRECT target, in query_context.RequestMeta. For TPROXY, l must be
+// opened by ListenTProxyTCP.
+func (s *Server) ServeTProxyTCP(l net.Listener) error {
+	return s.serveTCP(l, true)
+}
@@ -0,0 +1,196 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of netfilter.
+const soOriginalDst = 80
+
+// ListenTProxyUDP listens on addr with IP_TRANSPARENT, so it can receive
+// packets redirected by the iptables TPROXY target. The original
+// destination of the packets is received as cmsg. It requires CAP_NET_ADMIN.
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		return controlTransparent(c, true)
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// ListenTProxyTCP listens on addr with IP_TRANSPARENT, so it can accept
+// connections redirected by the iptables TPROXY target. It requires
+// CAP_NET_ADMIN.
+func ListenTProxyTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		return controlTransparent(c, false)
+	}}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// controlTransparent sets IP_TRANSPARENT on c. If recvOrigDst, it also
+// asks the kernel for the original destination of udp packets.
+func controlTransparent(c syscall.RawConn, recvOrigDst bool) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			sockErr = os.NewSyscallError("failed to get SO_DOMAIN", err)
+			return
+		}
+		// A dual stack socket receives ipv4 packets with SOL_IP cmsg.
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+			sockErr = os.NewSyscallError("failed to set IP_TRANSPARENT", err)
+			return
+		}
+		if recvOrigDst {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+				sockErr = os.NewSyscallError("failed to set IP_RECVORIGDSTADDR", err)
+				return
+			}
+		}
+		if domain != unix.AF_INET6 {
+			return
+		}
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			sockErr = os.NewSyscallError("failed to set IPV6_TRANSPARENT", err)
+			return
+		}
+		if recvOrigDst {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+				sockErr = os.NewSyscallError("failed to set IPV6_RECVORIGDSTADDR", err)
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseOrigDst reads the original destination from the cmsg of a packet
+// received by a ListenTProxyUDP socket.
+func parseOrigDst(oob []byte) (netip.AddrPort, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet4:
+			// struct sockaddr_in: family, port, addr
+			addr := netip.AddrFrom4(*(*[4]byte)(m.Data[4:8]))
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(m.Data[2:4])), true
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet6:
+			// struct sockaddr_in6: family, port, flowinfo, addr
+			addr := netip.AddrFrom16(*(*[16]byte)(m.Data[8:24]))
+			return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(m.Data[2:4])), true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// listenTransparentUDP opens a udp socket on laddr, which can be a non-local
+// address, so responses can be sent from the original destination.
+func listenTransparentUDP(laddr netip.AddrPort) (*net.UDPConn, error) {
+	network := "udp4"
+	if laddr.Addr().Is6() {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			// The port might have been bound by the listener.
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+				sockErr = os.NewSyscallError("failed to set SO_REUSEADDR", err)
+				return
+			}
+			level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+			if network == "udp6" {
+				level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+			}
+			if err := unix.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+				sockErr = os.NewSyscallError("failed to set IP_TRANSPARENT", err)
+			}
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	c, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// tcpOriginalDst returns the original destination of a connection that was
+// redirected by iptables REDIRECT (SO_ORIGINAL_DST). Otherwise, e.g. it was
+// redirected by TPROXY, the original destination is the local address of c.
+func tcpOriginalDst(c net.Conn) netip.AddrPort {
+	local, _ := netip.ParseAddrPort(c.LocalAddr().String())
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return local
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return local
+	}
+
+	var dst netip.AddrPort
+	rc.Control(func(fd uintptr) {
+		if local.Addr().Is4() || local.Addr().Is4In6() {
+			// struct sockaddr_in fits in IPv6Mreq.
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				return
+			}
+			addr := netip.AddrFrom4(*(*[4]byte)(mreq.Multiaddr[4:8]))
+			dst = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+			return
+		}
+		// struct sockaddr_in6 is the first field of IPv6MTUInfo.
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			return
+		}
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), port)
+	})
+	if !dst.IsValid() {
+		return local
+	}
+	return dst
+}
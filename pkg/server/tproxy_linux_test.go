@@ -0,0 +1,104 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+type origDstHandler struct {
+	dst chan netip.AddrPort
+}
+
+func (h *origDstHandler) ServeDNS(_ context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	h.dst <- meta.OriginalDst
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestTProxyUDPServer(t *testing.T) {
+	c, err := ListenTProxyUDP("127.0.0.1:0")
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("tproxy requires CAP_NET_ADMIN")
+		}
+		t.Fatal(err)
+	}
+	h := &origDstHandler{dst: make(chan netip.AddrPort, 1)}
+	s := NewServer(ServerOpts{DNSHandler: h})
+	defer s.Close()
+	go func() {
+		if err := s.ServeTProxyUDP(c); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+
+	// Without a TPROXY rule, the original destination is the listener.
+	laddr := c.LocalAddr().String()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	if _, _, err := client.Exchange(q, laddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-h.dst; got.String() != laddr {
+		t.Fatalf("want original destination %s, got %s", laddr, got)
+	}
+}
+
+func TestTProxyTCPServer(t *testing.T) {
+	l, err := ListenTProxyTCP("127.0.0.1:0")
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("tproxy requires CAP_NET_ADMIN")
+		}
+		t.Fatal(err)
+	}
+	h := &origDstHandler{dst: make(chan netip.AddrPort, 1)}
+	s := NewServer(ServerOpts{DNSHandler: h})
+	defer s.Close()
+	go func() {
+		if err := s.ServeTProxyTCP(l); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+
+	laddr := l.Addr().(*net.TCPAddr).String()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	if _, _, err := client.Exchange(q, laddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-h.dst; got.String() != laddr {
+		t.Fatalf("want original destination %s, got %s", laddr, got)
+	}
+}
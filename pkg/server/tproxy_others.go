@@ -0,0 +1,53 @@
+//go:build !linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errTProxyNotSupported = errors.New("tproxy is only supported on linux")
+
+// ListenTProxyUDP is only supported on linux.
+func ListenTProxyUDP(_ string) (*net.UDPConn, error) {
+	return nil, errTProxyNotSupported
+}
+
+// ListenTProxyTCP is only supported on linux.
+func ListenTProxyTCP(_ string) (net.Listener, error) {
+	return nil, errTProxyNotSupported
+}
+
+func parseOrigDst(_ []byte) (netip.AddrPort, bool) {
+	return netip.AddrPort{}, false
+}
+
+func listenTransparentUDP(_ netip.AddrPort) (*net.UDPConn, error) {
+	return nil, errTProxyNotSupported
+}
+
+func tcpOriginalDst(c net.Conn) netip.AddrPort {
+	local, _ := netip.ParseAddrPort(c.LocalAddr().String())
+	return local
+}
@@ -37,6 +37,13 @@ type cmcUDPConn interface {
 	writeTo(b []byte, src net.IP, IfIndex int, dst net.Addr) (n int, err error)
 }
 
+// UDPSocketStats contains kernel statistics of a udp socket.
+type UDPSocketStats struct {
+	RcvBuf int    // effective SO_RCVBUF in bytes
+	SndBuf int    // effective SO_SNDBUF in bytes
+	Drops  uint64 // datagrams dropped by the kernel, e.g. due to a full receive buffer
+}
+
 func (s *Server) ServeUDP(c net.PacketConn) error {
 	defer c.Close()
 
@@ -70,6 +77,13 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 		cmc = newDummyCmc(c)
 	}
 
+	// Unix datagram sockets have no practical size limit, responses
+	// are not truncated.
+	protocol := "udp"
+	if c.LocalAddr().Network() == "unixgram" {
+		protocol = "unixgram"
+	}
+
 	for {
 		n, localAddr, ifIndex, remoteAddr, err := cmc.readFrom(rb)
 		if err != nil {
@@ -90,15 +104,20 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 		go func() {
 			meta := &query_context.RequestMeta{
 				ClientAddr: clientAddr,
+				ClientPort: utils.GetPortFromAddr(remoteAddr),
+				FromUDP:    protocol == "udp",
+				Protocol:   protocol,
 			}
 
 			r, err := handler.ServeDNS(listenerCtx, q, meta)
 			if err != nil {
-				s.opts.Logger.Warn("handler err", zap.Error(err))
+				logHandlerErr(s.opts.Logger, err)
 				return
 			}
 			if r != nil {
-				r.Truncate(getUDPSize(q))
+				if protocol == "udp" {
+					r.Truncate(getUDPSize(q))
+				}
 				b, buf, err := pool.PackBuffer(r)
 				if err != nil {
 					s.opts.Logger.Error("failed to unpack handler's response", zap.Error(err), zap.Stringer("msg", r))
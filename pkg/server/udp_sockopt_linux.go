@@ -0,0 +1,150 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SetUDPSocketBuffers sets SO_RCVBUF and SO_SNDBUF of c. Zero or negative
+// values are ignored. It tries SO_RCVBUFFORCE/SO_SNDBUFFORCE first so that
+// privileged processes can exceed net.core.rmem_max/wmem_max, and falls back
+// to the normal options (which are silently capped by the kernel).
+func SetUDPSocketBuffers(c *net.UDPConn, rcvBuf, sndBuf int) error {
+	sc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	if err := sc.Control(func(fd uintptr) {
+		if rcvBuf > 0 {
+			if err := setBuf(int(fd), unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, rcvBuf); err != nil {
+				setErr = os.NewSyscallError("failed to set SO_RCVBUF", err)
+				return
+			}
+		}
+		if sndBuf > 0 {
+			if err := setBuf(int(fd), unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, sndBuf); err != nil {
+				setErr = os.NewSyscallError("failed to set SO_SNDBUF", err)
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return setErr
+}
+
+func setBuf(fd, forceOpt, opt, v int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, forceOpt, v); err == nil {
+		return nil
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, v)
+}
+
+// GetUDPSocketStats reads the effective buffer sizes of c and the number of
+// datagrams the kernel dropped on it. Drops are read from /proc/net/udp{,6}.
+func GetUDPSocketStats(c *net.UDPConn) (*UDPSocketStats, error) {
+	sc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := new(UDPSocketStats)
+	var inode uint64
+	var controlErr error
+	if err := sc.Control(func(fd uintptr) {
+		if stats.RcvBuf, controlErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); controlErr != nil {
+			controlErr = os.NewSyscallError("failed to get SO_RCVBUF", controlErr)
+			return
+		}
+		if stats.SndBuf, controlErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF); controlErr != nil {
+			controlErr = os.NewSyscallError("failed to get SO_SNDBUF", controlErr)
+			return
+		}
+		var st unix.Stat_t
+		if controlErr = unix.Fstat(int(fd), &st); controlErr != nil {
+			controlErr = os.NewSyscallError("failed to stat socket", controlErr)
+			return
+		}
+		inode = st.Ino
+	}); err != nil {
+		return nil, err
+	}
+	if controlErr != nil {
+		return nil, controlErr
+	}
+
+	for _, fn := range [...]string{"/proc/net/udp", "/proc/net/udp6"} {
+		drops, ok, err := readProcUDPDrops(fn, inode)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if ok {
+			stats.Drops = drops
+			return stats, nil
+		}
+	}
+	return nil, fmt.Errorf("socket inode %d not found in /proc/net/udp", inode)
+}
+
+// readProcUDPDrops finds the socket with the given inode in a /proc/net/udp
+// formatted file and returns its drops column.
+func readProcUDPDrops(fn string, inode uint64) (uint64, bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	return parseProcUDPDrops(f, inode)
+}
+
+func parseProcUDPDrops(r io.Reader, inode uint64) (uint64, bool, error) {
+	s := bufio.NewScanner(r)
+	s.Scan() // skip the header
+	for s.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(s.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		if fields[9] != strconv.FormatUint(inode, 10) {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid drops field %s, %w", fields[12], err)
+		}
+		return drops, true, nil
+	}
+	return 0, false, s.Err()
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_parseProcUDPDrops(t *testing.T) {
+	data := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  253: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 0
+  254: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 23456 2 0000000000000000 42
+`
+	drops, ok, err := parseProcUDPDrops(strings.NewReader(data), 23456)
+	if err != nil || !ok || drops != 42 {
+		t.Fatalf("want 42 drops, got %d, %v, %v", drops, ok, err)
+	}
+	_, ok, err = parseProcUDPDrops(strings.NewReader(data), 1)
+	if err != nil || ok {
+		t.Fatalf("unexpected result for unknown inode, %v, %v", ok, err)
+	}
+}
+
+func TestUDPSocketStats(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := SetUDPSocketBuffers(c, 64*1024, 32*1024); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := GetUDPSocketStats(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The kernel doubles the value to leave room for bookkeeping overhead.
+	if stats.RcvBuf < 64*1024 || stats.SndBuf < 32*1024 {
+		t.Fatalf("unexpected buffer sizes, %+v", stats)
+	}
+	if stats.Drops != 0 {
+		t.Fatalf("unexpected drops, %d", stats.Drops)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// SetUDPSocketBuffers sets SO_RCVBUF and SO_SNDBUF of c. Zero or negative
+// values are ignored.
+func SetUDPSocketBuffers(c *net.UDPConn, rcvBuf, sndBuf int) error {
+	if rcvBuf > 0 {
+		if err := c.SetReadBuffer(rcvBuf); err != nil {
+			return err
+		}
+	}
+	if sndBuf > 0 {
+		if err := c.SetWriteBuffer(sndBuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUDPSocketStats is only supported on linux.
+func GetUDPSocketStats(_ *net.UDPConn) (*UDPSocketStats, error) {
+	return nil, errors.New("udp socket stats is not supported on this platform")
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// UnixSocketOpts sets the permission and ownership of unix socket files.
+type UnixSocketOpts struct {
+	Mode  os.FileMode // Zero leaves the mode set by umask.
+	Owner string      // User name or uid. Empty leaves the owner unchanged.
+	Group string      // Group name or gid. Empty leaves the group unchanged.
+}
+
+// ListenUnix listens on the unix stream socket path. A stale socket file
+// at path is removed first. The socket file is removed when the listener
+// is closed. Path that starts with "@" is in the linux abstract namespace,
+// which has no socket file, so opts are ignored.
+func ListenUnix(path string, opts UnixSocketOpts) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := setupSocketFile(path, opts); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenUnixgram is like ListenUnix but listens on a unix datagram socket.
+// Clients must bind their sockets to receive responses.
+func ListenUnixgram(path string, opts UnixSocketOpts) (net.PacketConn, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	uc := &unixgramConn{UnixConn: c, path: path}
+	if err := setupSocketFile(path, opts); err != nil {
+		uc.Close()
+		return nil, err
+	}
+	return uc, nil
+}
+
+// unixgramConn removes its socket file on Close.
+// (Unlike net.UnixListener, net.UnixConn does not do it.)
+type unixgramConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	if !isAbstractSocket(c.path) {
+		os.Remove(c.path)
+	}
+	return err
+}
+
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket removes the socket file left by a previous process.
+// It refuses to remove a file that is not a socket.
+func removeStaleSocket(path string) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func setupSocketFile(path string, opts UnixSocketOpts) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			return fmt.Errorf("failed to set socket mode, %w", err)
+		}
+	}
+	if len(opts.Owner) == 0 && len(opts.Group) == 0 {
+		return nil
+	}
+	uid, gid := -1, -1
+	if len(opts.Owner) > 0 {
+		u, err := lookupID(opts.Owner, func(s string) (string, error) {
+			u, err := user.Lookup(s)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket owner, %w", err)
+		}
+		uid = u
+	}
+	if len(opts.Group) > 0 {
+		g, err := lookupID(opts.Group, func(s string) (string, error) {
+			g, err := user.LookupGroup(s)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket group, %w", err)
+		}
+		gid = g
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set socket owner, %w", err)
+	}
+	return nil
+}
+
+// lookupID returns s if it is a numeric id. Otherwise, it looks up
+// the id of name s.
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	idStr, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(idStr)
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type protocolHandler struct {
+	protocol chan string
+}
+
+func (h *protocolHandler) ServeDNS(_ context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	h.protocol <- meta.Protocol
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return r, nil
+}
+
+func TestUnixServer(t *testing.T) {
+	dir := t.TempDir()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	tests := []struct {
+		name    string
+		network string
+		listen  func(path string, s *Server) (func(), error)
+		dial    func(path string) (net.Conn, error)
+	}{
+		{
+			name:    "unix",
+			network: "unix",
+			listen: func(path string, s *Server) (func(), error) {
+				l, err := ListenUnix(path, UnixSocketOpts{Mode: 0o600})
+				if err != nil {
+					return nil, err
+				}
+				go s.ServeTCP(l)
+				return func() { l.Close() }, nil
+			},
+			dial: func(path string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+		{
+			name:    "unixgram",
+			network: "unixgram",
+			listen: func(path string, s *Server) (func(), error) {
+				c, err := ListenUnixgram(path, UnixSocketOpts{Mode: 0o600})
+				if err != nil {
+					return nil, err
+				}
+				go s.ServeUDP(c)
+				return func() { c.Close() }, nil
+			},
+			dial: func(path string) (net.Conn, error) {
+				// The client must bind to receive responses.
+				laddr := &net.UnixAddr{Name: path + ".client", Net: "unixgram"}
+				return net.DialUnix("unixgram", laddr, &net.UnixAddr{Name: path, Net: "unixgram"})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".sock")
+
+			// A stale socket file is removed.
+			stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale.SetUnlinkOnClose(false)
+			stale.Close()
+
+			h := &protocolHandler{protocol: make(chan string, 1)}
+			s := NewServer(ServerOpts{DNSHandler: h, IdleTimeout: time.Second})
+			closeListener, err := tt.listen(path, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0o600 {
+				t.Fatalf("want socket mode 0600, got %o", fi.Mode().Perm())
+			}
+
+			c, err := tt.dial(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second))
+			if tt.network == "unix" {
+				_, err = dnsutils.WriteMsgToTCP(c, q)
+			} else {
+				_, err = dnsutils.WriteMsgToUDP(c, q)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r *dns.Msg
+			if tt.network == "unix" {
+				r, _, err = dnsutils.ReadMsgFromTCP(c)
+			} else {
+				r, _, err = dnsutils.ReadMsgFromUDP(c, 65535)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Id != q.Id {
+				t.Fatal("response id mismatched")
+			}
+			if got := <-h.protocol; got != tt.network {
+				t.Fatalf("want protocol %s, got %s", tt.network, got)
+			}
+
+			s.Close()
+			closeListener()
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Fatalf("socket file is not removed, %v", err)
+			}
+		})
+	}
+}
+
+func TestListenUnix_notSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(path, UnixSocketOpts{}); err == nil {
+		t.Fatal("want an error")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file is removed, %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sql_sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const clickHouseTimeFormat = "2006-01-02 15:04:05.000"
+
+// clickHouse inserts records over the ClickHouse HTTP interface.
+// The dsn is "http(s)://user:password@host:8123/database".
+type clickHouse struct {
+	endpoint string // without user info and path
+	user     string
+	password string
+	database string
+	table    string
+	client   *http.Client
+}
+
+func newClickHouse(u *url.URL, table string) (*clickHouse, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("clickhouse dsn must be a http or https url")
+	}
+	c := &clickHouse{
+		endpoint: u.Scheme + "://" + u.Host + "/",
+		database: strings.Trim(u.Path, "/"),
+		table:    table,
+		client:   &http.Client{},
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	return c, nil
+}
+
+func (c *clickHouse) CreateTable(ctx context.Context) error {
+	return c.exec(ctx, "CREATE TABLE IF NOT EXISTS "+c.table+` (
+	time DateTime64(3, 'UTC'),
+	client String,
+	protocol LowCardinality(String),
+	qname String,
+	qtype LowCardinality(String),
+	rcode LowCardinality(String),
+	answers Array(String),
+	upstream LowCardinality(String),
+	latency_ms Float64,
+	cache_hit Bool,
+	error String
+) ENGINE = MergeTree ORDER BY time`, nil)
+}
+
+// clickHouseRow is a row in JSONEachRow format.
+type clickHouseRow struct {
+	Time      string   `json:"time"`
+	Client    string   `json:"client"`
+	Protocol  string   `json:"protocol"`
+	Qname     string   `json:"qname"`
+	Qtype     string   `json:"qtype"`
+	Rcode     string   `json:"rcode"`
+	Answers   []string `json:"answers"`
+	Upstream  string   `json:"upstream"`
+	LatencyMs float64  `json:"latency_ms"`
+	CacheHit  bool     `json:"cache_hit"`
+	Error     string   `json:"error"`
+}
+
+func (c *clickHouse) Insert(ctx context.Context, rs []*Record) error {
+	body := new(bytes.Buffer)
+	enc := json.NewEncoder(body)
+	for _, r := range rs {
+		answers := r.Answers
+		if answers == nil {
+			answers = []string{}
+		}
+		row := clickHouseRow{
+			Time:      r.Time.UTC().Format(clickHouseTimeFormat),
+			Client:    r.Client,
+			Protocol:  r.Protocol,
+			Qname:     r.Qname,
+			Qtype:     r.Qtype,
+			Rcode:     r.Rcode,
+			Answers:   answers,
+			Upstream:  r.Upstream,
+			LatencyMs: r.LatencyMs,
+			CacheHit:  r.CacheHit,
+			Error:     r.Error,
+		}
+		if err := enc.Encode(&row); err != nil {
+			return err
+		}
+	}
+	return c.exec(ctx, "INSERT INTO "+c.table+" FORMAT JSONEachRow", body)
+}
+
+// exec runs query. If body is not nil, it is sent as the data of query.
+func (c *clickHouse) exec(ctx context.Context, query string, body io.Reader) error {
+	params := url.Values{}
+	if len(c.database) > 0 {
+		params.Set("database", c.database)
+	}
+	var req *http.Request
+	var err error
+	if body == nil {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"?"+params.Encode(), strings.NewReader(query))
+	} else {
+		params.Set("query", query)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"?"+params.Encode(), body)
+	}
+	if err != nil {
+		return err
+	}
+	if len(c.user) > 0 {
+		req.Header.Set("X-ClickHouse-User", c.user)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("clickhouse returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (c *clickHouse) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
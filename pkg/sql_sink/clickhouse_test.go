@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sql_sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_clickHouse(t *testing.T) {
+	var gotQuery, gotDB, gotUser, gotKey string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("query")
+		gotDB = r.URL.Query().Get("database")
+		gotUser = r.Header.Get("X-ClickHouse-User")
+		gotKey = r.Header.Get("X-ClickHouse-Key")
+		gotBody, _ = io.ReadAll(r.Body)
+		if strings.Contains(gotQuery, "bad_table") {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Code: 60. DB::Exception: Table does not exist\n")
+		}
+	}))
+	defer srv.Close()
+
+	dsn := strings.Replace(srv.URL, "http://", "http://default:secret@", 1) + "/logs"
+	ins, err := NewInserter("clickhouse", dsn, "query_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ins.Close()
+
+	rs := []*Record{
+		{Time: time.Date(2022, 1, 2, 3, 4, 5, 6e6, time.UTC), Qname: "example.com.", Answers: []string{"1.2.3.4"}, CacheHit: true},
+		{Time: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC), Qname: "example.org."},
+	}
+	if err := ins.Insert(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if gotQuery != "INSERT INTO query_log FORMAT JSONEachRow" || gotDB != "logs" || gotUser != "default" || gotKey != "secret" {
+		t.Fatalf("unexpected request: query %q, database %q, user %q, key %q", gotQuery, gotDB, gotUser, gotKey)
+	}
+	lines := strings.Split(strings.TrimSpace(string(gotBody)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 rows, got %q", gotBody)
+	}
+	var row clickHouseRow
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if row.Time != "2022-01-02 03:04:05.006" || row.Qname != "example.com." || len(row.Answers) != 1 || !row.CacheHit {
+		t.Fatalf("unexpected row %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"answers":[]`) {
+		t.Fatalf("empty answers should be an empty array, got %s", lines[1])
+	}
+
+	if err := ins.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(gotBody), "CREATE TABLE IF NOT EXISTS query_log") {
+		t.Fatalf("unexpected create table query %q", gotBody)
+	}
+
+	bad, _ := NewInserter("clickhouse", srv.URL, "bad_table")
+	if err := bad.Insert(context.Background(), rs); err == nil || !strings.Contains(err.Error(), "Table does not exist") {
+		t.Fatalf("want clickhouse error, got %v", err)
+	}
+}
+
+func TestNewInserter(t *testing.T) {
+	for _, tt := range []struct{ driver, dsn, table string }{
+		{"mysql", "mysql://localhost", "t"},
+		{"clickhouse", "tcp://localhost:9000", "t"},
+		{"postgres", "http://localhost", "t"},
+		{"postgres", "postgres://localhost/db", "t"}, // no user
+		{"postgres", "postgres://u@localhost/db?sslmode=allow", "t"},
+		{"clickhouse", "http://localhost", "t; DROP TABLE t"},
+	} {
+		if _, err := NewInserter(tt.driver, tt.dsn, tt.table); err == nil {
+			t.Errorf("NewInserter(%s, %s, %s) should fail", tt.driver, tt.dsn, tt.table)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sql_sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal client of the PostgreSQL frontend/backend protocol version 3,
+// see https://www.postgresql.org/docs/current/protocol.html.
+
+const (
+	pgProtocolVersion = 196608
+	pgSSLRequestCode  = 80877103
+	pgMaxMsgSize      = 1 << 24
+
+	pgAuthOK           = 0
+	pgAuthCleartext    = 3
+	pgAuthMD5          = 5
+	pgAuthSASL         = 10
+	pgAuthSASLContinue = 11
+	pgAuthSASLFinal    = 12
+
+	pgQueryTimeout = 30 * time.Second
+)
+
+// pgError is an ErrorResponse from the server. The connection is still
+// usable after it.
+type pgError struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("postgres: %s %s: %s", e.Severity, e.Code, e.Message)
+}
+
+// isDataError reports whether e is caused by the values of a row, i.e.
+// SQLSTATE class 22 (data exception) or 23 (integrity constraint
+// violation).
+func (e *pgError) isDataError() bool {
+	return strings.HasPrefix(e.Code, "22") || strings.HasPrefix(e.Code, "23")
+}
+
+func parsePgError(b []byte) *pgError {
+	e := new(pgError)
+	for len(b) > 1 {
+		typ := b[0]
+		i := bytes.IndexByte(b[1:], 0)
+		if i < 0 {
+			break
+		}
+		v := string(b[1 : 1+i])
+		b = b[2+i:]
+		switch typ {
+		case 'S':
+			e.Severity = v
+		case 'C':
+			e.Code = v
+		case 'M':
+			e.Message = v
+		}
+	}
+	return e
+}
+
+type pgConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// writeMsg writes a message. If typ is 0, the message has no type byte,
+// e.g. the startup message.
+func (c *pgConn) writeMsg(typ byte, body []byte) error {
+	_, err := c.nc.Write(appendMsg(make([]byte, 0, 5+len(body)), typ, body))
+	return err
+}
+
+// appendMsg appends a message to b. If typ is 0, the message has no type
+// byte.
+func appendMsg(b []byte, typ byte, body []byte) []byte {
+	if typ != 0 {
+		b = append(b, typ)
+	}
+	b = appendUint32(b, uint32(4+len(body)))
+	return append(b, body...)
+}
+
+func (c *pgConn) readMsg() (typ byte, body []byte, err error) {
+	var h [5]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	l := binary.BigEndian.Uint32(h[1:])
+	if l < 4 || l > pgMaxMsgSize {
+		return 0, nil, fmt.Errorf("invalid message length %d", l)
+	}
+	body = make([]byte, l-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return h[0], body, nil
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func (c *pgConn) startup(ctx context.Context, p *postgres) error {
+	setDeadline(ctx, c.nc)
+	if p.tlsConf != nil {
+		if err := c.upgradeTLS(p.tlsConf); err != nil {
+			return err
+		}
+		setDeadline(ctx, c.nc)
+	}
+
+	var body []byte
+	body = appendUint32(body, pgProtocolVersion)
+	for _, kv := range [][2]string{{"user", p.user}, {"database", p.database}, {"application_name", "mosdns"}} {
+		if len(kv[1]) > 0 {
+			body = append(body, cstring(kv[0])...)
+			body = append(body, cstring(kv[1])...)
+		}
+	}
+	body = append(body, 0)
+	if err := c.writeMsg(0, body); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		typ, body, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(body) < 4 {
+				return errors.New("invalid authentication message")
+			}
+			code, data := binary.BigEndian.Uint32(body), body[4:]
+			switch code {
+			case pgAuthOK:
+			case pgAuthCleartext:
+				err = c.writeMsg('p', cstring(p.password))
+			case pgAuthMD5:
+				if len(data) != 4 {
+					return errors.New("invalid md5 salt")
+				}
+				err = c.writeMsg('p', cstring(md5Password(p.user, p.password, data)))
+			case pgAuthSASL:
+				if !bytes.Contains(data, cstring("SCRAM-SHA-256")) {
+					return errors.New("server does not support SCRAM-SHA-256")
+				}
+				scram = newScramClient(p.password)
+				first := scram.clientFirst()
+				msg := cstring("SCRAM-SHA-256")
+				msg = appendUint32(msg, uint32(len(first)))
+				msg = append(msg, first...)
+				err = c.writeMsg('p', msg)
+			case pgAuthSASLContinue:
+				if scram == nil {
+					return errors.New("unexpected sasl continue")
+				}
+				var final string
+				if final, err = scram.clientFinal(string(data)); err == nil {
+					err = c.writeMsg('p', []byte(final))
+				}
+			case pgAuthSASLFinal:
+				if scram == nil {
+					return errors.New("unexpected sasl final")
+				}
+				err = scram.verifyServerFinal(string(data))
+			default:
+				return fmt.Errorf("unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'E':
+			return parsePgError(body)
+		case 'Z':
+			c.nc.SetDeadline(time.Time{})
+			return nil
+		default:
+			// ParameterStatus, BackendKeyData, NoticeResponse.
+		}
+	}
+}
+
+func (c *pgConn) upgradeTLS(conf *tls.Config) error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[0:4], 8)
+	binary.BigEndian.PutUint32(b[4:8], pgSSLRequestCode)
+	if _, err := c.nc.Write(b[:]); err != nil {
+		return err
+	}
+	resp, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if resp != 'S' {
+		return errors.New("server does not support ssl")
+	}
+	tc := tls.Client(c.nc, conf)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.nc = tc
+	c.r = bufio.NewReader(tc)
+	return nil
+}
+
+// query runs a simple query and discards its results.
+func (c *pgConn) query(ctx context.Context, q string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	setDeadline(ctx, c.nc)
+	defer c.nc.SetDeadline(time.Time{})
+
+	if err := c.writeMsg('Q', cstring(q)); err != nil {
+		return err
+	}
+	var qErr error
+	for {
+		typ, body, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			if qErr == nil {
+				qErr = parsePgError(body)
+			}
+		case 'Z':
+			return qErr
+		}
+	}
+}
+
+// execBatch runs q once for each row of args with the extended query
+// protocol. Args are sent as text parameters, q refers to them as $1, $2...
+// All rows are sent at once and run in an implicit transaction, so if a
+// row fails, nothing is done. If the error is caused by the values of a
+// row, e.g. invalid input, it is a *RecordError with the index of the row.
+func (c *pgConn) execBatch(ctx context.Context, q string, args [][]string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	setDeadline(ctx, c.nc)
+	defer c.nc.SetDeadline(time.Time{})
+
+	// Parse an unnamed statement and let the server infer the parameter
+	// types from q.
+	body := append(cstring(""), cstring(q)...)
+	b := appendMsg(nil, 'P', append(body, 0, 0))
+	for _, row := range args {
+		body = append(body[:0], 0, 0) // unnamed portal and statement
+		body = append(body, 0, 0)     // all parameters are text
+		body = append(body, byte(len(row)>>8), byte(len(row)))
+		for _, v := range row {
+			body = appendUint32(body, uint32(len(v)))
+			body = append(body, v...)
+		}
+		body = append(body, 0, 0) // all results are text
+		b = appendMsg(b, 'B', body)
+		b = appendMsg(b, 'E', []byte{0, 0, 0, 0, 0}) // unnamed portal, no row limit
+	}
+	b = appendMsg(b, 'S', nil)
+	if _, err := c.nc.Write(b); err != nil {
+		return err
+	}
+
+	var qErr error
+	parsed := false
+	done := 0 // completed rows
+	for {
+		typ, body, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case '1':
+			parsed = true
+		case 'C':
+			done++
+		case 'E':
+			if qErr == nil {
+				pgErr := parsePgError(body)
+				qErr = pgErr
+				if parsed && done < len(args) && pgErr.isDataError() {
+					qErr = &RecordError{Index: done, Err: pgErr}
+				}
+			}
+		case 'Z':
+			return qErr
+		}
+	}
+}
+
+func (c *pgConn) close() {
+	_ = c.writeMsg('X', nil)
+	c.nc.Close()
+}
+
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, pgQueryTimeout)
+}
+
+func setDeadline(ctx context.Context, c net.Conn) {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+}
+
+func md5Password(user, password string, salt []byte) string {
+	h := md5.Sum([]byte(password + user))
+	h = md5.Sum(append([]byte(hex.EncodeToString(h[:])), salt...))
+	return "md5" + hex.EncodeToString(h[:])
+}
+
+// scramClient implements the client side of SCRAM-SHA-256 (RFC 7677)
+// without channel binding.
+type scramClient struct {
+	password    string
+	clientNonce string
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newScramClient(password string) *scramClient {
+	nonce := make([]byte, 18)
+	_, _ = rand.Read(nonce)
+	return &scramClient{password: password, clientNonce: base64.StdEncoding.EncodeToString(nonce)}
+}
+
+func (s *scramClient) clientFirst() string {
+	// The user name is ignored by postgres, the one in the startup
+	// message is used.
+	s.clientFirstBare = "n=,r=" + s.clientNonce
+	return "n,," + s.clientFirstBare
+}
+
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	var iter int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch v := attr[2:]; attr[0] {
+		case 'r':
+			nonce = v
+		case 's':
+			salt = v
+		case 'i':
+			iter, _ = strconv.Atoi(v)
+		}
+	}
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return "", errors.New("invalid scram server nonce")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || iter <= 0 {
+		return "", errors.New("invalid scram server first message")
+	}
+
+	s.saltedPassword = pbkdf2.Key([]byte(s.password), saltBytes, iter, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + withoutProof
+	sig := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ sig[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return errors.New("invalid scram server final message")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.SplitN(serverFinal[2:], ",", 2)[0])
+	if err != nil {
+		return errors.New("invalid scram server signature")
+	}
+	serverKey := hmacSHA256(s.saltedPassword, "Server Key")
+	if !hmac.Equal(sig, hmacSHA256(serverKey, s.authMessage)) {
+		return errors.New("scram server signature mismatch")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sql_sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_pgText(t *testing.T) {
+	for s, want := range map[string]string{
+		"example.com.": "example.com.",
+		`it's`:         `it's`,
+		"nul\x00byte":  "nul\uFFFDbyte",
+		"bad\xffutf8":  "bad\uFFFDutf8",
+	} {
+		if got := pgText(s); got != want {
+			t.Errorf("pgText(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func Test_pgArray(t *testing.T) {
+	for _, tt := range []struct {
+		ss   []string
+		want string
+	}{
+		{nil, `{}`},
+		{[]string{"1.2.3.4", "::1"}, `{"1.2.3.4","::1"}`},
+		{[]string{`txt "a\b"`, "{,}"}, `{"txt \"a\\b\"","{,}"}`},
+	} {
+		if got := pgArray(tt.ss); got != tt.want {
+			t.Errorf("pgArray(%q) = %s, want %s", tt.ss, got, tt.want)
+		}
+	}
+}
+
+func Test_newPostgres_sslmode(t *testing.T) {
+	for dsn, wantErr := range map[string]bool{
+		"postgres://u@h/db":                                              false,
+		"postgres://u@h/db?sslmode=disable":                              false,
+		"postgres://u@h/db?sslmode=verify-ca":                            false,
+		"postgres://u@h/db?sslmode=verify-full":                          false,
+		"postgres://u@h/db?sslmode=require":                              true,
+		"postgres://u@h/db?sslmode=verify-full&sslrootcert=/nonexistent": true,
+		"postgres://u@h/db?sslmode=prefer":                               true,
+	} {
+		_, err := NewInserter("postgres", dsn, "t")
+		if gotErr := err != nil; gotErr != wantErr {
+			t.Errorf("%s: want err %v, got %v", dsn, wantErr, err)
+		}
+	}
+}
+
+// RFC 7677 section 3.
+func Test_scramClient(t *testing.T) {
+	s := &scramClient{password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+	s.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Fatalf("client final = %s, want %s", final, want)
+	}
+	if err := s.verifyServerFinal("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifyServerFinal("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Fatal("invalid server signature should fail")
+	}
+	if _, err := s.clientFinal("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Fatal("invalid server nonce should fail")
+	}
+}
+
+// pgServer is a fake postgres server that uses md5 authentication and
+// sends the received queries to queries. Extended queries are sent with
+// their rows of parameters joined by "|", one row per line. Queries that
+// contain "bad" fail, and rows that contain "invalid" fail.
+func pgServer(t *testing.T, l net.Listener, queries chan<- string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			write := func(typ byte, body []byte) {
+				b := []byte{typ, 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(b[1:], uint32(4+len(body)))
+				c.Write(append(b, body...))
+			}
+
+			var l [4]byte
+			io.ReadFull(r, l[:])
+			startup := make([]byte, binary.BigEndian.Uint32(l[:])-4)
+			io.ReadFull(r, startup)
+			if !bytes.Contains(startup, []byte("user\x00u\x00database\x00db\x00")) {
+				t.Errorf("unexpected startup message %q", startup)
+				return
+			}
+			write('R', []byte{0, 0, 0, 5, 1, 2, 3, 4})
+			typ, _ := r.ReadByte()
+			io.ReadFull(r, l[:])
+			pw := make([]byte, binary.BigEndian.Uint32(l[:])-4)
+			io.ReadFull(r, pw)
+			if typ != 'p' || string(pw) != md5Password("u", "p", []byte{1, 2, 3, 4})+"\x00" {
+				write('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+				return
+			}
+			write('R', []byte{0, 0, 0, 0})
+			write('S', []byte("server_version\x0014\x00"))
+			write('Z', []byte{'I'})
+
+			var (
+				query  string
+				rows   []string
+				failed bool // discard messages until Sync
+			)
+			for {
+				typ, err := r.ReadByte()
+				if err != nil || typ == 'X' {
+					return
+				}
+				io.ReadFull(r, l[:])
+				body := make([]byte, binary.BigEndian.Uint32(l[:])-4)
+				io.ReadFull(r, body)
+				switch {
+				case typ == 'Q':
+					query := strings.TrimSuffix(string(body), "\x00")
+					queries <- query
+					if strings.Contains(query, "bad") {
+						write('E', []byte("SERROR\x00C42P01\x00Mrelation \"bad\" does not exist\x00\x00"))
+					} else {
+						write('C', []byte("INSERT 0 1\x00"))
+					}
+					write('Z', []byte{'I'})
+				case typ == 'S':
+					queries <- strings.Join(append([]string{query}, rows...), "\n")
+					query, rows, failed = "", nil, false
+					write('Z', []byte{'I'})
+				case failed:
+				case typ == 'P':
+					query = strings.TrimSuffix(string(body[1:len(body)-2]), "\x00")
+					if strings.Contains(query, "bad") {
+						failed = true
+						write('E', []byte("SERROR\x00C42P01\x00Mrelation \"bad\" does not exist\x00\x00"))
+					} else {
+						write('1', nil)
+					}
+				case typ == 'B':
+					rows = append(rows, strings.Join(parseBind(body), "|"))
+					write('2', nil)
+				case typ == 'E':
+					if strings.Contains(rows[len(rows)-1], "invalid") {
+						failed = true
+						write('E', []byte("SERROR\x00C22P02\x00Minvalid input syntax\x00\x00"))
+					} else {
+						write('C', []byte("INSERT 0 1\x00"))
+					}
+				}
+			}
+		}()
+	}
+}
+
+// parseBind returns the text parameters of a Bind message body of an
+// unnamed portal and statement.
+func parseBind(b []byte) []string {
+	b = b[2:]
+	b = b[2+2*int(binary.BigEndian.Uint16(b)):]
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	var params []string
+	for i := 0; i < n; i++ {
+		l := binary.BigEndian.Uint32(b)
+		params = append(params, string(b[4:4+l]))
+		b = b[4+l:]
+	}
+	return params
+}
+
+func Test_postgres(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	queries := make(chan string, 16)
+	go pgServer(t, l, queries)
+
+	ins, err := NewInserter("postgres", "postgres://u:p@"+l.Addr().String()+"/db", "public.query_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ins.Close()
+
+	ctx := context.Background()
+	rs := []*Record{{
+		Time:      time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		Qname:     "it's.example.",
+		Answers:   []string{"1.2.3.4", "::1"},
+		LatencyMs: 1.5,
+		CacheHit:  true,
+	}}
+	if err := ins.Insert(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	want := "INSERT INTO public.query_log (time, client, protocol, qname, qtype, rcode, answers, upstream, latency_ms, cache_hit, error) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)\n" +
+		`2022-01-02 03:04:05.000000Z|||it's.example.|||{"1.2.3.4","::1"}||1.5|true|`
+	if got := <-queries; got != want {
+		t.Fatalf("unexpected query\n got: %s\nwant: %s", got, want)
+	}
+
+	// The second record is rejected.
+	err = ins.Insert(ctx, append(rs, &Record{Qname: "invalid."}, &Record{}))
+	var recErr *RecordError
+	if !errors.As(err, &recErr) || recErr.Index != 1 {
+		t.Fatalf("want record error of record 1, got %v", err)
+	}
+	<-queries
+
+	bad, _ := NewInserter("postgres", "postgres://u:p@"+l.Addr().String()+"/db", "bad")
+	defer bad.Close()
+	err = bad.Insert(ctx, rs)
+	if err == nil || !strings.Contains(err.Error(), "42P01") {
+		t.Fatalf("want postgres error, got %v", err)
+	}
+	<-queries
+	// The connection is still usable after a query error.
+	if err := bad.CreateTable(ctx); err == nil {
+		t.Fatal("want error")
+	}
+	if q := <-queries; !strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS bad") {
+		t.Fatalf("unexpected query %s", q)
+	}
+
+	wrongPw, _ := NewInserter("postgres", "postgres://u:wrong@"+l.Addr().String()+"/db", "t")
+	defer wrongPw.Close()
+	if err := wrongPw.Insert(ctx, rs); err == nil || !strings.Contains(err.Error(), "password authentication failed") {
+		t.Fatalf("want authentication error, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package sql_sink batches query log records and inserts them into
+// ClickHouse or PostgreSQL.
+package sql_sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"go.uber.org/zap"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	insertTimeout = 30 * time.Second
+	maxBackoff    = time.Minute
+)
+
+// Record is a row of the query log table.
+type Record struct {
+	Time      time.Time
+	Client    string
+	Protocol  string
+	Qname     string
+	Qtype     string
+	Rcode     string
+	Answers   []string
+	Upstream  string
+	LatencyMs float64
+	CacheHit  bool
+	Error     string
+}
+
+// Inserter inserts records into a database.
+type Inserter interface {
+	// CreateTable creates the query log table if it does not exist.
+	CreateTable(ctx context.Context) error
+	Insert(ctx context.Context, rs []*Record) error
+	Close() error
+}
+
+// RecordError is returned by Inserter.Insert if the database rejects a
+// record of the batch, e.g. it has an invalid value. Nothing of the batch
+// is inserted. Retrying the batch without the record may succeed.
+type RecordError struct {
+	Index int // Index of the rejected record in the batch.
+	Err   error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d rejected, %v", e.Index, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+var tableNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// NewInserter returns an Inserter for driver "clickhouse" or "postgres".
+// table is the name of the query log table, optionally qualified with a
+// database or schema name.
+func NewInserter(driver, dsn, table string) (Inserter, error) {
+	if !tableNameRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %s", table)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dsn, %w", err)
+	}
+	switch driver {
+	case "clickhouse":
+		return newClickHouse(u, table)
+	case "postgres":
+		return newPostgres(u, table)
+	default:
+		return nil, fmt.Errorf("unsupported driver %s", driver)
+	}
+}
+
+type Opts struct {
+	// BatchSize is the maximum number of records in an insert.
+	// Default is 1000.
+	BatchSize int
+
+	// FlushInterval is the maximum time a record waits before it is
+	// inserted. Default is 5s.
+	FlushInterval time.Duration
+
+	// MaxPending is the maximum number of records waiting to be inserted.
+	// New records are dropped if it is exceeded, e.g. the database is
+	// unreachable. Default is 100000.
+	MaxPending int
+
+	// MaxRetries is the maximum number of retries of a failed insert.
+	// The batch is dropped after that. Default is 3.
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry. It doubles on each
+	// retry. Default is 1s.
+	RetryBackoff time.Duration
+
+	Logger *zap.Logger
+}
+
+func (opts *Opts) init() {
+	utils.SetDefaultNum(&opts.BatchSize, 1000)
+	utils.SetDefaultNum(&opts.FlushInterval, 5*time.Second)
+	utils.SetDefaultNum(&opts.MaxPending, 100000)
+	utils.SetDefaultNum(&opts.MaxRetries, 3)
+	utils.SetDefaultNum(&opts.RetryBackoff, time.Second)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+}
+
+// Sink batches records and inserts them in the background. Writes never
+// block, so a slow or unreachable database does not slow down queries.
+// Sink is safe for concurrent use.
+type Sink struct {
+	opts Opts
+	ins  Inserter
+	c    chan *Record
+
+	dropped  uint64 // atomic
+	inserted uint64 // atomic
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+// New starts a Sink that inserts records with ins. The Sink owns ins
+// and closes it on Close.
+func New(ins Inserter, opts Opts) *Sink {
+	opts.init()
+	s := &Sink{
+		opts:        opts,
+		ins:         ins,
+		c:           make(chan *Record, opts.MaxPending),
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues r. It reports false if r is dropped because too many
+// records are pending or s is closed.
+func (s *Sink) Write(r *Record) bool {
+	select {
+	case <-s.closeNotify:
+	default:
+		select {
+		case s.c <- r:
+			return true
+		default:
+		}
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return false
+}
+
+// Dropped returns the number of records that were dropped, either on
+// Write or because their insert failed.
+func (s *Sink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Inserted returns the number of records that were inserted.
+func (s *Sink) Inserted() uint64 {
+	return atomic.LoadUint64(&s.inserted)
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Record, 0, s.opts.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			s.insert(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case r := <-s.c:
+			batch = append(batch, r)
+			if len(batch) >= s.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.closeNotify:
+			for len(s.c) > 0 {
+				batch = append(batch, <-s.c)
+				if len(batch) >= s.opts.BatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// insert inserts batch with retries. After s is closed, it is tried
+// only once. Records rejected by the database are dropped and the rest
+// of batch is inserted again without counting it as a retry.
+func (s *Sink) insert(batch []*Record) {
+	backoff := s.opts.RetryBackoff
+	for retry := 0; ; retry++ {
+		ctx, cancel := context.WithTimeout(context.Background(), insertTimeout)
+		err := s.ins.Insert(ctx, batch)
+		cancel()
+		if err == nil {
+			atomic.AddUint64(&s.inserted, uint64(len(batch)))
+			return
+		}
+
+		var recErr *RecordError
+		if errors.As(err, &recErr) && recErr.Index >= 0 && recErr.Index < len(batch) {
+			atomic.AddUint64(&s.dropped, 1)
+			s.opts.Logger.Warn("query log record rejected, record dropped", zap.String("qname", batch[recErr.Index].Qname), zap.Error(recErr.Err))
+			batch = append(batch[:recErr.Index:recErr.Index], batch[recErr.Index+1:]...)
+			if len(batch) == 0 {
+				return
+			}
+			retry--
+			continue
+		}
+
+		closed := false
+		select {
+		case <-s.closeNotify:
+			closed = true
+		default:
+		}
+		if retry >= s.opts.MaxRetries || closed {
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			s.opts.Logger.Error("failed to insert query log records, records dropped", zap.Int("records", len(batch)), zap.Error(err))
+			return
+		}
+		s.opts.Logger.Warn("failed to insert query log records, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-s.closeNotify:
+			t.Stop()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Close inserts pending records and closes the Inserter.
+func (s *Sink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeNotify)
+	})
+	<-s.done
+	return s.ins.Close()
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sql_sink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testInserter struct {
+	m       sync.Mutex
+	batches [][]*Record
+	fails   int // the number of following inserts that fail
+	closed  bool
+}
+
+func (t *testInserter) CreateTable(ctx context.Context) error {
+	return nil
+}
+
+func (t *testInserter) Insert(_ context.Context, rs []*Record) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.fails > 0 {
+		t.fails--
+		return errors.New("db unreachable")
+	}
+	t.batches = append(t.batches, append([]*Record(nil), rs...))
+	return nil
+}
+
+func (t *testInserter) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.closed = true
+	return nil
+}
+
+func (t *testInserter) batchSizes() []int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	var s []int
+	for _, b := range t.batches {
+		s = append(s, len(b))
+	}
+	return s
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSink(t *testing.T) {
+	t.Run("batch", func(t *testing.T) {
+		ins := &testInserter{}
+		s := New(ins, Opts{BatchSize: 3, FlushInterval: time.Hour})
+		for i := 0; i < 7; i++ {
+			s.Write(&Record{Qname: "example.com."})
+		}
+		waitFor(t, func() bool { return len(ins.batchSizes()) == 2 })
+		s.Close()
+		if got := ins.batchSizes(); len(got) != 3 || got[2] != 1 {
+			t.Fatalf("unexpected batches %v", got)
+		}
+		if !ins.closed || s.Inserted() != 7 || s.Dropped() != 0 {
+			t.Fatalf("closed %v, inserted %d, dropped %d", ins.closed, s.Inserted(), s.Dropped())
+		}
+		if s.Write(&Record{}) || s.Dropped() != 1 {
+			t.Fatal("write after close should be dropped")
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		ins := &testInserter{}
+		s := New(ins, Opts{FlushInterval: 20 * time.Millisecond})
+		defer s.Close()
+		s.Write(&Record{})
+		s.Write(&Record{})
+		waitFor(t, func() bool { return len(ins.batchSizes()) == 1 })
+		if got := ins.batchSizes(); got[0] != 2 {
+			t.Fatalf("unexpected batches %v", got)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		ins := &testInserter{fails: 2}
+		s := New(ins, Opts{BatchSize: 1, MaxRetries: 2, RetryBackoff: time.Millisecond})
+		s.Write(&Record{})
+		waitFor(t, func() bool { return s.Inserted() == 1 })
+
+		ins.m.Lock()
+		ins.fails = 3
+		ins.m.Unlock()
+		s.Write(&Record{})
+		waitFor(t, func() bool { return s.Dropped() == 1 })
+		s.Close()
+	})
+
+	t.Run("full", func(t *testing.T) {
+		ins := &testInserter{fails: 1 << 30}
+		s := New(ins, Opts{BatchSize: 1, MaxPending: 2, MaxRetries: 1000, RetryBackoff: time.Hour})
+		for i := 0; i < 10; i++ {
+			s.Write(&Record{})
+		}
+		if s.Dropped() < 7 {
+			t.Fatalf("records should be dropped when the queue is full, dropped %d", s.Dropped())
+		}
+		s.Close() // must not wait for the backoff
+		if s.Dropped() != 10 {
+			t.Fatalf("want 10 dropped records, got %d", s.Dropped())
+		}
+	})
+}
+
+// recordInserter rejects records with Qname "bad.".
+type recordInserter struct {
+	testInserter
+}
+
+func (t *recordInserter) Insert(ctx context.Context, rs []*Record) error {
+	for i, r := range rs {
+		if r.Qname == "bad." {
+			return &RecordError{Index: i, Err: errors.New("invalid input")}
+		}
+	}
+	return t.testInserter.Insert(ctx, rs)
+}
+
+func TestSink_recordError(t *testing.T) {
+	ins := &recordInserter{}
+	s := New(ins, Opts{BatchSize: 4, FlushInterval: time.Hour, MaxRetries: 0})
+	for _, qname := range []string{"a.", "bad.", "b.", "bad."} {
+		s.Write(&Record{Qname: qname})
+	}
+	waitFor(t, func() bool { return s.Inserted()+s.Dropped() == 4 })
+	s.Close()
+	if s.Inserted() != 2 || s.Dropped() != 2 {
+		t.Fatalf("want 2 inserted and 2 dropped records, got %d and %d", s.Inserted(), s.Dropped())
+	}
+	if got := ins.batchSizes(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("unexpected batches %v", got)
+	}
+}
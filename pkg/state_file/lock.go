@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package state_file
+
+import (
+	"os"
+)
+
+// FileLock is an advisory file lock that is shared between processes.
+// The lock is held on a separate "path.lock" file, so the locked file
+// itself can be replaced by renaming.
+// The "path.lock" file is left behind after Unlock and is reused by later
+// locks. It cannot be removed safely: a process that is waiting on the old
+// file would hold a lock that no one else sees.
+type FileLock struct {
+	f *os.File
+}
+
+// Lock acquires an exclusive lock for path. It blocks until the lock is
+// acquired.
+func Lock(path string) (*FileLock, error) {
+	return lockFile(path, true)
+}
+
+// RLock acquires a shared lock for path. It blocks until the lock is
+// acquired.
+func RLock(path string) (*FileLock, error) {
+	return lockFile(path, false)
+}
+
+func lockFile(path string, exclusive bool) (*FileLock, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	err := unlock(l.f)
+	l.f.Close()
+	return err
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package state_file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File layout:
+// | magic (4) | name len (1) | name | version (4) | payload len (8) | payload crc32 (4) | payload |
+const magic = "MSDS"
+
+var (
+	ErrBadFormat    = errors.New("bad state file format")
+	ErrNewVersion   = errors.New("state file was written by a newer version")
+	ErrNameMismatch = errors.New("state file name mismatched")
+)
+
+// Migration converts the payload of version v to version v+1.
+type Migration func(payload []byte) ([]byte, error)
+
+// Format describes a versioned state file format.
+// State files can be shared between multiple mosdns instances (or the old and
+// new instance during an upgrade). Format uses file locks to make sure that
+// readers never see a partially written file and concurrent writers do not
+// corrupt each other.
+type Format struct {
+	// Name identifies the kind of the state file. e.g. "cache".
+	// It is stored in the header and checked when reading. Max length is 255.
+	Name string
+
+	// Version is the current version of the payload.
+	Version uint32
+
+	// Migrations contains the Migration from version k to version k+1.
+	// If a file with an older version is read and there is no migration
+	// path to the current Version, ReadFile returns an error.
+	Migrations map[uint32]Migration
+}
+
+// WriteFile writes payload to path with the current Version.
+// See the package level WriteFile for details.
+func (f *Format) WriteFile(path string, payload []byte) error {
+	if len(f.Name) > 255 {
+		return errors.New("format name is too long")
+	}
+	buf := new(bytes.Buffer)
+	if err := f.encode(buf, payload); err != nil {
+		return err
+	}
+	return WriteFile(path, buf.Bytes(), 0600)
+}
+
+// WriteFile writes data to path with permission perm. The data is written
+// to a temporary file first and then renamed, under an exclusive file lock,
+// so concurrent readers (using RLock) and writers never see or produce a
+// partially written file.
+// Use it for state files that must keep their own format (e.g. key files
+// that are shared with other tools). Otherwise, use Format.WriteFile.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	l, err := Lock(path)
+	if err != nil {
+		return fmt.Errorf("failed to lock file, %w", err)
+	}
+	defer l.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op if it was renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+// ReadFile reads the payload from path under a shared file lock. If the
+// file has an older version, the payload will be migrated to the current
+// Version. The file itself is not modified.
+func (f *Format) ReadFile(path string) ([]byte, error) {
+	l, err := RLock(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock file, %w", err)
+	}
+	b, err := os.ReadFile(path)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return f.Decode(b)
+}
+
+// Decode decodes and migrates the payload from b.
+func (f *Format) Decode(b []byte) ([]byte, error) {
+	name, version, payload, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if name != f.Name {
+		return nil, fmt.Errorf("%w, want %s, got %s", ErrNameMismatch, f.Name, name)
+	}
+	if version > f.Version {
+		return nil, fmt.Errorf("%w, file version %d, supported version %d", ErrNewVersion, version, f.Version)
+	}
+	for v := version; v < f.Version; v++ {
+		m := f.Migrations[v]
+		if m == nil {
+			return nil, fmt.Errorf("no migration from version %d to %d", v, v+1)
+		}
+		payload, err = m(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate from version %d to %d, %w", v, v+1, err)
+		}
+	}
+	return payload, nil
+}
+
+func (f *Format) encode(w io.Writer, payload []byte) error {
+	buf := new(bytes.Buffer)
+	buf.WriteString(magic)
+	buf.WriteByte(byte(len(f.Name)))
+	buf.WriteString(f.Name)
+	binary.Write(buf, binary.BigEndian, f.Version)
+	binary.Write(buf, binary.BigEndian, uint64(len(payload)))
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func decode(b []byte) (name string, version uint32, payload []byte, err error) {
+	if len(b) < len(magic)+1 || string(b[:len(magic)]) != magic {
+		return "", 0, nil, ErrBadFormat
+	}
+	b = b[len(magic):]
+	nameLen := int(b[0])
+	b = b[1:]
+	if len(b) < nameLen+16 {
+		return "", 0, nil, ErrBadFormat
+	}
+	name = string(b[:nameLen])
+	b = b[nameLen:]
+	version = binary.BigEndian.Uint32(b)
+	payloadLen := binary.BigEndian.Uint64(b[4:])
+	checksum := binary.BigEndian.Uint32(b[12:])
+	payload = b[16:]
+	if uint64(len(payload)) != payloadLen || crc32.ChecksumIEEE(payload) != checksum {
+		return "", 0, nil, fmt.Errorf("%w, broken payload", ErrBadFormat)
+	}
+	return name, version, payload, nil
+}
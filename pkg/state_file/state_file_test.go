@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package state_file
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+
+	v1 := &Format{Name: "test", Version: 1}
+	if err := v1.WriteFile(path, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := v1.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "v1" {
+		t.Fatalf("want payload v1, got %s", b)
+	}
+
+	// migration
+	v3 := &Format{Name: "test", Version: 3, Migrations: map[uint32]Migration{
+		1: func(p []byte) ([]byte, error) { return append(p, "->v2"...), nil },
+		2: func(p []byte) ([]byte, error) { return append(p, "->v3"...), nil },
+	}}
+	b, err = v3.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "v1->v2->v3" {
+		t.Fatalf("unexpected migrated payload %s", b)
+	}
+
+	// newer version
+	if err := v3.WriteFile(path, []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v1.ReadFile(path); !errors.Is(err, ErrNewVersion) {
+		t.Fatalf("want ErrNewVersion, got %v", err)
+	}
+
+	// name mismatched
+	if _, err := (&Format{Name: "other", Version: 3}).ReadFile(path); !errors.Is(err, ErrNameMismatch) {
+		t.Fatalf("want ErrNameMismatch, got %v", err)
+	}
+
+	// broken file
+	raw, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, raw[:len(raw)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v3.ReadFile(path); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("want ErrBadFormat, got %v", err)
+	}
+}
+
+func TestFormat_concurrentWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	f := &Format{Name: "test", Version: 1}
+
+	payloads := make([][]byte, 8)
+	for i := range payloads {
+		payloads[i] = bytes.Repeat([]byte{byte(i)}, 64*1024)
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, p := range payloads {
+		p := p
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := f.WriteFile(path, p); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := f.ReadFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raw")
+	for _, data := range []string{"first", "second"} {
+		if err := WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Fatalf("want %s, got %s", data, b)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Fatalf("want perm 0640, got %v", fi.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package time_window
+
+import (
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cron_spec"
+	"time"
+)
+
+// maxCronDuration limits the duration of cron windows, because Match
+// checks every minute of the duration.
+const maxCronDuration = time.Hour * 24 * 7
+
+// CronWindow is a window that starts at minutes that match a cron spec
+// and lasts for a duration.
+type CronWindow struct {
+	spec     *cron_spec.Spec
+	duration time.Duration
+}
+
+// ParseCron parses a cron spec, e.g. "0 20 * * 1-5" and the duration of
+// its windows. The duration is truncated to minutes, at most 7 days.
+func ParseCron(spec string, d time.Duration) (*CronWindow, error) {
+	s, err := cron_spec.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	d = d.Truncate(time.Minute)
+	if d <= 0 || d > maxCronDuration {
+		return nil, errors.New("cron window duration must be in 1 minute to 7 days")
+	}
+	return &CronWindow{spec: s, duration: d}, nil
+}
+
+// Match reports whether t is in a window. The spec is in the location of t.
+func (w *CronWindow) Match(t time.Time) bool {
+	start := t.Truncate(time.Minute)
+	for m := start; start.Sub(m) < w.duration; m = m.Add(-time.Minute) {
+		if w.spec.Match(m) {
+			return true
+		}
+	}
+	return false
+}
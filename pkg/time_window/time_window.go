@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package time_window parses weekly time windows, e.g.
+// "mon-fri 20:00-07:00", and cron windows.
+package time_window
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matcher matches time.
+type Matcher interface {
+	Match(t time.Time) bool
+}
+
+var (
+	_ Matcher = (*Window)(nil)
+	_ Matcher = (*CronWindow)(nil)
+)
+
+// Window is a daily time range on some days of the week.
+type Window struct {
+	days       uint8 // bitset of time.Weekday
+	start, end int   // minutes of the day, [start, end).
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse parses s in the format of "[days] HH:MM-HH:MM". Days is a list of
+// weekdays or weekday ranges, e.g. "mon-fri", "sat,sun" or "fri-mon".
+// If days is omitted, the window is on every day. If the end is not after
+// the start, e.g. "20:00-07:00", the window ends on the next day. In this
+// case, days are the days that the window starts.
+func Parse(s string) (*Window, error) {
+	f := strings.Fields(s)
+	var daysStr, timeStr string
+	switch len(f) {
+	case 1:
+		timeStr = f[0]
+	case 2:
+		daysStr, timeStr = f[0], f[1]
+	default:
+		return nil, fmt.Errorf("invalid time window %q", s)
+	}
+
+	w := new(Window)
+	if len(daysStr) == 0 {
+		w.days = 0x7f
+	} else {
+		for _, d := range strings.Split(strings.ToLower(daysStr), ",") {
+			from, to, isRange := strings.Cut(d, "-")
+			fromDay, ok := weekdays[from]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday %q", from)
+			}
+			toDay := fromDay
+			if isRange {
+				if toDay, ok = weekdays[to]; !ok {
+					return nil, fmt.Errorf("invalid weekday %q", to)
+				}
+			}
+			for day := fromDay; ; day = (day + 1) % 7 {
+				w.days |= 1 << day
+				if day == toDay {
+					break
+				}
+			}
+		}
+	}
+
+	startStr, endStr, ok := strings.Cut(timeStr, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time range %q", timeStr)
+	}
+	var err error
+	if w.start, err = parseClock(startStr); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(endStr); err != nil {
+		return nil, err
+	}
+	if w.start == 24*60 {
+		return nil, fmt.Errorf("invalid start time %q", startStr)
+	}
+	return w, nil
+}
+
+// parseClock parses "HH:MM" to minutes of the day. "24:00" is allowed.
+func parseClock(s string) (int, error) {
+	hs, ms, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hs)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(ms)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Match reports whether t is in the window. The window is in the location
+// of t.
+func (w *Window) Match(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.onDay(day) && m >= w.start && m < w.end
+	}
+	// Overnight window.
+	yesterday := (day + 6) % 7
+	return (w.onDay(day) && m >= w.start) || (w.onDay(yesterday) && m < w.end)
+}
+
+func (w *Window) onDay(d time.Weekday) bool {
+	return w.days&(1<<d) != 0
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package time_window
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantErr bool
+	}{
+		{"08:00-17:30", false},
+		{"mon-fri 20:00-07:00", false},
+		{"sat,sun 00:00-24:00", false},
+		{"fri-mon 10:00-11:00", false},
+		{"mon-fri", true},
+		{"abc 10:00-11:00", true},
+		{"10:00", true},
+		{"25:00-26:00", true},
+		{"24:00-01:00", true},
+		{"10:60-11:00", true},
+		{"mon 10:00-11:00 x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			_, err := Parse(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWindow_Match(t *testing.T) {
+	// 2022-11-07 is a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2022, 11, 7+day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		s    string
+		t    time.Time
+		want bool
+	}{
+		{"08:00-17:30", at(0, 8, 0), true},
+		{"08:00-17:30", at(0, 17, 30), false},
+		{"08:00-17:30", at(0, 7, 59), false},
+		{"mon-fri 20:00-07:00", at(0, 21, 0), true},
+		{"mon-fri 20:00-07:00", at(1, 6, 59), true},  // tuesday morning
+		{"mon-fri 20:00-07:00", at(0, 6, 0), false},  // monday morning, started on sunday
+		{"mon-fri 20:00-07:00", at(5, 6, 0), true},   // saturday morning, started on friday
+		{"mon-fri 20:00-07:00", at(5, 21, 0), false}, // saturday evening
+		{"sat,sun 00:00-24:00", at(6, 23, 59), true},
+		{"sat,sun 00:00-24:00", at(0, 0, 0), false},
+		{"fri-mon 10:00-11:00", at(0, 10, 30), true},
+		{"fri-mon 10:00-11:00", at(1, 10, 30), false},
+	}
+	for _, tt := range tests {
+		w, err := Parse(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Match(tt.t); got != tt.want {
+			t.Errorf("%s Match(%s) = %v, want %v", tt.s, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestCronWindow_Match(t *testing.T) {
+	// 2022-11-07 is a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2022, 11, 7+day, hour, min, 30, 0, time.UTC)
+	}
+	w, err := ParseCron("0 20 * * 1-5", time.Hour*11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(0, 19, 59), false},
+		{at(0, 20, 0), true},
+		{at(1, 6, 59), true},
+		{at(1, 7, 0), false},
+		{at(5, 6, 0), true}, // saturday morning, started on friday
+		{at(5, 20, 0), false},
+	}
+	for _, tt := range tests {
+		if got := w.Match(tt.t); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	if _, err := ParseCron("0 20 * * *", time.Second); err == nil {
+		t.Fatal("zero duration should be rejected")
+	}
+}
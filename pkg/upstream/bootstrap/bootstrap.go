@@ -16,39 +16,143 @@
  * You should have received a copy of the GNU General Public License
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
-
 package bootstrap
 
 import (
 	"context"
-	"net"
-	"strings"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/netip"
+	"sync"
+	"time"
 )
 
-// NewPlainBootstrap returns a customized *net.Resolver which Dial func is modified to dial s.
-// s SHOULD be a literal IP address and the port SHOULD also be literal.
-// Port can be omitted. In this case, the default port is :53.
-// e.g. NewPlainBootstrap("8.8.8.8"), NewPlainBootstrap("127.0.0.1:5353")
-// If s is empty, NewPlainBootstrap returns nil. (A nil *net.Resolver is valid in net.Dialer.)
-// Note that not all platform support a customized *net.Resolver. It also depends on the
-// version of go runtime.
-// See the package docs from the net package for more info.
-func NewPlainBootstrap(s string) *net.Resolver {
-	if len(s) == 0 {
-		return nil
-	}
-	// Add port.
-	_, _, err := net.SplitHostPort(s)
-	if err != nil { // no port, add it.
-		s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
-	}
-
-	return &net.Resolver{
-		PreferGo:     true,
-		StrictErrors: false,
-		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
-			d := new(net.Dialer)
-			return d.DialContext(ctx, network, s)
-		},
+const (
+	defaultMinTTL = time.Minute
+	defaultMaxTTL = time.Hour
+
+	// failedLookupTTL is how long the expired address is reused after a
+	// failed lookup before the host is resolved again.
+	failedLookupTTL = time.Second * 5
+)
+
+// Resolver looks up the addresses of a hostname.
+type Resolver interface {
+	// LookupAddr returns the addresses of host and the ttl of the result.
+	LookupAddr(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+}
+
+type Opts struct {
+	// MinTTL and MaxTTL limit the ttl of the cached addresses.
+	// Default: MinTTL: 1m, MaxTTL: 1h.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// Logger specifies the logger that the Bootstrap will use.
+	Logger *zap.Logger
+}
+
+// Bootstrap resolves a hostname with a Resolver and caches the result
+// within its ttl. It is used by upstreams to find the address of the
+// server without the system resolver.
+type Bootstrap struct {
+	host string
+	r    Resolver
+	opts Opts
+
+	lookupMu sync.Mutex // only one lookup at a time
+
+	m      sync.Mutex
+	addrs  []netip.Addr
+	expire time.Time
+}
+
+// NewBootstrap returns a Bootstrap that resolves host with r.
+func NewBootstrap(host string, r Resolver, opts Opts) *Bootstrap {
+	if opts.MinTTL <= 0 {
+		opts.MinTTL = defaultMinTTL
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = defaultMaxTTL
+	}
+	if opts.MaxTTL < opts.MinTTL {
+		opts.MaxTTL = opts.MinTTL
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return &Bootstrap{
+		host: host,
+		r:    r,
+		opts: opts,
+	}
+}
+
+// Addr returns an address of the host. If the cached result is expired
+// or was invalidated, the host will be resolved again. If the lookup
+// failed, the expired result will be used if there is one, and the host
+// won't be resolved again in a short period.
+func (b *Bootstrap) Addr(ctx context.Context) (netip.Addr, error) {
+	if addr, ok := b.cachedAddr(time.Now()); ok {
+		return addr, nil
+	}
+
+	b.lookupMu.Lock()
+	defer b.lookupMu.Unlock()
+
+	// Another goroutine may have finished the lookup.
+	if addr, ok := b.cachedAddr(time.Now()); ok {
+		return addr, nil
+	}
+
+	addrs, ttl, err := b.r.LookupAddr(ctx, b.host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no address")
+	}
+	if err != nil {
+		b.m.Lock()
+		defer b.m.Unlock()
+		if len(b.addrs) > 0 {
+			b.expire = time.Now().Add(failedLookupTTL)
+			b.opts.Logger.Warn("failed to resolve upstream host, using the expired address", zap.String("host", b.host), zap.Error(err))
+			return b.addrs[0], nil
+		}
+		return netip.Addr{}, fmt.Errorf("failed to resolve %s, %w", b.host, err)
+	}
+
+	if ttl < b.opts.MinTTL {
+		ttl = b.opts.MinTTL
+	}
+	if ttl > b.opts.MaxTTL {
+		ttl = b.opts.MaxTTL
+	}
+	b.opts.Logger.Debug("upstream host resolved", zap.String("host", b.host), zap.Any("addrs", addrs), zap.Duration("ttl", ttl))
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.addrs = addrs
+	b.expire = time.Now().Add(ttl)
+	return addrs[0], nil
+}
+
+func (b *Bootstrap) cachedAddr(now time.Time) (netip.Addr, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if len(b.addrs) == 0 || now.After(b.expire) {
+		return netip.Addr{}, false
+	}
+	return b.addrs[0], true
+}
+
+// Invalidate marks the cached result as expired, e.g. when the connection
+// to addr failed. The next call of Addr will resolve the host again.
+// If addr is valid and is not the current address, Invalidate is a noop.
+func (b *Bootstrap) Invalidate(addr netip.Addr) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if addr.IsValid() && (len(b.addrs) == 0 || b.addrs[0] != addr) {
+		return
 	}
+	b.expire = time.Time{}
 }
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	addrs []netip.Addr
+	ttl   time.Duration
+	err   error
+	calls int
+}
+
+func (r *fakeResolver) LookupAddr(_ context.Context, _ string) ([]netip.Addr, time.Duration, error) {
+	r.calls++
+	return r.addrs, r.ttl, r.err
+}
+
+func TestBootstrap(t *testing.T) {
+	a1 := netip.MustParseAddr("192.0.2.1")
+	a2 := netip.MustParseAddr("192.0.2.2")
+	r := &fakeResolver{addrs: []netip.Addr{a1}, ttl: time.Second}
+	b := NewBootstrap("example.com", r, Opts{MinTTL: time.Hour})
+	ctx := context.Background()
+
+	mustAddr := func(want netip.Addr, wantCalls int) {
+		t.Helper()
+		addr, err := b.Addr(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != want {
+			t.Fatalf("want addr %s, got %s", want, addr)
+		}
+		if r.calls != wantCalls {
+			t.Fatalf("want %d lookups, got %d", wantCalls, r.calls)
+		}
+	}
+
+	mustAddr(a1, 1)
+	mustAddr(a1, 1) // cached
+
+	// Invalidating an address that is not in use is a noop.
+	b.Invalidate(a2)
+	mustAddr(a1, 1)
+
+	r.addrs = []netip.Addr{a2}
+	b.Invalidate(a1)
+	mustAddr(a2, 2)
+
+	// The expired address is used if the lookup failed.
+	r.err = errors.New("lookup failed")
+	b.Invalidate(netip.Addr{})
+	mustAddr(a2, 3)
+	mustAddr(a2, 3) // no more lookups within failedLookupTTL
+
+	b2 := NewBootstrap("example.com", r, Opts{})
+	if _, err := b2.Addr(ctx); err == nil {
+		t.Fatal("want an error")
+	}
+}
+
+func TestPlainResolver(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := dns.Server{PacketConn: c, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET}
+		switch q.Question[0].Qtype {
+		case dns.TypeA:
+			hdr.Ttl = 300
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)})
+		case dns.TypeAAAA:
+			hdr.Ttl = 100
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		w.WriteMsg(r)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	if _, err := NewPlainResolver("dns.google", nil); err == nil {
+		t.Fatal("want an error for a domain server")
+	}
+	pr, err := NewPlainResolver(c.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	addrs, ttl, err := pr.LookupAddr(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	if len(addrs) != len(want) || addrs[0] != want[0] || addrs[1] != want[1] {
+		t.Fatalf("want addrs %v, got %v", want, addrs)
+	}
+	if ttl != time.Second*100 {
+		t.Fatalf("want ttl 100s, got %s", ttl)
+	}
+}
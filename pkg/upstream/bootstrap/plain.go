@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// PlainResolver is a Resolver that sends plain dns queries to a server.
+type PlainResolver struct {
+	server string
+	dialer *net.Dialer
+}
+
+// NewPlainResolver returns a PlainResolver that queries s.
+// s MUST be a literal IP address. Port can be omitted. In this case,
+// the default port is :53. e.g. "8.8.8.8", "127.0.0.1:5353".
+// dialer can be nil.
+func NewPlainResolver(s string, dialer *net.Dialer) (*PlainResolver, error) {
+	_, _, err := net.SplitHostPort(s)
+	if err != nil { // no port, add it.
+		s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+	}
+	if _, err := netip.ParseAddrPort(s); err != nil {
+		return nil, fmt.Errorf("bootstrap server must be an ip address, %w", err)
+	}
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	return &PlainResolver{server: s, dialer: dialer}, nil
+}
+
+// NewPlainBootstrap returns a customized *net.Resolver which Dial func is modified to dial s.
+// s SHOULD be a literal IP address and the port SHOULD also be literal.
+// Port can be omitted. In this case, the default port is :53.
+// e.g. NewPlainBootstrap("8.8.8.8"), NewPlainBootstrap("127.0.0.1:5353")
+// If s is empty, NewPlainBootstrap returns nil. (A nil *net.Resolver is valid in net.Dialer.)
+//
+// Deprecated: Use NewPlainResolver with NewBootstrap instead. They cache the
+// result and do not depend on the platform support of a customized *net.Resolver.
+func NewPlainBootstrap(s string) *net.Resolver {
+	if len(s) == 0 {
+		return nil
+	}
+	// Add port.
+	_, _, err := net.SplitHostPort(s)
+	if err != nil { // no port, add it.
+		s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+	}
+
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: false,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := new(net.Dialer)
+			return d.DialContext(ctx, network, s)
+		},
+	}
+}
+
+// LookupAddr queries A and AAAA records of host concurrently. IPv4
+// addresses are placed before IPv6 addresses.
+func (r *PlainResolver) LookupAddr(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	qtypes := [...]uint16{dns.TypeA, dns.TypeAAAA}
+	var results [len(qtypes)]chan result
+	for i, qt := range qtypes {
+		c := make(chan result, 1)
+		results[i] = c
+		qt := qt
+		go func() {
+			addrs, ttl, err := r.lookup(ctx, host, qt)
+			c <- result{addrs: addrs, ttl: ttl, err: err}
+		}()
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var firstErr error
+	for _, c := range results {
+		res := <-c
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if len(res.addrs) == 0 {
+			continue
+		}
+		if len(addrs) == 0 || res.ttl < ttl {
+			ttl = res.ttl
+		}
+		addrs = append(addrs, res.addrs...)
+	}
+	if len(addrs) == 0 && firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return addrs, ttl, nil
+}
+
+func (r *PlainResolver) lookup(ctx context.Context, host string, qt uint16) ([]netip.Addr, time.Duration, error) {
+	resp, err := r.exchange(ctx, host, qt)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []netip.Addr
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		if len(addrs) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+func (r *PlainResolver) exchange(ctx context.Context, name string, qt uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qt)
+
+	c := &dns.Client{Net: "udp", Dialer: utils.DialerForNetwork(r.dialer, "udp")}
+	resp, _, err := c.ExchangeContext(ctx, q, r.server)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		c.Dialer = utils.DialerForNetwork(r.dialer, "tcp")
+		resp, _, err = c.ExchangeContext(ctx, q, r.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("bootstrap server returned rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
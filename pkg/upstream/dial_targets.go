@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/bootstrap"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDialAttemptTimeout is the timeout of each dial attempt if the
+// dial context has no deadline.
+const defaultDialAttemptTimeout = time.Second * 5
+
+// dialTarget is a server address that the upstream dials to.
+type dialTarget struct {
+	addr string
+	b    *bootstrap.Bootstrap // can be nil
+}
+
+// dialTargets is a list of pinned server addresses. Dials start from the
+// last address that worked and rotate through the others on failures.
+type dialTargets struct {
+	targets []dialTarget
+	logger  *zap.Logger // can be nil
+	last    uint32      // atomic, index of the last working target
+}
+
+// newDialTargets returns the dialTargets from opt.DialAddr and opt.DialAddrs.
+// If both are empty, host will be dialed.
+func newDialTargets(host string, defaultPort int, dialer *net.Dialer, opt *Opt) (*dialTargets, error) {
+	var addrs []string
+	if len(opt.DialAddr) > 0 {
+		addrs = append(addrs, opt.DialAddr)
+	}
+	addrs = append(addrs, opt.DialAddrs...)
+	if len(addrs) == 0 {
+		addrs = append(addrs, "")
+	}
+
+	t := &dialTargets{logger: opt.Logger}
+	for _, a := range addrs {
+		addr := getDialAddrWithPort(host, a, defaultPort)
+		b, err := newBootstrap(addr, opt.Bootstrap, dialer, opt)
+		if err != nil {
+			return nil, err
+		}
+		t.targets = append(t.targets, dialTarget{addr: addr, b: b})
+	}
+	return t, nil
+}
+
+// first returns the first address.
+func (t *dialTargets) first() string {
+	return t.targets[0].addr
+}
+
+// dialTargetsDo calls f with targets of t until f succeeded. If there are
+// more than one target, each attempt has its own share of the ctx deadline.
+func dialTargetsDo[T any](ctx context.Context, t *dialTargets, f func(ctx context.Context, target dialTarget) (T, error)) (T, error) {
+	n := len(t.targets)
+	if n == 1 {
+		return f(ctx, t.targets[0])
+	}
+
+	start := int(atomic.LoadUint32(&t.last))
+	var firstErr error
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		timeout := defaultDialAttemptTimeout
+		if ddl, ok := ctx.Deadline(); ok {
+			timeout = time.Until(ddl) / time.Duration(n-i)
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		v, err := f(attemptCtx, t.targets[idx])
+		cancel()
+		if err == nil {
+			if idx != start {
+				atomic.StoreUint32(&t.last, uint32(idx))
+			}
+			return v, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if t.logger != nil {
+			t.logger.Debug("failed to dial server address", zap.String("addr", t.targets[idx].addr), zap.Error(err))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	var zero T
+	return zero, firstErr
+}
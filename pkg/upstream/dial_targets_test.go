@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_dialTargetsDo(t *testing.T) {
+	targets, err := newDialTargets("example.com", 853, new(net.Dialer), &Opt{
+		DialAddr:  "192.0.2.1",
+		DialAddrs: []string{"192.0.2.2", "[2001:db8::1]:8853"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.1:853", "192.0.2.2:853", "[2001:db8::1]:8853"}
+	for i, target := range targets.targets {
+		if target.addr != want[i] {
+			t.Fatalf("target #%d, want %s, got %s", i, want[i], target.addr)
+		}
+	}
+
+	working := "192.0.2.2:853"
+	var dialed []string
+	dial := func(ctx context.Context, target dialTarget) (string, error) {
+		dialed = append(dialed, target.addr)
+		if target.addr != working {
+			return "", errors.New("dial failed")
+		}
+		return target.addr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if addr, err := dialTargetsDo(ctx, targets, dial); err != nil || addr != working {
+		t.Fatalf("unexpected result %s, %v", addr, err)
+	}
+	if len(dialed) != 2 {
+		t.Fatalf("want 2 attempts, got %v", dialed)
+	}
+
+	// The last working address is dialed first.
+	dialed = nil
+	if _, err := dialTargetsDo(ctx, targets, dial); err != nil || len(dialed) != 1 {
+		t.Fatalf("want 1 attempt, got %v, %v", dialed, err)
+	}
+
+	// Rotate to the next one.
+	working = "[2001:db8::1]:8853"
+	dialed = nil
+	if _, err := dialTargetsDo(ctx, targets, dial); err != nil || len(dialed) != 2 || dialed[0] != "192.0.2.2:853" {
+		t.Fatalf("unexpected attempts %v, %v", dialed, err)
+	}
+
+	working = ""
+	if _, err := dialTargetsDo(ctx, targets, dial); err == nil {
+		t.Fatal("want an error")
+	}
+}
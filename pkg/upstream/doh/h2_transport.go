@@ -0,0 +1,360 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultH2MaxConns     = 2
+	defaultH2IdleTimeout  = time.Second * 30
+	defaultH2PingInterval = time.Second * 15
+	defaultH2PingTimeout  = time.Second * 5
+	h2DialTimeout         = time.Second * 5
+)
+
+var (
+	errPoolClosed = errors.New("connection pool closed")
+	errNotH2      = errors.New("server does not support http2")
+)
+
+// H2TransportOpts configures a H2Transport.
+type H2TransportOpts struct {
+	// DialTLS dials a tls connection to the server with nextProtos as
+	// its ALPN protocols. Required.
+	DialTLS func(ctx context.Context, nextProtos []string) (*tls.Conn, error)
+
+	// MaxConns limits the number of http2 connections. Default is 2.
+	MaxConns int
+
+	// IdleTimeout closes connections that have no active stream for this
+	// period. Default is 30s.
+	IdleTimeout time.Duration
+
+	// PingInterval and PingTimeout control the liveness check. Every
+	// connection will be pinged every PingInterval. If the ping takes
+	// longer than PingTimeout, the connection will be evicted and closed.
+	// Default is 15s and 5s.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	Logger *zap.Logger
+}
+
+// H2Transport is a http.RoundTripper that manages its own http2 connections
+// instead of relying on http.Transport.
+// Connections that received a GOAWAY frame, have no available stream or
+// failed a ping are evicted from the pool immediately. So new requests
+// won't be sent to broken connections.
+// If the server does not support http2, H2Transport falls back to http/1.1.
+type H2Transport struct {
+	opts H2TransportOpts
+	t2   *http2.Transport
+	t1   *http.Transport // http/1.1 fallback
+	pool *h2ConnPool
+
+	useH1 uint32 // atomic, set if the server does not support http2
+}
+
+func NewH2Transport(opts H2TransportOpts) *H2Transport {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = defaultH2MaxConns
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultH2IdleTimeout
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = defaultH2PingInterval
+	}
+	if opts.PingTimeout <= 0 {
+		opts.PingTimeout = defaultH2PingTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	t := &H2Transport{opts: opts}
+	t.pool = &h2ConnPool{t: t}
+	// Requests on full connections wait for a free slot instead of
+	// failing. The pool only does this once MaxConns is reached.
+	t.t2 = &http2.Transport{ConnPool: t.pool, StrictMaxConcurrentStreams: true}
+	t.t1 = &http.Transport{
+		DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return opts.DialTLS(ctx, []string{"http/1.1"})
+		},
+		IdleConnTimeout:     opts.IdleTimeout,
+		MaxConnsPerHost:     opts.MaxConns,
+		MaxIdleConnsPerHost: opts.MaxConns,
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *H2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadUint32(&t.useH1) == 1 {
+		return t.t1.RoundTrip(req)
+	}
+	resp, err := t.t2.RoundTrip(req)
+	if errors.Is(err, errNotH2) {
+		t.opts.Logger.Warn("server does not support http2, falling back to http/1.1")
+		atomic.StoreUint32(&t.useH1, 1)
+		return t.t1.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes all idle connections. Active connections
+// won't be used by new requests and will be closed once their requests
+// are finished.
+func (t *H2Transport) CloseIdleConnections() {
+	t.pool.shutdownAll()
+	t.t1.CloseIdleConnections()
+}
+
+// Close closes all connections.
+func (t *H2Transport) Close() error {
+	t.pool.close()
+	t.t1.CloseIdleConnections()
+	return nil
+}
+
+// h2ConnPool implements http2.ClientConnPool.
+type h2ConnPool struct {
+	t *H2Transport
+
+	mu      sync.Mutex
+	closed  bool
+	conns   []*http2.ClientConn
+	dialing *dialCall
+}
+
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// GetClientConn implements http2.ClientConnPool.
+func (p *h2ConnPool) GetClientConn(req *http.Request, _ string) (*http2.ClientConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		if cc := p.pickLocked(); cc != nil {
+			p.mu.Unlock()
+			return cc, nil
+		}
+		call := p.dialing
+		if call == nil {
+			call = &dialCall{done: make(chan struct{})}
+			p.dialing = call
+			go p.dial(call)
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-call.done:
+			if call.err != nil {
+				return nil, call.err
+			}
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// pickLocked evicts unusable connections and reserves a stream on the
+// least loaded connection that is not full, i.e. has not reached the
+// server's MaxConcurrentStreams. If all connections are full, it returns
+// nil so a new connection will be opened, unless the pool has reached
+// MaxConns. In this case, the stream is reserved on the least loaded
+// connection and the request waits there for a free slot.
+func (p *h2ConnPool) pickLocked() *http2.ClientConn {
+	var best *http2.ClientConn
+	bestLoad := -1
+	bestFull := false
+	conns := p.conns[:0]
+	for _, c := range p.conns {
+		st := c.State()
+		if st.Closed || st.Closing {
+			if st.Closing && !st.Closed {
+				p.t.opts.Logger.Debug("evicting closing http2 connection", zap.Int("active_streams", st.StreamsActive))
+			}
+			continue
+		}
+		conns = append(conns, c)
+		load := st.StreamsActive + st.StreamsReserved + st.StreamsPending
+		full := st.MaxConcurrentStreams > 0 && uint32(load) >= st.MaxConcurrentStreams
+		if best == nil || (bestFull && !full) || (bestFull == full && load < bestLoad) {
+			best, bestLoad, bestFull = c, load, full
+		}
+	}
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = conns
+
+	if best == nil || (bestFull && len(p.conns) < p.t.opts.MaxConns) {
+		return nil
+	}
+	if !best.ReserveNewRequest() {
+		return nil
+	}
+	return best
+}
+
+func (p *h2ConnPool) dial(call *dialCall) {
+	cc, err := p.dialConn()
+
+	p.mu.Lock()
+	p.dialing = nil
+	if err == nil {
+		if p.closed {
+			cc.Close()
+			err = errPoolClosed
+		} else {
+			p.conns = append(p.conns, cc)
+			go p.healthCheck(cc)
+		}
+	}
+	p.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+}
+
+func (p *h2ConnPool) dialConn() (*http2.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h2DialTimeout)
+	defer cancel()
+	c, err := p.t.opts.DialTLS(ctx, []string{http2.NextProtoTLS, "http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+	if c.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		c.Close()
+		return nil, errNotH2
+	}
+	cc, err := p.t.t2.NewClientConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// healthCheck pings cc periodically and closes cc if it has been idle
+// for too long, until cc is closed.
+func (p *h2ConnPool) healthCheck(cc *http2.ClientConn) {
+	opts := p.t.opts
+	interval := opts.PingInterval
+	if opts.IdleTimeout < interval {
+		interval = opts.IdleTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	created := time.Now()
+	lastPing := created
+	for now := range ticker.C {
+		st := cc.State()
+		if st.Closed {
+			return
+		}
+		if st.Closing { // e.g. GOAWAY received, wait for active streams.
+			continue
+		}
+
+		if st.StreamsActive+st.StreamsReserved+st.StreamsPending == 0 {
+			lastIdle := st.LastIdle
+			if lastIdle.IsZero() {
+				lastIdle = created
+			}
+			if now.Sub(lastIdle) >= opts.IdleTimeout {
+				// Shutdown waits for requests that might just be started.
+				p.remove(cc)
+				cc.Shutdown(context.Background())
+				return
+			}
+		}
+
+		if now.Sub(lastPing) < opts.PingInterval {
+			continue
+		}
+		lastPing = now
+		ctx, cancel := context.WithTimeout(context.Background(), opts.PingTimeout)
+		err := cc.Ping(ctx)
+		cancel()
+		if err != nil {
+			opts.Logger.Debug("http2 ping failed, closing connection", zap.Error(err))
+			p.MarkDead(cc)
+			return
+		}
+	}
+}
+
+// MarkDead implements http2.ClientConnPool.
+func (p *h2ConnPool) MarkDead(cc *http2.ClientConn) {
+	p.remove(cc)
+	cc.Close()
+}
+
+func (p *h2ConnPool) remove(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == cc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// shutdownAll gracefully closes all connections.
+func (p *h2ConnPool) shutdownAll() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	for _, cc := range conns {
+		go cc.Shutdown(context.Background())
+	}
+}
+
+func (p *h2ConnPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	for _, cc := range conns {
+		cc.Close()
+	}
+}
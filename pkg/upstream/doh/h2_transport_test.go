@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestH2Transport(s *httptest.Server, dials *int32) *H2Transport {
+	return NewH2Transport(H2TransportOpts{
+		DialTLS: func(ctx context.Context, nextProtos []string) (*tls.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			d := new(net.Dialer)
+			c, err := d.DialContext(ctx, "tcp", s.Listener.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		PingInterval: time.Millisecond * 50,
+		PingTimeout:  time.Millisecond * 50,
+	})
+}
+
+func doTestRequest(t *testing.T, rt http.RoundTripper, url string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestH2Transport(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	var dials int32
+	h2t := newTestH2Transport(s, &dials)
+	defer h2t.Close()
+
+	if resp := doTestRequest(t, h2t, s.URL); resp.ProtoMajor != 2 {
+		t.Fatalf("want http2, got %s", resp.Proto)
+	}
+	doTestRequest(t, h2t, s.URL)
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("connection should be reused, got %d dials", n)
+	}
+
+	// Broken connections should be evicted.
+	s.CloseClientConnections()
+	time.Sleep(time.Millisecond * 100)
+	doTestRequest(t, h2t, s.URL)
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("want a new connection, got %d dials", n)
+	}
+
+	// Connections that received a GOAWAY should not take new requests.
+	h2t.CloseIdleConnections()
+	doTestRequest(t, h2t, s.URL)
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatalf("want a new connection, got %d dials", n)
+	}
+}
+
+func TestH2Transport_fullConn(t *testing.T) {
+	arrived := make(chan struct{}, 8)
+	release := make(chan struct{})
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	if err := http2.ConfigureServer(s.Config, &http2.Server{MaxConcurrentStreams: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	for _, maxConns := range []int{1, 2} {
+		var dials int32
+		h2t := newTestH2Transport(s, &dials)
+		h2t.opts.MaxConns = maxConns
+
+		done := make(chan struct{}, 2)
+		go func() {
+			doTestRequest(t, h2t, s.URL)
+			done <- struct{}{}
+		}()
+		<-arrived // The first connection is full now.
+		go func() {
+			doTestRequest(t, h2t, s.URL)
+			done <- struct{}{}
+		}()
+
+		if maxConns == 1 {
+			// The second request waits on the full connection.
+			select {
+			case <-arrived:
+				t.Fatal("the second request should wait for a free stream")
+			case <-time.After(time.Millisecond * 100):
+			}
+			release <- struct{}{}
+			<-arrived
+			release <- struct{}{}
+		} else {
+			// The second request is sent through a new connection.
+			<-arrived
+			release <- struct{}{}
+			release <- struct{}{}
+		}
+		<-done
+		<-done
+		if n := atomic.LoadInt32(&dials); n != int32(maxConns) {
+			t.Fatalf("max conns %d, want %d dials, got %d", maxConns, maxConns, n)
+		}
+		h2t.Close()
+	}
+}
+
+func TestH2Transport_H1Fallback(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	var dials int32
+	h2t := newTestH2Transport(s, &dials)
+	defer h2t.Close()
+
+	for i := 0; i < 2; i++ {
+		if resp := doTestRequest(t, h2t, s.URL); resp.ProtoMajor != 1 {
+			t.Fatalf("want http/1.1, got %s", resp.Proto)
+		}
+	}
+}
@@ -20,6 +20,7 @@
 package doh
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
@@ -45,12 +46,27 @@ type Upstream struct {
 
 	// AddOnCloser will be closed when Upstream is closed.
 	AddOnCloser io.Closer
+
+	// UsePOST sends queries in the body of POST requests instead of the
+	// "dns" parameter of GET requests. GET requests are cache friendly and
+	// should be preferred. POST requests have a smaller overhead.
+	UsePOST bool
+
+	// Header specifies additional headers that will be sent with every
+	// request. A "Host" header overwrites the host of EndPoint.
+	Header http.Header
 }
 
 func (u *Upstream) CloseIdleConnections() {
 	u.Client.CloseIdleConnections()
 }
 
+// ResetConnections closes idle connections. Active connections will
+// be closed once their requests are finished.
+func (u *Upstream) ResetConnections() {
+	u.Client.CloseIdleConnections()
+}
+
 func (u *Upstream) Close() error {
 	u.Client.CloseIdleConnections()
 	if u.AddOnCloser != nil {
@@ -78,22 +94,16 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	wire[0] = 0
 	wire[1] = 0
 
-	urlLen := len(u.EndPoint) + 5 + base64.RawURLEncoding.EncodedLen(len(wire))
-	urlBuf := make([]byte, urlLen)
-
-	p := 0
-	p += copy(urlBuf[p:], u.EndPoint)
-	// A simple way to check whether the endpoint already has a parameter.
-	if strings.LastIndexByte(u.EndPoint, '?') >= 0 {
-		p += copy(urlBuf[p:], "&dns=")
+	var url string
+	var body []byte
+	if u.UsePOST {
+		url = u.EndPoint
+		body = make([]byte, len(wire))
+		copy(body, wire)
 	} else {
-		p += copy(urlBuf[p:], "?dns=")
+		url = u.getURL(wire)
 	}
 
-	// Padding characters for base64url MUST NOT be included.
-	// See: https://tools.ietf.org/html/rfc8484#section-6.
-	base64.RawURLEncoding.Encode(urlBuf[p:], wire)
-
 	type result struct {
 		r   *dns.Msg
 		err error
@@ -107,7 +117,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 		// reduces the connection reuse efficiency.
 		ctx, cancel := context.WithTimeout(context.Background(), defaultDoHTimeout)
 		defer cancel()
-		r, err := u.exchange(ctx, utils.BytesToStringUnsafe(urlBuf))
+		r, err := u.exchange(ctx, url, body)
 		resChan <- &result{r: r, err: err}
 	}()
 
@@ -124,14 +134,54 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	}
 }
 
-func (u *Upstream) exchange(ctx context.Context, url string) (*dns.Msg, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// getURL returns the url of a GET request for query wire.
+func (u *Upstream) getURL(wire []byte) string {
+	urlLen := len(u.EndPoint) + 5 + base64.RawURLEncoding.EncodedLen(len(wire))
+	urlBuf := make([]byte, urlLen)
+
+	p := 0
+	p += copy(urlBuf[p:], u.EndPoint)
+	// A simple way to check whether the endpoint already has a parameter.
+	if strings.LastIndexByte(u.EndPoint, '?') >= 0 {
+		p += copy(urlBuf[p:], "&dns=")
+	} else {
+		p += copy(urlBuf[p:], "?dns=")
+	}
+
+	// Padding characters for base64url MUST NOT be included.
+	// See: https://tools.ietf.org/html/rfc8484#section-6.
+	base64.RawURLEncoding.Encode(urlBuf[p:], wire)
+	return utils.BytesToStringUnsafe(urlBuf)
+}
+
+// exchange sends a GET request to url if body is nil. Otherwise, it sends
+// body in a POST request.
+func (u *Upstream) exchange(ctx context.Context, url string, body []byte) (*dns.Msg, error) {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("interal err: NewRequestWithContext: %w", err)
 	}
 
 	req.Header["Accept"] = []string{"application/dns-message"}
+	if body != nil {
+		req.Header["Content-Type"] = []string{"application/dns-message"}
+	}
 	req.Header["User-Agent"] = nil // Don't let go http send a default user agent header.
+	for k, vs := range u.Header {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			if len(vs) > 0 {
+				req.Host = vs[0]
+			}
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(k)] = vs
+	}
 	resp, err := u.Client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("http request failed: %w", err)
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstream_ExchangeContext(t *testing.T) {
+	type reqInfo struct {
+		method string
+		host   string
+		auth   string
+		query  []byte
+	}
+	reqs := make(chan reqInfo, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info := reqInfo{method: req.Method, host: req.Host, auth: req.Header.Get("Authorization")}
+		var err error
+		if req.Method == http.MethodPost {
+			info.query, err = io.ReadAll(req.Body)
+		} else {
+			info.query, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reqs <- info
+
+		q := new(dns.Msg)
+		if err := q.Unpack(info.query); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		b, _ := r.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(b)
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		name       string
+		usePOST    bool
+		header     http.Header
+		wantMethod string
+		wantHost   string
+		wantAuth   string
+	}{
+		{name: "get", wantMethod: http.MethodGet},
+		{name: "post", usePOST: true, wantMethod: http.MethodPost},
+		{
+			name:       "header",
+			header:     http.Header{"Authorization": {"Bearer token"}, "Host": {"dns.example"}},
+			wantMethod: http.MethodGet,
+			wantHost:   "dns.example",
+			wantAuth:   "Bearer token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Upstream{
+				EndPoint: s.URL + "/dns-query",
+				Client:   s.Client(),
+				UsePOST:  tt.usePOST,
+				Header:   tt.header,
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			r, err := u.ExchangeContext(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Id != q.Id {
+				t.Fatalf("want id %d, got %d", q.Id, r.Id)
+			}
+
+			info := <-reqs
+			if info.method != tt.wantMethod {
+				t.Fatalf("want method %s, got %s", tt.wantMethod, info.method)
+			}
+			if len(tt.wantHost) > 0 && info.host != tt.wantHost {
+				t.Fatalf("want host %s, got %s", tt.wantHost, info.host)
+			}
+			if info.auth != tt.wantAuth {
+				t.Fatalf("want auth header %q, got %q", tt.wantAuth, info.auth)
+			}
+			if info.query[0] != 0 || info.query[1] != 0 {
+				t.Fatal("query id should be 0")
+			}
+		})
+	}
+}
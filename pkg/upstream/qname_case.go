@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/miekg/dns"
+)
+
+// ErrQNameCaseMismatch is returned by UDP upstreams with Opt.Enable0x20 if
+// the qname in the response does not have the same case as the query,
+// which means the response may be spoofed.
+var ErrQNameCaseMismatch = errors.New("qname case mismatch")
+
+// randomizeCase returns a copy of q whose qname has letters in random
+// cases (DNS 0x20). Other fields are shared with q.
+func randomizeCase(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return q
+	}
+	name := []byte(q.Question[0].Name)
+	rnd := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(rnd); err != nil {
+		return q
+	}
+	for i, c := range name {
+		if !isLetter(c) {
+			continue
+		}
+		if rnd[i/8]&(1<<(i%8)) != 0 {
+			name[i] = c | 0x20 // lower
+		} else {
+			name[i] = c &^ 0x20 // upper
+		}
+	}
+	nq := new(dns.Msg)
+	*nq = *q
+	nq.Question = []dns.Question{q.Question[0]}
+	nq.Question[0].Name = string(name)
+	return nq
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// restoreCase verifies that the qname of r, the response of the randomized
+// query rq, has the same case as rq, and restores the names of q in r.
+// Responses without a question section are accepted only if they are
+// errors.
+func restoreCase(r, rq, q *dns.Msg) error {
+	if rq == q {
+		return nil
+	}
+	randomized, org := rq.Question[0].Name, q.Question[0].Name
+	if len(r.Question) == 0 {
+		if r.Rcode == dns.RcodeSuccess {
+			return ErrQNameCaseMismatch
+		}
+		return nil
+	}
+	if r.Question[0].Name != randomized {
+		return ErrQNameCaseMismatch
+	}
+	r.Question[0].Name = org
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Name == randomized {
+				h.Name = org
+			}
+		}
+	}
+	return nil
+}
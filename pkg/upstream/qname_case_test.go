@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_randomizeCase(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.a-very-long-domain-name.example.com.", dns.TypeA)
+	changed := false
+	for i := 0; i < 10; i++ {
+		rq := randomizeCase(q)
+		if q.Question[0].Name != "www.a-very-long-domain-name.example.com." {
+			t.Fatal("query is modified")
+		}
+		if !strings.EqualFold(rq.Question[0].Name, q.Question[0].Name) {
+			t.Fatalf("randomized name %s is a different name", rq.Question[0].Name)
+		}
+		if rq.Question[0].Name != q.Question[0].Name {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Fatal("name is never randomized")
+	}
+}
+
+func Test_udpWithFallback_0x20(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler dns.HandlerFunc
+		wantErr bool
+	}{
+		{"case preserved", func(w dns.ResponseWriter, q *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: []byte{1, 1, 1, 1}}}
+			w.WriteMsg(r)
+		}, false},
+		{"case not preserved", func(w dns.ResponseWriter, q *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+			w.WriteMsg(r)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, shutdown := newUDPTestServer(t, tt.handler)
+			defer shutdown()
+			u, err := NewUpstream(addr+"?0x20=true", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("www.example.com.", dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			r, err := u.ExchangeContext(ctx, q)
+			if tt.wantErr {
+				if !errors.Is(err, ErrQNameCaseMismatch) {
+					t.Fatalf("want ErrQNameCaseMismatch, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Question[0].Name != "www.example.com." || r.Answer[0].Header().Name != "www.example.com." {
+				t.Fatalf("names are not restored, %v", r)
+			}
+		})
+	}
+}
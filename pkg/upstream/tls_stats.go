@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package upstream
+
+import (
+	"crypto/tls"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// defaultTLSSessionCacheSize is the size of the per-upstream tls session
+// cache if the tls.Config from Opt does not have one.
+const defaultTLSSessionCacheSize = 64
+
+// tlsStats records the tls handshakes of an upstream, so users can
+// see how many handshakes were resumed from a cached session.
+type tlsStats struct {
+	addr             string
+	logger           *zap.Logger        // can be nil
+	handshakeCounter prometheus.Counter // can be nil
+	resumedCounter   prometheus.Counter // can be nil
+	early0RTTCounter prometheus.Counter // can be nil
+}
+
+func newTLSStats(addr string, opt *Opt) *tlsStats {
+	return &tlsStats{
+		addr:             addr,
+		logger:           opt.Logger,
+		handshakeCounter: opt.TLSHandshakeCounter,
+		resumedCounter:   opt.TLSResumedCounter,
+		early0RTTCounter: opt.TLS0RTTCounter,
+	}
+}
+
+// observe records a completed handshake.
+func (s *tlsStats) observe(cs tls.ConnectionState, used0RTT bool) {
+	if s.handshakeCounter != nil {
+		s.handshakeCounter.Inc()
+	}
+	if cs.DidResume && s.resumedCounter != nil {
+		s.resumedCounter.Inc()
+	}
+	if used0RTT && s.early0RTTCounter != nil {
+		s.early0RTTCounter.Inc()
+	}
+	if s.logger != nil {
+		s.logger.Debug(
+			"tls handshake completed",
+			zap.String("addr", s.addr),
+			zap.Bool("resumed", cs.DidResume),
+			zap.Bool("0rtt", used0RTT),
+		)
+	}
+}
+
+// cloneTLSConfig returns a copy of c with a session cache. If c does not have
+// a session cache, a new one is created, so sessions are not shared between
+// upstreams that have different servers.
+func cloneTLSConfig(c *tls.Config) *tls.Config {
+	if c == nil {
+		c = new(tls.Config)
+	} else {
+		c = c.Clone()
+	}
+	if c.ClientSessionCache == nil {
+		c.ClientSessionCache = tls.NewLRUClientSessionCache(defaultTLSSessionCacheSize)
+	}
+	return c
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// RetryClass is a bit set of failure classes that a RetryPolicy retries on.
+type RetryClass uint8
+
+const (
+	// RetryOnConnReset retries queries that failed on a reused connection,
+	// which may have been closed or reset by the server or middle boxes.
+	// Failures on freshly dialed connections are never retried by this class.
+	RetryOnConnReset RetryClass = 1 << iota
+	// RetryOnTimeout retries queries that did not get a response within
+	// RetryPolicy.AttemptTimeout.
+	RetryOnTimeout
+	// RetryOnServfail retries queries that got a SERVFAIL response.
+	RetryOnServfail
+	// RetryOnRefused retries queries that got a REFUSED response.
+	RetryOnRefused
+)
+
+var retryClassNames = map[string]RetryClass{
+	"conn_reset": RetryOnConnReset,
+	"timeout":    RetryOnTimeout,
+	"servfail":   RetryOnServfail,
+	"refused":    RetryOnRefused,
+}
+
+// ParseRetryClasses parses class names (conn_reset, timeout, servfail,
+// refused) to a RetryClass.
+func ParseRetryClasses(names []string) (RetryClass, error) {
+	var c RetryClass
+	for _, name := range names {
+		v, ok := retryClassNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown retry class %s", name)
+		}
+		c |= v
+	}
+	return c, nil
+}
+
+const (
+	defaultRetryMaxAttempts = 4
+	defaultRetryOn          = RetryOnConnReset
+)
+
+// RetryPolicy controls how Transport retries a query.
+// A nil RetryPolicy is valid and has the default values. The zero
+// value retries nothing.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a query, including
+	// the first one. Default (nil policy) is 4.
+	MaxAttempts int
+
+	// Backoff is the delay before the second attempt. It doubles on each
+	// following attempt but won't exceed MaxBackoff, if MaxBackoff > 0.
+	// Default is 0, which means retrying immediately.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// AttemptTimeout limits the time of each attempt. It is required by
+	// RetryOnTimeout. Otherwise, the first attempt consumes the whole
+	// query timeout.
+	// Default is 0, which means no limit.
+	AttemptTimeout time.Duration
+
+	// RetryOn specifies which failures will be retried.
+	// Default (nil policy) is RetryOnConnReset.
+	RetryOn RetryClass
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil {
+		return defaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryOn() RetryClass {
+	if p == nil {
+		return defaultRetryOn
+	}
+	return p.RetryOn
+}
+
+// attemptContext returns the context of an attempt.
+func (p *RetryPolicy) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p == nil || p.AttemptTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.AttemptTimeout)
+}
+
+// backoff returns the delay before the attempt. attempt starts from 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	if p == nil || p.Backoff <= 0 || attempt <= 1 {
+		return 0
+	}
+	d := p.Backoff
+	for i := 2; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return d
+}
+
+// shouldRetry reports whether the result of the attempt should be retried.
+// attemptCtx is the context of the attempt. reusedConn reports whether the
+// attempt was on a reused connection.
+func (p *RetryPolicy) shouldRetry(attempt int, attemptCtx context.Context, r *dns.Msg, reusedConn bool, err error) bool {
+	if attempt >= p.maxAttempts() {
+		return false
+	}
+	retryOn := p.retryOn()
+	if err != nil {
+		if errors.Is(err, ErrTooManyInflight) || errors.Is(err, errClosedTransport) {
+			return false
+		}
+		if retryOn&RetryOnTimeout != 0 && (isTimeout(err) || attemptCtx.Err() == context.DeadlineExceeded) {
+			return true
+		}
+		return reusedConn && retryOn&RetryOnConnReset != 0
+	}
+	switch r.Rcode {
+	case dns.RcodeServerFailure:
+		return retryOn&RetryOnServfail != 0
+	case dns.RcodeRefused:
+		return retryOn&RetryOnRefused != 0
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryClasses(t *testing.T) {
+	c, err := ParseRetryClasses([]string{"timeout", "servfail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != RetryOnTimeout|RetryOnServfail {
+		t.Fatalf("unexpected classes %b", c)
+	}
+	if _, err := ParseRetryClasses([]string{"nxdomain"}); err == nil {
+		t.Fatal("want err for unknown class")
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 30}
+	want := []time.Duration{0, 0, 10, 20, 30, 30}
+	for attempt, w := range want {
+		if got := p.backoff(attempt); got != w*time.Millisecond {
+			t.Fatalf("attempt %d: want %v, got %v", attempt, w*time.Millisecond, got)
+		}
+	}
+}
+
+// newRcodeTransport returns a Transport whose server replies with rcode to
+// the first n queries and with NOERROR to others.
+func newRcodeTransport(t *testing.T, rcode, n int, p *RetryPolicy) (*Transport, *int32) {
+	var queries int32
+	transport, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				for {
+					q, _, err := dnsutils.ReadMsgFromTCP(c2)
+					if err != nil {
+						return
+					}
+					r := new(dns.Msg)
+					r.SetReply(q)
+					if atomic.AddInt32(&queries, 1) <= int32(n) {
+						r.Rcode = rcode
+					}
+					if _, err := dnsutils.WriteMsgToTCP(c2, r); err != nil {
+						return
+					}
+				}
+			}()
+			return c1, nil
+		},
+		WriteFunc:      dnsutils.WriteMsgToTCP,
+		ReadFunc:       dnsutils.ReadMsgFromTCP,
+		EnablePipeline: true,
+		RetryPolicy:    p,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport, &queries
+}
+
+func TestTransport_RetryPolicy(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	exchange := func(transport *Transport) *dns.Msg {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		r, err := transport.ExchangeContext(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Default policy does not retry SERVFAIL.
+	transport, queries := newRcodeTransport(t, dns.RcodeServerFailure, 1, nil)
+	defer transport.Close()
+	if r := exchange(transport); r.Rcode != dns.RcodeServerFailure || atomic.LoadInt32(queries) != 1 {
+		t.Fatalf("unexpected rcode %d after %d queries", r.Rcode, atomic.LoadInt32(queries))
+	}
+
+	// Retry until success.
+	p := &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: RetryOnServfail | RetryOnRefused}
+	transport, queries = newRcodeTransport(t, dns.RcodeRefused, 2, p)
+	defer transport.Close()
+	if r := exchange(transport); r.Rcode != dns.RcodeSuccess || atomic.LoadInt32(queries) != 3 {
+		t.Fatalf("unexpected rcode %d after %d queries", r.Rcode, atomic.LoadInt32(queries))
+	}
+
+	// The last response is returned if all attempts failed.
+	transport, queries = newRcodeTransport(t, dns.RcodeServerFailure, 5, p)
+	defer transport.Close()
+	if r := exchange(transport); r.Rcode != dns.RcodeServerFailure || atomic.LoadInt32(queries) != 3 {
+		t.Fatalf("unexpected rcode %d after %d queries", r.Rcode, atomic.LoadInt32(queries))
+	}
+}
+
+func TestTransport_RetryOnTimeout(t *testing.T) {
+	var dials int32
+	transport, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			first := atomic.AddInt32(&dials, 1) == 1
+			go func() {
+				defer c2.Close()
+				for {
+					q, _, err := dnsutils.ReadMsgFromTCP(c2)
+					if err != nil {
+						return
+					}
+					if first { // black hole
+						continue
+					}
+					r := new(dns.Msg)
+					r.SetReply(q)
+					if _, err := dnsutils.WriteMsgToTCP(c2, r); err != nil {
+						return
+					}
+				}
+			}()
+			return c1, nil
+		},
+		WriteFunc:   dnsutils.WriteMsgToTCP,
+		ReadFunc:    dnsutils.ReadMsgFromTCP,
+		IdleTimeout: -1,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 2, AttemptTimeout: time.Millisecond * 50, RetryOn: RetryOnTimeout},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := transport.ExchangeContext(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("want 2 dials, got %d", n)
+	}
+}
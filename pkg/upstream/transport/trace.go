@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// ExchangeTrace is a set of hooks to run at various stages of a query
+// exchanged by Transport. Any particular hook may be nil. Hooks are
+// called synchronously by the goroutine of Transport.ExchangeContext,
+// and are called once per attempt if the query is retried.
+// Only upstreams built on Transport (udp, tcp and dot) support it. DoH
+// and DoH over HTTP/3 (quic) upstreams ignore the ExchangeTrace of the
+// context.
+type ExchangeTrace struct {
+	// DialStart is called when the query needs a new connection.
+	DialStart func()
+
+	// DialDone is called when the dial of the new connection has
+	// completed. err is the dial error, if any.
+	DialDone func(err error)
+
+	// ConnReused is called when the query is sent over an existing
+	// connection.
+	ConnReused func()
+
+	// WroteQuery is called after the query has been written.
+	// err is the write error, if any.
+	WroteQuery func(err error)
+
+	// GotResponse is called when the response of the query is received.
+	GotResponse func(r *dns.Msg)
+}
+
+type exchangeTraceKey struct{}
+
+// WithExchangeTrace returns a new context based on ctx. Queries
+// exchanged with the returned context will call the hooks of trace.
+func WithExchangeTrace(ctx context.Context, trace *ExchangeTrace) context.Context {
+	return context.WithValue(ctx, exchangeTraceKey{}, trace)
+}
+
+// ContextExchangeTrace returns the ExchangeTrace of ctx, or nil.
+func ContextExchangeTrace(ctx context.Context) *ExchangeTrace {
+	trace, _ := ctx.Value(exchangeTraceKey{}).(*ExchangeTrace)
+	return trace
+}
+
+func (t *ExchangeTrace) dialStart() {
+	if t != nil && t.DialStart != nil {
+		t.DialStart()
+	}
+}
+
+func (t *ExchangeTrace) dialDone(err error) {
+	if t != nil && t.DialDone != nil {
+		t.DialDone(err)
+	}
+}
+
+func (t *ExchangeTrace) connReused() {
+	if t != nil && t.ConnReused != nil {
+		t.ConnReused()
+	}
+}
+
+func (t *ExchangeTrace) wroteQuery(err error) {
+	if t != nil && t.WroteQuery != nil {
+		t.WroteQuery(err)
+	}
+}
+
+func (t *ExchangeTrace) gotResponse(r *dns.Msg) {
+	if t != nil && t.GotResponse != nil {
+		t.GotResponse(r)
+	}
+}
+
+// ExchangeTimings records the time of each stage of the last attempt
+// of a query. Zero values mean the stage was not reached.
+type ExchangeTimings struct {
+	Start       time.Time
+	DialStart   time.Time
+	DialDone    time.Time
+	WroteQuery  time.Time
+	GotResponse time.Time
+	ConnReused  bool
+}
+
+// Trace returns an ExchangeTrace that records timings to et. Start
+// is set to the current time. et must not be read until the exchange
+// returned.
+func (et *ExchangeTimings) Trace() *ExchangeTrace {
+	et.Start = time.Now()
+	return &ExchangeTrace{
+		DialStart: func() {
+			*et = ExchangeTimings{Start: et.Start, DialStart: time.Now()}
+		},
+		DialDone: func(error) { et.DialDone = time.Now() },
+		ConnReused: func() {
+			*et = ExchangeTimings{Start: et.Start, ConnReused: true}
+		},
+		WroteQuery:  func(error) { et.WroteQuery = time.Now() },
+		GotResponse: func(*dns.Msg) { et.GotResponse = time.Now() },
+	}
+}
+
+// Dial returns the duration of the dial, or zero if the connection
+// was reused.
+func (et *ExchangeTimings) Dial() time.Duration {
+	return sub(et.DialDone, et.DialStart)
+}
+
+// RTT returns the duration between the query was written and the
+// response was received.
+func (et *ExchangeTimings) RTT() time.Duration {
+	return sub(et.GotResponse, et.WroteQuery)
+}
+
+// Total returns the duration between Start and the response was received.
+func (et *ExchangeTimings) Total() time.Duration {
+	return sub(et.GotResponse, et.Start)
+}
+
+func sub(end, start time.Time) time.Duration {
+	if end.IsZero() || start.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExchangeTrace(t *testing.T) {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c2.Close()
+			for {
+				m, _, err := dnsutils.ReadRawMsgFromTCP(c2)
+				if err != nil {
+					return
+				}
+				dnsutils.WriteRawMsgToTCP(c2, m.Bytes())
+				m.Release()
+			}
+		}()
+		return c1, nil
+	}
+
+	tests := []struct {
+		name           string
+		idleTimeout    time.Duration
+		enablePipeline bool
+		wantReused     bool
+	}{
+		{"no connection reuse", -1, false, false},
+		{"connection reuse", time.Second, false, true},
+		{"pipeline", time.Second, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewTransport(Opts{
+				DialFunc:       dial,
+				WriteFunc:      dnsutils.WriteMsgToTCP,
+				ReadFunc:       dnsutils.ReadMsgFromTCP,
+				IdleTimeout:    tt.idleTimeout,
+				EnablePipeline: tt.enablePipeline,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+
+			for i := 0; i < 2; i++ {
+				var et ExchangeTimings
+				var gotResp bool
+				trace := et.Trace()
+				gotResponse := trace.GotResponse
+				trace.GotResponse = func(r *dns.Msg) {
+					gotResp = true
+					gotResponse(r)
+				}
+				ctx := WithExchangeTrace(context.Background(), trace)
+
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				if _, err := transport.ExchangeContext(ctx, q); err != nil {
+					t.Fatal(err)
+				}
+
+				if !gotResp {
+					t.Fatal("GotResponse is not called")
+				}
+				wantReused := i > 0 && tt.wantReused
+				if et.ConnReused != wantReused {
+					t.Fatalf("#%d: ConnReused = %v, want %v", i, et.ConnReused, wantReused)
+				}
+				if !wantReused && (et.DialStart.IsZero() || et.DialDone.IsZero()) {
+					t.Fatalf("#%d: dial is not traced, %+v", i, et)
+				}
+				if et.WroteQuery.Before(et.DialDone) || et.GotResponse.Before(et.WroteQuery) {
+					t.Fatalf("#%d: invalid timings, %+v", i, et)
+				}
+				if et.Total() <= 0 || et.Total() < et.RTT() {
+					t.Fatalf("#%d: invalid durations, total %s, rtt %s", i, et.Total(), et.RTT())
+				}
+			}
+		})
+	}
+}
@@ -26,14 +26,20 @@ import (
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
 )
 
 var (
+	// ErrTooManyInflight is returned when all pipeline connections have
+	// reached Opts.MaxInflightPerConn and the query cannot wait any longer.
+	ErrTooManyInflight = errors.New("too many inflight queries")
+
 	errEOL             = errors.New("end of life")
 	errClosedTransport = errors.New("transport has been closed")
+	errConnReset       = errors.New("connection reset by transport")
 
 	nopLogger = zap.NewNop()
 )
@@ -88,6 +94,38 @@ type Opts struct {
 	// can handle. The connection will be closed if it reached the limit.
 	// Default is defaultMaxQueryPerConn.
 	MaxQueryPerConn uint16
+
+	// MaxInflightPerConn controls the maximum concurrent queries that one
+	// pipeline connection can handle. If all connections are busy and no
+	// more connection can be opened, queries will wait in a queue that can
+	// hold MaxInflightPerConn * MaxConns queries. If the queue is full or
+	// the query context is done while waiting, ErrTooManyInflight will be
+	// returned.
+	// Default is 0, which means no limit.
+	MaxInflightPerConn int
+
+	// KeepaliveProbes controls the maximum number of consecutive probe
+	// queries that an idle pipeline connection sends shortly before
+	// IdleTimeout expires. Probes keep persistent connections alive
+	// through NATs and middle boxes that drop idle connections.
+	// Default is 0, which disables probes. Negative means no limit.
+	KeepaliveProbes int
+
+	// KeepaliveQname is the qname of NS probe queries.
+	// Default is the root domain ".".
+	KeepaliveQname string
+
+	// Datagram indicates that connections are connected datagram (UDP)
+	// sockets, which anyone can send packets to. Pipeline connections
+	// then allocate random query ids that are not in flight on the same
+	// socket, and ignore packets that cannot be unpacked or do not match
+	// the question of the query instead of closing the socket.
+	Datagram bool
+
+	// RetryPolicy controls how failed queries are retried.
+	// Default (nil) retries queries that failed on reused connections
+	// up to 3 times.
+	RetryPolicy *RetryPolicy
 }
 
 // init check and set defaults for this Opts.
@@ -103,6 +141,10 @@ func (opts *Opts) init() error {
 	utils.SetDefaultNum(&opts.IdleTimeout, defaultIdleTimeout)
 	utils.SetDefaultNum(&opts.MaxConns, defaultMaxConns)
 	utils.SetDefaultNum(&opts.MaxQueryPerConn, defaultMaxQueryPerConn)
+	if len(opts.KeepaliveQname) == 0 {
+		opts.KeepaliveQname = "."
+	}
+	opts.KeepaliveQname = dns.Fqdn(opts.KeepaliveQname)
 	return nil
 }
 
@@ -127,11 +169,14 @@ type Transport struct {
 	pipelineConns      map[*dnsConn]*pipelineStatus
 	idledReusableConns map[*dnsConn]struct{}
 	reusableConns      map[*dnsConn]struct{}
+	pipelineWaiting    int
+	pipelineSlotFreed  chan struct{} // closed and renewed when a pipeline query finished
 }
 
 type pipelineStatus struct {
-	wg     sync.WaitGroup
-	served int
+	wg       sync.WaitGroup
+	served   int
+	inflight int
 }
 
 func (t *Transport) isClosed() bool {
@@ -142,12 +187,43 @@ func (t *Transport) isClosed() bool {
 }
 
 func (t *Transport) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	if t.isClosed() {
-		return nil, errClosedTransport
+	p := t.opts.RetryPolicy
+	attempt := 0
+	for {
+		attempt++
+		if t.isClosed() {
+			return nil, errClosedTransport
+		}
+
+		attemptCtx, cancel := p.attemptContext(ctx)
+		r, reusedConn, err := t.exchangeOnce(attemptCtx, q)
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !p.shouldRetry(attempt, attemptCtx, r, reusedConn, err) {
+			return r, err
+		}
+
+		t.opts.Logger.Debug("retrying query", zap.NamedError("previous_err", err), zap.Int("attempt", attempt+1))
+		if d := p.backoff(attempt + 1); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
 	}
+}
 
+// exchangeOnce exchanges q once. reusedConn reports whether q was sent
+// over a reused connection.
+func (t *Transport) exchangeOnce(ctx context.Context, q *dns.Msg) (r *dns.Msg, reusedConn bool, err error) {
 	if t.opts.IdleTimeout <= 0 {
-		return t.exchangeWithoutConnReuse(ctx, q)
+		r, err = t.exchangeWithoutConnReuse(ctx, q)
+		return r, false, err
 	}
 
 	if t.opts.EnablePipeline {
@@ -176,41 +252,62 @@ func (t *Transport) Close() error {
 	return nil
 }
 
-func (t *Transport) exchangeWithPipelineConn(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
-	const maxRetry = 3
+// ResetConnections closes all active connections. Going queries on
+// those connections will fail. Unlike Close, Transport will dial new
+// connections for later queries.
+func (t *Transport) ResetConnections() {
+	t.m.Lock()
+	defer t.m.Unlock()
 
-	attempt := 0
-	var latestErr error
-	for {
-		attempt++
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
+	for conn := range t.pipelineConns {
+		delete(t.pipelineConns, conn)
+		conn.closeWithErr(errConnReset)
+	}
+	for conn := range t.reusableConns {
+		conn.closeWithErr(errConnReset)
+		delete(t.reusableConns, conn)
+		delete(t.idledReusableConns, conn)
+	}
+}
 
-		if latestErr != nil {
-			t.opts.Logger.Debug("retrying pipeline connection", zap.NamedError("previous_err", latestErr), zap.Int("attempt", attempt))
-		}
+// ConnStats is a snapshot of the connections of a Transport.
+type ConnStats struct {
+	Open int // All open connections, including idle ones.
+	Idle int // Connections without inflight queries.
+}
 
-		conn, allocatedQid, isNewConn, wg, err := t.getPipelineConn()
-		if err != nil {
-			return nil, err
+// ConnStats returns the current connection stats of t.
+func (t *Transport) ConnStats() ConnStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s := ConnStats{
+		Open: len(t.pipelineConns) + len(t.reusableConns),
+		Idle: len(t.idledReusableConns),
+	}
+	for _, status := range t.pipelineConns {
+		if status.inflight == 0 {
+			s.Idle++
 		}
+	}
+	return s
+}
 
-		r, err := conn.exchangePipeline(ctx, m, allocatedQid)
-		wg.Done()
-
-		if err != nil {
-			if !isNewConn && attempt <= maxRetry {
-				continue
-			}
-			return nil, err
-		}
-		return r, nil
+func (t *Transport) exchangeWithPipelineConn(ctx context.Context, m *dns.Msg) (*dns.Msg, bool, error) {
+	conn, allocatedQid, isNewConn, status, err := t.getPipelineConn(ctx)
+	if err != nil {
+		return nil, false, err
 	}
+
+	r, err := conn.exchangePipeline(ctx, m, allocatedQid, isNewConn)
+	t.releasePipelineConn(status)
+	return r, !isNewConn, err
 }
 
 func (t *Transport) exchangeWithoutConnReuse(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	trace := ContextExchangeTrace(ctx)
+	trace.dialStart()
 	conn, err := t.opts.DialFunc(ctx)
+	trace.dialDone(err)
 	if err != nil {
 		return nil, err
 	}
@@ -219,6 +316,7 @@ func (t *Transport) exchangeWithoutConnReuse(ctx context.Context, m *dns.Msg) (*
 	conn.SetDeadline(getContextDeadline(ctx, defaultNoConnReuseQueryTimeout))
 
 	_, err = t.opts.WriteFunc(conn, m)
+	trace.wroteQuery(err)
 	if err != nil {
 		return nil, err
 	}
@@ -236,43 +334,24 @@ func (t *Transport) exchangeWithoutConnReuse(ctx context.Context, m *dns.Msg) (*
 
 	select {
 	case res := <-resChan:
+		if res.err == nil {
+			trace.gotResponse(res.m)
+		}
 		return res.m, res.err
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
-func (t *Transport) exchangeWithReusableConn(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
-	const maxRetry = 3
-
-	attempt := 0
-	var latestErr error
-	for {
-		attempt++
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
-
-		if latestErr != nil {
-			t.opts.Logger.Debug("retrying reusable connection", zap.NamedError("previous_err", latestErr), zap.Int("attempt", attempt))
-		}
-
-		conn, isNewConn, err := t.getReusableConn()
-		if err != nil {
-			return nil, err
-		}
-
-		r, err := conn.exchangeConnReuse(ctx, m)
-		t.releaseReusableConn(conn, err)
-		if err != nil {
-			if !isNewConn && attempt <= maxRetry {
-				continue
-			}
-			return nil, err
-		}
-
-		return r, nil
+func (t *Transport) exchangeWithReusableConn(ctx context.Context, m *dns.Msg) (*dns.Msg, bool, error) {
+	conn, reused, err := t.getReusableConn()
+	if err != nil {
+		return nil, false, err
 	}
+
+	r, err := conn.exchangeConnReuse(ctx, m, !reused)
+	t.releaseReusableConn(conn, err)
+	return r, reused, err
 }
 
 // getReusableConn returns a *dnsConn.
@@ -329,12 +408,47 @@ func (t *Transport) releaseReusableConn(c *dnsConn, err error) {
 }
 
 // getPipelineConn returns a dnsConn for pipelining queries.
-// Caller must call wg.Done() after dnsConn.exchangePipeline.
-func (t *Transport) getPipelineConn() (
+// If Opts.MaxInflightPerConn is set and all connections are busy, it waits
+// until a query finished.
+// Caller must call releasePipelineConn(status) after dnsConn.exchangePipeline.
+func (t *Transport) getPipelineConn(ctx context.Context) (
 	conn *dnsConn,
 	allocatedQid uint16,
 	isNewConn bool,
-	wg *sync.WaitGroup,
+	status *pipelineStatus,
+	err error,
+) {
+	for {
+		var slotFreed <-chan struct{}
+		conn, allocatedQid, isNewConn, status, slotFreed, err = t.tryGetPipelineConn()
+		if err != nil || conn != nil {
+			return
+		}
+
+		select {
+		case <-slotFreed:
+		case <-ctx.Done():
+		}
+		t.m.Lock()
+		t.pipelineWaiting--
+		t.m.Unlock()
+		if ctx.Err() != nil {
+			err = ErrTooManyInflight
+			return
+		}
+	}
+}
+
+// tryGetPipelineConn returns a dnsConn for pipelining queries. If all
+// connections are busy, it returns a nil conn and a channel that will be
+// closed once a query finished, and the caller should wait on it and
+// decrease t.pipelineWaiting after that.
+func (t *Transport) tryGetPipelineConn() (
+	conn *dnsConn,
+	allocatedQid uint16,
+	isNewConn bool,
+	connStatus *pipelineStatus,
+	slotFreed <-chan struct{},
 	err error,
 ) {
 	t.m.Lock()
@@ -345,20 +459,29 @@ func (t *Transport) getPipelineConn() (
 		return
 	}
 
-	// Try to get an existing connection.
-	var connStatus *pipelineStatus
+	// Try to get an existing connection. Datagram sockets are cheap,
+	// queries are spread to the least loaded one.
+	maxInflight := t.opts.MaxInflightPerConn
 	for c, status := range t.pipelineConns {
 		if c.isClosed() || t.connTooOld(c) {
 			delete(t.pipelineConns, c)
 			continue
 		}
+		if maxInflight > 0 && status.inflight >= maxInflight {
+			continue
+		}
+		if conn != nil && (!t.opts.Datagram || status.inflight >= connStatus.inflight) {
+			continue
+		}
 		conn = c
 		connStatus = status
-		break
+		if !t.opts.Datagram {
+			break
+		}
 	}
 
 	// No conn available, create a new one.
-	if conn == nil || (conn.queueLen() > 0 && len(t.pipelineConns) < t.opts.MaxConns) {
+	if (conn == nil || conn.queueLen() > 0) && len(t.pipelineConns) < t.opts.MaxConns {
 		conn = newDNSConn(t)
 		isNewConn = true
 		if t.pipelineConns == nil {
@@ -368,16 +491,35 @@ func (t *Transport) getPipelineConn() (
 		t.pipelineConns[conn] = connStatus
 	}
 
+	// All connections are busy.
+	if conn == nil {
+		if t.pipelineWaiting >= maxInflight*t.opts.MaxConns {
+			err = ErrTooManyInflight
+			return
+		}
+		t.pipelineWaiting++
+		if t.pipelineSlotFreed == nil {
+			t.pipelineSlotFreed = make(chan struct{})
+		}
+		slotFreed = t.pipelineSlotFreed
+		return
+	}
+
 	connStatus.served++
+	connStatus.inflight++
 	connStatus.wg.Add(1)
 	eol := connStatus.served >= int(t.opts.MaxQueryPerConn)
-	allocatedQid = uint16(connStatus.served)
-	wg = &connStatus.wg
+	if t.opts.Datagram {
+		allocatedQid = conn.reserveRandomQid()
+	} else {
+		allocatedQid = uint16(connStatus.served)
+	}
 	if eol {
 		// This connection has served too many queries.
 		// Note: the connection should be closed only after all its queries finished.
 		// We can't close it here. Some queries may still on that connection.
 		delete(t.pipelineConns, conn)
+		wg := &connStatus.wg
 		defer func() {
 			go func() {
 				wg.Wait()
@@ -388,6 +530,17 @@ func (t *Transport) getPipelineConn() (
 	return
 }
 
+func (t *Transport) releasePipelineConn(status *pipelineStatus) {
+	t.m.Lock()
+	status.inflight--
+	if t.pipelineSlotFreed != nil {
+		close(t.pipelineSlotFreed)
+		t.pipelineSlotFreed = nil
+	}
+	t.m.Unlock()
+	status.wg.Done()
+}
+
 // connTooOld returns true if c's last read time is close to
 // its idle deadline.
 func (t *Transport) connTooOld(c *dnsConn) bool {
@@ -415,8 +568,9 @@ type dnsConn struct {
 	closeNotify        chan struct{}
 	closeErr           error
 
-	statMu   sync.Mutex
-	lastRead time.Time
+	statMu    sync.Mutex
+	lastRead  time.Time
+	lastQuery time.Time
 }
 
 func newDNSConn(t *Transport) *dnsConn {
@@ -430,14 +584,16 @@ func newDNSConn(t *Transport) *dnsConn {
 	return dc
 }
 
-func (dc *dnsConn) exchangeConnReuse(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	return dc.exchange(ctx, q)
+func (dc *dnsConn) exchangeConnReuse(ctx context.Context, q *dns.Msg, isNewConn bool) (*dns.Msg, error) {
+	return dc.exchange(ctx, q, isNewConn)
 }
 
-func (dc *dnsConn) exchangePipeline(ctx context.Context, q *dns.Msg, allocatedQid uint16) (*dns.Msg, error) {
+func (dc *dnsConn) exchangePipeline(ctx context.Context, q *dns.Msg, allocatedQid uint16, isNewConn bool) (*dns.Msg, error) {
+	dc.updateQueryTime()
+	defer dc.deleteQueueC(allocatedQid) // in case the qid was reserved.
 	qSend := shadowCopy(q)
 	qSend.Id = allocatedQid
-	r, err := dc.exchange(ctx, qSend)
+	r, err := dc.exchange(ctx, qSend, isNewConn)
 	if err != nil {
 		return nil, err
 	}
@@ -445,10 +601,25 @@ func (dc *dnsConn) exchangePipeline(ctx context.Context, q *dns.Msg, allocatedQi
 	return r, nil
 }
 
-func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+// exchange sends q and waits for its response. isNewConn indicates that
+// dc was dialed for q, which is only used by the ExchangeTrace of ctx.
+func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg, isNewConn bool) (*dns.Msg, error) {
+	trace := ContextExchangeTrace(ctx)
+	if isNewConn {
+		trace.dialStart()
+	} else {
+		trace.connReused()
+	}
+
 	select {
 	case <-dc.dialFinishedNotify:
+		if isNewConn {
+			trace.dialDone(nil)
+		}
 	case <-dc.closeNotify:
+		if isNewConn {
+			trace.dialDone(dc.closeErr)
+		}
 		return nil, dc.closeErr
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -461,19 +632,27 @@ func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 
 	dc.c.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := dc.t.opts.WriteFunc(dc.c, q)
+	trace.wroteQuery(err)
 	if err != nil {
 		// Write error usually is fatal. Abort and close this connection.
 		dc.closeWithErr(err)
 		return nil, err
 	}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case r := <-resChan:
-		return r, nil
-	case <-dc.closeNotify:
-		return nil, dc.closeErr
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r := <-resChan:
+			if dc.t.opts.Datagram && !questionMatches(q, r) {
+				dc.t.opts.Logger.Debug("unexpected response question, ignored", zap.Stringer("resp", r))
+				continue
+			}
+			trace.gotResponse(r)
+			return r, nil
+		case <-dc.closeNotify:
+			return nil, dc.closeErr
+		}
 	}
 }
 
@@ -497,14 +676,89 @@ func (dc *dnsConn) dialAndRead() {
 	close(dc.dialFinishedNotify)
 	dc.connMu.Unlock()
 
+	if dc.t.opts.EnablePipeline && dc.t.opts.KeepaliveProbes != 0 {
+		go dc.keepaliveLoop()
+	}
 	dc.readLoop()
 }
 
+// keepaliveLoop sends probe queries on this pipeline connection if it is
+// idle and is about to reach its IdleTimeout.
+func (dc *dnsConn) keepaliveLoop() {
+	idleTimeout := dc.t.opts.IdleTimeout
+	// Probes must be sent before the connection is considered too old.
+	probeAfter := idleTimeout * 3 / 4
+	if probeAfter <= 0 {
+		return
+	}
+	probeTimeout := idleTimeout / 4
+
+	lastActive := time.Now()
+	var lastProbe time.Time
+	probes := 0
+	timer := time.NewTimer(probeAfter)
+	defer timer.Stop()
+	for {
+		select {
+		case <-dc.closeNotify:
+			return
+		case <-timer.C:
+		}
+
+		if lrt := dc.getLastReadTime(); lrt.After(lastActive) {
+			lastActive = lrt
+		}
+		if idle := time.Since(lastActive); idle < probeAfter {
+			timer.Reset(probeAfter - idle)
+			continue
+		}
+
+		// This connection was removed from the pool. Let it expire.
+		dc.t.m.Lock()
+		_, inPool := dc.t.pipelineConns[dc]
+		dc.t.m.Unlock()
+		if !inPool {
+			return
+		}
+
+		if dc.getLastQueryTime().After(lastProbe) {
+			probes = 0
+		}
+		if limit := dc.t.opts.KeepaliveProbes; limit > 0 && probes >= limit {
+			return
+		}
+		probes++
+		lastProbe = time.Now()
+		if err := dc.probe(probeTimeout); err != nil {
+			dc.t.opts.Logger.Debug("keepalive probe failed", zap.Error(err))
+		}
+		lastActive = time.Now()
+		timer.Reset(probeAfter)
+	}
+}
+
+// probe sends a NS query of Opts.KeepaliveQname. It uses qid 0, which is
+// never allocated to pipelined queries.
+func (dc *dnsConn) probe(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	q := new(dns.Msg)
+	q.SetQuestion(dc.t.opts.KeepaliveQname, dns.TypeNS)
+	q.Id = 0
+	_, err := dc.exchange(ctx, q, false)
+	return err
+}
+
 func (dc *dnsConn) readLoop() {
 	for {
 		dc.c.SetReadDeadline(time.Now().Add(dc.t.opts.IdleTimeout))
-		r, _, err := dc.t.opts.ReadFunc(dc.c)
+		r, n, err := dc.t.opts.ReadFunc(dc.c)
 		if err != nil {
+			if dc.t.opts.Datagram && n > 0 {
+				// A bad packet, not a socket error.
+				dc.t.opts.Logger.Debug("invalid packet, ignored", zap.Error(err))
+				continue
+			}
 			dc.closeWithErr(err) // abort this connection.
 			return
 		}
@@ -560,6 +814,20 @@ func (dc *dnsConn) addQueueC(qid uint16, c chan *dns.Msg) {
 	dc.queue[qid] = c
 }
 
+// reserveRandomQid reserves a random non-zero qid that is not in the queue.
+// The qid should be released by deleteQueueC after the query is done.
+func (dc *dnsConn) reserveRandomQid() uint16 {
+	dc.queueMu.Lock()
+	defer dc.queueMu.Unlock()
+	for {
+		qid := uint16(rand.Intn(0xffff) + 1)
+		if _, inflight := dc.queue[qid]; !inflight {
+			dc.queue[qid] = make(chan *dns.Msg, 1)
+			return qid
+		}
+	}
+}
+
 func (dc *dnsConn) deleteQueueC(qid uint16) {
 	dc.queueMu.Lock()
 	defer dc.queueMu.Unlock()
@@ -578,3 +846,16 @@ func (dc *dnsConn) getLastReadTime() time.Time {
 	defer dc.statMu.Unlock()
 	return dc.lastRead
 }
+
+func (dc *dnsConn) updateQueryTime() {
+	t := time.Now()
+	dc.statMu.Lock()
+	defer dc.statMu.Unlock()
+	dc.lastQuery = t
+}
+
+func (dc *dnsConn) getLastQueryTime() time.Time {
+	dc.statMu.Lock()
+	defer dc.statMu.Unlock()
+	return dc.lastQuery
+}
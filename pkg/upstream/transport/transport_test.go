@@ -30,6 +30,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -340,14 +341,14 @@ func TestTransport_Exchange(t *testing.T) {
 			// Wait until all connections are timed out.
 			time.Sleep(tt.fields.IdleTimeout + time.Millisecond*200)
 
-			_, _, newConn, pipelineWg, err := transport.getPipelineConn()
+			_, _, newConn, pipelineStatus, err := transport.getPipelineConn(context.Background())
 			if err != nil {
 				t.Fatal(err)
 			}
 			if !newConn {
 				t.Fatal("pipelineConn should be a new connection")
 			}
-			pipelineWg.Done()
+			transport.releasePipelineConn(pipelineStatus)
 			reusableConn, reused, err := transport.getReusableConn()
 			if err != nil {
 				t.Fatal(err)
@@ -369,3 +370,201 @@ func TestTransport_Exchange(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_MaxInflightPerConn(t *testing.T) {
+	transport, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			c1, _ := net.Pipe()
+			return c1, nil
+		},
+		WriteFunc:          dnsutils.WriteMsgToTCP,
+		ReadFunc:           dnsutils.ReadMsgFromTCP,
+		EnablePipeline:     true,
+		MaxConns:           1,
+		MaxInflightPerConn: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	_, _, _, status, err := transport.getPipelineConn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is busy, the query waits until the ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, _, _, _, err := transport.getPipelineConn(ctx); err != ErrTooManyInflight {
+		t.Fatalf("want ErrTooManyInflight, got %v", err)
+	}
+
+	// A waiting query gets the connection after the previous one finished.
+	waiterDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _, _, status, err := transport.getPipelineConn(ctx)
+		if err == nil {
+			transport.releasePipelineConn(status)
+		}
+		waiterDone <- err
+	}()
+	for {
+		transport.m.Lock()
+		waiting := transport.pipelineWaiting
+		transport.m.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full.
+	if _, _, _, _, err := transport.getPipelineConn(context.Background()); err != ErrTooManyInflight {
+		t.Fatalf("want ErrTooManyInflight, got %v", err)
+	}
+
+	transport.releasePipelineConn(status)
+	if err := <-waiterDone; err != nil {
+		t.Fatalf("waiting query failed, %v", err)
+	}
+}
+
+func TestTransport_KeepaliveProbes(t *testing.T) {
+	var probes int32
+	dial := func(ctx context.Context) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			for {
+				q, _, err := dnsutils.ReadMsgFromTCP(c2)
+				if err != nil {
+					return
+				}
+				if q.Question[0].Qtype == dns.TypeNS {
+					atomic.AddInt32(&probes, 1)
+				}
+				r := new(dns.Msg)
+				r.SetReply(q)
+				dnsutils.WriteMsgToTCP(c2, r)
+			}
+		}()
+		return c1, nil
+	}
+	transport, err := NewTransport(Opts{
+		DialFunc:        dial,
+		WriteFunc:       dnsutils.WriteMsgToTCP,
+		ReadFunc:        dnsutils.ReadMsgFromTCP,
+		EnablePipeline:  true,
+		IdleTimeout:     time.Millisecond * 200,
+		KeepaliveProbes: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := transport.ExchangeContext(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 1000)
+	if n := atomic.LoadInt32(&probes); n != 2 {
+		t.Fatalf("want 2 probes, got %d", n)
+	}
+	transport.m.Lock()
+	defer transport.m.Unlock()
+	for c := range transport.pipelineConns {
+		if !c.isClosed() {
+			t.Fatal("connection should be closed after probes")
+		}
+	}
+}
+
+func TestTransport_Datagram(t *testing.T) {
+	var qidDup int32
+	transport, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				var m sync.Mutex
+				inflight := make(map[uint16]struct{})
+				for {
+					q, _, err := dnsutils.ReadMsgFromUDP(c2, 4096)
+					if err != nil {
+						return
+					}
+					m.Lock()
+					if _, dup := inflight[q.Id]; dup {
+						atomic.AddInt32(&qidDup, 1)
+					}
+					inflight[q.Id] = struct{}{}
+					m.Unlock()
+					go func() {
+						time.Sleep(time.Millisecond * 10)
+						// A bad packet and a spoofed response come first.
+						c2.Write([]byte{1, 2, 3})
+						spoofed := new(dns.Msg)
+						spoofed.SetQuestion("spoofed.", dns.TypeA)
+						spoofed.Id = q.Id
+						spoofed.Response = true
+						dnsutils.WriteMsgToUDP(c2, spoofed)
+
+						r := new(dns.Msg)
+						r.SetReply(q)
+						m.Lock()
+						delete(inflight, q.Id)
+						m.Unlock()
+						dnsutils.WriteMsgToUDP(c2, r)
+					}()
+				}
+			}()
+			return c1, nil
+		},
+		WriteFunc: dnsutils.WriteMsgToUDP,
+		ReadFunc: func(c io.Reader) (*dns.Msg, int, error) {
+			return dnsutils.ReadMsgFromUDP(c, 4096)
+		},
+		EnablePipeline: true,
+		Datagram:       true,
+		MaxConns:       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	wg := new(sync.WaitGroup)
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion(fmt.Sprintf("%d.example.com.", i), dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
+			r, err := transport.ExchangeContext(ctx, q)
+			if err == nil && r.Question[0].Name != q.Question[0].Name {
+				err = fmt.Errorf("unexpected response %s", r.Question[0].Name)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&qidDup); n != 0 {
+		t.Fatalf("%d inflight qid collisions", n)
+	}
+}
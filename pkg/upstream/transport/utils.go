@@ -22,6 +22,7 @@ package transport
 import (
 	"context"
 	"github.com/miekg/dns"
+	"strings"
 	"time"
 )
 
@@ -40,3 +41,22 @@ func shadowCopy(m *dns.Msg) *dns.Msg {
 	*nm = *m
 	return nm
 }
+
+// questionMatches reports whether r's question matches q's.
+// Names are compared case-insensitively. Error responses without a
+// question section, e.g. FORMERR from some servers, also match.
+func questionMatches(q, r *dns.Msg) bool {
+	if len(r.Question) == 0 && r.Rcode != dns.RcodeSuccess {
+		return true
+	}
+	if len(q.Question) != len(r.Question) {
+		return false
+	}
+	for i := range q.Question {
+		qq, rq := q.Question[i], r.Question[i]
+		if qq.Qtype != rq.Qtype || qq.Qclass != rq.Qclass || !strings.EqualFold(qq.Name, rq.Name) {
+			return false
+		}
+	}
+	return true
+}
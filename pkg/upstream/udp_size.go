@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+const (
+	flagDayUDPSize          = 1232 // https://www.dnsflagday.net/2020/
+	minimumUDPSize          = dns.MinMsgSize
+	udpSizeRecoveryInterval = time.Minute * 10
+)
+
+// udpSizeController manages the EDNS0 UDP buffer size that is advertised to
+// an upstream. If there are signs of fragmentation problems, it downgrades the
+// size to 1232 and then to 512. The configured size will be tried again after
+// udpSizeRecoveryInterval.
+type udpSizeController struct {
+	configured uint16
+
+	m            sync.Mutex
+	current      uint16
+	downgradedAt time.Time
+}
+
+func newUDPSizeController(size uint16) *udpSizeController {
+	if size < minimumUDPSize {
+		size = minimumUDPSize
+	}
+	return &udpSizeController{configured: size, current: size}
+}
+
+// size returns the current size.
+func (c *udpSizeController) size() uint16 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.current != c.configured && time.Since(c.downgradedAt) > udpSizeRecoveryInterval {
+		c.current = c.configured
+	}
+	return c.current
+}
+
+// downgrade downgrades the size if the current size is still the failed
+// size. It returns the size that should be used from now on, and false
+// if the size cannot be downgraded anymore.
+func (c *udpSizeController) downgrade(failed uint16) (uint16, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.current < failed { // Already downgraded by others.
+		return c.current, true
+	}
+	switch {
+	case c.current > flagDayUDPSize:
+		c.current = flagDayUDPSize
+	case c.current > minimumUDPSize:
+		c.current = minimumUDPSize
+	default:
+		return c.current, false
+	}
+	c.downgradedAt = time.Now()
+	return c.current, true
+}
+
+// setUDPSize returns a copy of q which EDNS0 UDP size is size.
+// Only the OPT record of q will be deep copied.
+// If q does not have an OPT record, q will be returned.
+func setUDPSize(q *dns.Msg, size uint16) *dns.Msg {
+	for i, rr := range q.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		if opt.UDPSize() == size {
+			return q
+		}
+		nq := new(dns.Msg)
+		*nq = *q
+		nq.Extra = make([]dns.RR, len(q.Extra))
+		copy(nq.Extra, q.Extra)
+		newOpt := dns.Copy(opt).(*dns.OPT)
+		newOpt.SetUDPSize(size)
+		nq.Extra[i] = newOpt
+		return nq
+	}
+	return q
+}
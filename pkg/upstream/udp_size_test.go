@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_udpSizeController(t *testing.T) {
+	c := newUDPSizeController(4096)
+	if s := c.size(); s != 4096 {
+		t.Fatalf("want size 4096, got %d", s)
+	}
+	if s, ok := c.downgrade(4096); !ok || s != flagDayUDPSize {
+		t.Fatalf("want size %d, got %d", flagDayUDPSize, s)
+	}
+	// Concurrent failure with the old size should not downgrade it again.
+	if s, ok := c.downgrade(4096); !ok || s != flagDayUDPSize {
+		t.Fatalf("want size %d, got %d", flagDayUDPSize, s)
+	}
+	if s, ok := c.downgrade(flagDayUDPSize); !ok || s != minimumUDPSize {
+		t.Fatalf("want size %d, got %d", minimumUDPSize, s)
+	}
+	if _, ok := c.downgrade(minimumUDPSize); ok {
+		t.Fatal("size should not be downgraded below the minimum")
+	}
+}
+
+func Test_setUDPSize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if nq := setUDPSize(q, 1232); nq != q {
+		t.Fatal("query without edns0 should not be copied")
+	}
+
+	q.SetEdns0(4096, false)
+	nq := setUDPSize(q, 1232)
+	if got := nq.IsEdns0().UDPSize(); got != 1232 {
+		t.Fatalf("want udp size 1232, got %d", got)
+	}
+	if got := q.IsEdns0().UDPSize(); got != 4096 {
+		t.Fatalf("original query was modified, udp size %d", got)
+	}
+}
@@ -22,16 +22,16 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
-	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/bootstrap"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/doh"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/h3roundtripper"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/transport"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
-	"golang.org/x/net/http2"
 	"io"
 	"net"
 	"net/http"
@@ -41,10 +41,6 @@ import (
 	"time"
 )
 
-const (
-	tlsHandshakeTimeout = time.Second * 5
-)
-
 // Upstream represents a DNS upstream.
 type Upstream interface {
 	// ExchangeContext exchanges query message m to the upstream, and returns
@@ -54,22 +50,45 @@ type Upstream interface {
 	io.Closer
 }
 
+// ConnResetter is implemented by Upstreams that keep long-lived connections.
+type ConnResetter interface {
+	// ResetConnections closes existing connections, so new connections will
+	// be opened for later queries. e.g. when the network was changed.
+	ResetConnections()
+}
+
+// ConnStatser is implemented by Upstreams that keep connection pools.
+type ConnStatser interface {
+	ConnStats() transport.ConnStats
+}
+
 type Opt struct {
 	// DialAddr specifies the address the upstream will
 	// actually dial to.
 	DialAddr string
 
+	// DialAddrs specifies more pinned addresses of the server. Together with
+	// DialAddr, the upstream starts dialing from the address that worked
+	// last time, and tries the next one if the dial failed.
+	// UDP upstreams and TCP fallbacks of UDP upstreams only use the first one.
+	DialAddrs []string
+
 	// Socks5 specifies the socks5 proxy server that the upstream
 	// will connect though.
 	// Not implemented for udp upstreams and doh upstreams with http/3.
 	Socks5 string
 
 	// SoMark sets the socket SO_MARK option in unix system.
-	SoMark int
+	SoMark uint32
 
 	// BindToDevice sets the socket SO_BINDTODEVICE option in unix system.
 	BindToDevice string
 
+	// LocalAddr specifies the local ip address that the upstream sends
+	// queries from, e.g. the address of a VPN interface. Bootstrap queries
+	// are also sent from it. Not implemented for socks5 proxies.
+	LocalAddr string
+
 	// IdleTimeout specifies the idle timeout for long-connections.
 	// Available for TCP, DoT, DoH.
 	// If negative, TCP, DoT will not reuse connections.
@@ -89,22 +108,83 @@ type Opt struct {
 	// Default is 2.
 	MaxConns int
 
-	// Bootstrap specifies a plain dns server for the go runtime to solve the
-	// domain of the upstream server. It SHOULD be an IP address. Custom port
-	// is supported.
-	// Note: Use a domain address may cause dead resolve loop and additional
-	// latency to dial upstream server.
-	// HTTP3 is not supported.
+	// MaxInflightPerConn limits the concurrent queries on one pipeline
+	// connection. Queries will wait for a free slot in a bounded queue, or
+	// fail with transport.ErrTooManyInflight.
+	// Implemented for UDP and TCP/DoT pipeline enabled upstreams.
+	// Default is 0, which means no limit.
+	MaxInflightPerConn int
+
+	// KeepaliveProbes and KeepaliveQname control probe queries on idle
+	// connections. See transport.Opts for details.
+	// Implemented for TCP/DoT pipeline enabled upstreams.
+	KeepaliveProbes int
+	KeepaliveQname  string
+
+	// RetryPolicy controls how failed queries are retried.
+	// Implemented for UDP, TCP, DoT upstreams.
+	// Default (nil) retries queries that failed on reused connections
+	// up to 3 times.
+	RetryPolicy *transport.RetryPolicy
+
+	// Bootstrap specifies a plain dns server to solve the domain of the
+	// upstream server. It MUST be an IP address. Custom port is supported.
+	// The result will be cached within its ttl and will be resolved again
+	// if the upstream failed to connect to the server.
+	// If empty, the system resolver will be used.
 	Bootstrap string
 
 	// TLSConfig specifies the tls.Config that the TLS client will use.
-	// Available for DoT, DoH upstreams.
+	// Available for DoT, DoH upstreams. Set its Certificates to authenticate
+	// the client to servers that require mutual TLS.
+	// If TLSConfig does not have a ClientSessionCache, each upstream will
+	// use its own LRU session cache, so sessions can be resumed after
+	// connections were closed by idle timeouts.
 	TLSConfig *tls.Config
 
+	// DoHUsePOST makes DoH upstreams send queries with POST requests.
+	// Default is GET, which is cache friendly for http caches and CDNs.
+	DoHUsePOST bool
+
+	// DoHHeader specifies additional http headers for DoH upstreams.
+	DoHHeader http.Header
+
+	// Enable0x20 randomizes letter cases of qnames of UDP queries (DNS
+	// 0x20), and rejects responses whose qname has a different case with
+	// ErrQNameCaseMismatch, which makes spoofing harder. Some servers do
+	// not preserve the case, and won't work with it.
+	Enable0x20 bool
+
 	// Logger specifies the logger that the upstream will use.
 	Logger *zap.Logger
+
+	// UDPBufferSize specifies the EDNS0 UDP buffer size that UDP upstreams
+	// will advertise to the server. The size will be downgraded to 1232 and
+	// then to 512 automatically if the server replies FORMERR or the query
+	// times out, which may be caused by ip fragmentation problems.
+	// See https://www.dnsflagday.net/2020/.
+	// Zero means the size from the query is used as it is.
+	UDPBufferSize int
+
+	// TCPFallbackCounter, if not nil, will be increased every time a UDP
+	// upstream received a truncated response and retried the query over TCP.
+	TCPFallbackCounter prometheus.Counter
+
+	// TLSHandshakeCounter, TLSResumedCounter, if not nil, will be increased
+	// every time a DoT/DoH upstream completed a tls handshake and the
+	// handshake resumed a cached session, respectively.
+	TLSHandshakeCounter prometheus.Counter
+	TLSResumedCounter   prometheus.Counter
+
+	// TLS0RTTCounter, if not nil, will be increased every time a DoH
+	// upstream with HTTP/3 sent 0-RTT data and the server accepted it.
+	TLS0RTTCounter prometheus.Counter
 }
 
+// NewUpstream creates an upstream from addr, e.g. "8.8.8.8", "tls://dns.google".
+// Options in opt can be overwritten by inline options in the query string
+// of addr, e.g. "tls://1.1.1.1?sni=cloudflare-dns.com&mark=0x20&iface=wg0".
+// See urlOptionFuncs for supported options.
 func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 	if opt == nil {
 		opt = new(Opt)
@@ -118,31 +198,56 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid server address, %w", err)
 	}
+	opt, err = applyURLOptions(addrURL, opt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address options, %w", err)
+	}
+	if addrURL.Scheme == "https" {
+		addr = addrURL.String() // without inline options
+	}
 
 	dialer := &net.Dialer{
-		Resolver: bootstrap.NewPlainBootstrap(opt.Bootstrap),
 		Control: getSocketControlFunc(socketOpts{
 			so_mark:        opt.SoMark,
 			bind_to_device: opt.BindToDevice,
 		}),
 	}
+	var localIP net.IP
+	if len(opt.LocalAddr) > 0 {
+		localIP = net.ParseIP(opt.LocalAddr)
+		if localIP == nil {
+			return nil, fmt.Errorf("invalid local addr %s", opt.LocalAddr)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
 
 	switch addrURL.Scheme {
 	case "", "udp":
-		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 53)
+		targets, err := newDialTargets(addrURL.Host, 53, dialer, opt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot init bootstrap, %w", err)
+		}
+		dialAddr, b := targets.targets[0].addr, targets.targets[0].b
 
+		readBufSize := 4096
+		if opt.UDPBufferSize > readBufSize {
+			readBufSize = opt.UDPBufferSize
+		}
 		uto := transport.Opts{
 			Logger: opt.Logger,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				return dialer.DialContext(ctx, "udp", dialAddr)
+				return dialWithBootstrap(ctx, "udp", dialAddr, dialer, b)
 			},
 			WriteFunc: dnsutils.WriteMsgToUDP,
 			ReadFunc: func(c io.Reader) (*dns.Msg, int, error) {
-				return dnsutils.ReadMsgFromUDP(c, 4096)
+				return dnsutils.ReadMsgFromUDP(c, readBufSize)
 			},
-			EnablePipeline: true,
-			MaxConns:       opt.MaxConns,
-			IdleTimeout:    time.Second * 60,
+			EnablePipeline:     true,
+			Datagram:           true,
+			MaxConns:           opt.MaxConns,
+			MaxInflightPerConn: opt.MaxInflightPerConn,
+			IdleTimeout:        time.Second * 60,
+			RetryPolicy:        opt.RetryPolicy,
 		}
 		ut, err := transport.NewTransport(uto)
 		if err != nil {
@@ -151,64 +256,89 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		tto := transport.Opts{
 			Logger: opt.Logger,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				return dialer.DialContext(ctx, "tcp", dialAddr)
+				return dialWithBootstrap(ctx, "tcp", dialAddr, dialer, b)
 			},
-			WriteFunc: dnsutils.WriteMsgToTCP,
-			ReadFunc:  dnsutils.ReadMsgFromTCP,
+			WriteFunc:   dnsutils.WriteMsgToTCP,
+			ReadFunc:    dnsutils.ReadMsgFromTCP,
+			RetryPolicy: opt.RetryPolicy,
 		}
 		tt, err := transport.NewTransport(tto)
 		if err != nil {
 			return nil, fmt.Errorf("cannot init tcp transport, %w", err)
 		}
+		var sc *udpSizeController
+		if opt.UDPBufferSize > 0 {
+			if opt.UDPBufferSize > dns.MaxMsgSize {
+				return nil, fmt.Errorf("invalid udp buffer size %d", opt.UDPBufferSize)
+			}
+			sc = newUDPSizeController(uint16(opt.UDPBufferSize))
+		}
 		return &udpWithFallback{
-			u: ut,
-			t: tt,
+			u:               ut,
+			sc:              sc,
+			t:               tt,
+			addr:            dialAddr,
+			enable0x20:      opt.Enable0x20,
+			logger:          opt.Logger,
+			fallbackCounter: opt.TCPFallbackCounter,
 		}, nil
 	case "tcp":
-		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 53)
+		targets, err := newDialTargets(addrURL.Host, 53, dialer, opt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot init bootstrap, %w", err)
+		}
 		to := transport.Opts{
 			Logger: opt.Logger,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				return dialTCP(ctx, dialAddr, opt.Socks5, dialer)
+				return dialTargetsDo(ctx, targets, func(ctx context.Context, target dialTarget) (net.Conn, error) {
+					return dialTCP(ctx, target.addr, opt.Socks5, dialer, target.b)
+				})
 			},
-			WriteFunc:      dnsutils.WriteMsgToTCP,
-			ReadFunc:       dnsutils.ReadMsgFromTCP,
-			IdleTimeout:    opt.IdleTimeout,
-			EnablePipeline: opt.EnablePipeline,
-			MaxConns:       opt.MaxConns,
+			WriteFunc:          dnsutils.WriteMsgToTCP,
+			ReadFunc:           dnsutils.ReadMsgFromTCP,
+			IdleTimeout:        opt.IdleTimeout,
+			EnablePipeline:     opt.EnablePipeline,
+			MaxConns:           opt.MaxConns,
+			MaxInflightPerConn: opt.MaxInflightPerConn,
+			KeepaliveProbes:    opt.KeepaliveProbes,
+			KeepaliveQname:     opt.KeepaliveQname,
+			RetryPolicy:        opt.RetryPolicy,
 		}
 		return transport.NewTransport(to)
 	case "tls":
-		var tlsConfig *tls.Config
-		if opt.TLSConfig != nil {
-			tlsConfig = opt.TLSConfig.Clone()
-		} else {
-			tlsConfig = new(tls.Config)
-		}
+		tlsConfig := cloneTLSConfig(opt.TLSConfig)
 		if len(tlsConfig.ServerName) == 0 {
 			tlsConfig.ServerName = tryRemovePort(addrURL.Host)
 		}
 
-		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 853)
+		targets, err := newDialTargets(addrURL.Host, 853, dialer, opt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot init bootstrap, %w", err)
+		}
+		stats := newTLSStats(targets.first(), opt)
 		to := transport.Opts{
 			Logger: opt.Logger,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				conn, err := dialTCP(ctx, dialAddr, opt.Socks5, dialer)
-				if err != nil {
-					return nil, err
-				}
-				tlsConn := tls.Client(conn, tlsConfig)
-				if err := tlsConn.HandshakeContext(ctx); err != nil {
-					tlsConn.Close()
-					return nil, err
-				}
-				return tlsConn, nil
+				return dialTargetsDo(ctx, targets, func(ctx context.Context, target dialTarget) (net.Conn, error) {
+					tlsConn, err := tlsHandshake(ctx, func(ctx context.Context) (net.Conn, error) {
+						return dialTCP(ctx, target.addr, opt.Socks5, dialer, target.b)
+					}, tlsConfig)
+					if err != nil {
+						return nil, err
+					}
+					stats.observe(tlsConn.ConnectionState(), false)
+					return tlsConn, nil
+				})
 			},
-			WriteFunc:      dnsutils.WriteMsgToTCP,
-			ReadFunc:       dnsutils.ReadMsgFromTCP,
-			IdleTimeout:    opt.IdleTimeout,
-			EnablePipeline: opt.EnablePipeline,
-			MaxConns:       opt.MaxConns,
+			WriteFunc:          dnsutils.WriteMsgToTCP,
+			ReadFunc:           dnsutils.ReadMsgFromTCP,
+			IdleTimeout:        opt.IdleTimeout,
+			EnablePipeline:     opt.EnablePipeline,
+			MaxConns:           opt.MaxConns,
+			MaxInflightPerConn: opt.MaxInflightPerConn,
+			KeepaliveProbes:    opt.KeepaliveProbes,
+			KeepaliveQname:     opt.KeepaliveQname,
+			RetryPolicy:        opt.RetryPolicy,
 		}
 		return transport.NewTransport(to)
 	case "https":
@@ -221,19 +351,28 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			maxConn = opt.MaxConns
 		}
 
-		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 443)
+		targets, err := newDialTargets(addrURL.Host, 443, dialer, opt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot init bootstrap, %w", err)
+		}
+		tlsConfig := cloneTLSConfig(opt.TLSConfig)
+		stats := newTLSStats(targets.first(), opt)
 		var t http.RoundTripper
 		var addonCloser io.Closer // udpConn
 		if opt.EnableHTTP3 {
 			lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-			conn, err := lc.ListenPacket(context.Background(), "udp", "")
+			var laddr string
+			if localIP != nil {
+				laddr = net.JoinHostPort(localIP.String(), "0")
+			}
+			conn, err := lc.ListenPacket(context.Background(), "udp", laddr)
 			if err != nil {
 				return nil, fmt.Errorf("failed to init udp socket for quic")
 			}
 			addonCloser = conn
 			t = &h3roundtripper.H3RTHelper{
 				Logger:    opt.Logger,
-				TLSConfig: opt.TLSConfig,
+				TLSConfig: tlsConfig,
 				QUICConfig: &quic.Config{
 					TokenStore:                     quic.NewLRUTokenStore(4, 8),
 					InitialStreamReceiveWindow:     4 * 1024,
@@ -242,41 +381,77 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 					MaxConnectionReceiveWindow:     64 * 1024,
 				},
 				DialFunc: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-					ua, err := net.ResolveUDPAddr("udp", dialAddr) // TODO: Support bootstrap.
+					c, err := dialTargetsDo(ctx, targets, func(ctx context.Context, target dialTarget) (quic.EarlyConnection, error) {
+						var ua *net.UDPAddr
+						if target.b != nil {
+							ap, err := resolveWithBootstrap(ctx, target.addr, target.b)
+							if err != nil {
+								return nil, err
+							}
+							ua = net.UDPAddrFromAddrPort(ap)
+						} else {
+							var err error
+							ua, err = net.ResolveUDPAddr("udp", target.addr)
+							if err != nil {
+								return nil, err
+							}
+						}
+						c, err := quic.DialEarlyContext(ctx, conn, ua, addrURL.Host, tlsCfg, cfg)
+						if err != nil {
+							if target.b != nil {
+								target.b.Invalidate(ua.AddrPort().Addr())
+							}
+							return nil, err
+						}
+						return c, nil
+					})
 					if err != nil {
 						return nil, err
 					}
-					return quic.DialEarlyContext(ctx, conn, ua, addrURL.Host, tlsCfg, cfg)
+					go func() {
+						select {
+						case <-c.HandshakeComplete().Done():
+							cs := c.ConnectionState().TLS
+							stats.observe(cs.ConnectionState, cs.Used0RTT)
+						case <-c.Context().Done():
+						}
+					}()
+					return c, nil
 				},
 			}
 		} else {
-			t1 := &http.Transport{
-				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
-					return dialTCP(ctx, dialAddr, opt.Socks5, dialer)
-				},
-				TLSClientConfig:     opt.TLSConfig,
-				TLSHandshakeTimeout: tlsHandshakeTimeout,
-				IdleConnTimeout:     idleConnTimeout,
-
-				// MaxConnsPerHost and MaxIdleConnsPerHost should be equal.
-				// Otherwise, it might seriously affect the efficiency of connection reuse.
-				MaxConnsPerHost:     maxConn,
-				MaxIdleConnsPerHost: maxConn,
+			if len(tlsConfig.ServerName) == 0 {
+				tlsConfig.ServerName = tryRemovePort(addrURL.Host)
 			}
-
-			t2, err := http2.ConfigureTransports(t1)
-			if err != nil {
-				return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
-			}
-			t2.ReadIdleTimeout = time.Second * 30
-			t2.PingTimeout = time.Second * 5
-			t = t1
+			h2t := doh.NewH2Transport(doh.H2TransportOpts{
+				DialTLS: func(ctx context.Context, nextProtos []string) (*tls.Conn, error) {
+					return dialTargetsDo(ctx, targets, func(ctx context.Context, target dialTarget) (*tls.Conn, error) {
+						c := tlsConfig.Clone()
+						c.NextProtos = nextProtos
+						tlsConn, err := tlsHandshake(ctx, func(ctx context.Context) (net.Conn, error) {
+							return dialTCP(ctx, target.addr, opt.Socks5, dialer, target.b)
+						}, c)
+						if err != nil {
+							return nil, err
+						}
+						stats.observe(tlsConn.ConnectionState(), false)
+						return tlsConn, nil
+					})
+				},
+				MaxConns:    maxConn,
+				IdleTimeout: idleConnTimeout,
+				Logger:      opt.Logger,
+			})
+			t = h2t
+			addonCloser = h2t
 		}
 
 		return &doh.Upstream{
 			EndPoint:    addr,
 			Client:      &http.Client{Transport: t},
 			AddOnCloser: addonCloser,
+			UsePOST:     opt.DoHUsePOST,
+			Header:      opt.DoHHeader,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
@@ -303,20 +478,103 @@ func tryRemovePort(s string) string {
 	return host
 }
 
+// udpWithFallback is a UDP upstream that retries the query over TCP
+// when the UDP response is truncated.
 type udpWithFallback struct {
-	u *transport.Transport
-	t *transport.Transport
+	u  *transport.Transport
+	t  *transport.Transport
+	sc *udpSizeController // can be nil
+
+	addr            string
+	enable0x20      bool
+	logger          *zap.Logger        // can be nil
+	fallbackCounter prometheus.Counter // can be nil
 }
 
 func (u *udpWithFallback) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	m, err := u.u.ExchangeContext(ctx, q)
+	uq := q
+	if u.enable0x20 {
+		uq = randomizeCase(q)
+	}
+	m, err := u.exchangeUDP(ctx, uq)
 	if err != nil {
 		return nil, err
 	}
-	if m.Truncated {
-		return u.t.ExchangeContext(ctx, q)
+	if err := restoreCase(m, uq, q); err != nil {
+		if u.logger != nil {
+			u.logger.Warn("possibly spoofed udp response", zap.String("addr", u.addr), zap.Uint16("qid", q.Id), zap.Error(err))
+		}
+		return nil, err
+	}
+	if !m.Truncated {
+		return m, nil
+	}
+
+	if u.fallbackCounter != nil {
+		u.fallbackCounter.Inc()
+	}
+	if u.logger != nil {
+		u.logger.Debug("truncated udp response, retrying over tcp", zap.String("addr", u.addr), zap.Uint16("qid", q.Id))
+	}
+	r, err := u.t.ExchangeContext(ctx, q)
+	if err != nil {
+		// The truncated response is still a valid response. Let the client
+		// retry it by itself.
+		if u.logger != nil {
+			u.logger.Debug("tcp fallback failed, using the truncated response", zap.String("addr", u.addr), zap.Error(err))
+		}
+		return m, nil
+	}
+	return r, nil
+}
+
+// exchangeUDP exchanges q over udp. If u.sc is not nil, the EDNS0 UDP size
+// of q will be replaced and downgraded if necessary.
+func (u *udpWithFallback) exchangeUDP(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.sc == nil || q.IsEdns0() == nil {
+		return u.u.ExchangeContext(ctx, q)
+	}
+
+	for {
+		size := u.sc.size()
+		m, err := u.u.ExchangeContext(ctx, setUDPSize(q, size))
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				u.downgradeUDPSize(size, err)
+			}
+			return nil, err
+		}
+		if m.Rcode == dns.RcodeFormatError {
+			if newSize := u.downgradeUDPSize(size, nil); newSize < size {
+				continue
+			}
+		}
+		return m, nil
+	}
+}
+
+func (u *udpWithFallback) downgradeUDPSize(failed uint16, cause error) uint16 {
+	newSize, ok := u.sc.downgrade(failed)
+	if ok && newSize < failed && u.logger != nil {
+		u.logger.Debug(
+			"udp buffer size downgraded",
+			zap.String("addr", u.addr),
+			zap.Uint16("from", failed),
+			zap.Uint16("to", newSize),
+			zap.NamedError("cause", cause),
+		)
 	}
-	return m, nil
+	return newSize
+}
+
+func (u *udpWithFallback) ResetConnections() {
+	u.u.ResetConnections()
+	u.t.ResetConnections()
+}
+
+func (u *udpWithFallback) ConnStats() transport.ConnStats {
+	s, ts := u.u.ConnStats(), u.t.ConnStats()
+	return transport.ConnStats{Open: s.Open + ts.Open, Idle: s.Idle + ts.Idle}
 }
 
 func (u *udpWithFallback) Close() error {
@@ -26,6 +26,8 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"net"
 	"sync"
 	"testing"
@@ -213,3 +215,122 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func Test_udpWithFallback(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udpConn.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		t.Skipf("failed to listen tcp on %s: %v", addr, err)
+	}
+
+	handler := func(truncated bool) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, q *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Truncated = truncated
+			w.WriteMsg(r)
+		}
+	}
+	udpServer := dns.Server{PacketConn: udpConn, Handler: handler(true)}
+	tcpServer := dns.Server{Listener: l, Handler: handler(false)}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	u, err := NewUpstream(addr, &Opt{TCPFallbackCounter: counter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	r, err := u.ExchangeContext(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated {
+		t.Fatal("truncated response was not retried over tcp")
+	}
+	if v := testutil.ToFloat64(counter); v != 1 {
+		t.Fatalf("want fallback counter 1, got %v", v)
+	}
+}
+
+func Test_tlsSessionResumption(t *testing.T) {
+	addr, shutdown := newDoTTestServer(t, &vServer{})
+	defer shutdown()
+
+	handshakes := prometheus.NewCounter(prometheus.CounterOpts{Name: "handshakes"})
+	resumed := prometheus.NewCounter(prometheus.CounterOpts{Name: "resumed"})
+	u, err := NewUpstream("tls://"+addr, &Opt{
+		IdleTimeout:         -1, // new connection for every query
+		TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeCounter: handshakes,
+		TLSResumedCounter:   resumed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		_, err := u.ExchangeContext(ctx, q)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := testutil.ToFloat64(handshakes); v != 3 {
+		t.Fatalf("want 3 handshakes, got %v", v)
+	}
+	if v := testutil.ToFloat64(resumed); v != 2 {
+		t.Fatalf("want 2 resumed handshakes, got %v", v)
+	}
+}
+
+func Test_localAddr(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if ip := utils.GetIPFromAddr(w.RemoteAddr()); !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+			r.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(r)
+	})
+	udpAddr, shutdownUDP := newUDPTestServer(t, handler)
+	defer shutdownUDP()
+	tcpAddr, shutdownTCP := newTCPTestServer(t, handler)
+	defer shutdownTCP()
+
+	for _, addr := range []string{"udp://" + udpAddr, "tcp://" + tcpAddr} {
+		u, err := NewUpstream(addr, &Opt{LocalAddr: "127.0.0.2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		r, err := u.ExchangeContext(ctx, q)
+		cancel()
+		u.Close()
+		if err != nil {
+			t.Skipf("cannot send queries from 127.0.0.2: %v", err)
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: query was not sent from the local addr", addr)
+		}
+	}
+}
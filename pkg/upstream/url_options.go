@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// urlOptionFuncs are the options that can be set inline in the query string
+// of the upstream address. e.g. "tls://1.1.1.1?sni=cloudflare-dns.com&mark=0x20&iface=wg0&pin=BASE64".
+// A key can have multiple values if the option accepts a list.
+var urlOptionFuncs = map[string]func(opt *Opt, vs []string) error{
+	"sni": func(opt *Opt, vs []string) error {
+		opt.TLSConfig.ServerName = vs[0]
+		return nil
+	},
+	"insecure": func(opt *Opt, vs []string) error {
+		return parseBoolOption(&opt.TLSConfig.InsecureSkipVerify, vs[0])
+	},
+	"pin": func(opt *Opt, vs []string) error {
+		pins, err := utils.ParseSPKIPins(vs)
+		if err != nil {
+			return err
+		}
+		opt.TLSConfig.VerifyConnection = utils.NewSPKIPinVerifier(pins)
+		return nil
+	},
+	"mark": func(opt *Opt, vs []string) error {
+		i, err := strconv.ParseUint(vs[0], 0, 32) // fwmark is an u32.
+		if err != nil {
+			return err
+		}
+		opt.SoMark = uint32(i)
+		return nil
+	},
+	"iface": func(opt *Opt, vs []string) error {
+		opt.BindToDevice = vs[0]
+		return nil
+	},
+	"local_addr": func(opt *Opt, vs []string) error {
+		opt.LocalAddr = vs[0]
+		return nil
+	},
+	"dial_addr": func(opt *Opt, vs []string) error {
+		opt.DialAddr = vs[0]
+		opt.DialAddrs = append([]string(nil), vs[1:]...)
+		return nil
+	},
+	"bootstrap": func(opt *Opt, vs []string) error {
+		opt.Bootstrap = vs[0]
+		return nil
+	},
+	"socks5": func(opt *Opt, vs []string) error {
+		opt.Socks5 = vs[0]
+		return nil
+	},
+	"idle_timeout": func(opt *Opt, vs []string) error {
+		i, err := strconv.Atoi(vs[0])
+		if err != nil {
+			return err
+		}
+		opt.IdleTimeout = time.Duration(i) * time.Second
+		return nil
+	},
+	"max_conns": func(opt *Opt, vs []string) error {
+		return parseIntOption(&opt.MaxConns, vs[0])
+	},
+	"pipeline": func(opt *Opt, vs []string) error {
+		return parseBoolOption(&opt.EnablePipeline, vs[0])
+	},
+	"http3": func(opt *Opt, vs []string) error {
+		return parseBoolOption(&opt.EnableHTTP3, vs[0])
+	},
+	"post": func(opt *Opt, vs []string) error {
+		return parseBoolOption(&opt.DoHUsePOST, vs[0])
+	},
+	"0x20": func(opt *Opt, vs []string) error {
+		return parseBoolOption(&opt.Enable0x20, vs[0])
+	},
+}
+
+func parseBoolOption(p *bool, s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*p = b
+	return nil
+}
+
+func parseIntOption(p *int, s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*p = i
+	return nil
+}
+
+// applyURLOptions removes inline options from the query string of u and
+// applies them to a copy of opt. opt is returned as-is if u has no option.
+// Unknown keys are an error, except for https upstreams, whose query string
+// may be a part of the server's endpoint.
+func applyURLOptions(u *url.URL, opt *Opt) (*Opt, error) {
+	if len(u.RawQuery) == 0 {
+		return opt, nil
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query string, %w", err)
+	}
+
+	newOpt := *opt
+	if opt.TLSConfig != nil {
+		newOpt.TLSConfig = opt.TLSConfig.Clone()
+	} else {
+		newOpt.TLSConfig = new(tls.Config)
+	}
+	applied := false
+	for k, vs := range q {
+		f := urlOptionFuncs[k]
+		if f == nil {
+			if u.Scheme == "https" {
+				continue
+			}
+			return nil, fmt.Errorf("unknown option %s", k)
+		}
+		if err := f(&newOpt, vs); err != nil {
+			return nil, fmt.Errorf("invalid option %s, %w", k, err)
+		}
+		q.Del(k)
+		applied = true
+	}
+	if !applied {
+		return opt, nil
+	}
+	u.RawQuery = q.Encode()
+	return &newOpt, nil
+}
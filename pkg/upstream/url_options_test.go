@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_applyURLOptions(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	u, err := url.Parse("tls://1.1.1.1?sni=cloudflare-dns.com&mark=0x20&iface=wg0&pin=" + url.QueryEscape(pin) +
+		"&dial_addr=1.0.0.1&dial_addr=1.1.1.1&idle_timeout=30&pipeline=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &Opt{SoMark: 1, MaxConns: 4}
+	opt, err := applyURLOptions(u, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt == base || base.SoMark != 1 || base.TLSConfig != nil {
+		t.Fatal("base opt should not be modified")
+	}
+	if opt.TLSConfig.ServerName != "cloudflare-dns.com" || opt.TLSConfig.VerifyConnection == nil {
+		t.Fatalf("unexpected tls config %+v", opt.TLSConfig)
+	}
+	if opt.SoMark != 0x20 || opt.BindToDevice != "wg0" || opt.MaxConns != 4 {
+		t.Fatalf("unexpected socket opts %+v", opt)
+	}
+	if opt.DialAddr != "1.0.0.1" || len(opt.DialAddrs) != 1 || opt.DialAddrs[0] != "1.1.1.1" {
+		t.Fatalf("unexpected dial addrs %s %v", opt.DialAddr, opt.DialAddrs)
+	}
+	if opt.IdleTimeout != time.Second*30 || !opt.EnablePipeline {
+		t.Fatalf("unexpected transport opts %+v", opt)
+	}
+	if len(u.RawQuery) != 0 {
+		t.Fatalf("options should be removed from the url, got %s", u.RawQuery)
+	}
+
+	// https keeps unknown parameters.
+	u, _ = url.Parse("https://dns.example/dns-query?token=abc&post=1")
+	opt, err = applyURLOptions(u, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opt.DoHUsePOST || u.String() != "https://dns.example/dns-query?token=abc" {
+		t.Fatalf("unexpected result %v, %s", opt.DoHUsePOST, u)
+	}
+
+	// fwmarks are u32.
+	u, _ = url.Parse("tls://1.1.1.1?mark=0xffffffff")
+	opt, err = applyURLOptions(u, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.SoMark != uint32(0xffffffff) {
+		t.Fatalf("unexpected mark %#x", opt.SoMark)
+	}
+
+	// Unknown and invalid options.
+	for _, s := range []string{"tls://1.1.1.1?foo=bar", "tls://1.1.1.1?mark=abc", "tls://1.1.1.1?mark=-1", "tls://1.1.1.1?mark=0x100000000", "tls://1.1.1.1?pin=abc"} {
+		u, _ = url.Parse(s)
+		if _, err := applyURLOptions(u, base); err == nil {
+			t.Fatalf("%s should fail", s)
+		}
+	}
+
+	// No option.
+	u, _ = url.Parse("tls://1.1.1.1")
+	if opt, err = applyURLOptions(u, base); err != nil || opt != base {
+		t.Fatalf("unexpected result %v, %v", opt, err)
+	}
+}
@@ -21,17 +21,24 @@ package upstream
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/bootstrap"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"golang.org/x/net/proxy"
 	"net"
+	"net/netip"
 )
 
 type socketOpts struct {
-	so_mark        int
+	so_mark        uint32
 	bind_to_device string
 }
 
-func dialTCP(ctx context.Context, addr, socks5 string, dialer *net.Dialer) (net.Conn, error) {
+// dialTCP dials addr over tcp. If socks5 is not empty, addr will be
+// dialed through the socks5 proxy and the proxy will resolve its host.
+// Otherwise, b (can be nil) will be used to resolve the host of addr.
+func dialTCP(ctx context.Context, addr, socks5 string, dialer *net.Dialer, b *bootstrap.Bootstrap) (net.Conn, error) {
 	if len(socks5) > 0 {
 		socks5Dialer, err := proxy.SOCKS5("tcp", socks5, nil, dialer)
 		if err != nil {
@@ -40,5 +47,76 @@ func dialTCP(ctx context.Context, addr, socks5 string, dialer *net.Dialer) (net.
 		return socks5Dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
 	}
 
-	return dialer.DialContext(ctx, "tcp", addr)
+	return dialWithBootstrap(ctx, "tcp", addr, dialer, b)
+}
+
+// dialWithBootstrap dials addr. If b is not nil, the host of addr will be
+// replaced by the address from b, and b will be invalidated if the dial
+// failed. So the host will be resolved again for the next dial.
+func dialWithBootstrap(ctx context.Context, network, addr string, dialer *net.Dialer, b *bootstrap.Bootstrap) (net.Conn, error) {
+	dialer = utils.DialerForNetwork(dialer, network)
+	if b == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ap, err := resolveWithBootstrap(ctx, addr, b)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialer.DialContext(ctx, network, ap.String())
+	if err != nil {
+		b.Invalidate(ap.Addr())
+		return nil, err
+	}
+	return c, nil
+}
+
+func resolveWithBootstrap(ctx context.Context, addr string, b *bootstrap.Bootstrap) (netip.AddrPort, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip, err := b.Addr(ctx)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+// newBootstrap returns a *bootstrap.Bootstrap that resolves the host of
+// dialAddr with the plain dns server. It returns nil if server is empty or
+// the host is already an ip address.
+func newBootstrap(dialAddr, server string, dialer *net.Dialer, opt *Opt) (*bootstrap.Bootstrap, error) {
+	if len(server) == 0 {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil, nil
+	}
+	r, err := bootstrap.NewPlainResolver(server, dialer)
+	if err != nil {
+		return nil, err
+	}
+	return bootstrap.NewBootstrap(host, r, bootstrap.Opts{Logger: opt.Logger}), nil
+}
+
+// tlsHandshake dials a connection by dial and runs a tls handshake on it.
+func tlsHandshake(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), tlsConfig *tls.Config) (*tls.Conn, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
@@ -33,7 +33,7 @@ func getSocketControlFunc(opts socketOpts) func(string, string, syscall.RawConn)
 		if err := c.Control(func(fd uintptr) {
 			// SO_MARK
 			if opts.so_mark > 0 {
-				sysCallErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, opts.so_mark)
+				sysCallErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(opts.so_mark))
 				if sysCallErr != nil {
 					sysCallErr = os.NewSyscallError("failed to set SO_MARK", sysCallErr)
 					return
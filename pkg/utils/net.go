@@ -48,6 +48,18 @@ func GetAddrFromAddr(addr net.Addr) netip.Addr {
 	return a
 }
 
+// GetPortFromAddr returns the port of a *net.TCPAddr or *net.UDPAddr.
+// Otherwise, it returns 0.
+func GetPortFromAddr(addr net.Addr) uint16 {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return uint16(v.Port)
+	case *net.UDPAddr:
+		return uint16(v.Port)
+	}
+	return 0
+}
+
 // SplitSchemeAndHost splits addr to protocol and host.
 func SplitSchemeAndHost(addr string) (protocol, host string) {
 	if protocol, host, ok := SplitString2(addr, "://"); ok {
@@ -56,3 +68,32 @@ func SplitSchemeAndHost(addr string) (protocol, host string) {
 		return "", addr
 	}
 }
+
+// DialerForNetwork returns a dialer for network. If the LocalAddr of d
+// is a *net.TCPAddr or *net.UDPAddr that does not match network, a copy
+// of d with the converted LocalAddr will be returned. So one dialer with
+// a local address can dial both tcp and udp.
+func DialerForNetwork(d *net.Dialer, network string) *net.Dialer {
+	ip := GetIPFromAddr(d.LocalAddr)
+	if ip == nil {
+		return d
+	}
+	var la net.Addr
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, ok := d.LocalAddr.(*net.TCPAddr); ok {
+			return d
+		}
+		la = &net.TCPAddr{IP: ip}
+	case "udp", "udp4", "udp6":
+		if _, ok := d.LocalAddr.(*net.UDPAddr); ok {
+			return d
+		}
+		la = &net.UDPAddr{IP: ip}
+	default:
+		return d
+	}
+	nd := *d
+	nd.LocalAddr = la
+	return &nd
+}
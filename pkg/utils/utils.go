@@ -23,13 +23,18 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -49,6 +54,117 @@ func LoadCertPool(certs []string) (*x509.CertPool, error) {
 	return rootCAs, nil
 }
 
+// LoadKeyPair reads and parses a public/private key pair from a pair of PEM
+// files. If passphrase is not empty, it is used to decrypt the private key.
+// Only legacy PEM encryption (RFC 1423, "Proc-Type: 4,ENCRYPTED") is supported.
+func LoadKeyPair(certFile, keyFile, passphrase string) (tls.Certificate, error) {
+	if len(passphrase) == 0 {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err = decryptKeyPEM(keyPEM, []byte(passphrase))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to decrypt key %s, %w", keyFile, err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// decryptKeyPEM finds the first private key block in b and returns
+// it decrypted and PEM encoded.
+func decryptKeyPEM(b, passphrase []byte) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("no private key block found")
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, errors.New("encrypted pkcs8 key is not supported, convert it to an unencrypted or legacy encrypted pem key")
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		// Legacy PEM encryption is deprecated because it is insecure by design,
+		// but it is still the only one that stdlib can decrypt.
+		if !x509.IsEncryptedPEMBlock(block) {
+			return pem.EncodeToMemory(block), nil
+		}
+		der, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+	}
+}
+
+// ParseSPKIPins parses base64 (as in HPKP) or hex encoded sha256 hashes
+// of certificates' SubjectPublicKeyInfo.
+func ParseSPKIPins(pins []string) ([][sha256.Size]byte, error) {
+	res := make([][sha256.Size]byte, 0, len(pins))
+	for _, s := range pins {
+		var b []byte
+		var err error
+		if len(s) == hex.EncodedLen(sha256.Size) {
+			b, err = hex.DecodeString(s)
+		} else {
+			b, err = base64.StdEncoding.DecodeString(s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin %s, %w", s, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %s, want %d bytes, got %d", s, sha256.Size, len(b))
+		}
+		res = append(res, *(*[sha256.Size]byte)(b))
+	}
+	return res, nil
+}
+
+// NewSPKIPinVerifier returns a function that can be used as tls.Config.VerifyConnection.
+// It returns an error if none of the trusted certificates has a SubjectPublicKeyInfo
+// that matches one of the pins.
+// It runs after the normal chain verification, so it can be used with
+// InsecureSkipVerify to trust self-signed certificates by their pins only.
+// If the chain was verified, only certificates in the verified chains are
+// trusted. Otherwise (InsecureSkipVerify), only the leaf certificate is
+// trusted. Other certificates sent by the peer are never matched, because
+// anyone can append a copy of the pinned certificate to its own chain.
+func NewSPKIPinVerifier(pins [][sha256.Size]byte) func(cs tls.ConnectionState) error {
+	match := func(cert *x509.Certificate) bool {
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if h == pin {
+				return true
+			}
+		}
+		return false
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			if len(cs.PeerCertificates) > 0 && match(cs.PeerCertificates[0]) {
+				return nil
+			}
+		} else {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if match(cert) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("no peer certificate matches the pinned spki hashes")
+	}
+}
+
 // GenerateCertificate generates an ecdsa certificate with given dnsName.
 // This should only use in test.
 func GenerateCertificate(dnsName string) (cert tls.Certificate, err error) {
@@ -20,6 +20,17 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -112,3 +123,111 @@ func Test_WeakDecode(t *testing.T) {
 		t.Fatalf("args decode failed, want %v, got %v", wantObj, testObj)
 	}
 }
+
+func TestLoadKeyPair(t *testing.T) {
+	cert, err := GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+
+	encBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", keyDER, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(encBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadKeyPair(certFile, keyFile, ""); err == nil {
+		t.Fatal("encrypted key loaded without passphrase")
+	}
+	if _, err := LoadKeyPair(certFile, keyFile, "wrong"); err == nil {
+		t.Fatal("encrypted key loaded with a wrong passphrase")
+	}
+	loaded, err := LoadKeyPair(certFile, keyFile, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], cert.Certificate[0]) {
+		t.Fatal("loaded certificate mismatched")
+	}
+}
+
+func TestSPKIPinVerifier(t *testing.T) {
+	cert, err := GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+
+	for _, s := range []string{base64.StdEncoding.EncodeToString(h[:]), hex.EncodeToString(h[:])} {
+		pins, err := ParseSPKIPins([]string{s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewSPKIPinVerifier(pins)(cs); err != nil {
+			t.Fatalf("pin %s should match, %v", s, err)
+		}
+	}
+
+	otherPins, err := ParseSPKIPins([]string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSPKIPinVerifier(otherPins)(cs); err == nil {
+		t.Fatal("mismatched pin should fail")
+	}
+
+	// A forged leaf followed by the pinned certificate must not pass
+	// without chain verification (InsecureSkipVerify).
+	forged, err := GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedLeaf, err := x509.ParseCertificate(forged.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins, err := ParseSPKIPins([]string{base64.StdEncoding.EncodeToString(h[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedCS := tls.ConnectionState{PeerCertificates: []*x509.Certificate{forgedLeaf, leaf}}
+	if err := NewSPKIPinVerifier(pins)(forgedCS); err == nil {
+		t.Fatal("pinned certificate after a forged leaf should fail")
+	}
+
+	// With verified chains, only certificates in the chains are trusted.
+	forgedCS.VerifiedChains = [][]*x509.Certificate{{forgedLeaf}}
+	if err := NewSPKIPinVerifier(pins)(forgedCS); err == nil {
+		t.Fatal("pinned certificate outside the verified chains should fail")
+	}
+	verifiedCS := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{forgedLeaf},
+		VerifiedChains:   [][]*x509.Certificate{{forgedLeaf, leaf}},
+	}
+	if err := NewSPKIPinVerifier(pins)(verifiedCS); err != nil {
+		t.Fatalf("pinned certificate in the verified chain should match, %v", err)
+	}
+
+	if _, err := ParseSPKIPins([]string{"dGVzdA=="}); err == nil {
+		t.Fatal("short pin should fail")
+	}
+}
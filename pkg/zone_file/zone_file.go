@@ -62,6 +62,13 @@ func (m *Matcher) Load(r io.Reader) error {
 	return parser.Err()
 }
 
+// Range calls f for each rrset in m. The returned rrs must not be modified.
+func (m *Matcher) Range(f func(q dns.Question, rrs []dns.RR)) {
+	for q, rrs := range m.m {
+		f(q, rrs)
+	}
+}
+
 func (m *Matcher) Search(q dns.Question) []dns.RR {
 	return m.m[q]
 }
@@ -21,31 +21,57 @@ package plugin
 
 // import all plugins
 import (
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/acl"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/anti_pollution"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/arbitrary"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/blackhole"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/bufsize"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/cache"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/client_limiter"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/client_policy"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dedup"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dhcp_leases"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dns64"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dnstap"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dual_query"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dual_selector"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ebpf_map"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ecs"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/edns0_filter"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/fast_forward"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/filter_answer"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/forward"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/hosts"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ipset"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/marker"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/mdns"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/metrics_collector"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/misc_optm"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/name_watcher"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/nftset"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/padding"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/query_log"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/query_stats"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/query_summary"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/recursive"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/reverse_lookup"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/rewrite"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/route"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/sleep"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/static_records"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/svcb_filter"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/ttl"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/whoami"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/zone"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/blocklist"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/dynamic_set"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/query_matcher"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/response_matcher"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/matcher/time_matcher"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/misc/net_watcher"
+	_ "github.com/IrineSistiana/mosdns/v4/plugin/misc/warmup"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/iptoshell"
 	_ "github.com/IrineSistiana/mosdns/v4/plugin/executable/dcname"
 )
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acl
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "acl"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*aclPlugin)(nil)
+var _ coremain.MatcherPlugin = (*aclPlugin)(nil)
+
+// Args of the acl plugin. Allow and Deny have the same format as the
+// client_ip of query_matcher, e.g. "192.168.0.0/16", "provider:geoip:cn".
+// A client is allowed if it is not in Deny and, if Allow is not empty,
+// it is in Allow. Queries without a client address (e.g. from unix
+// sockets) are not in any list.
+type Args struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// Action for denied queries, can be:
+	// "", "refuse" -> respond REFUSED
+	// "drop" -> drop the query without a response
+	Action string `yaml:"action"`
+}
+
+// aclPlugin denies queries from clients that are not allowed.
+// As a matcher, it matches queries from allowed clients.
+type aclPlugin struct {
+	*coremain.BP
+	allow *netlist.MatcherGroup // nil if Args.Allow is empty.
+	deny  *netlist.MatcherGroup // nil if Args.Deny is empty.
+	drop  bool
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newACL(bp, args.(*Args))
+}
+
+func newACL(bp *coremain.BP, args *Args) (_ *aclPlugin, err error) {
+	p := &aclPlugin{BP: bp}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	switch args.Action {
+	case "", "refuse":
+	case "drop":
+		p.drop = true
+	default:
+		return nil, fmt.Errorf("invalid action %s", args.Action)
+	}
+
+	if len(args.Allow) > 0 {
+		p.allow, err = netlist.BatchLoadProvider(args.Allow, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load allow list, %w", err)
+		}
+		bp.L().Info("allow list loaded", zap.Int("length", p.allow.Len()))
+	}
+	if len(args.Deny) > 0 {
+		p.deny, err = netlist.BatchLoadProvider(args.Deny, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load deny list, %w", err)
+		}
+		bp.L().Info("deny list loaded", zap.Int("length", p.deny.Len()))
+	}
+	return p, nil
+}
+
+// Match implements executable_seq.Matcher. It returns true if the client
+// of qCtx is allowed.
+func (p *aclPlugin) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	addr := qCtx.ReqMeta().ClientAddr
+	if p.deny != nil && addr.IsValid() {
+		denied, err := p.deny.Match(addr)
+		if err != nil || denied {
+			return false, err
+		}
+	}
+	if p.allow != nil {
+		if !addr.IsValid() {
+			return false, nil
+		}
+		return p.allow.Match(addr)
+	}
+	return true, nil
+}
+
+// Exec implements executable_seq.Executable. Queries from allowed clients
+// are passed to next.
+func (p *aclPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	allowed, err := p.Match(ctx, qCtx)
+	if err != nil {
+		return err
+	}
+	if allowed {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	p.L().Debug("query denied", qCtx.InfoField())
+	if p.drop {
+		return dns_handler.ErrDrop
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (p *aclPlugin) Close() error {
+	if p.allow != nil {
+		p.allow.Close()
+	}
+	if p.deny != nil {
+		p.deny.Close()
+	}
+	return nil
+}
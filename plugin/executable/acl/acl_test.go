@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acl
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func Test_aclPlugin_Exec(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	tests := []struct {
+		name       string
+		args       *Args
+		clientAddr string
+		wantPass   bool
+		wantDrop   bool
+	}{
+		{"no list", &Args{}, "1.1.1.1", true, false},
+		{"allowed", &Args{Allow: []string{"10.0.0.0/8"}}, "10.1.1.1", true, false},
+		{"allowed mapped", &Args{Allow: []string{"10.0.0.0/8"}}, "::ffff:10.1.1.1", true, false},
+		{"not allowed", &Args{Allow: []string{"10.0.0.0/8"}}, "1.1.1.1", false, false},
+		{"no client addr", &Args{Allow: []string{"10.0.0.0/8"}}, "", false, false},
+		{"no client addr deny", &Args{Deny: []string{"10.0.0.0/8"}}, "", true, false},
+		{"denied", &Args{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}, "10.0.0.1", false, false},
+		{"denied drop", &Args{Deny: []string{"10.0.0.0/8"}, Action: "drop"}, "10.0.0.1", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newACL(coremain.NewBP("acl", PluginType, nil, m), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			var addr netip.Addr
+			if len(tt.clientAddr) > 0 {
+				addr = netip.MustParseAddr(tt.clientAddr)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: addr})
+			r := new(dns.Msg)
+			r.SetReply(q)
+			next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: r})
+
+			err = p.Exec(context.Background(), qCtx, next)
+			if tt.wantDrop {
+				if !errors.Is(err, dns_handler.ErrDrop) {
+					t.Fatalf("want ErrDrop, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			passed := qCtx.R() == r
+			if passed != tt.wantPass {
+				t.Fatalf("want passed %v, got %v", tt.wantPass, passed)
+			}
+			if !passed && qCtx.R().Rcode != dns.RcodeRefused {
+				t.Fatalf("want REFUSED, got rcode %d", qCtx.R().Rcode)
+			}
+		})
+	}
+}
+
+func Test_newACL_invalidAction(t *testing.T) {
+	if _, err := newACL(coremain.NewBP("acl", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil)), &Args{Action: "x"}); err == nil {
+		t.Fatal("want an error")
+	}
+}
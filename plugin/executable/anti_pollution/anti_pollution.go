@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package anti_pollution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const PluginType = "anti_pollution"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultTimeout = time.Second * 2
+	maxUDPSize     = 4096
+)
+
+const (
+	reasonBadIP    = "bad_ip"
+	reasonEmpty    = "empty_noerror"
+	reasonEarly    = "early"
+	reasonMismatch = "mismatch"
+)
+
+var _ coremain.ExecutablePlugin = (*antiPollution)(nil)
+
+type Args struct {
+	// Upstream are plain udp servers, e.g. "8.8.8.8" or "8.8.8.8:53".
+	// Queries are sent to all of them at the same time, the first
+	// response that passes all checks is used.
+	Upstream []string `yaml:"upstream"` // required
+
+	// BadIPs are known bogus addresses of injected responses. Responses
+	// that have A or AAAA records in them are dropped. It has the same
+	// format as the ip of response_matcher.
+	BadIPs []string `yaml:"bad_ips"`
+
+	// MinRTT (ms) drops responses that arrive earlier than it, which are
+	// injected by on-path devices that are closer than the server.
+	MinRTT int `yaml:"min_rtt"`
+
+	// DropEmptyNoError drops NOERROR responses that have neither answer
+	// nor SOA record. Genuine NODATA responses have a SOA record.
+	DropEmptyNoError bool `yaml:"drop_empty_noerror"`
+
+	// Timeout (ms) of waiting for a good response. Default is 2000.
+	Timeout int `yaml:"timeout"`
+}
+
+// antiPollution forwards queries over udp and keeps reading from the
+// socket until a response passes all checks, so the genuine response
+// that arrives after injected ones is used. Truncated responses are
+// retried over tcp. Like forward, it sets the response and executes the
+// rest of the sequence.
+type antiPollution struct {
+	*coremain.BP
+	upstreams        []string
+	badIPs           *netlist.MatcherGroup // nil if Args.BadIPs is empty.
+	minRTT           time.Duration
+	dropEmptyNoError bool
+	timeout          time.Duration
+
+	droppedTotal *prometheus.CounterVec
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newAntiPollution(bp, args.(*Args))
+}
+
+func newAntiPollution(bp *coremain.BP, args *Args) (*antiPollution, error) {
+	if len(args.Upstream) == 0 {
+		return nil, errors.New("missing upstream")
+	}
+	p := &antiPollution{
+		BP:               bp,
+		minRTT:           time.Duration(args.MinRTT) * time.Millisecond,
+		dropEmptyNoError: args.DropEmptyNoError,
+		timeout:          time.Duration(args.Timeout) * time.Millisecond,
+		droppedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dropped_responses_total",
+			Help: "The total number of dropped bogus responses",
+		}, []string{"reason"}),
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+	for _, s := range args.Upstream {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		if _, err := netip.ParseAddrPort(s); err != nil {
+			return nil, fmt.Errorf("invalid upstream %s, %w", s, err)
+		}
+		p.upstreams = append(p.upstreams, s)
+	}
+	if len(args.BadIPs) > 0 {
+		l, err := netlist.BatchLoadProvider(args.BadIPs, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bad_ips, %w", err)
+		}
+		bp.L().Info("bad ips loaded", zap.Int("length", l.Len()))
+		p.badIPs = l
+	}
+	bp.GetMetricsReg().MustRegister(p.droppedTotal)
+	return p, nil
+}
+
+func (p *antiPollution) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r, err := p.exchange(ctx, qCtx.Q())
+	if err != nil {
+		return err
+	}
+	qCtx.SetResponse(r)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// exchange sends q to all upstreams and returns the first good response.
+func (p *antiPollution) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	resChan := make(chan result, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		upstream := upstream
+		go func() {
+			r, err := p.exchangeUDP(ctx, q, upstream)
+			if err == nil && r.Truncated {
+				r, err = p.exchangeTCP(ctx, q, upstream)
+			}
+			resChan <- result{r: r, err: err}
+		}()
+	}
+
+	var lastErr error
+	for range p.upstreams {
+		res := <-resChan
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		return res.r, nil
+	}
+	return nil, lastErr
+}
+
+// exchangeUDP sends q to upstream and reads responses until a response
+// passes all checks or ctx is done.
+func (p *antiPollution) exchangeUDP(ctx context.Context, q *dns.Msg, upstream string) (*dns.Msg, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxUDPSize)
+	dropped := 0
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if dropped > 0 {
+				return nil, fmt.Errorf("%d bogus responses from %s are dropped, and no good response, %w", dropped, upstream, err)
+			}
+			return nil, err
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		if reason := p.check(q, r, time.Since(start)); len(reason) > 0 {
+			dropped++
+			p.droppedTotal.WithLabelValues(reason).Inc()
+			p.L().Debug("bogus response dropped", zap.String("upstream", upstream), zap.String("reason", reason), zap.Stringer("resp", r))
+			continue
+		}
+		return r, nil
+	}
+}
+
+func (p *antiPollution) exchangeTCP(ctx context.Context, q *dns.Msg, upstream string) (*dns.Msg, error) {
+	c := &dns.Client{Net: "tcp"}
+	r, _, err := c.ExchangeContext(ctx, q, upstream)
+	return r, err
+}
+
+// check returns the reason if r is a bogus response of q. Or an empty
+// string if r passes all checks.
+func (p *antiPollution) check(q, r *dns.Msg, rtt time.Duration) string {
+	if r.Id != q.Id || !r.Response || len(r.Question) != len(q.Question) {
+		return reasonMismatch
+	}
+	for i := range q.Question {
+		if !strings.EqualFold(r.Question[i].Name, q.Question[i].Name) || r.Question[i].Qtype != q.Question[i].Qtype {
+			return reasonMismatch
+		}
+	}
+	if rtt < p.minRTT {
+		return reasonEarly
+	}
+	if p.dropEmptyNoError && r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0 && !hasSOA(r) && !r.Truncated {
+		return reasonEmpty
+	}
+	if p.badIPs != nil {
+		for _, rr := range r.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok {
+				continue
+			}
+			if bad, _ := p.badIPs.Match(addr.Unmap()); bad {
+				return reasonBadIP
+			}
+		}
+	}
+	return ""
+}
+
+func hasSOA(r *dns.Msg) bool {
+	for _, rr := range r.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *antiPollution) Close() error {
+	if p.badIPs != nil {
+		_ = p.badIPs.Close()
+	}
+	return nil
+}
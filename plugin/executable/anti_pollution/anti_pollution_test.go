@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package anti_pollution
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer starts a udp server that replies every query with an
+// injected response that has the address bogus immediately, then an
+// empty NOERROR response, and then the genuine response that has the
+// address genuine after delay.
+func startServer(t *testing.T, bogus, genuine string, delay time.Duration) string {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			reply := func(ip string) {
+				r := new(dns.Msg)
+				r.SetReply(q)
+				if len(ip) > 0 {
+					r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}}
+				}
+				b, _ := r.Pack()
+				c.WriteTo(b, from)
+			}
+			reply(bogus)
+			reply("")
+			go func() {
+				time.Sleep(delay)
+				reply(genuine)
+			}()
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func Test_antiPollution(t *testing.T) {
+	tests := []struct {
+		name string
+		args *Args
+		want string
+	}{
+		{"no check", &Args{}, "10.0.0.1"},
+		{"bad ips", &Args{BadIPs: []string{"10.0.0.0/8"}, DropEmptyNoError: true}, "1.1.1.1"},
+		{"min rtt", &Args{MinRTT: 30}, "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.args.Upstream = []string{startServer(t, "10.0.0.1", "1.1.1.1", time.Millisecond*50)}
+			m := coremain.NewTestMosdnsWithPlugins(nil)
+			p, err := newAntiPollution(coremain.NewBP("test", PluginType, nil, m), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q, nil)
+			if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != tt.want {
+				t.Fatalf("want %s, got %v", tt.want, r)
+			}
+		})
+	}
+
+	// Only bogus responses.
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	p, err := newAntiPollution(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Upstream:         []string{startServer(t, "10.0.0.1", "10.0.0.2", 0)},
+		BadIPs:           []string{"10.0.0.0/8"},
+		DropEmptyNoError: true,
+		Timeout:          200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if err := p.Exec(context.Background(), query_context.NewContext(q, nil), nil); err == nil {
+		t.Fatal("want an error")
+	}
+}
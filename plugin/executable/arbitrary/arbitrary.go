@@ -36,18 +36,30 @@ func init() {
 }
 
 type Args struct {
-	RR []string `yaml:"rr"`
+	RR     []string    `yaml:"rr"`
+	DNSSEC *DNSSECArgs `yaml:"dnssec"`
 }
 
 var _ coremain.ExecutablePlugin = (*arbitraryPlugin)(nil)
 
 type arbitraryPlugin struct {
 	*coremain.BP
-	m *zone_file.Matcher
+	m    *zone_file.Matcher
+	zone *signedZone // can be nil
 }
 
 func (p *arbitraryPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	if r := p.m.Reply(qCtx.Q()); r != nil {
+	q := qCtx.Q()
+	if p.zone != nil && p.zone.inZone(q) {
+		r, err := p.zone.reply(q)
+		if err != nil {
+			return err
+		}
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	if r := p.m.Reply(q); r != nil {
 		qCtx.SetResponse(r)
 		return nil
 	}
@@ -64,8 +76,15 @@ func Init(bp *coremain.BP, v interface{}) (p coremain.Plugin, err error) {
 			return nil, fmt.Errorf("failed to load rr #%d [%s], %w", i, s, err)
 		}
 	}
-	return &arbitraryPlugin{
+	ap := &arbitraryPlugin{
 		BP: bp,
 		m:  m,
-	}, nil
+	}
+	if args.DNSSEC != nil {
+		ap.zone, err = newSignedZone(bp, m, args.DNSSEC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init dnssec, %w", err)
+		}
+	}
+	return ap, nil
 }
@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package arbitrary
+
+import (
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnssec_signer"
+	"github.com/IrineSistiana/mosdns/v4/pkg/zone_file"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"time"
+)
+
+// DNSSECArgs enables online DNSSEC signing. Queries for names in Zone
+// will be answered authoritatively, including negative answers.
+type DNSSECArgs struct {
+	Zone string `yaml:"zone"` // required
+
+	// KSK and ZSK are key file prefixes in BIND format, e.g.
+	// "Kexample.com.+013+12345". If the files do not exist, new keys will
+	// be generated and saved. If empty, keys will be generated in memory,
+	// which means the DS record changes after every restart.
+	KSK string `yaml:"ksk"`
+	ZSK string `yaml:"zsk"`
+
+	// Validity is the validity period of signatures in seconds.
+	// Default is 7 days.
+	Validity int `yaml:"validity"`
+}
+
+const (
+	ednsUDPSize = 1232
+)
+
+type signedZone struct {
+	m      *zone_file.Matcher
+	signer *dnssec_signer.Signer
+	soa    *dns.SOA
+
+	// types contains names in the zone and their ancestors (empty
+	// non-terminals) with the types that exist at the name.
+	types map[string][]uint16
+}
+
+func newSignedZone(bp *coremain.BP, m *zone_file.Matcher, args *DNSSECArgs) (*signedZone, error) {
+	if len(args.Zone) == 0 {
+		return nil, errors.New("missing zone")
+	}
+	zone := dns.CanonicalName(args.Zone)
+
+	loadKey := func(prefix string, ksk bool) (*dnssec_signer.Key, error) {
+		if len(prefix) == 0 {
+			return dnssec_signer.GenerateKey(zone, ksk)
+		}
+		return dnssec_signer.LoadOrGenerateKey(prefix, zone, ksk)
+	}
+	ksk, err := loadKey(args.KSK, true)
+	if err != nil {
+		return nil, err
+	}
+	zsk, err := loadKey(args.ZSK, false)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := dnssec_signer.NewSigner(dnssec_signer.Opts{
+		Zone:     zone,
+		KSK:      ksk,
+		ZSK:      zsk,
+		Validity: time.Duration(args.Validity) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	z := &signedZone{
+		m:      m,
+		signer: signer,
+		types:  make(map[string][]uint16),
+	}
+	m.Range(func(q dns.Question, rrs []dns.RR) {
+		name := dns.CanonicalName(q.Name)
+		if !signer.InZone(name) {
+			return
+		}
+		if q.Qtype == dns.TypeSOA && name == zone {
+			z.soa = rrs[0].(*dns.SOA)
+		}
+		z.types[name] = append(z.types[name], q.Qtype)
+		for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(zone, name[off:]); off, end = dns.NextLabel(name, off) {
+			if _, ok := z.types[name[off:]]; !ok {
+				z.types[name[off:]] = nil
+			}
+		}
+	})
+	if z.soa == nil {
+		z.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "ns." + zone,
+			Mbox:    "hostmaster." + zone,
+			Serial:  uint32(time.Now().Unix()),
+			Refresh: 7200,
+			Retry:   3600,
+			Expire:  1209600,
+			Minttl:  300,
+		}
+		z.types[zone] = append(z.types[zone], dns.TypeSOA)
+	}
+	z.types[zone] = append(z.types[zone], dns.TypeDNSKEY)
+
+	if len(args.KSK) == 0 {
+		bp.L().Warn("dnssec ksk is generated in memory, the ds record will change after restart")
+	}
+	bp.L().Info("dnssec signing enabled", zap.String("zone", zone), zap.Stringer("ds", signer.DS()))
+	return z, nil
+}
+
+func (z *signedZone) inZone(q *dns.Msg) bool {
+	return len(q.Question) == 1 && z.signer.InZone(q.Question[0].Name)
+}
+
+func (z *signedZone) reply(q *dns.Msg) (*dns.Msg, error) {
+	question := q.Question[0]
+	name := dns.CanonicalName(question.Name)
+	isApex := name == z.signer.Zone()
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+
+	switch {
+	case isApex && question.Qtype == dns.TypeDNSKEY:
+		r.Answer = z.signer.DNSKEYs()
+	case isApex && question.Qtype == dns.TypeSOA:
+		r.Answer = []dns.RR{dns.Copy(z.soa)}
+	default:
+		rrs := z.m.Search(question)
+		if rrs == nil {
+			cq := question
+			cq.Name = name
+			rrs = z.m.Search(cq)
+		}
+		r.Answer = append(r.Answer, rrs...)
+	}
+
+	do := false
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+		r.SetEdns0(ednsUDPSize, do)
+	}
+
+	if len(r.Answer) == 0 {
+		negTTL := z.soa.Minttl
+		if z.soa.Hdr.Ttl < negTTL {
+			negTTL = z.soa.Hdr.Ttl
+		}
+		soa := dns.Copy(z.soa)
+		soa.Header().Ttl = negTTL
+		r.Ns = append(r.Ns, soa)
+
+		// NSEC black lies: a non-existent name is reported as a name
+		// without the queried type (NOERROR/NODATA). The rcode does not
+		// depend on the DO bit, so all clients get the same answer.
+		if do {
+			r.Ns = append(r.Ns, z.signer.BlackLie(question.Name, z.types[name], negTTL))
+		}
+	}
+
+	if do {
+		if err := z.signer.Sign(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package arbitrary
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/zone_file"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func Test_signedZone_nonExistentName(t *testing.T) {
+	m := new(zone_file.Matcher)
+	if err := m.Load(strings.NewReader("a.example.com. 300 IN A 192.0.2.1\n")); err != nil {
+		t.Fatal(err)
+	}
+	z, err := newSignedZone(coremain.NewBP("test", PluginType, zap.NewNop(), nil), m, &DNSSECArgs{Zone: "example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, do := range []bool{false, true} {
+		q := new(dns.Msg)
+		q.SetQuestion("nx.example.com.", dns.TypeA)
+		q.SetEdns0(1232, do)
+		r, err := z.reply(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			t.Fatalf("do=%v, want NOERROR/NODATA, got %s with %d answers", do, dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+		hasNSEC := false
+		for _, rr := range r.Ns {
+			if _, ok := rr.(*dns.NSEC); ok {
+				hasNSEC = true
+			}
+		}
+		if hasNSEC != do {
+			t.Fatalf("do=%v, unexpected nsec record in authority section", do)
+		}
+	}
+}
@@ -47,22 +47,52 @@ func init() {
 	coremain.RegNewPersetPluginFunc("_new_nxdomain_response", func(bp *coremain.BP) (coremain.Plugin, error) {
 		return newBlackHole(bp, &Args{RCode: dns.RcodeNameError})
 	})
+	coremain.RegNewPersetPluginFunc("_new_null_response", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return newBlackHole(bp, &Args{Mode: ModeNull})
+	})
+	coremain.RegNewPersetPluginFunc("_new_refused_response", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return newBlackHole(bp, &Args{Mode: ModeRefused})
+	})
 }
 
+const (
+	defaultTTL = 3600
+)
+
+// Blocking modes.
+const (
+	ModeNXDomain = "nxdomain" // NXDOMAIN with a SOA record.
+	ModeNoData   = "nodata"   // NOERROR with an empty answer and a SOA record.
+	ModeNull     = "null"     // 0.0.0.0 and ::, NODATA for other types.
+	ModeRefused  = "refused"
+	ModeServFail = "servfail"
+	ModeDrop     = "drop" // drops the response, so the client gets no reply.
+)
+
 var _ coremain.ExecutablePlugin = (*blackHole)(nil)
 
 type blackHole struct {
 	*coremain.BP
-	args *Args
+	rcode int // negative means dropping the response.
+	ttl   uint32
 
 	ipv4 []netip.Addr
 	ipv6 []netip.Addr
 }
 
 type Args struct {
+	// Mode is a preset blocking style, one of "nxdomain", "nodata",
+	// "null", "refused", "servfail" and "drop". It cannot be used with
+	// IPv4, IPv6 and RCode. If empty, IPv4, IPv6 and RCode are used.
+	Mode string `yaml:"mode"`
+
 	IPv4  []string `yaml:"ipv4"` // block by responding specific IP
 	IPv6  []string `yaml:"ipv6"`
 	RCode int      `yaml:"rcode"` // block by responding specific RCode
+
+	// TTL of synthesized records, including the SOA record of negative
+	// responses. Default is 3600 for addresses, and 300 for SOA records.
+	TTL uint32 `yaml:"ttl"`
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -70,7 +100,31 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 }
 
 func newBlackHole(bp *coremain.BP, args *Args) (*blackHole, error) {
-	b := &blackHole{BP: bp, args: args}
+	b := &blackHole{BP: bp, rcode: args.RCode, ttl: args.TTL}
+	if len(args.Mode) > 0 {
+		if len(args.IPv4) > 0 || len(args.IPv6) > 0 || args.RCode != 0 {
+			return nil, fmt.Errorf("mode %s cannot be used with ipv4, ipv6 and rcode", args.Mode)
+		}
+		switch args.Mode {
+		case ModeNXDomain:
+			b.rcode = dns.RcodeNameError
+		case ModeNoData:
+			b.rcode = dns.RcodeSuccess
+		case ModeNull:
+			b.rcode = dns.RcodeSuccess
+			b.ipv4 = []netip.Addr{netip.IPv4Unspecified()}
+			b.ipv6 = []netip.Addr{netip.IPv6Unspecified()}
+		case ModeRefused:
+			b.rcode = dns.RcodeRefused
+		case ModeServFail:
+			b.rcode = dns.RcodeServerFailure
+		case ModeDrop:
+			b.rcode = -1
+		default:
+			return nil, fmt.Errorf("invalid mode %s", args.Mode)
+		}
+		return b, nil
+	}
 	for _, s := range args.IPv4 {
 		addr, err := netip.ParseAddr(s)
 		if err != nil {
@@ -112,6 +166,10 @@ func (b *blackHole) exec(qCtx *query_context.Context) {
 
 	qName := q.Question[0].Name
 	qtype := q.Question[0].Qtype
+	ttl := b.ttl
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
 
 	switch {
 	case qtype == dns.TypeA && len(b.ipv4) > 0:
@@ -124,7 +182,7 @@ func (b *blackHole) exec(qCtx *query_context.Context) {
 					Name:   qName,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				A: addr.AsSlice(),
 			}
@@ -142,7 +200,7 @@ func (b *blackHole) exec(qCtx *query_context.Context) {
 					Name:   qName,
 					Rrtype: dns.TypeAAAA,
 					Class:  dns.ClassINET,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				AAAA: addr.AsSlice(),
 			}
@@ -150,8 +208,13 @@ func (b *blackHole) exec(qCtx *query_context.Context) {
 		}
 		qCtx.SetResponse(r)
 
-	case b.args.RCode >= 0:
-		r := dnsutils.GenEmptyReply(q, b.args.RCode)
+	case b.rcode >= 0:
+		r := dnsutils.GenEmptyReply(q, b.rcode)
+		if b.ttl > 0 {
+			soa := r.Ns[0].(*dns.SOA)
+			soa.Hdr.Ttl = b.ttl
+			soa.Minttl = b.ttl
+		}
 		qCtx.SetResponse(r)
 	default:
 		qCtx.SetResponse(nil)
@@ -42,6 +42,13 @@ func Test_blackhole_Exec(t *testing.T) {
 		{"respond with ipv4 1", &Args{IPv4: []string{"127.0.0.1"}}, dns.TypeA, true, 0, "127.0.0.1"},
 		{"respond with ipv4 2", &Args{IPv4: []string{"127.0.0.1"}, RCode: 2}, dns.TypeAAAA, true, 2, ""},
 		{"respond with ipv6", &Args{IPv6: []string{"::1"}}, dns.TypeAAAA, true, 0, "::1"},
+		{"mode nxdomain", &Args{Mode: ModeNXDomain}, dns.TypeA, true, dns.RcodeNameError, ""},
+		{"mode nodata", &Args{Mode: ModeNoData}, dns.TypeA, true, dns.RcodeSuccess, ""},
+		{"mode null ipv4", &Args{Mode: ModeNull}, dns.TypeA, true, dns.RcodeSuccess, "0.0.0.0"},
+		{"mode null ipv6", &Args{Mode: ModeNull}, dns.TypeAAAA, true, dns.RcodeSuccess, "::"},
+		{"mode null other", &Args{Mode: ModeNull}, dns.TypeMX, true, dns.RcodeSuccess, ""},
+		{"mode refused", &Args{Mode: ModeRefused}, dns.TypeA, true, dns.RcodeRefused, ""},
+		{"mode drop", &Args{Mode: ModeDrop}, dns.TypeA, false, 0, ""},
 	}
 
 	ctx := context.Background()
@@ -89,4 +96,29 @@ func Test_blackhole_Exec(t *testing.T) {
 			}
 		})
 	}
+
+	if _, err := newBlackHole(coremain.NewBP("test", PluginType, nil, nil), &Args{Mode: ModeNull, IPv4: []string{"127.0.0.1"}}); err == nil {
+		t.Fatal("mode with ipv4 should be rejected")
+	}
+}
+
+func Test_blackhole_TTL(t *testing.T) {
+	b, err := newBlackHole(coremain.NewBP("test", PluginType, nil, nil), &Args{Mode: ModeNull, TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeMX} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		qCtx := query_context.NewContext(q, nil)
+		if err := b.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		for _, rr := range append(r.Answer, r.Ns...) {
+			if rr.Header().Ttl != 60 {
+				t.Fatalf("want ttl 60, got %v", rr)
+			}
+		}
+	}
 }
@@ -0,0 +1,308 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEntriesLimit = 100
+	maxEntriesLimit     = 10000
+
+	// maxPurgeMarks limits the number of purged names. If it is exceeded,
+	// the whole cache is flushed instead.
+	maxPurgeMarks = 4096
+)
+
+// counter is a prometheus counter whose value can be read by the api.
+type counter struct {
+	prometheus.CounterFunc
+	n uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := new(counter)
+	c.CounterFunc = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, func() float64 {
+		return float64(c.Load())
+	})
+	return c
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *counter) Load() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// purgeMark records when a name was purged. Zero means never.
+type purgeMark struct {
+	name   int64 // unix nano, the name only.
+	suffix int64 // unix nano, the name and its subdomains.
+}
+
+// ServeHTTP serves the api of the plugin.
+//
+//	GET    /entries?name=&suffix=&limit=   list responses in the in-memory cache, optionally
+//	                                       filtered by the query name or its suffix.
+//	POST   /purge?name=                    purge responses of the name.
+//	POST   /purge?suffix=                  purge responses of the domain and its subdomains.
+//	POST   /flush                          purge all responses.
+//	GET    /stats                          show cache counters.
+//
+// Purges apply to all backends, including redis.
+func (c *cachePlugin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	query := req.URL.Query()
+	switch {
+	case strings.HasSuffix(path, "/entries"):
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c.handleEntries(w, req)
+	case strings.HasSuffix(path, "/purge"):
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name, suffix := query.Get("name"), query.Get("suffix")
+		if (len(name) == 0) == (len(suffix) == 0) {
+			writeError(w, http.StatusBadRequest, errors.New("one of name and suffix is required"))
+			return
+		}
+		if len(suffix) > 0 {
+			c.purge(suffix, true)
+		} else {
+			c.purge(name, false)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/flush"):
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c.Flush()
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/stats"):
+		writeJSON(w, http.StatusOK, c.stats())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type cacheStats struct {
+	Query    uint64 `json:"query"`
+	Hit      uint64 `json:"hit"`
+	Miss     uint64 `json:"miss"`
+	LazyHit  uint64 `json:"lazy_hit"`
+	Prefetch uint64 `json:"prefetch"`
+	NSECHit  uint64 `json:"nsec_hit"`
+	Evict    uint64 `json:"evict"`
+	Size     int    `json:"size"`
+}
+
+func (c *cachePlugin) stats() cacheStats {
+	s := cacheStats{
+		Query:    c.queryTotal.Load(),
+		Hit:      c.hitTotal.Load(),
+		LazyHit:  c.lazyHitTotal.Load(),
+		Prefetch: c.prefetchTotal.Load(),
+		NSECHit:  c.nsecHitTotal.Load(),
+		Evict:    c.memCache.Evicted(),
+		Size:     c.backend.Len(),
+	}
+	if s.Query > s.Hit {
+		s.Miss = s.Query - s.Hit
+	}
+	return s
+}
+
+type cacheEntry struct {
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Answer    []string  `json:"answer,omitempty"`
+	StoredAt  time.Time `json:"stored_at"`
+	ExpireAt  time.Time `json:"expire_at"`
+}
+
+func (c *cachePlugin) handleEntries(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	limit := defaultEntriesLimit
+	if s := query.Get("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+		limit = n
+		if limit > maxEntriesLimit {
+			limit = maxEntriesLimit
+		}
+	}
+	name := strings.ToLower(dns.Fqdn(query.Get("name")))
+	suffix := strings.ToLower(dns.Fqdn(query.Get("suffix")))
+
+	entries := make([]cacheEntry, 0)
+	flushedAt := atomic.LoadInt64(&c.flushedAt)
+	c.memCache.Range(func(key string, v []byte, storedTime, expirationTime time.Time) {
+		if len(entries) >= limit || storedTime.UnixNano() < flushedAt {
+			return
+		}
+		ns, q, ok := parseMsgKey(key)
+		if !ok || c.isPurged(q.Name, storedTime) {
+			return
+		}
+		qname := strings.ToLower(q.Name)
+		if len(query.Get("name")) > 0 && qname != name {
+			return
+		}
+		if len(query.Get("suffix")) > 0 && !dns.IsSubDomain(suffix, qname) {
+			return
+		}
+		e := cacheEntry{
+			Namespace: ns,
+			Name:      q.Name,
+			Type:      dns.Type(q.Qtype).String(),
+			StoredAt:  storedTime,
+			ExpireAt:  expirationTime,
+		}
+		if r, err := c.unpackValue(v); err == nil {
+			e.Rcode = dns.RcodeToString[r.Rcode]
+			for _, rr := range r.Answer {
+				e.Answer = append(e.Answer, rr.String())
+			}
+		}
+		entries = append(entries, e)
+	})
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// unpackValue unpacks a cached value without changing its ttls.
+func (c *cachePlugin) unpackValue(v []byte) (*dns.Msg, error) {
+	if c.args.CompressResp {
+		var err error
+		v, err = snappy.Decode(nil, v)
+		if err != nil {
+			return nil, fmt.Errorf("snappy decode err: %w", err)
+		}
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(v); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseMsgKey returns the namespace and the question of a cache key.
+// Keys are the packed queries, with their namespaces and a "\x00" prepended.
+// A packed query always starts with a zero id.
+func parseMsgKey(key string) (ns string, q dns.Question, ok bool) {
+	if len(key) > 0 && key[0] != 0 {
+		i := strings.IndexByte(key, 0)
+		if i < 0 {
+			return "", q, false
+		}
+		ns, key = key[:i], key[i+1:]
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack([]byte(key)); err != nil || len(m.Question) != 1 {
+		return "", q, false
+	}
+	return ns, m.Question[0], true
+}
+
+// purge marks responses of name, or of name and its subdomains if suffix
+// is true, that were stored before now as expired.
+func (c *cachePlugin) purge(name string, suffix bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if name == "." && suffix {
+		c.Flush()
+		return
+	}
+	now := time.Now().UnixNano()
+	c.purgeMu.Lock()
+	if _, ok := c.purged[name]; !ok && len(c.purged) >= maxPurgeMarks {
+		c.purgeMu.Unlock()
+		c.Flush()
+		return
+	}
+	m := c.purged[name]
+	if suffix {
+		m.suffix = now
+	} else {
+		m.name = now
+	}
+	c.purged[name] = m
+	c.purgeMu.Unlock()
+
+	// Synthesized responses may cover the name.
+	if c.nsec != nil {
+		c.nsec.flush()
+	}
+}
+
+// isPurged reports whether a response of name that was stored at
+// storedTime was purged.
+func (c *cachePlugin) isPurged(name string, storedTime time.Time) bool {
+	c.purgeMu.RLock()
+	defer c.purgeMu.RUnlock()
+	if len(c.purged) == 0 {
+		return false
+	}
+	stored := storedTime.UnixNano()
+	name = strings.ToLower(dns.Fqdn(name))
+	if m, ok := c.purged[name]; ok && stored < m.name {
+		return true
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if m, ok := c.purged[name[off:]]; ok && stored < m.suffix {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_cachePlugin_api(t *testing.T) {
+	c := newTestCache(t, &Args{Namespace: "ns"}, nil)
+	next := &testNext{rcode: dns.RcodeSuccess}
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(method, "/plugins/cache"+target, nil))
+		return w
+	}
+
+	execCache(t, c, next)
+	w := serve(http.MethodGet, "/entries?suffix=com")
+	var entries []cacheEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "example.com." || entries[0].Namespace != "ns" || len(entries[0].Answer) != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	w = serve(http.MethodGet, "/entries?name=example.org")
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 0 {
+		t.Fatalf("want no entry, got %s", w.Body)
+	}
+
+	// Purging a sibling keeps the response.
+	serve(http.MethodPost, "/purge?name=www.example.com")
+	execCache(t, c, next)
+	if next.getCalls() != 1 {
+		t.Fatalf("want 1 call, got %d", next.getCalls())
+	}
+	if w := serve(http.MethodPost, "/purge?suffix=com"); w.Code != http.StatusNoContent {
+		t.Fatalf("want 204, got %d", w.Code)
+	}
+	execCache(t, c, next)
+	if next.getCalls() != 2 {
+		t.Fatalf("want 2 calls after purge, got %d", next.getCalls())
+	}
+	if w := serve(http.MethodPost, "/purge"); w.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+
+	var s cacheStats
+	if err := json.Unmarshal(serve(http.MethodGet, "/stats").Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Query != 3 || s.Hit != 1 || s.Miss != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	serve(http.MethodPost, "/flush")
+	execCache(t, c, next)
+	if next.getCalls() != 3 {
+		t.Fatalf("want 3 calls after flush, got %d", next.getCalls())
+	}
+}
@@ -21,11 +21,14 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/cache"
 	"github.com/IrineSistiana/mosdns/v4/pkg/cache/mem_cache"
 	"github.com/IrineSistiana/mosdns/v4/pkg/cache/redis_cache"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cache/tiered_cache"
+	"github.com/IrineSistiana/mosdns/v4/pkg/concurrent_lru"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/pool"
@@ -36,6 +39,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -53,20 +60,97 @@ func init() {
 
 const (
 	defaultLazyUpdateTimeout = time.Second * 5
-	defaultEmptyAnswerTTL    = time.Second * 300
+	defaultValidateTimeout   = time.Second * 5
+
+	prefetchThreshold = 0.1 // of the msg ttl
+
+	// maxNegativeTTL caps the ttl of negative responses, as suggested
+	// by RFC 2308 section 5.
+	maxNegativeTTL = time.Hour * 3
+
+	validatedAtShards       = 64
+	validatedAtSizePerShard = 1024
 )
 
 var _ coremain.ExecutablePlugin = (*cachePlugin)(nil)
 
 type Args struct {
-	Size              int    `yaml:"size"`
-	Redis             string `yaml:"redis"`
-	RedisTimeout      int    `yaml:"redis_timeout"`
+	// Size of the in-memory cache. If Redis or RedisCluster is set, the
+	// in-memory cache is used in front of redis. It keeps working when
+	// redis is unavailable.
+	Size         int    `yaml:"size"`
+	Redis        string `yaml:"redis"`
+	RedisTimeout int    `yaml:"redis_timeout"`
+
+	// RedisCluster are urls of redis cluster nodes, in the same format of
+	// Redis. Auth and tls options are taken from the first url. It cannot
+	// be used with Redis.
+	RedisCluster []string `yaml:"redis_cluster"`
+
 	LazyCacheTTL      int    `yaml:"lazy_cache_ttl"`
 	LazyCacheReplyTTL int    `yaml:"lazy_cache_reply_ttl"`
 	CacheEverything   bool   `yaml:"cache_everything"`
 	CompressResp      bool   `yaml:"compress_resp"`
 	WhenHit           string `yaml:"when_hit"`
+
+	// ErrorCacheTTL (sec) enables caching of SERVFAIL/REFUSED responses and
+	// failed queries for a short period, so clients that retry a dead
+	// domain won't hammer the whole chain. Default is 0, which disables it.
+	ErrorCacheTTL int `yaml:"error_cache_ttl"`
+
+	// RcodeTTL overrides the ttl (sec) of responses by their rcode, e.g.
+	// {"NXDOMAIN": 60, "SERVFAIL": 5}. Responses with an rcode in RcodeTTL
+	// will be cached even if the rcode is not NOERROR. It takes precedence
+	// over ErrorCacheTTL.
+	RcodeTTL map[string]int `yaml:"rcode_ttl"`
+
+	// AggressiveNSEC synthesizes NXDOMAIN responses from the NSEC records
+	// of cached DNSSEC validated (AD bit set) NXDOMAIN responses, as
+	// described in RFC 8198. So queries for random subdomains of signed
+	// zones are answered without querying upstreams.
+	AggressiveNSEC bool `yaml:"aggressive_nsec"`
+
+	// DumpFile persists the in-memory cache to the file, so it survives
+	// restarts. The file is loaded on start, and saved every DumpInterval
+	// (sec, default 600) and on shutdown.
+	DumpFile     string `yaml:"dump_file"`
+	DumpInterval int    `yaml:"dump_interval"`
+
+	// Prefetch updates a cached response in the background if it is hit
+	// when less than 10% of its ttl is left. So popular names are renewed
+	// before they expire.
+	Prefetch bool `yaml:"prefetch"`
+
+	// ValidateExec is the tag of an executable that validates cache hits
+	// older than ValidateAfter (sec). It runs in the background with the
+	// cached response set. A validation fails if the executable returns
+	// an error, drops the response or changes its rcode to a non-success
+	// one. A failed validation triggers a background re-resolution.
+	// A key that passed the validation won't be validated again within
+	// ValidateAfter.
+	ValidateExec  string `yaml:"validate_exec"`
+	ValidateAfter int    `yaml:"validate_after"`
+
+	// Namespace is prepended to cache keys, so cache plugins that share
+	// a redis server don't share their responses.
+	Namespace string `yaml:"namespace"`
+
+	// Views split the cache into namespaces by the queries' view, so
+	// responses produced under different policies (e.g. filtered and
+	// unfiltered) never leak across views. The first view whose matchers
+	// all match the query is used. Queries that match no view use
+	// Namespace.
+	Views []ViewArgs `yaml:"views"`
+}
+
+type ViewArgs struct {
+	Namespace string   `yaml:"namespace"` // required, must be unique.
+	Matchers  []string `yaml:"matchers"`  // required, matcher tags.
+}
+
+type cacheView struct {
+	namespace string
+	matchers  []executable_seq.Matcher
 }
 
 type cachePlugin struct {
@@ -74,13 +158,39 @@ type cachePlugin struct {
 	args *Args
 
 	whenHit      executable_seq.Executable
+	views        []cacheView
 	backend      cache.Backend
+	memCache     *mem_cache.MemCache // the in-memory tier of backend.
+	closeNotify  chan struct{}
+	rcodeTTL     map[int]time.Duration
+	nsec         *nsecCache // nil if Args.AggressiveNSEC is disabled.
 	lazyUpdateSF singleflight.Group
 
-	queryTotal   prometheus.Counter
-	hitTotal     prometheus.Counter
-	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	validator   executable_seq.Executable
+	validating  sync.Map                          // msgKeys that are being validated.
+	validatedAt *concurrent_lru.ShardedLRU[int64] // Unix nano timestamps.
+
+	// Unix nano timestamps. Cached responses that were stored before
+	// flushedAt are ignored. Those were stored before staledAt are
+	// considered as expired.
+	flushedAt int64
+	staledAt  int64
+
+	// purged are the times when names were purged by the api.
+	purgeMu sync.RWMutex
+	purged  map[string]purgeMark
+
+	queryTotal    *counter
+	hitTotal      *counter
+	lazyHitTotal  *counter
+	prefetchTotal *counter
+	nsecHitTotal  *counter
+	evictTotal    prometheus.CounterFunc
+	size          prometheus.GaugeFunc
+	hitRatio      prometheus.GaugeFunc
+
+	validateTotal       prometheus.Counter
+	validateFailedTotal prometheus.Counter
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -89,13 +199,12 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 
 func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 	var c cache.Backend
-	if len(args.Redis) != 0 {
-		opt, err := redis.ParseURL(args.Redis)
+	mc := mem_cache.NewMemCache(args.Size, 0)
+	if len(args.Redis) != 0 || len(args.RedisCluster) != 0 {
+		r, err := newRedisClient(args)
 		if err != nil {
-			return nil, fmt.Errorf("invalid redis url, %w", err)
+			return nil, err
 		}
-		opt.MaxRetries = -1
-		r := redis.NewClient(opt)
 		rcOpts := redis_cache.RedisCacheOpts{
 			Client:        r,
 			ClientCloser:  r,
@@ -106,9 +215,9 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to init redis cache, %w", err)
 		}
-		c = rc
+		c = tiered_cache.NewTieredCache(mc, rc)
 	} else {
-		c = mem_cache.NewMemCache(args.Size, 0)
+		c = mc
 	}
 
 	if args.LazyCacheReplyTTL <= 0 {
@@ -124,23 +233,53 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 		}
 	}
 
+	var validator executable_seq.Executable
+	if tag := args.ValidateExec; len(tag) > 0 {
+		validator = bp.M().GetExecutables()[tag]
+		if validator == nil {
+			return nil, fmt.Errorf("cannot find exectable %s", tag)
+		}
+	}
+
+	views, err := newCacheViews(bp, args)
+	if err != nil {
+		return nil, err
+	}
+
+	rcodeTTL, err := parseRcodeTTL(args.RcodeTTL)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &cachePlugin{
-		BP:      bp,
-		args:    args,
-		whenHit: whenHit,
-		backend: c,
-
-		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "query_total",
-			Help: "The total number of processed queries",
-		}),
-		hitTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "hit_total",
-			Help: "The total number of queries that hit the cache",
-		}),
-		lazyHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "lazy_hit_total",
-			Help: "The total number of queries that hit the expired cache",
+		BP:       bp,
+		args:     args,
+		whenHit:  whenHit,
+		views:    views,
+		backend:  c,
+		memCache: mc,
+
+		closeNotify: make(chan struct{}),
+		rcodeTTL:    rcodeTTL,
+		purged:      make(map[string]purgeMark),
+
+		validator: validator,
+
+		queryTotal: newCounter("query_total",
+			"The total number of processed queries"),
+		hitTotal: newCounter("hit_total",
+			"The total number of queries that hit the cache"),
+		lazyHitTotal: newCounter("lazy_hit_total",
+			"The total number of queries that hit the expired cache"),
+		prefetchTotal: newCounter("prefetch_total",
+			"The total number of cache hits that triggered a prefetch"),
+		nsecHitTotal: newCounter("nsec_hit_total",
+			"The total number of NXDOMAIN responses synthesized from cached NSEC records"),
+		evictTotal: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "evict_total",
+			Help: "The total number of unexpired responses evicted from the in-memory cache",
+		}, func() float64 {
+			return float64(mc.Evicted())
 		}),
 		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name: "cache_size",
@@ -148,11 +287,125 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 		}, func() float64 {
 			return float64(c.Len())
 		}),
+		validateTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "validate_total",
+			Help: "The total number of cache hits that were validated",
+		}),
+		validateFailedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "validate_failed_total",
+			Help: "The total number of cache hits that failed the validation",
+		}),
+	}
+	p.hitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hit_ratio",
+		Help: "The ratio of queries that hit the cache since start",
+	}, func() float64 {
+		q := p.queryTotal.Load()
+		if q == 0 {
+			return 0
+		}
+		return float64(p.hitTotal.Load()) / float64(q)
+	})
+	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.evictTotal, p.size, p.hitRatio)
+	if args.Prefetch {
+		bp.GetMetricsReg().MustRegister(p.prefetchTotal)
+	}
+	if args.AggressiveNSEC {
+		p.nsec = newNSECCache()
+		bp.GetMetricsReg().MustRegister(p.nsecHitTotal)
+	}
+	if validator != nil {
+		p.validatedAt = concurrent_lru.NewShardedLRU[int64](validatedAtShards, validatedAtSizePerShard, nil)
+		bp.GetMetricsReg().MustRegister(p.validateTotal, p.validateFailedTotal)
+	}
+	if len(args.DumpFile) > 0 {
+		n, err := p.loadDump()
+		if err != nil {
+			bp.L().Warn("failed to load cache dump", zap.String("file", args.DumpFile), zap.Error(err))
+		} else {
+			bp.L().Info("cache dump loaded", zap.Int("entries", n))
+		}
+		go p.dumpLoop()
 	}
-	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.size)
 	return p, nil
 }
 
+func newRedisClient(args *Args) (redis.UniversalClient, error) {
+	if len(args.RedisCluster) == 0 {
+		opt, err := redis.ParseURL(args.Redis)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url, %w", err)
+		}
+		opt.MaxRetries = -1
+		return redis.NewClient(opt), nil
+	}
+
+	if len(args.Redis) != 0 {
+		return nil, errors.New("redis and redis_cluster cannot be used together")
+	}
+	opt := &redis.ClusterOptions{MaxRetries: -1}
+	for i, s := range args.RedisCluster {
+		nodeOpt, err := redis.ParseURL(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis cluster url #%d, %w", i, err)
+		}
+		if i == 0 {
+			opt.Username = nodeOpt.Username
+			opt.Password = nodeOpt.Password
+			opt.TLSConfig = nodeOpt.TLSConfig
+		}
+		opt.Addrs = append(opt.Addrs, nodeOpt.Addr)
+	}
+	return redis.NewClusterClient(opt), nil
+}
+
+// parseRcodeTTL parses Args.RcodeTTL. Rcodes can be names or numbers.
+func parseRcodeTTL(m map[string]int) (map[int]time.Duration, error) {
+	rcodeTTL := make(map[int]time.Duration, len(m))
+	for s, ttl := range m {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rcode %s", s)
+			}
+			rcode = n
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %d of rcode %s", ttl, s)
+		}
+		rcodeTTL[rcode] = time.Duration(ttl) * time.Second
+	}
+	return rcodeTTL, nil
+}
+
+func newCacheViews(bp *coremain.BP, args *Args) ([]cacheView, error) {
+	var views []cacheView
+	dup := map[string]struct{}{args.Namespace: {}}
+	for i, va := range args.Views {
+		if len(va.Namespace) == 0 {
+			return nil, fmt.Errorf("view #%d has no namespace", i)
+		}
+		if _, ok := dup[va.Namespace]; ok {
+			return nil, fmt.Errorf("duplicated namespace %s", va.Namespace)
+		}
+		dup[va.Namespace] = struct{}{}
+		if len(va.Matchers) == 0 {
+			return nil, fmt.Errorf("view %s has no matcher", va.Namespace)
+		}
+		v := cacheView{namespace: va.Namespace}
+		for _, tag := range va.Matchers {
+			m := bp.M().GetMatchers()[tag]
+			if m == nil {
+				return nil, fmt.Errorf("cannot find matcher %s", tag)
+			}
+			v.matchers = append(v.matchers, m)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
 func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	c.queryTotal.Inc()
 	q := qCtx.Q()
@@ -164,20 +417,40 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 	if len(msgKey) == 0 { // skip cache
 		return executable_seq.ExecChainNode(ctx, qCtx, next)
 	}
+	ns, err := c.getNamespace(ctx, qCtx)
+	if err != nil {
+		c.L().Warn("failed to match cache view, skip cache", qCtx.InfoField(), zap.Error(err))
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	if len(ns) > 0 {
+		msgKey = ns + "\x00" + msgKey
+	}
 
-	cachedResp, lazyHit, err := c.lookupCache(msgKey)
+	cachedResp, storedTime, lazyHit, prefetch, err := c.lookupCache(msgKey)
 	if err != nil {
 		c.L().Error("lookup cache", qCtx.InfoField(), zap.Error(err))
 	}
 	if lazyHit {
 		c.lazyHitTotal.Inc()
 		c.doLazyUpdate(msgKey, qCtx, next)
+	} else if prefetch {
+		c.prefetchTotal.Inc()
+		c.doLazyUpdate(msgKey, qCtx, next)
+	} else if cachedResp != nil && c.shouldValidate(msgKey, cachedResp, storedTime) {
+		c.doValidate(msgKey, qCtx, cachedResp, next)
+	}
+	if cachedResp == nil && c.nsec != nil {
+		if cachedResp = c.nsec.synthesize(ns, q, time.Now()); cachedResp != nil {
+			c.nsecHitTotal.Inc()
+		}
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
 		cachedResp.Id = q.Id // change msg id
 		c.L().Debug("cache hit", qCtx.InfoField())
 		qCtx.SetResponse(cachedResp)
+		qCtx.SetCacheHit(true)
+		qCtx.Tracef(c.Tag(), "cache hit")
 		if c.whenHit != nil {
 			return c.whenHit.Exec(ctx, qCtx, nil)
 		}
@@ -186,12 +459,22 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 
 	// cache miss, run the entry and try to store its response.
 	c.L().Debug("cache miss", qCtx.InfoField())
+	qCtx.Tracef(c.Tag(), "cache miss")
 	err = executable_seq.ExecChainNode(ctx, qCtx, next)
 	r := qCtx.R()
+	if r == nil && err != nil && c.errTTL(dns.RcodeServerFailure) > 0 {
+		r = dnsutils.GenEmptyReply(q, dns.RcodeServerFailure)
+	}
 	if r != nil {
 		if err := c.tryStoreMsg(msgKey, r); err != nil {
 			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
 		}
+		if err := c.tryStoreErrMsg(msgKey, r); err != nil {
+			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
+		}
+		if c.nsec != nil {
+			c.nsec.add(ns, r, time.Now())
+		}
 	}
 	return err
 }
@@ -210,57 +493,113 @@ func (c *cachePlugin) getMsgKey(q *dns.Msg) (string, error) {
 	return "", nil
 }
 
-// lookupCache returns the cached response. The ttl of returned msg will be changed properly.
+// getNamespace returns the namespace of the first view that matches qCtx,
+// or Args.Namespace.
+func (c *cachePlugin) getNamespace(ctx context.Context, qCtx *query_context.Context) (string, error) {
+	for _, v := range c.views {
+		ok, err := executable_seq.LogicalAndMatcherGroup(ctx, qCtx, v.matchers)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return v.namespace, nil
+		}
+	}
+	return c.args.Namespace, nil
+}
+
+// lookupCache returns the cached response and the time it was stored.
+// The ttl of returned msg will be changed properly.
 // Remember, caller must change the msg id.
-func (c *cachePlugin) lookupCache(msgKey string) (r *dns.Msg, lazyHit bool, err error) {
+// prefetch reports whether r is about to expire and should be updated.
+func (c *cachePlugin) lookupCache(msgKey string) (r *dns.Msg, storedTime time.Time, lazyHit, prefetch bool, err error) {
 	// lookup in cache
 	v, storedTime, _ := c.backend.Get(msgKey)
 
+	if v != nil && storedTime.UnixNano() < atomic.LoadInt64(&c.flushedAt) {
+		v = nil
+	}
+
 	// cache hit
 	if v != nil {
 		if c.args.CompressResp {
 			decodeLen, err := snappy.DecodedLen(v)
 			if err != nil {
-				return nil, false, fmt.Errorf("snappy decode err: %w", err)
+				return nil, storedTime, false, false, fmt.Errorf("snappy decode err: %w", err)
 			}
 			if decodeLen > dns.MaxMsgSize {
-				return nil, false, fmt.Errorf("invalid snappy data, not a dns msg, data len: %d", decodeLen)
+				return nil, storedTime, false, false, fmt.Errorf("invalid snappy data, not a dns msg, data len: %d", decodeLen)
 			}
 			decompressBuf := pool.GetBuf(decodeLen)
 			defer decompressBuf.Release()
 			v, err = snappy.Decode(decompressBuf.Bytes(), v)
 			if err != nil {
-				return nil, false, fmt.Errorf("snappy decode err: %w", err)
+				return nil, storedTime, false, false, fmt.Errorf("snappy decode err: %w", err)
 			}
 		}
 		r = new(dns.Msg)
 		if err := r.Unpack(v); err != nil {
-			return nil, false, fmt.Errorf("failed to unpack cached data, %w", err)
+			return nil, storedTime, false, false, fmt.Errorf("failed to unpack cached data, %w", err)
+		}
+		if len(r.Question) == 1 && c.isPurged(r.Question[0].Name, storedTime) {
+			return nil, storedTime, false, false, nil
 		}
 
-		var msgTTL time.Duration
-		if len(r.Answer) == 0 {
-			msgTTL = defaultEmptyAnswerTTL
-		} else {
-			msgTTL = time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
+		staled := storedTime.UnixNano() < atomic.LoadInt64(&c.staledAt)
+		if isErrRcode(r.Rcode) {
+			errTTL := c.errTTL(r.Rcode)
+			if !staled && storedTime.Add(errTTL).After(time.Now()) {
+				return r, storedTime, false, false, nil
+			}
+			return nil, storedTime, false, false, nil
+		}
+
+		msgTTL, setTTL, ok := c.msgTTL(r)
+		if !ok {
+			return nil, storedTime, false, false, nil
 		}
 
 		// not expired
-		if storedTime.Add(msgTTL).After(time.Now()) {
-			dnsutils.SubtractTTL(r, uint32(time.Since(storedTime).Seconds()))
-			return r, false, nil
+		if elapsed := time.Since(storedTime); !staled && elapsed < msgTTL {
+			if setTTL {
+				dnsutils.SetTTL(r, uint32((msgTTL - elapsed).Seconds()))
+			} else {
+				dnsutils.SubtractTTL(r, uint32(elapsed.Seconds()))
+			}
+			prefetch = c.args.Prefetch && float64(msgTTL-elapsed) < float64(msgTTL)*prefetchThreshold
+			return r, storedTime, false, prefetch, nil
 		}
 
 		// expired but lazy update enabled
 		if c.args.LazyCacheTTL > 0 {
 			// set the default ttl
 			dnsutils.SetTTL(r, uint32(c.args.LazyCacheReplyTTL))
-			return r, true, nil
+			return r, storedTime, true, false, nil
 		}
 	}
 
 	// cache miss
-	return nil, false, nil
+	return nil, storedTime, false, false, nil
+}
+
+// Flush drops all cached responses.
+func (c *cachePlugin) Flush() {
+	atomic.StoreInt64(&c.flushedAt, time.Now().UnixNano())
+	c.purgeMu.Lock()
+	c.purged = make(map[string]purgeMark)
+	c.purgeMu.Unlock()
+	if c.nsec != nil {
+		c.nsec.flush()
+	}
+}
+
+// MarkStale marks all cached responses as expired. If lazy cache is enabled,
+// they can still be used as lazy responses until they are updated.
+func (c *cachePlugin) MarkStale() {
+	atomic.StoreInt64(&c.staledAt, time.Now().UnixNano())
+	if c.nsec != nil {
+		c.nsec.flush()
+	}
 }
 
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
@@ -270,29 +609,96 @@ func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, n
 	lazyUpdateFunc := func() (interface{}, error) {
 		c.L().Debug("start lazy cache update", lazyQCtx.InfoField())
 		defer c.lazyUpdateSF.Forget(msgKey)
-		lazyCtx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
-		defer cancel()
+		c.updateCache(msgKey, lazyQCtx, next)
+		c.L().Debug("lazy cache updated", lazyQCtx.InfoField())
+		return nil, nil
+	}
+	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+}
 
-		err := executable_seq.ExecChainNode(lazyCtx, lazyQCtx, next)
-		if err != nil {
-			c.L().Warn("failed to update lazy cache", lazyQCtx.InfoField(), zap.Error(err))
+// updateCache executes next node and stores its response.
+func (c *cachePlugin) updateCache(msgKey string, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+	defer cancel()
+
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	if err != nil {
+		c.L().Warn("failed to update cache", qCtx.InfoField(), zap.Error(err))
+	}
+
+	r := qCtx.R()
+	if r != nil {
+		if err := c.tryStoreMsg(msgKey, r); err != nil {
+			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
 		}
+	}
+}
 
-		r := lazyQCtx.R()
-		if r != nil {
-			if err := c.tryStoreMsg(msgKey, r); err != nil {
-				c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
-			}
+// shouldValidate reports whether the cache hit r stored at storedTime
+// should be validated. Only success responses are validated. Cached
+// error responses would always fail the validation.
+func (c *cachePlugin) shouldValidate(msgKey string, r *dns.Msg, storedTime time.Time) bool {
+	if c.validator == nil || r.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	validateAfter := time.Duration(c.args.ValidateAfter) * time.Second
+	now := time.Now()
+	if now.Sub(storedTime) < validateAfter {
+		return false
+	}
+	if validatedAt, ok := c.validatedAt.Get(msgKey); ok && validatedAt > storedTime.UnixNano() {
+		return now.Sub(time.Unix(0, validatedAt)) >= validateAfter
+	}
+	return true
+}
+
+// doValidate starts a new goroutine to run the validator with cachedResp.
+// If the validation fails, next node will be executed to update the cache.
+// Only one validation of the same msgKey can run at a time. qCtx is only
+// copied if a new validation is started.
+func (c *cachePlugin) doValidate(msgKey string, qCtx *query_context.Context, cachedResp *dns.Msg, next executable_seq.ExecutableChainNode) {
+	if _, running := c.validating.LoadOrStore(msgKey, struct{}{}); running {
+		return
+	}
+	updateQCtx := qCtx.Copy()
+	validateQCtx := qCtx.Copy()
+	validateQCtx.SetResponse(cachedResp.Copy())
+	go func() {
+		defer c.validating.Delete(msgKey)
+		c.validateTotal.Inc()
+		if c.validate(validateQCtx) {
+			c.validatedAt.Add(msgKey, time.Now().UnixNano())
+			return
 		}
-		c.L().Debug("lazy cache updated", lazyQCtx.InfoField())
-		return nil, nil
+
+		c.validateFailedTotal.Inc()
+		c.L().Debug("cache validation failed, updating", updateQCtx.InfoField())
+		c.validatedAt.Del(msgKey)
+		c.updateCache(msgKey, updateQCtx, next)
+	}()
+}
+
+// validate runs the validator and reports whether the response in qCtx
+// passed the validation.
+func (c *cachePlugin) validate(qCtx *query_context.Context) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultValidateTimeout)
+	defer cancel()
+	if err := c.validator.Exec(ctx, qCtx, nil); err != nil {
+		c.L().Warn("cache validator failed", qCtx.InfoField(), zap.Error(err))
+		return false
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+	r := qCtx.R()
+	return r != nil && r.Rcode == dns.RcodeSuccess
 }
 
 // tryStoreMsg tries to store r to cache. If r should be cached.
+// Error responses are stored by tryStoreErrMsg.
 func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
-	if r.Rcode != dns.RcodeSuccess || r.Truncated != false {
+	if isErrRcode(r.Rcode) || r.Truncated != false {
+		return nil
+	}
+	ttl, _, ok := c.msgTTL(r)
+	if !ok || (ttl == 0 && c.args.LazyCacheTTL <= 0) {
 		return nil
 	}
 
@@ -303,15 +709,10 @@ func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 
 	now := time.Now()
 	var expirationTime time.Time
-	if c.args.LazyCacheTTL > 0 {
-		expirationTime = now.Add(time.Duration(c.args.LazyCacheTTL) * time.Second)
-	} else {
-		minTTL := dnsutils.GetMinimalTTL(r)
-		if minTTL == 0 {
-			return nil
-		}
-		expirationTime = now.Add(time.Duration(minTTL) * time.Second)
+	if lazyTTL := time.Duration(c.args.LazyCacheTTL) * time.Second; lazyTTL > ttl {
+		ttl = lazyTTL
 	}
+	expirationTime = now.Add(ttl)
 	if c.args.CompressResp {
 		compressBuf := pool.GetBuf(snappy.MaxEncodedLen(len(v)))
 		v = snappy.Encode(compressBuf.Bytes(), v)
@@ -321,6 +722,78 @@ func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 	return nil
 }
 
-func (c *cachePlugin) Shutdown() error {
+// tryStoreErrMsg stores r to cache for errTTL if r is an error response
+// and error caching is enabled.
+func (c *cachePlugin) tryStoreErrMsg(key string, r *dns.Msg) error {
+	if !isErrRcode(r.Rcode) {
+		return nil
+	}
+	errTTL := c.errTTL(r.Rcode)
+	if errTTL <= 0 {
+		return nil
+	}
+
+	v, err := r.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack response msg, %w", err)
+	}
+	now := time.Now()
+	expirationTime := now.Add(errTTL)
+	if c.args.CompressResp {
+		compressBuf := pool.GetBuf(snappy.MaxEncodedLen(len(v)))
+		v = snappy.Encode(compressBuf.Bytes(), v)
+		defer compressBuf.Release()
+	}
+	c.backend.Store(key, v, now, expirationTime)
+	return nil
+}
+
+// msgTTL returns the cache ttl of a non-error response r. setTTL reports
+// whether the ttl is not the minimal record ttl of r, so records of a
+// cached r should be set to the remaining ttl instead of being decreased.
+// ok is false if r should not be cached.
+// Negative responses (NXDOMAIN and NODATA) are cached for the negative
+// ttl in their SOA record (RFC 2308). Those without a SOA are not cached.
+func (c *cachePlugin) msgTTL(r *dns.Msg) (ttl time.Duration, setTTL, ok bool) {
+	if ttl, ok := c.rcodeTTL[r.Rcode]; ok {
+		return ttl, true, true
+	}
+	switch {
+	case r.Rcode == dns.RcodeNameError || (r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0):
+		negTTL, ok := dnsutils.GetNegativeTTL(r)
+		if !ok {
+			return 0, false, false
+		}
+		ttl = time.Duration(negTTL) * time.Second
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+		return ttl, true, true
+	case r.Rcode == dns.RcodeSuccess:
+		return time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second, false, true
+	default:
+		return 0, false, false
+	}
+}
+
+// errTTL returns the cache ttl of error responses with rcode.
+// Zero means error responses should not be cached.
+func (c *cachePlugin) errTTL(rcode int) time.Duration {
+	if ttl, ok := c.rcodeTTL[rcode]; ok {
+		return ttl
+	}
+	return time.Duration(c.args.ErrorCacheTTL) * time.Second
+}
+
+func isErrRcode(rcode int) bool {
+	return rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused
+}
+
+// Close saves the cache dump, if enabled, and closes the cache backend.
+func (c *cachePlugin) Close() error {
+	close(c.closeNotify)
+	if len(c.args.DumpFile) > 0 {
+		c.saveDumpAndLog()
+	}
 	return c.backend.Close()
 }
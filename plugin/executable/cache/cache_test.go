@@ -0,0 +1,500 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/go-redis/redis/v8"
+	"github.com/miekg/dns"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNext replies with rcode, or returns err if err is not nil.
+// Negative responses include soa if it is not nil.
+type testNext struct {
+	rcode int
+	soa   *dns.SOA
+	err   error
+	calls int32
+}
+
+func (n *testNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	atomic.AddInt32(&n.calls, 1)
+	if n.err != nil {
+		return n.err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), n.rcode)
+	if n.rcode == dns.RcodeSuccess {
+		q := qCtx.Q().Question[0]
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	} else if n.soa != nil {
+		r.Ns = append(r.Ns, dns.Copy(n.soa))
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (n *testNext) getCalls() int {
+	return int(atomic.LoadInt32(&n.calls))
+}
+
+func newTestCache(t *testing.T, args *Args, plugins map[string]coremain.Plugin) *cachePlugin {
+	t.Helper()
+	m := coremain.NewTestMosdnsWithPlugins(plugins)
+	c, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, m), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func execCache(t *testing.T, c *cachePlugin, next executable_seq.Executable) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next))
+	return qCtx.R()
+}
+
+func Test_cachePlugin_errorCache(t *testing.T) {
+	t.Run("cached within ttl", func(t *testing.T) {
+		c := newTestCache(t, &Args{ErrorCacheTTL: 1}, nil)
+		next := &testNext{rcode: dns.RcodeServerFailure}
+		for i := 0; i < 3; i++ {
+			if r := execCache(t, c, next); r == nil || r.Rcode != dns.RcodeServerFailure {
+				t.Fatalf("want SERVFAIL, got %v", r)
+			}
+		}
+		if next.getCalls() != 1 {
+			t.Fatalf("want 1 call within error_cache_ttl, got %d", next.getCalls())
+		}
+		time.Sleep(time.Millisecond * 1100)
+		execCache(t, c, next)
+		if next.getCalls() != 2 {
+			t.Fatalf("want 2 calls after error_cache_ttl, got %d", next.getCalls())
+		}
+	})
+
+	t.Run("failed query is cached as SERVFAIL", func(t *testing.T) {
+		c := newTestCache(t, &Args{ErrorCacheTTL: 60}, nil)
+		next := &testNext{err: errors.New("upstream failed")}
+		execCache(t, c, next)
+		if r := execCache(t, c, next); r == nil || r.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("want cached SERVFAIL, got %v", r)
+		}
+		if next.getCalls() != 1 {
+			t.Fatalf("want 1 call, got %d", next.getCalls())
+		}
+	})
+
+	t.Run("ignored after flush", func(t *testing.T) {
+		c := newTestCache(t, &Args{ErrorCacheTTL: 60}, nil)
+		next := &testNext{rcode: dns.RcodeRefused}
+		execCache(t, c, next)
+		c.Flush()
+		execCache(t, c, next)
+		if next.getCalls() != 2 {
+			t.Fatalf("want 2 calls, got %d", next.getCalls())
+		}
+	})
+
+	t.Run("ignored after mark stale", func(t *testing.T) {
+		c := newTestCache(t, &Args{ErrorCacheTTL: 60, LazyCacheTTL: 600}, nil)
+		next := &testNext{rcode: dns.RcodeServerFailure}
+		execCache(t, c, next)
+		c.MarkStale()
+		execCache(t, c, next)
+		if next.getCalls() != 2 {
+			t.Fatalf("want 2 calls, got %d", next.getCalls())
+		}
+	})
+
+	t.Run("disabled by zero ttl", func(t *testing.T) {
+		c := newTestCache(t, &Args{}, nil)
+		next := &testNext{rcode: dns.RcodeServerFailure}
+		for i := 0; i < 3; i++ {
+			execCache(t, c, next)
+		}
+		if next.getCalls() != 3 {
+			t.Fatalf("want 3 calls, got %d", next.getCalls())
+		}
+		next.err = errors.New("upstream failed")
+		execCache(t, c, next)
+		execCache(t, c, next)
+		if next.getCalls() != 5 {
+			t.Fatalf("want 5 calls, got %d", next.getCalls())
+		}
+	})
+}
+
+// testValidator is an executable plugin that passes or fails the
+// validation.
+type testValidator struct {
+	*coremain.BP
+	fail  bool
+	calls int32
+}
+
+func (v *testValidator) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	atomic.AddInt32(&v.calls, 1)
+	if v.fail {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+func (v *testValidator) getCalls() int {
+	return int(atomic.LoadInt32(&v.calls))
+}
+
+func Test_cachePlugin_validate(t *testing.T) {
+	newValidatorCache := func(t *testing.T, v *testValidator, validateAfter int, errorCacheTTL int) *cachePlugin {
+		v.BP = coremain.NewBP("validator", "test", nil, nil)
+		return newTestCache(t, &Args{
+			ValidateExec:  "validator",
+			ValidateAfter: validateAfter,
+			ErrorCacheTTL: errorCacheTTL,
+		}, map[string]coremain.Plugin{"validator": v})
+	}
+	waitValidation := func(t *testing.T, c *cachePlugin) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second * 3)
+		for {
+			n := 0
+			c.validating.Range(func(_, _ interface{}) bool { n++; return true })
+			if n == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("validation timed out")
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		v := new(testValidator)
+		c := newValidatorCache(t, v, 0, 0)
+		next := &testNext{rcode: dns.RcodeSuccess}
+		execCache(t, c, next)
+		if r := execCache(t, c, next); r == nil || len(r.Answer) != 1 {
+			t.Fatalf("want the cached response, got %v", r)
+		}
+		waitValidation(t, c)
+		if v.getCalls() != 1 || next.getCalls() != 1 {
+			t.Fatalf("want 1 validation and no re-resolution, got %d, %d", v.getCalls(), next.getCalls()-1)
+		}
+	})
+
+	t.Run("fail then re-resolve", func(t *testing.T) {
+		v := &testValidator{fail: true}
+		c := newValidatorCache(t, v, 0, 0)
+		next := &testNext{rcode: dns.RcodeSuccess}
+		execCache(t, c, next)
+		if r := execCache(t, c, next); r == nil || len(r.Answer) != 1 {
+			t.Fatalf("want the cached response, got %v", r)
+		}
+		waitValidation(t, c)
+		if v.getCalls() != 1 || next.getCalls() != 2 {
+			t.Fatalf("want 1 validation and 1 re-resolution, got %d, %d", v.getCalls(), next.getCalls()-1)
+		}
+	})
+
+	t.Run("suppressed within validate_after", func(t *testing.T) {
+		v := new(testValidator)
+		c := newValidatorCache(t, v, 1, 0)
+		next := &testNext{rcode: dns.RcodeSuccess}
+		execCache(t, c, next)
+		execCache(t, c, next) // too young
+		if v.getCalls() != 0 {
+			t.Fatalf("fresh hits should not be validated, got %d validations", v.getCalls())
+		}
+		time.Sleep(time.Millisecond * 1100)
+		execCache(t, c, next)
+		waitValidation(t, c)
+		execCache(t, c, next) // validated just now
+		waitValidation(t, c)
+		if v.getCalls() != 1 {
+			t.Fatalf("want 1 validation within validate_after, got %d", v.getCalls())
+		}
+	})
+
+	t.Run("error responses are not validated", func(t *testing.T) {
+		v := new(testValidator)
+		c := newValidatorCache(t, v, 0, 60)
+		next := &testNext{rcode: dns.RcodeServerFailure}
+		execCache(t, c, next)
+		if r := execCache(t, c, next); r == nil || r.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("want the cached error response, got %v", r)
+		}
+		waitValidation(t, c)
+		if v.getCalls() != 0 {
+			t.Fatalf("want no validation, got %d", v.getCalls())
+		}
+	})
+}
+
+// testMarkMatcher is a matcher plugin that matches queries with mark.
+type testMarkMatcher struct {
+	*coremain.BP
+	mark uint
+}
+
+func (m *testMarkMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	return qCtx.HasMark(m.mark), nil
+}
+
+func Test_cachePlugin_views(t *testing.T) {
+	matcher := &testMarkMatcher{BP: coremain.NewBP("filtered", "test", nil, nil), mark: 1}
+	c := newTestCache(t, &Args{
+		Views: []ViewArgs{{Namespace: "filtered", Matchers: []string{"filtered"}}},
+	}, map[string]coremain.Plugin{"filtered": matcher})
+
+	exec := func(marked bool, next executable_seq.Executable) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		if marked {
+			qCtx.AddMark(1)
+		}
+		c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next))
+		return qCtx.R()
+	}
+
+	filtered := &testNext{rcode: dns.RcodeNameError}
+	unfiltered := &testNext{rcode: dns.RcodeSuccess}
+	exec(true, filtered)
+	exec(false, unfiltered)
+	if r := exec(false, unfiltered); r == nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("want the unfiltered response, got %v", r)
+	}
+	if unfiltered.getCalls() != 1 {
+		t.Fatalf("want 1 unfiltered call, got %d", unfiltered.getCalls())
+	}
+
+	// NXDOMAIN without a SOA is not cached, but the NOERROR response of the default
+	// namespace must not be served to the filtered view.
+	if r := exec(true, filtered); r == nil || r.Rcode != dns.RcodeNameError {
+		t.Fatalf("want the filtered response, got %v", r)
+	}
+	if filtered.getCalls() != 2 {
+		t.Fatalf("want 2 filtered calls, got %d", filtered.getCalls())
+	}
+}
+
+func Test_newCacheViews(t *testing.T) {
+	matcher := &testMarkMatcher{BP: coremain.NewBP("m", "test", nil, nil)}
+	m := coremain.NewTestMosdnsWithPlugins(map[string]coremain.Plugin{"m": matcher})
+	bp := coremain.NewBP("cache", PluginType, nil, m)
+	tests := []struct {
+		name string
+		args *Args
+	}{
+		{"no namespace", &Args{Views: []ViewArgs{{Matchers: []string{"m"}}}}},
+		{"dup namespace", &Args{Namespace: "a", Views: []ViewArgs{{Namespace: "a", Matchers: []string{"m"}}}}},
+		{"no matcher", &Args{Views: []ViewArgs{{Namespace: "a"}}}},
+		{"unknown matcher", &Args{Views: []ViewArgs{{Namespace: "a", Matchers: []string{"x"}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newCacheViews(bp, tt.args); err == nil {
+				t.Fatal("want an error")
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_rcodeTTL(t *testing.T) {
+	c := newTestCache(t, &Args{RcodeTTL: map[string]int{"NXDOMAIN": 60, "2": 60}}, nil)
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeServerFailure} {
+		c.Flush()
+		next := &testNext{rcode: rcode}
+		for i := 0; i < 3; i++ {
+			if r := execCache(t, c, next); r == nil || r.Rcode != rcode {
+				t.Fatalf("want rcode %d, got %v", rcode, r)
+			}
+		}
+		if next.getCalls() != 1 {
+			t.Fatalf("want 1 call for rcode %d, got %d", rcode, next.getCalls())
+		}
+	}
+
+	if _, err := parseRcodeTTL(map[string]int{"BADRCODE": 1}); err == nil {
+		t.Fatal("want an error for invalid rcode")
+	}
+	if _, err := parseRcodeTTL(map[string]int{"NXDOMAIN": 0}); err == nil {
+		t.Fatal("want an error for invalid ttl")
+	}
+}
+
+func Test_cachePlugin_negativeCache(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+		Ns:     "ns.com.",
+		Mbox:   "hostmaster.com.",
+		Minttl: 1,
+	}
+	c := newTestCache(t, &Args{}, nil)
+	next := &testNext{rcode: dns.RcodeNameError, soa: soa}
+	for i := 0; i < 3; i++ {
+		if r := execCache(t, c, next); r == nil || r.Rcode != dns.RcodeNameError {
+			t.Fatalf("want NXDOMAIN, got %v", r)
+		}
+	}
+	if next.getCalls() != 1 {
+		t.Fatalf("want 1 call within the negative ttl, got %d", next.getCalls())
+	}
+
+	// The negative ttl is the SOA MINIMUM, which is less than the SOA ttl.
+	time.Sleep(time.Millisecond * 1100)
+	execCache(t, c, next)
+	if next.getCalls() != 2 {
+		t.Fatalf("want 2 calls after the negative ttl, got %d", next.getCalls())
+	}
+
+	noSOA := &testNext{rcode: dns.RcodeNameError}
+	c.Flush()
+	execCache(t, c, noSOA)
+	execCache(t, c, noSOA)
+	if noSOA.getCalls() != 2 {
+		t.Fatalf("negative responses without a SOA should not be cached, got %d calls", noSOA.getCalls())
+	}
+}
+
+func Test_cachePlugin_prefetch(t *testing.T) {
+	c := newTestCache(t, &Args{Prefetch: true}, nil)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	msgKey, err := dnsutils.GetMsgKey(q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(age time.Duration) {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		v, err := r.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		storedTime := time.Now().Add(-age)
+		c.backend.Store(msgKey, v, storedTime, storedTime.Add(time.Second*100))
+	}
+
+	next := &testNext{rcode: dns.RcodeSuccess}
+	store(time.Second * 50)
+	if r := execCache(t, c, next); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want a cache hit, got %v", r)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if next.getCalls() != 0 {
+		t.Fatal("response that is not about to expire should not be prefetched")
+	}
+
+	store(time.Second * 95)
+	if r := execCache(t, c, next); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want a cache hit, got %v", r)
+	}
+	deadline := time.Now().Add(time.Second)
+	for next.getCalls() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("response is not prefetched")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func Test_newRedisClient(t *testing.T) {
+	c, err := newRedisClient(&Args{RedisCluster: []string{"redis://:pw@10.0.0.1:6379", "redis://10.0.0.2:6379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, ok := c.(*redis.ClusterClient)
+	if !ok {
+		t.Fatalf("want a cluster client, got %T", c)
+	}
+	if opt := cc.Options(); len(opt.Addrs) != 2 || opt.Password != "pw" {
+		t.Fatalf("unexpected cluster options, addrs %v, password %s", opt.Addrs, opt.Password)
+	}
+
+	if _, err := newRedisClient(&Args{Redis: "redis://10.0.0.1:6379", RedisCluster: []string{"redis://10.0.0.2:6379"}}); err == nil {
+		t.Fatal("want an error for redis and redis_cluster")
+	}
+}
+
+func Test_cachePlugin_dump(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	next := &testNext{rcode: dns.RcodeSuccess}
+
+	c := newTestCache(t, &Args{DumpFile: dumpFile, CompressResp: true}, nil)
+	execCache(t, c, next)
+	c.memCache.Store("expired", []byte{1}, time.Now(), time.Now().Add(time.Millisecond*10))
+	time.Sleep(time.Millisecond * 20)
+	n, err := c.saveDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("want 1 dumped entry, got %d", n)
+	}
+
+	// Reloaded by a new cache plugin.
+	c2 := newTestCache(t, &Args{DumpFile: dumpFile, CompressResp: true}, nil)
+	if c2.memCache.Len() != 1 {
+		t.Fatalf("want 1 loaded entry, got %d", c2.memCache.Len())
+	}
+	if r := execCache(t, c2, next); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want a cache hit, got %v", r)
+	}
+	if next.getCalls() != 1 {
+		t.Fatalf("want 1 call, got %d", next.getCalls())
+	}
+
+	// The dump is ignored if compress_resp was changed.
+	c3, err := newCachePlugin(coremain.NewBP("cache3", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil)), &Args{DumpFile: dumpFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	if c3.memCache.Len() != 0 {
+		t.Fatalf("want 0 loaded entry, got %d", c3.memCache.Len())
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/state_file"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDumpInterval = time.Minute * 10
+
+	dumpFlagCompressed = 1 << 0
+)
+
+// Payload layout:
+// | flags (1) | entry... |
+// entry: | key len (uvarint) | key | stored time (8) | expiration time (8) | value len (uvarint) | value |
+// Times are unix nano timestamps.
+var dumpFormat = &state_file.Format{Name: "cache", Version: 1}
+
+// dumpLoop saves the in-memory cache every Args.DumpInterval until
+// closeNotify is closed.
+func (c *cachePlugin) dumpLoop() {
+	interval := time.Duration(c.args.DumpInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultDumpInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.saveDumpAndLog()
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
+
+func (c *cachePlugin) saveDumpAndLog() {
+	start := time.Now()
+	n, err := c.saveDump()
+	if err != nil {
+		c.L().Error("failed to save cache dump", zap.String("file", c.args.DumpFile), zap.Error(err))
+		return
+	}
+	c.L().Info("cache dumped", zap.Int("entries", n), zap.Duration("elapsed", time.Since(start)))
+}
+
+// saveDump saves unexpired values of the in-memory cache to Args.DumpFile.
+func (c *cachePlugin) saveDump() (int, error) {
+	buf := new(bytes.Buffer)
+	var flags byte
+	if c.args.CompressResp {
+		flags |= dumpFlagCompressed
+	}
+	buf.WriteByte(flags)
+
+	n := 0
+	flushedAt := atomic.LoadInt64(&c.flushedAt)
+	b := make([]byte, binary.MaxVarintLen64)
+	c.memCache.Range(func(key string, v []byte, storedTime, expirationTime time.Time) {
+		if storedTime.UnixNano() < flushedAt {
+			return
+		}
+		if _, q, ok := parseMsgKey(key); ok && c.isPurged(q.Name, storedTime) {
+			return
+		}
+		buf.Write(b[:binary.PutUvarint(b, uint64(len(key)))])
+		buf.WriteString(key)
+		binary.Write(buf, binary.BigEndian, storedTime.UnixNano())
+		binary.Write(buf, binary.BigEndian, expirationTime.UnixNano())
+		buf.Write(b[:binary.PutUvarint(b, uint64(len(v)))])
+		buf.Write(v)
+		n++
+	})
+	return n, dumpFormat.WriteFile(c.args.DumpFile, buf.Bytes())
+}
+
+// loadDump loads values from Args.DumpFile to the in-memory cache.
+// Values that expired since they were dumped are skipped. Their ttls are
+// adjusted by the time elapsed since they were stored, like other values.
+// It is a noop if the file does not exist.
+func (c *cachePlugin) loadDump() (int, error) {
+	payload, err := dumpFormat.ReadFile(c.args.DumpFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	r := bytes.NewReader(payload)
+	flags, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if compressed := flags&dumpFlagCompressed != 0; compressed != c.args.CompressResp {
+		return 0, errors.New("compress_resp was changed, dump is ignored")
+	}
+
+	n := 0
+	for r.Len() > 0 {
+		key, err := readDumpBytes(r)
+		if err != nil {
+			return n, err
+		}
+		var storedTime, expirationTime int64
+		if err := binary.Read(r, binary.BigEndian, &storedTime); err != nil {
+			return n, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &expirationTime); err != nil {
+			return n, err
+		}
+		v, err := readDumpBytes(r)
+		if err != nil {
+			return n, err
+		}
+		c.memCache.Store(string(key), v, time.Unix(0, storedTime), time.Unix(0, expirationTime))
+		n++
+	}
+	return n, nil
+}
+
+func readDumpBytes(r *bytes.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(r.Len()) {
+		return nil, fmt.Errorf("invalid length %d, %w", l, io.ErrUnexpectedEOF)
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
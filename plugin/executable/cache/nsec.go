@@ -0,0 +1,337 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nsecMaxZones         = 1024
+	nsecMaxRangesPerZone = 4096
+)
+
+// nsecCache keeps NSEC records from DNSSEC validated NXDOMAIN responses,
+// and synthesizes NXDOMAIN responses for names that they prove to be
+// nonexistent (aggressive use of DNSSEC-validated cache, RFC 8198).
+// NSEC3 records are ignored.
+type nsecCache struct {
+	mu    sync.Mutex
+	zones map[string]*nsecZone // namespace + "\x00" + zone apex
+}
+
+type nsecZone struct {
+	zone      string
+	soa       []dns.RR // SOA and its RRSIGs.
+	soaExpire time.Time
+	ranges    []*nsecRange // sorted by owner in canonical order.
+}
+
+type nsecRange struct {
+	owner, next string // lower case
+	nsec        *dns.NSEC
+	rrs         []dns.RR // NSEC and its RRSIGs.
+	expire      time.Time
+}
+
+func newNSECCache() *nsecCache {
+	return &nsecCache{zones: make(map[string]*nsecZone)}
+}
+
+// add stores the NSEC records of r, if r is a validated NXDOMAIN response.
+func (c *nsecCache) add(ns string, r *dns.Msg, now time.Time) {
+	if r.Rcode != dns.RcodeNameError || !r.AuthenticatedData {
+		return
+	}
+	var soa *dns.SOA
+	for _, rr := range r.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+	negTTL, _ := dnsutils.GetNegativeTTL(r)
+	ttl := time.Duration(negTTL) * time.Second
+	if ttl > maxNegativeTTL {
+		ttl = maxNegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	zone := strings.ToLower(dns.CanonicalName(soa.Hdr.Name))
+	soaRRs := []dns.RR{dns.Copy(soa)}
+	soaRRs = append(soaRRs, rrsigsOf(r.Ns, soa.Hdr.Name, dns.TypeSOA)...)
+
+	var ranges []*nsecRange
+	for _, rr := range r.Ns {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok {
+			continue
+		}
+		nsec = dns.Copy(nsec).(*dns.NSEC)
+		owner := strings.ToLower(dns.CanonicalName(nsec.Hdr.Name))
+		next := strings.ToLower(dns.CanonicalName(nsec.NextDomain))
+		if !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(zone, next) {
+			continue
+		}
+		sigs := rrsigsOf(r.Ns, nsec.Hdr.Name, dns.TypeNSEC)
+		if len(sigs) == 0 {
+			continue
+		}
+		rangeTTL := time.Duration(nsec.Hdr.Ttl) * time.Second
+		if rangeTTL > ttl {
+			rangeTTL = ttl
+		}
+		ranges = append(ranges, &nsecRange{
+			owner:  owner,
+			next:   next,
+			nsec:   nsec,
+			rrs:    append([]dns.RR{nsec}, sigs...),
+			expire: now.Add(rangeTTL),
+		})
+	}
+	if len(ranges) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := ns + "\x00" + zone
+	z := c.zones[key]
+	if z == nil {
+		if len(c.zones) >= nsecMaxZones {
+			c.purgeExpiredZones(now)
+			if len(c.zones) >= nsecMaxZones {
+				return
+			}
+		}
+		z = &nsecZone{zone: zone}
+		c.zones[key] = z
+	}
+	z.soa = soaRRs
+	z.soaExpire = now.Add(ttl)
+	for _, nr := range ranges {
+		z.insert(nr, now)
+	}
+}
+
+// flush drops all cached NSEC records.
+func (c *nsecCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zones = make(map[string]*nsecZone)
+}
+
+func (c *nsecCache) purgeExpiredZones(now time.Time) {
+	for key, z := range c.zones {
+		if !z.soaExpire.After(now) {
+			delete(c.zones, key)
+		}
+	}
+}
+
+func (z *nsecZone) insert(nr *nsecRange, now time.Time) {
+	i := sort.Search(len(z.ranges), func(i int) bool {
+		return canonicalCompare(z.ranges[i].owner, nr.owner) >= 0
+	})
+	if i < len(z.ranges) && z.ranges[i].owner == nr.owner {
+		z.ranges[i] = nr
+		return
+	}
+	if len(z.ranges) >= nsecMaxRangesPerZone {
+		z.purgeExpired(now)
+		if len(z.ranges) >= nsecMaxRangesPerZone {
+			return
+		}
+		i = sort.Search(len(z.ranges), func(i int) bool {
+			return canonicalCompare(z.ranges[i].owner, nr.owner) >= 0
+		})
+	}
+	z.ranges = append(z.ranges, nil)
+	copy(z.ranges[i+1:], z.ranges[i:])
+	z.ranges[i] = nr
+}
+
+func (z *nsecZone) purgeExpired(now time.Time) {
+	n := 0
+	for _, nr := range z.ranges {
+		if nr.expire.After(now) {
+			z.ranges[n] = nr
+			n++
+		}
+	}
+	for i := n; i < len(z.ranges); i++ {
+		z.ranges[i] = nil
+	}
+	z.ranges = z.ranges[:n]
+}
+
+// covering returns the unexpired range that proves name does not exist.
+func (z *nsecZone) covering(name string, now time.Time) *nsecRange {
+	i := sort.Search(len(z.ranges), func(i int) bool {
+		return canonicalCompare(z.ranges[i].owner, name) >= 0
+	})
+	if i < len(z.ranges) && z.ranges[i].owner == name {
+		return nil // name exists
+	}
+	if i == 0 {
+		return nil
+	}
+	nr := z.ranges[i-1]
+	if !nr.expire.After(now) {
+		return nil
+	}
+	// The last NSEC of the zone points back to the apex.
+	if nr.next != z.zone && canonicalCompare(name, nr.next) >= 0 {
+		return nil
+	}
+	// Names below a delegation point or a DNAME are not in this zone.
+	if dns.IsSubDomain(nr.owner, name) {
+		for _, t := range nr.nsec.TypeBitMap {
+			if t == dns.TypeDNAME || (t == dns.TypeNS && nr.owner != z.zone) {
+				return nil
+			}
+		}
+	}
+	return nr
+}
+
+// synthesize returns a NXDOMAIN response for q if the cached NSEC records
+// prove that neither the query name nor the wildcard at its closest
+// encloser exists. Otherwise, it returns nil.
+func (c *nsecCache) synthesize(ns string, q *dns.Msg, now time.Time) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	qname := strings.ToLower(dns.CanonicalName(q.Question[0].Name))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.zones) == 0 {
+		return nil
+	}
+
+	var z *nsecZone
+	for _, off := range append(dns.Split(qname), len(qname)-1) {
+		if z = c.zones[ns+"\x00"+qname[off:]]; z != nil {
+			break
+		}
+	}
+	if z == nil || qname == z.zone || !z.soaExpire.After(now) {
+		return nil
+	}
+
+	nr := z.covering(qname, now)
+	if nr == nil {
+		return nil
+	}
+	ce := closestEncloser(qname, nr)
+	if !dns.IsSubDomain(z.zone, ce) {
+		ce = z.zone
+	}
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	wr := z.covering(wildcard, now)
+	if wr == nil {
+		return nil
+	}
+
+	expire := z.soaExpire
+	for _, e := range [...]time.Time{nr.expire, wr.expire} {
+		if e.Before(expire) {
+			expire = e
+		}
+	}
+	ttl := uint32(expire.Sub(now) / time.Second)
+	if ttl == 0 {
+		return nil
+	}
+
+	do := false
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeNameError)
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+		r.SetEdns0(opt.UDPSize(), do)
+	}
+	r.AuthenticatedData = do || q.AuthenticatedData
+	for _, rr := range z.soa {
+		r.Ns = append(r.Ns, dns.Copy(rr))
+	}
+	if do {
+		for _, rr := range nr.rrs {
+			r.Ns = append(r.Ns, dns.Copy(rr))
+		}
+		if wr != nr {
+			for _, rr := range wr.rrs {
+				r.Ns = append(r.Ns, dns.Copy(rr))
+			}
+		}
+	}
+	dnsutils.SetTTL(r, ttl)
+	return r
+}
+
+// closestEncloser returns the longest existing ancestor of name that
+// is proved by nr, which covers name.
+func closestEncloser(name string, nr *nsecRange) string {
+	n := dns.CompareDomainName(name, nr.owner)
+	if m := dns.CompareDomainName(name, nr.next); m > n {
+		n = m
+	}
+	if n == 0 {
+		return "."
+	}
+	idx := dns.Split(name)
+	return name[idx[len(idx)-n]:]
+}
+
+func rrsigsOf(rrs []dns.RR, name string, covered uint16) []dns.RR {
+	var sigs []dns.RR
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == covered && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, dns.Copy(sig))
+		}
+	}
+	return sigs
+}
+
+// canonicalCompare compares two lower case domain names in the canonical
+// order of RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
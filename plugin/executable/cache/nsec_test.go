@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func Test_canonicalCompare(t *testing.T) {
+	// RFC 4034 section 6.1
+	ordered := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "z.a.example.",
+		"zabc.a.example.", "z.example.", "*.z.example.", "\\200.z.example.",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		if canonicalCompare(ordered[i], ordered[i+1]) >= 0 {
+			t.Fatalf("want %s < %s", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+// testSignedNXNext replies a validated NXDOMAIN response with NSEC
+// records of a zone example.com. that has only a.example.com. and
+// c.example.com.
+type testSignedNXNext struct {
+	calls int
+}
+
+func (n *testSignedNXNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	n.calls++
+	hdr := func(name string, typ uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: typ, Class: dns.ClassINET, Ttl: 300}
+	}
+	sig := func(name string, covered uint16) *dns.RRSIG {
+		return &dns.RRSIG{Hdr: hdr(name, dns.TypeRRSIG), TypeCovered: covered, SignerName: "example.com."}
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+	r.AuthenticatedData = true
+	r.Ns = []dns.RR{
+		&dns.SOA{Hdr: hdr("example.com.", dns.TypeSOA), Ns: "ns.example.com.", Mbox: "h.example.com.", Minttl: 60},
+		sig("example.com.", dns.TypeSOA),
+		&dns.NSEC{Hdr: hdr("example.com.", dns.TypeNSEC), NextDomain: "a.example.com.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA}},
+		sig("example.com.", dns.TypeNSEC),
+		&dns.NSEC{Hdr: hdr("a.example.com.", dns.TypeNSEC), NextDomain: "c.example.com.", TypeBitMap: []uint16{dns.TypeA}},
+		sig("a.example.com.", dns.TypeNSEC),
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_aggressiveNSEC(t *testing.T) {
+	c := newTestCache(t, &Args{AggressiveNSEC: true, CacheEverything: true}, nil)
+	next := &testSignedNXNext{}
+	exec := func(name string, do bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		if do {
+			q.SetEdns0(1232, true)
+		}
+		qCtx := query_context.NewContext(q, nil)
+		c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next))
+		return qCtx.R()
+	}
+
+	exec("b.example.com.", false)
+	for _, name := range []string{"bb.example.com.", "x.a.example.com."} {
+		r := exec(name, true)
+		if r == nil || r.Rcode != dns.RcodeNameError || !r.AuthenticatedData {
+			t.Fatalf("%s: want a validated NXDOMAIN, got %v", name, r)
+		}
+		if len(r.Ns) < 4 {
+			t.Fatalf("%s: want SOA and NSEC records, got %v", name, r.Ns)
+		}
+		if ttl := r.Ns[0].Header().Ttl; ttl == 0 || ttl > 60 {
+			t.Fatalf("%s: want ttl limited by the SOA minimum, got %d", name, ttl)
+		}
+	}
+	if next.calls != 1 {
+		t.Fatalf("want 1 call, got %d", next.calls)
+	}
+
+	// Not covered by cached NSEC records.
+	for _, name := range []string{"d.example.com.", "a.example.com.", "b.example.org."} {
+		exec(name, false)
+	}
+	if next.calls != 4 {
+		t.Fatalf("want 4 calls, got %d", next.calls)
+	}
+
+	c.Flush()
+	exec("bc.example.com.", false)
+	if next.calls != 5 {
+		t.Fatalf("want 5 calls after flush, got %d", next.calls)
+	}
+}
+
+func Test_nsecCache_unsigned(t *testing.T) {
+	c := newNSECCache()
+	q := new(dns.Msg)
+	q.SetQuestion("b.example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	(&testSignedNXNext{}).Exec(context.Background(), qCtx, nil)
+	r := qCtx.R()
+	r.AuthenticatedData = false
+	c.add("", r, time.Now())
+	q.SetQuestion("bb.example.com.", dns.TypeA)
+	if c.synthesize("", q, time.Now()) != nil {
+		t.Fatal("responses without the AD bit should not be used")
+	}
+}
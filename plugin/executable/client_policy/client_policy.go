@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/neighbor"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/time_window"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const PluginType = "client_policy"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*clientPolicy)(nil)
+
+// Args of the client_policy plugin. Groups are checked in order, the exec
+// of the first matched group is executed. Then the query is passed to the
+// next node, like a sequence.
+type Args struct {
+	Groups []GroupArgs `yaml:"groups"`
+
+	// Default is executed if no group matches. Optional.
+	Default interface{} `yaml:"default"`
+
+	// NeighborRefresh (sec) is the refresh interval of the system neighbor
+	// table that maps client ips to mac addresses. Default is 60.
+	NeighborRefresh int `yaml:"neighbor_refresh"`
+}
+
+// GroupArgs is a group of clients. A client is in the group if it matches
+// ClientIP or MAC. If both are empty, all clients are in the group.
+type GroupArgs struct {
+	Name string `yaml:"name"`
+
+	ClientIP []string `yaml:"client_ip"`
+
+	// MAC addresses of clients. They are looked up from the system
+	// neighbor table, so clients must be on the same link. Linux only.
+	MAC []string `yaml:"mac"`
+
+	// Time windows in local time, e.g. "mon-fri 20:00-07:00". If set,
+	// the group only matches during the windows.
+	Time []string `yaml:"time"`
+
+	Exec interface{} `yaml:"exec"`
+}
+
+type clientPolicy struct {
+	*coremain.BP
+	groups      []*group
+	defaultExec executable_seq.ExecutableChainNode
+	neighbors   *neighbor.Table
+
+	now func() time.Time
+}
+
+type group struct {
+	name    string
+	ip      *netlist.MatcherGroup
+	mac     map[string]struct{}
+	windows []*time_window.Window
+	exec    executable_seq.ExecutableChainNode
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newClientPolicy(bp, args.(*Args))
+}
+
+func newClientPolicy(bp *coremain.BP, args *Args) (_ *clientPolicy, err error) {
+	p := &clientPolicy{BP: bp, now: time.Now}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+	if len(args.Groups) == 0 {
+		return nil, errors.New("no group is configured")
+	}
+
+	buildExec := func(exec interface{}) (executable_seq.ExecutableChainNode, error) {
+		return executable_seq.BuildExecutableLogicTree(exec, bp.L(), bp.M().GetExecutables(), bp.M().GetMatchers())
+	}
+	for i, ga := range args.Groups {
+		g := &group{name: ga.Name}
+		if len(g.name) == 0 {
+			g.name = fmt.Sprintf("#%d", i)
+		}
+		p.groups = append(p.groups, g)
+
+		if len(ga.ClientIP) > 0 {
+			l, err := netlist.BatchLoadProvider(ga.ClientIP, bp.M().GetDataManager())
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", g.name, err)
+			}
+			g.ip = l
+		}
+		if len(ga.MAC) > 0 {
+			if !neighbor.Supported() {
+				return nil, fmt.Errorf("group %s: %w", g.name, neighbor.ErrNotSupported)
+			}
+			g.mac = make(map[string]struct{})
+			for _, s := range ga.MAC {
+				hw, err := net.ParseMAC(s)
+				if err != nil {
+					return nil, fmt.Errorf("group %s: %w", g.name, err)
+				}
+				g.mac[hw.String()] = struct{}{}
+			}
+			if p.neighbors == nil {
+				p.neighbors = neighbor.NewTable(time.Duration(args.NeighborRefresh) * time.Second)
+			}
+		}
+		for _, s := range ga.Time {
+			w, err := time_window.Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", g.name, err)
+			}
+			g.windows = append(g.windows, w)
+		}
+		if g.exec, err = buildExec(ga.Exec); err != nil {
+			return nil, fmt.Errorf("group %s: cannot build exec: %w", g.name, err)
+		}
+	}
+	if args.Default != nil {
+		if p.defaultExec, err = buildExec(args.Default); err != nil {
+			return nil, fmt.Errorf("cannot build default exec: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *clientPolicy) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	exec := p.defaultExec
+	if g := p.match(qCtx.ReqMeta().ClientAddr); g != nil {
+		p.L().Debug("client policy matched", qCtx.InfoField(), zap.String("group", g.name))
+		exec = g.exec
+	}
+	if err := executable_seq.ExecChainNode(ctx, qCtx, exec); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// match returns the first group that matches the client, or nil.
+func (p *clientPolicy) match(client netip.Addr) *group {
+	now := p.now()
+	var hw string
+	hwLoaded := false
+	for _, g := range p.groups {
+		if !g.inWindows(now) {
+			continue
+		}
+		if g.ip == nil && g.mac == nil {
+			return g
+		}
+		if !client.IsValid() {
+			continue
+		}
+		if g.ip != nil {
+			if ok, _ := g.ip.Match(client); ok {
+				return g
+			}
+		}
+		if g.mac != nil {
+			if !hwLoaded {
+				hwLoaded = true
+				addr, err := p.neighbors.Lookup(client)
+				if err != nil {
+					p.L().Warn("failed to lookup client mac address", zap.Error(err))
+				} else if addr != nil {
+					hw = addr.String()
+				}
+			}
+			if _, ok := g.mac[hw]; ok && len(hw) > 0 {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+func (g *group) inWindows(t time.Time) bool {
+	if len(g.windows) == 0 {
+		return true
+	}
+	for _, w := range g.windows {
+		if w.Match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *clientPolicy) Close() error {
+	for _, g := range p.groups {
+		if g.ip != nil {
+			g.ip.Close()
+		}
+	}
+	return nil
+}
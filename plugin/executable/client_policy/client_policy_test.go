@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_policy
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// tagExec records its tag in the response.
+type tagExec struct {
+	*coremain.BP
+}
+
+func (e *tagExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: qCtx.Q().Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{e.Tag()},
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_clientPolicy(t *testing.T) {
+	plugins := make(map[string]coremain.Plugin)
+	for _, tag := range []string{"kids", "night", "default"} {
+		plugins[tag] = &tagExec{BP: coremain.NewBP(tag, "test", nil, nil)}
+	}
+	m := coremain.NewTestMosdnsWithPlugins(plugins)
+	p, err := newClientPolicy(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Groups: []GroupArgs{
+			{Name: "kids", ClientIP: []string{"192.168.1.10", "192.168.2.0/24"}, Time: []string{"mon-fri 20:00-07:00"}, Exec: "kids"},
+			{Name: "night", Time: []string{"23:00-06:00"}, Exec: "night"},
+		},
+		Default: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// 2022-11-07 is a Monday.
+	monday := func(hour int) time.Time { return time.Date(2022, 11, 7, hour, 0, 0, 0, time.Local) }
+	tests := []struct {
+		client string
+		now    time.Time
+		want   string
+	}{
+		{"192.168.1.10", monday(21), "kids"},
+		{"192.168.2.3", monday(21), "kids"},
+		{"192.168.1.10", monday(12), "default"},
+		{"192.168.1.11", monday(21), "default"},
+		{"192.168.1.11", monday(23), "night"},
+		{"192.168.1.10", monday(23), "kids"},
+		{"", monday(12), "default"},
+	}
+	for _, tt := range tests {
+		p.now = func() time.Time { return tt.now }
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		meta := new(query_context.RequestMeta)
+		if len(tt.client) > 0 {
+			meta.ClientAddr = netip.MustParseAddr(tt.client)
+		}
+		qCtx := query_context.NewContext(q, meta)
+		if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if r == nil || len(r.Answer) != 1 {
+			t.Fatalf("%s at %s: unexpected response %v", tt.client, tt.now, r)
+		}
+		if got := r.Answer[0].(*dns.TXT).Txt[0]; got != tt.want {
+			t.Errorf("%s at %s: want group %s, got %s", tt.client, tt.now, tt.want, got)
+		}
+	}
+
+	if _, err := newClientPolicy(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Groups: []GroupArgs{{Time: []string{"25:00-26:00"}, Exec: "kids"}},
+	}); err == nil {
+		t.Fatal("invalid time window should be rejected")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"time"
+)
+
+const PluginType = "dedup"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultTimeout = time.Second * 5
+)
+
+var _ coremain.ExecutablePlugin = (*dedup)(nil)
+
+type Args struct {
+	// Timeout (sec) of the shared execution of next. Default is 5.
+	// It is not bound to any query, so a query that is canceled won't
+	// fail other queries that are waiting for the same response.
+	Timeout int `yaml:"timeout"`
+}
+
+// dedup coalesces identical concurrent queries into one execution of
+// the rest of the sequence, and sends its response to all of them.
+// Queries are identical if their wire formats are identical except the
+// id, which means they have the same name, type, class, flags and edns0
+// options (e.g. ECS).
+type dedup struct {
+	*coremain.BP
+	timeout time.Duration
+	sf      singleflight.Group
+
+	dedupTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newDedup(bp, args.(*Args)), nil
+}
+
+func newDedup(bp *coremain.BP, args *Args) *dedup {
+	d := &dedup{
+		BP:      bp,
+		timeout: time.Duration(args.Timeout) * time.Second,
+		dedupTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dedup_total",
+			Help: "The total number of queries whose response was shared with identical queries",
+		}),
+	}
+	if d.timeout <= 0 {
+		d.timeout = defaultTimeout
+	}
+	bp.GetMetricsReg().MustRegister(d.dedupTotal)
+	return d
+}
+
+// sharedResult is the result of the shared execution. r must not be
+// modified.
+type sharedResult struct {
+	r *dns.Msg
+}
+
+func (d *dedup) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	key, err := dnsutils.GetMsgKey(q, 0)
+	if err != nil {
+		return fmt.Errorf("failed to pack query, %w", err)
+	}
+
+	sharedQCtx := qCtx.Copy()
+	resChan := d.sf.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		err := executable_seq.ExecChainNode(ctx, sharedQCtx, next)
+		return sharedResult{r: sharedQCtx.R()}, err
+	})
+
+	select {
+	case res := <-resChan:
+		if res.Shared {
+			d.dedupTotal.Inc()
+			d.L().Debug("query deduplicated", qCtx.InfoField())
+		}
+		if res.Err != nil {
+			return res.Err
+		}
+		if r := res.Val.(sharedResult).r; r != nil {
+			r = r.Copy()
+			r.Id = q.Id
+			qCtx.SetResponse(r)
+		}
+		return nil
+	case <-ctx.Done():
+		d.L().Debug("query canceled while waiting for the shared response", qCtx.InfoField(), zap.Error(ctx.Err()))
+		return ctx.Err()
+	}
+}
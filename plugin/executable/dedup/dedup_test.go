@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dedup
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowNext replies after a delay and counts its calls.
+type slowNext struct {
+	calls int32
+}
+
+func (n *slowNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	atomic.AddInt32(&n.calls, 1)
+	time.Sleep(time.Millisecond * 100)
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_dedup_Exec(t *testing.T) {
+	d := newDedup(coremain.NewBP("dedup", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil)), &Args{})
+	sn := &slowNext{}
+	next := executable_seq.WrapExecutable(sn)
+	exec := func(name string, id uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.Id = id
+		qCtx := query_context.NewContext(q, nil)
+		if err := d.Exec(context.Background(), qCtx, next); err != nil {
+			t.Error(err)
+		}
+		return qCtx.R()
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		i := i
+		name := "a.example."
+		if i%2 == 1 {
+			name = "b.example."
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := exec(name, uint16(i))
+			if r == nil || r.Id != uint16(i) || r.Question[0].Name != name {
+				t.Errorf("invalid response %v", r)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt32(&sn.calls); calls != 2 {
+		t.Fatalf("want 2 calls, got %d", calls)
+	}
+}
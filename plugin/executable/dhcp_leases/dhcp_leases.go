@@ -0,0 +1,350 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PluginType = "dhcp_leases"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultTTL          = 60
+	defaultPollInterval = time.Second * 30
+	keaSocketTimeout    = time.Second * 5
+	maxKeaResponseSize  = 64 * 1024 * 1024
+)
+
+const (
+	formatDnsmasq    = "dnsmasq"
+	formatKea        = "kea"
+	formatKea4Socket = "kea4_socket"
+	formatKea6Socket = "kea6_socket"
+)
+
+var _ coremain.ExecutablePlugin = (*dhcpLeases)(nil)
+
+type Args struct {
+	// Domain is the local domain, e.g. "lan". A client with the host name
+	// "pc" can be queried as "pc.lan".
+	Domain string      `yaml:"domain"` // required
+	Leases []LeaseArgs `yaml:"leases"` // required
+
+	TTL int `yaml:"ttl"` // Default is 60.
+
+	// PollInterval (sec) of kea control sockets. Default is 30.
+	PollInterval int `yaml:"poll_interval"`
+}
+
+type LeaseArgs struct {
+	// Format can be:
+	// "dnsmasq": a dnsmasq lease file.
+	// "kea": a lease file (csv) of the memfile backend of Kea.
+	// "kea4_socket", "kea6_socket": the control socket of kea-dhcp4 or
+	// kea-dhcp6.
+	// Lease files are reloaded when they are changed.
+	Format string `yaml:"format"`
+	Path   string `yaml:"path"`
+}
+
+// dhcpLeases answers A/AAAA queries of DHCP clients' host names under
+// its domain, and PTR queries of their addresses. Other queries, and
+// names under the domain without a lease, are passed to next.
+type dhcpLeases struct {
+	*coremain.BP
+	domain string // lower case fqdn
+	ttl    uint32
+	table  *leaseTable
+
+	closeNotify chan struct{}
+	closers     []func()
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newDHCPLeases(bp, args.(*Args))
+}
+
+func newDHCPLeases(bp *coremain.BP, args *Args) (_ *dhcpLeases, err error) {
+	if len(args.Domain) == 0 {
+		return nil, errors.New("missing domain")
+	}
+	if len(args.Leases) == 0 {
+		return nil, errors.New("missing leases")
+	}
+	p := &dhcpLeases{
+		BP:          bp,
+		domain:      strings.ToLower(dns.Fqdn(args.Domain)),
+		ttl:         uint32(args.TTL),
+		table:       newLeaseTable(len(args.Leases)),
+		closeNotify: make(chan struct{}),
+	}
+	if p.ttl == 0 {
+		p.ttl = defaultTTL
+	}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	pollInterval := time.Duration(args.PollInterval) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	for i, la := range args.Leases {
+		if len(la.Path) == 0 {
+			return nil, fmt.Errorf("lease #%d has no path", i)
+		}
+		switch la.Format {
+		case formatDnsmasq, formatKea:
+			parse := parseDnsmasqLeases
+			if la.Format == formatKea {
+				parse = parseKeaLeases
+			}
+			provider, err := data_provider.NewDataProvider(bp.L(), data_provider.DataProviderConfig{File: la.Path, AutoReload: true})
+			if err != nil {
+				return nil, fmt.Errorf("failed to open lease file %s, %w", la.Path, err)
+			}
+			p.closers = append(p.closers, provider.Close)
+			if err := provider.LoadAndAddListener(&leaseFile{p: p, i: i, parse: parse}); err != nil {
+				return nil, fmt.Errorf("failed to load lease file %s, %w", la.Path, err)
+			}
+		case formatKea4Socket, formatKea6Socket:
+			command := "lease4-get-all"
+			if la.Format == formatKea6Socket {
+				command = "lease6-get-all"
+			}
+			go p.pollKea(i, la.Path, command, pollInterval)
+		default:
+			return nil, fmt.Errorf("invalid lease format %s", la.Format)
+		}
+	}
+	return p, nil
+}
+
+// leaseFile is a data_provider.DataListener of a lease file.
+type leaseFile struct {
+	p     *dhcpLeases
+	i     int
+	parse func(b []byte) ([]lease, error)
+}
+
+func (f *leaseFile) Update(b []byte) error {
+	leases, err := f.parse(b)
+	if err != nil {
+		return err
+	}
+	f.p.table.update(f.i, leases)
+	f.p.L().Info("dhcp leases loaded", zap.Int("leases", len(leases)))
+	return nil
+}
+
+// pollKea loads leases from the kea control socket every interval until
+// the plugin is closed.
+func (p *dhcpLeases) pollKea(i int, socket, command string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		leases, err := queryKea(socket, command)
+		if err != nil {
+			p.L().Warn("failed to query kea leases", zap.String("socket", socket), zap.Error(err))
+		} else {
+			p.table.update(i, leases)
+		}
+		select {
+		case <-ticker.C:
+		case <-p.closeNotify:
+			return
+		}
+	}
+}
+
+// queryKea sends the command to the kea control socket and parses the
+// leases in the response. Kea closes the connection after the response.
+func queryKea(socket, command string) ([]lease, error) {
+	c, err := net.DialTimeout("unix", socket, keaSocketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(keaSocketTimeout))
+	if _, err := fmt.Fprintf(c, `{"command": %q}`, command); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(c, maxKeaResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeaResponse(b)
+}
+
+func (p *dhcpLeases) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.lookupMsg(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// lookupMsg returns the response of q, or nil if q is not answered.
+func (p *dhcpLeases) lookupMsg(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	now := time.Now()
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: p.ttl}
+
+	var answer []dns.RR
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		host, ok := p.hostOf(question.Name)
+		if !ok {
+			return nil
+		}
+		addrs := p.table.lookupHost(host, now)
+		if len(addrs) == 0 {
+			return nil
+		}
+		for _, addr := range addrs {
+			switch {
+			case addr.Is4() && question.Qtype == dns.TypeA:
+				answer = append(answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			case addr.Is6() && question.Qtype == dns.TypeAAAA:
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+	case dns.TypePTR:
+		addr, err := utils.ParsePTRName(strings.ToLower(question.Name))
+		if err != nil {
+			return nil
+		}
+		host, ok := p.table.lookupAddr(addr.Unmap(), now)
+		if !ok {
+			return nil
+		}
+		answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: host + "." + p.domain})
+	default:
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+	r.Answer = answer
+	return r
+}
+
+// hostOf returns the host label of name, if name is a host under the
+// domain.
+func (p *dhcpLeases) hostOf(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, "."+p.domain) {
+		return "", false
+	}
+	host := strings.TrimSuffix(name, "."+p.domain)
+	if len(host) == 0 || strings.Contains(host, ".") {
+		return "", false
+	}
+	return host, true
+}
+
+func (p *dhcpLeases) Close() error {
+	close(p.closeNotify)
+	for _, f := range p.closers {
+		f()
+	}
+	return nil
+}
+
+// leaseTable indexes leases of all sources. It is safe for concurrent use.
+type leaseTable struct {
+	mu      sync.RWMutex
+	sources [][]lease
+	byHost  map[string][]lease
+	byAddr  map[netip.Addr]lease
+}
+
+func newLeaseTable(sources int) *leaseTable {
+	return &leaseTable{
+		sources: make([][]lease, sources),
+		byHost:  make(map[string][]lease),
+		byAddr:  make(map[netip.Addr]lease),
+	}
+}
+
+// update replaces leases of the source i.
+func (t *leaseTable) update(i int, leases []lease) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sources[i] = leases
+	t.byHost = make(map[string][]lease)
+	t.byAddr = make(map[netip.Addr]lease)
+	for _, leases := range t.sources {
+		for _, l := range leases {
+			t.byHost[l.host] = append(t.byHost[l.host], l)
+			if old, dup := t.byAddr[l.addr]; !dup || l.expire.After(old.expire) {
+				t.byAddr[l.addr] = l
+			}
+		}
+	}
+}
+
+func (t *leaseTable) lookupHost(host string, now time.Time) []netip.Addr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var addrs []netip.Addr
+	for _, l := range t.byHost[host] {
+		if !l.expired(now) {
+			addrs = append(addrs, l.addr)
+		}
+	}
+	return addrs
+}
+
+func (t *leaseTable) lookupAddr(addr netip.Addr, now time.Time) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	l, ok := t.byAddr[addr]
+	if !ok || l.expired(now) {
+		return "", false
+	}
+	return l.host, true
+}
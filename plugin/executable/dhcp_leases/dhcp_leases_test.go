@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_parseDnsmasqLeases(t *testing.T) {
+	data := `
+1700000000 aa:bb:cc:dd:ee:ff 192.168.1.10 PC 01:aa:bb:cc:dd:ee:ff
+0 aa:bb:cc:dd:ee:00 192.168.1.11 printer.lan *
+1700000000 aa:bb:cc:dd:ee:01 192.168.1.12 * *
+duid 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:ff
+1700000000 12345 fd00::10 pc 00:01:00:01
+`
+	leases, err := parseDnsmasqLeases([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lease{
+		{host: "pc", addr: netip.MustParseAddr("192.168.1.10"), expire: time.Unix(1700000000, 0)},
+		{host: "printer", addr: netip.MustParseAddr("192.168.1.11")},
+		{host: "pc", addr: netip.MustParseAddr("fd00::10"), expire: time.Unix(1700000000, 0)},
+	}
+	checkLeases(t, leases, want)
+
+	if _, err := parseDnsmasqLeases([]byte("1700000000 aa:bb:cc:dd:ee:ff bad pc *")); err == nil {
+		t.Fatal("invalid address should return an error")
+	}
+}
+
+func Test_parseKeaLeases(t *testing.T) {
+	data := `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.168.1.10,aa:bb:cc:dd:ee:ff,,3600,1700000000,1,0,0,pc,0,
+192.168.1.11,aa:bb:cc:dd:ee:00,,3600,1700000000,1,0,0,printer,0,
+192.168.1.11,aa:bb:cc:dd:ee:00,,0,1700000100,1,0,0,printer,2,
+192.168.1.12,aa:bb:cc:dd:ee:01,,3600,1700000000,1,0,0,,0,
+192.168.1.10,aa:bb:cc:dd:ee:ff,,3600,1700003600,1,0,0,pc.lan,0,
+`
+	leases, err := parseKeaLeases([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lease{
+		{host: "pc", addr: netip.MustParseAddr("192.168.1.10"), expire: time.Unix(1700003600, 0)},
+	}
+	checkLeases(t, leases, want)
+
+	if _, err := parseKeaLeases([]byte("address,expire\n")); err == nil {
+		t.Fatal("missing columns should return an error")
+	}
+}
+
+func Test_parseKeaResponse(t *testing.T) {
+	data := `{"result": 0, "text": "2 IPv4 lease(s) found.", "arguments": {"leases": [
+{"ip-address": "192.168.1.10", "hostname": "pc", "cltt": 1700000000, "valid-lft": 3600, "state": 0},
+{"ip-address": "192.168.1.11", "hostname": "printer", "cltt": 1700000000, "valid-lft": 3600, "state": 1}
+]}}`
+	leases, err := parseKeaResponse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lease{
+		{host: "pc", addr: netip.MustParseAddr("192.168.1.10"), expire: time.Unix(1700003600, 0)},
+	}
+	checkLeases(t, leases, want)
+
+	leases, err = parseKeaResponse([]byte(`{"result": 3, "text": "0 IPv4 lease(s) found."}`))
+	if err != nil || len(leases) != 0 {
+		t.Fatalf("empty response: leases %v, err %v", leases, err)
+	}
+	if _, err := parseKeaResponse([]byte(`{"result": 1, "text": "unknown command"}`)); err == nil {
+		t.Fatal("error result should return an error")
+	}
+}
+
+func checkLeases(t *testing.T, got, want []lease) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("want %d leases, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i].host != want[i].host || got[i].addr != want[i].addr || !got[i].expire.Equal(want[i].expire) {
+			t.Errorf("lease #%d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func Test_dhcpLeases(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Unix()
+	dnsmasqFile := filepath.Join(dir, "dnsmasq.leases")
+	dnsmasqData := fmt.Sprintf("%d aa:bb:cc:dd:ee:ff 192.168.1.10 pc *\n%d aa:bb:cc:dd:ee:00 192.168.1.11 old *\n", now+3600, now-10)
+	if err := os.WriteFile(dnsmasqFile, []byte(dnsmasqData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake kea control socket.
+	socket := filepath.Join(dir, "kea.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 1024))
+			fmt.Fprintf(c, `{"result": 0, "arguments": {"leases": [{"ip-address": "fd00::20", "hostname": "laptop", "cltt": %d, "valid-lft": 3600, "state": 0}]}}`, now)
+			c.Close()
+		}
+	}()
+
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	p, err := newDHCPLeases(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Domain: "LAN",
+		Leases: []LeaseArgs{
+			{Format: formatDnsmasq, Path: dnsmasqFile},
+			{Format: formatKea6Socket, Path: socket},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Wait for the first poll.
+	for i := 0; len(p.table.lookupHost("laptop", time.Now())) == 0; i++ {
+		if i > 100 {
+			t.Fatal("kea leases are not loaded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		wantNil bool // passed to next
+		want    string
+	}{
+		{"pc.lan.", dns.TypeA, false, "192.168.1.10"},
+		{"PC.lan.", dns.TypeA, false, "192.168.1.10"},
+		{"pc.lan.", dns.TypeAAAA, false, ""},
+		{"laptop.lan.", dns.TypeAAAA, false, "fd00::20"},
+		{"old.lan.", dns.TypeA, true, ""},
+		{"unknown.lan.", dns.TypeA, true, ""},
+		{"pc.example.", dns.TypeA, true, ""},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, false, "pc.lan."},
+		{"11.1.168.192.in-addr.arpa.", dns.TypePTR, true, ""},
+		{"pc.lan.", dns.TypeMX, true, ""},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		qCtx := query_context.NewContext(q, nil)
+		next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: new(dns.Msg)})
+		if err := p.Exec(context.Background(), qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if tt.wantNil {
+			if r.Authoritative {
+				t.Errorf("%s %s: should be passed to next", tt.name, dns.TypeToString[tt.qtype])
+			}
+			continue
+		}
+		if !r.Authoritative || r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s %s: want an authoritative answer, got %v", tt.name, dns.TypeToString[tt.qtype], r)
+			continue
+		}
+		var got string
+		if len(r.Answer) > 0 {
+			switch rr := r.Answer[0].(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.AAAA:
+				got = rr.AAAA.String()
+			case *dns.PTR:
+				got = rr.Ptr
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: want %q, got %q", tt.name, dns.TypeToString[tt.qtype], tt.want, got)
+		}
+	}
+
+	// Leases are reloaded when the file changes.
+	if err := os.WriteFile(dnsmasqFile, []byte(fmt.Sprintf("%d aa:bb:cc:dd:ee:ff 192.168.1.20 pc *\n", now+3600)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		addrs := p.table.lookupHost("pc", time.Now())
+		if len(addrs) == 1 && addrs[0] == netip.MustParseAddr("192.168.1.20") {
+			break
+		}
+		if i > 300 {
+			t.Fatalf("lease file is not reloaded, got %v", addrs)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
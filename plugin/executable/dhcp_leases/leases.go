@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lease is a DHCP lease of a client with a host name.
+type lease struct {
+	host   string     // lower case host name, a single label.
+	addr   netip.Addr // unmapped
+	expire time.Time  // zero means never.
+}
+
+func (l lease) expired(now time.Time) bool {
+	return !l.expire.IsZero() && !l.expire.After(now)
+}
+
+// hostLabel returns the first label of the host name s in lower case, or
+// an empty string if s is not a valid host name.
+func hostLabel(s string) string {
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) == 0 || len(s) > 63 {
+		return ""
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+	return s
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file. IPv4 lines are
+// "expiry mac ip hostname client-id". IPv6 lines, which follow a
+// "duid" line, are "expiry iaid ip hostname client-id". An expiry of 0
+// means the lease never expires. Clients without a host name are "*".
+func parseDnsmasqLeases(b []byte) ([]lease, error) {
+	var leases []lease
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineCounter := 0
+	for scanner.Scan() {
+		lineCounter++
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || f[0] == "duid" {
+			continue
+		}
+		if len(f) < 4 {
+			return nil, fmt.Errorf("line %d: invalid lease", lineCounter)
+		}
+		expiry, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry, %w", lineCounter, err)
+		}
+		addr, err := netip.ParseAddr(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address, %w", lineCounter, err)
+		}
+		host := hostLabel(f[3])
+		if f[3] == "*" || len(host) == 0 {
+			continue
+		}
+		l := lease{host: host, addr: addr.Unmap()}
+		if expiry > 0 {
+			l.expire = time.Unix(expiry, 0)
+		}
+		leases = append(leases, l)
+	}
+	return leases, scanner.Err()
+}
+
+// parseKeaLeases parses a Kea memfile lease file (csv) of dhcp4 or
+// dhcp6. The file is append only, so a later line of an address replaces
+// earlier ones. Only leases in the default state are used.
+func parseKeaLeases(b []byte) ([]lease, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	col := make(map[string]int)
+	for i, name := range header {
+		col[name] = i
+	}
+	for _, name := range [...]string{"address", "expire", "hostname", "state"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	byAddr := make(map[netip.Addr]int) // index in leases
+	var leases []lease
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if len(rec) != len(header) {
+			continue
+		}
+		addr, err := netip.ParseAddr(rec[col["address"]])
+		if err != nil {
+			return nil, fmt.Errorf("invalid address, %w", err)
+		}
+		addr = addr.Unmap()
+		expire, err := strconv.ParseInt(rec[col["expire"]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expire, %w", err)
+		}
+		l := lease{addr: addr, expire: time.Unix(expire, 0)}
+		if rec[col["state"]] == "0" {
+			l.host = hostLabel(keaUnescape(rec[col["hostname"]]))
+		}
+		if i, ok := byAddr[addr]; ok {
+			leases[i] = l
+		} else {
+			byAddr[addr] = len(leases)
+			leases = append(leases, l)
+		}
+	}
+
+	valid := leases[:0]
+	for _, l := range leases {
+		if len(l.host) > 0 {
+			valid = append(valid, l)
+		}
+	}
+	return valid, nil
+}
+
+// keaUnescape unescapes commas, which Kea writes as "&#x2c", in s.
+func keaUnescape(s string) string {
+	return strings.ReplaceAll(s, "&#x2c", ",")
+}
+
+type keaResponse struct {
+	Result    int    `json:"result"`
+	Text      string `json:"text"`
+	Arguments struct {
+		Leases []keaLease `json:"leases"`
+	} `json:"arguments"`
+}
+
+type keaLease struct {
+	IPAddress string `json:"ip-address"`
+	Hostname  string `json:"hostname"`
+	CLTT      int64  `json:"cltt"`
+	ValidLft  int64  `json:"valid-lft"`
+	State     int    `json:"state"`
+}
+
+// parseKeaResponse parses the response of the lease4-get-all and
+// lease6-get-all commands of the Kea control channel. Result 3 means
+// there is no lease.
+func parseKeaResponse(b []byte) ([]lease, error) {
+	var resp keaResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	switch resp.Result {
+	case 0:
+	case 3:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("kea error %d: %s", resp.Result, resp.Text)
+	}
+
+	var leases []lease
+	for _, kl := range resp.Arguments.Leases {
+		if kl.State != 0 {
+			continue
+		}
+		host := hostLabel(kl.Hostname)
+		if len(host) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(kl.IPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address, %w", err)
+		}
+		leases = append(leases, lease{host: host, addr: addr.Unmap(), expire: time.Unix(kl.CLTT+kl.ValidLft, 0)})
+	}
+	return leases, nil
+}
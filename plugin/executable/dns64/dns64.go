@@ -0,0 +1,290 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+)
+
+const PluginType = "dns64"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultPrefix = "64:ff9b::/96"
+)
+
+var _ coremain.ExecutablePlugin = (*dns64)(nil)
+
+// Args of the dns64 plugin (RFC 6147). ExcludeAAAA and ExcludeA have the
+// same format as the client_ip of query_matcher.
+type Args struct {
+	// Prefix is the NAT64 prefix. Its length must be one of 32, 40, 48,
+	// 56, 64 and 96 (RFC 6052). Default is the well-known prefix
+	// "64:ff9b::/96".
+	Prefix string `yaml:"prefix"`
+
+	// OnlyEmpty synthesizes AAAA records only if the AAAA response of
+	// the name has no AAAA record, as recommended by RFC 6147. Otherwise,
+	// AAAA records are always synthesized from A records and the original
+	// AAAA records are ignored.
+	OnlyEmpty bool `yaml:"only_empty"`
+
+	// ExcludeAAAA are ranges of AAAA records that are treated as if they
+	// don't exist in the AAAA response, e.g. "::ffff:0:0/96". Only used
+	// with OnlyEmpty.
+	ExcludeAAAA []string `yaml:"exclude_aaaa"`
+
+	// ExcludeA are A records that are not synthesized, e.g. private
+	// addresses that are not reachable through the NAT64 gateway.
+	ExcludeA []string `yaml:"exclude_a"`
+}
+
+type dns64 struct {
+	*coremain.BP
+	prefix      netip.Prefix
+	onlyEmpty   bool
+	excludeAAAA *netlist.MatcherGroup // nil if Args.ExcludeAAAA is empty.
+	excludeA    *netlist.MatcherGroup // nil if Args.ExcludeA is empty.
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newDNS64(bp, args.(*Args))
+}
+
+func newDNS64(bp *coremain.BP, args *Args) (_ *dns64, err error) {
+	s := args.Prefix
+	if len(s) == 0 {
+		s = defaultPrefix
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix, %w", err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return nil, fmt.Errorf("prefix %s is not an ipv6 prefix", s)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid prefix length %d", prefix.Bits())
+	}
+
+	p := &dns64{
+		BP:        bp,
+		prefix:    prefix.Masked(),
+		onlyEmpty: args.OnlyEmpty,
+	}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+	if len(args.ExcludeAAAA) > 0 {
+		p.excludeAAAA, err = netlist.BatchLoadProvider(args.ExcludeAAAA, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load exclude_aaaa, %w", err)
+		}
+	}
+	if len(args.ExcludeA) > 0 {
+		p.excludeA, err = netlist.BatchLoadProvider(args.ExcludeA, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load exclude_a, %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Exec implements executable_seq.Executable. For AAAA queries, it queries
+// the A records of the name with next and replies AAAA records that embed
+// them in the NAT64 prefix.
+func (p *dns64) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA || q.Question[0].Qclass != dns.ClassINET || q.CheckingDisabled {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	var negTTL uint32 // of the AAAA response, zero if unknown.
+	if p.onlyEmpty {
+		if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+			return err
+		}
+		r := qCtx.R()
+		if r == nil || r.Rcode != dns.RcodeSuccess {
+			return nil
+		}
+		hasAAAA, err := p.hasAAAA(r)
+		if err != nil || hasAAAA {
+			return err
+		}
+		negTTL, _ = dnsutils.GetNegativeTTL(r)
+	}
+
+	qCtxA := qCtx.Copy()
+	qCtxA.Q().Question[0].Qtype = dns.TypeA
+	if err := executable_seq.ExecChainNode(ctx, qCtxA, next); err != nil {
+		if p.onlyEmpty { // keep the AAAA response.
+			p.L().Warn("failed to query A records", qCtx.InfoField(), zap.Error(err))
+			return nil
+		}
+		return err
+	}
+	rA := qCtxA.R()
+	if rA == nil {
+		return nil
+	}
+	r, err := p.synthesize(q, rA, negTTL)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+// hasAAAA reports whether r has AAAA records that are not excluded.
+func (p *dns64) hasAAAA(r *dns.Msg) (bool, error) {
+	for _, rr := range r.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		if p.excludeAAAA == nil {
+			return true, nil
+		}
+		addr, ok := netip.AddrFromSlice(aaaa.AAAA)
+		if !ok {
+			continue
+		}
+		excluded, err := p.excludeAAAA.Match(addr)
+		if err != nil {
+			return false, err
+		}
+		if !excluded {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// synthesize builds the AAAA response of q from the A response rA.
+// The ttls of synthesized records are capped by negTTL if it is not zero.
+// If there is nothing to synthesize, it returns nil with only_empty, so
+// the AAAA response is kept, or an empty AAAA response without it.
+func (p *dns64) synthesize(q *dns.Msg, rA *dns.Msg, negTTL uint32) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Rcode = rA.Rcode
+	r.RecursionAvailable = rA.RecursionAvailable
+	if opt := q.IsEdns0(); opt != nil {
+		r.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	synthesized := 0
+	for _, rr := range rA.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			r.Answer = append(r.Answer, dns.Copy(rr))
+		case *dns.A:
+			addr, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok {
+				continue
+			}
+			if p.excludeA != nil {
+				excluded, err := p.excludeA.Match(addr)
+				if err != nil {
+					return nil, err
+				}
+				if excluded {
+					continue
+				}
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if negTTL > 0 && hdr.Ttl > negTTL {
+				hdr.Ttl = negTTL
+			}
+			ip := embed(p.prefix, addr.As4())
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IP(ip[:])})
+			synthesized++
+		}
+	}
+
+	if synthesized == 0 {
+		if p.onlyEmpty {
+			return nil, nil
+		}
+		// Return an empty answer with the negative response records of rA.
+		r.Answer = nil
+		for _, rr := range rA.Ns {
+			if _, ok := rr.(*dns.SOA); ok {
+				r.Ns = append(r.Ns, dns.Copy(rr))
+			}
+		}
+	}
+	return r, nil
+}
+
+// embed embeds an ipv4 address in the NAT64 prefix as described in
+// RFC 6052 section 2.2. Bits 64 to 71 are reserved and must be zero.
+func embed(prefix netip.Prefix, v4 [4]byte) [16]byte {
+	b := prefix.Addr().As16()
+	switch prefix.Bits() {
+	case 32:
+		copy(b[4:8], v4[:])
+	case 40:
+		copy(b[5:8], v4[:3])
+		b[9] = v4[3]
+	case 48:
+		copy(b[6:8], v4[:2])
+		copy(b[9:11], v4[2:])
+	case 56:
+		b[7] = v4[0]
+		copy(b[9:12], v4[1:])
+	case 64:
+		copy(b[9:13], v4[:])
+	case 96:
+		copy(b[12:16], v4[:])
+	}
+	return b
+}
+
+func (p *dns64) Close() error {
+	if p.excludeAAAA != nil {
+		p.excludeAAAA.Close()
+	}
+	if p.excludeA != nil {
+		p.excludeA.Close()
+	}
+	return nil
+}
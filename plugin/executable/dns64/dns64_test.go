@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func Test_embed(t *testing.T) {
+	// RFC 6052 section 2.4
+	v4 := netip.MustParseAddr("192.0.2.33").As4()
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, tt := range tests {
+		got := netip.AddrFrom16(embed(netip.MustParsePrefix(tt.prefix), v4))
+		if got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s: want %s, got %s", tt.prefix, tt.want, got)
+		}
+	}
+}
+
+// testNext replies A records in a, and AAAA records in aaaa.
+type testNext struct {
+	a, aaaa []string
+}
+
+func (n *testNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	name := q.Question[0].Name
+	r.Answer = append(r.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: "target." + name,
+	})
+	hdr := dns.RR_Header{Name: "target." + name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		for _, s := range n.a {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(s)})
+		}
+	case dns.TypeAAAA:
+		for _, s := range n.aaaa {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(s)})
+		}
+	}
+	if len(r.Answer) == 1 {
+		r.Ns = append(r.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.",
+			Mbox:   "mbox.",
+			Minttl: 60,
+		})
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_dns64_Exec(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	tests := []struct {
+		name string
+		args *Args
+		next *testNext
+		want []string // AAAA records in the response.
+	}{
+		{"always", &Args{}, &testNext{a: []string{"192.0.2.33"}, aaaa: []string{"2001:db8::1"}}, []string{"64:ff9b::c000:221"}},
+		{"only empty", &Args{OnlyEmpty: true}, &testNext{a: []string{"192.0.2.33"}}, []string{"64:ff9b::c000:221"}},
+		{"only empty has aaaa", &Args{OnlyEmpty: true}, &testNext{a: []string{"192.0.2.33"}, aaaa: []string{"2001:db8::1"}}, []string{"2001:db8::1"}},
+		{"excluded aaaa", &Args{OnlyEmpty: true, ExcludeAAAA: []string{"::ffff:0:0/96"}}, &testNext{a: []string{"192.0.2.33"}, aaaa: []string{"::ffff:1.1.1.1"}}, []string{"64:ff9b::c000:221"}},
+		{"excluded a", &Args{Prefix: "2001:db8::/32", ExcludeA: []string{"10.0.0.0/8"}}, &testNext{a: []string{"10.0.0.1", "192.0.2.33"}}, []string{"2001:db8:c000:221::"}},
+		{"no a", &Args{}, &testNext{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newDNS64(coremain.NewBP("dns64", PluginType, nil, m), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeAAAA)
+			qCtx := query_context.NewContext(q, nil)
+			if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(tt.next)); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			var got []string
+			for _, rr := range r.Answer {
+				if aaaa, ok := rr.(*dns.AAAA); ok {
+					got = append(got, aaaa.AAAA.String())
+					if aaaa.Hdr.Name != "target.example.com." {
+						t.Fatalf("invalid name %s", aaaa.Hdr.Name)
+					}
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if netip.MustParseAddr(got[i]) != netip.MustParseAddr(tt.want[i]) {
+					t.Fatalf("want %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+
+	for _, prefix := range []string{"64:ff9b::/80", "1.1.1.0/24", "invalid"} {
+		if _, err := newDNS64(coremain.NewBP("dns64", PluginType, nil, m), &Args{Prefix: prefix}); err == nil {
+			t.Fatalf("want an error for prefix %s", prefix)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnstap"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PluginType = "dnstap"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*dnstapPlugin)(nil)
+
+type Args struct {
+	// Server is the address of the dnstap collector, "unix:///path/to/socket"
+	// or "tcp://host:port". An address without scheme is a unix socket path.
+	Server string `yaml:"server"`
+
+	// Identity is the identity of this server. Default is the hostname.
+	Identity string `yaml:"identity"`
+	// Version is the version of this server. Default is "mosdns".
+	Version string `yaml:"version"`
+
+	// QueueSize is the maximum number of pending messages. Messages are
+	// dropped if the collector is slow or unreachable. Default is 4096.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// dnstapPlugin logs client queries and responses as CLIENT_QUERY and
+// CLIENT_RESPONSE messages. Forwarders that refer to it log their upstream
+// exchanges as FORWARDER_QUERY and FORWARDER_RESPONSE messages.
+type dnstapPlugin struct {
+	*coremain.BP
+	w *dnstap.Writer
+
+	droppedTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newDnstap(bp, args.(*Args))
+}
+
+func newDnstap(bp *coremain.BP, args *Args) (*dnstapPlugin, error) {
+	network, addr, err := parseServer(args.Server)
+	if err != nil {
+		return nil, err
+	}
+	identity := args.Identity
+	if len(identity) == 0 {
+		identity, _ = os.Hostname()
+	}
+	version := args.Version
+	if len(version) == 0 {
+		version = "mosdns"
+	}
+
+	w, err := dnstap.NewWriter(dnstap.Opts{
+		Network:   network,
+		Addr:      addr,
+		Identity:  identity,
+		Version:   version,
+		QueueSize: args.QueueSize,
+		Logger:    bp.L(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &dnstapPlugin{
+		BP: bp,
+		w:  w,
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of dnstap messages that were dropped because the queue was full",
+		}),
+	}
+	bp.GetMetricsReg().MustRegister(p.droppedTotal)
+	return p, nil
+}
+
+func parseServer(s string) (network, addr string, err error) {
+	switch {
+	case len(s) == 0:
+		return "", "", errors.New("missing server address")
+	case strings.HasPrefix(s, "unix://"):
+		return "unix", strings.TrimPrefix(s, "unix://"), nil
+	case strings.HasPrefix(s, "tcp://"):
+		return "tcp", strings.TrimPrefix(s, "tcp://"), nil
+	case strings.Contains(s, "://"):
+		return "", "", errors.New("invalid server scheme, must be unix or tcp")
+	default:
+		return "unix", s, nil
+	}
+}
+
+func (p *dnstapPlugin) write(m *dnstap.Message) {
+	if !p.w.Write(m) {
+		p.droppedTotal.Inc()
+	}
+}
+
+func (p *dnstapPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	meta := qCtx.ReqMeta()
+	m := &dnstap.Message{
+		Type:         dnstap.MessageClientQuery,
+		Protocol:     clientProtocol(meta),
+		ResponseAddr: meta.OriginalDst,
+		QueryTime:    qCtx.StartTime(),
+	}
+	if meta.ClientAddr.IsValid() {
+		m.QueryAddr = netip.AddrPortFrom(meta.ClientAddr, meta.ClientPort)
+	}
+	m.QueryMessage, _ = qCtx.OriginalQuery().Pack()
+	p.write(m)
+
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+
+	if r := qCtx.R(); r != nil {
+		m.Type = dnstap.MessageClientResponse
+		m.ResponseTime = time.Now()
+		m.ResponseMessage, _ = r.Pack()
+		p.write(m)
+	}
+	return err
+}
+
+func clientProtocol(meta *query_context.RequestMeta) dnstap.SocketProtocol {
+	switch meta.Protocol {
+	case "udp":
+		return dnstap.ProtocolUDP
+	case "tcp":
+		return dnstap.ProtocolTCP
+	case "tls":
+		return dnstap.ProtocolDOT
+	case "http", "https", "h3":
+		return dnstap.ProtocolDOH
+	case "quic":
+		return dnstap.ProtocolDOQ
+	case "dnscrypt":
+		if meta.FromUDP {
+			return dnstap.ProtocolDNSCryptUDP
+		}
+		return dnstap.ProtocolDNSCryptTCP
+	}
+	return 0
+}
+
+// ForwarderTap implements the ForwarderTapper of fast_forward.
+func (p *dnstapPlugin) ForwarderTap(addr string) func(q, r *dns.Msg, queryTime, responseTime time.Time) {
+	protocol, responseAddr := parseUpstream(addr)
+	return func(q, r *dns.Msg, queryTime, responseTime time.Time) {
+		m := &dnstap.Message{
+			Type:         dnstap.MessageForwarderQuery,
+			Protocol:     protocol,
+			ResponseAddr: responseAddr,
+			QueryTime:    queryTime,
+		}
+		m.QueryMessage, _ = q.Pack()
+		p.write(m)
+		if r != nil {
+			m.Type = dnstap.MessageForwarderResponse
+			m.ResponseTime = responseTime
+			m.ResponseMessage, _ = r.Pack()
+			p.write(m)
+		}
+	}
+}
+
+// parseUpstream returns the protocol and the address of an upstream addr.
+// The address is invalid if the upstream host is not an ip address.
+func parseUpstream(addr string) (dnstap.SocketProtocol, netip.AddrPort) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return 0, netip.AddrPort{}
+	}
+
+	var protocol dnstap.SocketProtocol
+	var defaultPort uint16
+	switch u.Scheme {
+	case "udp":
+		protocol, defaultPort = dnstap.ProtocolUDP, 53
+	case "tcp":
+		protocol, defaultPort = dnstap.ProtocolTCP, 53
+	case "tls":
+		protocol, defaultPort = dnstap.ProtocolDOT, 853
+	case "https":
+		protocol, defaultPort = dnstap.ProtocolDOH, 443
+	default:
+		return 0, netip.AddrPort{}
+	}
+
+	host, port := u.Host, defaultPort
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+		if n, err := strconv.ParseUint(p, 10, 16); err == nil {
+			port = uint16(n)
+		}
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return protocol, netip.AddrPort{}
+	}
+	return protocol, netip.AddrPortFrom(ip, port)
+}
+
+func (p *dnstapPlugin) Close() error {
+	return p.w.Close()
+}
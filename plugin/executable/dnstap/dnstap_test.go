@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnstap"
+	"testing"
+)
+
+func Test_parseUpstream(t *testing.T) {
+	tests := []struct {
+		addr         string
+		wantProtocol dnstap.SocketProtocol
+		wantAddr     string
+	}{
+		{"8.8.8.8", dnstap.ProtocolUDP, "8.8.8.8:53"},
+		{"udp://8.8.8.8:5353", dnstap.ProtocolUDP, "8.8.8.8:5353"},
+		{"tcp://[2001:db8::1]", dnstap.ProtocolTCP, "[2001:db8::1]:53"},
+		{"tls://1.1.1.1", dnstap.ProtocolDOT, "1.1.1.1:853"},
+		{"https://1.1.1.1/dns-query", dnstap.ProtocolDOH, "1.1.1.1:443"},
+		{"https://dns.google/dns-query", dnstap.ProtocolDOH, "invalid AddrPort"},
+		{"quic://1.1.1.1", 0, "invalid AddrPort"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			protocol, addr := parseUpstream(tt.addr)
+			if protocol != tt.wantProtocol || addr.String() != tt.wantAddr {
+				t.Fatalf("parseUpstream() = %v, %v, want %v, %v", protocol, addr, tt.wantProtocol, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func Test_parseServer(t *testing.T) {
+	for s, want := range map[string]string{
+		"/run/dnstap.sock":        "unix /run/dnstap.sock",
+		"unix:///run/dnstap.sock": "unix /run/dnstap.sock",
+		"tcp://127.0.0.1:6000":    "tcp 127.0.0.1:6000",
+	} {
+		network, addr, err := parseServer(s)
+		if err != nil || network+" "+addr != want {
+			t.Errorf("parseServer(%s) = %s %s %v, want %s", s, network, addr, err, want)
+		}
+	}
+	for _, s := range []string{"", "udp://127.0.0.1:6000"} {
+		if _, _, err := parseServer(s); err == nil {
+			t.Errorf("parseServer(%s) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dual_query
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const PluginType = "dual_query"
+
+const (
+	modeBoth = iota
+	modeAOnly
+	modeAAAAOnly
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+type Args struct {
+	// Mode 0: A queries trigger AAAA queries and vice versa.
+	// Mode 1: Only A queries trigger AAAA queries.
+	// Mode 2: Only AAAA queries trigger A queries.
+	Mode          int `yaml:"mode"`
+	Timeout       int `yaml:"timeout"`        // (sec) Timeout of background queries. Default is 5.
+	MaxConcurrent int `yaml:"max_concurrent"` // Max number of background queries. Default is 64.
+}
+
+func (a *Args) init() {
+	if a.Timeout <= 0 {
+		a.Timeout = 5
+	}
+	if a.MaxConcurrent <= 0 {
+		a.MaxConcurrent = 64
+	}
+}
+
+var _ coremain.ExecutablePlugin = (*dualQuery)(nil)
+
+// dualQuery sends the paired query of an A/AAAA query to the rest of the
+// chain in the background. If there is a cache in the chain, the paired
+// query of dual-stack clients will hit the cache.
+type dualQuery struct {
+	*coremain.BP
+	args *Args
+
+	m        sync.Mutex
+	inflight map[dns.Question]struct{}
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	a := args.(*Args)
+	a.init()
+	return &dualQuery{
+		BP:       bp,
+		args:     a,
+		inflight: make(map[dns.Question]struct{}),
+	}, nil
+}
+
+func (d *dualQuery) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if pq, ok := d.pairedQuestion(qCtx.Q()); ok && d.acquire(pq) {
+		qCtxPair := qCtx.Copy()
+		qCtxPair.Q().Question[0] = pq
+		go func() {
+			defer d.release(pq)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.args.Timeout)*time.Second)
+			defer cancel()
+			if err := executable_seq.ExecChainNode(ctx, qCtxPair, next); err != nil {
+				d.L().Debug("paired query failed", qCtxPair.InfoField(), zap.Error(err))
+			}
+		}()
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (d *dualQuery) pairedQuestion(q *dns.Msg) (dns.Question, bool) {
+	if len(q.Question) != 1 {
+		return dns.Question{}, false
+	}
+	pq := q.Question[0]
+	switch {
+	case pq.Qtype == dns.TypeA && d.args.Mode != modeAAAAOnly:
+		pq.Qtype = dns.TypeAAAA
+	case pq.Qtype == dns.TypeAAAA && d.args.Mode != modeAOnly:
+		pq.Qtype = dns.TypeA
+	default:
+		return dns.Question{}, false
+	}
+	return pq, true
+}
+
+// acquire returns false if the same paired query is in flight or there
+// are too many background queries.
+func (d *dualQuery) acquire(q dns.Question) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if _, dup := d.inflight[q]; dup || len(d.inflight) >= d.args.MaxConcurrent {
+		return false
+	}
+	d.inflight[q] = struct{}{}
+	return true
+}
+
+func (d *dualQuery) release(q dns.Question) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	delete(d.inflight, q)
+}
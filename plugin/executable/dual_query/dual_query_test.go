@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dual_query
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeNext answers A and AAAA queries and stores the responses by
+// question, like a cache at the end of the chain.
+type storeNext struct {
+	block chan struct{} // if not nil, AAAA queries wait for it.
+
+	m     sync.Mutex
+	store map[dns.Question]*dns.Msg
+	calls map[dns.Question]int
+}
+
+func newStoreNext() *storeNext {
+	return &storeNext{store: make(map[dns.Question]*dns.Msg), calls: make(map[dns.Question]int)}
+}
+
+func (s *storeNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	question := qCtx.Q().Question[0]
+	if question.Qtype == dns.TypeAAAA && s.block != nil {
+		<-s.block
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 300}
+	switch question.Qtype {
+	case dns.TypeA:
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)})
+	case dns.TypeAAAA:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+	}
+	qCtx.SetResponse(r)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.store[question] = r
+	s.calls[question]++
+	return nil
+}
+
+func (s *storeNext) get(q dns.Question) (*dns.Msg, int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.store[q], s.calls[q]
+}
+
+func newTestDualQuery(t *testing.T, mode int) *dualQuery {
+	t.Helper()
+	p, err := Init(coremain.NewBP("test", PluginType, zap.NewNop(), nil), &Args{Mode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*dualQuery)
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 3)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func Test_dualQuery_Exec(t *testing.T) {
+	qA := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	qAAAA := dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	qMX := dns.Question{Name: "example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}
+
+	tests := []struct {
+		name       string
+		mode       int
+		q          dns.Question
+		wantPaired *dns.Question
+	}{
+		{"both: A triggers AAAA", modeBoth, qA, &qAAAA},
+		{"both: AAAA triggers A", modeBoth, qAAAA, &qA},
+		{"a only: A triggers AAAA", modeAOnly, qA, &qAAAA},
+		{"a only: AAAA is not paired", modeAOnly, qAAAA, nil},
+		{"aaaa only: AAAA triggers A", modeAAAAOnly, qAAAA, &qA},
+		{"aaaa only: A is not paired", modeAAAAOnly, qA, nil},
+		{"other types are not paired", modeBoth, qMX, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDualQuery(t, tt.mode)
+			next := newStoreNext()
+			q := new(dns.Msg)
+			q.Question = []dns.Question{tt.q}
+			qCtx := query_context.NewContext(q, nil)
+			if err := d.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next)); err != nil {
+				t.Fatal(err)
+			}
+
+			// The client leg is not affected by the paired leg.
+			r := qCtx.R()
+			if r == nil || r.Question[0] != tt.q {
+				t.Fatalf("unexpected response of the client leg: %v", r)
+			}
+			if qCtx.Q().Question[0] != tt.q {
+				t.Fatal("query of the client leg was modified")
+			}
+
+			if tt.wantPaired == nil {
+				time.Sleep(time.Millisecond * 50)
+				next.m.Lock()
+				n := len(next.calls)
+				next.m.Unlock()
+				if n != 1 {
+					t.Fatalf("want only the client query, got %d questions", n)
+				}
+				return
+			}
+			// The paired leg's response is stored next to the client's.
+			waitFor(t, func() bool {
+				pr, _ := next.get(*tt.wantPaired)
+				return pr != nil
+			})
+			pr, _ := next.get(*tt.wantPaired)
+			if len(pr.Answer) != 1 || pr.Answer[0].Header().Rrtype != tt.wantPaired.Qtype {
+				t.Fatalf("unexpected response of the paired leg: %v", pr)
+			}
+		})
+	}
+}
+
+func Test_dualQuery_dedup(t *testing.T) {
+	d := newTestDualQuery(t, modeBoth)
+	next := newStoreNext()
+	next.block = make(chan struct{})
+	qAAAA := dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if err := d.Exec(context.Background(), query_context.NewContext(q, nil), executable_seq.WrapExecutable(next)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(next.block)
+	waitFor(t, func() bool {
+		_, calls := next.get(qAAAA)
+		return calls > 0
+	})
+	waitFor(t, func() bool {
+		d.m.Lock()
+		defer d.m.Unlock()
+		return len(d.inflight) == 0
+	})
+	if _, calls := next.get(qAAAA); calls != 1 {
+		t.Fatalf("want 1 paired query while one is in flight, got %d", calls)
+	}
+}
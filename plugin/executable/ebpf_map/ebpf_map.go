@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ebpf_map
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+)
+
+const PluginType = "ebpf_map"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+// Args configures pinned eBPF maps that contain the IPs in responses,
+// so XDP/tc programs can look up the destinations of connections. Put
+// the plugin after a domain matcher in a sequence to export IPs of
+// specific domains.
+//
+// Keys are the masked addresses. For lpm_trie maps, keys are
+// struct bpf_lpm_trie_key, a host order u32 prefix length followed by
+// the address. Values are 16 bytes:
+//
+//	struct {
+//		__u64 expire; // bpf_ktime_get_ns() clock
+//		__u32 mark;
+//		__u32 reserved;
+//	};
+//
+// Expired entries are removed from the maps. The maps and their
+// entries persist across restarts.
+type Args struct {
+	PinPath4   string `yaml:"pin_path4"`   // in a bpf filesystem, e.g. /sys/fs/bpf/mosdns4
+	PinPath6   string `yaml:"pin_path6"`   // in a bpf filesystem, e.g. /sys/fs/bpf/mosdns6
+	MapType    string `yaml:"map_type"`    // "lpm_trie" (default) or "hash"
+	MaxEntries uint32 `yaml:"max_entries"` // of new maps, default 65536
+	Mask4      int    `yaml:"mask4"`       // default 32
+	Mask6      int    `yaml:"mask6"`       // default 128
+	Mark       uint32 `yaml:"mark"`
+
+	// Entries expire after the TTL of the record, but at least MinTTL
+	// (sec, default 300), after the last response that contained the IP.
+	MinTTL uint32 `yaml:"min_ttl"`
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newEbpfMapPlugin(bp, args.(*Args))
+}
@@ -0,0 +1,311 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ebpf_map
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/bpf_map"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinTTL       = 300
+	defaultMaxEntries   = 65536
+	expireCheckInterval = time.Second * 10
+	valueSize           = 16
+)
+
+var _ coremain.ExecutablePlugin = (*ebpfMapPlugin)(nil)
+var _ coremain.Shutdowner = (*ebpfMapPlugin)(nil)
+
+type ebpfMapPlugin struct {
+	*coremain.BP
+	args       *Args
+	lpm        bool
+	map4, map6 *exportMap // nil if not configured
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	expirerDone chan struct{}
+}
+
+// exportMap is a map and the expiration time of its entries.
+type exportMap struct {
+	m *bpf_map.Map
+
+	mu      sync.Mutex
+	entries map[string]time.Time // key: map key
+}
+
+func newEbpfMapPlugin(bp *coremain.BP, args *Args) (*ebpfMapPlugin, error) {
+	if m := args.Mask4; m <= 0 || m > 32 {
+		args.Mask4 = 32
+	}
+	if m := args.Mask6; m <= 0 || m > 128 {
+		args.Mask6 = 128
+	}
+	if args.MinTTL == 0 {
+		args.MinTTL = defaultMinTTL
+	}
+	if args.MaxEntries == 0 {
+		args.MaxEntries = defaultMaxEntries
+	}
+
+	p := &ebpfMapPlugin{
+		BP:          bp,
+		args:        args,
+		closeNotify: make(chan struct{}),
+		expirerDone: make(chan struct{}),
+	}
+	typ := bpf_map.MapTypeLPMTrie
+	switch args.MapType {
+	case "", "lpm_trie":
+		p.lpm = true
+	case "hash":
+		typ = bpf_map.MapTypeHash
+	default:
+		return nil, fmt.Errorf("invalid map type %s", args.MapType)
+	}
+	if len(args.PinPath4) == 0 && len(args.PinPath6) == 0 {
+		return nil, errors.New("missing pin path")
+	}
+
+	var err error
+	if len(args.PinPath4) > 0 {
+		if p.map4, err = p.openMap(args.PinPath4, typ, 4); err != nil {
+			return nil, err
+		}
+	}
+	if len(args.PinPath6) > 0 {
+		if p.map6, err = p.openMap(args.PinPath6, typ, 16); err != nil {
+			p.closeMaps()
+			return nil, err
+		}
+	}
+	go p.startExpirer()
+	return p, nil
+}
+
+// openMap opens the map and loads its existing entries.
+func (p *ebpfMapPlugin) openMap(path string, typ bpf_map.MapType, addrLen uint32) (*exportMap, error) {
+	keySize := addrLen
+	if p.lpm {
+		keySize += 4
+	}
+	m, err := bpf_map.OpenOrCreatePinned(path, bpf_map.MapSpec{
+		Type:       typ,
+		KeySize:    keySize,
+		ValueSize:  valueSize,
+		MaxEntries: p.args.MaxEntries,
+		Name:       "mosdns",
+	})
+	if err != nil {
+		return nil, err
+	}
+	em := &exportMap{m: m, entries: make(map[string]time.Time)}
+
+	keys, err := m.Keys()
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to load entries of map %s, %w", path, err)
+	}
+	now, mono := time.Now(), monoNow()
+	v := make([]byte, valueSize)
+	for _, k := range keys {
+		if err := m.Lookup(k, v); err != nil {
+			continue
+		}
+		// Entries from the previous run are removed by the expirer.
+		expire := now
+		if e := bpf_map.NativeEndian.Uint64(v); e > mono {
+			expire = now.Add(time.Duration(e - mono))
+		}
+		em.entries[string(k)] = expire
+	}
+	p.L().Info("ebpf map opened", zap.String("path", path), zap.Stringer("type", typ), zap.Int("entries", len(keys)))
+	return em, nil
+}
+
+func (p *ebpfMapPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r := qCtx.R()
+	if r != nil {
+		if err := p.export(r); err != nil {
+			p.L().Warn("failed to export IPs to ebpf map", qCtx.InfoField(), zap.Error(err))
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *ebpfMapPlugin) export(r *dns.Msg) error {
+	now, mono := time.Now(), monoNow()
+	for i := range r.Answer {
+		var em *exportMap
+		var addr netip.Addr
+		var mask int
+		var ok bool
+		switch rr := r.Answer[i].(type) {
+		case *dns.A:
+			em, mask = p.map4, p.args.Mask4
+			addr, ok = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			em, mask = p.map6, p.args.Mask6
+			addr, ok = netip.AddrFromSlice(rr.AAAA.To16())
+		default:
+			continue
+		}
+		if em == nil {
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("invalid ip in record %s", r.Answer[i])
+		}
+
+		ttl := r.Answer[i].Header().Ttl
+		if ttl < p.args.MinTTL {
+			ttl = p.args.MinTTL
+		}
+		lifetime := time.Duration(ttl) * time.Second
+		if err := em.update(p.key(netip.PrefixFrom(addr, mask).Masked()), p.value(mono+uint64(lifetime)), now.Add(lifetime)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update updates the entry if it was not in the map or expires earlier.
+func (em *exportMap) update(key, value []byte, expire time.Time) error {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if e, ok := em.entries[string(key)]; ok && !expire.After(e.Add(time.Second)) {
+		return nil
+	}
+	if err := em.m.Update(key, value); err != nil {
+		return err
+	}
+	em.entries[string(key)] = expire
+	return nil
+}
+
+func (em *exportMap) removeExpired(now time.Time) (int, error) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	var firstErr error
+	n := 0
+	for k, expire := range em.entries {
+		if now.Before(expire) {
+			continue
+		}
+		if err := em.m.Delete([]byte(k)); err != nil && !errors.Is(err, unix.ENOENT) && firstErr == nil {
+			firstErr = err
+		}
+		delete(em.entries, k)
+		n++
+	}
+	return n, firstErr
+}
+
+func (p *ebpfMapPlugin) key(prefix netip.Prefix) []byte {
+	addr := prefix.Addr().AsSlice()
+	if !p.lpm {
+		return addr
+	}
+	k := make([]byte, 4, 4+len(addr))
+	bpf_map.NativeEndian.PutUint32(k, uint32(prefix.Bits()))
+	return append(k, addr...)
+}
+
+func (p *ebpfMapPlugin) value(expire uint64) []byte {
+	v := make([]byte, valueSize)
+	bpf_map.NativeEndian.PutUint64(v, expire)
+	bpf_map.NativeEndian.PutUint32(v[8:], p.args.Mark)
+	return v
+}
+
+func (p *ebpfMapPlugin) startExpirer() {
+	defer close(p.expirerDone)
+	ticker := time.NewTicker(expireCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case now := <-ticker.C:
+			p.removeExpired(now)
+		}
+	}
+}
+
+func (p *ebpfMapPlugin) removeExpired(now time.Time) {
+	for _, em := range [...]*exportMap{p.map4, p.map6} {
+		if em == nil {
+			continue
+		}
+		if n, err := em.removeExpired(now); err != nil {
+			p.L().Warn("failed to remove expired entries from ebpf map", zap.Int("removed", n), zap.Error(err))
+		}
+	}
+}
+
+func (p *ebpfMapPlugin) Close() error {
+	return p.Shutdown(context.Background())
+}
+
+// Shutdown stops the expirer and closes the maps. Pinned maps and
+// their entries are kept.
+func (p *ebpfMapPlugin) Shutdown(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+	})
+	select {
+	case <-p.expirerDone:
+	case <-ctx.Done():
+		p.L().Warn("ebpf map expirer did not exit in time", zap.Error(ctx.Err()))
+	}
+	p.closeMaps()
+	return nil
+}
+
+func (p *ebpfMapPlugin) closeMaps() {
+	for _, em := range [...]*exportMap{p.map4, p.map6} {
+		if em != nil {
+			em.m.Close()
+		}
+	}
+}
+
+// monoNow returns the time of CLOCK_MONOTONIC, which is used by
+// bpf_ktime_get_ns.
+func monoNow() uint64 {
+	var ts unix.Timespec
+	_ = unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return uint64(ts.Nano())
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ebpf_map
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TEST_BPF_DIR must be a directory in a bpf filesystem.
+func Test_ebpfMapPlugin(t *testing.T) {
+	dir := os.Getenv("TEST_BPF_DIR")
+	if dir == "" {
+		t.SkipNow()
+	}
+	args := &Args{PinPath4: filepath.Join(dir, "mosdns_test4"), PinPath6: filepath.Join(dir, "mosdns_test6"), Mask4: 24, Mark: 1}
+	for _, path := range []string{args.PinPath4, args.PinPath6} {
+		os.Remove(path)
+		defer os.Remove(path)
+	}
+	newPlugin := func() *ebpfMapPlugin {
+		t.Helper()
+		p, err := newEbpfMapPlugin(coremain.NewBP("test", PluginType, nil, nil), args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	p := newPlugin()
+	r := new(dns.Msg)
+	for _, s := range []string{"a. 10 IN A 192.0.2.1", "a. 10 IN A 192.0.2.2", "a. 10 IN AAAA 2001:db8::1"} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	if err := p.export(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.map4.entries) != 1 || len(p.map6.entries) != 1 {
+		t.Fatalf("unexpected entries, %v, %v", p.map4.entries, p.map6.entries)
+	}
+	p.Close()
+
+	// Entries are loaded from the pinned maps.
+	p = newPlugin()
+	defer p.Close()
+	if len(p.map4.entries) != 1 || len(p.map6.entries) != 1 {
+		t.Fatalf("unexpected entries, %v, %v", p.map4.entries, p.map6.entries)
+	}
+	for _, e := range p.map4.entries {
+		if d := time.Until(e); d < time.Duration(defaultMinTTL-5)*time.Second || d > defaultMinTTL*time.Second {
+			t.Fatalf("unexpected expiration time %s", e)
+		}
+	}
+	p.removeExpired(time.Now().Add(time.Hour))
+	for _, em := range []*exportMap{p.map4, p.map6} {
+		keys, err := em.m.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 || len(em.entries) != 0 {
+			t.Fatalf("expired entries were not removed, %v", keys)
+		}
+	}
+}
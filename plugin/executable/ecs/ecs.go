@@ -45,12 +45,23 @@ var _ coremain.ExecutablePlugin = (*ecsPlugin)(nil)
 
 type Args struct {
 	// Automatically append client address as ecs.
-	// If this is true, pre-set addresses will not be used.
+	// If this is true, pre-set addresses will not be used, unless
+	// SkipPrivate is also true.
 	Auto bool `yaml:"auto"`
 
-	// force overwrite existing ecs
+	// SkipPrivate: used by auto. Client addresses that are not public
+	// (e.g. private, loopback and link-local addresses) will not be sent.
+	// Pre-set addresses will be used instead, if any.
+	SkipPrivate bool `yaml:"skip_private"`
+
+	// force overwrite existing ecs.
+	// The ecs of the client is restored in the response.
 	ForceOverwrite bool `yaml:"force_overwrite"`
 
+	// Strip removes ecs from queries and responses. Other arguments are
+	// ignored. It is the same as the preset plugin "_no_ecs".
+	Strip bool `yaml:"strip"`
+
 	// mask for ecs
 	Mask4 int `yaml:"mask4"` // default 24
 	Mask6 int `yaml:"mask6"` // default 48
@@ -120,19 +131,24 @@ func newPlugin(bp *coremain.BP, args *Args) (p *ecsPlugin, err error) {
 
 // Exec tries to append ECS to qCtx.Q().
 func (e *ecsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	upgraded, newECS := e.addECS(qCtx)
+	if e.args.Strip {
+		return stripECS(ctx, qCtx, next)
+	}
+
+	upgraded, newECS, clientECS := e.addECS(qCtx)
 	err := executable_seq.ExecChainNode(ctx, qCtx, next)
 	if err != nil {
 		return err
 	}
 
 	if r := qCtx.R(); r != nil {
-		if upgraded {
+		switch {
+		case upgraded:
 			dnsutils.RemoveEDNS0(r)
-		} else {
-			if newECS {
-				dnsutils.RemoveMsgECS(r)
-			}
+		case newECS:
+			dnsutils.RemoveMsgECS(r)
+		case clientECS != nil:
+			restoreECS(r, clientECS)
 		}
 	}
 	return nil
@@ -142,46 +158,24 @@ func (e *ecsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next
 // upgraded: Whether the addECS upgraded the q to a EDNS0 enabled query.
 // newECS: Whether the addECS added a *dns.EDNS0_SUBNET to q that didn't
 // have a *dns.EDNS0_SUBNET before.
-func (e *ecsPlugin) addECS(qCtx *query_context.Context) (upgraded bool, newECS bool) {
+// clientECS: The *dns.EDNS0_SUBNET of q that was overwritten, if any.
+func (e *ecsPlugin) addECS(qCtx *query_context.Context) (upgraded bool, newECS bool, clientECS *dns.EDNS0_SUBNET) {
 	q := qCtx.Q()
 	opt := q.IsEdns0()
-	hasECS := opt != nil && dnsutils.GetECS(opt) != nil
-	if hasECS && !e.args.ForceOverwrite {
+	if opt != nil {
+		clientECS = dnsutils.GetECS(opt)
+	}
+	if clientECS != nil && !e.args.ForceOverwrite {
 		// Argument args.ForceOverwrite is disabled. q already has an edns0 subnet. Skip it.
-		return false, false
+		return false, false, nil
 	}
 
 	var ecs *dns.EDNS0_SUBNET
 	if e.args.Auto { // use client ip
-		clientAddr := qCtx.ReqMeta().ClientAddr
-		if !clientAddr.IsValid() {
-			return false, false
-		}
-
-		switch {
-		case clientAddr.Is4():
-			ecs = dnsutils.NewEDNS0Subnet(clientAddr.AsSlice(), uint8(e.args.Mask4), false)
-		case clientAddr.Is4In6():
-			ecs = dnsutils.NewEDNS0Subnet(clientAddr.Unmap().AsSlice(), uint8(e.args.Mask4), false)
-		case clientAddr.Is6():
-			ecs = dnsutils.NewEDNS0Subnet(clientAddr.AsSlice(), uint8(e.args.Mask6), true)
-		}
-	} else { // use preset ip
-		switch {
-		case checkQueryType(q, dns.TypeA):
-			if e.ipv4.IsValid() {
-				ecs = dnsutils.NewEDNS0Subnet(e.ipv4.AsSlice(), uint8(e.args.Mask4), false)
-			} else if e.ipv6.IsValid() {
-				ecs = dnsutils.NewEDNS0Subnet(e.ipv6.AsSlice(), uint8(e.args.Mask6), true)
-			}
-
-		case checkQueryType(q, dns.TypeAAAA):
-			if e.ipv6.IsValid() {
-				ecs = dnsutils.NewEDNS0Subnet(e.ipv6.AsSlice(), uint8(e.args.Mask6), true)
-			} else if e.ipv4.IsValid() {
-				ecs = dnsutils.NewEDNS0Subnet(e.ipv4.AsSlice(), uint8(e.args.Mask4), false)
-			}
-		}
+		ecs = e.clientAddrECS(qCtx.ReqMeta().ClientAddr)
+	}
+	if ecs == nil && (!e.args.Auto || e.args.SkipPrivate) { // use preset ip
+		ecs = e.presetECS(q)
 	}
 
 	if ecs != nil {
@@ -190,9 +184,66 @@ func (e *ecsPlugin) addECS(qCtx *query_context.Context) (upgraded bool, newECS b
 			opt = dnsutils.UpgradeEDNS0(q)
 		}
 		newECS = dnsutils.AddECS(opt, ecs, true)
-		return upgraded, newECS
+		return upgraded, newECS, clientECS
 	}
-	return false, false
+	return false, false, nil
+}
+
+func (e *ecsPlugin) clientAddrECS(clientAddr netip.Addr) *dns.EDNS0_SUBNET {
+	clientAddr = clientAddr.Unmap()
+	if !clientAddr.IsValid() {
+		return nil
+	}
+	if e.args.SkipPrivate && !isPublicAddr(clientAddr) {
+		return nil
+	}
+	if clientAddr.Is4() {
+		return dnsutils.NewEDNS0Subnet(clientAddr.AsSlice(), uint8(e.args.Mask4), false)
+	}
+	return dnsutils.NewEDNS0Subnet(clientAddr.AsSlice(), uint8(e.args.Mask6), true)
+}
+
+func (e *ecsPlugin) presetECS(q *dns.Msg) *dns.EDNS0_SUBNET {
+	switch {
+	case checkQueryType(q, dns.TypeA):
+		if e.ipv4.IsValid() {
+			return dnsutils.NewEDNS0Subnet(e.ipv4.AsSlice(), uint8(e.args.Mask4), false)
+		} else if e.ipv6.IsValid() {
+			return dnsutils.NewEDNS0Subnet(e.ipv6.AsSlice(), uint8(e.args.Mask6), true)
+		}
+
+	case checkQueryType(q, dns.TypeAAAA):
+		if e.ipv6.IsValid() {
+			return dnsutils.NewEDNS0Subnet(e.ipv6.AsSlice(), uint8(e.args.Mask6), true)
+		} else if e.ipv4.IsValid() {
+			return dnsutils.NewEDNS0Subnet(e.ipv4.AsSlice(), uint8(e.args.Mask4), false)
+		}
+	}
+	return nil
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// restoreECS replaces the ecs of r with the clientECS, as RFC 7871 7.2.1
+// requires. The scope prefix-length of r is kept, but not longer than the
+// source prefix-length of clientECS.
+func restoreECS(r *dns.Msg, clientECS *dns.EDNS0_SUBNET) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	rECS := dnsutils.GetECS(opt)
+	if rECS == nil {
+		return
+	}
+	ecs := *clientECS
+	ecs.SourceScope = rECS.SourceScope
+	if ecs.SourceScope > ecs.SourceNetmask {
+		ecs.SourceScope = ecs.SourceNetmask
+	}
+	dnsutils.AddECS(opt, &ecs, true)
 }
 
 func checkQueryType(m *dns.Msg, typ uint16) bool {
@@ -209,6 +260,11 @@ type noECS struct {
 var _ coremain.ExecutablePlugin = (*noECS)(nil)
 
 func (n *noECS) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	return stripECS(ctx, qCtx, next)
+}
+
+// stripECS removes ecs from the query and its response.
+func stripECS(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	dnsutils.RemoveMsgECS(qCtx.Q())
 	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
 		return err
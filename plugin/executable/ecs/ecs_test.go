@@ -54,6 +54,11 @@ func Test_ecsPlugin(t *testing.T) {
 		{"overwrite off", Args{Auto: true}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "1.2.3.4", true, true},
 		{"overwrite on", Args{Auto: true, ForceOverwrite: true}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "1.0.0.0", true, true},
 
+		{"skip private", Args{Auto: true, SkipPrivate: true, IPv4: "1.2.3.4"}, dns.TypeA, false, "", "192.168.1.1", "1.2.3.4", false, false},
+		{"skip private2", Args{Auto: true, SkipPrivate: true}, dns.TypeA, false, "", "::ffff:127.0.0.1", "", false, false},
+		{"skip private3", Args{Auto: true, SkipPrivate: true, IPv4: "1.2.3.4"}, dns.TypeA, false, "", "1.0.0.0", "1.0.0.0", false, false},
+		{"strip", Args{Strip: true, Auto: true}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "", true, false},
+
 		{"preset v4", Args{IPv4: "1.2.3.4"}, dns.TypeA, false, "", "", "1.2.3.4", false, false},
 		{"preset v6", Args{IPv6: "::1"}, dns.TypeA, false, "", "", "::1", false, false},
 		{"preset both", Args{IPv4: "1.2.3.4", IPv6: "::1"}, dns.TypeA, false, "", "", "1.2.3.4", false, false},
@@ -120,3 +125,36 @@ func Test_ecsPlugin(t *testing.T) {
 		})
 	}
 }
+
+func Test_ecsPlugin_restoreECS(t *testing.T) {
+	p, err := newPlugin(coremain.NewBP("ecs", PluginType, nil, nil), &Args{Auto: true, ForceOverwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(".", dns.TypeA)
+	dnsutils.AddECS(dnsutils.UpgradeEDNS0(q), dnsutils.NewEDNS0Subnet(net.IPv4(1, 2, 3, 0), 16, false), true)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rECS := dnsutils.NewEDNS0Subnet(net.IPv4(1, 0, 0, 0), 24, false)
+	rECS.SourceScope = 24
+	dnsutils.AddECS(dnsutils.UpgradeEDNS0(r), rECS, true)
+
+	qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("1.0.0.1")})
+	next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: r})
+	if err := p.Exec(context.Background(), qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+
+	e := dnsutils.GetMsgECS(qCtx.R())
+	if e == nil {
+		t.Fatal("missing response ecs")
+	}
+	if !e.Address.Equal(net.IPv4(1, 2, 3, 0)) || e.SourceNetmask != 16 {
+		t.Fatalf("want client ecs 1.2.3.0/16, got %s/%d", e.Address, e.SourceNetmask)
+	}
+	if e.SourceScope != 16 {
+		t.Fatalf("want scope 16, got %d", e.SourceScope)
+	}
+}
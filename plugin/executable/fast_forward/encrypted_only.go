@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+)
+
+func init() {
+	coremain.RegNewPersetPluginFunc("_encrypted_only", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return &encryptedOnly{BP: bp}, nil
+	})
+}
+
+var _ coremain.ExecutablePlugin = (*encryptedOnly)(nil)
+
+// encryptedOnly marks queries as encrypted only. fast_forward and
+// upstream_group will only forward them to dot and doh upstreams.
+type encryptedOnly struct {
+	*coremain.BP
+}
+
+func (e *encryptedOnly) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	qCtx.SetEncryptedOnly(true)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// isEncryptedAddr reports whether the upstream of addr encrypts queries.
+func isEncryptedAddr(addr string) bool {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return false // udp
+	}
+	switch addr[:i] {
+	case "tls", "https":
+		return true
+	}
+	return false
+}
+
+// isEncrypted reports whether u encrypts queries.
+func isEncrypted(u bundled_upstream.Upstream) bool {
+	e, ok := u.(interface{ Encrypted() bool })
+	return ok && e.Encrypted()
+}
+
+// filterEncrypted returns the encrypted upstreams in us.
+func filterEncrypted(us []bundled_upstream.Upstream) []bundled_upstream.Upstream {
+	var eus []bundled_upstream.Upstream
+	for _, u := range us {
+		if isEncrypted(u) {
+			eus = append(eus, u)
+		}
+	}
+	return eus
+}
+
+// failEncryptedOnly sets a SERVFAIL response with an extended dns error
+// for an encrypted only query that cannot be forwarded.
+func failEncryptedOnly(qCtx *query_context.Context, text string) {
+	r := dnsutils.GenEmptyReply(qCtx.Q(), dns.RcodeServerFailure)
+	dnsutils.AddEDE(qCtx.Q(), r, dns.ExtendedErrorCodeNetworkError, text)
+	qCtx.SetResponse(r)
+}
+
+// exchangeEncryptedOnly forwards the encrypted only query of qCtx to the
+// encrypted upstreams in us. It fails closed with a SERVFAIL response.
+func exchangeEncryptedOnly(ctx context.Context, qCtx *query_context.Context, us []bundled_upstream.Upstream, bp *coremain.BP) {
+	us = filterEncrypted(us)
+	if len(us) == 0 {
+		failEncryptedOnly(qCtx, "no encrypted upstream is available")
+		return
+	}
+	r, err := bundled_upstream.ExchangeParallel(ctx, qCtx, us, bp.L())
+	if err != nil {
+		bp.L().Warn("encrypted upstreams are unreachable", qCtx.InfoField(), zap.Error(err))
+		failEncryptedOnly(qCtx, "encrypted upstreams are unreachable")
+		return
+	}
+	qCtx.SetResponse(r)
+}
@@ -30,9 +30,12 @@ import (
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v4/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/transport"
 	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"io"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -56,22 +59,89 @@ type fastForward struct {
 type Args struct {
 	Upstream []*UpstreamConfig `yaml:"upstream"`
 	CA       []string          `yaml:"ca"`
+	Dnstap   string            `yaml:"dnstap"` // tag of a dnstap plugin that logs upstream exchanges.
+}
+
+// ForwarderTapper is implemented by plugins that log upstream exchanges,
+// e.g. dnstap.
+type ForwarderTapper interface {
+	// ForwarderTap returns a func that logs an exchange with the upstream
+	// addr. r is nil if the exchange failed.
+	ForwarderTap(addr string) func(q, r *dns.Msg, queryTime, responseTime time.Time)
 }
 
 type UpstreamConfig struct {
-	Addr         string `yaml:"addr"` // required
-	DialAddr     string `yaml:"dial_addr"`
-	Trusted      bool   `yaml:"trusted"`
-	Socks5       string `yaml:"socks5"`
-	SoMark       int    `yaml:"so_mark"`
-	BindToDevice string `yaml:"bind_to_device"`
+	Addr         string   `yaml:"addr"` // required
+	DialAddr     string   `yaml:"dial_addr"`
+	DialAddrs    []string `yaml:"dial_addrs"` // more pinned addresses, tried in order if the dial failed.
+	Trusted      bool     `yaml:"trusted"`
+	Socks5       string   `yaml:"socks5"`
+	SoMark       uint32   `yaml:"so_mark"`
+	BindToDevice string   `yaml:"bind_to_device"`
+	LocalAddr    string   `yaml:"local_addr"` // local ip address to send queries from.
+
+	IdleTimeout         int               `yaml:"idle_timeout"`
+	MaxConns            int               `yaml:"max_conns"`
+	MaxInflightPerConn  int               `yaml:"max_inflight_per_conn"`
+	KeepaliveProbes     int               `yaml:"keepalive_probes"`
+	KeepaliveQname      string            `yaml:"keepalive_qname"`
+	EnablePipeline      bool              `yaml:"enable_pipeline"`
+	EnableHTTP3         bool              `yaml:"enable_http3"`
+	Bootstrap           string            `yaml:"bootstrap"`
+	InsecureSkipVerify  bool              `yaml:"insecure_skip_verify"`
+	CertPinSHA256       []string          `yaml:"cert_pin_sha256"` // base64 or hex sha256 of server spki. With insecure_skip_verify, only pins are checked.
+	DoHMethod           string            `yaml:"doh_method"`      // "GET" (default) or "POST".
+	DoHHeaders          map[string]string `yaml:"doh_headers"`     // additional http headers.
+	ClientCert          string            `yaml:"client_cert"`     // client certificate for mutual TLS, used by dot, doh.
+	ClientKey           string            `yaml:"client_key"`
+	ClientKeyPassphrase string            `yaml:"client_key_passphrase"` // optional, if client_key is encrypted.
+	UDPBufferSize       int               `yaml:"udp_buffer_size"`
+	Enable0x20          bool              `yaml:"enable_0x20"` // randomize qname cases of udp queries, used by udp only.
+	Retry               *RetryConfig      `yaml:"retry"`       // used by udp, tcp, dot only.
+
+	Maintenance []*MaintenanceConfig `yaml:"maintenance"` // used by upstream_group only.
+}
+
+// RetryConfig configures the transport.RetryPolicy of an upstream.
+type RetryConfig struct {
+	MaxAttempts    int      `yaml:"max_attempts"`    // including the first attempt. Default is 4.
+	Backoff        int      `yaml:"backoff"`         // ms, doubles on each retry.
+	MaxBackoff     int      `yaml:"max_backoff"`     // ms
+	AttemptTimeout int      `yaml:"attempt_timeout"` // ms, required by "timeout" class.
+	RetryOn        []string `yaml:"retry_on"`        // conn_reset (default), timeout, servfail, refused.
+}
+
+const defaultRetryMaxAttempts = 4
 
-	IdleTimeout        int    `yaml:"idle_timeout"`
-	MaxConns           int    `yaml:"max_conns"`
-	EnablePipeline     bool   `yaml:"enable_pipeline"`
-	EnableHTTP3        bool   `yaml:"enable_http3"`
-	Bootstrap          string `yaml:"bootstrap"`
-	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+func (c *RetryConfig) policy() (*transport.RetryPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	maxAttempts := c.MaxAttempts
+	switch {
+	case maxAttempts < 0:
+		return nil, fmt.Errorf("invalid max_attempts %d", maxAttempts)
+	case maxAttempts == 0:
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	retryOn := transport.RetryOnConnReset
+	if len(c.RetryOn) > 0 {
+		var err error
+		retryOn, err = transport.ParseRetryClasses(c.RetryOn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if retryOn&transport.RetryOnTimeout != 0 && c.AttemptTimeout <= 0 {
+		return nil, errors.New("retry on timeout requires a positive attempt_timeout")
+	}
+	return &transport.RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		Backoff:        time.Duration(c.Backoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(c.MaxBackoff) * time.Millisecond,
+		AttemptTimeout: time.Duration(c.AttemptTimeout) * time.Millisecond,
+		RetryOn:        retryOn,
+	}, nil
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -83,84 +153,326 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 		return nil, errors.New("no upstream is configured")
 	}
 
+	b, err := newUpstreamBuilder(bp, args.CA)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setTapper(args.Dnstap); err != nil {
+		return nil, err
+	}
 	f := &fastForward{
 		BP:   bp,
 		args: args,
 	}
 
+	for i, c := range args.Upstream {
+		// Set first upstream as trusted upstream.
+		u, closer, err := b.build(c, i == 0)
+		if err != nil {
+			return nil, err
+		}
+		f.upstreamWrappers = append(f.upstreamWrappers, u)
+		if closer != nil {
+			f.upstreamsCloser = append(f.upstreamsCloser, closer)
+		}
+	}
+
+	return f, nil
+}
+
+// upstreamBuilder builds upstreams from UpstreamConfig.
+type upstreamBuilder struct {
+	bp      *coremain.BP
+	rootCAs *x509.CertPool
+
+	tcpFallbackTotal  *prometheus.CounterVec
+	tlsHandshakeTotal *prometheus.CounterVec
+	tlsResumedTotal   *prometheus.CounterVec
+	tls0RTTTotal      *prometheus.CounterVec
+
+	// Latency breakdown of udp, tcp and dot upstreams, from
+	// transport.ExchangeTrace.
+	dialDuration    *prometheus.HistogramVec
+	rtt             *prometheus.HistogramVec
+	connReusedTotal *prometheus.CounterVec
+
+	// Metrics of all upstreams.
+	queryTotal    *prometheus.CounterVec
+	errTotal      *prometheus.CounterVec
+	queryDuration *prometheus.HistogramVec
+	conns         *connsCollector
+
+	tapper ForwarderTapper // may be nil
+}
+
+// newUpstreamBuilder loads the ca files and registers upstream metrics
+// to bp.
+func newUpstreamBuilder(bp *coremain.BP, ca []string) (*upstreamBuilder, error) {
+	b := &upstreamBuilder{
+		bp: bp,
+		tcpFallbackTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcp_fallback_total",
+			Help: "The total number of truncated udp responses that were retried over tcp",
+		}, []string{"upstream"}),
+		tlsHandshakeTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_handshake_total",
+			Help: "The total number of tls handshakes with upstreams",
+		}, []string{"upstream"}),
+		tlsResumedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_resumed_total",
+			Help: "The total number of tls handshakes with upstreams that resumed a cached session",
+		}, []string{"upstream"}),
+		tls0RTTTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_0rtt_total",
+			Help: "The total number of quic handshakes with upstreams in which 0-RTT data was accepted",
+		}, []string{"upstream"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dial_duration_seconds",
+			Help:    "The duration of dialing new connections to upstreams, including tls handshakes",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"upstream"}),
+		rtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rtt_seconds",
+			Help:    "The duration between a query was written to an upstream and its response was received",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"upstream"}),
+		connReusedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "conn_reused_total",
+			Help: "The total number of queries that were sent over existing upstream connections",
+		}, []string{"upstream"}),
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_query_total",
+			Help: "The total number of queries that were sent to upstreams",
+		}, []string{"upstream"}),
+		errTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_err_total",
+			Help: "The total number of queries that upstreams failed to answer",
+		}, []string{"upstream"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_query_duration_seconds",
+			Help:    "The duration of successful upstream exchanges, including dialing and retries",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"upstream"}),
+		conns: newConnsCollector(),
+	}
+	bp.GetMetricsReg().MustRegister(
+		b.tcpFallbackTotal, b.tlsHandshakeTotal, b.tlsResumedTotal, b.tls0RTTTotal,
+		b.dialDuration, b.rtt, b.connReusedTotal,
+		b.queryTotal, b.errTotal, b.queryDuration, b.conns,
+	)
+
 	// rootCAs
-	var rootCAs *x509.CertPool
-	if len(args.CA) != 0 {
+	if len(ca) != 0 {
 		var err error
-		rootCAs, err = utils.LoadCertPool(args.CA)
+		b.rootCAs, err = utils.LoadCertPool(ca)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load ca: %w", err)
 		}
 	}
+	return b, nil
+}
 
-	for i, c := range args.Upstream {
-		if len(c.Addr) == 0 {
-			return nil, errors.New("missing server addr")
-		}
+// usesTransport reports whether the upstream of addr uses a
+// transport.Transport, which is the only one that applies RetryConfig
+// and supports transport.ExchangeTrace.
+func usesTransport(addr string) bool {
+	scheme := "udp"
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme = addr[:i]
+	}
+	switch scheme {
+	case "udp", "tcp", "tls":
+		return true
+	}
+	return false
+}
 
-		if strings.HasPrefix(c.Addr, "udpme://") {
-			u := newUDPME(c.Addr[8:], c.Trusted)
-			f.upstreamWrappers = append(f.upstreamWrappers, u)
-			if i == 0 {
-				u.trusted = true
-			}
-			continue
-		}
+// setTapper sets the ForwarderTapper of built upstreams to plugin tag.
+func (b *upstreamBuilder) setTapper(tag string) error {
+	if len(tag) == 0 {
+		return nil
+	}
+	t, ok := b.bp.M().GetPlugin(tag).(ForwarderTapper)
+	if !ok {
+		return fmt.Errorf("plugin %s is not found or cannot log upstream exchanges", tag)
+	}
+	b.tapper = t
+	return nil
+}
 
-		opt := &upstream.Opt{
-			DialAddr:       c.DialAddr,
-			Socks5:         c.Socks5,
-			SoMark:         c.SoMark,
-			BindToDevice:   c.BindToDevice,
-			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
-			MaxConns:       c.MaxConns,
-			EnablePipeline: c.EnablePipeline,
-			EnableHTTP3:    c.EnableHTTP3,
-			Bootstrap:      c.Bootstrap,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureSkipVerify,
-				RootCAs:            rootCAs,
-				ClientSessionCache: tls.NewLRUClientSessionCache(64),
-			},
-			Logger: bp.L(),
-		}
+// build builds an upstream from c. The returned io.Closer may be nil
+// if the upstream has nothing to close.
+func (b *upstreamBuilder) build(c *UpstreamConfig, trusted bool) (bundled_upstream.Upstream, io.Closer, error) {
+	if len(c.Addr) == 0 {
+		return nil, nil, errors.New("missing server addr")
+	}
 
-		u, err := upstream.NewUpstream(c.Addr, opt)
+	if strings.HasPrefix(c.Addr, "udpme://") {
+		return newUDPME(c.Addr[8:], trusted || c.Trusted), nil, nil
+	}
 
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		RootCAs:            b.rootCAs,
+	}
+	if len(c.CertPinSHA256) != 0 {
+		pins, err := utils.ParseSPKIPins(c.CertPinSHA256)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init upstream: %w", err)
+			return nil, nil, fmt.Errorf("failed to parse cert pins for upstream %s: %w", c.Addr, err)
 		}
-
-		w := &upstreamWrapper{
-			address: c.Addr,
-			trusted: c.Trusted,
-			u:       u,
+		tlsConfig.VerifyConnection = utils.NewSPKIPinVerifier(pins)
+	}
+	if len(c.ClientCert) != 0 || len(c.ClientKey) != 0 {
+		cert, err := utils.LoadKeyPair(c.ClientCert, c.ClientKey, c.ClientKeyPassphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load client certificate for upstream %s: %w", c.Addr, err)
 		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		if i == 0 { // Set first upstream as trusted upstream.
-			w.trusted = true
+	var dohUsePOST bool
+	switch strings.ToUpper(c.DoHMethod) {
+	case "", http.MethodGet:
+	case http.MethodPost:
+		dohUsePOST = true
+	default:
+		return nil, nil, fmt.Errorf("invalid doh method %s", c.DoHMethod)
+	}
+	var dohHeader http.Header
+	if len(c.DoHHeaders) > 0 {
+		dohHeader = make(http.Header, len(c.DoHHeaders))
+		for k, v := range c.DoHHeaders {
+			dohHeader.Set(k, v)
 		}
+	}
 
-		f.upstreamWrappers = append(f.upstreamWrappers, w)
-		f.upstreamsCloser = append(f.upstreamsCloser, u)
+	if c.Retry != nil && !usesTransport(c.Addr) {
+		return nil, nil, fmt.Errorf("retry is not supported by upstream %s, only udp, tcp and dot upstreams support it", c.Addr)
+	}
+	retryPolicy, err := c.Retry.policy()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid retry policy for upstream %s: %w", c.Addr, err)
 	}
 
-	return f, nil
+	opt := &upstream.Opt{
+		DialAddr:            c.DialAddr,
+		DialAddrs:           c.DialAddrs,
+		Socks5:              c.Socks5,
+		SoMark:              c.SoMark,
+		BindToDevice:        c.BindToDevice,
+		LocalAddr:           c.LocalAddr,
+		IdleTimeout:         time.Duration(c.IdleTimeout) * time.Second,
+		MaxConns:            c.MaxConns,
+		MaxInflightPerConn:  c.MaxInflightPerConn,
+		KeepaliveProbes:     c.KeepaliveProbes,
+		KeepaliveQname:      c.KeepaliveQname,
+		RetryPolicy:         retryPolicy,
+		EnablePipeline:      c.EnablePipeline,
+		EnableHTTP3:         c.EnableHTTP3,
+		Bootstrap:           c.Bootstrap,
+		UDPBufferSize:       c.UDPBufferSize,
+		Enable0x20:          c.Enable0x20,
+		TLSConfig:           tlsConfig,
+		DoHUsePOST:          dohUsePOST,
+		DoHHeader:           dohHeader,
+		Logger:              b.bp.L(),
+		TCPFallbackCounter:  b.tcpFallbackTotal.WithLabelValues(c.Addr),
+		TLSHandshakeCounter: b.tlsHandshakeTotal.WithLabelValues(c.Addr),
+		TLSResumedCounter:   b.tlsResumedTotal.WithLabelValues(c.Addr),
+		TLS0RTTCounter:      b.tls0RTTTotal.WithLabelValues(c.Addr),
+	}
+
+	u, err := upstream.NewUpstream(c.Addr, opt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to init upstream: %w", err)
+	}
+
+	w := &upstreamWrapper{
+		address:       c.Addr,
+		trusted:       trusted || c.Trusted,
+		encrypted:     isEncryptedAddr(c.Addr),
+		u:             u,
+		queryTotal:    b.queryTotal.WithLabelValues(c.Addr),
+		errTotal:      b.errTotal.WithLabelValues(c.Addr),
+		queryDuration: b.queryDuration.WithLabelValues(c.Addr),
+	}
+	if b.tapper != nil {
+		w.tap = b.tapper.ForwarderTap(c.Addr)
+	}
+	if usesTransport(c.Addr) {
+		w.dialDuration = b.dialDuration.WithLabelValues(c.Addr)
+		w.rtt = b.rtt.WithLabelValues(c.Addr)
+		w.connReused = b.connReusedTotal.WithLabelValues(c.Addr)
+	}
+	var closer io.Closer = u
+	if cs, ok := u.(upstream.ConnStatser); ok {
+		b.conns.add(c.Addr, cs)
+		closer = closerFunc(func() error {
+			b.conns.remove(cs)
+			return u.Close()
+		})
+	}
+	return w, closer, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
 }
 
 type upstreamWrapper struct {
-	address string
-	trusted bool
-	u       upstream.Upstream
+	address   string
+	trusted   bool
+	encrypted bool
+	u         upstream.Upstream
+
+	queryTotal    prometheus.Counter
+	errTotal      prometheus.Counter
+	queryDuration prometheus.Observer
+
+	tap func(q, r *dns.Msg, queryTime, responseTime time.Time) // may be nil
+
+	// Nil if the upstream does not support transport.ExchangeTrace.
+	dialDuration prometheus.Observer
+	rtt          prometheus.Observer
+	connReused   prometheus.Counter
 }
 
 func (u *upstreamWrapper) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	return u.u.ExchangeContext(ctx, q)
+	u.queryTotal.Inc()
+	start := time.Now()
+	r, err := u.exchange(ctx, q)
+	if err != nil {
+		u.errTotal.Inc()
+	} else {
+		u.queryDuration.Observe(time.Since(start).Seconds())
+	}
+	if u.tap != nil {
+		u.tap(q, r, start, time.Now())
+	}
+	return r, err
+}
+
+func (u *upstreamWrapper) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.rtt == nil {
+		return u.u.ExchangeContext(ctx, q)
+	}
+
+	var et transport.ExchangeTimings
+	r, err := u.u.ExchangeContext(transport.WithExchangeTrace(ctx, et.Trace()), q)
+	if d := et.Dial(); d > 0 {
+		u.dialDuration.Observe(d.Seconds())
+	}
+	if et.ConnReused {
+		u.connReused.Inc()
+	}
+	if err == nil {
+		if d := et.RTT(); d > 0 {
+			u.rtt.Observe(d.Seconds())
+		}
+	}
+	return r, err
 }
 
 func (u *upstreamWrapper) Address() string {
@@ -171,6 +483,10 @@ func (u *upstreamWrapper) Trusted() bool {
 	return u.trusted
 }
 
+func (u *upstreamWrapper) Encrypted() bool {
+	return u.encrypted
+}
+
 // Exec forwards qCtx.Q() to upstreams, and sets qCtx.R().
 // qCtx.Status() will be set as
 // - handler.ContextStatusResponded: if it received a response.
@@ -184,14 +500,30 @@ func (f *fastForward) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (f *fastForward) exec(ctx context.Context, qCtx *query_context.Context) (err error) {
+	if qCtx.EncryptedOnly() {
+		exchangeEncryptedOnly(ctx, qCtx, f.upstreamWrappers, f.BP)
+		return nil
+	}
 	r, err := bundled_upstream.ExchangeParallel(ctx, qCtx, f.upstreamWrappers, f.L())
 	if err != nil {
 		return err
 	}
+	if qCtx.TraceEnabled() {
+		qCtx.Tracef(f.Tag(), "response from upstream %s", qCtx.Upstream())
+	}
 	qCtx.SetResponse(r)
 	return nil
 }
 
+// ResetConnections closes all upstream connections.
+func (f *fastForward) ResetConnections() {
+	for _, u := range f.upstreamsCloser {
+		if r, ok := u.(upstream.ConnResetter); ok {
+			r.ResetConnections()
+		}
+	}
+}
+
 func (f *fastForward) Shutdown() error {
 	for _, u := range f.upstreamsCloser {
 		u.Close()
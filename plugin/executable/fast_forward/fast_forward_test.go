@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBP(tag string) *coremain.BP {
+	return coremain.NewBP(tag, PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil))
+}
+
+func TestRetryConfig_policy(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       *RetryConfig
+		want    *transport.RetryPolicy
+		wantErr bool
+	}{
+		{"nil", nil, nil, false},
+		{"defaults", &RetryConfig{}, &transport.RetryPolicy{MaxAttempts: 4, RetryOn: transport.RetryOnConnReset}, false},
+		{"custom", &RetryConfig{MaxAttempts: 2, Backoff: 10, AttemptTimeout: 500, RetryOn: []string{"timeout", "servfail"}}, &transport.RetryPolicy{
+			MaxAttempts:    2,
+			Backoff:        10 * time.Millisecond,
+			AttemptTimeout: 500 * time.Millisecond,
+			RetryOn:        transport.RetryOnTimeout | transport.RetryOnServfail,
+		}, false},
+		{"negative attempts", &RetryConfig{MaxAttempts: -1}, nil, true},
+		{"timeout without attempt timeout", &RetryConfig{RetryOn: []string{"timeout"}}, nil, true},
+		{"unknown class", &RetryConfig{RetryOn: []string{"nxdomain"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.c.policy()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("policy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("policy() = %+v, want nil", got)
+				}
+				return
+			}
+			if *got != *tt.want {
+				t.Fatalf("policy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_upstreamBuilder_build_retry(t *testing.T) {
+	b, err := newUpstreamBuilder(newTestBP("ff"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{"127.0.0.1:53", false},
+		{"udp://127.0.0.1:53", false},
+		{"tcp://127.0.0.1:53", false},
+		{"tls://127.0.0.1:853", false},
+		{"https://127.0.0.1/dns-query", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			_, closer, err := b.build(&UpstreamConfig{Addr: tt.addr, Retry: &RetryConfig{}}, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("build() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if closer != nil {
+				closer.Close()
+			}
+		})
+	}
+}
+
+// startTestDNSServer starts a tcp dns server that answers every query
+// with an empty response.
+func startTestDNSServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		w.WriteMsg(r)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return l.Addr().String()
+}
+
+func Test_upstreamWrapper_Exchange_trace(t *testing.T) {
+	b, err := newUpstreamBuilder(newTestBP("ff"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "tcp://" + startTestDNSServer(t)
+	u, closer, err := b.build(&UpstreamConfig{Addr: addr}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, err := u.Exchange(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(b.dialDuration, b.rtt, b.connReusedTotal, b.queryTotal, b.errTotal, b.queryDuration, b.conns)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]uint64)
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		if h := m.GetHistogram(); h != nil {
+			got[mf.GetName()] = h.GetSampleCount()
+		} else if g := m.GetGauge(); g != nil {
+			got[mf.GetName()] = uint64(g.GetValue())
+		} else {
+			got[mf.GetName()] = uint64(m.GetCounter().GetValue())
+		}
+	}
+	want := map[string]uint64{
+		"dial_duration_seconds": 1,
+		"rtt_seconds":           2,
+		"conn_reused_total":     1,
+
+		"upstream_query_total":            2,
+		"upstream_err_total":              0,
+		"upstream_query_duration_seconds": 2,
+		"upstream_conns_open":             1,
+		"upstream_conns_idle":             1,
+	}
+	for name, n := range want {
+		if got[name] != n {
+			t.Errorf("%s: want %d, got %d", name, n, got[name])
+		}
+	}
+}
+
+type encryptedFakeUpstream struct {
+	*fakeUpstream
+}
+
+func (encryptedFakeUpstream) Encrypted() bool { return true }
+
+func Test_exchangeEncryptedOnly(t *testing.T) {
+	newQCtx := func() *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		return query_context.NewContext(q, nil)
+	}
+	bp := newTestBP("ff")
+
+	plain := newFakeUpstream("udp://127.0.0.1")
+	qCtx := newQCtx()
+	exchangeEncryptedOnly(context.Background(), qCtx, []bundled_upstream.Upstream{plain}, bp)
+	if n := atomic.LoadInt32(&plain.queries); n != 0 {
+		t.Fatalf("plaintext upstream received %d queries", n)
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want a servfail response, got %v", r)
+	}
+	ede, ok := dnsutils.GetEDNS0Option(r.IsEdns0(), dns.EDNS0EDE).(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Fatalf("want a network error ede, got %v", r.IsEdns0())
+	}
+
+	encrypted := encryptedFakeUpstream{newFakeUpstream("tls://127.0.0.1")}
+	qCtx = newQCtx()
+	exchangeEncryptedOnly(context.Background(), qCtx, []bundled_upstream.Upstream{plain, encrypted}, bp)
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("want a response from the encrypted upstream, got %v", r)
+	}
+	if atomic.LoadInt32(&plain.queries) != 0 || atomic.LoadInt32(&encrypted.queries) != 1 {
+		t.Fatal("query is not forwarded to the encrypted upstream only")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cron_spec"
+	"go.uber.org/zap"
+	"time"
+)
+
+const maintenanceCheckInterval = time.Second * 10
+
+// MaintenanceConfig is a maintenance window of an upstream. It is used
+// by upstream_group only. During the window, the upstream is drained from
+// the group.
+type MaintenanceConfig struct {
+	// Cron is the start of the windows in local time, e.g. "0 3 * * *"
+	// for 03:00 every day. Required.
+	Cron string `yaml:"cron"`
+
+	// Duration (sec) of the windows. Required.
+	Duration uint `yaml:"duration"`
+
+	// Ramp (sec) is optional. Before a window starts, the share of queries
+	// sent to the upstream decreases linearly from all to none over this
+	// period, so its load is moved to other members gradually.
+	Ramp uint `yaml:"ramp"`
+}
+
+type maintenanceWindow struct {
+	spec     *cron_spec.Spec
+	duration time.Duration
+	ramp     time.Duration
+}
+
+// maintenanceSchedule is the maintenance windows of an upstream.
+type maintenanceSchedule []maintenanceWindow
+
+func newMaintenanceSchedule(cfgs []*MaintenanceConfig) (maintenanceSchedule, error) {
+	var s maintenanceSchedule
+	for _, c := range cfgs {
+		spec, err := cron_spec.Parse(c.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if c.Duration == 0 {
+			return nil, errors.New("missing maintenance duration")
+		}
+		s = append(s, maintenanceWindow{
+			spec:     spec,
+			duration: time.Duration(c.Duration) * time.Second,
+			ramp:     time.Duration(c.Ramp) * time.Second,
+		})
+	}
+	return s, nil
+}
+
+// weight returns the share of queries that the upstream should receive
+// at t. It is 0 during a window, 1 out of windows and their ramps.
+func (s maintenanceSchedule) weight(t time.Time) float64 {
+	w := 1.0
+	for _, win := range s {
+		if win.active(t) {
+			return 0
+		}
+		if d, ok := win.nextStartWithin(t, win.ramp); ok {
+			if rw := float64(d) / float64(win.ramp); rw < w {
+				w = rw
+			}
+		}
+	}
+	return w
+}
+
+// active reports whether t is in a window, which starts at a minute that
+// matches the spec and lasts for duration.
+func (w maintenanceWindow) active(t time.Time) bool {
+	for m := t.Truncate(time.Minute); t.Sub(m) < w.duration; m = m.Add(-time.Minute) {
+		if w.spec.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStartWithin returns the time until the next window starts, if it
+// starts within d.
+func (w maintenanceWindow) nextStartWithin(t time.Time, d time.Duration) (time.Duration, bool) {
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Sub(t) <= d; m = m.Add(time.Minute) {
+		if w.spec.Match(m) {
+			return m.Sub(t), true
+		}
+	}
+	return 0, false
+}
+
+// updateMaintenance updates the weights of the members from their
+// maintenance schedules.
+func (g *upstreamGroup) updateMaintenance(now time.Time) {
+	g.m.RLock()
+	weights := make(map[*groupMember]float64)
+	for _, m := range g.members {
+		if len(m.schedule) > 0 {
+			weights[m] = 0
+		}
+	}
+	g.m.RUnlock()
+
+	for m := range weights {
+		weights[m] = m.schedule.weight(now)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	for m, w := range weights {
+		withheld := 1 - w
+		switch {
+		case withheld == 1 && m.withheld != 1:
+			g.L().Info("upstream maintenance started", zap.String("addr", m.cfg.Addr))
+		case withheld != 1 && m.withheld == 1:
+			g.L().Info("upstream maintenance ended", zap.String("addr", m.cfg.Addr))
+		}
+		m.withheld = withheld
+	}
+}
+
+func (g *upstreamGroup) maintenanceLoop() {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			g.updateMaintenance(now)
+		case <-g.closeNotify:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/bundled_upstream"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_maintenanceSchedule_weight(t *testing.T) {
+	s, err := newMaintenanceSchedule([]*MaintenanceConfig{{Cron: "0 3 * * *", Duration: 1800, Ramp: 600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 11, 7, 3, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		t    time.Time
+		want float64
+	}{
+		{"long before", start.Add(-time.Hour), 1},
+		{"ramp begins", start.Add(-time.Minute * 10), 1},
+		{"half ramp", start.Add(-time.Minute * 5), 0.5},
+		{"window starts", start, 0},
+		{"in window", start.Add(time.Minute * 29), 0},
+		{"window ends", start.Add(time.Minute * 30), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.weight(tt.t); got != tt.want {
+				t.Fatalf("weight() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, c := range []*MaintenanceConfig{{Cron: "0 3 * *", Duration: 60}, {Cron: "0 3 * * *"}} {
+		if _, err := newMaintenanceSchedule([]*MaintenanceConfig{c}); err == nil {
+			t.Fatalf("want an error from invalid config %+v", c)
+		}
+	}
+}
+
+func Test_upstreamGroup_maintenance(t *testing.T) {
+	u1, u2, fb := newFakeUpstream("u1"), newFakeUpstream("u2"), newFakeUpstream("fallback")
+	g := newTestGroup(t, u1, u2)
+	g.fallback = []bundled_upstream.Upstream{fb}
+	s, err := newMaintenanceSchedule([]*MaintenanceConfig{{Cron: "0 3 * * *", Duration: 1800}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range g.members {
+		m.schedule = s
+	}
+	start := time.Date(2022, 11, 7, 3, 0, 0, 0, time.Local)
+
+	g.updateMaintenance(start)
+	if l := g.list(); !l[0].Maintenance || l[0].Weight != 0 {
+		t.Fatalf("member is not in maintenance, %+v", l[0])
+	}
+	if _, err := execGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&fb.queries) != 1 || atomic.LoadInt32(&u1.queries)+atomic.LoadInt32(&u2.queries) != 0 {
+		t.Fatal("query is not sent to the fallback")
+	}
+
+	g.updateMaintenance(start.Add(time.Hour))
+	if _, err := execGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&fb.queries) != 1 {
+		t.Fatal("fallback is used after maintenance")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	connsOpenDesc = prometheus.NewDesc(
+		"upstream_conns_open",
+		"The number of open connections to the upstream",
+		[]string{"upstream"}, nil,
+	)
+	connsIdleDesc = prometheus.NewDesc(
+		"upstream_conns_idle",
+		"The number of open connections to the upstream without inflight queries",
+		[]string{"upstream"}, nil,
+	)
+)
+
+// connsCollector exports the connection pool stats of upstreams.
+type connsCollector struct {
+	m  sync.Mutex
+	us map[upstream.ConnStatser]string // upstream addresses
+}
+
+func newConnsCollector() *connsCollector {
+	return &connsCollector{us: make(map[upstream.ConnStatser]string)}
+}
+
+func (c *connsCollector) add(addr string, u upstream.ConnStatser) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.us[u] = addr
+}
+
+func (c *connsCollector) remove(u upstream.ConnStatser) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.us, u)
+}
+
+func (c *connsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connsOpenDesc
+	ch <- connsIdleDesc
+}
+
+func (c *connsCollector) Collect(ch chan<- prometheus.Metric) {
+	type stats struct{ open, idle int }
+	byAddr := make(map[string]*stats) // upstreams may have the same address
+	c.m.Lock()
+	for u, addr := range c.us {
+		s := byAddr[addr]
+		if s == nil {
+			s = new(stats)
+			byAddr[addr] = s
+		}
+		cs := u.ConnStats()
+		s.open += cs.Open
+		s.idle += cs.Idle
+	}
+	c.m.Unlock()
+
+	for addr, s := range byAddr {
+		ch <- prometheus.MustNewConstMetric(connsOpenDesc, prometheus.GaugeValue, float64(s.open), addr)
+		ch <- prometheus.MustNewConstMetric(connsIdleDesc, prometheus.GaugeValue, float64(s.idle), addr)
+	}
+}
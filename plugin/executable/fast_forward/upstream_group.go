@@ -0,0 +1,354 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const GroupPluginType = "upstream_group"
+
+func init() {
+	coremain.RegNewPluginFunc(GroupPluginType, InitGroup, func() interface{} { return new(GroupArgs) })
+}
+
+var _ coremain.ExecutablePlugin = (*upstreamGroup)(nil)
+
+var (
+	errNoActiveMember = errors.New("no active upstream in group")
+	errMemberNotFound = errors.New("upstream not found")
+	errDupMember      = errors.New("upstream already exists")
+	errGroupClosed    = errors.New("group closed")
+)
+
+// GroupArgs is the args of upstream_group. Members are identified by
+// their addr, which must be unique in the group.
+type GroupArgs struct {
+	Upstream []*UpstreamConfig `yaml:"upstream"`
+	CA       []string          `yaml:"ca"`
+	Dnstap   string            `yaml:"dnstap"` // tag of a dnstap plugin that logs upstream exchanges.
+
+	// Fallback upstreams are used when no member is active, e.g. all of
+	// them are draining or in maintenance. They cannot be changed via api.
+	Fallback []*UpstreamConfig `yaml:"fallback"`
+}
+
+// upstreamGroup forwards queries to its active members in parallel like
+// fast_forward. Members can be added, removed and drained at runtime
+// via its api.
+type upstreamGroup struct {
+	*coremain.BP
+	b *upstreamBuilder
+
+	fallback        []bundled_upstream.Upstream
+	fallbackClosers []io.Closer
+
+	m       sync.RWMutex
+	closed  bool
+	members []*groupMember
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+type groupMember struct {
+	cfg    *UpstreamConfig
+	u      bundled_upstream.Upstream
+	closer io.Closer // may be nil
+
+	schedule maintenanceSchedule
+
+	// Protected by upstreamGroup.m.
+	draining bool
+	withheld float64 // share of queries withheld by schedule, 1 during a window.
+
+	inflight int64
+	wg       sync.WaitGroup
+}
+
+// groupUpstream overrides the Trusted of a member.
+type groupUpstream struct {
+	bundled_upstream.Upstream
+	trusted bool
+}
+
+func (u groupUpstream) Trusted() bool {
+	return u.trusted
+}
+
+func InitGroup(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newUpstreamGroup(bp, args.(*GroupArgs))
+}
+
+func newUpstreamGroup(bp *coremain.BP, args *GroupArgs) (_ *upstreamGroup, err error) {
+	b, err := newUpstreamBuilder(bp, args.CA)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setTapper(args.Dnstap); err != nil {
+		return nil, err
+	}
+	g := &upstreamGroup{BP: bp, b: b, closeNotify: make(chan struct{})}
+	defer func() {
+		if err != nil {
+			g.Close()
+		}
+	}()
+	for _, c := range args.Upstream {
+		if err := g.add(c); err != nil {
+			return nil, fmt.Errorf("failed to add upstream %s, %w", c.Addr, err)
+		}
+	}
+	for _, c := range args.Fallback {
+		u, closer, err := b.build(c, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init fallback upstream %s, %w", c.Addr, err)
+		}
+		g.fallback = append(g.fallback, groupUpstream{Upstream: u, trusted: len(g.fallback) == 0 || c.Trusted})
+		if closer != nil {
+			g.fallbackClosers = append(g.fallbackClosers, closer)
+		}
+	}
+	go g.maintenanceLoop()
+	return g, nil
+}
+
+// Exec forwards qCtx.Q() to active members, and sets qCtx.R().
+// Members with trusted set and the first active member are trusted.
+// If no member is active, the fallback upstreams are used.
+func (g *upstreamGroup) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	us, release := g.acquire()
+	defer release()
+	if len(us) == 0 {
+		us = g.fallback
+	}
+	if qCtx.EncryptedOnly() {
+		exchangeEncryptedOnly(ctx, qCtx, us, g.BP)
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	if len(us) == 0 {
+		return errNoActiveMember
+	}
+	r, err := bundled_upstream.ExchangeParallel(ctx, qCtx, us, g.L())
+	if err != nil {
+		return err
+	}
+	qCtx.SetResponse(r)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// acquire returns the active members. Members that are ramping down
+// before maintenance are randomly skipped by their withheld share, unless
+// no other member and no fallback upstream is available.
+// Removed members will not be closed until release is called.
+func (g *upstreamGroup) acquire() (us []bundled_upstream.Upstream, release func()) {
+	var acquired []*groupMember
+	take := func(m *groupMember) {
+		m.wg.Add(1)
+		atomic.AddInt64(&m.inflight, 1)
+		acquired = append(acquired, m)
+		us = append(us, groupUpstream{Upstream: m.u, trusted: len(us) == 0 || m.cfg.Trusted})
+	}
+
+	g.m.RLock()
+	var skipped []*groupMember
+	for _, m := range g.members {
+		if m.draining || m.withheld == 1 {
+			continue
+		}
+		if m.withheld > 0 && rand.Float64() < m.withheld {
+			skipped = append(skipped, m)
+			continue
+		}
+		take(m)
+	}
+	if len(acquired) == 0 && len(g.fallback) == 0 {
+		for _, m := range skipped {
+			take(m)
+		}
+	}
+	g.m.RUnlock()
+
+	return us, func() {
+		for _, m := range acquired {
+			atomic.AddInt64(&m.inflight, -1)
+			m.wg.Done()
+		}
+	}
+}
+
+// add builds an upstream from c and adds it to the group.
+func (g *upstreamGroup) add(c *UpstreamConfig) error {
+	if g.find(c.Addr) != nil {
+		return errDupMember
+	}
+	schedule, err := newMaintenanceSchedule(c.Maintenance)
+	if err != nil {
+		return fmt.Errorf("invalid maintenance config, %w", err)
+	}
+	u, closer, err := g.b.build(c, false)
+	if err != nil {
+		return err
+	}
+	m := &groupMember{cfg: c, u: u, closer: closer, schedule: schedule}
+	if len(schedule) > 0 {
+		m.withheld = 1 - schedule.weight(time.Now())
+	}
+
+	g.m.Lock()
+	err = nil
+	switch {
+	case g.closed:
+		err = errGroupClosed
+	case g.findLocked(c.Addr) != nil:
+		err = errDupMember
+	default:
+		g.members = append(g.members, m)
+	}
+	g.m.Unlock()
+	if err != nil {
+		m.close()
+		return err
+	}
+	g.L().Info("upstream added", zap.String("addr", c.Addr))
+	return nil
+}
+
+// remove removes the member from the group. It will be closed after its
+// inflight queries are finished.
+func (g *upstreamGroup) remove(addr string) error {
+	g.m.Lock()
+	var removed *groupMember
+	for i, m := range g.members {
+		if m.cfg.Addr == addr {
+			removed = m
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.m.Unlock()
+	if removed == nil {
+		return errMemberNotFound
+	}
+
+	g.L().Info("upstream removed", zap.String("addr", addr))
+	go func() {
+		removed.wg.Wait()
+		removed.close()
+	}()
+	return nil
+}
+
+// setDraining sets whether the member is draining. Draining members
+// are kept in the group but receive no new queries.
+func (g *upstreamGroup) setDraining(addr string, draining bool) error {
+	g.m.Lock()
+	m := g.findLocked(addr)
+	if m != nil {
+		m.draining = draining
+	}
+	g.m.Unlock()
+	if m == nil {
+		return errMemberNotFound
+	}
+	g.L().Info("upstream draining state changed", zap.String("addr", addr), zap.Bool("draining", draining))
+	return nil
+}
+
+func (g *upstreamGroup) find(addr string) *groupMember {
+	g.m.RLock()
+	defer g.m.RUnlock()
+	return g.findLocked(addr)
+}
+
+func (g *upstreamGroup) findLocked(addr string) *groupMember {
+	for _, m := range g.members {
+		if m.cfg.Addr == addr {
+			return m
+		}
+	}
+	return nil
+}
+
+// MemberStatus is the status of a group member returned by the api.
+type MemberStatus struct {
+	Addr     string `json:"addr"`
+	Trusted  bool   `json:"trusted"`
+	Draining bool   `json:"draining"`
+	Inflight int64  `json:"inflight"`
+
+	// Maintenance is true during a maintenance window. Weight is the
+	// share of queries sent to the member by its maintenance schedule.
+	Maintenance bool    `json:"maintenance"`
+	Weight      float64 `json:"weight"`
+}
+
+func (g *upstreamGroup) list() []MemberStatus {
+	g.m.RLock()
+	defer g.m.RUnlock()
+	s := make([]MemberStatus, 0, len(g.members))
+	for _, m := range g.members {
+		s = append(s, MemberStatus{
+			Addr:        m.cfg.Addr,
+			Trusted:     m.cfg.Trusted,
+			Draining:    m.draining,
+			Inflight:    atomic.LoadInt64(&m.inflight),
+			Maintenance: m.withheld == 1,
+			Weight:      1 - m.withheld,
+		})
+	}
+	return s
+}
+
+// Close closes all members. It always returns a nil error.
+func (g *upstreamGroup) Close() error {
+	g.closeOnce.Do(func() { close(g.closeNotify) })
+	for _, c := range g.fallbackClosers {
+		c.Close()
+	}
+	g.fallbackClosers = nil
+	g.m.Lock()
+	ms := g.members
+	g.members = nil
+	g.closed = true
+	g.m.Unlock()
+	for _, m := range ms {
+		m.close()
+	}
+	return nil
+}
+
+func (m *groupMember) close() {
+	if m.closer != nil {
+		m.closer.Close()
+	}
+}
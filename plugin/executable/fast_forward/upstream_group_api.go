@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ServeHTTP serves the api of the plugin.
+//
+//	GET    /members                 list members.
+//	POST   /members                 add a member, body is an upstream config in json or yaml.
+//	DELETE /members?addr=           remove a member after its inflight queries finished.
+//	POST   /members/drain?addr=     stop sending new queries to a member.
+//	POST   /members/undrain?addr=   resume sending queries to a member.
+func (g *upstreamGroup) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	addr := req.URL.Query().Get("addr")
+	switch {
+	case strings.HasSuffix(path, "/members"):
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, g.list())
+		case http.MethodPost:
+			g.handleAdd(w, req)
+		case http.MethodDelete:
+			writeMemberResult(w, g.remove(addr))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasSuffix(path, "/members/drain"), strings.HasSuffix(path, "/members/undrain"):
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeMemberResult(w, g.setDraining(addr, strings.HasSuffix(path, "/drain")))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (g *upstreamGroup) handleAdd(w http.ResponseWriter, req *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(req.Body, 64*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c := new(UpstreamConfig)
+	if err := yaml.Unmarshal(b, c); err != nil { // json is also valid yaml.
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body, %w", err))
+		return
+	}
+	if err := g.add(c); err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errDupMember) {
+			code = http.StatusConflict
+		}
+		writeError(w, code, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeMemberResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errMemberNotFound):
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUpstream replies empty responses. If block is not nil, queries
+// are blocked until block is closed.
+type fakeUpstream struct {
+	addr     string
+	received chan struct{}
+	block    chan struct{}
+	queries  int32
+	closed   int32
+}
+
+func newFakeUpstream(addr string) *fakeUpstream {
+	return &fakeUpstream{addr: addr, received: make(chan struct{}, 16)}
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	u.received <- struct{}{}
+	if u.block != nil {
+		select {
+		case <-u.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+func (u *fakeUpstream) Trusted() bool   { return true }
+func (u *fakeUpstream) Address() string { return u.addr }
+
+func (u *fakeUpstream) Close() error {
+	atomic.StoreInt32(&u.closed, 1)
+	return nil
+}
+
+func (u *fakeUpstream) isClosed() bool {
+	return atomic.LoadInt32(&u.closed) == 1
+}
+
+func newTestGroup(t *testing.T, fakes ...*fakeUpstream) *upstreamGroup {
+	t.Helper()
+	g, err := newUpstreamGroup(newTestBP("group"), &GroupArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	for _, u := range fakes {
+		g.members = append(g.members, &groupMember{cfg: &UpstreamConfig{Addr: u.addr}, u: u, closer: u})
+	}
+	return g
+}
+
+func execGroup(g *upstreamGroup) (*query_context.Context, error) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	return qCtx, g.Exec(ctx, qCtx, nil)
+}
+
+func Test_upstreamGroup_add(t *testing.T) {
+	g := newTestGroup(t)
+	if _, err := execGroup(g); !errors.Is(err, errNoActiveMember) {
+		t.Fatalf("want errNoActiveMember from an empty group, got %v", err)
+	}
+
+	c := &UpstreamConfig{Addr: "udp://127.0.0.1:53"}
+	if err := g.add(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.add(&UpstreamConfig{Addr: c.Addr}); !errors.Is(err, errDupMember) {
+		t.Fatalf("want errDupMember, got %v", err)
+	}
+	if err := g.add(&UpstreamConfig{}); err == nil {
+		t.Fatal("want an error from an invalid upstream config")
+	}
+	if l := g.list(); len(l) != 1 || l[0].Addr != c.Addr {
+		t.Fatalf("unexpected members %v", l)
+	}
+
+	g.Close()
+	if err := g.add(&UpstreamConfig{Addr: "udp://127.0.0.2:53"}); !errors.Is(err, errGroupClosed) {
+		t.Fatalf("want errGroupClosed, got %v", err)
+	}
+}
+
+func Test_upstreamGroup_remove_inflight(t *testing.T) {
+	u := newFakeUpstream("u1")
+	u.block = make(chan struct{})
+	g := newTestGroup(t, u)
+
+	type result struct {
+		qCtx *query_context.Context
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		qCtx, err := execGroup(g)
+		done <- result{qCtx, err}
+	}()
+	<-u.received
+
+	if err := g.remove("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.remove("u1"); !errors.Is(err, errMemberNotFound) {
+		t.Fatalf("want errMemberNotFound, got %v", err)
+	}
+	if l := g.list(); len(l) != 0 {
+		t.Fatalf("removed member is still listed, %v", l)
+	}
+	if _, err := execGroup(g); !errors.Is(err, errNoActiveMember) {
+		t.Fatalf("removed member still receives queries, %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if u.isClosed() {
+		t.Fatal("member is closed while its query is inflight")
+	}
+
+	close(u.block)
+	res := <-done
+	if res.err != nil || res.qCtx.R() == nil {
+		t.Fatalf("inflight query failed, %v", res.err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !u.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("member is not closed after its inflight query finished")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func Test_upstreamGroup_drain(t *testing.T) {
+	u1, u2 := newFakeUpstream("u1"), newFakeUpstream("u2")
+	g := newTestGroup(t, u1, u2)
+
+	if err := g.setDraining("u1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.setDraining("u3", true); !errors.Is(err, errMemberNotFound) {
+		t.Fatalf("want errMemberNotFound, got %v", err)
+	}
+	if _, err := execGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&u1.queries); n != 0 {
+		t.Fatalf("draining member received %d queries", n)
+	}
+	if n := atomic.LoadInt32(&u2.queries); n != 1 {
+		t.Fatalf("active member received %d queries", n)
+	}
+	if l := g.list(); len(l) != 2 || !l[0].Draining || l[1].Draining {
+		t.Fatalf("unexpected members %v", l)
+	}
+
+	if err := g.setDraining("u1", false); err != nil {
+		t.Fatal(err)
+	}
+	us, release := g.acquire()
+	release()
+	if len(us) != 2 {
+		t.Fatalf("want 2 active members after undrain, got %d", len(us))
+	}
+}
+
+func Test_upstreamGroup_ServeHTTP(t *testing.T) {
+	g := newTestGroup(t, newFakeUpstream("u1"))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, "/plugins/group"+path, strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"add yaml", http.MethodPost, "/members", "addr: udp://127.0.0.1:53\ntrusted: true", http.StatusCreated},
+		{"add json", http.MethodPost, "/members", `{"addr": "tcp://127.0.0.1:53"}`, http.StatusCreated},
+		{"add dup", http.MethodPost, "/members", "addr: udp://127.0.0.1:53", http.StatusConflict},
+		{"add invalid body", http.MethodPost, "/members", "addr: [", http.StatusBadRequest},
+		{"add invalid config", http.MethodPost, "/members", "addr: ''", http.StatusBadRequest},
+		{"drain", http.MethodPost, "/members/drain?addr=u1", "", http.StatusNoContent},
+		{"drain unknown", http.MethodPost, "/members/drain?addr=u9", "", http.StatusNotFound},
+		{"drain wrong method", http.MethodGet, "/members/drain?addr=u1", "", http.StatusMethodNotAllowed},
+		{"undrain", http.MethodPost, "/members/undrain?addr=u1", "", http.StatusNoContent},
+		{"remove", http.MethodDelete, "/members?addr=tcp://127.0.0.1:53", "", http.StatusNoContent},
+		{"remove unknown", http.MethodDelete, "/members?addr=tcp://127.0.0.1:53", "", http.StatusNotFound},
+		{"wrong method", http.MethodPut, "/members", "", http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodGet, "/nothing", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(tt.method, tt.path, tt.body); w.Code != tt.wantCode {
+				t.Fatalf("want %d, got %d, %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := do(http.MethodGet, "/members", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	var l []MemberStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	want := []MemberStatus{{Addr: "u1", Weight: 1}, {Addr: "udp://127.0.0.1:53", Trusted: true, Weight: 1}}
+	if len(l) != len(want) || l[0] != want[0] || l[1] != want[1] {
+		t.Fatalf("want members %v, got %v", want, l)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filter_answer
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const PluginType = "filter_answer"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*filterAnswer)(nil)
+
+// Args of the filter_answer plugin. Types are type names, e.g. "AAAA",
+// or "TYPE" followed by the type number, e.g. "TYPE65".
+type Args struct {
+	// Types are record types that are removed from all sections.
+	Types []string `yaml:"types"`
+
+	// IPs are ranges of A and AAAA records that are removed from the answer
+	// and additional sections. It has the same format as the ip of
+	// response_matcher.
+	IPs []string `yaml:"ips"`
+
+	// Limits are the maximum numbers of records of types in the answer
+	// section, e.g. {A: 2}. The first records are kept.
+	Limits map[string]int `yaml:"limits"`
+}
+
+// filterAnswer removes records from the response. If all records are
+// removed from a NOERROR answer, the response becomes NODATA with a SOA
+// record. Like ttl, it applies to the current response and executes the
+// rest of the sequence.
+type filterAnswer struct {
+	*coremain.BP
+	types  map[uint16]struct{}
+	ips    *netlist.MatcherGroup // nil if Args.IPs is empty.
+	limits map[uint16]int
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newFilterAnswer(bp, args.(*Args))
+}
+
+func newFilterAnswer(bp *coremain.BP, args *Args) (*filterAnswer, error) {
+	p := &filterAnswer{
+		BP:     bp,
+		types:  make(map[uint16]struct{}),
+		limits: make(map[uint16]int),
+	}
+	for _, s := range args.Types {
+		t, err := parseType(s)
+		if err != nil {
+			return nil, err
+		}
+		p.types[t] = struct{}{}
+	}
+	for s, n := range args.Limits {
+		t, err := parseType(s)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid limit %d of %s", n, s)
+		}
+		p.limits[t] = n
+	}
+	if len(args.IPs) > 0 {
+		ips, err := netlist.BatchLoadProvider(args.IPs, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ips, %w", err)
+		}
+		p.ips = ips
+	}
+	return p, nil
+}
+
+func parseType(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, nil
+	}
+	if n, ok := cutPrefix(s, "TYPE"); ok {
+		t, err := strconv.ParseUint(n, 10, 16)
+		if err == nil {
+			return uint16(t), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid type %s", s)
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+func (p *filterAnswer) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := qCtx.R(); r != nil {
+		p.filter(qCtx.Q(), r)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *filterAnswer) filter(q, r *dns.Msg) {
+	hadAnswer := len(r.Answer) > 0
+	counts := make(map[uint16]int)
+	r.Answer = p.filterSection(r.Answer, true, counts)
+	r.Ns = p.filterSection(r.Ns, false, nil)
+	r.Extra = p.filterSection(r.Extra, true, nil)
+
+	if hadAnswer && len(r.Answer) == 0 && r.Rcode == dns.RcodeSuccess {
+		if _, hasSOA := dnsutils.GetNegativeTTL(r); !hasSOA && len(q.Question) == 1 {
+			r.Ns = append(r.Ns, dnsutils.FakeSOA(q.Question[0].Name))
+		}
+	}
+}
+
+// filterSection removes records from rrs in place. If filterIPs is true,
+// A and AAAA records in p.ips are removed. If counts is not nil, records
+// are limited by p.limits.
+func (p *filterAnswer) filterSection(rrs []dns.RR, filterIPs bool, counts map[uint16]int) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == dns.TypeOPT {
+			kept = append(kept, rr)
+			continue
+		}
+		if _, ok := p.types[t]; ok {
+			continue
+		}
+		if filterIPs && p.ips != nil && p.inIPs(rr) {
+			continue
+		}
+		if counts != nil {
+			if limit, ok := p.limits[t]; ok {
+				if counts[t] >= limit {
+					continue
+				}
+				counts[t]++
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+func (p *filterAnswer) inIPs(rr dns.RR) bool {
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	default:
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	matched, _ := p.ips.Match(addr.Unmap())
+	return matched
+}
+
+func (p *filterAnswer) Close() error {
+	if p.ips != nil {
+		_ = p.ips.Close()
+	}
+	return nil
+}
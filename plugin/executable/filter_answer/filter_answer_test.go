@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filter_answer
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_filterAnswer(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	p, err := newFilterAnswer(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Types:  []string{"hinfo", "TYPE65"},
+		IPs:    []string{"10.0.0.0/8", "fc00::/7"},
+		Limits: map[string]int{"A": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	exec := func(rrs ...string) *dns.Msg {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Answer = append(r.Answer, rr)
+		}
+		r.SetEdns0(1232, false)
+		qCtx := query_context.NewContext(q, nil)
+		qCtx.SetResponse(r)
+		if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+
+	r := exec(
+		"example.com. 300 IN CNAME a.example.com.",
+		"a.example.com. 300 IN A 10.0.0.1",
+		"a.example.com. 300 IN A 1.1.1.1",
+		"a.example.com. 300 IN A 1.1.1.2",
+		"a.example.com. 300 IN A 1.1.1.3",
+		"a.example.com. 300 IN AAAA fd00::1",
+		"a.example.com. 300 IN AAAA 2001:db8::1",
+		"a.example.com. 300 IN HINFO cpu os",
+		`a.example.com. 300 IN HTTPS 1 . alpn="h2"`,
+	)
+	var got []string
+	for _, rr := range r.Answer {
+		got = append(got, rr.String())
+	}
+	want := []string{
+		"example.com.\t300\tIN\tCNAME\ta.example.com.",
+		"a.example.com.\t300\tIN\tA\t1.1.1.1",
+		"a.example.com.\t300\tIN\tA\t1.1.1.2",
+		"a.example.com.\t300\tIN\tAAAA\t2001:db8::1",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+	if r.IsEdns0() == nil {
+		t.Fatal("opt record is removed")
+	}
+
+	// All records are removed.
+	r = exec("example.com. 300 IN A 10.0.0.1")
+	if len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("want a nodata response, got %v", r)
+	}
+
+	if _, err := newFilterAnswer(coremain.NewBP("test", PluginType, nil, m), &Args{Types: []string{"NOTATYPE"}}); err == nil {
+		t.Fatal("invalid type should be rejected")
+	}
+}
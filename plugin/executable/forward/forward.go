@@ -124,18 +124,24 @@ func (f *forwardPlugin) Exec(ctx context.Context, qCtx *query_context.Context, n
 
 func (f *forwardPlugin) exec(ctx context.Context, qCtx *query_context.Context) error {
 	type res struct {
-		r   *dns.Msg
-		err error
+		r    *dns.Msg
+		addr string
+		err  error
 	}
 	// Remainder: Always makes a copy of q. dnsproxy/upstream may keep or even modify the q in their
 	// Exchange() calls.
 	q := qCtx.Q().Copy()
 	c := make(chan res, 1)
 	go func() {
-		r, _, err := upstream.ExchangeParallel(f.upstreams, q)
+		r, u, err := upstream.ExchangeParallel(f.upstreams, q)
+		var addr string
+		if u != nil {
+			addr = u.Address()
+		}
 		c <- res{
-			r:   r,
-			err: err,
+			r:    r,
+			addr: addr,
+			err:  err,
 		}
 	}()
 
@@ -145,6 +151,7 @@ func (f *forwardPlugin) exec(ctx context.Context, qCtx *query_context.Context) e
 			return res.err
 		}
 		qCtx.SetResponse(res.r)
+		qCtx.SetUpstream(res.addr)
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
@@ -20,14 +20,20 @@
 package hosts
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
 	"io"
+	"net/http"
+	"strings"
+	"time"
 )
 
 const PluginType = "hosts"
@@ -36,47 +42,195 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
 }
 
+const (
+	defaultURLReloadInterval = time.Hour
+	urlRetryInterval         = time.Minute
+	urlFetchTimeout          = time.Second * 30
+	maxURLDataSize           = 64 * 1024 * 1024
+)
+
 var _ coremain.ExecutablePlugin = (*hostsPlugin)(nil)
 
+// Args of the hosts plugin. Entries are in the format of "pattern ip...".
+// A pattern "*.parent" matches all subdomains of the parent. Files, URLs
+// and data providers can also be in the format of system hosts files
+// ("ip name...").
 type Args struct {
 	Hosts []string `yaml:"hosts"`
+
+	// Files are hosts files. They are reloaded automatically when
+	// they are changed.
+	Files []string `yaml:"files"`
+
+	// URLs are http(s) urls of hosts files. They are reloaded every
+	// URLReloadInterval (sec, default 3600). If a url cannot be fetched,
+	// its last data is kept.
+	URLs              []string `yaml:"urls"`
+	URLReloadInterval int      `yaml:"url_reload_interval"`
+
+	// PTR answers PTR queries of addresses in the entries.
+	PTR bool `yaml:"ptr"`
 }
 
 type hostsPlugin struct {
 	*coremain.BP
-	h             *hosts.Hosts
-	matcherCloser io.Closer
+	h           *hosts.Hosts
+	mg          *domain.MatcherGroup[*hosts.IPs]
+	closeNotify chan struct{}
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 	return newHostsContainer(bp, args.(*Args))
 }
 
-func newHostsContainer(bp *coremain.BP, args *Args) (*hostsPlugin, error) {
-	staticMatcher := domain.NewMixMatcher[*hosts.IPs]()
-	staticMatcher.SetDefaultMatcher(domain.MatcherFull)
-	m, err := domain.BatchLoadProvider[*hosts.IPs](
-		args.Hosts,
-		staticMatcher,
-		hosts.ParseIPs,
-		bp.M().GetDataManager(),
-		func(b []byte) (domain.Matcher[*hosts.IPs], error) {
-			mixMatcher := domain.NewMixMatcher[*hosts.IPs]()
-			mixMatcher.SetDefaultMatcher(domain.MatcherFull)
-			if err := domain.LoadFromTextReader[*hosts.IPs](mixMatcher, bytes.NewReader(b), hosts.ParseIPs); err != nil {
+func newHostsContainer(bp *coremain.BP, args *Args) (_ *hostsPlugin, err error) {
+	p := &hostsPlugin{
+		BP:          bp,
+		mg:          new(domain.MatcherGroup[*hosts.IPs]),
+		closeNotify: make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	var ptr *hosts.PTRIndex
+	if args.PTR {
+		ptr = hosts.NewPTRIndex()
+	}
+	parserFunc := func(source string) func(b []byte) (domain.Matcher[*hosts.IPs], error) {
+		return func(b []byte) (domain.Matcher[*hosts.IPs], error) {
+			entries, err := hosts.ParseHostsFile(b)
+			if err != nil {
 				return nil, err
 			}
-			return mixMatcher, nil
-		},
-	)
+			m, err := hosts.NewMatcher(entries)
+			if err != nil {
+				return nil, err
+			}
+			if ptr != nil {
+				ptr.Update(source, entries)
+			}
+			return m, nil
+		}
+	}
+
+	var static []hosts.Entry
+	var providerMatchers []domain.Matcher[*hosts.IPs]
+	for _, s := range args.Hosts {
+		if tag, ok := cutPrefix(s, "provider:"); ok {
+			provider := bp.M().GetDataManager().GetDataProvider(tag)
+			if provider == nil {
+				return nil, fmt.Errorf("cannot find provider %s", tag)
+			}
+			m := domain.NewDynamicMatcher[*hosts.IPs](parserFunc(s))
+			if err := provider.LoadAndAddListener(m); err != nil {
+				return nil, fmt.Errorf("failed to load data from provider %s, %w", tag, err)
+			}
+			providerMatchers = append(providerMatchers, m)
+			p.mg.AppendCloser(func() { provider.DeleteListener(m) })
+			continue
+		}
+		pattern, v, err := hosts.ParseIPs(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load data %s: %w", s, err)
+		}
+		static = append(static, hosts.Entry{Pattern: pattern, IPs: v})
+	}
+	staticMatcher, err := hosts.NewMatcher(static)
 	if err != nil {
 		return nil, err
 	}
-	return &hostsPlugin{
-		BP:            bp,
-		h:             hosts.NewHosts(m),
-		matcherCloser: m,
-	}, nil
+	p.mg.Append(staticMatcher)
+	for _, m := range providerMatchers {
+		p.mg.Append(m)
+	}
+	if ptr != nil {
+		ptr.Update("", static)
+	}
+
+	for _, file := range args.Files {
+		provider, err := data_provider.NewDataProvider(bp.L(), data_provider.DataProviderConfig{File: file, AutoReload: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file %s, %w", file, err)
+		}
+		p.mg.AppendCloser(provider.Close)
+		m := domain.NewDynamicMatcher[*hosts.IPs](parserFunc("file:" + file))
+		if err := provider.LoadAndAddListener(m); err != nil {
+			return nil, fmt.Errorf("failed to load file %s, %w", file, err)
+		}
+		p.mg.Append(m)
+	}
+
+	interval := time.Duration(args.URLReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultURLReloadInterval
+	}
+	for _, u := range args.URLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("%s is not a http or https url", u)
+		}
+		m := domain.NewDynamicMatcher[*hosts.IPs](parserFunc("url:" + u))
+		if err := m.Update(nil); err != nil { // empty until the url is loaded.
+			return nil, err
+		}
+		p.mg.Append(m)
+		go p.urlLoop(u, m, interval)
+	}
+
+	if ptr != nil {
+		p.h = hosts.NewHostsWithPTR(p.mg, ptr)
+	} else {
+		p.h = hosts.NewHosts(p.mg)
+	}
+	return p, nil
+}
+
+// urlLoop loads the hosts file from u to m every interval, until the
+// plugin is closed. Failed loads are retried sooner.
+func (h *hostsPlugin) urlLoop(u string, m *domain.DynamicMatcher[*hosts.IPs], interval time.Duration) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if err := h.loadURL(u, m); err != nil {
+				h.L().Warn("failed to load hosts url", zap.String("url", u), zap.Error(err))
+				timer.Reset(urlRetryInterval)
+				continue
+			}
+			h.L().Info("hosts url loaded", zap.String("url", u))
+			timer.Reset(interval)
+		case <-h.closeNotify:
+			return
+		}
+	}
+}
+
+func (h *hostsPlugin) loadURL(u string, m *domain.DynamicMatcher[*hosts.IPs]) error {
+	ctx, cancel := context.WithTimeout(context.Background(), urlFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxURLDataSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxURLDataSize {
+		return errors.New("hosts file is too large")
+	}
+	return m.Update(b)
 }
 
 func (h *hostsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -90,6 +244,14 @@ func (h *hostsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (h *hostsPlugin) Close() error {
-	_ = h.matcherCloser.Close()
+	close(h.closeNotify)
+	_ = h.mg.Close()
 	return nil
 }
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
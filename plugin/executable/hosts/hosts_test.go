@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_hostsPlugin_sources(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(file, []byte("192.168.1.1 file.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("url.lan 192.168.1.2\n"))
+	}))
+	defer srv.Close()
+
+	p, err := newHostsContainer(coremain.NewBP("hosts", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil)), &Args{
+		Hosts: []string{"static.lan 192.168.1.3"},
+		Files: []string{file},
+		URLs:  []string{srv.URL},
+		PTR:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	lookup := func(name string, typ uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, typ)
+		qCtx := query_context.NewContext(q, nil)
+		if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(&executable_seq.DummyExecutable{})); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+	waitFor := func(name string, typ uint16) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			if r := lookup(name, typ); r != nil && len(r.Answer) > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		t.Fatalf("%s is not answered", name)
+	}
+
+	waitFor("static.lan.", dns.TypeA)
+	waitFor("file.lan.", dns.TypeA)
+	waitFor("url.lan.", dns.TypeA)
+	waitFor("2.1.168.192.in-addr.arpa.", dns.TypePTR)
+
+	// Files are reloaded when they are changed.
+	if err := os.WriteFile(file, []byte("192.168.1.4 file2.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("file2.lan.", dns.TypeA)
+	waitFor("4.1.168.192.in-addr.arpa.", dns.TypePTR)
+}
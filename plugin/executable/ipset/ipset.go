@@ -34,6 +34,34 @@ type Args struct {
 	SetName6 string `yaml:"set_name6"`
 	Mask4    int    `yaml:"mask4"` // default 24
 	Mask6    int    `yaml:"mask6"` // default 32
+
+	// Aggregate4 and Aggregate6 enable prefix aggregation. Contiguous
+	// prefixes will be merged into a larger prefix that is at most
+	// Aggregate4/6 bits shorter than Mask4/6. Aggregated entries
+	// are TTL-aware and will be removed from the set once expired.
+	// Zero disables aggregation (entries will never be removed). Max is 8.
+	Aggregate4 int    `yaml:"aggregate4"`
+	Aggregate6 int    `yaml:"aggregate6"`
+	MinTTL     uint32 `yaml:"min_ttl"` // (sec) minimum lifetime of aggregated entries and ttl timeouts, default 300
+
+	// CreateSet creates missing sets as hash:net sets at startup. Sets are
+	// created with the timeout extension if Timeout or TTLTimeout is set.
+	CreateSet bool `yaml:"create_set"`
+
+	// Timeout (sec) of new entries. The sets must have the timeout
+	// extension. Zero means the default timeout of the set.
+	Timeout uint32 `yaml:"timeout"`
+
+	// TTLTimeout uses the TTL of the record as the timeout of new entries,
+	// but at least MinTTL. It overrides Timeout.
+	TTLTimeout bool `yaml:"ttl_timeout"`
+
+	// Async updates the sets in background workers, so a slow kernel never
+	// delays the response. The response may reach the client before its
+	// IPs are in the sets. IPs are dropped if the queue is full.
+	Async     bool `yaml:"async"`
+	QueueSize int  `yaml:"queue_size"` // default 1024
+	Workers   int  `yaml:"workers"`    // default 1
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
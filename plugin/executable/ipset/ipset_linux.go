@@ -25,20 +25,42 @@ import (
 	"context"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/batch_queue"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/ip_aggregator"
+	"github.com/IrineSistiana/mosdns/v4/pkg/ipset_utils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
-	"github.com/nadoo/ipset"
 	"go.uber.org/zap"
 	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAggregateMinTTL = 300
+	expireCheckInterval    = time.Second * 10
 )
 
 var _ coremain.ExecutablePlugin = (*ipsetPlugin)(nil)
+var _ coremain.Shutdowner = (*ipsetPlugin)(nil)
 
 type ipsetPlugin struct {
 	*coremain.BP
 	args *Args
-	nl   *ipset.NetLink
+	nl   *ipset_utils.Conn
+	q    *batch_queue.Queue[ipItem] // nil if async is disabled
+
+	// aggMu serializes aggregator updates, so set changes are applied
+	// in the same order as they were generated.
+	aggMu      sync.Mutex
+	agg4, agg6 *ip_aggregator.Aggregator // nil if aggregation is disabled
+	// stale has prefixes that may remain in the sets after failed
+	// updates, by set name. Guarded by aggMu.
+	stale       map[string][]netip.Prefix
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	expirerDone chan struct{} // closed when the expirer exited.
 }
 
 func newIpsetPlugin(bp *coremain.BP, args *Args) (*ipsetPlugin, error) {
@@ -48,17 +70,69 @@ func newIpsetPlugin(bp *coremain.BP, args *Args) (*ipsetPlugin, error) {
 	if args.Mask6 == 0 {
 		args.Mask6 = 32
 	}
+	if args.MinTTL == 0 {
+		args.MinTTL = defaultAggregateMinTTL
+	}
 
-	nl, err := ipset.Init()
+	nl, err := ipset_utils.Dial()
 	if err != nil {
 		return nil, err
 	}
 
-	return &ipsetPlugin{
-		BP:   bp,
-		args: args,
-		nl:   nl,
-	}, nil
+	if args.CreateSet {
+		opts := ipset_utils.CreateOpts{}
+		if args.hasTimeout() {
+			opts.Timeout = args.Timeout
+			if opts.Timeout == 0 {
+				opts.Timeout = args.MinTTL
+			}
+		}
+		for _, s := range [...]struct {
+			name string
+			ipv6 bool
+		}{{args.SetName4, false}, {args.SetName6, true}} {
+			if len(s.name) == 0 {
+				continue
+			}
+			opts.IPv6 = s.ipv6
+			if err := nl.Create(s.name, opts); err != nil {
+				nl.Close()
+				return nil, err
+			}
+		}
+	}
+
+	p := &ipsetPlugin{
+		BP:          bp,
+		args:        args,
+		nl:          nl,
+		stale:       make(map[string][]netip.Prefix),
+		closeNotify: make(chan struct{}),
+		expirerDone: make(chan struct{}),
+	}
+	if len(args.SetName4) > 0 && args.Aggregate4 > 0 {
+		p.agg4 = ip_aggregator.NewAggregator(ip_aggregator.Opts{Mask: args.Mask4, MaxMerge: args.Aggregate4})
+	}
+	if len(args.SetName6) > 0 && args.Aggregate6 > 0 {
+		p.agg6 = ip_aggregator.NewAggregator(ip_aggregator.Opts{Mask: args.Mask6, MaxMerge: args.Aggregate6})
+	}
+	if p.agg4 != nil || p.agg6 != nil {
+		go p.startExpirer()
+	} else {
+		close(p.expirerDone)
+	}
+	if args.Async {
+		p.q = batch_queue.New(batch_queue.Opts{Size: args.QueueSize, Workers: args.Workers}, func(batch []ipItem) {
+			if err := p.addItems(batch); err != nil {
+				p.L().Warn("failed to add queued IPs to ipset", zap.Int("ips", len(batch)), zap.Error(err))
+			}
+		})
+	}
+	return p, nil
+}
+
+func (args *Args) hasTimeout() bool {
+	return args.Timeout > 0 || args.TTLTimeout
 }
 
 func (p *ipsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -74,10 +148,188 @@ func (p *ipsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (p *ipsetPlugin) Close() error {
+	return p.Shutdown(context.Background())
+}
+
+// Shutdown waits for queued IPs, then stops the expirer and waits for
+// its pending set changes before closing the netlink handle.
+func (p *ipsetPlugin) Shutdown(ctx context.Context) error {
+	if p.q != nil {
+		if err := p.q.Shutdown(ctx); err != nil {
+			p.L().Warn("ipset queue was not drained in time", zap.Int("pending", p.q.Len()), zap.Error(err))
+		}
+	}
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+	})
+	select {
+	case <-p.expirerDone:
+	case <-ctx.Done():
+		p.L().Warn("ipset expirer did not exit in time", zap.Error(ctx.Err()))
+	}
 	return p.nl.Close()
 }
 
-func (p *ipsetPlugin) addIPSet(r *dns.Msg) error {
+// startExpirer removes expired aggregated entries from the sets periodically.
+func (p *ipsetPlugin) startExpirer() {
+	defer close(p.expirerDone)
+	ticker := time.NewTicker(expireCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case now := <-ticker.C:
+			p.aggMu.Lock()
+			for _, s := range [...]struct {
+				name string
+				agg  *ip_aggregator.Aggregator
+			}{{p.args.SetName4, p.agg4}, {p.args.SetName6, p.agg6}} {
+				if s.agg == nil {
+					continue
+				}
+				if _, ok := p.stale[s.name]; ok {
+					if err := p.resync(s.name, s.agg); err != nil {
+						p.L().Warn("failed to resync ipset", zap.String("set", s.name), zap.Error(err))
+					}
+				}
+				if err := p.applyDiff(s.name, s.agg, s.agg.Expire(now)); err != nil {
+					p.L().Warn("failed to remove expired entries from ipset", zap.String("set", s.name), zap.Error(err))
+				}
+			}
+			p.aggMu.Unlock()
+		}
+	}
+}
+
+// applyDiff applies d of agg to the set. New prefixes are added before
+// the old ones are deleted, so there is no gap during the change.
+// ipset has no transactions, so if a half of d fails, the set is
+// resynced from agg, now or by the expirer later.
+// Caller must hold p.aggMu.
+func (p *ipsetPlugin) applyDiff(setName string, agg *ip_aggregator.Aggregator, d ip_aggregator.Diff) error {
+	err := p.update(setName, d.Add, d.Del)
+	if err == nil {
+		return nil
+	}
+	p.stale[setName] = append(p.stale[setName], d.Del...)
+	if rerr := p.resync(setName, agg); rerr != nil {
+		p.L().Warn("failed to resync ipset, will retry later", zap.String("set", setName), zap.Error(rerr))
+	}
+	return err
+}
+
+// resync makes the set match agg after failed updates. Prefixes of agg
+// are added again, and stale prefixes that agg does not have are deleted.
+// Caller must hold p.aggMu.
+func (p *ipsetPlugin) resync(setName string, agg *ip_aggregator.Aggregator) error {
+	installed := agg.Installed()
+	keep := make(map[netip.Prefix]struct{}, len(installed))
+	for _, prefix := range installed {
+		keep[prefix] = struct{}{}
+	}
+	var del []netip.Prefix
+	for _, prefix := range p.stale[setName] {
+		if _, ok := keep[prefix]; !ok {
+			del = append(del, prefix)
+		}
+	}
+	if err := p.update(setName, installed, del); err != nil {
+		return err
+	}
+	delete(p.stale, setName)
+	return nil
+}
+
+func (p *ipsetPlugin) update(setName string, add, del []netip.Prefix) error {
+	if len(add) > 0 {
+		// Aggregated entries are removed by the expirer, they should
+		// not expire by the default timeout of the set.
+		if err := p.nl.Add(setName, p.toEntries(add, 0)); err != nil {
+			return err
+		}
+	}
+	if len(del) > 0 {
+		if err := p.nl.Del(setName, p.toEntries(del, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ipsetPlugin) toEntries(prefixes []netip.Prefix, timeout uint32) []ipset_utils.Entry {
+	entries := make([]ipset_utils.Entry, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		entries = append(entries, ipset_utils.Entry{Prefix: prefix, Timeout: timeout, HasTimeout: p.args.hasTimeout()})
+	}
+	return entries
+}
+
+// setBatch collects the changes of a response to a set.
+type setBatch struct {
+	setName string
+	mask    int
+	agg     *ip_aggregator.Aggregator
+
+	entries []ipset_utils.Entry // used if agg is nil
+	diff    ip_aggregator.Diff  // used if agg is not nil
+}
+
+func (p *ipsetPlugin) add(b *setBatch, addr netip.Addr, ttl uint32) {
+	if b.agg != nil {
+		if ttl < p.args.MinTTL {
+			ttl = p.args.MinTTL
+		}
+		b.diff.Merge(b.agg.Add(addr, time.Duration(ttl)*time.Second, time.Now()))
+		return
+	}
+
+	prefix := netip.PrefixFrom(addr, b.mask).Masked()
+	e := ipset_utils.Entry{Prefix: prefix}
+	if p.args.hasTimeout() {
+		e.HasTimeout = true
+		e.Timeout = p.args.Timeout
+		if p.args.TTLTimeout {
+			if ttl < p.args.MinTTL {
+				ttl = p.args.MinTTL
+			}
+			e.Timeout = ttl
+		}
+	}
+	for i := range b.entries {
+		if b.entries[i].Prefix == prefix {
+			if e.Timeout > b.entries[i].Timeout {
+				b.entries[i].Timeout = e.Timeout
+			}
+			return
+		}
+	}
+	b.entries = append(b.entries, e)
+}
+
+// applyBatch sends all changes of b to the set in one batch.
+// Caller must hold p.aggMu if b has an aggregator.
+func (p *ipsetPlugin) applyBatch(b *setBatch) error {
+	if b.agg == nil {
+		if len(b.entries) == 0 {
+			return nil
+		}
+		return p.nl.Add(b.setName, b.entries)
+	}
+	return p.applyDiff(b.setName, b.agg, b.diff)
+}
+
+// ipItem is an address from a response.
+type ipItem struct {
+	addr netip.Addr
+	ttl  uint32
+}
+
+// addIPSet adds the addresses in r to the sets, or queues them if async
+// is enabled. Invalid records are skipped, the first error is returned
+// after other records were added.
+func (p *ipsetPlugin) addIPSet(r *dns.Msg) (err error) {
+	var items []ipItem
 	for i := range r.Answer {
 		switch rr := r.Answer[i].(type) {
 		case *dns.A:
@@ -86,11 +338,12 @@ func (p *ipsetPlugin) addIPSet(r *dns.Msg) error {
 			}
 			addr, ok := netip.AddrFromSlice(rr.A.To4())
 			if !ok {
-				return fmt.Errorf("invalid A record with ip: %s", rr.A)
-			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName4, netip.PrefixFrom(addr, p.args.Mask4)); err != nil {
-				return err
+				if err == nil {
+					err = fmt.Errorf("invalid A record with ip: %s", rr.A)
+				}
+				continue
 			}
+			items = append(items, ipItem{addr: addr, ttl: rr.Hdr.Ttl})
 
 		case *dns.AAAA:
 			if len(p.args.SetName6) == 0 {
@@ -98,15 +351,72 @@ func (p *ipsetPlugin) addIPSet(r *dns.Msg) error {
 			}
 			addr, ok := netip.AddrFromSlice(rr.AAAA.To16())
 			if !ok {
-				return fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
-			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName6, netip.PrefixFrom(addr, p.args.Mask6)); err != nil {
-				return err
+				if err == nil {
+					err = fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
+				}
+				continue
 			}
+			items = append(items, ipItem{addr: addr, ttl: rr.Hdr.Ttl})
 		default:
 			continue
 		}
 	}
 
-	return nil
+	if p.q != nil {
+		dropped := 0
+		for _, item := range items {
+			if !p.useTTL() {
+				// So the same address is deduplicated in the queue.
+				item.ttl = 0
+			}
+			if !p.q.Push(item) {
+				dropped++
+			}
+		}
+		if dropped > 0 && err == nil {
+			err = fmt.Errorf("queue is full, %d ips dropped", dropped)
+		}
+		return err
+	}
+
+	if addErr := p.addItems(items); addErr != nil && err == nil {
+		err = addErr
+	}
+	return err
+}
+
+// useTTL reports whether the ttl of records affects the sets.
+func (p *ipsetPlugin) useTTL() bool {
+	return p.agg4 != nil || p.agg6 != nil || p.args.TTLTimeout
+}
+
+// addItems adds items to the sets in one batch per set.
+func (p *ipsetPlugin) addItems(items []ipItem) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+	b4 := setBatch{setName: p.args.SetName4, mask: p.args.Mask4, agg: p.agg4}
+	b6 := setBatch{setName: p.args.SetName6, mask: p.args.Mask6, agg: p.agg6}
+
+	// Hold the lock while generating diffs, so diffs of concurrent
+	// batches will not interleave.
+	if p.agg4 != nil || p.agg6 != nil {
+		p.aggMu.Lock()
+		defer p.aggMu.Unlock()
+	}
+
+	for _, item := range items {
+		if item.addr.Is4() {
+			p.add(&b4, item.addr, item.ttl)
+		} else {
+			p.add(&b6, item.addr, item.ttl)
+		}
+	}
+
+	for _, b := range [...]*setBatch{&b4, &b6} {
+		if applyErr := p.applyBatch(b); applyErr != nil && err == nil {
+			err = applyErr
+		}
+	}
+	return err
 }
@@ -32,9 +32,16 @@ func init() {
 type Args struct {
 	SetName4 string `yaml:"set_bash_name4"`
 	SetName6 string `yaml:"set_bash_name6"`
-	Mask4    int    `yaml:"mask4"` // default 24
-	Mask6    int    `yaml:"mask6"` // default 32
-	Tagnum   int64    `yaml:"tagnum"` // default 0 
+	Mask4    int    `yaml:"mask4"`  // default 24
+	Mask6    int    `yaml:"mask6"`  // default 32
+	Tagnum   int64  `yaml:"tagnum"` // default 0
+
+	// Async runs the scripts in background workers, so slow scripts never
+	// delay the response. IPs that are already queued are deduplicated.
+	// IPs are dropped if the queue is full.
+	Async     bool `yaml:"async"`
+	QueueSize int  `yaml:"queue_size"` // default 1024
+	Workers   int  `yaml:"workers"`    // default 4
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
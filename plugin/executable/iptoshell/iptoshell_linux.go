@@ -25,6 +25,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/batch_queue"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/miekg/dns"
@@ -35,10 +36,18 @@ import (
 )
 
 var _ coremain.ExecutablePlugin = (*iptoshellPlugin)(nil)
+var _ coremain.Shutdowner = (*iptoshellPlugin)(nil)
 
 type iptoshellPlugin struct {
 	*coremain.BP
 	args *Args
+	q    *batch_queue.Queue[ipItem] // nil if async is disabled
+}
+
+// ipItem is an address from a response.
+type ipItem struct {
+	addr  netip.Addr
+	qname string
 }
 
 func newiptoshellPlugin(bp *coremain.BP, args *Args) (*iptoshellPlugin, error) {
@@ -49,11 +58,17 @@ func newiptoshellPlugin(bp *coremain.BP, args *Args) (*iptoshellPlugin, error) {
 		args.Mask6 = 32
 	}
 
-
-	return &iptoshellPlugin{
+	p := &iptoshellPlugin{
 		BP:   bp,
 		args: args,
-	}, nil
+	}
+	if args.Async {
+		if args.Workers == 0 {
+			args.Workers = 4
+		}
+		p.q = batch_queue.New(batch_queue.Opts{Size: args.QueueSize, Workers: args.Workers}, p.runBatch)
+	}
+	return p, nil
 }
 
 func (p *iptoshellPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -68,9 +83,56 @@ func (p *iptoshellPlugin) Exec(ctx context.Context, qCtx *query_context.Context,
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+func (p *iptoshellPlugin) Close() error {
+	return p.Shutdown(context.Background())
+}
+
+// Shutdown waits for the queued IPs.
+func (p *iptoshellPlugin) Shutdown(ctx context.Context) error {
+	if p.q == nil {
+		return nil
+	}
+	if err := p.q.Shutdown(ctx); err != nil {
+		p.L().Warn("iptoshell queue was not drained in time", zap.Int("pending", p.q.Len()), zap.Error(err))
+	}
+	return nil
+}
+
+func (p *iptoshellPlugin) runBatch(batch []ipItem) {
+	for _, item := range batch {
+		if err := p.run(item); err != nil {
+			p.L().Warn("failed to run iptoshell script", zap.Stringer("ip", item.addr), zap.String("qname", item.qname), zap.Error(err))
+		}
+	}
+}
+
+// run runs the script with the ip, the mask, the prefix, the tagnum
+// and the query name of item as arguments.
+func (p *iptoshellPlugin) run(item ipItem) error {
+	script, mask := p.args.SetName4, p.args.Mask4
+	if !item.addr.Is4() {
+		script, mask = p.args.SetName6, p.args.Mask6
+	}
+	prefix, err := item.addr.Prefix(mask)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(script, item.addr.String(), strconv.Itoa(mask), prefix.String(), strconv.FormatInt(p.args.Tagnum, 10), item.qname)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run %s for ip %s, %w", script, item.addr, err)
+	}
+	return nil
+}
 
 func (p *iptoshellPlugin) addIPtoshell(r *dns.Msg) error {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	qname := r.Question[0].Name
+
+	dropped := 0
 	for i := range r.Answer {
+		var item ipItem
 		switch rr := r.Answer[i].(type) {
 		case *dns.A:
 			if len(p.args.SetName4) == 0 {
@@ -80,18 +142,7 @@ func (p *iptoshellPlugin) addIPtoshell(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("iptoshell invalid A record with ip: %s", rr.A)
 			}
-			var okprefix error
-			prefix, okprefix := addr.Prefix(p.args.Mask4)
-			if okprefix != nil {
-				return fmt.Errorf("iptoshell to Prefix  invalid A record with ip: %s", rr.A)
-			}
-			cmd := exec.Command(p.args.SetName4, rr.A.String(), strconv.Itoa(p.args.Mask4), prefix.String(), strconv.FormatInt(int64(p.args.Tagnum), 10), r.Question[0].Name)
-                        err := cmd.Run()
-			if err != nil {
-			      return fmt.Errorf(" RUN iptoshell invalid  A record with ip: %s", rr.A)
-			}    
-			
-			
+			item = ipItem{addr: addr, qname: qname}
 
 		case *dns.AAAA:
 			if len(p.args.SetName6) == 0 {
@@ -101,22 +152,24 @@ func (p *iptoshellPlugin) addIPtoshell(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
 			}
-			var okprefix error
-			prefix, okprefix := addr.Prefix(p.args.Mask6)
-			if okprefix != nil {
-				return fmt.Errorf("iptoshell to Prefix  invalid AAAA record with ip: %s", rr.AAAA)
-			}
-			cmd := exec.Command(p.args.SetName6, rr.AAAA.String(),  strconv.Itoa(p.args.Mask6), prefix.String(), strconv.FormatInt(int64(p.args.Tagnum), 10), r.Question[0].Name)
-                        err := cmd.Run()
-			if err != nil {
-			     return fmt.Errorf("Run iptoshell AAAA record with ip: %s", rr.AAAA)
-			} 
-			
-			
+			item = ipItem{addr: addr, qname: qname}
 		default:
 			continue
 		}
+
+		if p.q != nil {
+			if !p.q.Push(item) {
+				dropped++
+			}
+			continue
+		}
+		if err := p.run(item); err != nil {
+			return err
+		}
 	}
 
+	if dropped > 0 {
+		return fmt.Errorf("queue is full, %d ips dropped", dropped)
+	}
 	return nil
 }
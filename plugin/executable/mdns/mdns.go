@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const PluginType = "mdns"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultTimeout = time.Second
+	mdnsDomain     = "local."
+	maxMsgSize     = 9000 // RFC 6762 section 17
+)
+
+var (
+	mdnsGroup4  = netip.MustParseAddrPort("224.0.0.251:5353")
+	mdnsGroup6  = netip.MustParseAddrPort("[ff02::fb]:5353")
+	llmnrGroup4 = netip.MustParseAddrPort("224.0.0.252:5355")
+	llmnrGroup6 = netip.MustParseAddrPort("[ff02::1:3]:5355")
+)
+
+var _ coremain.ExecutablePlugin = (*mdnsBridge)(nil)
+
+type Args struct {
+	// Interfaces to send queries on. Queries are sent on all interfaces
+	// at the same time, over IPv4 and IPv6. Default is the system
+	// default multicast interface, IPv4 only.
+	Interfaces []string `yaml:"interfaces"`
+
+	// Timeout (ms) of waiting for an answer. Default is 1000.
+	Timeout int `yaml:"timeout"`
+
+	// LLMNR enables resolving single label names (e.g. "printer") by
+	// LLMNR (RFC 4795).
+	LLMNR bool `yaml:"llmnr"`
+}
+
+// target is a multicast group on an interface.
+type target struct {
+	ifi   *net.Interface // nil means the system default.
+	group netip.AddrPort
+}
+
+// mdnsBridge resolves ".local" names by mDNS one-shot queries (RFC 6762
+// section 5.1), and optionally single label names by LLMNR. Responders
+// reply to one-shot queries with unicast answers, so no multicast
+// listener is needed. Names that get no answer before the timeout, and
+// other names, are passed to next.
+type mdnsBridge struct {
+	*coremain.BP
+	timeout time.Duration
+	llmnr   bool
+
+	mdnsTargets  []target
+	llmnrTargets []target
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newMDNSBridge(bp, args.(*Args))
+}
+
+func newMDNSBridge(bp *coremain.BP, args *Args) (*mdnsBridge, error) {
+	p := &mdnsBridge{
+		BP:      bp,
+		timeout: time.Duration(args.Timeout) * time.Millisecond,
+		llmnr:   args.LLMNR,
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+
+	if len(args.Interfaces) == 0 {
+		p.mdnsTargets = []target{{group: mdnsGroup4}}
+		p.llmnrTargets = []target{{group: llmnrGroup4}}
+		return p, nil
+	}
+	for _, name := range args.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface %s, %w", name, err)
+		}
+		if ifi.Flags&net.FlagMulticast == 0 {
+			return nil, fmt.Errorf("interface %s does not support multicast", name)
+		}
+		p.mdnsTargets = append(p.mdnsTargets, target{ifi: ifi, group: mdnsGroup4}, target{ifi: ifi, group: mdnsGroup6})
+		p.llmnrTargets = append(p.llmnrTargets, target{ifi: ifi, group: llmnrGroup4}, target{ifi: ifi, group: llmnrGroup6})
+	}
+	return p, nil
+}
+
+func (p *mdnsBridge) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if targets := p.targetsOf(q); len(targets) > 0 {
+		r, err := p.resolve(ctx, q, targets)
+		if err != nil {
+			p.L().Debug("no multicast answer", qCtx.InfoField(), zap.Error(err))
+		} else {
+			qCtx.SetResponse(r)
+			return nil
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// targetsOf returns the targets that q should be sent to, or nil if q
+// should not be resolved by multicast.
+func (p *mdnsBridge) targetsOf(q *dns.Msg) []target {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	name := strings.ToLower(q.Question[0].Name)
+	switch {
+	case dns.IsSubDomain(mdnsDomain, name) && name != mdnsDomain:
+		return p.mdnsTargets
+	case p.llmnr && dns.CountLabel(name) == 1:
+		return p.llmnrTargets
+	}
+	return nil
+}
+
+var errNoAnswer = errors.New("no answer")
+
+// resolve sends q to all targets and returns the first answer.
+func (p *mdnsBridge) resolve(ctx context.Context, q *dns.Msg, targets []target) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	question := q.Question[0]
+	mq := new(dns.Msg)
+	mq.SetQuestion(question.Name, question.Qtype)
+	mq.RecursionDesired = false
+
+	type result struct {
+		answer []dns.RR
+		err    error
+	}
+	resChan := make(chan result, len(targets))
+	for _, t := range targets {
+		t := t
+		go func() {
+			answer, err := exchange(ctx, mq, t)
+			resChan <- result{answer: answer, err: err}
+		}()
+	}
+
+	var lastErr error = errNoAnswer
+	for range targets {
+		res := <-resChan
+		if res.err != nil {
+			if !errors.Is(res.err, context.DeadlineExceeded) && !errors.Is(res.err, context.Canceled) {
+				lastErr = res.err
+			}
+			continue
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.RecursionAvailable = true
+		r.Answer = res.answer
+		return r, nil
+	}
+	return nil, lastErr
+}
+
+// exchange sends a one-shot query q to t, and waits for a response that
+// answers q until ctx is done.
+func exchange(ctx context.Context, q *dns.Msg, t target) ([]dns.RR, error) {
+	network := "udp4"
+	dst := t.group
+	if dst.Addr().Is6() {
+		network = "udp6"
+		if t.ifi != nil {
+			dst = netip.AddrPortFrom(dst.Addr().WithZone(t.ifi.Name), dst.Port())
+		}
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if t.ifi != nil {
+		if dst.Addr().Is4() {
+			err = ipv4.NewPacketConn(c).SetMulticastInterface(t.ifi)
+		} else {
+			err = ipv6.NewPacketConn(c).SetMulticastInterface(t.ifi)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set multicast interface, %w", err)
+		}
+	}
+
+	// Unblock the read when ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.WriteToUDPAddrPort(b, dst); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMsgSize)
+	for {
+		n, _, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		// Multicast responses have a zero id (RFC 6762 section 18.1).
+		if !r.Response || (r.Id != q.Id && r.Id != 0) {
+			continue
+		}
+		if answer := answerOf(r, q.Question[0]); len(answer) > 0 {
+			return answer, nil
+		}
+	}
+}
+
+// answerOf returns records in r that answer question. mDNS responders
+// may include unrelated records, and set the cache-flush bit in classes.
+func answerOf(r *dns.Msg, question dns.Question) []dns.RR {
+	var answer []dns.RR
+	name := question.Name
+	for _, rr := range r.Answer {
+		h := rr.Header()
+		h.Class &^= 1 << 15
+		if h.Class != dns.ClassINET || !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		switch {
+		case h.Rrtype == question.Qtype:
+			h.Name = name
+			answer = append(answer, rr)
+		case h.Rrtype == dns.TypeCNAME:
+			h.Name = name
+			answer = append(answer, rr)
+			name = rr.(*dns.CNAME).Target
+		}
+	}
+	return answer
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// startResponder starts a fake responder that answers A queries of
+// hosts like an mDNS responder: with a zero id and the cache-flush bit.
+func startResponder(t *testing.T, hosts map[string]string) netip.AddrPort {
+	t.Helper()
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, maxMsgSize)
+		for {
+			n, from, err := c.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			ip, ok := hosts[strings.ToLower(q.Question[0].Name)]
+			if !ok || q.Question[0].Qtype != dns.TypeA {
+				continue
+			}
+			r := new(dns.Msg)
+			r.Response = true
+			r.Authoritative = true
+			r.Answer = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: "other.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | 1<<15, Ttl: 120}, A: net.ParseIP("192.168.1.99")},
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET | 1<<15, Ttl: 120}, A: net.ParseIP(ip)},
+			}
+			b, _ := r.Pack()
+			c.WriteToUDPAddrPort(b, from)
+		}
+	}()
+	return netip.MustParseAddrPort(c.LocalAddr().String())
+}
+
+func Test_mdnsBridge(t *testing.T) {
+	mdnsAddr := startResponder(t, map[string]string{"printer.local.": "192.168.1.10"})
+	llmnrAddr := startResponder(t, map[string]string{"nas.": "192.168.1.20"})
+
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	p, err := newMDNSBridge(coremain.NewBP("test", PluginType, nil, m), &Args{Timeout: 200, LLMNR: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mdnsTargets = []target{{group: mdnsAddr}}
+	p.llmnrTargets = []target{{group: llmnrAddr}}
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		wantNext bool
+		want     string
+	}{
+		{"printer.local.", dns.TypeA, false, "192.168.1.10"},
+		{"PRINTER.local.", dns.TypeA, false, "192.168.1.10"},
+		{"nas.", dns.TypeA, false, "192.168.1.20"},
+		{"printer.local.", dns.TypeAAAA, true, ""},
+		{"unknown.local.", dns.TypeA, true, ""},
+		{"printer.example.", dns.TypeA, true, ""},
+		{"local.", dns.TypeA, true, ""},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		qCtx := query_context.NewContext(q, nil)
+		nextR := new(dns.Msg)
+		nextR.SetRcode(q, dns.RcodeRefused)
+		next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: nextR})
+		if err := p.Exec(context.Background(), qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if tt.wantNext {
+			if r.Rcode != dns.RcodeRefused {
+				t.Errorf("%s %s: should be passed to next", tt.name, dns.TypeToString[tt.qtype])
+			}
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess || r.Id != q.Id || len(r.Answer) != 1 {
+			t.Errorf("%s %s: unexpected response %v", tt.name, dns.TypeToString[tt.qtype], r)
+			continue
+		}
+		a := r.Answer[0].(*dns.A)
+		if a.Hdr.Name != tt.name || a.Hdr.Class != dns.ClassINET || a.A.String() != tt.want {
+			t.Errorf("%s %s: want %s, got %v", tt.name, dns.TypeToString[tt.qtype], tt.want, a)
+		}
+	}
+}
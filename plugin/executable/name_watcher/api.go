@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package name_watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPollTimeout = time.Second * 30
+	maxPollTimeout     = time.Minute * 5
+)
+
+// ServeHTTP serves the api of the plugin.
+//
+//	GET    /watches                          list watches.
+//	POST   /watches                          register a watch, body: {"domain": "", "webhook": ""}.
+//	                                         The webhook host must be in Args.AllowedWebhookHosts.
+//	DELETE /watches?id=                      remove a watch.
+//	GET    /poll?domain=&version=&timeout=   return the ip set of domain when its
+//	                                         version is not the given version.
+//	GET    /events?domain=                   stream events as server-sent events.
+func (p *nameWatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/watches"):
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, p.r.listWatches())
+		case http.MethodPost:
+			p.handleAddWatch(w, req)
+		case http.MethodDelete:
+			if !p.r.remove(req.URL.Query().Get("id")) {
+				writeError(w, http.StatusNotFound, errors.New("watch not found"))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasSuffix(path, "/poll"):
+		p.handlePoll(w, req)
+	case strings.HasSuffix(path, "/events"):
+		p.handleEvents(w, req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (p *nameWatcher) handleAddWatch(w http.ResponseWriter, req *http.Request) {
+	args := new(WatchArgs)
+	if err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(args); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body, %w", err))
+		return
+	}
+	if err := checkWebhook(args.Webhook); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := p.checkWebhookAllowed(args.Webhook); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	wt, err := p.r.add(args.Domain, args.Webhook)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errTooManyWatches) {
+			code = http.StatusTooManyRequests
+		}
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, wt)
+}
+
+func (p *nameWatcher) handlePoll(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	domain := query.Get("domain")
+	var version uint64
+	if s := query.Get("version"); len(s) > 0 {
+		var err error
+		version, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid version, %w", err))
+			return
+		}
+	}
+	timeout := defaultPollTimeout
+	if s := query.Get("timeout"); len(s) > 0 {
+		sec, err := strconv.Atoi(s)
+		if err != nil || sec < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid timeout"))
+			return
+		}
+		timeout = time.Duration(sec) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	state, changed, ok := p.r.state(domain)
+	if ok && state.Version == version {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-changed:
+			state, _, ok = p.r.state(domain)
+		case <-timer.C:
+		case <-req.Context().Done():
+			return
+		case <-p.closeNotify:
+			return
+		}
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("domain is not watched"))
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (p *nameWatcher) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	s := p.r.subscribe(req.URL.Query().Get("domain"))
+	defer p.r.unsubscribe(s)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-s.c:
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-p.closeNotify:
+			return
+		}
+	}
+}
+
+func checkWebhook(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return errors.New("webhook must be a http or https url")
+	}
+	return nil
+}
+
+// checkWebhookAllowed checks whether the host of the webhook s is in the
+// allowlist. Without it, anyone who can reach the api could make mosdns
+// send requests to arbitrary hosts.
+func (p *nameWatcher) checkWebhookAllowed(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url, %w", err)
+	}
+	if _, ok := p.allowedWebhookHosts[strings.ToLower(u.Hostname())]; !ok {
+		return fmt.Errorf("webhook host %s is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
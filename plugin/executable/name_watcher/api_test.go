@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package name_watcher
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_nameWatcher_addWatchWebhookAllowlist(t *testing.T) {
+	p, err := newNameWatcher(coremain.NewBP("test", PluginType, zap.NewNop(), nil), &Args{
+		Watches:             []WatchArgs{{Domain: "example.org", Webhook: "http://192.0.2.1/hook"}},
+		AllowedWebhookHosts: []string{"Hooks.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"no webhook", `{"domain": "a.example"}`, http.StatusCreated},
+		{"allowed host", `{"domain": "b.example", "webhook": "https://hooks.example.com:8443/x"}`, http.StatusCreated},
+		{"host not allowed", `{"domain": "c.example", "webhook": "http://169.254.169.254/latest"}`, http.StatusForbidden},
+		{"config webhook host is not allowed in api", `{"domain": "d.example", "webhook": "http://192.0.2.1/hook"}`, http.StatusForbidden},
+		{"not http", `{"domain": "e.example", "webhook": "file:///etc/passwd"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/plugins/test/watches", strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d, body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
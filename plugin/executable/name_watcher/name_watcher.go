@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package name_watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PluginType = "name_watcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	webhookQueueSize = 256
+)
+
+var _ coremain.ExecutablePlugin = (*nameWatcher)(nil)
+
+type Args struct {
+	Watches        []WatchArgs `yaml:"watches"`
+	MaxWatches     int         `yaml:"max_watches"`     // Max number of watches. Default is 1024.
+	WebhookTimeout int         `yaml:"webhook_timeout"` // (sec) Default is 5.
+
+	// AllowedWebhookHosts lists the hosts that watches registered through
+	// the api can send webhooks to. If empty, the api can only register
+	// watches without webhook. Webhooks in Watches are always allowed.
+	AllowedWebhookHosts []string `yaml:"allowed_webhook_hosts"`
+}
+
+type WatchArgs struct {
+	Domain  string `yaml:"domain" json:"domain"`
+	Webhook string `yaml:"webhook" json:"webhook"`
+}
+
+func (a *Args) init() {
+	if a.MaxWatches <= 0 {
+		a.MaxWatches = 1024
+	}
+	if a.WebhookTimeout <= 0 {
+		a.WebhookTimeout = 5
+	}
+}
+
+type webhookJob struct {
+	url string
+	e   *Event
+}
+
+// nameWatcher watches the ip sets of domains in responses and notifies
+// webhooks and api clients when they were changed.
+type nameWatcher struct {
+	*coremain.BP
+	r      *registry
+	client *http.Client
+
+	allowedWebhookHosts map[string]struct{}
+
+	jobs        chan webhookJob
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newNameWatcher(bp, args.(*Args))
+}
+
+func newNameWatcher(bp *coremain.BP, args *Args) (*nameWatcher, error) {
+	args.init()
+	p := &nameWatcher{
+		BP:          bp,
+		r:           newRegistry(args.MaxWatches),
+		client:      &http.Client{Timeout: time.Duration(args.WebhookTimeout) * time.Second},
+		jobs:        make(chan webhookJob, webhookQueueSize),
+		closeNotify: make(chan struct{}),
+
+		allowedWebhookHosts: make(map[string]struct{}),
+	}
+	for _, h := range args.AllowedWebhookHosts {
+		p.allowedWebhookHosts[strings.ToLower(h)] = struct{}{}
+	}
+	for i, w := range args.Watches {
+		if err := checkWebhook(w.Webhook); err != nil {
+			return nil, fmt.Errorf("invalid watch #%d, %w", i, err)
+		}
+		if _, err := p.r.add(w.Domain, w.Webhook); err != nil {
+			return nil, fmt.Errorf("invalid watch #%d, %w", i, err)
+		}
+	}
+	go p.webhookWorker()
+	return p, nil
+}
+
+func (p *nameWatcher) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	p.observe(qCtx.Q(), qCtx.R())
+	return nil
+}
+
+func (p *nameWatcher) observe(q, r *dns.Msg) {
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(q.Question) != 1 {
+		return
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return
+	}
+	domain := dns.CanonicalName(question.Name)
+	if !p.r.isWatched(domain) {
+		return
+	}
+
+	var addrs []netip.Addr
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if rr.Header().Rrtype != question.Qtype {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+
+	e, webhooks := p.r.update(domain, question.Qtype, addrs, time.Now())
+	if e == nil {
+		return
+	}
+	p.L().Info("ip set changed", zap.String("domain", domain), zap.Any("old", e.Old), zap.Any("new", e.New))
+	for _, u := range webhooks {
+		select {
+		case p.jobs <- webhookJob{url: u, e: e}:
+		default:
+			p.L().Warn("webhook queue is full, event dropped", zap.String("domain", domain), zap.String("webhook", u))
+		}
+	}
+}
+
+func (p *nameWatcher) webhookWorker() {
+	for {
+		select {
+		case job := <-p.jobs:
+			if err := p.postEvent(job.url, job.e); err != nil {
+				p.L().Warn("failed to notify webhook", zap.String("webhook", job.url), zap.Error(err))
+			}
+		case <-p.closeNotify:
+			return
+		}
+	}
+}
+
+func (p *nameWatcher) postEvent(url string, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad http status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *nameWatcher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+	})
+	return nil
+}
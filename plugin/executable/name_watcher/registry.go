@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package name_watcher
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTooManyWatches = errors.New("too many watches")
+
+type watch struct {
+	ID      string `json:"id"`
+	Domain  string `json:"domain"`
+	Webhook string `json:"webhook,omitempty"`
+}
+
+// Event is sent to webhooks and event streams when the ip set of
+// a watched domain was changed.
+type Event struct {
+	Domain  string       `json:"domain"`
+	Old     []netip.Addr `json:"old"`
+	New     []netip.Addr `json:"new"`
+	Version uint64       `json:"version"`
+	Time    time.Time    `json:"time"`
+}
+
+// DomainState is the latest known ip set of a watched domain.
+type DomainState struct {
+	Domain    string       `json:"domain"`
+	Addrs     []netip.Addr `json:"addrs"`
+	Version   uint64       `json:"version"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type domainState struct {
+	watches   map[string]*watch
+	v4, v6    []netip.Addr
+	version   uint64
+	updatedAt time.Time
+	changed   chan struct{} // closed and replaced when the state was changed
+}
+
+func (s *domainState) addrs() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(s.v4)+len(s.v6))
+	addrs = append(addrs, s.v4...)
+	return append(addrs, s.v6...)
+}
+
+type subscriber struct {
+	domain string // empty means all domains
+	c      chan *Event
+}
+
+// registry holds watches and the ip sets of watched domains.
+type registry struct {
+	maxWatches int
+
+	mu      sync.RWMutex
+	nextID  uint64
+	watches map[string]*watch
+	domains map[string]*domainState
+	subs    map[*subscriber]struct{}
+}
+
+func newRegistry(maxWatches int) *registry {
+	return &registry{
+		maxWatches: maxWatches,
+		watches:    make(map[string]*watch),
+		domains:    make(map[string]*domainState),
+		subs:       make(map[*subscriber]struct{}),
+	}
+}
+
+func (r *registry) add(domain, webhook string) (*watch, error) {
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return nil, errors.New("invalid domain")
+	}
+	domain = dns.CanonicalName(domain)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxWatches > 0 && len(r.watches) >= r.maxWatches {
+		return nil, errTooManyWatches
+	}
+	r.nextID++
+	w := &watch{
+		ID:      strconv.FormatUint(r.nextID, 10),
+		Domain:  domain,
+		Webhook: webhook,
+	}
+	r.watches[w.ID] = w
+	ds := r.domains[domain]
+	if ds == nil {
+		ds = &domainState{watches: make(map[string]*watch), changed: make(chan struct{})}
+		r.domains[domain] = ds
+	}
+	ds.watches[w.ID] = w
+	return w, nil
+}
+
+func (r *registry) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.watches[id]
+	if !ok {
+		return false
+	}
+	delete(r.watches, id)
+	ds := r.domains[w.Domain]
+	delete(ds.watches, id)
+	if len(ds.watches) == 0 {
+		delete(r.domains, w.Domain)
+		close(ds.changed) // wake up pollers
+	}
+	return true
+}
+
+func (r *registry) listWatches() []*watch {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l := make([]*watch, 0, len(r.watches))
+	for _, w := range r.watches {
+		l = append(l, w)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Domain < l[j].Domain })
+	return l
+}
+
+// state returns the state of domain and a channel that will be closed
+// when the state is changed.
+func (r *registry) state(domain string) (*DomainState, <-chan struct{}, bool) {
+	domain = dns.CanonicalName(domain)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ds, ok := r.domains[domain]
+	if !ok {
+		return nil, nil, false
+	}
+	return &DomainState{
+		Domain:    domain,
+		Addrs:     ds.addrs(),
+		Version:   ds.version,
+		UpdatedAt: ds.updatedAt,
+	}, ds.changed, true
+}
+
+func (r *registry) isWatched(domain string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.domains[domain]
+	return ok
+}
+
+// update updates the addresses of qtype of domain. domain must be
+// canonical. If the ip set of domain was changed, update returns the
+// event and the webhooks that should be notified.
+func (r *registry) update(domain string, qtype uint16, addrs []netip.Addr, now time.Time) (*Event, []string) {
+	if !r.isWatched(domain) {
+		return nil, nil
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	addrs = dedup(addrs)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds, ok := r.domains[domain]
+	if !ok {
+		return nil, nil
+	}
+
+	old := ds.addrs()
+	p := &ds.v4
+	if qtype == dns.TypeAAAA {
+		p = &ds.v6
+	}
+	if equalAddrs(*p, addrs) {
+		return nil, nil
+	}
+	*p = addrs
+	ds.version++
+	ds.updatedAt = now
+	close(ds.changed)
+	ds.changed = make(chan struct{})
+
+	e := &Event{
+		Domain:  domain,
+		Old:     old,
+		New:     ds.addrs(),
+		Version: ds.version,
+		Time:    now,
+	}
+	for s := range r.subs {
+		if len(s.domain) > 0 && s.domain != domain {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default: // slow subscriber, drop the event.
+		}
+	}
+
+	var webhooks []string
+	for _, w := range ds.watches {
+		if len(w.Webhook) > 0 {
+			webhooks = append(webhooks, w.Webhook)
+		}
+	}
+	return e, webhooks
+}
+
+func (r *registry) subscribe(domain string) *subscriber {
+	if len(domain) > 0 {
+		domain = dns.CanonicalName(domain)
+	}
+	s := &subscriber{domain: domain, c: make(chan *Event, 16)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs[s] = struct{}{}
+	return s
+}
+
+func (r *registry) unsubscribe(s *subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subs, s)
+}
+
+func dedup(addrs []netip.Addr) []netip.Addr {
+	n := 0
+	for i, addr := range addrs {
+		if i > 0 && addr == addrs[n-1] {
+			continue
+		}
+		addrs[n] = addr
+		n++
+	}
+	return addrs[:n]
+}
+
+func equalAddrs(a, b []netip.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package name_watcher
+
+import (
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_registry(t *testing.T) {
+	r := newRegistry(2)
+	w, err := r.add("Example.com", "http://127.0.0.1/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.add("example.org", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.add("example.net", ""); err != errTooManyWatches {
+		t.Fatalf("want errTooManyWatches, got %v", err)
+	}
+
+	a1 := netip.MustParseAddr("192.0.2.1")
+	a2 := netip.MustParseAddr("192.0.2.2")
+	a6 := netip.MustParseAddr("2001:db8::1")
+	now := time.Now()
+	s := r.subscribe("example.com")
+	defer r.unsubscribe(s)
+
+	if e, _ := r.update("example.net.", dns.TypeA, []netip.Addr{a1}, now); e != nil {
+		t.Fatal("unwatched domain should not have events")
+	}
+
+	e, hooks := r.update("example.com.", dns.TypeA, []netip.Addr{a2, a1, a1}, now)
+	if e == nil || len(e.New) != 2 || e.New[0] != a1 || len(e.Old) != 0 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if len(hooks) != 1 || hooks[0] != w.Webhook {
+		t.Fatalf("unexpected webhooks %v", hooks)
+	}
+	if got := <-s.c; got != e {
+		t.Fatal("subscriber did not receive the event")
+	}
+
+	if e, _ := r.update("example.com.", dns.TypeA, []netip.Addr{a1, a2}, now); e != nil {
+		t.Fatal("unchanged ip set should not have events")
+	}
+	if e, _ := r.update("example.com.", dns.TypeAAAA, nil, now); e != nil {
+		t.Fatal("empty AAAA set should not have events")
+	}
+
+	_, changed, _ := r.state("example.com")
+	e, _ = r.update("example.com.", dns.TypeAAAA, []netip.Addr{a6}, now)
+	if e == nil || len(e.New) != 3 || len(e.Old) != 2 || e.Version != 2 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed channel was not closed")
+	}
+
+	if !r.remove(w.ID) || r.isWatched("example.com.") {
+		t.Fatal("failed to remove watch")
+	}
+}
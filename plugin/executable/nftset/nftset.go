@@ -40,6 +40,16 @@ type Args struct {
 	SetName6     string `yaml:"set_name6"`
 	Mask4        int    `yaml:"mask4"` // default 24
 	Mask6        int    `yaml:"mask6"` // default 32
+
+	// Aggregate4 and Aggregate6 enable prefix aggregation. Contiguous
+	// prefixes will be merged into a larger prefix that is at most
+	// Aggregate4/6 bits shorter than Mask4/6. Aggregated elements
+	// are TTL-aware and will be removed from the set once expired.
+	// The set must have the 'interval' flag.
+	// Zero disables aggregation (elements will never be removed). Max is 8.
+	Aggregate4 int    `yaml:"aggregate4"`
+	Aggregate6 int    `yaml:"aggregate6"`
+	MinTTL     uint32 `yaml:"min_ttl"` // (sec) minimum lifetime of aggregated elements, default 300
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -26,12 +26,20 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/ip_aggregator"
 	"github.com/IrineSistiana/mosdns/v4/pkg/nftset_utils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
 	"github.com/google/nftables"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAggregateMinTTL = 300
+	expireCheckInterval    = time.Second * 10
 )
 
 type nftsetPlugin struct {
@@ -40,6 +48,13 @@ type nftsetPlugin struct {
 	v4set *nftset_utils.NftSetHandler
 	v6set *nftset_utils.NftSetHandler
 	nc    *nftables.Conn
+
+	// aggMu serializes aggregator updates, so set changes are applied
+	// in the same order as they were generated.
+	aggMu       sync.Mutex
+	agg4, agg6  *ip_aggregator.Aggregator // nil if aggregation is disabled
+	closeOnce   sync.Once
+	closeNotify chan struct{}
 }
 
 func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
@@ -49,6 +64,9 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 	if m := args.Mask6; m <= 0 || m > 128 {
 		args.Mask6 = 32
 	}
+	if args.MinTTL == 0 {
+		args.MinTTL = defaultAggregateMinTTL
+	}
 
 	nc, err := nftables.New(nftables.AsLasting())
 	if err != nil {
@@ -56,9 +74,10 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 	}
 
 	nftPlugin := &nftsetPlugin{
-		BP:   bp,
-		args: args,
-		nc:   nc,
+		BP:          bp,
+		args:        args,
+		nc:          nc,
+		closeNotify: make(chan struct{}),
 	}
 
 	if len(args.TableFamily4) > 0 && len(args.TableName4) > 0 && len(args.SetName4) > 0 {
@@ -87,6 +106,16 @@ func newNftsetPlugin(bp *coremain.BP, args *Args) (*nftsetPlugin, error) {
 		})
 	}
 
+	if nftPlugin.v4set != nil && args.Aggregate4 > 0 {
+		nftPlugin.agg4 = ip_aggregator.NewAggregator(ip_aggregator.Opts{Mask: args.Mask4, MaxMerge: args.Aggregate4})
+	}
+	if nftPlugin.v6set != nil && args.Aggregate6 > 0 {
+		nftPlugin.agg6 = ip_aggregator.NewAggregator(ip_aggregator.Opts{Mask: args.Mask6, MaxMerge: args.Aggregate6})
+	}
+	if nftPlugin.agg4 != nil || nftPlugin.agg6 != nil {
+		go nftPlugin.startExpirer()
+	}
+
 	return nftPlugin, nil
 }
 
@@ -108,6 +137,14 @@ func (p *nftsetPlugin) Exec(ctx context.Context, qCtx *query_context.Context, ne
 func (p *nftsetPlugin) addElems(r *dns.Msg) error {
 	var v4Elems []netip.Prefix
 	var v6Elems []netip.Prefix
+	var v4Diff ip_aggregator.Diff
+	var v6Diff ip_aggregator.Diff
+	now := time.Now()
+
+	if p.agg4 != nil || p.agg6 != nil {
+		p.aggMu.Lock()
+		defer p.aggMu.Unlock()
+	}
 
 	for i := range r.Answer {
 		switch rr := r.Answer[i].(type) {
@@ -120,6 +157,10 @@ func (p *nftsetPlugin) addElems(r *dns.Msg) error {
 			if !ok || !addr.Is4() {
 				return fmt.Errorf("internel: dns.A record [%s] is not a ipv4 address", rr.A)
 			}
+			if p.agg4 != nil {
+				v4Diff.Merge(p.agg4.Add(addr, p.aggregateTTL(rr.Hdr.Ttl), now))
+				continue
+			}
 			v4Elems = append(v4Elems, netip.PrefixFrom(addr, p.args.Mask4))
 
 		case *dns.AAAA:
@@ -133,6 +174,10 @@ func (p *nftsetPlugin) addElems(r *dns.Msg) error {
 			if addr.Is4() {
 				addr = netip.AddrFrom16(addr.As16())
 			}
+			if p.agg6 != nil {
+				v6Diff.Merge(p.agg6.Add(addr, p.aggregateTTL(rr.Hdr.Ttl), now))
+				continue
+			}
 			v6Elems = append(v6Elems, netip.PrefixFrom(addr, p.args.Mask6))
 		default:
 			continue
@@ -150,10 +195,59 @@ func (p *nftsetPlugin) addElems(r *dns.Msg) error {
 			return fmt.Errorf("failed to add ipv6 elems %s: %w", v6Elems, err)
 		}
 	}
+
+	if err := applyDiff(p.v4set, v4Diff); err != nil {
+		return fmt.Errorf("failed to update aggregated ipv4 elems: %w", err)
+	}
+	if err := applyDiff(p.v6set, v6Diff); err != nil {
+		return fmt.Errorf("failed to update aggregated ipv6 elems: %w", err)
+	}
 	return nil
 }
 
+func (p *nftsetPlugin) aggregateTTL(ttl uint32) time.Duration {
+	if ttl < p.args.MinTTL {
+		ttl = p.args.MinTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// startExpirer removes expired aggregated elements from the sets periodically.
+func (p *nftsetPlugin) startExpirer() {
+	ticker := time.NewTicker(expireCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case now := <-ticker.C:
+			p.aggMu.Lock()
+			if p.agg4 != nil {
+				if err := applyDiff(p.v4set, p.agg4.Expire(now)); err != nil {
+					p.L().Warn("failed to remove expired ipv4 elems", zap.Error(err))
+				}
+			}
+			if p.agg6 != nil {
+				if err := applyDiff(p.v6set, p.agg6.Expire(now)); err != nil {
+					p.L().Warn("failed to remove expired ipv6 elems", zap.Error(err))
+				}
+			}
+			p.aggMu.Unlock()
+		}
+	}
+}
+
+func applyDiff(h *nftset_utils.NftSetHandler, d ip_aggregator.Diff) error {
+	if h == nil || d.IsEmpty() {
+		return nil
+	}
+	return h.UpdateElems(d.Add, d.Del)
+}
+
 func (p *nftsetPlugin) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+	})
 	return p.nc.CloseLasting()
 }
 
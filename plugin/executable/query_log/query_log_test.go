@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type respond struct {
+	upstream string
+	err      error
+}
+
+func (r *respond) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	if r.err != nil {
+		return r.err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(qCtx.Q())
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	qCtx.SetResponse(resp)
+	qCtx.SetUpstream(r.upstream)
+	return nil
+}
+
+func exec(t *testing.T, l *queryLog, next executable_seq.Executable) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, &query_context.RequestMeta{
+		ClientAddr: netip.MustParseAddr("192.0.2.1"),
+		Protocol:   "udp",
+	})
+	_ = l.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next))
+}
+
+func Test_queryLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+
+	t.Run("json", func(t *testing.T) {
+		l, err := newQueryLog(coremain.NewBP("test", PluginType, nil, nil), &Args{File: file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exec(t, l, &respond{upstream: "udp://8.8.8.8"})
+		exec(t, l, &respond{err: errors.New("all upstreams failed")})
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("want 2 lines, got %q", b)
+		}
+		var e1, e2 entry
+		if err := json.Unmarshal([]byte(lines[0]), &e1); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(lines[1]), &e2); err != nil {
+			t.Fatal(err)
+		}
+		if e1.Client != "192.0.2.1" || e1.Qname != "example.com." || e1.Qtype != "A" || e1.Rcode != "NOERROR" ||
+			len(e1.Answers) != 1 || e1.Answers[0] != "1.2.3.4" || e1.Upstream != "udp://8.8.8.8" || e1.CacheHit {
+			t.Fatalf("unexpected entry %s", lines[0])
+		}
+		if e2.Rcode != "NORESPONSE" || e2.Error != "all upstreams failed" {
+			t.Fatalf("unexpected entry %s", lines[1])
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		os.Remove(file)
+		l, err := newQueryLog(coremain.NewBP("test", PluginType, nil, nil), &Args{File: file, Format: formatText})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exec(t, l, &respond{upstream: "udp://8.8.8.8"})
+		l.Close()
+
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Fields(string(b))
+		want := []string{"192.0.2.1", "udp", "example.com.", "A", "NOERROR"}
+		if len(fields) != 10 || strings.Join(fields[1:6], " ") != strings.Join(want, " ") ||
+			fields[7] != "udp://8.8.8.8" || fields[8] != "miss" || fields[9] != "1.2.3.4" {
+			t.Fatalf("unexpected line %q", b)
+		}
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		var mu sync.Mutex
+		var queries []string
+		var rows int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			defer mu.Unlock()
+			if q := r.URL.Query().Get("query"); len(q) > 0 {
+				queries = append(queries, q)
+				rows += strings.Count(string(b), "\n")
+			} else {
+				queries = append(queries, string(b))
+			}
+		}))
+		defer srv.Close()
+
+		m := coremain.NewTestMosdnsWithPlugins(nil)
+		l, err := newQueryLog(coremain.NewBP("test", PluginType, nil, m), &Args{SQL: &SQLArgs{
+			Driver:      "clickhouse",
+			DSN:         srv.URL,
+			CreateTable: true,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exec(t, l, &respond{upstream: "udp://8.8.8.8"})
+		exec(t, l, &respond{upstream: "udp://8.8.8.8"})
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(queries) != 2 || !strings.HasPrefix(queries[0], "CREATE TABLE IF NOT EXISTS mosdns_query_log") ||
+			queries[1] != "INSERT INTO mosdns_query_log FORMAT JSONEachRow" || rows != 2 {
+			t.Fatalf("unexpected queries %q, rows %d", queries, rows)
+		}
+	})
+
+	if _, err := newQueryLog(coremain.NewBP("test", PluginType, nil, nil), &Args{File: file, Format: "xml"}); err == nil {
+		t.Fatal("invalid format should fail")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTopN = 10
+	maxTopN     = 1000
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// ServeHTTP serves the api of the plugin.
+//
+//	GET /summary?top=&window=   statistics in json. top is the length of top
+//	                            lists, default is 10. window (sec) is the window
+//	                            of top lists and upstreams, default is 3600.
+//	GET /                       the web page, if Args.UI is set.
+func (p *queryStats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/summary"):
+		p.handleSummary(w, req)
+	case strings.HasSuffix(path, "/") && p.ui:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (p *queryStats) handleSummary(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	n := defaultTopN
+	if s := query.Get("top"); len(s) > 0 {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxTopN {
+			writeError(w, http.StatusBadRequest, errors.New("invalid top"))
+			return
+		}
+	}
+	var window time.Duration
+	if s := query.Get("window"); len(s) > 0 {
+		sec, err := strconv.Atoi(s)
+		if err != nil || sec <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid window"))
+			return
+		}
+		window = time.Duration(sec) * time.Second
+	}
+	writeJSON(w, http.StatusOK, p.s.Summary(n, window))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_stats"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"time"
+)
+
+const PluginType = "query_stats"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*queryStats)(nil)
+
+type Args struct {
+	// Blocked is the tag of a matcher that matches blocked queries after
+	// they are processed, e.g. a marker that is added by the blocking
+	// sequence. If empty, no query is counted as blocked.
+	Blocked string `yaml:"blocked"`
+
+	// TopCapacity is the maximum number of domains and clients that are
+	// tracked per minute. Default is 1000.
+	TopCapacity int `yaml:"top_capacity"`
+
+	// UI serves a web page of the statistics at /plugins/<tag>/.
+	UI bool `yaml:"ui"`
+}
+
+// queryStats collects statistics of queries that pass through it.
+type queryStats struct {
+	*coremain.BP
+	blocked executable_seq.Matcher // may be nil
+	ui      bool
+	s       *query_stats.Stats
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newQueryStats(bp, args.(*Args))
+}
+
+func newQueryStats(bp *coremain.BP, args *Args) (*queryStats, error) {
+	p := &queryStats{
+		BP: bp,
+		ui: args.UI,
+		s:  query_stats.New(query_stats.Opts{TopCapacity: args.TopCapacity}),
+	}
+	if tag := args.Blocked; len(tag) > 0 {
+		p.blocked = bp.M().GetMatchers()[tag]
+		if p.blocked == nil {
+			return nil, fmt.Errorf("cannot find matcher %s", tag)
+		}
+	}
+	return p, nil
+}
+
+func (p *queryStats) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+
+	q := &query_stats.Query{
+		Upstream: qCtx.Upstream(),
+		Latency:  time.Since(qCtx.StartTime()),
+		CacheHit: qCtx.CacheHit(),
+	}
+	if question := qCtx.Q().Question; len(question) == 1 {
+		q.Qname = question[0].Name
+	}
+	if addr := qCtx.ReqMeta().ClientAddr; addr.IsValid() {
+		q.Client = addr.String()
+	}
+	r := qCtx.R()
+	q.Failed = r == nil || r.Rcode == dns.RcodeServerFailure
+	if p.blocked != nil {
+		matched, mErr := p.blocked.Match(ctx, qCtx)
+		if mErr != nil {
+			p.L().Warn("blocked matcher err", qCtx.InfoField(), zap.Error(mErr))
+		}
+		q.Blocked = matched
+	}
+	p.s.Add(q)
+	return err
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_stats"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// blockedMatcher matches queries for "ad.".
+type blockedMatcher struct {
+	*coremain.BP
+}
+
+func (m *blockedMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	return qCtx.Q().Question[0].Name == "ad.", nil
+}
+
+type respond struct{}
+
+func (respond) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	qCtx.SetUpstream("udp://8.8.8.8")
+	return nil
+}
+
+func Test_queryStats(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(map[string]coremain.Plugin{
+		"blocked": &blockedMatcher{BP: coremain.NewBP("blocked", "test", nil, nil)},
+	})
+	p, err := newQueryStats(coremain.NewBP("stats", PluginType, nil, m), &Args{Blocked: "blocked", UI: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.", "a.", "ad."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr("192.0.2.1")})
+		if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(respond{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/plugins/stats/summary?top=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d, %s", w.Code, w.Body)
+	}
+	sum := new(query_stats.Summary)
+	if err := json.NewDecoder(w.Body).Decode(sum); err != nil {
+		t.Fatal(err)
+	}
+	w1 := sum.Windows["1m"]
+	if w1.Queries != 3 || w1.Blocked != 1 {
+		t.Fatalf("unexpected 1m window %+v", w1)
+	}
+	if len(sum.TopDomains) != 1 || sum.TopDomains[0].Key != "a." || sum.TopDomains[0].Count != 2 {
+		t.Fatalf("unexpected top domains %v", sum.TopDomains)
+	}
+	if len(sum.Upstreams) != 1 || sum.Upstreams[0].Responses != 3 {
+		t.Fatalf("unexpected upstreams %v", sum.Upstreams)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/plugins/stats/summary?top=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid top should fail, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/plugins/stats/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>mosdns query stats</title>") {
+		t.Fatalf("unexpected ui response %d", w.Code)
+	}
+
+	if _, err := newQueryStats(coremain.NewBP("stats", PluginType, nil, m), &Args{Blocked: "missing"}); err == nil {
+		t.Fatal("missing matcher should fail")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"time"
+)
+
+const PluginType = "recursive"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultTimeout = time.Second * 2
+)
+
+// defaultRootHints are IPv4 addresses of the root servers.
+var defaultRootHints = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+var _ coremain.ExecutablePlugin = (*recursivePlugin)(nil)
+
+type Args struct {
+	// RootHints are addresses of the root servers. Default is the IPv4
+	// addresses of the root servers.
+	RootHints []string `yaml:"root_hints"`
+
+	// QNameMinimization can be "relaxed" (default), "strict" or "off".
+	// With qname minimization (RFC 9156), a server only receives the
+	// labels of the query name that it is authoritative for. If a
+	// minimized query fails, the relaxed mode retries it with the full
+	// name, and the strict mode fails.
+	QNameMinimization string `yaml:"qname_minimization"`
+
+	// Timeout (sec) of a query to a server. Default is 2.
+	Timeout int `yaml:"timeout"`
+
+	// IPv6 enables sending queries to name servers over IPv6.
+	IPv6 bool `yaml:"ipv6"`
+}
+
+// recursivePlugin resolves queries iteratively from the root servers,
+// without DNSSEC validation. Like forward, it sets the response and
+// executes the rest of the sequence.
+type recursivePlugin struct {
+	*coremain.BP
+	r *resolver
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newRecursive(bp, args.(*Args))
+}
+
+func newRecursive(bp *coremain.BP, args *Args) (*recursivePlugin, error) {
+	hints := args.RootHints
+	if len(hints) == 0 {
+		hints = defaultRootHints
+	}
+	roots := make([]netip.Addr, 0, len(hints))
+	for _, s := range hints {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root hint %s, %w", s, err)
+		}
+		roots = append(roots, addr)
+	}
+
+	var minimize int
+	switch args.QNameMinimization {
+	case "", "relaxed":
+		minimize = minimizeRelaxed
+	case "strict":
+		minimize = minimizeStrict
+	case "off":
+		minimize = minimizeOff
+	default:
+		return nil, fmt.Errorf("invalid qname_minimization %s", args.QNameMinimization)
+	}
+
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &recursivePlugin{
+		BP: bp,
+		r:  newResolver(roots, minimize, timeout, args.IPv6, bp.L()),
+	}, nil
+}
+
+func (p *recursivePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	m, err := p.r.Resolve(ctx, question.Name, question.Qtype)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s, %w", question.Name, err)
+	}
+
+	r := new(dns.Msg)
+	r.SetRcode(q, m.Rcode)
+	r.RecursionAvailable = true
+	r.Answer = m.Answer
+	if len(r.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				r.Ns = append(r.Ns, rr)
+			}
+		}
+	}
+	qCtx.SetResponse(r)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_minimizedName(t *testing.T) {
+	name := "a.b.c.d.e.f.g.h.i.j.k.l.example.com."
+	var got []string
+	cur := "."
+	for i := 0; ; i++ {
+		qname := minimizedName(name, cur, i)
+		got = append(got, qname)
+		if qname == name {
+			break
+		}
+		cur = qname
+	}
+	// 4 queries with one more label each, then the rest is split, and at
+	// most 10 queries are minimized.
+	want := []string{"com.", "example.com.", "l.example.com.", "k.l.example.com.",
+		"j.k.l.example.com.", "i.j.k.l.example.com.", "g.h.i.j.k.l.example.com.",
+		"e.f.g.h.i.j.k.l.example.com.", "c.d.e.f.g.h.i.j.k.l.example.com.", name}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+// testServer is an authoritative server that records the names of
+// queries it received.
+type testServer struct {
+	mu     sync.Mutex
+	qnames []string
+	reply  func(q, r *dns.Msg)
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.mu.Lock()
+	s.qnames = append(s.qnames, q.Question[0].Name)
+	s.mu.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	s.reply(q, r)
+	w.WriteMsg(r)
+}
+
+func (s *testServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qnames := s.qnames
+	s.qnames = nil
+	return qnames
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// referralTo replies a referral of zone to the name server ns at addr.
+func referralTo(zone, ns, addr string) func(q, r *dns.Msg) {
+	return func(q, r *dns.Msg) {
+		if !dns.IsSubDomain(zone, strings.ToLower(q.Question[0].Name)) {
+			r.Rcode = dns.RcodeNameError
+			return
+		}
+		r.Ns = []dns.RR{mustRR(zone + " 3600 IN NS " + ns)}
+		r.Extra = []dns.RR{mustRR(ns + " 3600 IN A " + addr)}
+	}
+}
+
+func startServers(t *testing.T, servers map[string]*testServer) string {
+	t.Helper()
+	var port string
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		c, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("cannot listen on %s, %v", ip, err)
+		}
+		if len(port) == 0 {
+			port = strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port)
+		}
+		s := &dns.Server{PacketConn: c, Handler: servers[ip]}
+		go s.ActivateAndServe()
+		t.Cleanup(func() { s.Shutdown() })
+	}
+	return port
+}
+
+func Test_recursivePlugin(t *testing.T) {
+	root := &testServer{reply: referralTo("com.", "a.gtld.com.", "127.0.0.2")}
+	com := &testServer{reply: referralTo("example.com.", "ns.example.com.", "127.0.0.3")}
+	example := &testServer{reply: func(q, r *dns.Msg) {
+		r.Authoritative = true
+		name := strings.ToLower(q.Question[0].Name)
+		switch {
+		case name == "www.example.com." && q.Question[0].Qtype == dns.TypeA:
+			r.Answer = []dns.RR{mustRR("www.example.com. 300 IN A 192.0.2.1")}
+		case name == "alias.example.com.":
+			r.Answer = []dns.RR{mustRR("alias.example.com. 300 IN CNAME www.example.com.")}
+		case name == "x.y.example.com." && q.Question[0].Qtype == dns.TypeA:
+			r.Answer = []dns.RR{mustRR("x.y.example.com. 300 IN A 192.0.2.2")}
+		case name == "www.example.com.", name == "x.y.example.com.", name == "example.com.":
+			r.Ns = []dns.RR{mustRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")}
+		default:
+			// Including the empty non-terminal y.example.com, like
+			// broken servers do.
+			r.Rcode = dns.RcodeNameError
+			r.Ns = []dns.RR{mustRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")}
+		}
+	}}
+	port := startServers(t, map[string]*testServer{"127.0.0.1": root, "127.0.0.2": com, "127.0.0.3": example})
+
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	newPlugin := func(mode string) *recursivePlugin {
+		p, err := newRecursive(coremain.NewBP("test", PluginType, nil, m), &Args{RootHints: []string{"127.0.0.1"}, QNameMinimization: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.r.port = port
+		return p
+	}
+	exec := func(p *recursivePlugin, name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		qCtx := query_context.NewContext(q, nil)
+		if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+
+	p := newPlugin("")
+	r := exec(p, "www.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected response %v", r)
+	}
+	for _, tt := range []struct {
+		s    *testServer
+		want string
+	}{{root, "com."}, {com, "example.com."}, {example, "www.example.com."}} {
+		if got := strings.Join(tt.s.received(), " "); got != tt.want {
+			t.Fatalf("want queries %q, got %q", tt.want, got)
+		}
+	}
+
+	// Delegations are cached.
+	r = exec(p, "alias.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if q := root.received(); len(q) != 0 {
+		t.Fatalf("delegation is not cached, root received %v", q)
+	}
+
+	r = exec(p, "nope.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// The relaxed mode retries the full name.
+	r = exec(p, "x.y.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	r = exec(newPlugin("strict"), "x.y.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	root.received()
+	r = exec(newPlugin("off"), "www.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if got := root.received(); len(got) != 1 || got[0] != "www.example.com." {
+		t.Fatalf("want full name sent to root, got %v", got)
+	}
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxDepth         = 8  // of nested resolutions of cname targets and ns names.
+	maxIterations    = 32 // of queries of one lookup.
+	maxCNAMEChain    = 8
+	maxNSResolutions = 3 // ns names without glue that are resolved in a referral.
+	ednsUDPSize      = 1232
+
+	// RFC 9156 section 2.3
+	maxMinimiseCount = 10
+	minimiseOneLab   = 4
+)
+
+const (
+	minimizeOff = iota
+	minimizeRelaxed
+	minimizeStrict
+)
+
+var (
+	errMaxDepth      = errors.New("max resolution depth exceeded")
+	errMaxIterations = errors.New("max iterations exceeded")
+	errNoServer      = errors.New("no name server is available")
+)
+
+// delegation is a zone cut and its name servers.
+type delegation struct {
+	zone   string       // lower case fqdn
+	ns     []string     // names of name servers
+	addrs  []netip.Addr // known addresses of name servers
+	expire time.Time    // zero means never, for root hints.
+}
+
+// resolver is an iterative resolver that starts from root hints. It
+// caches delegations only, answers should be cached by the cache plugin.
+type resolver struct {
+	port     string
+	timeout  time.Duration
+	minimize int
+	ipv6     bool
+	logger   *zap.Logger
+
+	mu          sync.Mutex
+	roots       *delegation
+	delegations map[string]*delegation
+}
+
+func newResolver(roots []netip.Addr, minimize int, timeout time.Duration, ipv6 bool, logger *zap.Logger) *resolver {
+	return &resolver{
+		port:        "53",
+		timeout:     timeout,
+		minimize:    minimize,
+		ipv6:        ipv6,
+		logger:      logger,
+		roots:       &delegation{zone: ".", addrs: roots},
+		delegations: make(map[string]*delegation),
+	}
+}
+
+// closestDelegation returns the known delegation that is the closest
+// enclosing zone of name.
+func (r *resolver) closestDelegation(name string) *delegation {
+	name = strings.ToLower(name)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, ok := r.delegations[name[off:]]; ok {
+			if now.Before(d.expire) {
+				return d
+			}
+			delete(r.delegations, name[off:])
+		}
+	}
+	return r.roots
+}
+
+func (r *resolver) storeDelegation(d *delegation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delegations[d.zone] = d
+}
+
+// Resolve resolves name and qtype iteratively. The returned msg has the
+// rcode, answers (including the cname chain) and authority records of the
+// final response.
+func (r *resolver) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.resolve(ctx, name, qtype, 0)
+}
+
+func (r *resolver) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, errMaxDepth
+	}
+	var chain []dns.RR
+	for i := 0; ; i++ {
+		m, err := r.lookup(ctx, name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(chain, m.Answer...)
+		if m.Rcode != dns.RcodeSuccess || qtype == dns.TypeCNAME {
+			return m, nil
+		}
+		target, ok := danglingCNAME(m.Answer[len(chain):], name, qtype)
+		if !ok {
+			return m, nil
+		}
+		if i >= maxCNAMEChain {
+			return nil, fmt.Errorf("cname chain of %s is too long", name)
+		}
+		chain, name = m.Answer, target
+	}
+}
+
+// danglingCNAME follows the cname chain of name in answer. If the chain
+// ends with a target that has no record of qtype in answer, it returns the
+// target.
+func danglingCNAME(answer []dns.RR, name string, qtype uint16) (string, bool) {
+	followed := false
+	for i := 0; i <= len(answer); i++ {
+		next := ""
+		for _, rr := range answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == qtype {
+				return "", false
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if len(next) == 0 {
+			return name, followed
+		}
+		name, followed = next, true
+	}
+	return "", false // loop
+}
+
+// lookup queries name and qtype, starting from the closest known
+// delegation, and follows referrals. With qname minimization (RFC 9156),
+// only one more label than the current zone cut is sent to each server.
+func (r *resolver) lookup(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	d := r.closestDelegation(name)
+	minimize := r.minimize != minimizeOff
+	cur := d.zone
+	minimiseCount := 0
+	for i := 0; i < maxIterations; i++ {
+		qname, qt := name, qtype
+		if minimize {
+			qname = minimizedName(name, cur, minimiseCount)
+			if qname != name {
+				qt = dns.TypeA
+				minimiseCount++
+			}
+		}
+		minimized := qname != name
+
+		m, err := r.exchange(ctx, d, qname, qt)
+		if err != nil {
+			if minimized && r.minimize == minimizeRelaxed {
+				minimize = false
+				continue
+			}
+			return nil, err
+		}
+		if child, ok := referral(m, d.zone, qname); ok {
+			d, err = r.followReferral(ctx, m, d.zone, child, depth)
+			if err != nil {
+				return nil, err
+			}
+			cur = child
+			continue
+		}
+		if !minimized {
+			return m, nil
+		}
+
+		switch {
+		case m.Rcode == dns.RcodeSuccess && hasCNAME(m, qname):
+			// qname is an alias, the name is not under it.
+			minimize = false
+		case m.Rcode == dns.RcodeSuccess:
+			// No zone cut at qname.
+			cur = qname
+		case r.minimize == minimizeStrict:
+			// Nothing exists under a NXDOMAIN name (RFC 8020).
+			return m, nil
+		default:
+			// Some servers reply errors to empty non-terminals.
+			minimize = false
+		}
+	}
+	return nil, errMaxIterations
+}
+
+// minimizedName returns the ancestor of name that has more labels than
+// cur, which is an ancestor of name. The number of labels follows RFC 9156
+// section 2.3, so at most maxMinimiseCount queries are minimized.
+func minimizedName(name, cur string, minimiseCount int) string {
+	total := dns.CountLabel(name)
+	known := dns.CountLabel(cur)
+	if known >= total || minimiseCount >= maxMinimiseCount {
+		return name
+	}
+	add := 1
+	if minimiseCount >= minimiseOneLab {
+		add = (total - known) / (maxMinimiseCount - minimiseCount)
+		if add < 1 {
+			add = 1
+		}
+	}
+	return ancestor(name, known+add)
+}
+
+// ancestor returns the ancestor of name that has n labels.
+func ancestor(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+	if n <= 0 {
+		return "."
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+func hasCNAME(m *dns.Msg, name string) bool {
+	for _, rr := range m.Answer {
+		if h := rr.Header(); h.Rrtype == dns.TypeCNAME && strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// referral returns the child zone if m is a referral from zone for qname.
+func referral(m *dns.Msg, zone, qname string) (string, bool) {
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0 {
+		return "", false
+	}
+	for _, rr := range m.Ns {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeNS {
+			continue
+		}
+		child := strings.ToLower(h.Name)
+		if child != zone && dns.IsSubDomain(zone, child) && dns.IsSubDomain(child, strings.ToLower(qname)) {
+			return child, true
+		}
+	}
+	return "", false
+}
+
+// followReferral creates and caches the delegation of child from the
+// referral m from zone. Only in-bailiwick glue records are accepted.
+func (r *resolver) followReferral(ctx context.Context, m *dns.Msg, zone, child string, depth int) (*delegation, error) {
+	d := &delegation{zone: child}
+	var ttl uint32
+	for _, rr := range m.Ns {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, child) {
+			d.ns = append(d.ns, strings.ToLower(ns.Ns))
+			if ttl == 0 || ns.Hdr.Ttl < ttl {
+				ttl = ns.Hdr.Ttl
+			}
+		}
+	}
+	isNS := func(name string) bool {
+		name = strings.ToLower(name)
+		for _, ns := range d.ns {
+			if ns == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range m.Extra {
+		h := rr.Header()
+		if !isNS(h.Name) || !dns.IsSubDomain(zone, strings.ToLower(h.Name)) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(rr.A); ok {
+				d.addrs = append(d.addrs, addr.Unmap())
+			}
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(rr.AAAA); ok && r.ipv6 {
+				d.addrs = append(d.addrs, addr)
+			}
+		}
+	}
+	if len(d.addrs) == 0 {
+		d.addrs = r.resolveNSAddrs(ctx, d.ns, depth)
+		if len(d.addrs) == 0 {
+			return nil, fmt.Errorf("cannot resolve name servers of %s", child)
+		}
+	}
+	d.expire = time.Now().Add(time.Duration(ttl) * time.Second)
+	r.storeDelegation(d)
+	return d, nil
+}
+
+// resolveNSAddrs resolves addresses of name servers without glue.
+func (r *resolver) resolveNSAddrs(ctx context.Context, nss []string, depth int) []netip.Addr {
+	var addrs []netip.Addr
+	for i, ns := range nss {
+		if i >= maxNSResolutions {
+			break
+		}
+		qtypes := []uint16{dns.TypeA}
+		if r.ipv6 {
+			qtypes = append(qtypes, dns.TypeAAAA)
+		}
+		for _, qt := range qtypes {
+			m, err := r.resolve(ctx, ns, qt, depth+1)
+			if err != nil {
+				r.logger.Debug("failed to resolve name server", zap.String("ns", ns), zap.Error(err))
+				continue
+			}
+			for _, rr := range m.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					if addr, ok := netip.AddrFromSlice(rr.A); ok {
+						addrs = append(addrs, addr.Unmap())
+					}
+				case *dns.AAAA:
+					if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+						addrs = append(addrs, addr)
+					}
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+// exchange sends the query to servers of d until a server replies a
+// response that is not SERVFAIL or REFUSED.
+func (r *resolver) exchange(ctx context.Context, d *delegation, qname string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(ednsUDPSize, false)
+
+	var lastResp *dns.Msg
+	lastErr := errNoServer
+	for _, addr := range d.addrs {
+		m, err := r.exchangeWith(ctx, q, addr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if m.Rcode == dns.RcodeServerFailure || m.Rcode == dns.RcodeRefused {
+			lastResp = m
+			continue
+		}
+		return m, nil
+	}
+	if lastResp != nil {
+		return nil, fmt.Errorf("servers of %s replied %s", d.zone, dns.RcodeToString[lastResp.Rcode])
+	}
+	return nil, lastErr
+}
+
+func (r *resolver) exchangeWith(ctx context.Context, q *dns.Msg, addr netip.Addr) (*dns.Msg, error) {
+	server := net.JoinHostPort(addr.String(), r.port)
+	c := &dns.Client{Net: "udp", Timeout: r.timeout, UDPSize: ednsUDPSize}
+	m, _, err := c.ExchangeContext(ctx, q, server)
+	if err == nil && m.Truncated {
+		c.Net = "tcp"
+		m, _, err = c.ExchangeContext(ctx, q, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Question) != 1 || !strings.EqualFold(m.Question[0].Name, q.Question[0].Name) || m.Question[0].Qtype != q.Question[0].Qtype {
+		return nil, fmt.Errorf("unexpected question in the response from %s", server)
+	}
+	return m, nil
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+const PluginType = "rewrite"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*rewritePlugin)(nil)
+
+type Args struct {
+	// Query rewrites the query name before the rest of the sequence is
+	// executed. The first matched rule is used. Records of the rewritten
+	// name in the response are renamed back to the original name, so
+	// clients won't notice the rewrite (aliasing).
+	Query []NameRule `yaml:"query"`
+
+	// QueryCNAME inserts a CNAME record from the original name to the
+	// rewritten name to the response, instead of renaming records back.
+	QueryCNAME bool `yaml:"query_cname"`
+
+	// Names rewrites owner names and target names (CNAME, DNAME, NS, PTR,
+	// MX, SRV, SVCB and HTTPS) of answer records.
+	Names []NameRule `yaml:"names"`
+
+	// IPs rewrites addresses of A and AAAA answer records.
+	IPs []IPRule `yaml:"ips"`
+}
+
+// NameRule rewrites names that match Regexp to Replace. Names are fqdns in
+// lower case, e.g. "www.example.com.". Replace is a template that can
+// refer to capture groups, e.g. "$1.internal." or "${name}.internal.".
+type NameRule struct {
+	Regexp  string `yaml:"regexp"`
+	Replace string `yaml:"replace"`
+}
+
+// IPRule rewrites addresses in From to To. From and To are prefixes with
+// the same length, e.g. "10.0.0.0/8" and "172.16.0.0/8". The host bits
+// of addresses are kept.
+type IPRule struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+type nameRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+type ipRule struct {
+	from, to netip.Prefix
+}
+
+type rewritePlugin struct {
+	*coremain.BP
+	query      []nameRule
+	queryCNAME bool
+	names      []nameRule
+	ips        []ipRule
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newRewrite(bp, args.(*Args))
+}
+
+func newRewrite(bp *coremain.BP, args *Args) (*rewritePlugin, error) {
+	query, err := parseNameRules(args.Query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query rule, %w", err)
+	}
+	names, err := parseNameRules(args.Names)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name rule, %w", err)
+	}
+	ips := make([]ipRule, 0, len(args.IPs))
+	for i, ra := range args.IPs {
+		from, err := netip.ParsePrefix(ra.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip rule #%d, %w", i, err)
+		}
+		to, err := netip.ParsePrefix(ra.To)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip rule #%d, %w", i, err)
+		}
+		if from.Addr().Is4() != to.Addr().Is4() || from.Bits() != to.Bits() {
+			return nil, fmt.Errorf("invalid ip rule #%d, prefixes must have the same family and length", i)
+		}
+		ips = append(ips, ipRule{from: from.Masked(), to: to.Masked()})
+	}
+	return &rewritePlugin{
+		BP:         bp,
+		query:      query,
+		queryCNAME: args.QueryCNAME,
+		names:      names,
+		ips:        ips,
+	}, nil
+}
+
+func parseNameRules(args []NameRule) ([]nameRule, error) {
+	rules := make([]nameRule, 0, len(args))
+	for i, ra := range args {
+		re, err := regexp.Compile(ra.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("#%d: %w", i, err)
+		}
+		if len(ra.Replace) == 0 {
+			return nil, fmt.Errorf("#%d: missing replace", i)
+		}
+		rules = append(rules, nameRule{re: re, replace: ra.Replace})
+	}
+	return rules, nil
+}
+
+// rewriteName returns the name rewritten by the first matched rule.
+// Rewritten names that are not valid domain names are ignored.
+func rewriteName(rules []nameRule, name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, r := range rules {
+		m := r.re.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+		newName := dns.Fqdn(string(r.re.ExpandString(nil, r.replace, name, m)))
+		if _, ok := dns.IsDomainName(newName); !ok {
+			continue
+		}
+		return newName, true
+	}
+	return "", false
+}
+
+func rewriteIP(rules []ipRule, addr netip.Addr) (netip.Addr, bool) {
+	for _, r := range rules {
+		if !r.from.Contains(addr) {
+			continue
+		}
+		b := addr.AsSlice()
+		to := r.to.Addr().AsSlice()
+		bits := r.to.Bits()
+		for i := 0; i < bits/8; i++ {
+			b[i] = to[i]
+		}
+		if rem := bits % 8; rem != 0 {
+			mask := byte(0xff << (8 - rem))
+			b[bits/8] = to[bits/8]&mask | b[bits/8]&^mask
+		}
+		newAddr, _ := netip.AddrFromSlice(b)
+		return newAddr, true
+	}
+	return netip.Addr{}, false
+}
+
+func (p *rewritePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	orgQName := q.Question[0].Name
+	newQName, rewritten := rewriteName(p.query, orgQName)
+	if rewritten {
+		q.Question[0].Name = newQName
+	}
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	if rewritten {
+		q.Question[0].Name = orgQName
+	}
+
+	r := qCtx.R()
+	if r == nil {
+		return err
+	}
+	if rewritten {
+		p.restoreQName(r, orgQName, newQName)
+	}
+	p.rewriteAnswer(r)
+	return err
+}
+
+// restoreQName restores the original query name in r, which is the
+// response of the rewritten query.
+func (p *rewritePlugin) restoreQName(r *dns.Msg, orgQName, newQName string) {
+	for i := range r.Question {
+		if strings.EqualFold(r.Question[i].Name, newQName) {
+			r.Question[i].Name = orgQName
+		}
+	}
+
+	if p.queryCNAME {
+		newAns := make([]dns.RR, 1, len(r.Answer)+1)
+		newAns[0] = &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   orgQName,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    1,
+			},
+			Target: newQName,
+		}
+		r.Answer = append(newAns, r.Answer...)
+		return
+	}
+	for _, rr := range r.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, newQName) {
+			h.Name = orgQName
+		}
+	}
+}
+
+func (p *rewritePlugin) rewriteAnswer(r *dns.Msg) {
+	if len(p.names) == 0 && len(p.ips) == 0 {
+		return
+	}
+	rn := func(s *string) {
+		if newName, ok := rewriteName(p.names, *s); ok {
+			*s = newName
+		}
+	}
+	rip := func(ip *net.IP) {
+		addr, ok := netip.AddrFromSlice(*ip)
+		if !ok {
+			return
+		}
+		if newAddr, ok := rewriteIP(p.ips, addr.Unmap()); ok {
+			*ip = newAddr.AsSlice()
+		}
+	}
+	for _, rr := range r.Answer {
+		if len(p.names) > 0 {
+			rn(&rr.Header().Name)
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				rn(&rr.Target)
+			case *dns.DNAME:
+				rn(&rr.Target)
+			case *dns.NS:
+				rn(&rr.Ns)
+			case *dns.PTR:
+				rn(&rr.Ptr)
+			case *dns.MX:
+				rn(&rr.Mx)
+			case *dns.SRV:
+				rn(&rr.Target)
+			case *dns.SVCB:
+				rn(&rr.Target)
+			case *dns.HTTPS:
+				rn(&rr.Target)
+			}
+		}
+		if len(p.ips) > 0 {
+			switch rr := rr.(type) {
+			case *dns.A:
+				rip(&rr.A)
+			case *dns.AAAA:
+				rip(&rr.AAAA)
+			}
+		}
+	}
+}
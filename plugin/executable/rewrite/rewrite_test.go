@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rewrite
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func Test_rewriteIP(t *testing.T) {
+	rules := []ipRule{
+		{from: netip.MustParsePrefix("10.0.0.0/8"), to: netip.MustParsePrefix("172.16.0.0/8")},
+		{from: netip.MustParsePrefix("192.168.0.0/20"), to: netip.MustParsePrefix("192.168.48.0/20")},
+		{from: netip.MustParsePrefix("2001:db8::/32"), to: netip.MustParsePrefix("fd00::/32")},
+	}
+	tests := []struct {
+		addr string
+		want string // empty means no rewrite
+	}{
+		{"10.1.2.3", "172.1.2.3"},
+		{"192.168.1.2", "192.168.49.2"},
+		{"192.168.16.2", ""},
+		{"2001:db8::1", "fd00::1"},
+		{"1.1.1.1", ""},
+	}
+	for _, tt := range tests {
+		got, ok := rewriteIP(rules, netip.MustParseAddr(tt.addr))
+		if (len(tt.want) > 0) != ok || (ok && got != netip.MustParseAddr(tt.want)) {
+			t.Errorf("%s: want %q, got %s", tt.addr, tt.want, got)
+		}
+	}
+}
+
+// testNext replies a CNAME to "cdn.example.net." and an A record for
+// A queries.
+type testNext struct{}
+
+func (n *testNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	name := q.Question[0].Name
+	r.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "cdn.example.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("10.1.2.3")},
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_rewritePlugin(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	exec := func(args *Args, name string) (*dns.Msg, *dns.Msg) {
+		t.Helper()
+		p, err := newRewrite(coremain.NewBP("test", PluginType, nil, m), args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(&testNext{})); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.Q(), qCtx.R()
+	}
+
+	query := []NameRule{{Regexp: `^(.+)\.corp\.example\.$`, Replace: "${1}.internal."}}
+
+	// Aliasing
+	q, r := exec(&Args{Query: query}, "WWW.corp.example.")
+	if q.Question[0].Name != "WWW.corp.example." || r.Question[0].Name != "WWW.corp.example." {
+		t.Fatalf("query name is not restored, q %v, r %v", q.Question, r.Question)
+	}
+	if len(r.Answer) != 2 || r.Answer[0].Header().Name != "WWW.corp.example." {
+		t.Fatalf("unexpected answer %v", r.Answer)
+	}
+
+	// CNAME
+	_, r = exec(&Args{Query: query, QueryCNAME: true}, "www.corp.example.")
+	if len(r.Answer) != 3 || r.Answer[0].(*dns.CNAME).Target != "www.internal." || r.Answer[1].Header().Name != "www.internal." {
+		t.Fatalf("unexpected answer %v", r.Answer)
+	}
+
+	// Not matched
+	_, r = exec(&Args{Query: query}, "www.example.")
+	if r.Answer[0].Header().Name != "www.example." {
+		t.Fatalf("unexpected answer %v", r.Answer)
+	}
+
+	// Answer names and ips
+	_, r = exec(&Args{
+		Names: []NameRule{{Regexp: `^cdn\.(.+)$`, Replace: "edge.$1"}},
+		IPs:   []IPRule{{From: "10.0.0.0/8", To: "192.0.0.0/8"}},
+	}, "www.example.")
+	cname, a := r.Answer[0].(*dns.CNAME), r.Answer[1].(*dns.A)
+	if cname.Target != "edge.example.net." || a.Hdr.Name != "edge.example.net." || a.A.String() != "192.1.2.3" {
+		t.Fatalf("unexpected answer %v", r.Answer)
+	}
+
+	if _, err := newRewrite(coremain.NewBP("test", PluginType, nil, m), &Args{IPs: []IPRule{{From: "10.0.0.0/8", To: "fd00::/8"}}}); err == nil {
+		t.Fatal("ip rule with different families should be rejected")
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package route
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+)
+
+const PluginType = "route"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+// Args configures routes for the IPs in responses. Put the plugin after
+// a domain matcher in a sequence to route specific destinations, e.g.
+// through a VPN interface in a separate table with policy routing.
+// Routes are removed once expired and when the plugin is closed.
+type Args struct {
+	Table     uint32 `yaml:"table"`     // default 254 (main)
+	Interface string `yaml:"interface"` // output interface, optional if gateways are set
+	Gateway4  string `yaml:"gateway4"`  // optional
+	Gateway6  string `yaml:"gateway6"`  // optional
+	Metric    uint32 `yaml:"metric"`
+	Mask4     int    `yaml:"mask4"` // default 32
+	Mask6     int    `yaml:"mask6"` // default 128
+
+	// Routes expire after the TTL of the record, but at least MinTTL
+	// (sec, default 300), after the last response that contained the IP.
+	MinTTL uint32 `yaml:"min_ttl"`
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newRoutePlugin(bp, args.(*Args))
+}
@@ -0,0 +1,264 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/route_utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinTTL       = 300
+	expireCheckInterval = time.Second * 10
+)
+
+var _ coremain.ExecutablePlugin = (*routePlugin)(nil)
+var _ coremain.Shutdowner = (*routePlugin)(nil)
+
+type routePlugin struct {
+	*coremain.BP
+	args     *Args
+	nl       *route_utils.Conn
+	gateway4 netip.Addr // invalid if not set
+	gateway6 netip.Addr
+
+	m      sync.Mutex
+	routes map[netip.Prefix]time.Time // installed routes and their expiration time
+	closed bool
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	expirerDone chan struct{}
+}
+
+func newRoutePlugin(bp *coremain.BP, args *Args) (*routePlugin, error) {
+	if m := args.Mask4; m <= 0 || m > 32 {
+		args.Mask4 = 32
+	}
+	if m := args.Mask6; m <= 0 || m > 128 {
+		args.Mask6 = 128
+	}
+	if args.MinTTL == 0 {
+		args.MinTTL = defaultMinTTL
+	}
+
+	p := &routePlugin{
+		BP:          bp,
+		args:        args,
+		routes:      make(map[netip.Prefix]time.Time),
+		closeNotify: make(chan struct{}),
+		expirerDone: make(chan struct{}),
+	}
+	var err error
+	if len(args.Gateway4) > 0 {
+		if p.gateway4, err = netip.ParseAddr(args.Gateway4); err != nil || !p.gateway4.Is4() {
+			return nil, fmt.Errorf("invalid ipv4 gateway %s", args.Gateway4)
+		}
+	}
+	if len(args.Gateway6) > 0 {
+		if p.gateway6, err = netip.ParseAddr(args.Gateway6); err != nil || !p.gateway6.Is6() {
+			return nil, fmt.Errorf("invalid ipv6 gateway %s", args.Gateway6)
+		}
+	}
+	if len(args.Interface) == 0 && !p.gateway4.IsValid() && !p.gateway6.IsValid() {
+		return nil, errors.New("missing interface or gateway")
+	}
+
+	p.nl, err = route_utils.Dial()
+	if err != nil {
+		return nil, err
+	}
+	go p.startExpirer()
+	return p, nil
+}
+
+func (p *routePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	r := qCtx.R()
+	if r != nil {
+		if err := p.addRoutes(r); err != nil {
+			p.L().Warn("failed to add routes", qCtx.InfoField(), zap.Error(err))
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *routePlugin) Close() error {
+	return p.Shutdown(context.Background())
+}
+
+// Shutdown stops the expirer and removes all installed routes.
+func (p *routePlugin) Shutdown(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+	})
+	select {
+	case <-p.expirerDone:
+	case <-ctx.Done():
+		p.L().Warn("route expirer did not exit in time", zap.Error(ctx.Err()))
+	}
+
+	p.m.Lock()
+	p.closed = true
+	for prefix := range p.routes {
+		if err := p.delRoute(prefix); err != nil {
+			p.L().Warn("failed to remove route", zap.Stringer("dst", prefix), zap.Error(err))
+		}
+		delete(p.routes, prefix)
+	}
+	p.m.Unlock()
+	return p.nl.Close()
+}
+
+func (p *routePlugin) addRoutes(r *dns.Msg) error {
+	now := time.Now()
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return nil
+	}
+
+	for i := range r.Answer {
+		var addr netip.Addr
+		var mask int
+		var ok bool
+		switch rr := r.Answer[i].(type) {
+		case *dns.A:
+			addr, ok = netip.AddrFromSlice(rr.A.To4())
+			mask = p.args.Mask4
+		case *dns.AAAA:
+			addr, ok = netip.AddrFromSlice(rr.AAAA.To16())
+			mask = p.args.Mask6
+		default:
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("invalid ip in record %s", r.Answer[i])
+		}
+
+		ttl := r.Answer[i].Header().Ttl
+		if ttl < p.args.MinTTL {
+			ttl = p.args.MinTTL
+		}
+		expire := now.Add(time.Duration(ttl) * time.Second)
+		prefix := netip.PrefixFrom(addr, mask).Masked()
+		if e, installed := p.routes[prefix]; installed {
+			if expire.After(e) {
+				p.routes[prefix] = expire
+			}
+			continue
+		}
+
+		route, ok, err := p.route(prefix)
+		if err != nil {
+			return err
+		}
+		if !ok { // no gateway or interface for this family
+			continue
+		}
+		if err := p.nl.Replace(route); err != nil {
+			return err
+		}
+		p.routes[prefix] = expire
+	}
+	return nil
+}
+
+// route returns the route to prefix. ok is false if there is no
+// gateway or interface for the family of prefix.
+func (p *routePlugin) route(prefix netip.Prefix) (_ route_utils.Route, ok bool, err error) {
+	r := route_utils.Route{Dst: prefix, Table: p.args.Table, Metric: p.args.Metric}
+	if prefix.Addr().Is4() {
+		r.Gateway = p.gateway4
+	} else {
+		r.Gateway = p.gateway6
+	}
+	if len(p.args.Interface) > 0 {
+		// Resolve the index every time, tunnel interfaces may be re-created.
+		iface, err := net.InterfaceByName(p.args.Interface)
+		if err != nil {
+			return r, false, err
+		}
+		r.OIF = iface.Index
+	} else if !r.Gateway.IsValid() {
+		return r, false, nil
+	}
+	return r, true, nil
+}
+
+// delRoute deletes the route to prefix. Caller must hold p.m.
+func (p *routePlugin) delRoute(prefix netip.Prefix) error {
+	r := route_utils.Route{Dst: prefix, Table: p.args.Table, Metric: p.args.Metric}
+	if prefix.Addr().Is4() {
+		r.Gateway = p.gateway4
+	} else {
+		r.Gateway = p.gateway6
+	}
+	if !r.Gateway.IsValid() {
+		// The interface may have gone, the route has been removed with it.
+		iface, err := net.InterfaceByName(p.args.Interface)
+		if err != nil {
+			return nil
+		}
+		r.OIF = iface.Index
+	}
+	return p.nl.Del(r)
+}
+
+// startExpirer removes expired routes periodically.
+func (p *routePlugin) startExpirer() {
+	defer close(p.expirerDone)
+	ticker := time.NewTicker(expireCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case now := <-ticker.C:
+			p.removeExpired(now)
+		}
+	}
+}
+
+func (p *routePlugin) removeExpired(now time.Time) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for prefix, expire := range p.routes {
+		if now.Before(expire) {
+			continue
+		}
+		if err := p.delRoute(prefix); err != nil {
+			p.L().Warn("failed to remove expired route", zap.Stringer("dst", prefix), zap.Error(err))
+		}
+		delete(p.routes, prefix)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package route
+
+import (
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/miekg/dns"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_routePlugin(t *testing.T) {
+	if os.Getenv("TEST_ROUTE") == "" {
+		t.SkipNow()
+	}
+	p, err := newRoutePlugin(coremain.NewBP("test", PluginType, nil, nil), &Args{Table: 1000, Interface: "lo", Mask4: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	r := new(dns.Msg)
+	for _, s := range []string{"a. 10 IN A 192.0.2.1", "a. 10 IN A 192.0.2.2", "a. 10 IN AAAA 2001:db8::1"} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	if err := p.addRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.routes) != 2 {
+		t.Fatalf("want 2 routes, got %v", p.routes)
+	}
+
+	p.removeExpired(time.Now().Add(time.Hour))
+	if len(p.routes) != 0 {
+		t.Fatalf("expired routes were not removed, %v", p.routes)
+	}
+	// The route should be installed again.
+	if err := p.addRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.routes[netip.MustParsePrefix("192.0.2.0/24")]; !ok {
+		t.Fatal("route was not installed")
+	}
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package static_records
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/netip"
+	"strings"
+)
+
+const PluginType = "static_records"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultTTL    = 300
+	maxCNAMEChain = 8
+)
+
+var _ coremain.ExecutablePlugin = (*staticRecords)(nil)
+
+type Args struct {
+	TTL     int          `yaml:"ttl"` // Default ttl of records. Default is 300.
+	Records []RecordArgs `yaml:"records"`
+}
+
+// RecordArgs declares records of a name. Values of MX, SRV and HTTPS are
+// in zone file format, e.g. "10 mail.example.com.",
+// "0 5 5060 sip.example.com." and "1 . alpn=h2,h3".
+type RecordArgs struct {
+	// Name is a domain name, e.g. "nas.lan". "*.example.com" matches all
+	// subdomains of "example.com" that are not declared.
+	Name  string   `yaml:"name"`
+	TTL   int      `yaml:"ttl"` // Default is Args.TTL.
+	A     []string `yaml:"a"`
+	AAAA  []string `yaml:"aaaa"`
+	CNAME string   `yaml:"cname"`
+	TXT   []string `yaml:"txt"`
+	MX    []string `yaml:"mx"`
+	SRV   []string `yaml:"srv"`
+	HTTPS []string `yaml:"https"`
+}
+
+// staticRecords answers queries of declared names authoritatively. A
+// declared name without records of the query type gets an empty answer
+// (NODATA). A CNAME is followed if its target is declared. Otherwise, the
+// query of the target is passed to next, and the CNAME is prepended to
+// its answer. Queries of other names are passed to next.
+type staticRecords struct {
+	*coremain.BP
+	records map[string]map[uint16][]dns.RR // lower case fqdn -> type -> rrs
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newStaticRecords(bp, args.(*Args))
+}
+
+func newStaticRecords(bp *coremain.BP, args *Args) (*staticRecords, error) {
+	defTTL := args.TTL
+	if defTTL <= 0 {
+		defTTL = defaultTTL
+	}
+	p := &staticRecords{
+		BP:      bp,
+		records: make(map[string]map[uint16][]dns.RR),
+	}
+	for i, ra := range args.Records {
+		if err := p.load(&ra, defTTL); err != nil {
+			return nil, fmt.Errorf("invalid record #%d %s, %w", i, ra.Name, err)
+		}
+	}
+	bp.L().Info("static records loaded", zap.Int("names", len(p.records)))
+	return p, nil
+}
+
+func (p *staticRecords) load(ra *RecordArgs, defTTL int) error {
+	name := strings.ToLower(dns.Fqdn(ra.Name))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return fmt.Errorf("invalid name")
+	}
+	ttl := ra.TTL
+	if ttl <= 0 {
+		ttl = defTTL
+	}
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: uint32(ttl)}
+	}
+
+	set := p.records[name]
+	if set == nil {
+		set = make(map[uint16][]dns.RR)
+		p.records[name] = set
+	}
+	for _, s := range ra.A {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is4() {
+			return fmt.Errorf("invalid a record %s", s)
+		}
+		set[dns.TypeA] = append(set[dns.TypeA], &dns.A{Hdr: hdr(dns.TypeA), A: addr.AsSlice()})
+	}
+	for _, s := range ra.AAAA {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is6() {
+			return fmt.Errorf("invalid aaaa record %s", s)
+		}
+		set[dns.TypeAAAA] = append(set[dns.TypeAAAA], &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: addr.AsSlice()})
+	}
+	if len(ra.CNAME) > 0 {
+		target := dns.Fqdn(ra.CNAME)
+		if _, ok := dns.IsDomainName(target); !ok {
+			return fmt.Errorf("invalid cname %s", ra.CNAME)
+		}
+		set[dns.TypeCNAME] = []dns.RR{&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: target}}
+	}
+	for _, s := range ra.TXT {
+		set[dns.TypeTXT] = append(set[dns.TypeTXT], &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: splitTXT(s)})
+	}
+	for t, values := range map[uint16][]string{dns.TypeMX: ra.MX, dns.TypeSRV: ra.SRV, dns.TypeHTTPS: ra.HTTPS} {
+		for _, s := range values {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, dns.TypeToString[t], s))
+			if err != nil {
+				return fmt.Errorf("invalid %s record %s, %w", strings.ToLower(dns.TypeToString[t]), s, err)
+			}
+			set[t] = append(set[t], rr)
+		}
+	}
+	if _, ok := set[dns.TypeCNAME]; ok && len(set) > 1 {
+		return fmt.Errorf("cname cannot coexist with other records")
+	}
+	return nil
+}
+
+// splitTXT splits s into character strings of at most 255 bytes.
+func splitTXT(s string) []string {
+	var txt []string
+	for len(s) > 255 {
+		txt = append(txt, s[:255])
+		s = s[255:]
+	}
+	return append(txt, s)
+}
+
+// lookup returns the records of name. Records of a wildcard are copied
+// and renamed to name.
+func (p *staticRecords) lookup(name string) (map[uint16][]dns.RR, bool) {
+	lname := strings.ToLower(name)
+	if set, ok := p.records[lname]; ok {
+		return set, true
+	}
+	for off, end := dns.NextLabel(lname, 0); !end; off, end = dns.NextLabel(lname, off) {
+		set, ok := p.records["*."+lname[off:]]
+		if !ok {
+			continue
+		}
+		renamed := make(map[uint16][]dns.RR, len(set))
+		for t, rrs := range set {
+			for _, rr := range rrs {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				renamed[t] = append(renamed[t], rr)
+			}
+		}
+		return renamed, true
+	}
+	return nil, false
+}
+
+func (p *staticRecords) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	set, ok := p.lookup(question.Name)
+	if !ok {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	// copyRR copies rr with the owner name of the query, which may have a
+	// different case.
+	copyRR := func(rr dns.RR) dns.RR {
+		rr = dns.Copy(rr)
+		if h := rr.Header(); strings.EqualFold(h.Name, question.Name) {
+			h.Name = question.Name
+		}
+		return rr
+	}
+
+	var chain []dns.RR
+	for i := 0; ; i++ {
+		cname := set[dns.TypeCNAME]
+		if len(cname) == 0 || question.Qtype == dns.TypeCNAME || i >= maxCNAMEChain {
+			break
+		}
+		chain = append(chain, copyRR(cname[0]))
+		target := cname[0].(*dns.CNAME).Target
+		if set, ok = p.lookup(target); !ok {
+			return p.execTarget(ctx, qCtx, next, chain, target)
+		}
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+	r.Answer = chain
+	for _, rr := range set[question.Qtype] {
+		r.Answer = append(r.Answer, copyRR(rr))
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// execTarget executes next with the query of the cname target, and
+// prepends the cname chain to the response.
+func (p *staticRecords) execTarget(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode, chain []dns.RR, target string) error {
+	q := qCtx.Q()
+	orgQName := q.Question[0].Name
+	q.Question[0].Name = target
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	q.Question[0].Name = orgQName
+	if r := qCtx.R(); r != nil {
+		for i := range r.Question {
+			if r.Question[i].Name == target {
+				r.Question[i].Name = orgQName
+			}
+		}
+		r.Answer = append(chain, r.Answer...)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package static_records
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func Test_staticRecords(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	p, err := newStaticRecords(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Records: []RecordArgs{
+			{Name: "nas.lan", A: []string{"192.168.1.2"}, AAAA: []string{"fd00::2"}, TXT: []string{"hello"}},
+			{Name: "mail.lan", TTL: 60, MX: []string{"10 nas.lan."}, SRV: []string{"0 5 25 nas.lan."}},
+			{Name: "svc.lan", HTTPS: []string{`1 . alpn="h2,h3"`}},
+			{Name: "*.apps.lan", CNAME: "nas.lan"},
+			{Name: "cdn.lan", CNAME: "cdn.example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// next answers A queries with 1.1.1.1.
+	nextR := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(1, 1, 1, 1)}}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		wantNext bool
+		want     []string // answer rr types, in order
+	}{
+		{"nas.lan.", dns.TypeA, false, []string{"A"}},
+		{"NAS.lan.", dns.TypeAAAA, false, []string{"AAAA"}},
+		{"nas.lan.", dns.TypeTXT, false, []string{"TXT"}},
+		{"nas.lan.", dns.TypeMX, false, nil},
+		{"mail.lan.", dns.TypeMX, false, []string{"MX"}},
+		{"mail.lan.", dns.TypeSRV, false, []string{"SRV"}},
+		{"svc.lan.", dns.TypeHTTPS, false, []string{"HTTPS"}},
+		{"a.b.apps.lan.", dns.TypeA, false, []string{"CNAME", "A"}},
+		{"a.apps.lan.", dns.TypeCNAME, false, []string{"CNAME"}},
+		{"apps.lan.", dns.TypeA, true, nil},
+		{"other.lan.", dns.TypeA, true, nil},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		qCtx := query_context.NewContext(q, nil)
+		next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: nextR(q)})
+		if err := p.Exec(context.Background(), qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if tt.wantNext != !r.Authoritative {
+			t.Errorf("%s %s: unexpected response %v", tt.name, dns.TypeToString[tt.qtype], r)
+			continue
+		}
+		if tt.wantNext {
+			continue
+		}
+		var got []string
+		for _, rr := range r.Answer {
+			got = append(got, dns.TypeToString[rr.Header().Rrtype])
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s %s: want %v, got %v", tt.name, dns.TypeToString[tt.qtype], tt.want, r.Answer)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s %s: want %v, got %v", tt.name, dns.TypeToString[tt.qtype], tt.want, r.Answer)
+				break
+			}
+		}
+		if len(r.Answer) > 0 && r.Answer[0].Header().Name != tt.name {
+			t.Errorf("%s %s: unexpected owner name %v", tt.name, dns.TypeToString[tt.qtype], r.Answer[0])
+		}
+	}
+
+	// The cname target that is not declared is resolved by next.
+	q := new(dns.Msg)
+	q.SetQuestion("cdn.lan.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	target := new(dns.Msg)
+	target.SetQuestion("cdn.example.com.", dns.TypeA)
+	next := executable_seq.WrapExecutable(&executable_seq.DummyExecutable{WantR: nextR(target)})
+	if err := p.Exec(context.Background(), qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r.Question[0].Name != "cdn.lan." || r.Answer[1].Header().Name != "cdn.example.com." {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	if _, err := newStaticRecords(coremain.NewBP("test", PluginType, nil, m), &Args{
+		Records: []RecordArgs{{Name: "x.lan", CNAME: "y.lan", A: []string{"192.168.1.2"}}},
+	}); err == nil {
+		t.Fatal("cname with other records should be rejected")
+	}
+}
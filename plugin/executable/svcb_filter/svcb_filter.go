@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package svcb_filter
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/netip"
+)
+
+const PluginType = "svcb_filter"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*svcbFilter)(nil)
+
+// Args of the svcb_filter plugin. It applies to HTTPS (type 65) and SVCB
+// (type 64) records in the answer and additional sections.
+type Args struct {
+	// Domain are query names that the plugin applies to. It has the same
+	// format as the domain of query_matcher. Default is all names.
+	Domain []string `yaml:"domain"`
+
+	// Drop removes HTTPS and SVCB records entirely.
+	Drop bool `yaml:"drop"`
+
+	// StripECH removes the ech parameter, so clients connect without
+	// Encrypted Client Hello.
+	StripECH bool `yaml:"strip_ech"`
+
+	// RemoveHints removes the ipv4hint and ipv6hint parameters, so
+	// clients use A and AAAA records.
+	RemoveHints bool `yaml:"remove_hints"`
+
+	// IPv4Hint and IPv6Hint replace existing ipv4hint and ipv6hint
+	// parameters, e.g. with the addresses that A and AAAA queries of the
+	// names are redirected to.
+	IPv4Hint []string `yaml:"ipv4hint"`
+	IPv6Hint []string `yaml:"ipv6hint"`
+}
+
+type svcbFilter struct {
+	*coremain.BP
+	args     *Args
+	domain   *domain.MatcherGroup[struct{}] // nil if Args.Domain is empty.
+	ipv4Hint []net.IP
+	ipv6Hint []net.IP
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newSVCBFilter(bp, args.(*Args))
+}
+
+func newSVCBFilter(bp *coremain.BP, args *Args) (*svcbFilter, error) {
+	p := &svcbFilter{BP: bp, args: args}
+	for _, s := range args.IPv4Hint {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid ipv4hint %s", s)
+		}
+		p.ipv4Hint = append(p.ipv4Hint, addr.AsSlice())
+	}
+	for _, s := range args.IPv6Hint {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is6() {
+			return nil, fmt.Errorf("invalid ipv6hint %s", s)
+		}
+		p.ipv6Hint = append(p.ipv6Hint, addr.AsSlice())
+	}
+	if len(args.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.Domain, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		bp.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
+		p.domain = mg
+	}
+	return p, nil
+}
+
+func (p *svcbFilter) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := qCtx.R(); r != nil && p.match(qCtx.Q()) {
+		p.filter(qCtx.Q(), r)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *svcbFilter) match(q *dns.Msg) bool {
+	if p.domain == nil {
+		return true
+	}
+	if len(q.Question) != 1 {
+		return false
+	}
+	_, ok := p.domain.Match(q.Question[0].Name)
+	return ok
+}
+
+func (p *svcbFilter) filter(q, r *dns.Msg) {
+	hadAnswer := len(r.Answer) > 0
+	r.Answer = p.filterSection(r.Answer)
+	r.Extra = p.filterSection(r.Extra)
+
+	if hadAnswer && len(r.Answer) == 0 && r.Rcode == dns.RcodeSuccess {
+		if _, hasSOA := dnsutils.GetNegativeTTL(r); !hasSOA && len(q.Question) == 1 {
+			r.Ns = append(r.Ns, dnsutils.FakeSOA(q.Question[0].Name))
+		}
+	}
+}
+
+// filterSection removes or modifies HTTPS and SVCB records in rrs in place.
+func (p *svcbFilter) filterSection(rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			kept = append(kept, rr)
+			continue
+		}
+		if p.args.Drop {
+			continue
+		}
+		p.filterParams(svcb)
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+func (p *svcbFilter) filterParams(svcb *dns.SVCB) {
+	removed := make(map[dns.SVCBKey]struct{})
+	params := svcb.Value[:0]
+	for _, kv := range svcb.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBECHConfig:
+			if p.args.StripECH {
+				removed[kv.Key()] = struct{}{}
+				continue
+			}
+		case *dns.SVCBIPv4Hint:
+			if p.args.RemoveHints {
+				removed[kv.Key()] = struct{}{}
+				continue
+			}
+			if len(p.ipv4Hint) > 0 {
+				kv.Hint = p.ipv4Hint
+			}
+		case *dns.SVCBIPv6Hint:
+			if p.args.RemoveHints {
+				removed[kv.Key()] = struct{}{}
+				continue
+			}
+			if len(p.ipv6Hint) > 0 {
+				kv.Hint = p.ipv6Hint
+			}
+		}
+		params = append(params, kv)
+	}
+	svcb.Value = params
+	if len(removed) == 0 {
+		return
+	}
+
+	// Removed keys must not be mandatory (RFC 9460 section 8).
+	params = svcb.Value[:0]
+	for _, kv := range svcb.Value {
+		if m, ok := kv.(*dns.SVCBMandatory); ok {
+			codes := make([]dns.SVCBKey, 0, len(m.Code))
+			for _, k := range m.Code {
+				if _, ok := removed[k]; !ok {
+					codes = append(codes, k)
+				}
+			}
+			if len(codes) == 0 {
+				continue
+			}
+			m.Code = codes
+		}
+		params = append(params, kv)
+	}
+	svcb.Value = params
+}
+
+func (p *svcbFilter) Close() error {
+	if p.domain != nil {
+		_ = p.domain.Close()
+	}
+	return nil
+}
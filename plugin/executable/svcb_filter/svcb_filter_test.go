@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package svcb_filter
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_svcbFilter(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	const rr = `example.com. 300 IN HTTPS 1 . mandatory=ech alpn="h2,h3" ipv4hint="1.1.1.1" ech="AEX+DQBB" ipv6hint="2001:db8::1"`
+	tests := []struct {
+		name  string
+		args  *Args
+		qname string
+		want  string // empty means the record is removed
+	}{
+		{"strip ech", &Args{StripECH: true}, "example.com.",
+			`example.com.	300	IN	HTTPS	1 . alpn="h2,h3" ipv4hint="1.1.1.1" ipv6hint="2001:db8::1"`},
+		{"remove hints", &Args{RemoveHints: true}, "example.com.",
+			`example.com.	300	IN	HTTPS	1 . mandatory="ech" alpn="h2,h3" ech="AEX+DQBB"`},
+		{"rewrite hints", &Args{IPv4Hint: []string{"192.168.1.1", "192.168.1.2"}}, "example.com.",
+			`example.com.	300	IN	HTTPS	1 . mandatory="ech" alpn="h2,h3" ipv4hint="192.168.1.1,192.168.1.2" ech="AEX+DQBB" ipv6hint="2001:db8::1"`},
+		{"drop", &Args{Drop: true}, "example.com.", ""},
+		{"domain not matched", &Args{Domain: []string{"example.org"}, Drop: true}, "example.com.", rr},
+		{"domain matched", &Args{Domain: []string{"example.org"}, Drop: true}, "www.example.org.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newSVCBFilter(coremain.NewBP("test", PluginType, nil, m), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, dns.TypeHTTPS)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			https, err := dns.NewRR(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Answer = []dns.RR{https}
+			qCtx := query_context.NewContext(q, nil)
+			qCtx.SetResponse(r)
+			if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			r = qCtx.R()
+			if len(tt.want) == 0 {
+				if len(r.Answer) != 0 || len(r.Ns) != 1 {
+					t.Fatalf("want a nodata response, got %v", r)
+				}
+				return
+			}
+			want, err := dns.NewRR(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Answer) != 1 || r.Answer[0].String() != want.String() {
+				t.Fatalf("want %s, got %v", want, r.Answer)
+			}
+		})
+	}
+}
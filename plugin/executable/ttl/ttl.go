@@ -20,11 +20,20 @@
 package ttl
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cache/mem_cache"
 	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -35,37 +44,156 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
 }
 
+const (
+	decayCacheSize            = 64 * 1024
+	decayCacheCleanerInterval = time.Minute
+)
+
 var _ coremain.ExecutablePlugin = (*ttl)(nil)
 
 type Args struct {
 	MaximumTTL uint32 `yaml:"maximum_ttl"`
 	MinimalTTL uint32 `yaml:"minimal_ttl"`
+
+	// NegativeMaximumTTL and NegativeMinimalTTL are applied to negative
+	// responses (errors, NXDOMAIN and NODATA) instead of MaximumTTL and
+	// MinimalTTL, if any of them is set.
+	NegativeMaximumTTL uint32 `yaml:"negative_maximum_ttl"`
+	NegativeMinimalTTL uint32 `yaml:"negative_minimal_ttl"`
+
+	// Rules set the ttl of responses of matched query names. The format
+	// is "domain_pattern ttl", e.g. "domain:example.com 60", or
+	// "provider:tag" for a data provider of rules in the same format.
+	// The default matcher of patterns is "domain". Matched responses
+	// are not affected by the minimum and maximum ttls.
+	Rules []string `yaml:"rules"`
+
+	// Decay makes ttls that are set by rules count down from the first
+	// response, like records in a cache, instead of always being the
+	// same. So clients and downstream caches expire them at the same
+	// time.
+	Decay bool `yaml:"decay"`
 }
 
 type ttl struct {
 	*coremain.BP
 	args *Args
+
+	rules      *domain.MatcherGroup[uint32] // nil if no rule.
+	decayCache *mem_cache.MemCache          // nil if decay is disabled.
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
-	return newTTL(bp, args.(*Args)), nil
+	return newTTL(bp, args.(*Args))
 }
 
-func newTTL(bp *coremain.BP, args *Args) coremain.Plugin {
-	return &ttl{
+func newTTL(bp *coremain.BP, args *Args) (*ttl, error) {
+	t := &ttl{
 		BP:   bp,
 		args: args,
 	}
+	if len(args.Rules) > 0 {
+		newMatcher := func() *domain.MixMatcher[uint32] {
+			m := domain.NewMixMatcher[uint32]()
+			m.SetDefaultMatcher(domain.MatcherDomain)
+			return m
+		}
+		m, err := domain.BatchLoadProvider[uint32](
+			args.Rules,
+			newMatcher(),
+			parseRule,
+			bp.M().GetDataManager(),
+			func(b []byte) (domain.Matcher[uint32], error) {
+				m := newMatcher()
+				if err := domain.LoadFromTextReader[uint32](m, bytes.NewReader(b), parseRule); err != nil {
+					return nil, err
+				}
+				return m, nil
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		bp.L().Info("ttl rules loaded", zap.Int("length", m.Len()))
+		t.rules = m
+	}
+	if args.Decay {
+		t.decayCache = mem_cache.NewMemCache(decayCacheSize, decayCacheCleanerInterval)
+	}
+	return t, nil
+}
+
+func parseRule(s string) (p string, v uint32, err error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return "", 0, fmt.Errorf("ttl rule must have 2 fields, but got %d", len(f))
+	}
+	ttl, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ttl %s, %w", f[1], err)
+	}
+	return f[0], uint32(ttl), nil
 }
 
 func (t *ttl) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	if r := qCtx.R(); r != nil {
-		if t.args.MaximumTTL > 0 {
-			dnsutils.ApplyMaximumTTL(r, t.args.MaximumTTL)
-		}
-		if t.args.MinimalTTL > 0 {
-			dnsutils.ApplyMinimalTTL(r, t.args.MinimalTTL)
-		}
+		t.apply(qCtx.Q(), r)
 	}
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
+
+func (t *ttl) apply(q, r *dns.Msg) {
+	if t.rules != nil && len(q.Question) == 1 {
+		if v, ok := t.rules.Match(q.Question[0].Name); ok {
+			dnsutils.SetTTL(r, t.decay(q.Question[0], v))
+			return
+		}
+	}
+
+	maxTTL, minTTL := t.args.MaximumTTL, t.args.MinimalTTL
+	if t.hasNegativePolicy() && isNegative(r) {
+		maxTTL, minTTL = t.args.NegativeMaximumTTL, t.args.NegativeMinimalTTL
+	}
+	if maxTTL > 0 {
+		dnsutils.ApplyMaximumTTL(r, maxTTL)
+	}
+	if minTTL > 0 {
+		dnsutils.ApplyMinimalTTL(r, minTTL)
+	}
+}
+
+func (t *ttl) hasNegativePolicy() bool {
+	return t.args.NegativeMaximumTTL > 0 || t.args.NegativeMinimalTTL > 0
+}
+
+// decay returns the remaining ttl of question, which was first answered
+// with ttl v. If decay is disabled, it returns v.
+func (t *ttl) decay(question dns.Question, v uint32) uint32 {
+	if t.decayCache == nil || v == 0 {
+		return v
+	}
+	key := strings.ToLower(question.Name) + "/" + strconv.Itoa(int(question.Qtype))
+	now := time.Now()
+	if _, _, expirationTime := t.decayCache.Get(key); expirationTime.After(now) {
+		// Round up, so it never returns 0 before the expiration.
+		return uint32((expirationTime.Sub(now) + time.Second - 1) / time.Second)
+	}
+	t.decayCache.Store(key, nil, now, now.Add(time.Duration(v)*time.Second))
+	return v
+}
+
+// isNegative reports whether r is an error, a NXDOMAIN or a NODATA
+// response.
+func isNegative(r *dns.Msg) bool {
+	return r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0
+}
+
+func (t *ttl) Close() error {
+	if t.rules != nil {
+		_ = t.rules.Close()
+	}
+	if t.decayCache != nil {
+		_ = t.decayCache.Close()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ttl
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_ttl(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	p, err := newTTL(coremain.NewBP("test", PluginType, nil, m), &Args{
+		MaximumTTL:         600,
+		MinimalTTL:         60,
+		NegativeMaximumTTL: 30,
+		Rules:              []string{"example.com 10", "full:static.example.org 3600"},
+		Decay:              true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	exec := func(name string, answerTTL uint32, nxdomain bool) uint32 {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if nxdomain {
+			r.Rcode = dns.RcodeNameError
+			soa := dnsutils.FakeSOA(name)
+			soa.Hdr.Ttl = answerTTL
+			r.Ns = []dns.RR{soa}
+		} else {
+			r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: answerTTL}, A: net.IPv4(1, 1, 1, 1)}}
+		}
+		qCtx := query_context.NewContext(q, nil)
+		qCtx.SetResponse(r)
+		if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		return dnsutils.GetMinimalTTL(qCtx.R())
+	}
+
+	tests := []struct {
+		name      string
+		answerTTL uint32
+		nxdomain  bool
+		want      uint32
+	}{
+		{"a.example.net.", 10, false, 60},
+		{"a.example.net.", 3600, false, 600},
+		{"a.example.net.", 3600, true, 30},
+		{"a.example.net.", 10, true, 10},
+		{"www.example.com.", 300, false, 10},
+		{"www.example.com.", 300, true, 10},
+		{"static.example.org.", 5, false, 3600},
+		{"www.static.example.org.", 5, false, 60},
+	}
+	for _, tt := range tests {
+		if got := exec(tt.name, tt.answerTTL, tt.nxdomain); got != tt.want {
+			t.Errorf("%s %d %v: want ttl %d, got %d", tt.name, tt.answerTTL, tt.nxdomain, tt.want, got)
+		}
+	}
+
+	// Decay
+	if got := exec("decay.example.com.", 300, false); got != 10 {
+		t.Fatalf("want ttl 10, got %d", got)
+	}
+	time.Sleep(time.Millisecond * 1100)
+	if got := exec("decay.example.com.", 300, false); got != 9 {
+		t.Fatalf("want decayed ttl 9, got %d", got)
+	}
+}
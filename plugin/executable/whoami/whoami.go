@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package whoami
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"strconv"
+)
+
+const PluginType = "whoami"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const defaultZone = "mosdns."
+
+var _ coremain.ExecutablePlugin = (*whoami)(nil)
+
+// Args configures the zone of the helper names. Queries for these names
+// are answered with what the server observed about the client:
+//   - whoami.<zone> A/AAAA: the client ip. TXT: all fields below.
+//   - ip.<zone> TXT: the client ip.
+//   - port.<zone> TXT: the client source port.
+//   - proto.<zone> TXT: the transport protocol, e.g. "udp", "https".
+//
+// Other names in the zone are answered with NXDOMAIN. Queries out of the
+// zone are passed to the next node.
+type Args struct {
+	Zone string `yaml:"zone"` // Default is "mosdns.".
+}
+
+type whoami struct {
+	*coremain.BP
+	zone string
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newWhoami(bp, args.(*Args)), nil
+}
+
+func newWhoami(bp *coremain.BP, args *Args) *whoami {
+	zone := defaultZone
+	if len(args.Zone) > 0 {
+		zone = dns.CanonicalName(args.Zone)
+	}
+	return &whoami{BP: bp, zone: zone}
+}
+
+// Exec sets the response if the query is for a name in the zone.
+func (w *whoami) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := w.response(qCtx); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// response returns nil if the query is not for a name in the zone.
+func (w *whoami) response(qCtx *query_context.Context) *dns.Msg {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	name := dns.CanonicalName(question.Name)
+	if !dns.IsSubDomain(w.zone, name) {
+		return nil
+	}
+
+	meta := qCtx.ReqMeta()
+	addr := meta.ClientAddr.Unmap()
+	port := strconv.Itoa(int(meta.ClientPort))
+	if meta.ClientPort == 0 {
+		port = "unknown"
+	}
+	proto := meta.Protocol
+	if len(proto) == 0 {
+		proto = "unknown"
+	}
+	ip := "unknown"
+	if addr.IsValid() {
+		ip = addr.String()
+	}
+
+	var txt []string
+	switch name {
+	case "whoami." + w.zone:
+		txt = []string{"ip=" + ip, "port=" + port, "proto=" + proto}
+		if len(meta.ServerName) > 0 {
+			txt = append(txt, "sni="+meta.ServerName)
+		}
+	case "ip." + w.zone:
+		txt = []string{ip}
+	case "port." + w.zone:
+		txt = []string{port}
+	case "proto." + w.zone:
+		txt = []string{proto}
+	default:
+		return dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+	}
+
+	// TTL is 0, the answers must not be cached.
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET}
+	var rr dns.RR
+	switch {
+	case question.Qtype == dns.TypeTXT:
+		rr = &dns.TXT{Hdr: hdr, Txt: txt}
+	case question.Qtype == dns.TypeA && name == "whoami."+w.zone && addr.Is4():
+		rr = &dns.A{Hdr: hdr, A: addr.AsSlice()}
+	case question.Qtype == dns.TypeAAAA && name == "whoami."+w.zone && addr.Is6():
+		rr = &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}
+	default:
+		return dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Answer = []dns.RR{rr}
+	return r
+}
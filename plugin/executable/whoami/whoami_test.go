@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package whoami
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/netip"
+	"testing"
+)
+
+func Test_whoami_Exec(t *testing.T) {
+	w := newWhoami(coremain.NewBP("test", PluginType, nil, nil), &Args{})
+	meta := &query_context.RequestMeta{
+		ClientAddr: netip.MustParseAddr("::ffff:192.0.2.1"),
+		ClientPort: 5353,
+		Protocol:   "udp",
+	}
+
+	tests := []struct {
+		name      string
+		qName     string
+		qtype     uint16
+		wantR     bool
+		wantRcode int
+		wantRR    string
+	}{
+		{"out of zone", "example.com.", dns.TypeA, false, 0, ""},
+		{"whoami a", "whoami.mosdns.", dns.TypeA, true, dns.RcodeSuccess, "whoami.mosdns.\t0\tIN\tA\t192.0.2.1"},
+		{"whoami aaaa", "whoami.mosdns.", dns.TypeAAAA, true, dns.RcodeSuccess, ""},
+		{"whoami txt", "WhoAmI.mosdns.", dns.TypeTXT, true, dns.RcodeSuccess, "WhoAmI.mosdns.\t0\tIN\tTXT\t\"ip=192.0.2.1\" \"port=5353\" \"proto=udp\""},
+		{"port txt", "port.mosdns.", dns.TypeTXT, true, dns.RcodeSuccess, "port.mosdns.\t0\tIN\tTXT\t\"5353\""},
+		{"port a", "port.mosdns.", dns.TypeA, true, dns.RcodeSuccess, ""},
+		{"unknown name", "foo.mosdns.", dns.TypeTXT, true, dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qtype)
+			qCtx := query_context.NewContext(q, meta)
+			if err := w.Exec(context.Background(), qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if (r != nil) != tt.wantR {
+				t.Fatalf("want response %v, got %v", tt.wantR, r)
+			}
+			if r == nil {
+				return
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			var gotRR string
+			if len(r.Answer) > 0 {
+				gotRR = r.Answer[0].String()
+			}
+			if gotRR != tt.wantRR {
+				t.Fatalf("want rr %q, got %q", tt.wantRR, gotRR)
+			}
+		})
+	}
+}
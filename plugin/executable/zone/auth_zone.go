@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	maxCNAMEChain = 8
+)
+
+// authZone is an authoritative zone loaded from a zone file.
+type authZone struct {
+	origin string // lower case fqdn
+	soa    *dns.SOA
+
+	// rrsets maps lower case owner names to their rrsets by type. Empty
+	// non-terminals are also in rrsets, with no rrset.
+	rrsets map[string]map[uint16][]dns.RR
+}
+
+func loadZoneFile(origin, file string) (*authZone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return loadZone(origin, file, f)
+}
+
+// loadZone loads a zone in RFC 1035 format from r. $INCLUDE and $ORIGIN
+// are supported. Relative $INCLUDE paths are relative to the directory of
+// file.
+func loadZone(origin, file string, r io.Reader) (*authZone, error) {
+	if len(origin) == 0 {
+		return nil, errors.New("missing origin")
+	}
+	origin = strings.ToLower(dns.Fqdn(origin))
+	z := &authZone{
+		origin: origin,
+		rrsets: make(map[string]map[uint16][]dns.RR),
+	}
+
+	parser := dns.NewZoneParser(r, origin, file)
+	parser.SetDefaultTTL(3600)
+	parser.SetIncludeAllowed(true)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		hdr := rr.Header()
+		if hdr.Class != dns.ClassINET {
+			continue
+		}
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("%s is out of the zone", hdr.Name)
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			if name != origin {
+				return nil, fmt.Errorf("soa record at %s is not at the zone apex", hdr.Name)
+			}
+			if z.soa != nil {
+				return nil, errors.New("multiple soa records")
+			}
+			z.soa = soa
+		}
+		z.add(name, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, errors.New("missing soa record")
+	}
+	for name, sets := range z.rrsets {
+		if _, ok := sets[dns.TypeCNAME]; ok && len(sets) > 1 {
+			return nil, fmt.Errorf("cname and other data at %s", name)
+		}
+	}
+	return z, nil
+}
+
+func (z *authZone) add(name string, rr dns.RR) {
+	sets := z.rrsets[name]
+	if sets == nil {
+		sets = make(map[uint16][]dns.RR)
+		z.rrsets[name] = sets
+	}
+	t := rr.Header().Rrtype
+	sets[t] = append(sets[t], rr)
+
+	// Add empty non-terminals.
+	for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+		if _, ok := z.rrsets[name[off:]]; ok {
+			break
+		}
+		z.rrsets[name[off:]] = make(map[uint16][]dns.RR)
+	}
+}
+
+// negTTL returns the negative caching ttl of the zone (RFC 2308).
+func (z *authZone) negTTL() uint32 {
+	if z.soa.Minttl < z.soa.Hdr.Ttl {
+		return z.soa.Minttl
+	}
+	return z.soa.Hdr.Ttl
+}
+
+// reply answers q, which is in the zone, authoritatively. CNAMEs are
+// followed within the zone. Names at or below delegation points are
+// answered with referrals.
+func (z *authZone) reply(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+
+	qname := question.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		name := strings.ToLower(qname)
+		if ns := z.findCut(name); ns != nil {
+			if i == 0 {
+				r.Authoritative = false
+				r.Ns = copyRRs(ns)
+				r.Extra = z.glue(ns)
+			}
+			return r
+		}
+
+		sets, wildcard := z.lookup(name)
+		if sets == nil {
+			// The rcode is from the last name in the cname chain (RFC 6604).
+			r.Rcode = dns.RcodeNameError
+			r.Ns = []dns.RR{z.negSOA()}
+			return r
+		}
+		rrs := sets[question.Qtype]
+		if question.Qtype == dns.TypeANY {
+			for _, set := range sets {
+				rrs = append(rrs, set...)
+			}
+		}
+		if len(rrs) > 0 {
+			r.Answer = append(r.Answer, synthRRs(rrs, wildcard, qname)...)
+			if question.Qtype == dns.TypeNS {
+				r.Extra = z.glue(rrs)
+			}
+			return r
+		}
+		cname := sets[dns.TypeCNAME]
+		if len(cname) == 0 { // NODATA
+			r.Ns = []dns.RR{z.negSOA()}
+			return r
+		}
+		r.Answer = append(r.Answer, synthRRs(cname, wildcard, qname)...)
+		qname = cname[0].(*dns.CNAME).Target
+		if !dns.IsSubDomain(z.origin, strings.ToLower(qname)) {
+			return r
+		}
+	}
+	return r
+}
+
+// findCut returns the NS records of the topmost delegation point between
+// the apex (excluded) and name (included), if any.
+func (z *authZone) findCut(name string) []dns.RR {
+	labels := dns.Split(name)
+	for i := len(labels) - dns.CountLabel(z.origin) - 1; i >= 0; i-- {
+		if ns := z.rrsets[name[labels[i]:]][dns.TypeNS]; len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// lookup returns the rrsets of name. If name does not exist, it returns
+// the rrsets of the wildcard at the closest encloser of name (RFC 4592),
+// with wildcard set. It returns nil if neither exists.
+func (z *authZone) lookup(name string) (sets map[uint16][]dns.RR, wildcard bool) {
+	if sets, ok := z.rrsets[name]; ok {
+		return sets, false
+	}
+	for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+		if _, ok := z.rrsets[name[off:]]; ok { // the closest encloser
+			return z.rrsets["*."+name[off:]], true
+		}
+	}
+	return nil, false
+}
+
+func (z *authZone) negSOA() dns.RR {
+	soa := dns.Copy(z.soa)
+	soa.Header().Ttl = z.negTTL()
+	return soa
+}
+
+// glue returns in-zone address records of the name servers in ns.
+func (z *authZone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		sets := z.rrsets[strings.ToLower(ns.Ns)]
+		extra = append(extra, copyRRs(sets[dns.TypeA])...)
+		extra = append(extra, copyRRs(sets[dns.TypeAAAA])...)
+	}
+	return extra
+}
+
+// synthRRs copies rrs. If rrs are from a wildcard, their names are
+// replaced with name.
+func synthRRs(rrs []dns.RR, wildcard bool, name string) []dns.RR {
+	c := copyRRs(rrs)
+	if wildcard {
+		for _, rr := range c {
+			rr.Header().Name = name
+		}
+	}
+	return c
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	c := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		c = append(c, dns.Copy(rr))
+	}
+	return c
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const PluginType = "zone"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	ednsUDPSize = 1232
+)
+
+var _ coremain.ExecutablePlugin = (*zonePlugin)(nil)
+
+type Args struct {
+	Zones []ZoneArgs `yaml:"zones"`
+}
+
+type ZoneArgs struct {
+	Origin string `yaml:"origin"` // required, the apex of the zone.
+
+	// File is a zone file in RFC 1035 format. It must have a SOA record
+	// at the apex. Relative $INCLUDE paths are relative to its directory.
+	File string `yaml:"file"` // required
+}
+
+// zonePlugin answers queries for names in its zones authoritatively,
+// including negative answers. Other queries are passed to next.
+type zonePlugin struct {
+	*coremain.BP
+	zones map[string]*authZone // by origin
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newZonePlugin(bp, args.(*Args))
+}
+
+func newZonePlugin(bp *coremain.BP, args *Args) (*zonePlugin, error) {
+	if len(args.Zones) == 0 {
+		return nil, errors.New("no zone is configured")
+	}
+	p := &zonePlugin{BP: bp, zones: make(map[string]*authZone)}
+	for i, za := range args.Zones {
+		if len(za.File) == 0 {
+			return nil, fmt.Errorf("zone #%d has no file", i)
+		}
+		z, err := loadZoneFile(za.Origin, za.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load zone #%d %s, %w", i, za.Origin, err)
+		}
+		if _, dup := p.zones[z.origin]; dup {
+			return nil, fmt.Errorf("duplicated zone %s", z.origin)
+		}
+		p.zones[z.origin] = z
+		bp.L().Info("zone loaded", zap.String("origin", z.origin), zap.Int("names", len(z.rrsets)), zap.Uint32("serial", z.soa.Serial))
+	}
+	return p, nil
+}
+
+// findZone returns the closest zone that name is in, or nil.
+func (p *zonePlugin) findZone(name string) *authZone {
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z := p.zones[name[off:]]; z != nil {
+			return z
+		}
+	}
+	return p.zones["."]
+}
+
+func (p *zonePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	z := p.findZone(q.Question[0].Name)
+	if z == nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	r := z.reply(q)
+	if opt := q.IsEdns0(); opt != nil {
+		r.SetEdns0(ednsUDPSize, false)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testZone = `
+$TTL 300
+@       IN SOA ns.home.arpa. hostmaster.home.arpa. 1 7200 3600 1209600 60
+@       IN NS  ns
+ns      IN A   192.168.1.1
+www     IN CNAME nas
+ext     IN CNAME example.com.
+*.lan   IN A   192.168.1.100
+sub     IN NS  ns.sub
+ns.sub  IN A   192.168.1.2
+$INCLUDE hosts.zone
+`
+
+const testInclude = `
+$ORIGIN devices.home.arpa.
+printer IN A 192.168.1.20
+`
+
+func newTestZonePlugin(t *testing.T) *zonePlugin {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "home.zone"), []byte(testZone+"nas IN A 192.168.1.10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hosts.zone"), []byte(testInclude), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newZonePlugin(coremain.NewBP("zone", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil)), &Args{
+		Zones: []ZoneArgs{{Origin: "home.arpa", File: filepath.Join(dir, "home.zone")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_zonePlugin_Exec(t *testing.T) {
+	p := newTestZonePlugin(t)
+	next := &executable_seq.DummyExecutable{WantR: new(dns.Msg)}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantNext  bool
+		wantRcode int
+		wantAns   int
+		wantNs    uint16 // type of the first authority record.
+		wantAA    bool
+	}{
+		{"answer", "nas.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 1, 0, true},
+		{"case insensitive", "NAS.Home.Arpa.", dns.TypeA, false, dns.RcodeSuccess, 1, 0, true},
+		{"cname chain", "www.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 2, 0, true},
+		{"out of zone cname", "ext.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 1, 0, true},
+		{"nodata", "nas.home.arpa.", dns.TypeAAAA, false, dns.RcodeSuccess, 0, dns.TypeSOA, true},
+		{"empty non-terminal", "lan.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 0, dns.TypeSOA, true},
+		{"nxdomain", "none.home.arpa.", dns.TypeA, false, dns.RcodeNameError, 0, dns.TypeSOA, true},
+		{"wildcard", "pc.lan.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 1, 0, true},
+		{"referral", "a.sub.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 0, dns.TypeNS, false},
+		{"include", "printer.devices.home.arpa.", dns.TypeA, false, dns.RcodeSuccess, 1, 0, true},
+		{"soa", "home.arpa.", dns.TypeSOA, false, dns.RcodeSuccess, 1, 0, true},
+		{"not in zone", "example.com.", dns.TypeA, true, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			qCtx := query_context.NewContext(q, nil)
+			if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(next)); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if tt.wantNext {
+				if r != next.WantR {
+					t.Fatal("query should be passed to next")
+				}
+				return
+			}
+			if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAns || r.Authoritative != tt.wantAA {
+				t.Fatalf("unexpected response %v", r)
+			}
+			if tt.wantNs != 0 && (len(r.Ns) == 0 || r.Ns[0].Header().Rrtype != tt.wantNs) {
+				t.Fatalf("unexpected authority section %v", r.Ns)
+			}
+			if tt.name == "wildcard" && r.Answer[0].Header().Name != tt.qname {
+				t.Fatalf("wildcard owner is not replaced, %v", r.Answer[0])
+			}
+			if tt.name == "referral" && len(r.Extra) != 1 {
+				t.Fatalf("want glue records, got %v", r.Extra)
+			}
+		})
+	}
+}
+
+func Test_loadZone(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"no soa", "a IN A 1.1.1.1"},
+		{"out of zone", "@ IN SOA ns. h. 1 1 1 1 1\na.example. IN A 1.1.1.1"},
+		{"cname and other data", "@ IN SOA ns. h. 1 1 1 1 1\na IN CNAME b\na IN A 1.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadZone("home.arpa.", "", strings.NewReader(tt.zone)); err == nil {
+				t.Fatal("want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockUpstream is a udp dns server that answers A queries with ip.
+type mockUpstream struct {
+	addr    string
+	queries int32
+}
+
+func startMockUpstream(t *testing.T, ip string) *mockUpstream {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &mockUpstream{addr: c.LocalAddr().String()}
+	s := &dns.Server{PacketConn: c, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddInt32(&u.queries, 1)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if q.Question[0].Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP(ip),
+			})
+		}
+		w.WriteMsg(r)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return u
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	cert, err := utils.GenerateCertificate("mosdns.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startMosdns starts a Mosdns from the fixture file. Placeholders
+// "{key}" in the fixture are replaced by vars.
+func startMosdns(t *testing.T, fixture string, vars map[string]string) *coremain.Mosdns {
+	t.Helper()
+	b, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oldNew []string
+	for k, v := range vars {
+		oldNew = append(oldNew, "{"+k+"}", v)
+	}
+	b = []byte(strings.NewReplacer(oldNew...).Replace(string(b)))
+	cfg, err := coremain.LoadConfigFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := coremain.NewMosdns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+// exchangeDoH sends q to the doh server at url.
+func exchangeDoH(url string, q *dns.Msg) (*dns.Msg, error) {
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{
+		Timeout:   time.Second * 2,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	defer c.CloseIdleConnections()
+	resp, err := c.Post(url, "application/dns-message", bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	return r, r.Unpack(b)
+}
+
+func Test_integration(t *testing.T) {
+	local := startMockUpstream(t, "192.0.2.1")
+	remote := startMockUpstream(t, "192.0.2.2")
+	cert, key := writeTestCert(t, t.TempDir())
+	m := startMosdns(t, "./testdata/integration.yaml", map[string]string{
+		"upstream_local":  local.addr,
+		"upstream_remote": remote.addr,
+		"cert":            cert,
+		"key":             key,
+	})
+
+	addrs := m.GetServerAddrs()
+	if len(addrs) != 4 {
+		t.Fatalf("want 4 server listeners, got %d", len(addrs))
+	}
+	exchangers := []struct {
+		proto    string
+		exchange func(q *dns.Msg) (*dns.Msg, error)
+	}{
+		{"udp", func(q *dns.Msg) (*dns.Msg, error) {
+			r, _, err := (&dns.Client{Net: "udp"}).Exchange(q, addrs[0].String())
+			return r, err
+		}},
+		{"tcp", func(q *dns.Msg) (*dns.Msg, error) {
+			r, _, err := (&dns.Client{Net: "tcp"}).Exchange(q, addrs[1].String())
+			return r, err
+		}},
+		{"dot", func(q *dns.Msg) (*dns.Msg, error) {
+			c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+			r, _, err := c.Exchange(q, addrs[2].String())
+			return r, err
+		}},
+		{"doh", func(q *dns.Msg) (*dns.Msg, error) {
+			return exchangeDoH("https://"+addrs[3].String()+"/dns-query", q)
+		}},
+	}
+	queries := []struct {
+		qname  string
+		wantIP string
+	}{
+		{"host.lan.", "192.0.2.1"},
+		{"example.com.", "192.0.2.2"},
+	}
+
+	for _, e := range exchangers {
+		for _, tq := range queries {
+			t.Run(e.proto+" "+tq.qname, func(t *testing.T) {
+				q := new(dns.Msg)
+				q.SetQuestion(tq.qname, dns.TypeA)
+				r, err := e.exchange(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+					t.Fatalf("unexpected response %s", r)
+				}
+				if got := r.Answer[0].(*dns.A).A.String(); got != tq.wantIP {
+					t.Fatalf("want %s, got %s", tq.wantIP, got)
+				}
+			})
+		}
+	}
+
+	if n := atomic.LoadInt32(&local.queries); n != 4 {
+		t.Errorf("want 4 queries to the local upstream, got %d", n)
+	}
+	if n := atomic.LoadInt32(&remote.queries); n != 4 {
+		t.Errorf("want 4 queries to the remote upstream, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	m.GetHTTPAPIMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := "mosdns_plugin_metrics_query_total 8\n"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics do not contain %q", want)
+	}
+}
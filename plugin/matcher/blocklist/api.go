@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServeHTTP serves the api of the plugin.
+//
+//	POST   /reload        update all url lists now.
+//	GET    /stats         show the lists.
+//	GET    /check?name=   check whether the name is blocked or allowed.
+//
+// File lists are reloaded automatically when they are changed.
+func (p *blocklistPlugin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/reload"):
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := p.updateURLs(func(*list) bool { return true }); err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.stats())
+	case strings.HasSuffix(path, "/stats"):
+		writeJSON(w, http.StatusOK, p.stats())
+	case strings.HasSuffix(path, "/check"):
+		name := req.URL.Query().Get("name")
+		if len(name) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("missing name"))
+			return
+		}
+		r := p.m.Load().(*rules)
+		writeJSON(w, http.StatusOK, map[string]bool{"blocked": r.blocked(name), "allowed": r.allowed(name)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type listStats struct {
+	Source    string     `json:"source"`
+	Format    string     `json:"format"`
+	Allowlist bool       `json:"allowlist,omitempty"`
+	Block     int        `json:"block"`
+	Allow     int        `json:"allow"`
+	Skipped   int        `json:"skipped"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (p *blocklistPlugin) stats() []listStats {
+	s := make([]listStats, 0, len(p.lists))
+	for _, l := range p.lists {
+		l.m.Lock()
+		ls := listStats{
+			Source:    l.args.File,
+			Format:    l.args.Format,
+			Allowlist: l.args.Allow,
+			Block:     len(l.rules.Block),
+			Allow:     len(l.rules.Allow),
+			Skipped:   l.rules.Skipped,
+		}
+		if len(l.args.URL) > 0 {
+			ls.Source = l.args.URL
+		}
+		if !l.updatedAt.IsZero() {
+			t := l.updatedAt
+			ls.UpdatedAt = &t
+		}
+		if l.err != nil {
+			ls.Error = l.err.Error()
+		}
+		l.m.Unlock()
+		s = append(s, ls)
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
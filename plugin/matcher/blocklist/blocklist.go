@@ -0,0 +1,448 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/blocklist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/cron_spec"
+	"github.com/IrineSistiana/mosdns/v4/pkg/data_provider"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PluginType = "blocklist"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+const (
+	defaultUpdateInterval = time.Hour * 24
+	urlRetryInterval      = time.Minute * 5
+	urlFetchTimeout       = time.Second * 60
+	maxURLDataSize        = 128 * 1024 * 1024
+)
+
+var _ coremain.MatcherPlugin = (*blocklistPlugin)(nil)
+
+// Args of the blocklist plugin. It matches queries whose names are in any
+// of the lists, and are not allowed. Allow rules always win over block
+// rules, no matter where they are from.
+type Args struct {
+	Lists []ListArgs `yaml:"lists"`
+
+	// Allow rules are in the format of domain matchers, e.g. "full:x.com",
+	// "domain:x.com", "regexp:^ad\d+\.". Data providers "provider:tag" are
+	// also supported.
+	Allow []string `yaml:"allow"`
+
+	// UpdateInterval (sec) of url lists. Default is 86400.
+	UpdateInterval int `yaml:"update_interval"`
+
+	// UpdateCron is the update schedule of url lists in local time, e.g.
+	// "0 4 * * *" for 04:00 every day. If set, UpdateInterval is ignored.
+	UpdateCron string `yaml:"update_cron"`
+
+	// Prefilter enables a bloom filter in front of block rules, so names
+	// that are not blocked are answered by hash checks. See
+	// domain.SubDomainMatcher.EnablePrefilter.
+	Prefilter bool `yaml:"prefilter"`
+}
+
+// ListArgs is a blocklist. One of File and URL is required.
+type ListArgs struct {
+	// Format is one of "hosts", "adblock", "dnsmasq" and "domain".
+	// Default is "domain".
+	Format string `yaml:"format"`
+
+	// File is reloaded automatically when it is changed.
+	File string `yaml:"file"`
+
+	// URL is a http(s) url. It is updated on the schedule with
+	// conditional requests. If it cannot be fetched, its last data is
+	// kept.
+	URL string `yaml:"url"`
+
+	// Allow makes the list an allowlist. All its rules are allow rules.
+	Allow bool `yaml:"allow"`
+}
+
+type blocklistPlugin struct {
+	*coremain.BP
+	lists []*list
+	allow *domain.MatcherGroup[struct{}] // static allow rules.
+
+	interval  time.Duration
+	cron      *cron_spec.Spec
+	prefilter bool
+
+	m        atomic.Value // *rules
+	rebuildM sync.Mutex
+	updateM  sync.Mutex // serializes url updates.
+
+	firstLoad   chan struct{}
+	closeNotify chan struct{}
+	closer      []func()
+}
+
+// rules are the merged rules of all lists.
+type rules struct {
+	block  *domain.MixMatcher[struct{}]
+	allow  *domain.MixMatcher[struct{}]
+	static domain.Matcher[struct{}] // allow rules of args.
+}
+
+// list is a blocklist source.
+type list struct {
+	p    *blocklistPlugin
+	args ListArgs
+
+	m            sync.Mutex
+	rules        *blocklist.Rules
+	updatedAt    time.Time
+	etag         string
+	lastModified string
+	err          error
+	next         time.Time // next url update.
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newBlocklist(bp, args.(*Args))
+}
+
+func newBlocklist(bp *coremain.BP, args *Args) (_ *blocklistPlugin, err error) {
+	p := &blocklistPlugin{
+		BP:          bp,
+		interval:    time.Duration(args.UpdateInterval) * time.Second,
+		prefilter:   args.Prefilter,
+		firstLoad:   make(chan struct{}),
+		closeNotify: make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+	if p.interval <= 0 {
+		p.interval = defaultUpdateInterval
+	}
+	if len(args.UpdateCron) > 0 {
+		if p.cron, err = cron_spec.Parse(args.UpdateCron); err != nil {
+			return nil, err
+		}
+	}
+	if len(args.Lists) == 0 {
+		return nil, errors.New("no list is configured")
+	}
+	if p.allow, err = domain.BatchLoadDomainProvider(args.Allow, bp.M().GetDataManager()); err != nil {
+		return nil, err
+	}
+	p.closer = append(p.closer, func() { p.allow.Close() })
+	p.m.Store(p.newRules())
+
+	hasURL := false
+	for _, la := range args.Lists {
+		if _, err := blocklist.Parse(la.Format, nil); err != nil {
+			return nil, err
+		}
+		l := &list{p: p, args: la, rules: new(blocklist.Rules)}
+		switch {
+		case len(la.File) > 0 && len(la.URL) == 0:
+			provider, err := data_provider.NewDataProvider(bp.L(), data_provider.DataProviderConfig{File: la.File, AutoReload: true})
+			if err != nil {
+				return nil, fmt.Errorf("failed to open file %s, %w", la.File, err)
+			}
+			p.closer = append(p.closer, provider.Close)
+			if err := provider.LoadAndAddListener(l); err != nil {
+				return nil, fmt.Errorf("failed to load file %s, %w", la.File, err)
+			}
+		case len(la.URL) > 0 && len(la.File) == 0:
+			if !strings.HasPrefix(la.URL, "http://") && !strings.HasPrefix(la.URL, "https://") {
+				return nil, fmt.Errorf("%s is not a http or https url", la.URL)
+			}
+			hasURL = true
+		default:
+			return nil, errors.New("one of file and url is required")
+		}
+		p.lists = append(p.lists, l)
+	}
+
+	if hasURL {
+		go p.updateLoop()
+	} else {
+		close(p.firstLoad)
+	}
+	return p, nil
+}
+
+func (p *blocklistPlugin) newRules() *rules {
+	return &rules{block: domain.NewDomainMixMatcher(), allow: domain.NewDomainMixMatcher(), static: p.allow}
+}
+
+func (p *blocklistPlugin) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	r := p.m.Load().(*rules)
+	for _, q := range qCtx.Q().Question {
+		if r.blocked(q.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *rules) blocked(name string) bool {
+	if _, ok := r.block.Match(name); !ok {
+		return false
+	}
+	return !r.allowed(name)
+}
+
+func (r *rules) allowed(name string) bool {
+	if _, ok := r.static.Match(name); ok {
+		return true
+	}
+	_, ok := r.allow.Match(name)
+	return ok
+}
+
+// Ready waits for the first update of url lists.
+func (p *blocklistPlugin) Ready(ctx context.Context) error {
+	select {
+	case <-p.firstLoad:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *blocklistPlugin) Close() error {
+	close(p.closeNotify)
+	for _, f := range p.closer {
+		f()
+	}
+	return nil
+}
+
+// Update implements data_provider.DataListener for file lists.
+func (l *list) Update(b []byte) error {
+	r, err := blocklist.Parse(l.args.Format, b)
+	if err != nil {
+		return err
+	}
+	l.m.Lock()
+	l.rules = r
+	l.updatedAt = time.Now()
+	l.m.Unlock()
+	l.p.rebuild()
+	return nil
+}
+
+// rebuild merges rules of all lists.
+func (p *blocklistPlugin) rebuild() {
+	p.rebuildM.Lock()
+	defer p.rebuildM.Unlock()
+
+	r := p.newRules()
+	invalid := 0
+	for _, l := range p.lists {
+		l.m.Lock()
+		lr := l.rules
+		l.m.Unlock()
+		block := r.block
+		if l.args.Allow {
+			block = r.allow
+		}
+		for _, s := range lr.Block {
+			if err := block.Add(s, struct{}{}); err != nil {
+				invalid++
+			}
+		}
+		for _, s := range lr.Allow {
+			if err := r.allow.Add(s, struct{}{}); err != nil {
+				invalid++
+			}
+		}
+	}
+	if p.prefilter {
+		r.block.EnablePrefilter()
+	}
+	p.m.Store(r)
+	p.L().Info(
+		"blocklist rules loaded",
+		zap.Int("block", r.block.Len()),
+		zap.Int("allow", r.allow.Len()),
+		zap.Int("invalid", invalid),
+	)
+}
+
+// updateLoop updates url lists when they are due, until the plugin is
+// closed.
+func (p *blocklistPlugin) updateLoop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	first := true
+	for {
+		select {
+		case <-timer.C:
+			now := time.Now()
+			p.updateURLs(func(l *list) bool { return !now.Before(l.next) })
+			if first {
+				close(p.firstLoad)
+				first = false
+			}
+			timer.Reset(time.Until(p.nextUpdate()))
+		case <-p.closeNotify:
+			return
+		}
+	}
+}
+
+// nextUpdate returns the earliest next update time of url lists.
+func (p *blocklistPlugin) nextUpdate() time.Time {
+	var next time.Time
+	for _, l := range p.lists {
+		if len(l.args.URL) == 0 {
+			continue
+		}
+		l.m.Lock()
+		t := l.next
+		l.m.Unlock()
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// scheduleAfter returns the next scheduled update after t.
+func (p *blocklistPlugin) scheduleAfter(t time.Time) time.Time {
+	if p.cron == nil {
+		return t.Add(p.interval)
+	}
+	// Matches at most one year ahead.
+	m := t.Truncate(time.Minute).Add(time.Minute)
+	for end := m.AddDate(1, 0, 0); m.Before(end); m = m.Add(time.Minute) {
+		if p.cron.Match(m) {
+			return m
+		}
+	}
+	return t.Add(p.interval)
+}
+
+// updateURLs updates url lists that match filter, and rebuilds the rules
+// if any list is changed. It returns the first error.
+func (p *blocklistPlugin) updateURLs(filter func(l *list) bool) error {
+	p.updateM.Lock()
+	defer p.updateM.Unlock()
+
+	var firstErr error
+	changed := false
+	for _, l := range p.lists {
+		if len(l.args.URL) == 0 || !filter(l) {
+			continue
+		}
+		ok, err := l.fetch()
+		now := time.Now()
+		l.m.Lock()
+		l.err = err
+		if err != nil {
+			l.next = now.Add(urlRetryInterval)
+		} else {
+			l.next = p.scheduleAfter(now)
+		}
+		l.m.Unlock()
+		if err != nil {
+			p.L().Warn("failed to update blocklist", zap.String("url", l.args.URL), zap.Error(err))
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to update %s, %w", l.args.URL, err)
+			}
+			continue
+		}
+		changed = changed || ok
+	}
+	if changed {
+		p.rebuild()
+	}
+	return firstErr
+}
+
+// fetch downloads the list with a conditional request. It reports whether
+// the list is changed.
+func (l *list) fetch() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), urlFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.args.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	l.m.Lock()
+	if len(l.etag) > 0 {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	if len(l.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", l.lastModified)
+	}
+	l.m.Unlock()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		l.m.Lock()
+		l.updatedAt = time.Now()
+		l.m.Unlock()
+		return false, nil
+	default:
+		return false, fmt.Errorf("http status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxURLDataSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(b) > maxURLDataSize {
+		return false, errors.New("list is too large")
+	}
+	r, err := blocklist.Parse(l.args.Format, b)
+	if err != nil {
+		return false, err
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.rules = r
+	l.updatedAt = time.Now()
+	l.etag = resp.Header.Get("ETag")
+	l.lastModified = resp.Header.Get("Last-Modified")
+	return true, nil
+}
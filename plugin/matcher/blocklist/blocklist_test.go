@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_blocklist(t *testing.T) {
+	var data atomic.Value
+	data.Store("||ads.example.com^\n@@||good.ads.example.com^\n||cdn.example.com^\n/^ad[0-9]+\\./\n")
+	var requests, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		s := data.Load().(string)
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(s)))
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(s))
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(file, []byte("0.0.0.0 tracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allowFile := filepath.Join(t.TempDir(), "allow")
+	if err := os.WriteFile(allowFile, []byte("full:static.cdn.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bp := coremain.NewBP("test", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil))
+	p, err := newBlocklist(bp, &Args{Lists: []ListArgs{
+		{Format: "adblock", URL: srv.URL},
+		{Format: "hosts", File: file},
+		{Format: "domain", File: allowFile, Allow: true},
+	}, Allow: []string{"regexp:^ad1\\."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Ready(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	match := func(name string) bool {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		ok, err := p.Match(context.Background(), query_context.NewContext(q, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	for name, want := range map[string]bool{
+		"ads.example.com.":         true,
+		"sub.ads.example.com.":     true,
+		"good.ads.example.com.":    false,
+		"tracker.example.com.":     true,
+		"sub.tracker.example.com.": false,
+		"example.com.":             false,
+		"img.cdn.example.com.":     true,
+		"static.cdn.example.com.":  false,
+		"ad0.example.com.":         true,
+		"ad1.example.com.":         false,
+	} {
+		if got := match(name); got != want {
+			t.Errorf("Match(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	// Not modified.
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/plugins/test/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", rec.Code, rec.Body)
+	}
+	if atomic.LoadInt32(&notModified) != 1 {
+		t.Fatalf("want a conditional request, got %d requests", atomic.LoadInt32(&requests))
+	}
+
+	data.Store("||new.example.com^\n")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/plugins/test/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", rec.Code, rec.Body)
+	}
+	if match("ads.example.com.") || !match("new.example.com.") {
+		t.Fatal("list is not updated")
+	}
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/plugins/test/check?name=new.example.com", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"allowed\":false,\"blocked\":true}\n" {
+		t.Fatalf("check: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dynamicset
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxRequestBodySize = 4 * 1024 * 1024
+
+// ServeHTTP serves the api of the plugin.
+//
+//	GET  /entries   list entries that are not expired.
+//	POST /add       add entries, {"domain": [...], "ip": [...], "ttl": sec}.
+//	                Adding an existing entry updates its ttl. Entries
+//	                without ttl never expire.
+//	POST /del       remove entries, {"domain": [...], "ip": [...]}.
+func (p *dynamicSet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/entries"):
+		domains, ips := p.s.entries(time.Now())
+		writeJSON(w, http.StatusOK, map[string][]entry{"domain": domains, "ip": ips})
+	case strings.HasSuffix(path, "/add"), strings.HasSuffix(path, "/del"):
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		r := new(entriesRequest)
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxRequestBodySize)).Decode(r); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(r.Domain)+len(r.IP) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("no entry"))
+			return
+		}
+		if strings.HasSuffix(path, "/add") {
+			if r.TTL < 0 {
+				writeError(w, http.StatusBadRequest, errors.New("invalid ttl"))
+				return
+			}
+			if err := p.s.add(r.Domain, r.IP, time.Duration(r.TTL)*time.Second, time.Now()); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"added": len(r.Domain) + len(r.IP)})
+			return
+		}
+		n, err := p.s.del(r.Domain, r.IP)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"removed": n})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type entriesRequest struct {
+	Domain []string `json:"domain"`
+	IP     []string `json:"ip"`
+	TTL    int64    `json:"ttl"` // sec
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dynamicset
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"time"
+)
+
+const PluginType = "dynamic_set"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.MatcherPlugin = (*dynamicSet)(nil)
+
+const (
+	defaultMaxEntries = 65536
+	janitorInterval   = time.Second
+)
+
+// Args of the dynamic_set plugin. It matches if the query name matches a
+// domain entry, or the ip target matches an ip entry. Entries can be added
+// and removed at runtime via the api, optionally with a ttl.
+type Args struct {
+	// Domain and IP are initial entries that never expire.
+	Domain []string `yaml:"domain"`
+	IP     []string `yaml:"ip"`
+
+	// IPTarget is the address that is matched against ip entries,
+	// "client" (default) for the client ip, or "response" for ips of A
+	// and AAAA answers.
+	IPTarget string `yaml:"ip_target"`
+
+	// MaxEntries limits the number of entries. Default is 65536.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+type dynamicSet struct {
+	*coremain.BP
+	s        *set
+	matchers []executable_seq.Matcher
+
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newDynamicSet(bp, args.(*Args))
+}
+
+func newDynamicSet(bp *coremain.BP, args *Args) (*dynamicSet, error) {
+	maxEntries := args.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
+	s := newSet(maxEntries)
+	if err := s.add(args.Domain, args.IP, 0, time.Now()); err != nil {
+		return nil, err
+	}
+
+	p := &dynamicSet{
+		BP:          bp,
+		s:           s,
+		closeNotify: make(chan struct{}),
+	}
+	p.matchers = append(p.matchers, msg_matcher.NewQNameMatcher(s.domainMatcher()))
+	switch args.IPTarget {
+	case "", "client":
+		p.matchers = append(p.matchers, msg_matcher.NewClientIPMatcher(s.ipMatcher()))
+	case "response":
+		p.matchers = append(p.matchers, msg_matcher.NewAAAAAIPMatcher(s.ipMatcher()))
+	default:
+		return nil, fmt.Errorf("invalid ip target %s", args.IPTarget)
+	}
+	go p.janitor()
+	return p, nil
+}
+
+func (p *dynamicSet) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	for _, m := range p.matchers {
+		matched, err := m.Match(ctx, qCtx)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+func (p *dynamicSet) Close() error {
+	close(p.closeNotify)
+	return nil
+}
+
+// janitor removes expired entries, until the plugin is closed.
+func (p *dynamicSet) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.s.removeExpired(now)
+		case <-p.closeNotify:
+			return
+		}
+	}
+}
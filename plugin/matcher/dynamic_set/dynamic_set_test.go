@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dynamicset
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_set(t *testing.T) {
+	now := time.Now()
+	s := newSet(4)
+	if err := s.add([]string{"static.com"}, []string{"10.0.0.0/8"}, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add([]string{"temp.com"}, []string{"192.168.1.1"}, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add([]string{"full:one.com"}, nil, 0, now); err == nil {
+		t.Fatal("entries over the limit should be rejected")
+	}
+	if err := s.add([]string{"regexp:("}, nil, 0, now); err == nil {
+		t.Fatal("invalid domain should be rejected")
+	}
+	if err := s.add(nil, []string{"bad"}, 0, now); err == nil {
+		t.Fatal("invalid ip should be rejected")
+	}
+
+	later := now.Add(time.Minute * 2)
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"a.static.com", later, true},
+		{"temp.com.", now, true},
+		{"temp.com.", later, false},
+		{"other.com", now, false},
+	}
+	for _, tt := range tests {
+		if got := s.matchDomain(tt.name, tt.at); got != tt.want {
+			t.Errorf("matchDomain(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	ipTests := []struct {
+		ip   string
+		at   time.Time
+		want bool
+	}{
+		{"10.1.2.3", later, true},
+		{"192.168.1.1", now, true},
+		{"192.168.1.1", later, false},
+		{"192.168.1.2", now, false},
+	}
+	for _, tt := range ipTests {
+		if got := s.matchIP(netip.MustParseAddr(tt.ip), tt.at); got != tt.want {
+			t.Errorf("matchIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	s.removeExpired(later)
+	domains, ips := s.entries(later)
+	if len(domains) != 1 || domains[0].Entry != "static.com" || len(ips) != 1 || ips[0].Entry != "10.0.0.0/8" {
+		t.Fatalf("unexpected entries %v %v", domains, ips)
+	}
+	if n, _ := s.del([]string{"static.com", "none.com"}, []string{"10.0.0.0/8"}); n != 2 {
+		t.Fatalf("want 2 entries removed, got %d", n)
+	}
+	if s.matchDomain("static.com", now) || s.matchIP(netip.MustParseAddr("10.1.2.3"), now) {
+		t.Fatal("removed entries should not match")
+	}
+}
+
+func Test_dynamicSet_api(t *testing.T) {
+	bp := coremain.NewBP("test", PluginType, nil, coremain.NewTestMosdnsWithPlugins(nil))
+	p, err := newDynamicSet(bp, &Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, "/plugins/test"+path, strings.NewReader(body)))
+		return rec
+	}
+	match := func(name string, client string) bool {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, &query_context.RequestMeta{ClientAddr: netip.MustParseAddr(client)})
+		ok, err := p.Match(context.Background(), qCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if match("example.com.", "127.0.0.1") {
+		t.Fatal("empty set should not match")
+	}
+	if rec := do(http.MethodPost, "/add", `{"domain": ["example.com"], "ip": ["127.0.0.2"], "ttl": 60}`); rec.Code != http.StatusOK {
+		t.Fatalf("add failed, %d %s", rec.Code, rec.Body)
+	}
+	if !match("www.example.com.", "127.0.0.1") || !match("other.com.", "127.0.0.2") {
+		t.Fatal("added entries should match")
+	}
+	rec := do(http.MethodGet, "/entries", "")
+	if !strings.Contains(rec.Body.String(), `"entry":"example.com"`) || !strings.Contains(rec.Body.String(), "expires_at") {
+		t.Fatalf("unexpected entries %s", rec.Body)
+	}
+	if rec := do(http.MethodPost, "/del", `{"domain": ["example.com"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("del failed, %d %s", rec.Code, rec.Body)
+	}
+	if match("www.example.com.", "127.0.0.1") {
+		t.Fatal("removed entry should not match")
+	}
+	if rec := do(http.MethodPost, "/add", `{"ip": ["x"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid ip should be rejected, %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/add", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("want 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dynamicset
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// set is a set of domain and ip entries that may expire. Expired entries
+// never match, even before they are removed by removeExpired.
+type set struct {
+	maxEntries int
+
+	m         sync.RWMutex
+	domains   *domain.MixMatcher[time.Time] // value is the expiry time.
+	domainExp map[string]time.Time          // zero time means never.
+	ipExp     map[netip.Prefix]time.Time
+	ipList    *netlist.List
+
+	nextExpire time.Time // zero if no entry expires.
+}
+
+type entry struct {
+	Entry     string     `json:"entry"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newSet(maxEntries int) *set {
+	s := &set{
+		maxEntries: maxEntries,
+		domains:    domain.NewMixMatcher[time.Time](),
+		domainExp:  make(map[string]time.Time),
+		ipExp:      make(map[netip.Prefix]time.Time),
+		ipList:     netlist.NewList(),
+	}
+	s.domains.SetDefaultMatcher(domain.MatcherDomain)
+	return s
+}
+
+// add adds entries to the set, or updates the expiry time of existing
+// entries. Entries without ttl never expire. Either all entries are added,
+// or none of them if any entry is invalid.
+func (s *set) add(domains, ips []string, ttl time.Duration, now time.Time) error {
+	var exp time.Time
+	if ttl > 0 {
+		exp = now.Add(ttl)
+	}
+	prefixes := make([]netip.Prefix, 0, len(ips))
+	for _, ip := range ips {
+		p, err := parsePrefix(ip)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	newEntries := 0
+	for _, d := range domains {
+		if _, ok := s.domainExp[d]; !ok {
+			newEntries++
+		}
+	}
+	for _, p := range prefixes {
+		if _, ok := s.ipExp[p]; !ok {
+			newEntries++
+		}
+	}
+	if len(s.domainExp)+len(s.ipExp)+newEntries > s.maxEntries {
+		return fmt.Errorf("too many entries, the limit is %d", s.maxEntries)
+	}
+
+	// Check all domains before adding any of them.
+	check := domain.NewMixMatcher[struct{}]()
+	check.SetDefaultMatcher(domain.MatcherDomain)
+	for _, d := range domains {
+		if err := check.Add(d, struct{}{}); err != nil {
+			return fmt.Errorf("invalid domain %s, %w", d, err)
+		}
+	}
+	for _, d := range domains {
+		if _, ok := s.domainExp[d]; ok {
+			_ = s.domains.Del(d)
+		}
+		_ = s.domains.Add(d, exp)
+		s.domainExp[d] = exp
+	}
+	for _, p := range prefixes {
+		s.ipExp[p] = exp
+	}
+	if len(prefixes) > 0 {
+		s.rebuildIPList()
+	}
+	if !exp.IsZero() && (s.nextExpire.IsZero() || exp.Before(s.nextExpire)) {
+		s.nextExpire = exp
+	}
+	return nil
+}
+
+// del removes entries from the set. Entries that do not exist are ignored.
+// It returns the number of removed entries.
+func (s *set) del(domains, ips []string) (int, error) {
+	prefixes := make([]netip.Prefix, 0, len(ips))
+	for _, ip := range ips {
+		p, err := parsePrefix(ip)
+		if err != nil {
+			return 0, err
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := 0
+	for _, d := range domains {
+		if _, ok := s.domainExp[d]; ok {
+			_ = s.domains.Del(d)
+			delete(s.domainExp, d)
+			n++
+		}
+	}
+	ipRemoved := false
+	for _, p := range prefixes {
+		if _, ok := s.ipExp[p]; ok {
+			delete(s.ipExp, p)
+			ipRemoved = true
+			n++
+		}
+	}
+	if ipRemoved {
+		s.rebuildIPList()
+	}
+	return n, nil
+}
+
+// removeExpired removes entries that expired before now.
+func (s *set) removeExpired(now time.Time) {
+	s.m.RLock()
+	next := s.nextExpire
+	s.m.RUnlock()
+	if next.IsZero() || now.Before(next) {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.nextExpire = time.Time{}
+	updateNext := func(exp time.Time) {
+		if s.nextExpire.IsZero() || exp.Before(s.nextExpire) {
+			s.nextExpire = exp
+		}
+	}
+	for d, exp := range s.domainExp {
+		if exp.IsZero() {
+			continue
+		}
+		if !now.Before(exp) {
+			_ = s.domains.Del(d)
+			delete(s.domainExp, d)
+			continue
+		}
+		updateNext(exp)
+	}
+	ipRemoved := false
+	for p, exp := range s.ipExp {
+		if exp.IsZero() {
+			continue
+		}
+		if !now.Before(exp) {
+			delete(s.ipExp, p)
+			ipRemoved = true
+			continue
+		}
+		updateNext(exp)
+	}
+	if ipRemoved {
+		s.rebuildIPList()
+	}
+}
+
+// rebuildIPList rebuilds ipList from ipExp. Caller must hold the lock.
+func (s *set) rebuildIPList() {
+	l := netlist.NewList()
+	for p := range s.ipExp {
+		l.Append(p)
+	}
+	l.Sort()
+	s.ipList = l
+}
+
+// entries returns all entries that are not expired, sorted.
+func (s *set) entries(now time.Time) (domains, ips []entry) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	newEntry := func(e string, exp time.Time) entry {
+		if exp.IsZero() {
+			return entry{Entry: e}
+		}
+		return entry{Entry: e, ExpiresAt: &exp}
+	}
+	domains = make([]entry, 0, len(s.domainExp))
+	for d, exp := range s.domainExp {
+		if exp.IsZero() || now.Before(exp) {
+			domains = append(domains, newEntry(d, exp))
+		}
+	}
+	ips = make([]entry, 0, len(s.ipExp))
+	for p, exp := range s.ipExp {
+		if exp.IsZero() || now.Before(exp) {
+			ips = append(ips, newEntry(p.String(), exp))
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Entry < domains[j].Entry })
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Entry < ips[j].Entry })
+	return domains, ips
+}
+
+func (s *set) matchDomain(name string, now time.Time) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	exp, ok := s.domains.Match(name)
+	return ok && (exp.IsZero() || now.Before(exp))
+}
+
+func (s *set) matchIP(addr netip.Addr, now time.Time) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	matched, _ := s.ipList.Match(addr)
+	if !matched || s.nextExpire.IsZero() || now.Before(s.nextExpire) {
+		return matched
+	}
+	// Some entries have expired but are not removed yet.
+	for p, exp := range s.ipExp {
+		if p.Contains(addr) && (exp.IsZero() || now.Before(exp)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *set) domainMatcher() domain.Matcher[struct{}] {
+	return setDomainMatcher{s: s}
+}
+
+func (s *set) ipMatcher() netlist.Matcher {
+	return setIPMatcher{s: s}
+}
+
+type setDomainMatcher struct {
+	s *set
+}
+
+func (m setDomainMatcher) Match(name string) (struct{}, bool) {
+	return struct{}{}, m.s.matchDomain(name, time.Now())
+}
+
+func (m setDomainMatcher) Len() int {
+	m.s.m.RLock()
+	defer m.s.m.RUnlock()
+	return len(m.s.domainExp)
+}
+
+type setIPMatcher struct {
+	s *set
+}
+
+func (m setIPMatcher) Match(addr netip.Addr) (bool, error) {
+	return m.s.matchIP(addr, time.Now()), nil
+}
+
+func (m setIPMatcher) Len() int {
+	m.s.m.RLock()
+	defer m.s.m.RUnlock()
+	return len(m.s.ipExp)
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsRune(s, '/') {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -21,7 +21,10 @@ package querymatcher
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/IrineSistiana/mosdns/v4/coremain"
 	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
@@ -42,13 +45,13 @@ func init() {
 	coremain.RegNewPersetPluginFunc(
 		"_qtype_A_AAAA",
 		func(bp *coremain.BP) (coremain.Plugin, error) {
-			return newQueryMatcher(bp, &Args{QType: []int{int(dns.TypeA), int(dns.TypeAAAA)}})
+			return newQueryMatcher(bp, &Args{QType: []string{"A", "AAAA"}})
 		},
 	)
 	coremain.RegNewPersetPluginFunc(
 		"_qtype_AAAA",
 		func(bp *coremain.BP) (coremain.Plugin, error) {
-			return newQueryMatcher(bp, &Args{QType: []int{int(dns.TypeAAAA)}})
+			return newQueryMatcher(bp, &Args{QType: []string{"AAAA"}})
 		},
 	)
 
@@ -66,8 +69,18 @@ type Args struct {
 	ClientIP []string `yaml:"client_ip"`
 	ECS      []string `yaml:"ecs"`
 	Domain   []string `yaml:"domain"`
-	QType    []int    `yaml:"qtype"`
-	QClass   []int    `yaml:"qclass"`
+
+	// QType and QClass are numbers or names, e.g. "28", "AAAA", "TYPE65",
+	// "IN". Ranges "65-99" are supported. Rules prefixed with "!" exclude
+	// values, e.g. ["!ANY", "!HTTPS"] matches all types except ANY and
+	// HTTPS.
+	QType  []string `yaml:"qtype"`
+	QClass []string `yaml:"qclass"`
+
+	// OriginalDst matches the original destination ip of requests from
+	// tproxy server listeners.
+	OriginalDst []string `yaml:"original_dst"`
+
 	// TODO: Add PTR matcher.
 }
 
@@ -98,7 +111,7 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		}
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientIPMatcher(l))
 		m.closer = append(m.closer, l)
-		bp.L().Info("client ip matcher loaded", zap.Int("length", l.Len()))
+		bp.L().Info("client ip matcher loaded", zap.Int("length", l.Len()), zap.Int("bytes", l.MemSize()))
 	}
 	if len(args.ECS) > 0 {
 		l, err := netlist.BatchLoadProvider(args.ECS, bp.M().GetDataManager())
@@ -107,7 +120,16 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		}
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientECSMatcher(l))
 		m.closer = append(m.closer, l)
-		bp.L().Info("ecs ip matcher loaded", zap.Int("length", l.Len()))
+		bp.L().Info("ecs ip matcher loaded", zap.Int("length", l.Len()), zap.Int("bytes", l.MemSize()))
+	}
+	if len(args.OriginalDst) > 0 {
+		l, err := netlist.BatchLoadProvider(args.OriginalDst, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewOriginalDstMatcher(l))
+		m.closer = append(m.closer, l)
+		bp.L().Info("original destination matcher loaded", zap.Int("length", l.Len()), zap.Int("bytes", l.MemSize()))
 	}
 	if len(args.Domain) > 0 {
 		mg, err := domain.BatchLoadDomainProvider(
@@ -122,17 +144,49 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		bp.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
 	}
 	if len(args.QType) > 0 {
-		elemMatcher := elem.NewIntMatcher(args.QType)
+		elemMatcher, err := elem.ParseIntMatcher(args.QType, parseQType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid qtype, %w", err)
+		}
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQTypeMatcher(elemMatcher))
 	}
 	if len(args.QClass) > 0 {
-		elemMatcher := elem.NewIntMatcher(args.QClass)
+		elemMatcher, err := elem.ParseIntMatcher(args.QClass, parseQClass)
+		if err != nil {
+			return nil, fmt.Errorf("invalid qclass, %w", err)
+		}
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQClassMatcher(elemMatcher))
 	}
 
 	return m, nil
 }
 
+// parseQType parses a type number, a type name or "TYPEnnn".
+func parseQType(s string) (int, error) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return int(t), nil
+	}
+	return parseUint16(strings.TrimPrefix(s, "TYPE"))
+}
+
+// parseQClass parses a class number, a class name or "CLASSnnn".
+func parseQClass(s string) (int, error) {
+	s = strings.ToUpper(s)
+	if c, ok := dns.StringToClass[s]; ok {
+		return int(c), nil
+	}
+	return parseUint16(strings.TrimPrefix(s, "CLASS"))
+}
+
+func parseUint16(s string) (int, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+	return int(n), nil
+}
+
 var _ coremain.MatcherPlugin = (*queryMatcher)(nil)
 
 type queryIsEDNS0 struct {
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package querymatcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_queryMatcher_QType(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	tests := []struct {
+		name    string
+		args    *Args
+		qtype   uint16
+		qclass  uint16
+		want    bool
+		wantErr bool
+	}{
+		{"number", &Args{QType: []string{"28"}}, dns.TypeAAAA, dns.ClassINET, true, false},
+		{"name", &Args{QType: []string{"aaaa"}}, dns.TypeAAAA, dns.ClassINET, true, false},
+		{"generic name", &Args{QType: []string{"TYPE65"}}, dns.TypeHTTPS, dns.ClassINET, true, false},
+		{"range", &Args{QType: []string{"64-65"}}, dns.TypeSVCB, dns.ClassINET, true, false},
+		{"range not matched", &Args{QType: []string{"64-65"}}, dns.TypeA, dns.ClassINET, false, false},
+		{"negation", &Args{QType: []string{"!ANY", "!HTTPS"}}, dns.TypeA, dns.ClassINET, true, false},
+		{"negation not matched", &Args{QType: []string{"!ANY", "!HTTPS"}}, dns.TypeANY, dns.ClassINET, false, false},
+		{"qclass", &Args{QClass: []string{"CH"}}, dns.TypeTXT, dns.ClassCHAOS, true, false},
+		{"qclass not matched", &Args{QClass: []string{"!IN"}}, dns.TypeA, dns.ClassINET, false, false},
+		{"invalid name", &Args{QType: []string{"NOPE"}}, 0, 0, false, true},
+		{"invalid number", &Args{QType: []string{"65536"}}, 0, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm, err := newQueryMatcher(coremain.NewBP("test", PluginType, nil, m), tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newQueryMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", tt.qtype)
+			q.Question[0].Qclass = tt.qclass
+			got, err := qm.Match(context.Background(), query_context.NewContext(q, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
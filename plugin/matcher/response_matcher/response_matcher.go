@@ -103,7 +103,7 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 		}
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewAAAAAIPMatcher(l))
 		m.closer = append(m.closer, l)
-		bp.L().Info("ip matcher loaded", zap.Int("length", l.Len()))
+		bp.L().Info("ip matcher loaded", zap.Int("length", l.Len()), zap.Int("bytes", l.MemSize()))
 	}
 
 	return m, nil
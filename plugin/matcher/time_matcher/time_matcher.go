@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package timematcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v4/pkg/time_window"
+	"sync/atomic"
+	"time"
+)
+
+const PluginType = "time_matcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.MatcherPlugin = (*timeMatcher)(nil)
+
+// Args of the time_matcher plugin. It matches if the current time is in
+// any of the windows.
+type Args struct {
+	// Windows are weekly time windows, e.g. "mon-fri 20:00-07:00",
+	// "sat,sun 09:00-12:00" or "22:00-06:00".
+	Windows []string `yaml:"windows"`
+
+	Cron []CronArgs `yaml:"cron"`
+
+	// Timezone of the windows, e.g. "Asia/Shanghai". Default is the local
+	// timezone.
+	Timezone string `yaml:"timezone"`
+
+	// Invert makes the matcher match if the current time is out of all
+	// windows.
+	Invert bool `yaml:"invert"`
+}
+
+// CronArgs is a cron window. It starts at minutes that match the cron
+// spec, e.g. "0 20 * * 1-5" for 20:00 on weekdays, and lasts for Duration.
+type CronArgs struct {
+	Cron     string `yaml:"cron"`
+	Duration uint   `yaml:"duration"` // sec, required, at most 7 days.
+}
+
+type timeMatcher struct {
+	*coremain.BP
+	windows []time_window.Matcher
+	loc     *time.Location
+	invert  bool
+
+	now func() time.Time
+
+	// cache is the result of the last checked minute, in the format of
+	// unix minute << 1 | matched.
+	cache int64
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newTimeMatcher(bp, args.(*Args))
+}
+
+func newTimeMatcher(bp *coremain.BP, args *Args) (*timeMatcher, error) {
+	m := &timeMatcher{BP: bp, loc: time.Local, invert: args.Invert, now: time.Now, cache: -1}
+	if len(args.Timezone) > 0 {
+		loc, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone, %w", err)
+		}
+		m.loc = loc
+	}
+	for _, s := range args.Windows {
+		w, err := time_window.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		m.windows = append(m.windows, w)
+	}
+	for _, c := range args.Cron {
+		w, err := time_window.ParseCron(c.Cron, time.Duration(c.Duration)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron window %s, %w", c.Cron, err)
+		}
+		m.windows = append(m.windows, w)
+	}
+	if len(m.windows) == 0 {
+		return nil, errors.New("no window is configured")
+	}
+	return m, nil
+}
+
+func (m *timeMatcher) Match(_ context.Context, _ *query_context.Context) (bool, error) {
+	return m.match(m.now()) != m.invert, nil
+}
+
+// match reports whether t is in any window. Windows have a resolution of
+// minute, so the result is cached for the minute.
+func (m *timeMatcher) match(t time.Time) bool {
+	minute := t.Unix() / 60
+	if c := atomic.LoadInt64(&m.cache); c >= 0 && c>>1 == minute {
+		return c&1 == 1
+	}
+	t = t.In(m.loc)
+	matched := false
+	for _, w := range m.windows {
+		if w.Match(t) {
+			matched = true
+			break
+		}
+	}
+	c := minute << 1
+	if matched {
+		c |= 1
+	}
+	atomic.StoreInt64(&m.cache, c)
+	return matched
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package timematcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func Test_timeMatcher(t *testing.T) {
+	bp := coremain.NewBP("test", PluginType, nil, nil)
+	m, err := newTimeMatcher(bp, &Args{
+		Windows:  []string{"mon-fri 20:00-07:00"},
+		Cron:     []CronArgs{{Cron: "0 12 * * 0", Duration: 3600}},
+		Timezone: "Asia/Shanghai",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	// 2022-11-07 is a Monday. Asia/Shanghai is UTC+8.
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2022, 11, 7, 12, 0, 0, 0, time.UTC), true}, // 20:00 monday
+		{time.Date(2022, 11, 7, 11, 59, 0, 0, time.UTC), false},
+		{time.Date(2022, 11, 6, 4, 30, 0, 0, time.UTC), true}, // 12:30 sunday
+		{time.Date(2022, 11, 6, 5, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		m.now = func() time.Time { return tt.t }
+		got, err := m.Match(context.Background(), qCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Match() at %s = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	m.invert = true
+	m.now = func() time.Time { return tests[0].t }
+	if got, _ := m.Match(context.Background(), qCtx); got {
+		t.Fatal("inverted matcher should not match")
+	}
+
+	for _, args := range []*Args{
+		{},
+		{Windows: []string{"mon"}},
+		{Windows: []string{"10:00-11:00"}, Timezone: "Mars/Olympus"},
+		{Cron: []CronArgs{{Cron: "0 12 * * *"}}},
+	} {
+		if _, err := newTimeMatcher(bp, args); err == nil {
+			t.Errorf("args %+v should be rejected", args)
+		}
+	}
+}
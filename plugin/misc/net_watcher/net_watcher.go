@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package net_watcher
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/net_watcher"
+	"go.uber.org/zap"
+	"time"
+)
+
+const PluginType = "net_watcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.Plugin = (*netWatcher)(nil)
+
+type Args struct {
+	Interval      int      `yaml:"interval"`       // (sec) polling interval, default is 5.
+	FlushCache    []string `yaml:"flush_cache"`    // tags of caches that will be flushed.
+	StaleCache    []string `yaml:"stale_cache"`    // tags of caches that will be marked as stale.
+	ResetUpstream []string `yaml:"reset_upstream"` // tags of forwarders whose connections will be reset.
+}
+
+// Flusher is implemented by plugins that can drop all their cached data.
+type Flusher interface {
+	Flush()
+}
+
+// StaleMarker is implemented by plugins that can mark all their cached data
+// as expired.
+type StaleMarker interface {
+	MarkStale()
+}
+
+// ConnResetter is implemented by plugins that can reset their upstream
+// connections.
+type ConnResetter interface {
+	ResetConnections()
+}
+
+type netWatcher struct {
+	*coremain.BP
+
+	flushers      []Flusher
+	staleMarkers  []StaleMarker
+	connResetters []ConnResetter
+	w             *net_watcher.Watcher
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newNetWatcher(bp, args.(*Args))
+}
+
+func newNetWatcher(bp *coremain.BP, args *Args) (*netWatcher, error) {
+	nw := &netWatcher{BP: bp}
+	for _, tag := range args.FlushCache {
+		f, ok := bp.M().GetPlugin(tag).(Flusher)
+		if !ok {
+			return nil, fmt.Errorf("plugin %s is not found or cannot be flushed", tag)
+		}
+		nw.flushers = append(nw.flushers, f)
+	}
+	for _, tag := range args.StaleCache {
+		s, ok := bp.M().GetPlugin(tag).(StaleMarker)
+		if !ok {
+			return nil, fmt.Errorf("plugin %s is not found or cannot be marked as stale", tag)
+		}
+		nw.staleMarkers = append(nw.staleMarkers, s)
+	}
+	for _, tag := range args.ResetUpstream {
+		r, ok := bp.M().GetPlugin(tag).(ConnResetter)
+		if !ok {
+			return nil, fmt.Errorf("plugin %s is not found or cannot reset connections", tag)
+		}
+		nw.connResetters = append(nw.connResetters, r)
+	}
+
+	w, err := net_watcher.NewWatcher(net_watcher.Opts{
+		Interval: time.Duration(args.Interval) * time.Second,
+		OnChange: nw.onChange,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start network watcher, %w", err)
+	}
+	nw.w = w
+	return nw, nil
+}
+
+func (nw *netWatcher) onChange(old, new net_watcher.Snapshot) {
+	nw.L().Info("network changed", zap.Stringer("old", old), zap.Stringer("new", new))
+	for _, r := range nw.connResetters {
+		r.ResetConnections()
+	}
+	for _, f := range nw.flushers {
+		f.Flush()
+	}
+	for _, s := range nw.staleMarkers {
+		s.MarkStale()
+	}
+}
+
+func (nw *netWatcher) Close() error {
+	return nw.w.Close()
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package warmup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PluginType = "warmup"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.Plugin = (*warmup)(nil)
+
+const (
+	defaultConcurrency  = 4
+	defaultQueryTimeout = time.Second * 5
+)
+
+// Args of warmup. Domains in Files are resolved through Entry, so the
+// responses populate caches and ipset/nftset like normal queries.
+type Args struct {
+	Entry string   `yaml:"entry"` // required, tag of the executable plugin.
+	Files []string `yaml:"files"` // required, domain lists. Re-read on each round.
+
+	QTypes      []uint16 `yaml:"qtypes"`      // Default is A and AAAA.
+	StartDelay  int      `yaml:"start_delay"` // (sec) delay of the first round.
+	Interval    int      `yaml:"interval"`    // (sec) interval of rounds. Default is 0, which runs only once.
+	Concurrency int      `yaml:"concurrency"` // Default is 4.
+	MaxDomains  int      `yaml:"max_domains"` // Default is 0, no limit.
+}
+
+type warmup struct {
+	*coremain.BP
+	args  *Args
+	entry executable_seq.Executable
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newWarmup(bp, args.(*Args))
+}
+
+func newWarmup(bp *coremain.BP, args *Args) (*warmup, error) {
+	if len(args.Files) == 0 {
+		return nil, errors.New("no domain file is configured")
+	}
+	entry := bp.M().GetExecutables()[args.Entry]
+	if entry == nil {
+		return nil, fmt.Errorf("cannot find entry %s", args.Entry)
+	}
+	if len(args.QTypes) == 0 {
+		args.QTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+	if args.Concurrency <= 0 {
+		args.Concurrency = defaultConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &warmup{BP: bp, args: args, entry: entry, cancel: cancel}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.loop(ctx)
+	}()
+	return w, nil
+}
+
+func (w *warmup) loop(ctx context.Context) {
+	delay := time.Duration(w.args.StartDelay) * time.Second
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		w.round(ctx)
+		if w.args.Interval <= 0 {
+			return
+		}
+		delay = time.Duration(w.args.Interval) * time.Second
+	}
+}
+
+// round resolves all domains in the files once.
+func (w *warmup) round(ctx context.Context) {
+	start := time.Now()
+	var domains []string
+	seen := make(map[string]struct{})
+	for _, f := range w.args.Files {
+		ds, err := loadDomainFile(f)
+		if err != nil {
+			w.L().Warn("failed to load domain file", zap.String("file", f), zap.Error(err))
+			continue
+		}
+		for _, d := range ds {
+			if _, dup := seen[d]; dup {
+				continue
+			}
+			seen[d] = struct{}{}
+			domains = append(domains, d)
+		}
+	}
+	if n := w.args.MaxDomains; n > 0 && len(domains) > n {
+		domains = domains[:n]
+	}
+
+	var failed int64
+	sem := make(chan struct{}, w.args.Concurrency)
+	wg := new(sync.WaitGroup)
+	for _, d := range domains {
+		for _, qt := range w.args.QTypes {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func(d string, qt uint16) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if err := w.resolve(ctx, d, qt); err != nil {
+					atomic.AddInt64(&failed, 1)
+					w.L().Debug("warmup query failed", zap.String("domain", d), zap.Uint16("qtype", qt), zap.Error(err))
+				}
+			}(d, qt)
+		}
+	}
+	wg.Wait()
+	w.L().Info(
+		"warmup finished",
+		zap.Int("domains", len(domains)),
+		zap.Int64("failed", failed),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+}
+
+func (w *warmup) resolve(ctx context.Context, domain string, qtype uint16) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultQueryTimeout)
+	defer cancel()
+	q := new(dns.Msg)
+	q.SetQuestion(domain, qtype)
+	qCtx := query_context.NewContext(q, nil)
+	if err := w.entry.Exec(ctx, qCtx, nil); err != nil {
+		return err
+	}
+	if qCtx.R() == nil {
+		return errors.New("no response")
+	}
+	return nil
+}
+
+func (w *warmup) Close() error {
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+func loadDomainFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDomains(f)
+}
+
+// parseDomains reads domains from r. Each line can be a domain, or text
+// that contains http(s) urls, e.g. a url list or exported bookmarks, in
+// which case the hosts of the urls are used. Empty lines and lines
+// starting with "#" are ignored.
+func parseDomains(r io.Reader) ([]string, error) {
+	var ds []string
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if urls := urlRegexp.FindAllString(line, -1); len(urls) > 0 {
+			for _, us := range urls {
+				if u, err := url.Parse(us); err == nil {
+					ds = appendDomain(ds, u.Hostname())
+				}
+			}
+			continue
+		}
+		ds = appendDomain(ds, strings.Fields(line)[0])
+	}
+	return ds, s.Err()
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+(\.[a-zA-Z0-9_-]+)*\.?$`)
+
+// appendDomain appends d to ds if d is a valid host name but not an ip.
+func appendDomain(ds []string, d string) []string {
+	if !hostnameRegexp.MatchString(d) {
+		return ds
+	}
+	if _, err := netip.ParseAddr(d); err == nil {
+		return ds
+	}
+	return append(ds, dns.Fqdn(strings.ToLower(d)))
+}
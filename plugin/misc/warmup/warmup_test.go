@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package warmup
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v4/coremain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v4/pkg/query_context"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_parseDomains(t *testing.T) {
+	in := `
+# comment
+example.com
+Example.ORG extra fields
+<DT><A HREF="https://news.example/path?q=1" ADD_DATE="1">News</A>
+http://a.example:8080/ and https://b.example
+192.0.2.1
+not_a_domain!
+`
+	got, err := parseDomains(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"example.com.", "example.org.", "news.example.", "a.example.", "b.example."}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+type recordEntry struct {
+	*coremain.BP
+	m    sync.Mutex
+	qs   []string
+	done chan struct{}
+	n    int
+}
+
+func (e *recordEntry) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	q := qCtx.Q().Question[0]
+	e.qs = append(e.qs, q.Name+" "+dns.TypeToString[q.Qtype])
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	if len(e.qs) == e.n {
+		close(e.done)
+	}
+	return nil
+}
+
+func Test_warmup(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "domains.txt")
+	if err := os.WriteFile(f, []byte("a.example\nb.example\na.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &recordEntry{BP: coremain.NewBP("entry", "test", nil, nil), done: make(chan struct{}), n: 4}
+	m := coremain.NewTestMosdnsWithPlugins(map[string]coremain.Plugin{"entry": e})
+	w, err := newWarmup(coremain.NewBP("warmup", PluginType, nil, m), &Args{Entry: "entry", Files: []string{f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	select {
+	case <-e.done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("warmup queries are not sent")
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	want := map[string]bool{"a.example. A": true, "a.example. AAAA": true, "b.example. A": true, "b.example. AAAA": true}
+	for _, q := range e.qs {
+		if !want[q] {
+			t.Fatalf("unexpected query %s", q)
+		}
+		delete(want, q)
+	}
+	if len(want) != 0 {
+		t.Fatalf("missing queries %v", want)
+	}
+}
+
+func Test_newWarmup_missingEntry(t *testing.T) {
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	if _, err := newWarmup(coremain.NewBP("warmup", PluginType, nil, m), &Args{Entry: "entry", Files: []string{"f"}}); err == nil {
+		t.Fatal("want an error for a missing entry")
+	}
+}
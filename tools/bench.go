@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/perf_stats"
+	"github.com/IrineSistiana/mosdns/v4/pkg/upstream"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchOpts struct {
+	server      string
+	dataFile    string
+	concurrent  int
+	timeLimit   time.Duration
+	runs        int
+	timeout     time.Duration
+	format      string
+	insecureTLS bool
+}
+
+func newBenchCmd() *cobra.Command {
+	opts := new(benchOpts)
+	c := &cobra.Command{
+		Use:   "bench -s server [-d datafile] [flags]",
+		Args:  cobra.NoArgs,
+		Short: "Send queries from a dnsperf format data file to a server and report the statistics.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runBench(opts, os.Stdout); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	fs := c.Flags()
+	fs.StringVarP(&opts.server, "server", "s", "", "server address, e.g. 8.8.8.8, tls://dns.google, https://dns.google/dns-query")
+	fs.StringVarP(&opts.dataFile, "data", "d", "", "data file, one \"name [type]\" per line, default is stdin")
+	fs.IntVarP(&opts.concurrent, "concurrent", "c", 64, "maximum number of outstanding queries")
+	fs.DurationVarP(&opts.timeLimit, "limit", "l", 0, "run for at most this duration")
+	fs.IntVarP(&opts.runs, "runs", "n", 0, "run through the data file at most this many times, default is 1 if --limit is not set, or unlimited")
+	fs.DurationVarP(&opts.timeout, "timeout", "t", time.Second*5, "query timeout, queries without a response in time are lost")
+	fs.StringVarP(&opts.format, "format", "f", "dnsperf", "output format, can be \"dnsperf\" or \"resperf\"")
+	fs.BoolVar(&opts.insecureTLS, "insecure", false, "skip tls certificate verification")
+	c.MarkFlagRequired("server")
+	c.MarkFlagFilename("data")
+	return c
+}
+
+type benchQuery struct {
+	name  string
+	qtype uint16
+}
+
+// parseBenchData parses dnsperf data file format.
+// Each line contains a domain name and an optional query type (default is A).
+// Empty lines and lines starting with ";" or "#" are ignored.
+func parseBenchData(r io.Reader) ([]benchQuery, error) {
+	var queries []benchQuery
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		q := benchQuery{name: dns.Fqdn(fields[0]), qtype: dns.TypeA}
+		if len(fields) > 1 {
+			t, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid query type %s", line, fields[1])
+			}
+			q.qtype = t
+		}
+		queries = append(queries, q)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("no query in data file")
+	}
+	return queries, nil
+}
+
+func runBench(opts *benchOpts, out io.Writer) error {
+	if opts.format != "dnsperf" && opts.format != "resperf" {
+		return fmt.Errorf("invalid output format %s", opts.format)
+	}
+
+	var r io.Reader = os.Stdin
+	if len(opts.dataFile) > 0 {
+		f, err := os.Open(opts.dataFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	queries, err := parseBenchData(r)
+	if err != nil {
+		return fmt.Errorf("failed to read data file, %w", err)
+	}
+
+	u, err := upstream.NewUpstream(opts.server, &upstream.Opt{
+		MaxConns:       opts.concurrent,
+		EnablePipeline: true,
+		TLSConfig:      &tls.Config{InsecureSkipVerify: opts.insecureTLS},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to init server, %w", err)
+	}
+	defer u.Close()
+
+	total := uint64(opts.runs) * uint64(len(queries))
+	if opts.runs <= 0 {
+		total = 0 // unlimited
+		if opts.timeLimit <= 0 {
+			total = uint64(len(queries))
+		}
+	}
+	var deadline time.Time
+	if opts.timeLimit > 0 {
+		deadline = time.Now().Add(opts.timeLimit)
+	}
+
+	concurrent := opts.concurrent
+	if concurrent <= 0 {
+		concurrent = 1
+	}
+
+	stats := perf_stats.NewStats()
+	var next uint64
+	wg := new(sync.WaitGroup)
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddUint64(&next, 1) - 1
+				if total > 0 && i >= total {
+					return
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+
+				bq := queries[i%uint64(len(queries))]
+				q := new(dns.Msg)
+				q.SetQuestion(bq.name, bq.qtype)
+				stats.Sent(q.Len())
+
+				start := time.Now()
+				ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+				resp, err := u.ExchangeContext(ctx, q)
+				cancel()
+				if err != nil {
+					mlog.L().Debug("query failed", zap.Error(err))
+					continue
+				}
+				stats.Completed(resp.Rcode, resp.Len(), time.Since(start))
+			}
+		}()
+	}
+	wg.Wait()
+	stats.Stop()
+
+	sum := stats.Summary()
+	if opts.format == "resperf" {
+		return sum.WriteResperf(out)
+	}
+	return sum.WriteDnsperf(out)
+}
@@ -52,4 +52,13 @@ func init() {
 	}
 	configCmd.AddCommand(newGenCmd(), newConvCmd())
 	coremain.AddSubCmd(configCmd)
+
+	rulesCmd := &cobra.Command{
+		Use:   "rules",
+		Short: "Tools that can lint/convert/test domain and ip rule files.",
+	}
+	rulesCmd.AddCommand(newRulesLintCmd(), newRulesConvertCmd(), newRulesTestCmd())
+	coremain.AddSubCmd(rulesCmd)
+
+	coremain.AddSubCmd(newBenchCmd())
 }
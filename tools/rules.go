@@ -0,0 +1,599 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v4/mlog"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v4/pkg/matcher/v2data"
+	"github.com/IrineSistiana/mosdns/v4/pkg/utils"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rule file formats.
+const (
+	formatText    = "text"
+	formatDnsmasq = "dnsmasq"
+	formatHosts   = "hosts"
+	formatDat     = "dat"
+)
+
+// domainRule is a rule of a domain list, in the mosdns text format.
+type domainRule struct {
+	typ   string // domain.MatcherFull, MatcherDomain, etc.
+	value string
+	line  int // line number in the source file, 0 for dat files.
+}
+
+func (r domainRule) String() string {
+	if r.typ == domain.MatcherDomain {
+		return r.value
+	}
+	return r.typ + ":" + r.value
+}
+
+func newRulesLintCmd() *cobra.Command {
+	var typ, format string
+	c := &cobra.Command{
+		Use:   "lint [-t domain|ip] [-f format] file[:tags]...",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Validate rule files.",
+		Run: func(cmd *cobra.Command, args []string) {
+			failed := false
+			for _, in := range args {
+				n, errs := lintRuleFile(typ, format, in)
+				for _, err := range errs {
+					fmt.Printf("%s: %v\n", in, err)
+				}
+				if len(errs) > 0 {
+					failed = true
+				}
+				fmt.Printf("%s: %d rules, %d problems\n", in, n, len(errs))
+			}
+			if failed {
+				mlog.S().Fatal("lint failed")
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&typ, "type", "t", "domain", "rule type, domain or ip")
+	c.Flags().StringVarP(&format, "format", "f", "", "file format, text, dnsmasq, hosts or dat. Default is dat for .dat files, otherwise text")
+	return c
+}
+
+func newRulesConvertCmd() *cobra.Command {
+	var from, to, out, tag, server, ip string
+	c := &cobra.Command{
+		Use:   "convert -t format [-f format] [-o output] file[:tags]",
+		Args:  cobra.ExactArgs(1),
+		Short: "Convert domain rule files between text, dnsmasq, hosts and dat formats.",
+		Long: "Convert domain rule files between text, dnsmasq, hosts and dat formats.\n" +
+			"Rules that cannot be represented in the output format (e.g. keyword rules in hosts) are skipped with a warning.",
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := convertOpts{to: to, tag: tag, server: server, ip: ip}
+			if err := convertRuleFile(from, args[0], out, opts); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&from, "from", "f", "", "input format. Default is dat for .dat files, otherwise text")
+	c.Flags().StringVarP(&to, "to", "t", formatText, "output format")
+	c.Flags().StringVarP(&out, "out", "o", "", "output file. Default is stdout")
+	c.Flags().StringVar(&tag, "tag", "custom", "tag of the dat output")
+	c.Flags().StringVar(&server, "server", "127.0.0.1", "upstream of the dnsmasq output")
+	c.Flags().StringVar(&ip, "ip", "0.0.0.0", "address of the hosts output")
+	return c
+}
+
+func newRulesTestCmd() *cobra.Command {
+	var typ, format string
+	c := &cobra.Command{
+		Use:   "test [-t domain|ip] [-f format] file[:tags] domain_or_ip...",
+		Args:  cobra.MinimumNArgs(2),
+		Short: "Test whether domains or IPs match a rule file, as mosdns does at runtime.",
+		Run: func(cmd *cobra.Command, args []string) {
+			match, err := loadRuleMatcher(typ, format, args[0])
+			if err != nil {
+				mlog.S().Fatal(err)
+			}
+			if err := printMatches(os.Stdout, match, args[1:]); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&typ, "type", "t", "domain", "rule type, domain or ip")
+	c.Flags().StringVarP(&format, "format", "f", "", "file format, text, dnsmasq, hosts or dat. Default is dat for .dat files, otherwise text")
+	return c
+}
+
+// readRuleFile reads in ("file[:tags]") and detects its format if
+// format is empty.
+func readRuleFile(format, in string) (b []byte, f string, tags string, err error) {
+	file := in
+	if strings.HasSuffix(strings.ToLower(strings.SplitN(in, ":", 2)[0]), ".dat") {
+		file, tags, _ = strings.Cut(in, ":")
+		if len(format) == 0 {
+			format = formatDat
+		}
+	}
+	if len(format) == 0 {
+		format = formatText
+	}
+	switch format {
+	case formatText, formatDnsmasq, formatHosts, formatDat:
+	default:
+		return nil, "", "", fmt.Errorf("unknown format %s", format)
+	}
+	b, err = os.ReadFile(file)
+	return b, format, tags, err
+}
+
+func lintRuleFile(typ, format, in string) (int, []error) {
+	b, format, tags, err := readRuleFile(format, in)
+	if err != nil {
+		return 0, []error{err}
+	}
+	switch typ {
+	case "domain":
+		rules, errs := parseDomainRules(b, format, tags)
+		return len(rules), append(errs, lintDomainRules(rules)...)
+	case "ip":
+		return lintIPRules(b, format, tags)
+	default:
+		return 0, []error{fmt.Errorf("unknown rule type %s", typ)}
+	}
+}
+
+// lintDomainRules loads rules into the runtime matcher and reports
+// invalid and duplicated rules.
+func lintDomainRules(rules []domainRule) []error {
+	var errs []error
+	m := domain.NewDomainMixMatcher()
+	seen := make(map[string]int)
+	for _, r := range rules {
+		if err := m.Add(r.String(), struct{}{}); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", r.line, err))
+			continue
+		}
+		if (r.typ == domain.MatcherFull || r.typ == domain.MatcherDomain) && !isDomainName(r.value) {
+			errs = append(errs, fmt.Errorf("line %d: %s is not a valid domain", r.line, r.value))
+		}
+		k := r.typ + ":" + domain.NormalizeDomain(r.value)
+		if line, dup := seen[k]; dup {
+			errs = append(errs, fmt.Errorf("line %d: duplicated rule %s, first seen at line %d", r.line, r, line))
+			continue
+		}
+		seen[k] = r.line
+	}
+	return errs
+}
+
+func isDomainName(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '*') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func lintIPRules(b []byte, format, tags string) (int, []error) {
+	switch format {
+	case formatText:
+		var errs []error
+		l := netlist.NewList()
+		seen := make(map[netip.Prefix]int)
+		err := scanLines(b, func(line int, s string) {
+			s = strings.TrimSpace(utils.RemoveComment(s, " "))
+			if err := netlist.LoadFromText(l, s); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+				return
+			}
+			p := parseIPRule(s)
+			if p != p.Masked() {
+				errs = append(errs, fmt.Errorf("line %d: %s has host bits set", line, s))
+			}
+			if first, dup := seen[p.Masked()]; dup {
+				errs = append(errs, fmt.Errorf("line %d: duplicated rule %s, first seen at line %d", line, s, first))
+				return
+			}
+			seen[p.Masked()] = line
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return l.Len(), errs
+	case formatDat:
+		l, err := netlist.ParseV2rayIPDat(b, tags)
+		if err != nil {
+			return 0, []error{err}
+		}
+		return l.Len(), nil
+	default:
+		return 0, []error{fmt.Errorf("format %s is not supported for ip rules", format)}
+	}
+}
+
+// parseIPRule parses a valid ip rule, see netlist.LoadFromText.
+func parseIPRule(s string) netip.Prefix {
+	if strings.ContainsRune(s, '/') {
+		return netip.MustParsePrefix(s)
+	}
+	addr := netip.MustParseAddr(s)
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// scanLines calls f with every non-empty line of b without comments.
+func scanLines(b []byte, f func(line int, s string)) error {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(utils.RemoveComment(scanner.Text(), "#"))
+		if len(s) == 0 {
+			continue
+		}
+		f(line, s)
+	}
+	return scanner.Err()
+}
+
+// parseDomainRules parses b in format. Lines that cannot be parsed are
+// reported as errors and skipped.
+func parseDomainRules(b []byte, format, tags string) ([]domainRule, []error) {
+	var rules []domainRule
+	var errs []error
+	add := func(line int, typ, value string) {
+		rules = append(rules, domainRule{typ: typ, value: value, line: line})
+	}
+
+	var err error
+	switch format {
+	case formatText:
+		err = scanLines(b, func(line int, s string) {
+			if len(strings.Fields(s)) != 1 {
+				errs = append(errs, fmt.Errorf("line %d: string does not only contain pattern", line))
+				return
+			}
+			typ, value, ok := strings.Cut(s, ":")
+			if !ok {
+				typ, value = domain.MatcherDomain, s
+			}
+			add(line, typ, value)
+		})
+	case formatDnsmasq:
+		// e.g. "server=/a.com/b.com/1.1.1.1", "address=/a.com/0.0.0.0",
+		// "ipset=/a.com/set", "local=/a.com/"
+		err = scanLines(b, func(line int, s string) {
+			_, v, ok := strings.Cut(s, "=")
+			if !ok || !strings.HasPrefix(v, "/") || strings.Count(v, "/") < 2 {
+				errs = append(errs, fmt.Errorf("line %d: not a dnsmasq domain rule", line))
+				return
+			}
+			fs := strings.Split(v, "/")
+			for _, d := range fs[1 : len(fs)-1] {
+				d = strings.TrimPrefix(d, ".")
+				if len(d) == 0 || d == "#" {
+					continue // "//" is for unqualified names, "#" is for all names.
+				}
+				add(line, domain.MatcherDomain, d)
+			}
+		})
+	case formatHosts:
+		err = scanLines(b, func(line int, s string) {
+			fs := strings.Fields(s)
+			if len(fs) < 2 {
+				errs = append(errs, fmt.Errorf("line %d: not a hosts entry", line))
+				return
+			}
+			if _, err := netip.ParseAddr(fs[0]); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+				return
+			}
+			for _, d := range fs[1:] {
+				add(line, domain.MatcherFull, d)
+			}
+		})
+	case formatDat:
+		var gl *v2data.GeoSiteList
+		gl, err = domain.LoadGeoSiteList(b)
+		if err != nil {
+			break
+		}
+		var ds []*v2data.Domain
+		ds, err = filterGeoSite(gl, tags)
+		if err != nil {
+			break
+		}
+		for _, d := range ds {
+			typ, ok := v2TypeToMatcher[d.Type]
+			if !ok {
+				errs = append(errs, fmt.Errorf("invalid v2ray domain type %d", d.Type))
+				continue
+			}
+			add(0, typ, d.Value)
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return rules, errs
+}
+
+var v2TypeToMatcher = map[v2data.Domain_Type]string{
+	v2data.Domain_Plain:  domain.MatcherKeyword,
+	v2data.Domain_Regex:  domain.MatcherRegexp,
+	v2data.Domain_Domain: domain.MatcherDomain,
+	v2data.Domain_Full:   domain.MatcherFull,
+}
+
+// filterGeoSite returns domains of tags in the format of
+// domain.ParseV2Suffix. All domains are returned if tags is empty.
+func filterGeoSite(gl *v2data.GeoSiteList, tags string) ([]*v2data.Domain, error) {
+	entries := make(map[string][]*v2data.Domain)
+	for _, gs := range gl.GetEntry() {
+		tag := strings.ToLower(gs.GetCountryCode())
+		entries[tag] = append(entries[tag], gs.GetDomain()...)
+	}
+	filters := domain.ParseV2Suffix(tags)
+	if len(filters) == 0 {
+		var all []*v2data.Domain
+		for _, gs := range gl.GetEntry() {
+			all = append(all, gs.GetDomain()...)
+		}
+		return all, nil
+	}
+
+	// Excluded filters remove the same rules, so the result is a list.
+	type rule struct {
+		typ   v2data.Domain_Type
+		value string
+	}
+	excluded := make(map[rule]struct{})
+	var ds []*v2data.Domain
+	for _, f := range filters {
+		domains, ok := entries[f.Tag]
+		if !ok {
+			return nil, fmt.Errorf("tag %s does not exist", f.Tag)
+		}
+		for _, d := range domains {
+			if !f.MatchDomain(d) {
+				continue
+			}
+			if f.Exclude {
+				excluded[rule{d.GetType(), d.GetValue()}] = struct{}{}
+				continue
+			}
+			ds = append(ds, d)
+		}
+	}
+	if len(excluded) > 0 {
+		kept := ds[:0]
+		for _, d := range ds {
+			if _, ok := excluded[rule{d.GetType(), d.GetValue()}]; !ok {
+				kept = append(kept, d)
+			}
+		}
+		ds = kept
+	}
+	return ds, nil
+}
+
+type convertOpts struct {
+	to     string
+	tag    string // of dat output
+	server string // of dnsmasq output
+	ip     string // of hosts output
+}
+
+func convertRuleFile(from, in, out string, opts convertOpts) error {
+	b, from, tags, err := readRuleFile(from, in)
+	if err != nil {
+		return err
+	}
+	rules, errs := parseDomainRules(b, from, tags)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to parse %s, %w", in, firstErr(errs))
+	}
+
+	var w io.Writer = os.Stdout
+	if len(out) > 0 {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	} else if opts.to == formatDat {
+		return errors.New("dat output requires an output file")
+	}
+
+	skipped, err := writeDomainRules(w, rules, opts)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		mlog.S().Warnf("%d rules cannot be represented in %s format and were skipped", skipped, opts.to)
+	}
+	if len(out) > 0 {
+		mlog.S().Infof("%d rules saved to %s", len(rules)-skipped, filepath.Clean(out))
+	}
+	return nil
+}
+
+// writeDomainRules writes rules to w in opts.to format. It returns the
+// number of rules that cannot be represented in the format.
+func writeDomainRules(w io.Writer, rules []domainRule, opts convertOpts) (skipped int, err error) {
+	if opts.to == formatDat {
+		gs := &v2data.GeoSite{CountryCode: strings.ToUpper(opts.tag)}
+		for _, r := range rules {
+			for t, typ := range v2TypeToMatcher {
+				if typ == r.typ {
+					gs.Domain = append(gs.Domain, &v2data.Domain{Type: t, Value: r.value})
+				}
+			}
+		}
+		b, err := proto.Marshal(&v2data.GeoSiteList{Entry: []*v2data.GeoSite{gs}})
+		if err != nil {
+			return 0, err
+		}
+		_, err = w.Write(b)
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, r := range rules {
+		var line string
+		switch opts.to {
+		case formatText:
+			line = r.String()
+		case formatDnsmasq:
+			if r.typ != domain.MatcherDomain {
+				skipped++
+				continue
+			}
+			line = fmt.Sprintf("server=/%s/%s", r.value, opts.server)
+		case formatHosts:
+			if r.typ != domain.MatcherFull {
+				skipped++
+				continue
+			}
+			line = opts.ip + " " + r.value
+		default:
+			return 0, fmt.Errorf("unknown format %s", opts.to)
+		}
+		if _, err := bw.WriteString(line + "\n"); err != nil {
+			return 0, err
+		}
+	}
+	return skipped, bw.Flush()
+}
+
+// loadRuleMatcher loads in by the same matchers that plugins use.
+func loadRuleMatcher(typ, format, in string) (func(s string) (bool, error), error) {
+	b, format, tags, err := readRuleFile(format, in)
+	if err != nil {
+		return nil, err
+	}
+	if format == formatDat && len(tags) == 0 {
+		return nil, errors.New("tags of the dat file are required, e.g. geosite.dat:cn")
+	}
+	switch typ {
+	case "domain":
+		var m domain.Matcher[struct{}]
+		switch format {
+		case formatText:
+			m, err = domain.ParseTextDomainFile(b)
+		case formatDat:
+			m, err = domain.ParseV2rayDomainFile(b, domain.ParseV2Suffix(tags)...)
+		default:
+			rules, errs := parseDomainRules(b, format, tags)
+			if len(errs) > 0 {
+				return nil, firstErr(errs)
+			}
+			mm := domain.NewDomainMixMatcher()
+			for _, r := range rules {
+				if err := mm.Add(r.String(), struct{}{}); err != nil {
+					return nil, err
+				}
+			}
+			m = mm
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) (bool, error) {
+			_, ok := m.Match(s)
+			return ok, nil
+		}, nil
+	case "ip":
+		var l *netlist.List
+		switch format {
+		case formatText:
+			l = netlist.NewList()
+			err = netlist.LoadFromReader(l, bytes.NewReader(b))
+			l.Sort()
+		case formatDat:
+			l, err = netlist.ParseV2rayIPDat(b, tags)
+		default:
+			err = fmt.Errorf("format %s is not supported for ip rules", format)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) (bool, error) {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return false, err
+			}
+			return l.Match(addr)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown rule type %s", typ)
+	}
+}
+
+// printMatches writes whether each of ss matches to w, one per line.
+func printMatches(w io.Writer, match func(s string) (bool, error), ss []string) error {
+	for _, s := range ss {
+		ok, err := match(s)
+		if err != nil {
+			return err
+		}
+		result := "not matched"
+		if ok {
+			result = "matched"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", s, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstErr returns the first error of errs, noting how many more there are.
+func firstErr(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("%w (and %d more errors)", errs[0], len(errs)-1)
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDomainRules = `# comment
+example.com
+full:www.example.com
+keyword:google
+regexp:^ad[0-9]+\.
+`
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_lintRuleFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     string
+		format  string
+		content string
+		wantN   int
+		wantErr []string // prefixes of the reported problems, in order.
+	}{
+		{
+			name:    "valid domain",
+			typ:     "domain",
+			content: testDomainRules,
+			wantN:   4,
+		},
+		{
+			name:   "invalid domain",
+			typ:    "domain",
+			format: formatText,
+			content: "example.com\n" +
+				"EXAMPLE.com\n" +
+				"full:bad!name\n" +
+				"regexp:(\n" +
+				"a.com b.com\n",
+			wantN: 4,
+			wantErr: []string{
+				"line 5: string does not only contain pattern",
+				"line 2: duplicated rule EXAMPLE.com, first seen at line 1",
+				"line 3: bad!name is not a valid domain",
+				"line 4: ",
+			},
+		},
+		{
+			name:    "dnsmasq",
+			typ:     "domain",
+			format:  formatDnsmasq,
+			content: "server=/a.com/1.1.1.1\nnot a rule\naddress=/b.com/c.com/0.0.0.0\nserver=/a.com/8.8.8.8\n",
+			wantN:   4,
+			wantErr: []string{
+				"line 2: not a dnsmasq domain rule",
+				"line 4: duplicated rule a.com, first seen at line 1",
+			},
+		},
+		{
+			name:    "hosts",
+			typ:     "domain",
+			format:  formatHosts,
+			content: "1.2.3.4 a.com b.com\nbad a.com\n1.2.3.4\n",
+			wantN:   2,
+			wantErr: []string{
+				"line 2: ",
+				"line 3: not a hosts entry",
+			},
+		},
+		{
+			name:    "valid ip",
+			typ:     "ip",
+			content: "1.0.0.0/24 # comment\n2001:db8::/32\n10.0.0.1\n",
+			wantN:   3,
+		},
+		{
+			name:    "invalid ip",
+			typ:     "ip",
+			content: "1.0.0.0/24\n1.0.0.1/24\nnot-an-ip\n1.0.0.0/24\n",
+			wantN:   3,
+			wantErr: []string{
+				"line 2: 1.0.0.1/24 has host bits set",
+				"line 2: duplicated rule 1.0.0.1/24, first seen at line 1",
+				"line 3: ",
+				"line 4: duplicated rule 1.0.0.0/24, first seen at line 1",
+			},
+		},
+		{
+			name:    "unsupported ip format",
+			typ:     "ip",
+			format:  formatHosts,
+			content: "1.2.3.4 a.com\n",
+			wantErr: []string{"format hosts is not supported for ip rules"},
+		},
+		{
+			name:    "unknown format",
+			typ:     "domain",
+			format:  "yaml",
+			wantErr: []string{"unknown format yaml"},
+		},
+		{
+			name:    "unknown type",
+			typ:     "url",
+			wantErr: []string{"unknown rule type url"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, errs := lintRuleFile(tt.typ, tt.format, writeTestFile(t, "rules.txt", tt.content))
+			if n != tt.wantN {
+				t.Errorf("want %d rules, got %d", tt.wantN, n)
+			}
+			if len(errs) != len(tt.wantErr) {
+				t.Fatalf("want problems %q, got %v", tt.wantErr, errs)
+			}
+			for i, err := range errs {
+				if !strings.HasPrefix(err.Error(), tt.wantErr[i]) {
+					t.Errorf("problem %d: want %q, got %q", i, tt.wantErr[i], err)
+				}
+			}
+		})
+	}
+}
+
+func Test_writeDomainRules_roundTrip(t *testing.T) {
+	rules, errs := parseDomainRules([]byte(testDomainRules), formatText, "")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		to          string
+		wantSkipped int
+		wantOut     string // empty for dat
+		want        []string
+	}{
+		{formatText, 0, "example.com\nfull:www.example.com\nkeyword:google\nregexp:^ad[0-9]+\\.\n", []string{"example.com", "full:www.example.com", "keyword:google", `regexp:^ad[0-9]+\.`}},
+		{formatDat, 0, "", []string{"example.com", "full:www.example.com", "keyword:google", `regexp:^ad[0-9]+\.`}},
+		{formatDnsmasq, 3, "server=/example.com/127.0.0.1\n", []string{"example.com"}},
+		{formatHosts, 3, "0.0.0.0 www.example.com\n", []string{"full:www.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.to, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			skipped, err := writeDomainRules(b, rules, convertOpts{to: tt.to, tag: "custom", server: "127.0.0.1", ip: "0.0.0.0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("want %d skipped rules, got %d", tt.wantSkipped, skipped)
+			}
+			if len(tt.wantOut) > 0 && b.String() != tt.wantOut {
+				t.Errorf("want output %q, got %q", tt.wantOut, b.String())
+			}
+
+			tags := ""
+			if tt.to == formatDat {
+				tags = "custom"
+			}
+			got, errs := parseDomainRules(b.Bytes(), tt.to, tags)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			var gotStrs []string
+			for _, r := range got {
+				gotStrs = append(gotStrs, r.String())
+			}
+			if !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Errorf("want rules %q after round trip, got %q", tt.want, gotStrs)
+			}
+		})
+	}
+}
+
+func Test_loadRuleMatcher(t *testing.T) {
+	text := writeTestFile(t, "rules.txt", testDomainRules)
+	dat := filepath.Join(t.TempDir(), "rules.dat")
+	if err := convertRuleFile("", text, dat, convertOpts{to: formatDat, tag: "custom"}); err != nil {
+		t.Fatal(err)
+	}
+	dnsmasq := writeTestFile(t, "dnsmasq.conf", "server=/example.com/1.1.1.1\n")
+	ip := writeTestFile(t, "ip.txt", "1.0.0.0/24\n2001:db8::/32\n")
+
+	domains := []string{"example.com", "a.example.com", "www.example.com", "www.google.cn", "ad1.example.org", "example.org"}
+	domainOut := "example.com\tmatched\n" +
+		"a.example.com\tmatched\n" +
+		"www.example.com\tmatched\n" +
+		"www.google.cn\tmatched\n" +
+		"ad1.example.org\tmatched\n" +
+		"example.org\tnot matched\n"
+	tests := []struct {
+		name    string
+		typ     string
+		format  string
+		in      string
+		inputs  []string
+		wantOut string
+		wantErr bool
+	}{
+		{name: "text", typ: "domain", in: text, inputs: domains, wantOut: domainOut},
+		{name: "dat", typ: "domain", in: dat + ":custom", inputs: domains, wantOut: domainOut},
+		{name: "dat without tags", typ: "domain", in: dat, wantErr: true},
+		{name: "dnsmasq", typ: "domain", format: formatDnsmasq, in: dnsmasq, inputs: []string{"a.example.com", "google.com"},
+			wantOut: "a.example.com\tmatched\ngoogle.com\tnot matched\n"},
+		{name: "ip", typ: "ip", in: ip, inputs: []string{"1.0.0.5", "1.0.1.1", "2001:db8::1"},
+			wantOut: "1.0.0.5\tmatched\n1.0.1.1\tnot matched\n2001:db8::1\tmatched\n"},
+		{name: "invalid ip", typ: "ip", in: ip, inputs: []string{"example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := loadRuleMatcher(tt.typ, tt.format, tt.in)
+			if err == nil {
+				b := new(bytes.Buffer)
+				err = printMatches(b, match, tt.inputs)
+				if err == nil && b.String() != tt.wantOut {
+					t.Errorf("want output\n%s\ngot\n%s", tt.wantOut, b.String())
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}